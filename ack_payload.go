@@ -0,0 +1,211 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+/*
+An ack's payload, from PingDelegate.AckPayload, goes in the same packet as
+the ack, and one too large for a packet is likely to be dropped along with
+the ack, failing the probe. So the prober says in its ping that it can
+fetch a payload separately, and if the payload won't fit, we send the ack
+with just the payload's length and hold on to the payload for a while. The
+ack counts for the probe as usual, and the prober then fetches the payload
+over a stream and hands it to NotifyPingComplete.
+
+Older probers don't ask, and get the payload in the ack as before, with a
+warning logged since it may not get through.
+*/
+
+// maxHeldAckPayloads is the most payloads we hold for probers to fetch.
+const maxHeldAckPayloads = 64
+
+// ackPayloadReq asks for the payload that was too large to go with an ack.
+type ackPayloadReq struct {
+	Node  string `codec:"Node"` // The prober
+	SeqNo uint32 `codec:"SeqNo"`
+}
+
+// ackPayloadResp answers an ackPayloadReq with either the payload or the
+// reason it can't be had.
+type ackPayloadResp struct {
+	Error   string `codec:"Error,omitempty"`
+	Payload []byte `codec:"Payload,omitempty"`
+}
+
+// ackPayloadKey names a held payload by the prober and its ping.
+type ackPayloadKey struct {
+	node  string
+	seqNo uint32
+}
+
+// heldAckPayload is a payload waiting to be fetched.
+type heldAckPayload struct {
+	payload []byte
+	expires time.Time
+}
+
+// ackPayloads holds payloads too large to go with their acks until the
+// probers fetch them.
+type ackPayloads struct {
+	sync.Mutex
+	held map[ackPayloadKey]heldAckPayload
+}
+
+// hold keeps a payload until it's taken or the ttl is up, returning false
+// if we're already holding too many.
+func (a *ackPayloads) hold(key ackPayloadKey, payload []byte, ttl time.Duration) bool {
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	for k, h := range a.held {
+		if now.After(h.expires) {
+			delete(a.held, k)
+		}
+	}
+	if len(a.held) >= maxHeldAckPayloads {
+		return false
+	}
+	if a.held == nil {
+		a.held = make(map[ackPayloadKey]heldAckPayload)
+	}
+	a.held[key] = heldAckPayload{payload, now.Add(ttl)}
+	return true
+}
+
+// take returns a held payload and forgets it.
+func (a *ackPayloads) take(key ackPayloadKey) ([]byte, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	h, ok := a.held[key]
+	delete(a.held, key)
+	if !ok || time.Now().After(h.expires) {
+		return nil, false
+	}
+	return h.payload, true
+}
+
+// fitAckPayload makes sure an ack answering the given ping fits in a
+// packet to the prober, holding its payload for it to fetch if it doesn't.
+func (m *Memberlist) fitAckPayload(ack *ackResp, p *ping, to net.Addr) {
+	out, err := encode(ackRespMsg, ack)
+	if err != nil {
+		return
+	}
+	avail := m.packetBudget(to) - m.securityOverhead()
+	if out.Len() <= avail {
+		return
+	}
+
+	if !p.FetchPayload {
+		m.logger.Printf("[WARN] memberlist: Ack payload of %d bytes may not fit in a packet to %s, which can't fetch it separately",
+			len(ack.Payload), p.SourceNode)
+		return
+	}
+	key := ackPayloadKey{p.SourceNode, p.SeqNo}
+	if !m.ackPayloads.hold(key, ack.Payload, m.tune().TCPTimeout) {
+		m.logger.Printf("[WARN] memberlist: Too many ack payloads waiting to be fetched, sending %d bytes to %s in the ack",
+			len(ack.Payload), p.SourceNode)
+		return
+	}
+	metrics.IncrCounter([]string{"memberlist", "ack", "payload", "held"}, 1)
+	ack.PayloadLen = uint32(len(ack.Payload))
+	ack.Payload = nil
+}
+
+// notifyPingComplete tells the PingDelegate about a completed probe,
+// first fetching the ack's payload from the node if it was too large to go
+// with the ack.
+func (m *Memberlist) notifyPingComplete(node *Node, seqNo uint32, rtt time.Duration, v ackMessage) {
+	if v.PayloadLen == 0 || len(v.Payload) > 0 {
+		m.config.Ping.NotifyPingComplete(node, rtt, v.Payload)
+		return
+	}
+
+	go func() {
+		defer m.recoverInternal("ack payload")
+
+		addr := net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+		payload, err := m.fetchAckPayload(addr, &ackPayloadReq{Node: m.config.Name, SeqNo: seqNo})
+		if err == nil && uint32(len(payload)) != v.PayloadLen {
+			err = fmt.Errorf("Got %d bytes, expected %d", len(payload), v.PayloadLen)
+		}
+		if err != nil {
+			// The ping still completed, so say so without the payload.
+			m.logger.Printf("[WARN] memberlist: Failed to fetch ack payload from %s: %s", node.Name, err)
+			payload = nil
+		}
+		m.config.Ping.NotifyPingComplete(node, rtt, payload)
+	}()
+}
+
+// fetchAckPayload asks the node listening at the given address for a held
+// ack payload.
+func (m *Memberlist) fetchAckPayload(addr string, req *ackPayloadReq) ([]byte, error) {
+	deadline := time.Now().Add(m.tune().TCPTimeout)
+	conn, err := m.dialTCP(addr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return nil, err
+	}
+
+	out, err := encode(ackPayloadReqMsg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rawSendMsgTCP(conn, out.Bytes()); err != nil {
+		return nil, err
+	}
+
+	msgType, _, dec, err := m.readTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != ackPayloadRespMsg {
+		return nil, fmt.Errorf("Unexpected msgType (%d) from ack payload request %s", msgType, LogConn(conn))
+	}
+
+	var resp ackPayloadResp
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("Ack payload refused: %s", resp.Error)
+	}
+	return resp.Payload, nil
+}
+
+// handleAckPayloadReq answers an ack payload request read from a stream.
+func (m *Memberlist) handleAckPayloadReq(conn net.Conn, dec *codec.Decoder) error {
+	var req ackPayloadReq
+	if err := dec.Decode(&req); err != nil {
+		return err
+	}
+
+	var resp ackPayloadResp
+	if payload, ok := m.ackPayloads.take(ackPayloadKey{req.Node, req.SeqNo}); ok {
+		resp.Payload = payload
+	} else {
+		resp.Error = "payload not found"
+	}
+
+	out, err := encode(ackPayloadRespMsg, &resp)
+	if err != nil {
+		return err
+	}
+	return m.rawSendMsgTCP(conn, out.Bytes())
+}
@@ -0,0 +1,102 @@
+package memberlist
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// payloadPing is a PingDelegate that sends a fixed ack payload and reports
+// the payloads it receives.
+type payloadPing struct {
+	payload []byte
+	ch      chan []byte
+}
+
+func (p *payloadPing) AckPayload() []byte {
+	return p.payload
+}
+
+func (p *payloadPing) NotifyPingComplete(other *Node, rtt time.Duration, payload []byte) {
+	select {
+	case p.ch <- payload:
+	default:
+	}
+}
+
+func TestMemberlist_AckPayloadFetch(t *testing.T) {
+	big := bytes.Repeat([]byte("x"), 2*udpSendBuf)
+
+	c1 := testConfig()
+	c1.Ping = &payloadPing{payload: big}
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	ping := &payloadPing{ch: make(chan []byte, 1)}
+	c2 := testConfig()
+	c2.Ping = ping
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	m2.nodeLock.RLock()
+	n := *m2.nodeMap[c1.Name]
+	m2.nodeLock.RUnlock()
+	m2.probeNode(&n)
+
+	select {
+	case payload := <-ping.ch:
+		if !bytes.Equal(payload, big) {
+			t.Fatalf("bad payload of %d bytes", len(payload))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("should get notified")
+	}
+
+	// The payload is only held until it's fetched.
+	m1.ackPayloads.Lock()
+	held := len(m1.ackPayloads.held)
+	m1.ackPayloads.Unlock()
+	if held != 0 {
+		t.Fatalf("bad: %d", held)
+	}
+}
+
+func TestAckPayloads_Hold(t *testing.T) {
+	var a ackPayloads
+	key := ackPayloadKey{"a", 1}
+	if !a.hold(key, []byte("payload"), time.Minute) {
+		t.Fatalf("should hold")
+	}
+	if payload, ok := a.take(key); !ok || string(payload) != "payload" {
+		t.Fatalf("bad: %q %v", payload, ok)
+	}
+	if _, ok := a.take(key); ok {
+		t.Fatalf("should only be taken once")
+	}
+
+	// Expired payloads can't be taken, and make room for more.
+	if !a.hold(key, []byte("payload"), -time.Second) {
+		t.Fatalf("should hold")
+	}
+	if _, ok := a.take(key); ok {
+		t.Fatalf("should have expired")
+	}
+	for i := 0; i < maxHeldAckPayloads; i++ {
+		if !a.hold(ackPayloadKey{"a", uint32(i)}, nil, time.Minute) {
+			t.Fatalf("should hold %d", i)
+		}
+	}
+	if a.hold(ackPayloadKey{"b", 1}, nil, time.Minute) {
+		t.Fatalf("should be full")
+	}
+}
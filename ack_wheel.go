@@ -0,0 +1,157 @@
+package memberlist
+
+import (
+	"time"
+)
+
+/*
+Every probe, indirect ping and relayed ping registers an ack handler that
+has to be dropped if no ack arrives in time. With a timer per handler, a
+busy node creates and stops thousands of runtime timers a second. Instead,
+handlers are expired by a hashed timing wheel: a ring of slots that a single
+goroutine steps through once per tick, expiring the handlers in each slot it
+reaches. Timeouts longer than a turn of the wheel wait out the extra turns
+in their slot, and the rare timeouts shorter than a tick still get a timer
+of their own.
+
+Acked handlers aren't removed from their slot, which would mean a search.
+They're just removed from the handler map, and the wheel skips any entry
+that's no longer the map's handler for its sequence number. The goroutine
+only runs while handlers are pending, so an idle node doesn't tick.
+*/
+
+const (
+	// ackWheelTick is the resolution of the wheel. A handler expires up to
+	// one tick before its timeout, so that it's never late.
+	ackWheelTick = 5 * time.Millisecond
+
+	// ackWheelSlots is the number of slots, so that one turn of the wheel
+	// covers a little over 2.5 seconds, which is longer than most probe
+	// timeouts.
+	ackWheelSlots = 512
+)
+
+// ackWheel tracks when ack handlers expire. It's guarded by the
+// Memberlist's ackLock.
+type ackWheel struct {
+	slots   [][]*ackHandler
+	pos     int
+	pending int       // Entries in the slots, including acked ones
+	running bool      // Whether the goroutine is stepping the wheel
+	last    time.Time // When the wheel was last stepped
+}
+
+// add schedules a handler to expire at the last tick before the given
+// deadline, but at least one tick from now.
+func (w *ackWheel) add(ah *ackHandler, deadline time.Time) {
+	if w.slots == nil {
+		w.slots = make([][]*ackHandler, ackWheelSlots)
+	}
+
+	ticks := int(deadline.Sub(w.last) / ackWheelTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	ah.rounds = (ticks - 1) / ackWheelSlots
+	slot := (w.pos + ticks) % ackWheelSlots
+	w.slots[slot] = append(w.slots[slot], ah)
+	w.pending++
+}
+
+// advance steps the wheel by one tick, removing the handlers that have
+// expired from the map and returning them.
+func (w *ackWheel) advance(handlers map[uint32]*ackHandler) []*ackHandler {
+	if w.slots == nil {
+		return nil
+	}
+	w.pos = (w.pos + 1) % ackWheelSlots
+
+	var expired []*ackHandler
+	slot := w.slots[w.pos]
+	keep := slot[:0]
+	for _, ah := range slot {
+		if handlers[ah.seqNo] != ah {
+			w.pending--
+			continue
+		}
+		if ah.rounds > 0 {
+			ah.rounds--
+			keep = append(keep, ah)
+			continue
+		}
+		delete(handlers, ah.seqNo)
+		w.pending--
+		expired = append(expired, ah)
+	}
+	for i := len(keep); i < len(slot); i++ {
+		slot[i] = nil
+	}
+	w.slots[w.pos] = keep
+	return expired
+}
+
+// addAckHandler registers a handler for the given sequence number that
+// expires after the timeout, replacing any existing one.
+func (m *Memberlist) addAckHandler(seqNo uint32, ah *ackHandler, timeout time.Duration) {
+	ah.seqNo = seqNo
+
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+
+	m.ackHandlers[seqNo] = ah
+	if timeout < ackWheelTick {
+		time.AfterFunc(timeout, func() {
+			m.ackLock.Lock()
+			current := m.ackHandlers[seqNo] == ah
+			if current {
+				delete(m.ackHandlers, seqNo)
+			}
+			m.ackLock.Unlock()
+
+			if current && ah.timeoutFn != nil {
+				ah.timeoutFn()
+			}
+		})
+		return
+	}
+
+	now := time.Now()
+	if !m.ackWheel.running {
+		m.ackWheel.running = true
+		m.ackWheel.last = now
+		go m.runAckWheel()
+	}
+	m.ackWheel.add(ah, now.Add(timeout))
+}
+
+// runAckWheel steps the wheel every tick until no handlers are left. Ticks
+// can arrive late on a busy host, so each time it wakes the wheel is
+// stepped once for every tick that has passed.
+func (m *Memberlist) runAckWheel() {
+	ticker := time.NewTicker(ackWheelTick)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		m.ackLock.Lock()
+		var expired []*ackHandler
+		now := time.Now()
+		for m.ackWheel.pending > 0 && now.Sub(m.ackWheel.last) >= ackWheelTick {
+			expired = append(expired, m.ackWheel.advance(m.ackHandlers)...)
+			m.ackWheel.last = m.ackWheel.last.Add(ackWheelTick)
+		}
+		idle := m.ackWheel.pending == 0
+		if idle {
+			m.ackWheel.running = false
+		}
+		m.ackLock.Unlock()
+
+		for _, ah := range expired {
+			if ah.timeoutFn != nil {
+				ah.timeoutFn()
+			}
+		}
+		if idle {
+			return
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package memberlist
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAckWheel_Advance(t *testing.T) {
+	w := ackWheel{last: time.Now()}
+	handlers := make(map[uint32]*ackHandler)
+	add := func(seqNo uint32, timeout time.Duration) *ackHandler {
+		ah := &ackHandler{seqNo: seqNo}
+		handlers[seqNo] = ah
+		w.add(ah, w.last.Add(timeout))
+		return ah
+	}
+
+	add(1, ackWheelTick)
+	add(2, 3*ackWheelTick)
+	add(3, ackWheelSlots*ackWheelTick+ackWheelTick) // One extra turn
+	add(5, 2*ackWheelTick+ackWheelTick/2)           // Rounded down to a tick
+	acked := add(4, 2*ackWheelTick)
+	delete(handlers, acked.seqNo)
+
+	var order []uint32
+	for i := 0; i < 2*ackWheelSlots; i++ {
+		for _, ah := range w.advance(handlers) {
+			order = append(order, ah.seqNo)
+			if i != map[uint32]int{1: 0, 5: 1, 2: 2, 3: ackWheelSlots}[ah.seqNo] {
+				t.Fatalf("handler %d expired on tick %d", ah.seqNo, i)
+			}
+		}
+	}
+	if !reflect.DeepEqual(order, []uint32{1, 5, 2, 3}) {
+		t.Fatalf("bad: %v", order)
+	}
+	if len(handlers) != 0 || w.pending != 0 {
+		t.Fatalf("bad: %v %d", handlers, w.pending)
+	}
+}
+
+func TestAckWheel_Replaced(t *testing.T) {
+	w := ackWheel{last: time.Now()}
+	handlers := make(map[uint32]*ackHandler)
+
+	// Re-registering a sequence number leaves the old entry behind, which
+	// must not expire the new handler.
+	old := &ackHandler{seqNo: 1}
+	handlers[1] = old
+	w.add(old, w.last.Add(ackWheelTick))
+	ah := &ackHandler{seqNo: 1}
+	handlers[1] = ah
+	w.add(ah, w.last.Add(2*ackWheelTick))
+
+	if expired := w.advance(handlers); len(expired) != 0 {
+		t.Fatalf("bad: %v", expired)
+	}
+	if handlers[1] != ah {
+		t.Fatalf("handler should still be registered")
+	}
+	if expired := w.advance(handlers); len(expired) != 1 || expired[0] != ah {
+		t.Fatalf("bad: %v", expired)
+	}
+}
+
+func TestMemberList_AckWheel_Timeouts(t *testing.T) {
+	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+
+	const n = 1000
+	ch := make(chan ackMessage, n)
+	for i := uint32(0); i < n; i++ {
+		m.setProbeChannels(i, ch, nil, 20*time.Millisecond)
+	}
+
+	// Ack half of them.
+	for i := uint32(0); i < n; i += 2 {
+		m.invokeAckHandler(ackResp{SeqNo: i}, time.Now())
+	}
+
+	complete, timedOut := 0, 0
+	deadline := time.After(time.Second)
+	for complete+timedOut < n {
+		select {
+		case msg := <-ch:
+			if msg.Complete {
+				complete++
+			} else {
+				timedOut++
+			}
+		case <-deadline:
+			t.Fatalf("only got %d acks and %d timeouts", complete, timedOut)
+		}
+	}
+	if complete != n/2 || timedOut != n/2 {
+		t.Fatalf("bad: %d %d", complete, timedOut)
+	}
+
+	// The wheel stops once it's empty.
+	time.Sleep(5 * ackWheelTick)
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+	if m.ackWheel.running || m.ackWheel.pending != 0 || len(m.ackHandlers) != 0 {
+		t.Fatalf("bad: %#v", m.ackWheel)
+	}
+}
+
+func TestMemberList_AckWheel_ShortTimeout(t *testing.T) {
+	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
+
+	ch := make(chan ackMessage, 1)
+	start := time.Now()
+	m.setProbeChannels(1, ch, nil, time.Millisecond)
+	if msg := <-ch; msg.Complete {
+		t.Fatalf("should time out")
+	}
+	if elapsed := time.Since(start); elapsed >= ackWheelTick {
+		t.Fatalf("took too long: %v", elapsed)
+	}
+	if m.ackWheel.pending != 0 {
+		t.Fatalf("short timeouts shouldn't use the wheel")
+	}
+}
@@ -0,0 +1,177 @@
+package memberlist
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Admission control protects a node from a cluster bigger or busier than it
+can handle, whether it was pointed at one by mistake or a hostile peer is
+flooding it.
+
+MaxMembers caps the nodes we track. Once it's reached, alive messages and
+push/pull state for nodes we don't already know about are ignored; nodes we
+know about carry on as normal, and new ones are admitted as old ones are
+reaped. A node we don't know that tries to join through us is turned away
+with a rejection, so that it can try another seed. We always admit
+ourselves.
+
+MaxStateMsgRate caps how many alive, suspect and dead messages per second
+we take from the network, with bursts of up to StateMsgBurst. Messages over
+the limit are dropped before they're queued for the handler. Gossip is
+retransmitted, so a dropped update will usually arrive again from another
+peer. Push/pull state is bounded by MaxMembers instead.
+
+MaxJoinRate caps how many joins per second we take part in, with bursts of
+up to JoinBurst, so that a seed node isn't swamped when a whole fleet starts
+at once. Only push/pulls from joining nodes count; the periodic ones between
+members don't. A join over the limit waits for its turn, up to JoinQueueDepth
+of them at a time and for no more than half the stream timeout, after which
+joiners are turned away with a rejection saying how long until the queue
+will have drained. Joiners retry after that long plus a random stagger, so
+that the ones turned away together don't come back together.
+*/
+
+// rateLimiter is a token bucket.
+type rateLimiter struct {
+	sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a full bucket, or nil if rate is zero, which
+// allows everything.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token if there's one to take.
+func (r *rateLimiter) allow(now time.Time) bool {
+	if r == nil {
+		return true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.refill(now)
+	if r.tokens < 1 {
+		return false
+	}
+	r.tokens--
+	return true
+}
+
+// reserve takes a token, waiting in line for one if need be, and returns
+// how long to wait before using it. Each caller in line takes the bucket a
+// token further below zero. If the line is depth long already, or the wait
+// would be longer than maxWait, it takes nothing and returns false and how
+// long until the line will have cleared.
+func (r *rateLimiter) reserve(now time.Time, depth int, maxWait time.Duration) (time.Duration, bool) {
+	if r == nil {
+		return 0, true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.refill(now)
+	if r.tokens >= 1 {
+		r.tokens--
+		return 0, true
+	}
+	wait := time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+	if r.tokens-1 < -float64(depth) || wait > maxWait {
+		return wait, false
+	}
+	r.tokens--
+	return wait, true
+}
+
+// refill adds the tokens earned since it was last called. The lock must be
+// held.
+func (r *rateLimiter) refill(now time.Time) {
+	if !r.last.IsZero() {
+		r.tokens += now.Sub(r.last).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+	}
+	r.last = now
+}
+
+// admitStateMsg returns false if a state message from the network should
+// be dropped to stay within MaxStateMsgRate.
+func (m *Memberlist) admitStateMsg(msgType messageType, from net.Addr) bool {
+	if m.stateLimit.allow(time.Now()) {
+		return true
+	}
+	metrics.IncrCounter([]string{"memberlist", "admission", "rate_limited"}, 1)
+	m.packetLog.Printf("[WARN] memberlist: State message rate limit reached, dropping message (%d) %s", msgType, LogAddress(from))
+	return false
+}
+
+// admitMember returns false if a node we haven't seen before would take us
+// over MaxMembers. The node lock must be held.
+func (m *Memberlist) admitMember(name string) bool {
+	limit := m.config.MaxMembers
+	if limit <= 0 || name == m.config.Name || len(m.nodes) < limit {
+		return true
+	}
+	metrics.IncrCounter([]string{"memberlist", "admission", "member_rejected"}, 1)
+	m.packetLog.Printf("[WARN] memberlist: Member limit (%d) reached, ignoring node %s", limit, name)
+	return false
+}
+
+// admitJoiner returns a rejection if a joining node we don't know yet would
+// take us over MaxMembers.
+func (m *Memberlist) admitJoiner(name string) error {
+	limit := m.config.MaxMembers
+	if limit <= 0 {
+		return nil
+	}
+
+	m.nodeLock.RLock()
+	_, known := m.nodeMap[name]
+	full := len(m.nodes) >= limit
+	m.nodeLock.RUnlock()
+	if known || !full {
+		return nil
+	}
+	metrics.IncrCounter([]string{"memberlist", "admission", "member_rejected"}, 1)
+	return &MergeRejection{Reason: "Member limit reached"}
+}
+
+// admitJoin holds a joining node's push/pull until it's within MaxJoinRate,
+// returning a rejection telling it when to come back instead if too many
+// are waiting already.
+func (m *Memberlist) admitJoin() error {
+	wait, ok := m.joinLimit.reserve(time.Now(), m.config.JoinQueueDepth, m.tune().TCPTimeout/2)
+	if !ok {
+		metrics.IncrCounter([]string{"memberlist", "admission", "join_rejected"}, 1)
+		return &MergeRejection{Reason: "Too many nodes joining at once", RetryAfter: wait}
+	}
+	if wait == 0 {
+		return nil
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "admission", "join_queued"}, 1)
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-m.shutdownCh:
+		return ErrShutdown
+	}
+}
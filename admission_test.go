@@ -0,0 +1,251 @@
+package memberlist
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	if newRateLimiter(0, 10) != nil {
+		t.Fatalf("expected no limiter for a zero rate")
+	}
+	var unlimited *rateLimiter
+	if !unlimited.allow(time.Now()) {
+		t.Fatalf("nil limiter should allow everything")
+	}
+
+	r := newRateLimiter(10, 3)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !r.allow(now) {
+			t.Fatalf("burst %d should be allowed", i)
+		}
+	}
+	if r.allow(now) {
+		t.Fatalf("should be limited after the burst")
+	}
+
+	// A tenth of a second buys one more.
+	now = now.Add(100 * time.Millisecond)
+	if !r.allow(now) {
+		t.Fatalf("should have refilled")
+	}
+	if r.allow(now) {
+		t.Fatalf("should be limited again")
+	}
+
+	// The bucket never holds more than the burst.
+	now = now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !r.allow(now) {
+			t.Fatalf("burst %d should be allowed", i)
+		}
+	}
+	if r.allow(now) {
+		t.Fatalf("should be limited after the burst")
+	}
+}
+
+func TestMemberList_AliveNode_MaxMembers(t *testing.T) {
+	c := testConfig()
+	c.MaxMembers = 3
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	// We're already one of the three.
+	for _, name := range []string{"test1", "test2", "test3"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	if n := m.NumMembers(); n != 3 {
+		t.Fatalf("expected 3 members, got %d", n)
+	}
+	if _, ok := m.nodeMap["test3"]; ok {
+		t.Fatalf("test3 should have been rejected")
+	}
+
+	// Known nodes are still updated.
+	a := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 2}
+	m.aliveNode(&a, nil, false)
+	if inc := m.nodeMap["test1"].Incarnation; inc != 2 {
+		t.Fatalf("expected incarnation 2, got %d", inc)
+	}
+}
+
+func TestMemberlist_Join_MaxMembers(t *testing.T) {
+	c1 := testConfig()
+	c1.MaxMembers = 2
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	join := func(m *Memberlist) JoinResult {
+		results, _ := m.JoinWithOptions([]string{c1.BindAddr}, JoinOptions{})
+		return results[0]
+	}
+	create := func() *Memberlist {
+		c := testConfig()
+		c.BindPort = m1.config.BindPort
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return m
+	}
+
+	m2 := create()
+	defer m2.Shutdown()
+	if r := join(m2); r.Class != JoinSuccess {
+		t.Fatalf("should join: %v", r.Err)
+	}
+
+	// A newcomer is told it can't join rather than being ignored.
+	m3 := create()
+	defer m3.Shutdown()
+	r := join(m3)
+	var rej *MergeRejection
+	if r.Class != JoinRejected || !errors.As(r.Err, &rej) {
+		t.Fatalf("should be rejected: %v %v", r.Class, r.Err)
+	}
+	if m1.NumMembers() != 2 {
+		t.Fatalf("expected 2 members, got %d", m1.NumMembers())
+	}
+
+	// A member we know can still join again.
+	if r := join(m2); r.Class != JoinSuccess {
+		t.Fatalf("should rejoin: %v", r.Err)
+	}
+}
+
+func TestMemberList_HandleCommand_StateRateLimit(t *testing.T) {
+	// There's no handler running, so we can see what was queued.
+	c := testConfig()
+	logger := log.New(os.Stderr, "", log.LstdFlags)
+	m := &Memberlist{
+		config:     c,
+		logger:     logger,
+		packetLog:  newPacketLogger(logger, c.PacketLogInterval, c.PacketLogBurst),
+		handoff:    make(chan msgHandoff, 10),
+		stateLimit: newRateLimiter(0.001, 2),
+	}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	for i := 0; i < 4; i++ {
+		buf, err := encode(suspectMsg, &suspect{Node: "test", Incarnation: uint32(i)})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		m.handleCommand(buf.Bytes(), from, time.Now(), "")
+	}
+	buf, err := encode(userMsg, &ping{})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.handleCommand(buf.Bytes(), from, time.Now(), "")
+
+	// Two state messages fit in the burst, and user messages aren't
+	// limited.
+	if n := len(m.handoff); n != 3 {
+		t.Fatalf("expected 3 queued messages, got %d", n)
+	}
+}
+
+func TestRateLimiter_Reserve(t *testing.T) {
+	var unlimited *rateLimiter
+	if wait, ok := unlimited.reserve(time.Now(), 0, time.Second); !ok || wait != 0 {
+		t.Fatalf("nil limiter should allow everything")
+	}
+
+	r := newRateLimiter(10, 1)
+	now := time.Now()
+	if wait, ok := r.reserve(now, 2, time.Second); !ok || wait != 0 {
+		t.Fatalf("burst should be allowed at once: %v %v", wait, ok)
+	}
+
+	// Two can wait in line, a tenth of a second apart.
+	if wait, ok := r.reserve(now, 2, time.Second); !ok || wait != 100*time.Millisecond {
+		t.Fatalf("should wait its turn: %v %v", wait, ok)
+	}
+	if wait, ok := r.reserve(now, 2, time.Second); !ok || wait != 200*time.Millisecond {
+		t.Fatalf("should wait its turn: %v %v", wait, ok)
+	}
+
+	// The line is full, and clears after another tenth of a second.
+	if wait, ok := r.reserve(now, 2, time.Second); ok || wait != 300*time.Millisecond {
+		t.Fatalf("should be turned away: %v %v", wait, ok)
+	}
+	now = now.Add(300 * time.Millisecond)
+	if wait, ok := r.reserve(now, 2, time.Second); !ok || wait != 0 {
+		t.Fatalf("should have cleared: %v %v", wait, ok)
+	}
+
+	// Nobody waits longer than they're allowed to.
+	r = newRateLimiter(1, 1)
+	r.reserve(now, 10, time.Second)
+	if _, ok := r.reserve(now, 10, 500*time.Millisecond); ok {
+		t.Fatalf("should not wait too long")
+	}
+}
+
+func TestMemberlist_Join_Throttled(t *testing.T) {
+	c1 := testConfig()
+	c1.MaxJoinRate = 5
+	c1.JoinBurst = 1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	join := func(opts JoinOptions) (*Memberlist, JoinResult) {
+		c := testConfig()
+		c.BindPort = m1.config.BindPort
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		results, _ := m.JoinWithOptions([]string{c1.BindAddr}, opts)
+		return m, results[0]
+	}
+
+	// The first uses up the burst, and with no queue the next is turned
+	// away and told when to come back.
+	m2, r := join(JoinOptions{})
+	defer m2.Shutdown()
+	if r.Class != JoinSuccess {
+		t.Fatalf("should join: %v", r.Err)
+	}
+	m3, r := join(JoinOptions{})
+	defer m3.Shutdown()
+	if r.Class != JoinThrottled {
+		t.Fatalf("should be throttled: %v %v", r.Class, r.Err)
+	}
+
+	// One that retries gets in once it's been long enough.
+	m4, r := join(JoinOptions{Retries: 3})
+	defer m4.Shutdown()
+	if r.Class != JoinSuccess || r.Attempts < 2 {
+		t.Fatalf("should join on a retry: %v %d %v", r.Class, r.Attempts, r.Err)
+	}
+
+	// Periodic push/pulls between members aren't limited.
+	if err := m2.pushPullNode(net.ParseIP(c1.BindAddr), uint16(m1.config.BindPort), false); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// With a queue, a join over the limit waits instead.
+	m1.config.JoinQueueDepth = 2
+	m5, r := join(JoinOptions{})
+	defer m5.Shutdown()
+	if r.Class != JoinSuccess {
+		t.Fatalf("should have waited its turn: %v %v", r.Class, r.Err)
+	}
+}
@@ -0,0 +1,73 @@
+package memberlist
+
+import (
+	"sync"
+	"time"
+)
+
+// aliveLimiter keeps track of the alive messages we've recently queued for
+// rebroadcast so that redundant copies for the same node and incarnation
+// aren't forwarded again within a short window. This matters most during
+// mass restarts, where reaped nodes would otherwise be resurrected and
+// re-gossiped by every stale copy of their alive message still in flight.
+// The records are deliberately kept apart from the node map so they survive
+// dead nodes being reaped.
+type aliveLimiter struct {
+	sync.Mutex
+
+	// window is how long a rebroadcast suppresses duplicates for. A zero
+	// window disables the limiter.
+	window time.Duration
+
+	// seen maps node names to the last incarnation we rebroadcast for them.
+	seen map[string]aliveRecord
+
+	// lastSweep is when we last dropped expired records.
+	lastSweep time.Time
+}
+
+// aliveRecord is a single rebroadcast we've done.
+type aliveRecord struct {
+	incarnation uint32
+	at          time.Time
+}
+
+// newAliveLimiter returns a limiter with the given suppression window.
+func newAliveLimiter(window time.Duration) *aliveLimiter {
+	return &aliveLimiter{
+		window: window,
+		seen:   make(map[string]aliveRecord),
+	}
+}
+
+// Allow returns true if an alive message for the given node and incarnation
+// should be rebroadcast, and records it if so. Messages for an incarnation
+// we've already rebroadcast within the window are refused; newer
+// incarnations are always allowed through, and will invalidate the older
+// message in the broadcast queue.
+func (l *aliveLimiter) Allow(node string, incarnation uint32, now time.Time) bool {
+	if l.window <= 0 {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// Periodically drop expired records so the map doesn't grow with
+	// every node we've ever heard of.
+	if now.Sub(l.lastSweep) > l.window {
+		for name, rec := range l.seen {
+			if now.Sub(rec.at) >= l.window {
+				delete(l.seen, name)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	rec, ok := l.seen[node]
+	if ok && now.Sub(rec.at) < l.window && incarnation <= rec.incarnation {
+		return false
+	}
+	l.seen[node] = aliveRecord{incarnation, now}
+	return true
+}
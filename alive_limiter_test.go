@@ -0,0 +1,81 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAliveLimiter(t *testing.T) {
+	l := newAliveLimiter(time.Second)
+	now := time.Now()
+
+	if !l.Allow("foo", 1, now) {
+		t.Fatalf("should allow first alive")
+	}
+	if l.Allow("foo", 1, now.Add(10*time.Millisecond)) {
+		t.Fatalf("should suppress duplicate alive")
+	}
+	if l.Allow("foo", 0, now.Add(10*time.Millisecond)) {
+		t.Fatalf("should suppress older alive")
+	}
+	if !l.Allow("bar", 1, now.Add(10*time.Millisecond)) {
+		t.Fatalf("should allow other node")
+	}
+	if !l.Allow("foo", 2, now.Add(20*time.Millisecond)) {
+		t.Fatalf("should allow newer incarnation")
+	}
+	if l.Allow("foo", 2, now.Add(30*time.Millisecond)) {
+		t.Fatalf("should suppress duplicate of newer incarnation")
+	}
+	if !l.Allow("foo", 2, now.Add(2*time.Second)) {
+		t.Fatalf("should allow once the window expires")
+	}
+
+	// The expired record for bar should have been swept.
+	if _, ok := l.seen["bar"]; ok {
+		t.Fatalf("expected bar to be swept")
+	}
+}
+
+func TestAliveLimiter_Disabled(t *testing.T) {
+	l := newAliveLimiter(0)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !l.Allow("foo", 1, now) {
+			t.Fatalf("should always allow when disabled")
+		}
+	}
+}
+
+func TestMemberList_AliveNode_SuppressReplay(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected queued message")
+	}
+
+	// Kill and reap the node, then replay the alive message as a stale
+	// copy would arrive during a mass restart.
+	d := dead{Node: "test", Incarnation: 1}
+	m.deadNode(&d)
+	m.resetNodes()
+	m.broadcasts.Reset()
+
+	m.aliveNode(&a, nil, false)
+	if m.broadcasts.NumQueued() != 0 {
+		t.Fatalf("expected replayed alive to be suppressed")
+	}
+	if _, ok := m.nodeMap["test"]; !ok {
+		t.Fatalf("expected node to be known again")
+	}
+
+	// A newer incarnation should still go out.
+	a.Incarnation = 2
+	m.aliveNode(&a, nil, false)
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected queued message")
+	}
+}
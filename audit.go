@@ -0,0 +1,51 @@
+package memberlist
+
+import (
+	"net"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+The audit sink gets a structured record of the events a security team
+would want to keep: members joining and leaving, keys being installed,
+promoted and removed, traffic no key can open, refused merges and address
+conflicts. Records are sent whether or not the matching delegates are
+configured, and carry the time of the event rather than of delivery.
+
+Key changes are reported by the keyring itself, so changes made directly
+through Config.Keyring are audited as well as ours. A keyring reports to
+the last memberlist created with it.
+*/
+
+// audit sends a record to the audit sink, if there is one.
+func (m *Memberlist) audit(event AuditEvent, node string, addr net.Addr, detail string) {
+	sink := m.config.Audit
+	if sink == nil {
+		return
+	}
+	r := AuditRecord{
+		Time:   time.Now(),
+		Event:  event,
+		Node:   node,
+		Detail: detail,
+	}
+	if addr != nil {
+		r.Addr = addr.String()
+	}
+	metrics.IncrCounter([]string{"memberlist", "audit", string(event)}, 1)
+	m.dispatchDelegate(node, "audit", func() {
+		sink.Audit(r)
+	})
+}
+
+// auditKeys has the keyring report key changes to the audit sink.
+func (m *Memberlist) auditKeys() {
+	if m.config.Audit == nil || m.config.Keyring == nil {
+		return
+	}
+	m.config.Keyring.watch(func(event AuditEvent, key []byte) {
+		m.audit(event, m.config.Name, nil, KeyID(key))
+	})
+}
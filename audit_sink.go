@@ -0,0 +1,56 @@
+package memberlist
+
+import "time"
+
+// AuditEvent is the kind of security-relevant event an AuditRecord
+// describes.
+type AuditEvent string
+
+const (
+	// AuditJoin and AuditLeave record a node joining or leaving the
+	// cluster. The leave's Detail is "graceful" or "failed".
+	AuditJoin  AuditEvent = "join"
+	AuditLeave AuditEvent = "leave"
+
+	// AuditKeyInstall, AuditKeyUse and AuditKeyRemove record changes to
+	// the keyring. Detail is the KeyID of the key.
+	AuditKeyInstall AuditEvent = "key_install"
+	AuditKeyUse     AuditEvent = "key_use"
+	AuditKeyRemove  AuditEvent = "key_remove"
+
+	// AuditDecryptFailed records a message that no installed key could
+	// decrypt or verify. Detail is how many have failed from the same
+	// host, as failures=N.
+	AuditDecryptFailed AuditEvent = "decrypt_failed"
+
+	// AuditMergeRejected records a push/pull that we refused, or that the
+	// peer refused, with the reason in Detail.
+	AuditMergeRejected AuditEvent = "merge_rejected"
+
+	// AuditConflict records a node claiming a name that's already in use
+	// at a different address. Detail is the other address.
+	AuditConflict AuditEvent = "conflict"
+)
+
+// AuditRecord is a single security-relevant event.
+type AuditRecord struct {
+	Time  time.Time
+	Event AuditEvent
+
+	// Node is the node the event is about, if known, and Addr the address
+	// it came from, if any.
+	Node string
+	Addr string
+
+	// Detail depends on the event.
+	Detail string
+}
+
+// AuditSink receives a record of security-relevant events, so that they
+// can be kept or forwarded without scraping the logs.
+type AuditSink interface {
+	// Audit is invoked for each event. It's called from the delegate
+	// workers if they're configured, and inline otherwise, so it shouldn't
+	// block.
+	Audit(AuditRecord)
+}
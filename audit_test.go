@@ -0,0 +1,132 @@
+package memberlist
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingAudit struct {
+	sync.Mutex
+	records []AuditRecord
+}
+
+func (r *recordingAudit) Audit(rec AuditRecord) {
+	r.Lock()
+	defer r.Unlock()
+	r.records = append(r.records, rec)
+}
+
+func (r *recordingAudit) events(event AuditEvent) []AuditRecord {
+	r.Lock()
+	defer r.Unlock()
+	var out []AuditRecord
+	for _, rec := range r.records {
+		if rec.Event == event {
+			out = append(out, rec)
+		}
+	}
+	return out
+}
+
+func TestAudit_Keyring(t *testing.T) {
+	sink := &recordingAudit{}
+	c := testConfig()
+	c.SecretKey = TestKeys[0]
+	c.Audit = sink
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	k := m.config.Keyring
+	if err := k.AddKey(TestKeys[1]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := k.AddKey(TestKeys[1]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := k.UseKey(TestKeys[1]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := k.RemoveKey(TestKeys[0]); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	for event, want := range map[AuditEvent][]byte{
+		AuditKeyInstall: TestKeys[1],
+		AuditKeyUse:     TestKeys[1],
+		AuditKeyRemove:  TestKeys[0],
+	} {
+		recs := sink.events(event)
+		if len(recs) != 1 {
+			t.Fatalf("expected 1 %s record, got %v", event, recs)
+		}
+		if recs[0].Detail != KeyID(want) || recs[0].Node != c.Name {
+			t.Fatalf("bad %s record: %+v", event, recs[0])
+		}
+	}
+}
+
+func TestAudit_DecryptConflictLeave(t *testing.T) {
+	sink := &recordingAudit{}
+	c := testConfig()
+	c.SecretKey = TestKeys[0]
+	c.Audit = sink
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 7946}
+	m.recordDecrypt(m.config.Keyring.GetKeys(), -1, from)
+	recs := sink.events(AuditDecryptFailed)
+	if len(recs) != 1 || recs[0].Addr != from.String() || recs[0].Detail != "failures=1" {
+		t.Fatalf("bad: %v", recs)
+	}
+	if got := m.DecryptFailures(); got["127.0.0.9"] != 1 {
+		t.Fatalf("bad: %v", got)
+	}
+
+	a := alive{
+		Node:        "test",
+		Addr:        []byte{127, 0, 0, 1},
+		Port:        7946,
+		Incarnation: 1,
+		Vsn: []uint8{
+			ProtocolVersionMin,
+			ProtocolVersionMax,
+			m.config.ProtocolVersion,
+			m.config.DelegateProtocolMin,
+			m.config.DelegateProtocolMax,
+			m.config.DelegateProtocolVersion,
+		},
+	}
+	m.aliveNode(&a, nil, false)
+	recs = sink.events(AuditJoin)
+	if len(recs) != 2 || recs[0].Node != c.Name || recs[1].Node != "test" {
+		t.Fatalf("bad: %v", recs)
+	}
+
+	other := a
+	other.Addr = []byte{127, 0, 0, 2}
+	other.Incarnation = 2
+	m.aliveNode(&other, nil, false)
+	recs = sink.events(AuditConflict)
+	if len(recs) != 1 || recs[0].Addr != "127.0.0.1:7946" || recs[0].Detail != "127.0.0.2:7946" {
+		t.Fatalf("bad: %v", recs)
+	}
+
+	d := dead{Node: "test", Incarnation: 1, From: "test"}
+	m.deadNode(&d)
+	recs = sink.events(AuditLeave)
+	if len(recs) != 1 || recs[0].Detail != "graceful" {
+		t.Fatalf("bad: %v", recs)
+	}
+	if recs[0].Time.IsZero() || time.Since(recs[0].Time) > time.Minute {
+		t.Fatalf("bad time: %v", recs[0].Time)
+	}
+}
@@ -0,0 +1,207 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Bans keep decommissioned nodes out of the cluster. A banned node is marked
+dead straight away, and any alive message about it is ignored until the ban
+expires, so it can't rejoin, or be brought back by another member's state.
+
+Bans are gossiped like any other broadcast. So that members that weren't
+around at the time still find out, we gossip a ban again whenever we see
+the banned node trying to come back. Each ban carries the time it was
+issued on the sender's clock, and the latest one for a node wins, which is
+how lifting a ban gets past stale copies of it.
+*/
+
+// banRetention is how long we remember a ban after it expires or is
+// lifted, to recognize stale copies of it that are still being gossiped.
+const banRetention = time.Hour
+
+// ban is broadcast to ban a node from the cluster, or to lift a ban.
+type ban struct {
+	Node   string `codec:"Node"`
+	Issued int64  `codec:"Issued"` // Unix nanoseconds on the issuer's clock
+	TTL    int64  `codec:"TTL"`    // Nanoseconds left on the ban, or zero to lift it
+	From   string `codec:"From"`
+}
+
+// banEntry is a ban we know about.
+type banEntry struct {
+	issued  int64
+	expires time.Time
+}
+
+// banList tracks the bans we know about, including lifted ones so that
+// we can tell if a ban we hear about later is stale.
+type banList struct {
+	sync.Mutex
+	entries map[string]banEntry
+}
+
+// update records a ban, returning false if we already knew about it or
+// about a later one.
+func (l *banList) update(b *ban, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	if e, ok := l.entries[b.Node]; ok && e.issued >= b.Issued {
+		return false
+	}
+	if l.entries == nil {
+		l.entries = make(map[string]banEntry)
+	}
+	l.entries[b.Node] = banEntry{
+		issued:  b.Issued,
+		expires: now.Add(time.Duration(b.TTL)),
+	}
+	return true
+}
+
+// banned returns the ban for the given node, if it's currently banned.
+func (l *banList) banned(node string, now time.Time) (ban, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	e, ok := l.entries[node]
+	if !ok || !now.Before(e.expires) {
+		return ban{}, false
+	}
+	return ban{Node: node, Issued: e.issued, TTL: int64(e.expires.Sub(now))}, true
+}
+
+// prune forgets about bans that expired or were lifted a while ago.
+func (l *banList) prune(now time.Time, keep time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	for node, e := range l.entries {
+		if now.Sub(e.expires) > keep {
+			delete(l.entries, node)
+		}
+	}
+}
+
+// banKey is the broadcast key for a ban, so that it doesn't invalidate
+// messages about the node itself.
+func banKey(node string) string {
+	return "ban:" + node
+}
+
+// Ban keeps the named node out of the cluster for the given time. The node
+// is marked dead straight away if we know about it, and the ban is gossiped
+// to the rest of the cluster, which will refuse to let it rejoin until the
+// ban expires. The node doesn't have to be a member right now.
+func (m *Memberlist) Ban(node string, ttl time.Duration) error {
+	if node == m.config.Name {
+		return fmt.Errorf("Cannot ban ourselves")
+	}
+	if ttl <= 0 {
+		return fmt.Errorf("Ban TTL must be positive")
+	}
+	return m.issueBan(node, ttl)
+}
+
+// Unban lifts a ban on the named node, so it can join again.
+func (m *Memberlist) Unban(node string) error {
+	return m.issueBan(node, 0)
+}
+
+// Bans returns the nodes that are currently banned and when each ban
+// expires.
+func (m *Memberlist) Bans() map[string]time.Time {
+	now := time.Now()
+	m.bans.Lock()
+	defer m.bans.Unlock()
+
+	out := make(map[string]time.Time)
+	for node, e := range m.bans.entries {
+		if now.Before(e.expires) {
+			out[node] = e.expires
+		}
+	}
+	return out
+}
+
+func (m *Memberlist) issueBan(node string, ttl time.Duration) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
+	b := ban{
+		Node:   node,
+		Issued: time.Now().UnixNano(),
+		TTL:    int64(ttl),
+		From:   m.config.Name,
+	}
+	m.applyBan(&b)
+	return nil
+}
+
+// applyBan records a ban and passes it on, if it's news to us.
+func (m *Memberlist) applyBan(b *ban) {
+	now := time.Now()
+	m.bans.prune(now, banRetention)
+	if !m.bans.update(b, now) {
+		return
+	}
+	m.encodeAndBroadcast(banKey(b.Node), banMsg, b)
+
+	if b.TTL <= 0 {
+		m.logger.Printf("[INFO] memberlist: Ban on %s lifted (from: %s)", b.Node, b.From)
+		return
+	}
+	if b.Node == m.config.Name {
+		m.logger.Printf("[WARN] memberlist: We've been banned from the cluster (from: %s)", b.From)
+		return
+	}
+	m.logger.Printf("[INFO] memberlist: Banned %s for %v (from: %s)", b.Node, time.Duration(b.TTL), b.From)
+	metrics.IncrCounter([]string{"memberlist", "ban"}, 1)
+
+	// Mark it dead now rather than waiting for it to fail.
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[b.Node]
+	var d dead
+	if ok {
+		d = dead{Incarnation: state.Incarnation, Node: b.Node, From: m.config.Name}
+	}
+	m.nodeLock.RUnlock()
+	if ok {
+		m.deadNode(&d)
+	}
+}
+
+// checkBanned is called with the nodeLock held when we hear a node is
+// alive, and returns true if it's banned and should be ignored. It
+// gossips the ban again, since whoever sent the message didn't know.
+func (m *Memberlist) checkBanned(node string) bool {
+	if node == m.config.Name {
+		return false
+	}
+	b, ok := m.bans.banned(node, time.Now())
+	if !ok {
+		return false
+	}
+	b.From = m.config.Name
+	m.encodeAndBroadcast(banKey(node), banMsg, &b)
+	metrics.IncrCounter([]string{"memberlist", "ban", "refused"}, 1)
+	return true
+}
+
+func (m *Memberlist) handleBan(buf []byte, from net.Addr) {
+	var b ban
+	if err := decode(buf, &b); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode ban message: %s %s", err, LogAddress(from))
+		return
+	}
+	m.applyBan(&b)
+}
@@ -0,0 +1,122 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	var l banList
+	now := time.Now()
+
+	b := &ban{Node: "test", Issued: 10, TTL: int64(time.Minute)}
+	if !l.update(b, now) {
+		t.Fatalf("should be new")
+	}
+	if l.update(b, now) {
+		t.Fatalf("should not be new")
+	}
+	if _, ok := l.banned("test", now.Add(59*time.Second)); !ok {
+		t.Fatalf("should be banned")
+	}
+	if _, ok := l.banned("test", now.Add(time.Minute)); ok {
+		t.Fatalf("should have expired")
+	}
+	if _, ok := l.banned("other", now); ok {
+		t.Fatalf("should not be banned")
+	}
+
+	// Lifting it needs a later ban.
+	if l.update(&ban{Node: "test", Issued: 5}, now) {
+		t.Fatalf("stale lift should be ignored")
+	}
+	if !l.update(&ban{Node: "test", Issued: 20}, now) {
+		t.Fatalf("should be new")
+	}
+	if _, ok := l.banned("test", now); ok {
+		t.Fatalf("should have been lifted")
+	}
+
+	// A stale copy of the original ban doesn't bring it back.
+	if l.update(b, now) {
+		t.Fatalf("stale ban should be ignored")
+	}
+
+	l.prune(now.Add(2*time.Hour), time.Hour)
+	if len(l.entries) != 0 {
+		t.Fatalf("should have pruned: %v", l.entries)
+	}
+}
+
+func TestMemberlist_Ban(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	if err := m.Ban(m.config.Name, time.Minute); err == nil {
+		t.Fatalf("should not ban ourselves")
+	}
+	if err := m.Ban("test", 0); err == nil {
+		t.Fatalf("should need a TTL")
+	}
+	if err := m.Ban("test", time.Minute); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state := m.nodeMap["test"]; state.State != stateDead {
+		t.Fatalf("should be dead: %v", state.State)
+	}
+	if _, ok := m.Bans()["test"]; !ok {
+		t.Fatalf("should be listed: %v", m.Bans())
+	}
+
+	// It can't come back while the ban holds, and the ban is gossiped
+	// again when it tries.
+	m.broadcasts.Reset()
+	a.Incarnation = 2
+	m.aliveNode(&a, nil, false)
+	if state := m.nodeMap["test"]; state.State != stateDead {
+		t.Fatalf("should still be dead: %v", state.State)
+	}
+	if m.broadcasts.NumQueued() != 1 || messageType(m.broadcasts.bcQueue[0].b.Message()[0]) != banMsg {
+		t.Fatalf("expected ban to be queued")
+	}
+
+	if err := m.Unban("test"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(m.Bans()) != 0 {
+		t.Fatalf("should be lifted: %v", m.Bans())
+	}
+	a.Incarnation = 3
+	m.aliveNode(&a, nil, false)
+	if state := m.nodeMap["test"]; state.State != stateAlive {
+		t.Fatalf("should be alive: %v", state.State)
+	}
+}
+
+func TestMemberlist_HandleBan(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	b := ban{Node: "test", Issued: time.Now().UnixNano(), TTL: int64(time.Minute), From: "other"}
+	buf, err := encode(banMsg, &b)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.handleBan(buf.Bytes()[1:], nil)
+	if _, ok := m.Bans()["test"]; !ok {
+		t.Fatalf("should be banned")
+	}
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("should pass the ban on")
+	}
+
+	// Hearing it again changes nothing.
+	m.broadcasts.Reset()
+	m.handleBan(buf.Bytes()[1:], nil)
+	if m.broadcasts.NumQueued() != 0 {
+		t.Fatalf("should not pass the ban on again")
+	}
+}
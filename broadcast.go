@@ -1,5 +1,9 @@
 package memberlist
 
+import (
+	"time"
+)
+
 /*
 The broadcast mechanism works by maintaining a sorted list of messages to be
 sent out. When a message is to be broadcast, the retransmit count
@@ -20,8 +24,13 @@ type memberlistBroadcast struct {
 
 func (b *memberlistBroadcast) Invalidates(other Broadcast) bool {
 	// Check if that broadcast is a memberlist type
-	mb, ok := other.(*memberlistBroadcast)
-	if !ok {
+	var mb *memberlistBroadcast
+	switch o := other.(type) {
+	case *memberlistBroadcast:
+		mb = o
+	case *localAliveBroadcast:
+		mb = &o.memberlistBroadcast
+	default:
 		return false
 	}
 
@@ -40,6 +49,45 @@ func (b *memberlistBroadcast) Finished() {
 	}
 }
 
+// userBroadcast is a user message queued on our own queue.
+type userBroadcast struct {
+	msg []byte
+}
+
+// Invalidates never replaces another broadcast, since user messages have
+// no key to compare.
+func (b *userBroadcast) Invalidates(other Broadcast) bool {
+	return false
+}
+
+func (b *userBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *userBroadcast) Finished() {}
+
+// userExpiringBroadcast is a user message queued with BroadcastUntil.
+type userExpiringBroadcast struct {
+	msg     []byte
+	expires time.Time
+}
+
+// Invalidates never replaces another broadcast, since user messages have
+// no key to compare.
+func (b *userExpiringBroadcast) Invalidates(other Broadcast) bool {
+	return false
+}
+
+func (b *userExpiringBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *userExpiringBroadcast) Finished() {}
+
+func (b *userExpiringBroadcast) Expires() time.Time {
+	return b.expires
+}
+
 // encodeAndBroadcast encodes a message and enqueues it for broadcast. Fails
 // silently if there is an encoding error.
 func (m *Memberlist) encodeAndBroadcast(node string, msgType messageType, msg interface{}) {
@@ -70,31 +118,55 @@ func (m *Memberlist) queueBroadcast(node string, msg []byte, notify chan struct{
 // a maximum byte size, while imposing a per-broadcast overhead. This is used
 // to fill a UDP packet with piggybacked data
 func (m *Memberlist) getBroadcasts(overhead, limit int) [][]byte {
-	// Get memberlist messages first
-	toSend := m.broadcasts.GetBroadcasts(overhead, limit)
-
-	// Check if the user has anything to broadcast
 	d := m.config.Delegate
-	if d != nil {
-		// Determine the bytes used already
-		bytesUsed := 0
-		for _, msg := range toSend {
-			bytesUsed += len(msg) + overhead
-		}
+	var toSend [][]byte
+	bytesUsed := 0
 
-		// Check space remaining for user messages
-		avail := limit - bytesUsed
-		if avail > overhead+userMsgOverhead {
-			userMsgs := d.GetBroadcasts(overhead+userMsgOverhead, avail)
-
-			// Frame each user message
-			for _, msg := range userMsgs {
-				buf := make([]byte, 1, len(msg)+1)
-				buf[0] = byte(userMsg)
-				buf = append(buf, msg...)
-				toSend = append(toSend, buf)
-			}
+	// Give the user's broadcasts their reserved space first, so our own
+	// messages can't crowd them out. If they don't need it all, we get the
+	// rest.
+	if reserve := m.tune().UserBroadcastReserve; d != nil && reserve > 0 {
+		if reserve > limit {
+			reserve = limit
 		}
+		toSend = m.getUserBroadcasts(d, overhead, reserve, toSend)
+		bytesUsed = piggybackBytes(toSend, overhead)
+	}
+
+	// Get memberlist messages next
+	msgs := m.broadcasts.GetBroadcasts(overhead, limit-bytesUsed)
+	toSend = append(toSend, msgs...)
+	bytesUsed += piggybackBytes(msgs, overhead)
+
+	// Check if the user has anything to broadcast in the space remaining
+	if d != nil {
+		toSend = m.getUserBroadcasts(d, overhead, limit-bytesUsed, toSend)
 	}
 	return toSend
 }
+
+// getUserBroadcasts appends the delegate's broadcasts that fit within the
+// given limit to toSend, framing each as a userMsg.
+func (m *Memberlist) getUserBroadcasts(d Delegate, overhead, avail int, toSend [][]byte) [][]byte {
+	if avail <= overhead+userMsgOverhead {
+		return toSend
+	}
+
+	userMsgs := d.GetBroadcasts(overhead+userMsgOverhead, avail)
+	for _, msg := range userMsgs {
+		buf := make([]byte, 1, len(msg)+1)
+		buf[0] = byte(userMsg)
+		buf = append(buf, msg...)
+		toSend = append(toSend, buf)
+	}
+	return toSend
+}
+
+// piggybackBytes returns the space taken up by the given messages.
+func piggybackBytes(msgs [][]byte, overhead int) int {
+	n := 0
+	for _, msg := range msgs {
+		n += len(msg) + overhead
+	}
+	return n
+}
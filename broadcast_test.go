@@ -1,6 +1,7 @@
 package memberlist
 
 import (
+	"fmt"
 	"reflect"
 	"testing"
 )
@@ -25,3 +26,53 @@ func TestMemberlistBroadcast_Message(t *testing.T) {
 		t.Fatalf("messages do not match")
 	}
 }
+
+// queueDelegate serves user broadcasts from a queue, respecting limits.
+type queueDelegate struct {
+	MockDelegate
+	queue *TransmitLimitedQueue
+}
+
+func (d *queueDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.queue.GetBroadcasts(overhead, limit)
+}
+
+func countUserBroadcasts(t *testing.T, reserve int) int {
+	d := &queueDelegate{queue: &TransmitLimitedQueue{
+		NumNodes:       func() int { return 1 },
+		RetransmitMult: 1,
+	}}
+	c := testConfig()
+	c.Delegate = d
+	c.UserBroadcastReserve = reserve
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	for i := 0; i < 10; i++ {
+		m.queueBroadcast(fmt.Sprintf("node%d", i), make([]byte, 100), nil)
+		d.queue.QueueBroadcast(&memberlistBroadcast{fmt.Sprintf("user%d", i), make([]byte, 50), nil})
+	}
+
+	users := 0
+	for _, msg := range m.getBroadcasts(2, 400) {
+		if messageType(msg[0]) == userMsg {
+			users++
+		}
+	}
+	return users
+}
+
+func TestMemberlist_GetBroadcasts_UserReserve(t *testing.T) {
+	// Our own messages come first and leave room for one user message.
+	if n := countUserBroadcasts(t, 0); n != 1 {
+		t.Fatalf("expected 1 user broadcast, got %d", n)
+	}
+
+	// Reserving space lets three through ahead of them.
+	if n := countUserBroadcasts(t, 160); n != 3 {
+		t.Fatalf("expected 3 user broadcasts, got %d", n)
+	}
+}
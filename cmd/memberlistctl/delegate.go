@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/hashicorp/memberlist"
+)
+
+// delegate lets the tool gossip broadcasts. It has no state of its own and
+// ignores any messages it receives.
+type delegate struct {
+	queue *memberlist.TransmitLimitedQueue
+}
+
+func (d *delegate) NodeMeta(limit int) []byte {
+	return nil
+}
+
+func (d *delegate) NotifyMsg(msg []byte) {}
+
+func (d *delegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.queue.GetBroadcasts(overhead, limit)
+}
+
+func (d *delegate) LocalState(join bool) []byte {
+	return nil
+}
+
+func (d *delegate) MergeRemoteState(buf []byte, join bool) {}
+
+// userBroadcast is a message given on the command line. Each one is
+// unique, so it never invalidates another.
+type userBroadcast struct {
+	msg  []byte
+	done chan struct{}
+}
+
+func (b *userBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (b *userBroadcast) Message() []byte {
+	return b.msg
+}
+
+func (b *userBroadcast) Finished() {
+	close(b.done)
+}
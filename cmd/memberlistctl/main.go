@@ -0,0 +1,356 @@
+/*
+memberlistctl is a small tool for operating clusters built on memberlist. It
+joins the cluster as an observer, runs a single command, and shuts down
+again. As an observer it learns the membership and can gossip, but it never
+announces itself, so the members don't track it or count it in their
+failure detection. The marker command is the exception: members send their
+receipts to the marker's origin, so for that the tool joins as a member and
+leaves gracefully afterwards.
+
+Usage:
+
+	memberlistctl [flags] <command> [args]
+
+The commands are:
+
+	members              list the live members
+	ping <node>          ping a member by name and print the round trip time
+	sync                 do a push/pull with a random member right away
+	query <host:port>    print a node's own view of the cluster; the node
+	                     must have Config.EnableQueries set
+	keys                 print the IDs of the configured keys
+	broadcast <message>  gossip a message to the members' delegates
+	marker               gossip a marker and report which members heard
+	                     it, after how many hops, and how quickly
+
+The label, keys and protocol settings must match the cluster's, or its
+members will ignore us. Keys are given base64 encoded with -key, which may
+be repeated, or as a keyring file written by Keyring.Save with -keyring. The
+keyring's passphrase is read from the environment variable named by
+-passphrase-env.
+*/
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// keyFlags collects repeated -key flags.
+type keyFlags [][]byte
+
+func (k *keyFlags) String() string {
+	return fmt.Sprintf("%d keys", len(*k))
+}
+
+func (k *keyFlags) Set(value string) error {
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("key is not valid base64: %v", err)
+	}
+	if err := memberlist.ValidateKey(key); err != nil {
+		return err
+	}
+	*k = append(*k, key)
+	return nil
+}
+
+// options holds the parsed command line.
+type options struct {
+	join          string
+	bind          string
+	port          int
+	name          string
+	label         string
+	keys          keyFlags
+	keyringPath   string
+	passphraseEnv string
+	timeout       time.Duration
+	verbose       bool
+
+	command string
+	args    []string
+}
+
+// run parses the arguments and runs the command, returning the exit
+// status.
+func run(args []string, stdout, stderr io.Writer) int {
+	opts, err := parseArgs(args, stderr)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(stderr, "Error: %v\n", err)
+		}
+		return 2
+	}
+
+	if err := runCommand(opts, stdout, stderr); err != nil {
+		fmt.Fprintf(stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+func parseArgs(args []string, stderr io.Writer) (*options, error) {
+	opts := &options{}
+	host, _ := os.Hostname()
+
+	flags := flag.NewFlagSet("memberlistctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&opts.join, "join", "", "comma separated addresses of members to join through")
+	flags.StringVar(&opts.bind, "bind", "0.0.0.0", "address to bind to")
+	flags.IntVar(&opts.port, "port", 0, "port to bind to, or 0 for any free port")
+	flags.StringVar(&opts.name, "name", fmt.Sprintf("memberlistctl-%s-%d", host, os.Getpid()), "node name to join as")
+	flags.StringVar(&opts.label, "label", "", "cluster label")
+	flags.Var(&opts.keys, "key", "base64 encoded encryption key; the first is the primary (repeatable)")
+	flags.StringVar(&opts.keyringPath, "keyring", "", "keyring file to load keys from")
+	flags.StringVar(&opts.passphraseEnv, "passphrase-env", "MEMBERLIST_KEYRING_PASSPHRASE", "environment variable holding the keyring passphrase")
+	flags.DurationVar(&opts.timeout, "timeout", 5*time.Second, "how long to wait for each operation")
+	flags.BoolVar(&opts.verbose, "v", false, "log memberlist's own messages to stderr")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: memberlistctl [flags] members|ping|sync|query|keys|broadcast|marker [args]\n\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return nil, fmt.Errorf("no command given")
+	}
+	opts.command = flags.Arg(0)
+	opts.args = flags.Args()[1:]
+	return opts, nil
+}
+
+func runCommand(opts *options, stdout, stderr io.Writer) error {
+	keyring, err := loadKeyring(opts)
+	if err != nil {
+		return err
+	}
+
+	switch opts.command {
+	case "keys":
+		return printKeys(keyring, stdout)
+	case "query":
+		if len(opts.args) != 1 {
+			return fmt.Errorf("query takes the host:port of a node")
+		}
+		list, _, err := create(opts, keyring, stderr)
+		if err != nil {
+			return err
+		}
+		defer list.Shutdown()
+		return query(list, opts.args[0], opts.timeout, stdout)
+	case "members", "ping", "sync", "broadcast", "marker":
+	default:
+		return fmt.Errorf("unknown command %q", opts.command)
+	}
+
+	if opts.join == "" {
+		return fmt.Errorf("-join is required for %s", opts.command)
+	}
+	list, d, err := create(opts, keyring, stderr)
+	if err != nil {
+		return err
+	}
+	defer list.Shutdown()
+	if _, err := list.Join(strings.Split(opts.join, ",")); err != nil {
+		return err
+	}
+	defer list.Leave(opts.timeout)
+
+	switch opts.command {
+	case "members":
+		return printMembers(list, opts.name, stdout)
+	case "ping":
+		if len(opts.args) != 1 {
+			return fmt.Errorf("ping takes the name of a node")
+		}
+		return ping(list, opts.args[0], opts.timeout, stdout)
+	case "sync":
+		if err := list.SyncNow(); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "Synced with the cluster, %d members alive\n", list.NumMembers())
+		return nil
+	case "marker":
+		return sendMarker(list, opts.timeout, stdout)
+	default:
+		if len(opts.args) != 1 {
+			return fmt.Errorf("broadcast takes a single message")
+		}
+		return broadcast(d, []byte(opts.args[0]), opts.timeout, stdout)
+	}
+}
+
+// loadKeyring builds a keyring from the -keyring and -key flags, returning
+// nil if neither was given.
+func loadKeyring(opts *options) (*memberlist.Keyring, error) {
+	var keyring *memberlist.Keyring
+	if opts.keyringPath != "" {
+		var err error
+		passphrase := []byte(os.Getenv(opts.passphraseEnv))
+		if keyring, err = memberlist.LoadKeyring(opts.keyringPath, passphrase); err != nil {
+			return nil, err
+		}
+	}
+	if len(opts.keys) == 0 {
+		return keyring, nil
+	}
+
+	if keyring == nil {
+		return memberlist.NewKeyring(opts.keys, opts.keys[0])
+	}
+	for _, key := range opts.keys {
+		if err := keyring.AddKey(key); err != nil {
+			return nil, err
+		}
+	}
+	if err := keyring.UseKey(opts.keys[0]); err != nil {
+		return nil, err
+	}
+	return keyring, nil
+}
+
+// create starts a memberlist for the tool, without joining anything. It's
+// an observer for every command but marker.
+func create(opts *options, keyring *memberlist.Keyring, stderr io.Writer) (*memberlist.Memberlist, *delegate, error) {
+	conf := memberlist.DefaultLANConfig()
+	conf.Observer = opts.command != "marker"
+	conf.Name = opts.name
+	conf.BindAddr = opts.bind
+	conf.BindPort = opts.port
+	conf.Label = opts.label
+	conf.Keyring = keyring
+	conf.LogOutput = ioutil.Discard
+	if opts.verbose {
+		conf.LogOutput = stderr
+	}
+
+	d := &delegate{queue: &memberlist.TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult}}
+	conf.Delegate = d
+
+	list, err := memberlist.Create(conf)
+	if err != nil {
+		return nil, nil, err
+	}
+	d.queue.NumNodes = list.NumMembers
+	return list, d, nil
+}
+
+func printKeys(keyring *memberlist.Keyring, stdout io.Writer) error {
+	if keyring == nil {
+		return fmt.Errorf("no keys given; use -key or -keyring")
+	}
+	for i, key := range keyring.GetKeys() {
+		if i == 0 {
+			fmt.Fprintf(stdout, "%s (primary)\n", memberlist.KeyID(key))
+		} else {
+			fmt.Fprintf(stdout, "%s\n", memberlist.KeyID(key))
+		}
+	}
+	return nil
+}
+
+// printMembers lists the live members, leaving out the tool itself.
+func printMembers(list *memberlist.Memberlist, self string, stdout io.Writer) error {
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name\tAddress\tProtocol\n")
+	for _, n := range list.Members() {
+		if n.Name == self {
+			continue
+		}
+		addr := net.JoinHostPort(n.Addr.String(), fmt.Sprintf("%d", n.Port))
+		fmt.Fprintf(w, "%s\t%s\t%d\n", n.Name, addr, n.PCur)
+	}
+	return w.Flush()
+}
+
+func ping(list *memberlist.Memberlist, name string, timeout time.Duration, stdout io.Writer) error {
+	rtt, err := list.PingNode(name, timeout)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Reply from %s: time=%v\n", name, rtt)
+	return nil
+}
+
+func query(list *memberlist.Memberlist, addr string, timeout time.Duration, stdout io.Writer) error {
+	report, err := list.QueryNode(addr, timeout)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Node:              %s\n", report.Name)
+	fmt.Fprintf(stdout, "Health score:      %d\n", report.HealthScore)
+	fmt.Fprintf(stdout, "Queued broadcasts: %d\n", report.QueuedBroadcasts)
+	fmt.Fprintf(stdout, "Queued callbacks:  %d\n\n", report.QueuedCallbacks)
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name\tAddress\tStatus\tIncarnation\n")
+	for _, n := range report.Members {
+		addr := net.JoinHostPort(n.Addr.String(), fmt.Sprintf("%d", n.Port))
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\n", n.Name, addr, n.Status, n.Incarnation)
+	}
+	return w.Flush()
+}
+
+func broadcast(d *delegate, msg []byte, timeout time.Duration, stdout io.Writer) error {
+	b := &userBroadcast{msg: msg, done: make(chan struct{})}
+	d.queue.QueueBroadcast(b)
+
+	select {
+	case <-b.done:
+		fmt.Fprintf(stdout, "Broadcast %d bytes\n", len(msg))
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out waiting for the broadcast to go out")
+	}
+}
+
+// sendMarker gossips a marker and prints the receipts, waiting until every
+// other member has replied or the timeout passes.
+func sendMarker(list *memberlist.Memberlist, timeout time.Duration, stdout io.Writer) error {
+	id, err := list.SendMarker()
+	if err != nil {
+		return err
+	}
+
+	var report memberlist.MarkerReport
+	deadline := time.Now().Add(timeout)
+	for {
+		report, _ = list.MarkerReport(id)
+		if len(report.Receipts) >= list.NumMembers()-1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	w := tabwriter.NewWriter(stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Name\tHops\tLatency\n")
+	for _, r := range report.Receipts {
+		fmt.Fprintf(w, "%s\t%d\t%v\n", r.Node, r.Hops, r.Latency)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if missing := list.NumMembers() - 1 - len(report.Receipts); missing > 0 {
+		fmt.Fprintf(stdout, "\n%d members didn't reply\n", missing)
+	}
+	return nil
+}
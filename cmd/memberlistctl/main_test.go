@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+type recordingDelegate struct {
+	sync.Mutex
+	msgs []string
+}
+
+func (d *recordingDelegate) NodeMeta(limit int) []byte { return nil }
+
+func (d *recordingDelegate) NotifyMsg(msg []byte) {
+	d.Lock()
+	defer d.Unlock()
+	d.msgs = append(d.msgs, string(msg))
+}
+
+func (d *recordingDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (d *recordingDelegate) LocalState(join bool) []byte                { return nil }
+func (d *recordingDelegate) MergeRemoteState(buf []byte, join bool)     {}
+
+func (d *recordingDelegate) received() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.msgs...)
+}
+
+func testNode(t *testing.T, key []byte) (*memberlist.Memberlist, *recordingDelegate, string) {
+	d := &recordingDelegate{}
+	conf := memberlist.DefaultLocalConfig()
+	conf.Name = "node"
+	conf.BindAddr = "127.0.0.1"
+	conf.BindPort = 0
+	conf.EnableQueries = true
+	conf.Delegate = d
+	conf.LogOutput = ioutil.Discard
+	if key != nil {
+		conf.SecretKey = key
+	}
+	list, err := memberlist.Create(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return list, d, fmt.Sprintf("127.0.0.1:%d", conf.BindPort)
+}
+
+func runCtl(t *testing.T, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestRun_Commands(t *testing.T) {
+	list, d, addr := testNode(t, nil)
+	defer list.Shutdown()
+
+	common := []string{"-join", addr, "-bind", "127.0.0.1", "-name", "ctl", "-timeout", "5s"}
+
+	code, out, errOut := runCtl(t, append(common, "members")...)
+	if code != 0 || !strings.Contains(out, "node") || strings.Contains(out, "ctl") {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+
+	code, out, errOut = runCtl(t, append(common, "ping", "node")...)
+	if code != 0 || !strings.HasPrefix(out, "Reply from node") {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+	if code, _, _ := runCtl(t, append(common, "ping", "nope")...); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+
+	code, out, errOut = runCtl(t, append(common, "sync")...)
+	if code != 0 || !strings.HasPrefix(out, "Synced") {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+
+	// Observing leaves no trace in the cluster.
+	if n := list.NumMembers(); n != 1 {
+		t.Fatalf("node should only know itself, not %d members", n)
+	}
+
+	// The marker joins as a member, for the receipts to reach it.
+	code, out, errOut = runCtl(t, append(common, "marker")...)
+	if code != 0 || !strings.Contains(out, "node") || strings.Contains(out, "didn't reply") {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+
+	code, out, errOut = runCtl(t, append(common, "broadcast", "hello")...)
+	if code != 0 || out != "Broadcast 5 bytes\n" {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(d.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if msgs := d.received(); len(msgs) == 0 || msgs[0] != "hello" {
+		t.Fatalf("bad: %v", msgs)
+	}
+
+	code, out, errOut = runCtl(t, "-bind", "127.0.0.1", "query", addr)
+	if code != 0 || !strings.Contains(out, "Node:              node") {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+}
+
+func TestRun_Keys(t *testing.T) {
+	k1 := []byte("0123456789abcdef")
+	k2 := []byte("fedcba9876543210")
+	code, out, errOut := runCtl(t,
+		"-key", base64.StdEncoding.EncodeToString(k1),
+		"-key", base64.StdEncoding.EncodeToString(k2),
+		"keys")
+	expected := fmt.Sprintf("%s (primary)\n%s\n", memberlist.KeyID(k1), memberlist.KeyID(k2))
+	if code != 0 || out != expected {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+
+	if code, _, _ := runCtl(t, "-key", "not base64!", "keys"); code != 2 {
+		t.Fatalf("bad: %d", code)
+	}
+	if code, _, _ := runCtl(t, "keys"); code != 1 {
+		t.Fatalf("bad: %d", code)
+	}
+}
+
+func TestRun_Encrypted(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	list, _, addr := testNode(t, key)
+	defer list.Shutdown()
+
+	code, out, errOut := runCtl(t, "-join", addr, "-bind", "127.0.0.1",
+		"-key", base64.StdEncoding.EncodeToString(key), "members")
+	if code != 0 || !strings.Contains(out, "node") {
+		t.Fatalf("bad: %d %q %q", code, out, errOut)
+	}
+
+	if code, _, _ := runCtl(t, "-join", addr, "-bind", "127.0.0.1", "members"); code != 1 {
+		t.Fatalf("should fail without the key")
+	}
+}
+
+func TestRun_Usage(t *testing.T) {
+	if code, _, _ := runCtl(t); code != 2 {
+		t.Fatalf("bad: %d", code)
+	}
+	if code, _, errOut := runCtl(t, "bogus"); code != 1 || !strings.Contains(errOut, "unknown command") {
+		t.Fatalf("bad: %d %q", code, errOut)
+	}
+	if code, _, errOut := runCtl(t, "members"); code != 1 || !strings.Contains(errOut, "-join is required") {
+		t.Fatalf("bad: %d %q", code, errOut)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 	"time"
+
+	"github.com/hashicorp/memberlist/coordinate"
 )
 
 type Config struct {
@@ -23,6 +25,18 @@ type Config struct {
 	AdvertiseAddr string
 	AdvertisePort int
 
+	// ReplyToAdvertiseAddr, for when the advertised address is a virtual
+	// IP fronted by a UDP load balancer or anycast, sends acks and nacks to
+	// the advertised address that pings and indirect pings carry, rather
+	// than to the packet's source, so replies come back through the virtual
+	// IP as well. Those are the only packets that are answered to an
+	// address: push/pulls and TCP pings are answered on the stream they
+	// came in on, which needs the load balancer to pass TCP through too.
+	// The address isn't authenticated, so it's only honoured when
+	// encryption is enabled; otherwise anyone could have our replies sent
+	// wherever they like.
+	ReplyToAdvertiseAddr bool
+
 	// ProtocolVersion is the configured protocol version that we
 	// will _speak_. This must be between ProtocolVersionMin and
 	// ProtocolVersionMax.
@@ -32,6 +46,13 @@ type Config struct {
 	// a remote node for a full state sync.
 	TCPTimeout time.Duration
 
+	// StreamHeaderTimeout bounds how long an incoming stream has to send
+	// its header: any PROXY protocol header, the label, the message type
+	// and, if sealed, the payload length. The payload then has the rest of
+	// TCPTimeout. This stops peers holding connections open by trickling
+	// bytes. Zero, or anything longer than TCPTimeout, uses TCPTimeout.
+	StreamHeaderTimeout time.Duration
+
 	// IndirectChecks is the number of nodes that will be asked to perform
 	// an indirect probe of a node in the case a direct probe fails. Memberlist
 	// waits for an ack from any single indirect node, so increasing this
@@ -80,6 +101,15 @@ type Config struct {
 	// nodes failed in a reasonable amount of time.
 	SuspicionMaxTimeoutMult int
 
+	// AdaptiveMultipliers raises RetransmitMult and SuspicionMult by one
+	// once the cluster reaches 100 nodes, and again every time it grows
+	// tenfold from there, lowering them as it shrinks. This lets settings
+	// tuned for a small cluster keep working as it scales, without having
+	// to restart nodes with new ones. So that a cluster hovering around
+	// one of these sizes doesn't flap between them, the multipliers are
+	// only lowered once it's 20% below.
+	AdaptiveMultipliers bool
+
 	// PushPullInterval is the interval between complete state syncs.
 	// Complete state syncs are done with a single node over TCP and are
 	// quite expensive relative to standard gossiped messages. Setting this
@@ -103,16 +133,48 @@ type Config struct {
 	ProbeInterval time.Duration
 	ProbeTimeout  time.Duration
 
+	// ProbeIntervalMult, if set, gives a multiplier on how often each node
+	// is probed, so that nodes of some class, picked out by their
+	// metadata, like battery-powered devices or far-off WAN members, are
+	// probed less often than the rest. A node with a multiplier of 3 is
+	// only probed every third time its turn comes round; 1 or less means
+	// as usual. It's called with the node lock held, so it must be quick
+	// and must not call back into memberlist.
+	ProbeIntervalMult func(*Node) int
+
+	// SkipProbeOnTraffic passes over a node's turn to be probed if we've
+	// had a packet from it within the last ProbeInterval, since it's
+	// plainly alive. This cuts down pings in a busy cluster. Packets are
+	// matched to nodes by source address, so it's best used with
+	// encryption, which stops others from passing for a member.
+	SkipProbeOnTraffic bool
+
 	// DisableTcpPings will turn off the fallback TCP pings that are attempted
 	// if the direct UDP ping fails. These get pipelined along with the
-	// indirect UDP pings.
+	// indirect UDP pings. It also stops us asking the helpers of indirect
+	// pings to try TCP, and trying it ourselves when we're asked.
 	DisableTcpPings bool
 
+	// DiscoverPacketSize has us find the largest packet that gets through
+	// to each peer, with a few padded pings after it first answers a probe
+	// and every ten minutes after that. Gossip and piggybacked broadcasts
+	// are packed to fit, rather than assuming 1400 bytes gets through, and
+	// SendToUDP sends messages too large for the peer over a stream
+	// instead. Turn this on when some paths have a smaller MTU, such as
+	// over a VPN or an IPv6 tunnel. See Memberlist.PeerTransports.
+	DiscoverPacketSize bool
+
 	// AwarenessMaxMultiplier will increase the probe interval if the node
 	// becomes aware that it might be degraded and not meeting the soft real
 	// time requirements to reliably probe other nodes.
 	AwarenessMaxMultiplier int
 
+	// PauseTimeout is how long a member may stay paused, with Pause,
+	// before we start probing it again. A paused member still answers
+	// probes, so this only catches one that failed while paused. Zero
+	// means paused members are never probed.
+	PauseTimeout time.Duration
+
 	// GossipInterval and GossipNodes are used to configure the gossip
 	// behavior of memberlist.
 	//
@@ -129,6 +191,150 @@ type Config struct {
 	GossipInterval time.Duration
 	GossipNodes    int
 
+	// RefuteFanout is the number of random nodes we send our alive message
+	// to straight away when refuting a suspect or dead message about us,
+	// on top of the node that made the accusation. This gets the refutation
+	// out faster than waiting for the next gossip round.
+	RefuteFanout int
+
+	// AliveCoalesceInterval is the window during which redundant alive
+	// messages are not rebroadcast. Once we've gossiped an alive message for
+	// a given node and incarnation, further copies of it arriving within
+	// this window are applied locally but not queued for broadcast again.
+	// Newer incarnations are always rebroadcast. This keeps alive messages
+	// from flooding the cluster during mass restarts. It's usually set to
+	// the GossipInterval, and setting it to zero disables the limit.
+	AliveCoalesceInterval time.Duration
+
+	// MetaMergeLWW settles metadata that differs between alive messages
+	// with the same incarnation, which can happen when a node restarts
+	// with new metadata before the rest of the cluster has seen it refute
+	// its old incarnation. Normally the first message to arrive wins, so
+	// members can disagree until the node's next update. With this set,
+	// each node stamps its metadata with when it last changed, and the
+	// newest stamp wins, with ties broken by comparing the metadata, so
+	// every member settles on the same metadata whatever order the
+	// messages arrive in. Members running an older version, or without it
+	// set, keep the first message they see.
+	MetaMergeLWW bool
+
+	// MaxMembers caps the number of nodes we track, including ourselves
+	// and nodes that are dead but not yet reaped. Once it's reached, nodes
+	// we haven't heard of before are ignored until room frees up. Zero
+	// means no limit.
+	MaxMembers int
+
+	// MaxStateMsgRate caps the alive, suspect and dead messages we accept
+	// from the network per second, with bursts of up to StateMsgBurst.
+	// Messages over the limit are dropped. Zero means no limit.
+	MaxStateMsgRate float64
+	StateMsgBurst   int
+
+	// MaxJoinRate caps the joins we take part in per second, with bursts
+	// of up to JoinBurst. Up to JoinQueueDepth joins over the limit wait
+	// for their turn; any more are turned away and told when to try
+	// again, which JoinWithOptions does if it has retries left. Zero means
+	// no limit.
+	MaxJoinRate    float64
+	JoinBurst      int
+	JoinQueueDepth int
+
+	// Observer looks in on a cluster without becoming a member of it. We
+	// learn the membership by push/pull and gossip as usual, and can send
+	// user messages and broadcasts, but we leave ourselves out of the state
+	// we push and never gossip alive or dead messages about ourselves, so
+	// the other members don't know we're there. We don't probe them either,
+	// so we take no part in failure detection. It's meant for tools that
+	// join a cluster briefly. Anything that relies on the other members
+	// knowing us, such as marker receipts, won't reach us.
+	Observer bool
+
+	// PartialView switches to a HyParView-style partial view of the
+	// cluster, for clusters too big for every member to track every other.
+	// We only track, probe and gossip with an active view of up to
+	// ActiveViewSize nodes, and keep up to PassiveViewSize more names and
+	// addresses in reserve to replace them as they fail. Members, events
+	// and delegates only see the active view.
+	PartialView     bool
+	ActiveViewSize  int
+	PassiveViewSize int
+
+	// MisbehaviorThreshold is the score at which a peer is quarantined.
+	// A packet from a peer's address that fails to decrypt or decode adds
+	// one to its score, and a state message with an impossible
+	// incarnation adds five. Scores halve every QuarantineDuration. A
+	// quarantined peer's packets are dropped, apart from replies to our
+	// probes, and it's not asked to help probe other nodes, for
+	// QuarantineDuration. Zero disables quarantine, though violations are
+	// still counted in metrics.
+	//
+	// Peers are known by source address, which can be forged unless
+	// encryption is enabled, so without it a forged packet can get an
+	// honest peer quarantined. A warning is logged at startup if
+	// quarantine is on without encryption.
+	MisbehaviorThreshold float64
+	QuarantineDuration   time.Duration
+
+	// RefuseDowngrades drops alive messages and push/pulls that advertise
+	// a lower maximum protocol or delegate protocol version for a node
+	// than we've seen from it before, and packets from an address that
+	// are protected less strongly than before, such as authenticated-only
+	// after encrypted. Downgrades are reported to Downgrade either way. A
+	// node that really has been rolled back must be let back in with
+	// Memberlist.AcceptDowngrade.
+	RefuseDowngrades bool
+
+	// FIPSMode requires Go's FIPS 140 crypto module, so that all of the
+	// cryptography memberlist does uses validated, approved algorithms.
+	// Create fails if the program wasn't built with
+	// GOEXPERIMENT=boringcrypto or run with GODEBUG=fips140=on. Building
+	// with the fips tag has the same effect. Keyring files are written
+	// with PBKDF2 rather than scrypt in FIPS mode.
+	FIPSMode bool
+
+	// DedupInterval is how long suspect and dead messages are remembered
+	// after we've handled them. Repeated copies of the same message (by
+	// node, incarnation, sender and type) arriving within this interval are
+	// dropped as soon as they're decoded, so they don't invoke delegates or
+	// get considered for rebroadcast again. Setting this to zero disables
+	// the cache.
+	DedupInterval time.Duration
+
+	// UserBroadcastReserve is the number of bytes of each packet's spare
+	// room that's offered to the delegate's broadcasts before memberlist's
+	// own. Normally memberlist's messages take what they need first, which
+	// can hold user broadcasts back for a long time while a lot of nodes
+	// are joining or failing. Any reserved room the delegate doesn't use
+	// is still available to memberlist. Memberlist.PiggybackStats shows how
+	// the room is being shared.
+	UserBroadcastReserve int
+
+	// PiggybackUserMessages fills the spare room in the packets sent by
+	// SendToUDP with our queued membership updates, as probes and gossip
+	// do. Applications whose own traffic far outweighs gossip spread
+	// updates much faster this way. These extra copies don't count against
+	// an update's retransmit limit, so gossip still spreads it as widely
+	// as it otherwise would, and they stop once gossip is done with it.
+	// Receivers need nothing new to take them in.
+	PiggybackUserMessages bool
+
+	// EnableUDPOffload uses UDP receive offload, where the kernel supports
+	// it, to cut the number of syscalls at high packet rates: the kernel
+	// can hand us several packets from the same peer in one read. We don't
+	// use segmentation offload for sending, since we almost never send a
+	// peer more than one packet at a time. It's only supported on Linux,
+	// and not when using a Router.
+	EnableUDPOffload bool
+
+	// EnableECN marks our UDP packets as ECN capable, so routers can mark
+	// them when a link is getting congested rather than drop them, and
+	// reads the marks on the packets we receive. When we see them we back
+	// off our gossip, first sending to fewer nodes each round and then
+	// skipping rounds, down to a sixteenth of the usual rate, and speed up
+	// again once they stop. Probes and push/pulls aren't affected. It's
+	// only supported on Linux, and not when using a Router.
+	EnableECN bool
+
 	// EnableCompression is used to control message compression. This can
 	// be used to reduce bandwidth usage at the cost of slightly more CPU
 	// utilization. This is only available starting at protocol version 1.
@@ -143,10 +349,96 @@ type Config struct {
 	// AES-192, or AES-256.
 	SecretKey []byte
 
+	// Passphrase, if set instead of SecretKey, derives the primary key
+	// from a passphrase with Argon2id, using the parameters and salt in
+	// PassphraseKDF. Without a salt there, a random one is used, which
+	// only works for the first member unless PassphraseAdopt is set. Every
+	// member must use the same passphrase. Passphrases can't be used in
+	// FIPS mode.
+	Passphrase []byte
+
+	// PassphraseAdopt, if PassphraseKDF has no salt, lets us learn the
+	// cluster's salt and costs from the node we first join, in the clear.
+	// Only costs between ours and a few times ours are adopted.
+	PassphraseAdopt bool
+
+	// PassphraseKDF holds the Argon2id parameters for Passphrase, and
+	// defaults to DefaultPassphraseKDF. Parameters learned on join must
+	// cost at least as much as these.
+	PassphraseKDF *PassphraseKDF
+
 	// The keyring holds all of the encryption keys used internally. It is
 	// automatically initialized using the SecretKey and SecretKeys values.
 	Keyring *Keyring
 
+	// AuthenticateOnly, when set along with a keyring, signs messages with
+	// an HMAC-SHA256 tag computed with the primary key instead of
+	// encrypting them. This keeps traffic inspectable, by an IDS for
+	// example, while still rejecting messages from anyone without a key.
+	// Members with a keyring accept both encrypted and authenticated
+	// messages regardless of this setting, so it can be changed with a
+	// rolling restart. Older versions of memberlist only understand
+	// encrypted messages.
+	AuthenticateOnly bool
+
+	// Entropy is the source of randomness for encryption nonces. It
+	// defaults to crypto/rand, and can be set to use a hardware RNG or,
+	// for deterministic tests, a fixed stream. It must be safe to read
+	// from concurrently.
+	Entropy io.Reader
+
+	// NonceStrategy chooses how nonces for encrypted messages are made.
+	// NonceRandom, the default, reads each one from Entropy. NonceCounter
+	// reads a random prefix from Entropy once and then counts messages,
+	// which suits devices where randomness is expensive but is only safe
+	// in clusters of up to a few thousand members per key.
+	NonceStrategy NonceStrategy
+
+	// SealUserMessages encrypts the payloads of SendToUDP and SendToTCP
+	// for their recipient alone, with a key derived from the cluster key
+	// and both node names, so that nodes forwarding them can't read them.
+	// It needs a keyring, and every member must be running a version that
+	// understands sealed messages.
+	SealUserMessages bool
+
+	// Label is an optional namespace for this cluster. When set, it is
+	// attached to every packet and stream we send, and anything arriving
+	// with a different label (or no label) is discarded. If encryption is
+	// enabled the label is also authenticated along with the payload. All
+	// members of a cluster must use the same label, which can be at most
+	// LabelMaxSize bytes.
+	Label string
+
+	// AcceptLabels lists labels we accept traffic with besides Label, for
+	// talking to members of clusters labelled differently. Only pings and
+	// user messages are taken under them: membership stays separate per
+	// label, so the clusters don't merge. An empty string accepts traffic
+	// without a label. We still send Label, except to peers given another
+	// with Memberlist.SetPeerLabel. With a shared Router, the instance is
+	// registered under each of them.
+	AcceptLabels []string
+
+	// AcceptProxyProtocol allows incoming streams to start with a PROXY
+	// protocol v2 header, as added by L4 proxies such as HAProxy, and uses
+	// the address in it as the peer's address for logging. Streams without
+	// a header are accepted as usual. Only enable this when the stream port
+	// can't be reached except through a trusted proxy, since anyone else
+	// could use the header to claim any address. It can't be set with a
+	// shared Router.
+	//
+	// EmitProxyProtocol writes a PROXY protocol v2 header describing our
+	// side of the connection at the start of every stream we open, for
+	// proxies that expect one.
+	AcceptProxyProtocol bool
+	EmitProxyProtocol   bool
+
+	// Router, if set, is a shared set of listeners that this memberlist
+	// will register with instead of binding its own, allowing several
+	// clusters to use the same port. BindAddr and BindPort are ignored in
+	// this case, and a non-empty Label unique to the router is required.
+	// The router is not shut down along with the memberlist.
+	Router *Router
+
 	// Delegate and Events are delegates for receiving and providing
 	// data to memberlist via callback mechanisms. For Delegate, see
 	// the Delegate interface. For Events, see the EventDelegate interface.
@@ -155,6 +447,9 @@ type Config struct {
 	// for any custom messages that the delegate might do (broadcasts,
 	// local/remote state, etc.). If you don't set these, then the protocol
 	// versions will just be zero, and version compliance won't be done.
+	//
+	// SetDelegates sets Delegate, Events, EventsV2, Conflict, Merge, Ping
+	// and Alive together, and can combine several event delegates.
 	Delegate                Delegate
 	DelegateProtocolVersion uint8
 	DelegateProtocolMin     uint8
@@ -164,6 +459,150 @@ type Config struct {
 	Merge                   MergeDelegate
 	Ping                    PingDelegate
 	Alive                   AliveDelegate
+	Suspicion               SuspicionDelegate
+	GossipTrace             GossipTraceDelegate
+
+	// EventsV2 is like Events, but is also told whether a node that left
+	// did so gracefully or was declared dead by failure detection. Events
+	// and EventsV2 may both be set, in which case both are notified.
+	EventsV2 EventDelegateV2
+
+	// Purge is notified when a dead node is removed from our state for
+	// good.
+	Purge PurgeDelegate
+
+	// Quarantine is notified when a misbehaving peer is quarantined.
+	Quarantine QuarantineDelegate
+
+	// Downgrade is notified when a peer offers older protocol versions or
+	// weaker encryption than it has before.
+	Downgrade DowngradeDelegate
+
+	// Maintenance is notified when members go into or come out of
+	// maintenance.
+	Maintenance MaintenanceDelegate
+
+	// Audit receives a record of security-relevant events: joins, leaves,
+	// keyring changes, decryption failures, refused merges and address
+	// conflicts.
+	Audit AuditSink
+
+	// Coordinator is notified whenever the member returned by
+	// Memberlist.Coordinator changes. CoordinatorFilter, if set, limits
+	// which members can be picked as coordinator, for example to those
+	// with a given role in their metadata. It's called with the node lock
+	// held, so it must be quick and must not call back into memberlist.
+	Coordinator       CoordinatorDelegate
+	CoordinatorFilter func(*Node) bool
+
+	// MulticastAddr, if set, is a multicast group, like "239.255.77.46:7947",
+	// that gossip is also sent to and read from. On a LAN this gets
+	// broadcasts to every member in one packet, speeding up convergence.
+	// MulticastInterface names the interface to join the group on; if
+	// empty the system picks one. Multicast isn't available with a Router.
+	//
+	// MulticastAnnounceInterval is how often we send our own alive message
+	// to the group, so that nodes on the LAN discover each other without
+	// having to Join. Zero disables announcements.
+	MulticastAddr             string
+	MulticastInterface        string
+	MulticastAnnounceInterval time.Duration
+
+	// PeerCachePath, if set, is a file where we remember the live members
+	// we've seen, so that Join can fall back to them if none of the given
+	// addresses work. PeerCacheMaxAge is how long a peer is remembered
+	// after it was last seen alive.
+	PeerCachePath   string
+	PeerCacheMaxAge time.Duration
+
+	// ReachabilityInterval, if set, is how often we ask a random member to
+	// ping another random member, to build up the picture of which members
+	// can reach each other returned by Memberlist.Reachability. This costs
+	// one indirect ping per interval. Zero disables sampling.
+	ReachabilityInterval time.Duration
+
+	// AutoTune applies Memberlist.Recommendations every AutoTuneInterval,
+	// adjusting the tunables to the loss rate and round trip times we see.
+	// The tunables in this Config are the least they're set to, and they
+	// go up to twice that.
+	AutoTune         bool
+	AutoTuneInterval time.Duration
+
+	// ReliableBroadcastCacheSize is the number of bytes of payloads sent
+	// with Memberlist.BroadcastReliable that we keep, so that other members
+	// can pull them from us. It's also the largest payload that can be
+	// sent. The oldest payloads are dropped first to stay within it.
+	ReliableBroadcastCacheSize int
+
+	// TreeGraftTimeout is how long we wait for a message sent with
+	// Memberlist.BroadcastTree after hearing about it, before asking the
+	// member that told us for it, and repairing the broadcast tree.
+	TreeGraftTimeout time.Duration
+
+	// UserMsgDedupWindow, if set, drops user messages that are copies of
+	// one handed to the delegate within this long, so that an application
+	// that rebroadcasts the messages it gets sees each only once. Zero
+	// delivers every copy.
+	UserMsgDedupWindow time.Duration
+
+	// LeaveQuorum, if set, makes Leave wait until this fraction of the
+	// other live members, from 0 to 1, have acknowledged that we're
+	// leaving, rather than just until the news has been gossiped. Only
+	// members new enough to acknowledge count. Leave's timeout still
+	// applies, and with none it gives up a ProbeInterval after the news
+	// has been gossiped. Zero doesn't wait for acknowledgements.
+	LeaveQuorum float64
+
+	// HealthAdvisories gossips the overrides made with
+	// Memberlist.MarkUnhealthy to the rest of the cluster, and applies
+	// the ones we hear about from other members. Without it, overrides
+	// are local and advisories from others are ignored. Only set it once
+	// every member understands advisories, since older ones count them as
+	// undecodable messages against the sender.
+	HealthAdvisories bool
+
+	// EnableQueries answers queries from Memberlist.QueryNode with our
+	// view of the cluster, health score and queue depths. Queries come in
+	// over the stream port and are only authenticated if encryption is
+	// enabled; otherwise anyone who can reach the port can read the member
+	// list.
+	EnableQueries bool
+
+	// CoordinateConfig, if set, enables Vivaldi network coordinates. Acks
+	// to our pings carry the responder's coordinate, which together with
+	// the measured round trip time is used to refine our own. See
+	// Memberlist.GetCoordinate and DistanceTo. Nodes without coordinates
+	// enabled interoperate fine; they just don't contribute samples.
+	CoordinateConfig *coordinate.Config
+
+	// ShutdownTimeout is how long Shutdown waits for in-flight probes,
+	// push/pulls and incoming streams to finish before closing the
+	// listeners and abandoning them. Zero, the default, means don't wait,
+	// which is how Shutdown has always behaved.
+	ShutdownTimeout time.Duration
+
+	// DelegateWorkers, if greater than zero, moves notification callbacks
+	// (the EventDelegate methods and Delegate.NotifyMsg) off the packet
+	// handling and probe paths and onto a pool of this many goroutines, so
+	// a slow delegate can't delay failure detection. Notifications about
+	// different nodes may then be delivered concurrently, and after the
+	// triggering state change has been superseded, but the events for any
+	// one node are always delivered in order. Callbacks that return data to
+	// memberlist are always run inline. Panics in notification callbacks
+	// are recovered and logged either way.
+	//
+	// DelegateQueueDepth is the number of notifications that can be waiting
+	// for a worker, split evenly between the workers. When a worker's queue
+	// is full, memberlist blocks until a slot frees up.
+	DelegateWorkers    int
+	DelegateQueueDepth int
+
+	// EventQueueDepth, if greater than zero, gives each event delegate,
+	// including each one combined by SetDelegates, its own goroutine and a
+	// queue of this many events, so that one that's slow or panics can't
+	// hold up the others. A delegate whose queue is full misses events,
+	// which are counted in the memberlist.events.dropped metric.
+	EventQueueDepth int
 
 	// DNSConfigPath points to the system's DNS config file, usually located
 	// at /etc/resolv.conf. It can be overridden via config for easier testing.
@@ -179,6 +618,67 @@ type Config struct {
 	// behavior for using LogOutput. You cannot specify both LogOutput and Logger
 	// at the same time.
 	Logger *log.Logger
+
+	// PacketLogger receives the warnings about individual bad packets and
+	// streams: ones that can't be decoded, decrypted or verified, carry the
+	// wrong label, or are of an unknown type. They're usually caused by
+	// port scanners or misconfigured peers rather than by a problem with
+	// the cluster, and can arrive at a high rate. If it's nil, they go to
+	// the regular logger.
+	PacketLogger *log.Logger
+
+	// PacketLogInterval and PacketLogBurst limit the rate of packet
+	// warnings to PacketLogBurst per PacketLogInterval. Any beyond that are
+	// counted, and the count is logged with the first warning after the
+	// interval is over. A zero PacketLogInterval logs every warning.
+	PacketLogInterval time.Duration
+	PacketLogBurst    int
+
+	// OnInternalError, if set, is called when memberlist recovers from a
+	// panic in one of its background goroutines, such as while decoding a
+	// hostile packet. The error is always an *InternalError. Memberlist
+	// logs the panic and carries on either way, but the callback gives the
+	// application a chance to report it, or to shut down if it would
+	// rather not run in an unknown state.
+	OnInternalError func(err error)
+}
+
+// Tunables are the settings that can be changed on a running Memberlist,
+// with SetTunables. They start out as the fields of the same names in its
+// Config, which document what each one does; the rest of the Config is
+// fixed once the Memberlist is created.
+type Tunables struct {
+	TCPTimeout              time.Duration
+	IndirectChecks          int
+	RetransmitMult          int
+	SuspicionMult           int
+	SuspicionMaxTimeoutMult int
+	ProbeTimeout            time.Duration
+
+	// GossipNodes can't be changed to or from zero while running, since
+	// that would turn non-piggyback gossip on or off.
+	GossipNodes int
+
+	RefuteFanout          int
+	UserBroadcastReserve  int
+	PiggybackUserMessages bool
+}
+
+// tunables returns the settings from the Config that can later be changed
+// with Memberlist.SetTunables.
+func (c *Config) tunables() Tunables {
+	return Tunables{
+		TCPTimeout:              c.TCPTimeout,
+		IndirectChecks:          c.IndirectChecks,
+		RetransmitMult:          c.RetransmitMult,
+		SuspicionMult:           c.SuspicionMult,
+		SuspicionMaxTimeoutMult: c.SuspicionMaxTimeoutMult,
+		ProbeTimeout:            c.ProbeTimeout,
+		GossipNodes:             c.GossipNodes,
+		RefuteFanout:            c.RefuteFanout,
+		UserBroadcastReserve:    c.UserBroadcastReserve,
+		PiggybackUserMessages:   c.PiggybackUserMessages,
+	}
 }
 
 // DefaultLANConfig returns a sane set of configurations for Memberlist.
@@ -197,6 +697,7 @@ func DefaultLANConfig() *Config {
 		AdvertisePort:           7946,
 		ProtocolVersion:         ProtocolVersion2Compatible,
 		TCPTimeout:              10 * time.Second,       // Timeout after 10 seconds
+		StreamHeaderTimeout:     2 * time.Second,        // Allow 2 seconds for stream headers
 		IndirectChecks:          3,                      // Use 3 nodes for the indirect ping
 		RetransmitMult:          4,                      // Retransmit a message 4 * log(N+1) nodes
 		SuspicionMult:           5,                      // Suspect a node for 5 * log(N+1) * Interval
@@ -205,17 +706,47 @@ func DefaultLANConfig() *Config {
 		ProbeTimeout:            500 * time.Millisecond, // Reasonable RTT time for LAN
 		ProbeInterval:           1 * time.Second,        // Failure check every second
 		DisableTcpPings:         false,                  // TCP pings are safe, even with mixed versions
+		SkipProbeOnTraffic:      false,                  // Probe every node in turn
 		AwarenessMaxMultiplier:  8,                      // Probe interval backs off to 8 seconds
+		PauseTimeout:            time.Hour,              // Long enough for most maintenance
+
+		GossipNodes:           3,                      // Gossip to 3 nodes
+		GossipInterval:        200 * time.Millisecond, // Gossip more rapidly
+		RefuteFanout:          3,                      // Refute to 3 nodes directly
+		AliveCoalesceInterval: 200 * time.Millisecond, // Suppress duplicate alives for one gossip interval
+		DedupInterval:         time.Second,            // Remember suspect/dead messages for a few gossip rounds
 
-		GossipNodes:    3,                      // Gossip to 3 nodes
-		GossipInterval: 200 * time.Millisecond, // Gossip more rapidly
+		PartialView:     false, // Track the full membership by default
+		ActiveViewSize:  5,     // Enough to stay connected in very large clusters
+		PassiveViewSize: 30,    // Six replacements for each active node
+
+		MisbehaviorThreshold: 0,               // Quarantine is opt-in
+		QuarantineDuration:   5 * time.Minute, // Scores halve, and quarantine lasts, 5 minutes
 
 		EnableCompression: true, // Enable compression by default
 
+		ShutdownTimeout:    0,    // Don't wait for in-flight operations unless asked to
+		DelegateWorkers:    0,    // Run notification callbacks inline by default
+		DelegateQueueDepth: 1024, // Notifications buffered when DelegateWorkers is set
+		EventQueueDepth:    0,    // Call event delegates one after another
+
 		SecretKey: nil,
 		Keyring:   nil,
 
+		PeerCacheMaxAge: 72 * time.Hour, // Survive a long weekend of seed downtime
+
+		AutoTune:         false,       // Recommend, but leave the tunables alone
+		AutoTuneInterval: time.Minute, // Plenty of probes between changes
+
 		DNSConfigPath: "/etc/resolv.conf",
+
+		PacketLogInterval: 10 * time.Second, // Log a few bad packets every 10 seconds
+		PacketLogBurst:    10,
+
+		ReliableBroadcastCacheSize: 16 << 20,               // Payloads of up to 16 MB
+		TreeGraftTimeout:           500 * time.Millisecond, // Several round trips, on a LAN
+		UserMsgDedupWindow:         0,                      // Deliver every copy
+		LeaveQuorum:                0,                      // Wait for the broadcast, not acks
 	}
 }
 
@@ -225,12 +756,15 @@ func DefaultLANConfig() *Config {
 func DefaultWANConfig() *Config {
 	conf := DefaultLANConfig()
 	conf.TCPTimeout = 30 * time.Second
+	conf.StreamHeaderTimeout = 5 * time.Second
 	conf.SuspicionMult = 6
 	conf.PushPullInterval = 60 * time.Second
 	conf.ProbeTimeout = 3 * time.Second
 	conf.ProbeInterval = 5 * time.Second
 	conf.GossipNodes = 4 // Gossip less frequently, but to an additional node
 	conf.GossipInterval = 500 * time.Millisecond
+	conf.AliveCoalesceInterval = 500 * time.Millisecond
+	conf.DedupInterval = 3 * time.Second
 	return conf
 }
 
@@ -247,6 +781,8 @@ func DefaultLocalConfig() *Config {
 	conf.ProbeTimeout = 200 * time.Millisecond
 	conf.ProbeInterval = time.Second
 	conf.GossipInterval = 100 * time.Millisecond
+	conf.AliveCoalesceInterval = 100 * time.Millisecond
+	conf.DedupInterval = 500 * time.Millisecond
 	return conf
 }
 
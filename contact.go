@@ -0,0 +1,159 @@
+package memberlist
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Contact hints let us spare a peer our probes when we already know it's
+alive. A peer reported by ObserveContact since its last turn to be probed
+has its next turn passed over, as if it had been probed and answered. Once
+the application stops talking to it, it's probed again as usual.
+
+With SkipProbeOnTraffic, we also take the packets we get as hints: a peer
+we've had a packet from within the last probe interval has its turn passed
+over too. In a chatty cluster most turns are spared, roughly halving the
+pings sent. Only packets that got through our label and encryption checks
+count, and they're matched to a peer by their source address, so without
+encryption anyone able to spoof a member's address could hold off its
+probes.
+
+The hints are local: nothing is gossiped, and they only stand in for
+probes of alive nodes. A suspect node is still probed, since only it can
+refute the suspicion, and a dead one is left to the usual reaping.
+*/
+
+// maxHeardPeers is the most addresses we remember packets from.
+const maxHeardPeers = 65536
+
+// heardPeers remembers when we last had a packet from each address, for
+// SkipProbeOnTraffic.
+type heardPeers struct {
+	sync.Mutex
+	last map[string]time.Time
+}
+
+// record notes a packet from the given address, forgetting addresses we
+// haven't heard from within the window if we're remembering too many.
+func (h *heardPeers) record(addr string, now time.Time, window time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.last == nil {
+		h.last = make(map[string]time.Time)
+	}
+	if _, ok := h.last[addr]; !ok && len(h.last) >= maxHeardPeers {
+		for a, t := range h.last {
+			if now.Sub(t) >= window {
+				delete(h.last, a)
+			}
+		}
+		if len(h.last) >= maxHeardPeers {
+			return
+		}
+	}
+	h.last[addr] = now
+}
+
+// since returns true if we've had a packet from the address since the
+// given time.
+func (h *heardPeers) since(addr string, t time.Time) bool {
+	h.Lock()
+	defer h.Unlock()
+	last, ok := h.last[addr]
+	return ok && last.After(t)
+}
+
+// contacts remembers the last contact ObserveContact reported with each
+// node. It's kept apart from the node state so that reports, which come
+// with the application's traffic, only need the node lock for reading.
+type contacts struct {
+	sync.Mutex
+	last map[string]int64
+}
+
+// record notes contact with a node at the given time, keeping the latest.
+func (c *contacts) record(node string, at int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.last == nil {
+		c.last = make(map[string]int64)
+	}
+	if at > c.last[node] {
+		c.last[node] = at
+	}
+}
+
+// since returns true if there's been contact with a node after the given
+// time.
+func (c *contacts) since(node string, t int64) bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.last[node] > t
+}
+
+// forget drops what we know about a node that's gone.
+func (c *contacts) forget(node string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.last, node)
+}
+
+// observeTraffic notes an authenticated packet from a peer.
+func (m *Memberlist) observeTraffic(from net.Addr, now time.Time) {
+	if !m.config.SkipProbeOnTraffic {
+		return
+	}
+	m.heard.record(from.String(), now, m.config.ProbeInterval)
+}
+
+// ObserveContact reports that the application has just talked to the named
+// node, at the given time, so there's no need to probe it until its next
+// turn. Contact reported for unknown nodes, or for us, is ignored, and a
+// time in the future is taken as now.
+func (m *Memberlist) ObserveContact(node string, at time.Time) {
+	if node == m.config.Name {
+		return
+	}
+	if now := time.Now(); at.After(now) {
+		at = now
+	}
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	if _, ok := m.nodeMap[node]; !ok {
+		return
+	}
+	m.contacts.record(node, at.UnixNano())
+}
+
+// spareProbe returns true if a live node's turn to be probed should be
+// passed over, because we've had contact with it since its last turn, or
+// traffic from it within the last probe interval. It starts a new turn.
+// The node lock must be held.
+func (m *Memberlist) spareProbe(state *nodeState) bool {
+	now := time.Now()
+	turn := atomic.SwapInt64(&state.lastTurn, now.UnixNano())
+	if !state.State.active() {
+		return false
+	}
+	if m.contacts.since(state.Name, turn) {
+		metrics.IncrCounter([]string{"memberlist", "probe", "contact_skip"}, 1)
+		return true
+	}
+	if m.config.SkipProbeOnTraffic {
+		addr := net.JoinHostPort(state.Addr.String(), strconv.Itoa(int(state.Port)))
+		if m.heard.since(addr, now.Add(-m.config.ProbeInterval)) {
+			metrics.IncrCounter([]string{"memberlist", "probe", "traffic_skip"}, 1)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package memberlist
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// probeTurn probes until the named node's turn has come round once.
+func probeTurn(t *testing.T, m *Memberlist, name string) {
+	m.nodeLock.RLock()
+	state := m.nodeMap[name]
+	m.nodeLock.RUnlock()
+	turn := atomic.LoadInt64(&state.lastTurn)
+	for i := 0; atomic.LoadInt64(&state.lastTurn) == turn; i++ {
+		if i > 100 {
+			t.Fatalf("node never came up")
+		}
+		m.probe()
+	}
+}
+
+func TestMemberlist_ObserveContact(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{
+		Node:        addr1.String(),
+		Addr:        []byte(addr1),
+		Port:        uint16(m1.config.BindPort),
+		Incarnation: 1,
+	}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{
+		Node:        addr2.String(),
+		Addr:        []byte(addr2),
+		Port:        uint16(m2.config.BindPort),
+		Incarnation: 1,
+	}
+	m1.aliveNode(&a2, nil, false)
+	name := addr2.String()
+
+	// Contact spares the node its next turn, but not the one after.
+	m1.ObserveContact(name, time.Now())
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 0 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 1 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// Contact from before the last turn doesn't count.
+	m1.ObserveContact(name, time.Now().Add(-time.Hour))
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 2 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// Contact in the future counts as now, so it doesn't hold off probes
+	// past the next turn.
+	m1.ObserveContact(name, time.Now().Add(time.Hour))
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 2 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 3 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// A node in maintenance is spared too, since it's probed like an alive one.
+	m1.nodeLock.Lock()
+	m1.nodeMap[name].State = stateMaintenance
+	m1.nodeLock.Unlock()
+	m1.ObserveContact(name, time.Now())
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 3 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// A suspect node is probed regardless.
+	m1.nodeLock.Lock()
+	m1.nodeMap[name].State = stateSuspect
+	m1.nodeLock.Unlock()
+	m1.ObserveContact(name, time.Now())
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 4 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// Unknown nodes are ignored.
+	m1.ObserveContact("nope", time.Now())
+	if _, ok := m1.MemberStatus("nope"); ok {
+		t.Fatalf("should not know the node")
+	}
+}
+
+func TestMemberlist_SkipProbeOnTraffic(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.SkipProbeOnTraffic = true
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{
+		Node:        addr1.String(),
+		Addr:        []byte(addr1),
+		Port:        uint16(m1.config.BindPort),
+		Incarnation: 1,
+	}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{
+		Node:        addr2.String(),
+		Addr:        []byte(addr2),
+		Port:        uint16(m2.config.BindPort),
+		Incarnation: 1,
+	}
+	m1.aliveNode(&a2, nil, false)
+	name := addr2.String()
+	from := &net.UDPAddr{IP: addr2, Port: m2.config.BindPort}
+
+	// A packet within the last probe interval spares the node its turn.
+	m1.observeTraffic(from, time.Now())
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 0 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// An older one doesn't.
+	m1.heard.record(from.String(), time.Now().Add(-2*m1.config.ProbeInterval), m1.config.ProbeInterval)
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 1 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// The ack to that probe is traffic too, so it spares the next turn.
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 1 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// Packets from another port don't count.
+	m1.heard.Lock()
+	m1.heard.last = nil
+	m1.heard.Unlock()
+	m1.observeTraffic(&net.UDPAddr{IP: addr2, Port: m2.config.BindPort + 1}, time.Now())
+	probeTurn(t, m1, name)
+	if m1.sequenceNum != 2 {
+		t.Fatalf("bad seqno %v", m1.sequenceNum)
+	}
+
+	// Traffic isn't tracked unless asked for.
+	m2.observeTraffic(&net.UDPAddr{IP: addr1, Port: m1.config.BindPort}, time.Now())
+	m2.heard.Lock()
+	defer m2.heard.Unlock()
+	if m2.heard.last != nil {
+		t.Fatalf("bad: %v", m2.heard.last)
+	}
+}
@@ -0,0 +1,322 @@
+package memberlist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+/*
+Reliable broadcasts spread payloads that are too big to piggyback on
+gossip. Only a small announcement, naming the payload by its SHA-256 and
+saying who has it, is gossiped. A node that hears about a payload it
+doesn't have pulls it over a stream from the node that told it, checks the
+hash, hands it to the delegate through NotifyMsg, and then announces it
+again naming itself as a holder. So the payload spreads in the same
+epidemic way as any other broadcast, but each node downloads it only once
+and the load of serving it is spread around the cluster.
+
+Each node keeps the payloads it has in a cache of up to
+ReliableBroadcastCacheSize bytes to serve pulls from. If a pull fails, we
+try again when another holder announces the payload. Only maxContentPulls
+pulls run at once; an announcement that arrives while they're all busy is
+passed over, and picked up again when the payload is next announced.
+*/
+
+// maxSeenContent is how many payload IDs we remember, so that we don't
+// pull the same payload again after it's dropped from the cache.
+const maxSeenContent = 1024
+
+// maxContentPulls is how many payloads we pull at once.
+const maxContentPulls = 4
+
+// contentAnnounce is gossiped to say that a node has a payload.
+type contentAnnounce struct {
+	ID     []byte `codec:"ID"` // SHA-256 of the payload
+	Size   int    `codec:"Size"`
+	Holder string `codec:"Holder"`
+	Addr   []byte `codec:"Addr"`
+	Port   uint16 `codec:"Port"`
+}
+
+// contentPull asks a holder for a payload over a stream.
+type contentPull struct {
+	ID []byte `codec:"ID"`
+}
+
+// contentResp answers a contentPull with either the payload or the reason
+// it can't be had.
+type contentResp struct {
+	Error string `codec:"Error,omitempty"`
+	Body  []byte `codec:"Body,omitempty"`
+}
+
+// contentStore tracks the payloads we've seen and caches their bodies.
+type contentStore struct {
+	sync.Mutex
+	seen      map[string]bool // True once we have the payload
+	seenOrder []string        // Seen IDs, oldest first
+	bodies    map[string][]byte
+	order     []string // Cached IDs, oldest first
+	size      int
+}
+
+// start records that we're getting a payload, returning false if we
+// already have it or are already pulling it.
+func (s *contentStore) start(id string) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.seen[id]; ok {
+		return false
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	s.seen[id] = false
+	s.seenOrder = append(s.seenOrder, id)
+	if len(s.seenOrder) > maxSeenContent {
+		delete(s.seen, s.seenOrder[0])
+		s.seenOrder = s.seenOrder[1:]
+	}
+	return true
+}
+
+// failed forgets a payload we couldn't get, so it's pulled again the next
+// time it's announced.
+func (s *contentStore) failed(id string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if have, ok := s.seen[id]; !ok || have {
+		return
+	}
+	delete(s.seen, id)
+	for i, seen := range s.seenOrder {
+		if seen == id {
+			s.seenOrder = append(s.seenOrder[:i], s.seenOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// add caches a payload, dropping the oldest ones to stay within limit.
+func (s *contentStore) add(id string, body []byte, limit int) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.seen != nil {
+		s.seen[id] = true
+	}
+	if _, ok := s.bodies[id]; ok {
+		return
+	}
+	if s.bodies == nil {
+		s.bodies = make(map[string][]byte)
+	}
+	s.bodies[id] = body
+	s.order = append(s.order, id)
+	s.size += len(body)
+	for s.size > limit && len(s.order) > 0 {
+		s.size -= len(s.bodies[s.order[0]])
+		delete(s.bodies, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// get returns a cached payload.
+func (s *contentStore) get(id string) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+	body, ok := s.bodies[id]
+	return body, ok
+}
+
+// contentKey is the broadcast key for a payload announcement.
+func contentKey(id []byte) string {
+	return fmt.Sprintf("content:%x", id)
+}
+
+// BroadcastReliable disseminates a payload too large to gossip to every
+// member of the cluster, which receive it through the delegate's NotifyMsg.
+// Only an announcement is gossiped, and members pull the payload itself
+// over a stream from whoever told them about it, so it can be as large as
+// ReliableBroadcastCacheSize. Members running an older version won't get
+// the payload.
+//
+// This returns once the payload is announced, not once it has been
+// delivered. Broadcasting the same payload twice only delivers it once.
+func (m *Memberlist) BroadcastReliable(msg []byte) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
+	if len(msg) > m.config.ReliableBroadcastCacheSize {
+		return fmt.Errorf("Payload of %d bytes is larger than ReliableBroadcastCacheSize", len(msg))
+	}
+
+	sum := sha256.Sum256(msg)
+	id := sum[:]
+	m.content.start(string(id))
+	m.content.add(string(id), msg, m.config.ReliableBroadcastCacheSize)
+	return m.announceContent(id, len(msg))
+}
+
+// announceContent gossips that we have a payload.
+func (m *Memberlist) announceContent(id []byte, size int) error {
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[m.config.Name]
+	var a contentAnnounce
+	if ok {
+		a = contentAnnounce{
+			ID:     id,
+			Size:   size,
+			Holder: m.config.Name,
+			Addr:   state.Addr,
+			Port:   state.Port,
+		}
+	}
+	m.nodeLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Cannot announce a payload before we're alive")
+	}
+
+	m.encodeAndBroadcast(contentKey(id), contentAnnounceMsg, &a)
+	return nil
+}
+
+func (m *Memberlist) handleContentAnnounce(buf []byte, from net.Addr) {
+	var a contentAnnounce
+	if err := decode(buf, &a); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode payload announcement: %s %s", err, LogAddress(from))
+		return
+	}
+	if len(a.ID) != sha256.Size || a.Size < 0 {
+		m.packetLog.Printf("[ERR] memberlist: Invalid payload announcement %s", LogAddress(from))
+		return
+	}
+	if a.Size > m.config.ReliableBroadcastCacheSize {
+		m.logger.Printf("[WARN] memberlist: Ignoring payload of %d bytes from %s, larger than ReliableBroadcastCacheSize",
+			a.Size, a.Holder)
+		return
+	}
+
+	if !m.content.start(string(a.ID)) {
+		return
+	}
+	select {
+	case m.contentPulls <- struct{}{}:
+	default:
+		m.content.failed(string(a.ID))
+		metrics.IncrCounter([]string{"memberlist", "content", "pull_deferred"}, 1)
+		return
+	}
+	go func() {
+		defer func() { <-m.contentPulls }()
+		m.pullContent(a)
+	}()
+}
+
+// pullContent fetches an announced payload from its holder, delivers it,
+// and announces that we have it too.
+func (m *Memberlist) pullContent(a contentAnnounce) {
+	defer m.recoverInternal("content")
+
+	id := string(a.ID)
+	addr := net.JoinHostPort(net.IP(a.Addr).String(), strconv.Itoa(int(a.Port)))
+	body, err := m.fetchContent(addr, a.ID)
+	if err == nil {
+		if sum := sha256.Sum256(body); !bytes.Equal(sum[:], a.ID) {
+			err = fmt.Errorf("Payload doesn't match its hash")
+		}
+	}
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to pull payload from %s: %s", a.Holder, err)
+		metrics.IncrCounter([]string{"memberlist", "content", "pull_failed"}, 1)
+		m.content.failed(id)
+		return
+	}
+	metrics.IncrCounter([]string{"memberlist", "content", "pulled"}, float32(len(body)))
+	m.content.add(id, body, m.config.ReliableBroadcastCacheSize)
+
+	if d := m.config.Delegate; d != nil {
+		m.dispatchDelegate("", "notify_msg", func() {
+			d.NotifyMsg(body)
+		})
+	}
+
+	if err := m.announceContent(a.ID, len(body)); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to announce payload: %s", err)
+	}
+}
+
+// fetchContent pulls a payload from the node listening at the given
+// address.
+func (m *Memberlist) fetchContent(addr string, id []byte) ([]byte, error) {
+	deadline := time.Now().Add(m.tune().TCPTimeout)
+	conn, err := m.dialTCP(addr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return nil, err
+	}
+
+	out, err := encode(contentPullMsg, &contentPull{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rawSendMsgTCP(conn, out.Bytes()); err != nil {
+		return nil, err
+	}
+
+	msgType, _, dec, err := m.readTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != contentRespMsg {
+		return nil, fmt.Errorf("Unexpected msgType (%d) from payload pull %s", msgType, LogConn(conn))
+	}
+
+	var resp contentResp
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("Pull refused: %s", resp.Error)
+	}
+	return resp.Body, nil
+}
+
+// handleContentPull answers a payload pull read from a stream.
+func (m *Memberlist) handleContentPull(conn net.Conn, dec *codec.Decoder) error {
+	var p contentPull
+	if err := dec.Decode(&p); err != nil {
+		return err
+	}
+
+	var resp contentResp
+	if body, ok := m.content.get(string(p.ID)); ok {
+		resp.Body = body
+	} else {
+		resp.Error = "payload not found"
+	}
+
+	out, err := encode(contentRespMsg, &resp)
+	if err != nil {
+		return err
+	}
+	return m.rawSendMsgTCP(conn, out.Bytes())
+}
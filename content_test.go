@@ -0,0 +1,140 @@
+package memberlist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestContentStore(t *testing.T) {
+	var s contentStore
+
+	if !s.start("a") {
+		t.Fatalf("should be new")
+	}
+	if s.start("a") {
+		t.Fatalf("should already be pulling")
+	}
+
+	// A failed pull can be tried again, and isn't left behind in the
+	// order it was seen.
+	s.failed("a")
+	if len(s.seenOrder) != 0 {
+		t.Fatalf("bad: %v", s.seenOrder)
+	}
+	if !s.start("a") {
+		t.Fatalf("should be new after failing")
+	}
+
+	s.add("a", []byte("aaaa"), 10)
+	s.failed("a")
+	if s.start("a") {
+		t.Fatalf("should not pull what we have")
+	}
+	if body, ok := s.get("a"); !ok || string(body) != "aaaa" {
+		t.Fatalf("bad: %q %v", body, ok)
+	}
+
+	// The oldest is dropped to make room, but is still known.
+	s.start("b")
+	s.add("b", []byte("bbbbbbbb"), 10)
+	if _, ok := s.get("a"); ok {
+		t.Fatalf("should have been dropped")
+	}
+	if _, ok := s.get("b"); !ok {
+		t.Fatalf("should be cached")
+	}
+	if s.size != 8 {
+		t.Fatalf("bad size: %d", s.size)
+	}
+	if s.start("a") {
+		t.Fatalf("should still be seen")
+	}
+}
+
+func TestMemberlist_BroadcastReliable(t *testing.T) {
+	c1 := testConfig()
+	c1.GossipInterval = 10 * time.Millisecond
+	m1, err := NewMemberlistOnOpenPort(c1)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+
+	d2 := &MockDelegate{}
+
+	// Create a second node
+	c := DefaultLANConfig()
+	addr1 := getBindAddr()
+	c.Name = addr1.String()
+	c.BindAddr = addr1.String()
+	c.BindPort = m1.config.BindPort
+	c.Delegate = d2
+
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	if err := m1.BroadcastReliable(make([]byte, m1.config.ReliableBroadcastCacheSize+1)); err == nil {
+		t.Fatalf("should refuse oversized payload")
+	}
+
+	// Far too big to fit in a packet.
+	payload := bytes.Repeat([]byte("payload"), 20000)
+	if err := m1.BroadcastReliable(payload); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if msgs := d2.getMessages(); len(msgs) != 1 || !bytes.Equal(msgs[0], payload) {
+		t.Fatalf("expected payload, got %d messages", len(msgs))
+	}
+
+	// m2 can now serve it too.
+	sum := sha256.Sum256(payload)
+	body, ok := m2.content.get(string(sum[:]))
+	if !ok || !bytes.Equal(body, payload) {
+		t.Fatalf("m2 should have cached the payload")
+	}
+}
+
+func TestMemberlist_HandleContentAnnounce_PullLimit(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	// Take every pull slot, as if they were all busy.
+	for i := 0; i < maxContentPulls; i++ {
+		m.contentPulls <- struct{}{}
+	}
+
+	sum := sha256.Sum256([]byte("payload"))
+	a := contentAnnounce{
+		ID:     sum[:],
+		Size:   7,
+		Holder: "other",
+		Addr:   []byte{127, 0, 0, 1},
+		Port:   1,
+	}
+	buf, err := encode(contentAnnounceMsg, &a)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.handleContentAnnounce(buf.Bytes()[1:], nil)
+
+	// It's passed over, so that the next announcement is pulled.
+	if !m.content.start(string(a.ID)) {
+		t.Fatalf("should not have started a pull")
+	}
+	if len(m.content.seenOrder) != 1 {
+		t.Fatalf("bad: %d", len(m.content.seenOrder))
+	}
+}
@@ -0,0 +1,166 @@
+package coordinate
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestClient_NewClient(t *testing.T) {
+	config := DefaultConfig()
+
+	config.Dimensionality = 0
+	if _, err := NewClient(config); err == nil {
+		t.Fatalf("expected an error for zero dimensionality")
+	}
+
+	config.Dimensionality = 7
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	origin := NewCoordinate(config)
+	if !origin.IsCompatibleWith(client.GetCoordinate()) {
+		t.Fatalf("bad coordinate")
+	}
+}
+
+func TestClient_Update(t *testing.T) {
+	config := DefaultConfig()
+	config.Dimensionality = 3
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make sure the Euclidean part of our coordinate is what we expect.
+	c := client.GetCoordinate()
+	verifyEqualVectors(t, c.Vec, []float64{0.0, 0.0, 0.0})
+
+	// Place a node right above the client and observe an RTT longer than
+	// the client expects, given its distance.
+	other := NewCoordinate(config)
+	other.Vec[2] = 0.001
+	rtt := time.Duration(2.0 * other.Vec[2] * 1.0e9)
+	c, err = client.Update("node", other, rtt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The client should have scooted down to get away from it.
+	if !(c.Vec[2] < 0.0) {
+		t.Fatalf("client z coordinate %9.6f should be < 0.0", c.Vec[2])
+	}
+
+	// Set the coordinate to a known state.
+	c.Vec[2] = 99.0
+	client.SetCoordinate(c)
+	c = client.GetCoordinate()
+	verifyEqualFloats(t, c.Vec[2], 99.0)
+
+	// Incompatible and invalid coordinates are refused.
+	config.Dimensionality = 2
+	if _, err := client.Update("node", NewCoordinate(config), rtt); err == nil {
+		t.Fatalf("expected an error for an incompatible coordinate")
+	}
+	other.Vec[0] = math.NaN()
+	if _, err := client.Update("node", other, rtt); err == nil {
+		t.Fatalf("expected an error for an invalid coordinate")
+	}
+}
+
+func TestClient_InvalidInPingValues(t *testing.T) {
+	config := DefaultConfig()
+	config.Dimensionality = 3
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	other := NewCoordinate(config)
+	other.Vec[2] = 0.001
+	dist := client.DistanceTo(other)
+
+	for _, rtt := range []time.Duration{-1, 11 * time.Second} {
+		if _, err := client.Update("node", other, rtt); err == nil {
+			t.Fatalf("expected an error for rtt %v", rtt)
+		}
+		if client.DistanceTo(other) != dist {
+			t.Fatalf("distance shouldn't change for a bad rtt")
+		}
+	}
+}
+
+func TestClient_DistanceTo(t *testing.T) {
+	config := DefaultConfig()
+	config.Dimensionality = 3
+	config.HeightMin = 0
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Fiddle a raw coordinate to put it a specific number of seconds away.
+	other := NewCoordinate(config)
+	other.Vec[2] = 12.345
+	expected := time.Duration(other.Vec[2] * 1.0e9)
+	if dist := client.DistanceTo(other); dist != expected {
+		t.Fatalf("distance doesn't match %9.6f != %9.6f", dist.Seconds(), expected.Seconds())
+	}
+}
+
+func TestClient_latencyFilter(t *testing.T) {
+	config := DefaultConfig()
+	config.LatencyFilterSize = 3
+
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Make sure we get the median, and that things age properly.
+	verifyEqualFloats(t, client.latencyFilter("alice", 0.201), 0.201)
+	verifyEqualFloats(t, client.latencyFilter("alice", 0.200), 0.201)
+	verifyEqualFloats(t, client.latencyFilter("alice", 0.207), 0.201)
+
+	// This glitch will get median-ed out and never seen by Vivaldi.
+	verifyEqualFloats(t, client.latencyFilter("alice", 1.9), 0.207)
+	verifyEqualFloats(t, client.latencyFilter("alice", 0.203), 0.207)
+	verifyEqualFloats(t, client.latencyFilter("alice", 0.199), 0.203)
+	verifyEqualFloats(t, client.latencyFilter("alice", 0.211), 0.203)
+
+	// Make sure different nodes are not coupled.
+	verifyEqualFloats(t, client.latencyFilter("bob", 0.310), 0.310)
+
+	// Make sure we don't leak coordinates for nodes that leave.
+	client.ForgetNode("alice")
+	verifyEqualFloats(t, client.latencyFilter("alice", 0.888), 0.888)
+}
+
+func TestClient_Converges(t *testing.T) {
+	config := DefaultConfig()
+	a, _ := NewClient(config)
+	b, _ := NewClient(config)
+
+	// Two nodes pinging each other should settle at about the right
+	// distance apart.
+	rtt := 10 * time.Millisecond
+	for i := 0; i < 1000; i++ {
+		if _, err := a.Update("b", b.GetCoordinate(), rtt); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err := b.Update("a", a.GetCoordinate(), rtt); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	dist := a.DistanceTo(b.GetCoordinate())
+	if dist < 9*time.Millisecond || dist > 11*time.Millisecond {
+		t.Fatalf("bad distance: %v", dist)
+	}
+	if a.Stats().Resets != 0 {
+		t.Fatalf("unexpected resets")
+	}
+}
@@ -0,0 +1,181 @@
+package coordinate
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// verifyEqualFloats will compare f1 and f2 and fail if they are not
+// "equal" within a threshold.
+func verifyEqualFloats(t *testing.T, f1 float64, f2 float64) {
+	const zeroThreshold = 1.0e-6
+	if math.Abs(f1-f2) > zeroThreshold {
+		t.Fatalf("equal assertion fail, %9.6f != %9.6f", f1, f2)
+	}
+}
+
+// verifyEqualVectors will compare vec1 and vec2 and fail if they are not
+// "equal" within a threshold.
+func verifyEqualVectors(t *testing.T, vec1 []float64, vec2 []float64) {
+	if len(vec1) != len(vec2) {
+		t.Fatalf("vector length mismatch, %d != %d", len(vec1), len(vec2))
+	}
+	for i := range vec1 {
+		verifyEqualFloats(t, vec1[i], vec2[i])
+	}
+}
+
+func TestCoordinate_NewCoordinate(t *testing.T) {
+	config := DefaultConfig()
+	c := NewCoordinate(config)
+	if uint(len(c.Vec)) != config.Dimensionality {
+		t.Fatalf("dimensionality not set correctly %d != %d",
+			len(c.Vec), config.Dimensionality)
+	}
+}
+
+func TestCoordinate_Clone(t *testing.T) {
+	c := NewCoordinate(DefaultConfig())
+	c.Vec[0], c.Vec[1], c.Vec[2] = 1.0, 2.0, 3.0
+	c.Error = 5.0
+	c.Adjustment = 10.0
+	c.Height = 4.2
+
+	other := c.Clone()
+	verifyEqualVectors(t, c.Vec, other.Vec)
+	verifyEqualFloats(t, c.Error, other.Error)
+	verifyEqualFloats(t, c.Adjustment, other.Adjustment)
+	verifyEqualFloats(t, c.Height, other.Height)
+
+	// Make sure the clone is independent.
+	other.Vec[0] = c.Vec[0] + 0.5
+	if c.Vec[0] == other.Vec[0] {
+		t.Fatalf("clone shares the vector")
+	}
+}
+
+func TestCoordinate_IsValid(t *testing.T) {
+	c := NewCoordinate(DefaultConfig())
+
+	var fields []*float64
+	for i := range c.Vec {
+		fields = append(fields, &c.Vec[i])
+	}
+	fields = append(fields, &c.Error)
+	fields = append(fields, &c.Adjustment)
+	fields = append(fields, &c.Height)
+
+	for i, field := range fields {
+		if !c.IsValid() {
+			t.Fatalf("field %d should be valid", i)
+		}
+
+		*field = math.NaN()
+		if c.IsValid() {
+			t.Fatalf("field %d should not be valid (NaN)", i)
+		}
+
+		*field = 0.0
+		if !c.IsValid() {
+			t.Fatalf("field %d should be valid", i)
+		}
+
+		*field = math.Inf(0)
+		if c.IsValid() {
+			t.Fatalf("field %d should not be valid (Inf)", i)
+		}
+
+		*field = 0.0
+	}
+}
+
+func TestCoordinate_IsCompatibleWith(t *testing.T) {
+	config := DefaultConfig()
+
+	config.Dimensionality = 3
+	c1 := NewCoordinate(config)
+	c2 := NewCoordinate(config)
+
+	config.Dimensionality = 2
+	alien := NewCoordinate(config)
+
+	if !c1.IsCompatibleWith(c1) || !c1.IsCompatibleWith(c2) {
+		t.Fatalf("coordinates should be compatible")
+	}
+	if c1.IsCompatibleWith(alien) || alien.IsCompatibleWith(c1) {
+		t.Fatalf("coordinates should not be compatible")
+	}
+}
+
+func TestCoordinate_ApplyForce(t *testing.T) {
+	config := DefaultConfig()
+	config.Dimensionality = 3
+	config.HeightMin = 0
+
+	origin := NewCoordinate(config)
+
+	// This proves that we normalize, get the direction right, and apply
+	// the force multiplier correctly.
+	above := NewCoordinate(config)
+	above.Vec = []float64{0.0, 0.0, 2.9}
+	c := origin.ApplyForce(config, 5.3, above)
+	verifyEqualVectors(t, c.Vec, []float64{0.0, 0.0, -5.3})
+
+	// Scoot a point not starting at the origin to make sure there's
+	// nothing special there.
+	right := NewCoordinate(config)
+	right.Vec = []float64{3.4, 0.0, -5.3}
+	c = c.ApplyForce(config, 2.0, right)
+	verifyEqualVectors(t, c.Vec, []float64{-2.0, 0.0, -5.3})
+
+	// If the points are right on top of each other, then we should end up
+	// in a random direction, one unit away.
+	c = origin.ApplyForce(config, 1.0, origin)
+	verifyEqualFloats(t, magnitude(diff(c.Vec, origin.Vec)), 1.0)
+
+	// Enable a minimum height and make sure that gets factored in
+	// properly.
+	config.HeightMin = 10.0e-6
+	origin = NewCoordinate(config)
+	c = origin.ApplyForce(config, 5.3, above)
+	verifyEqualVectors(t, c.Vec, []float64{0.0, 0.0, -5.3})
+	verifyEqualFloats(t, c.Height, config.HeightMin+5.3*config.HeightMin/2.9)
+
+	// Make sure the height minimum is enforced.
+	c = origin.ApplyForce(config, -5.3, above)
+	verifyEqualVectors(t, c.Vec, []float64{0.0, 0.0, 5.3})
+	verifyEqualFloats(t, c.Height, config.HeightMin)
+}
+
+func TestCoordinate_DistanceTo(t *testing.T) {
+	config := DefaultConfig()
+	config.Dimensionality = 3
+	config.HeightMin = 0
+
+	c1, c2 := NewCoordinate(config), NewCoordinate(config)
+	c1.Vec = []float64{-0.5, 1.3, 2.4}
+	c2.Vec = []float64{1.2, -2.3, 3.4}
+
+	verifyEqualFloats(t, c1.DistanceTo(c1).Seconds(), 0.0)
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), c2.DistanceTo(c1).Seconds())
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758)
+
+	// Make sure negative adjustment factors are ignored.
+	c1.Adjustment = -1.0e6
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758)
+
+	// Make sure positive adjustment factors affect the distance.
+	c1.Adjustment = 0.1
+	c2.Adjustment = 0.2
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758+0.3)
+
+	// Make sure the heights affect the distance.
+	c1.Height = 0.7
+	c2.Height = 0.1
+	verifyEqualFloats(t, c1.DistanceTo(c2).Seconds(), 4.104875150354758+0.3+0.8)
+
+	if c1.DistanceTo(c2) < 5*time.Second {
+		t.Fatalf("bad distance: %v", c1.DistanceTo(c2))
+	}
+}
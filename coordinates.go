@@ -0,0 +1,81 @@
+package memberlist
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/memberlist/coordinate"
+)
+
+// GetCoordinate returns our current network coordinate. It returns an error
+// if coordinates aren't enabled; see Config.CoordinateConfig.
+func (m *Memberlist) GetCoordinate() (*coordinate.Coordinate, error) {
+	if m.coords == nil {
+		return nil, fmt.Errorf("Coordinates are disabled")
+	}
+	return m.coords.GetCoordinate(), nil
+}
+
+// GetCachedCoordinate returns the latest network coordinate we've seen for
+// the given node, if any.
+func (m *Memberlist) GetCachedCoordinate(node string) (*coordinate.Coordinate, bool) {
+	m.coordLock.Lock()
+	defer m.coordLock.Unlock()
+	coord, ok := m.coordCache[node]
+	return coord, ok
+}
+
+// DistanceTo estimates the round trip time to the given node from our
+// coordinate and its latest known coordinate. It returns an error if
+// coordinates are disabled or we haven't yet heard the node's coordinate,
+// which happens after we've probed it at least once.
+func (m *Memberlist) DistanceTo(node string) (time.Duration, error) {
+	if m.coords == nil {
+		return 0, fmt.Errorf("Coordinates are disabled")
+	}
+	if node == m.config.Name {
+		return 0, nil
+	}
+	other, ok := m.GetCachedCoordinate(node)
+	if !ok {
+		return 0, fmt.Errorf("No coordinate known for node '%s'", node)
+	}
+	return m.coords.DistanceTo(other), nil
+}
+
+// updateCoordinate feeds a round trip time measured by a probe, along with
+// the coordinate the node sent back, into our coordinate.
+func (m *Memberlist) updateCoordinate(node string, other *coordinate.Coordinate, rtt time.Duration) {
+	if m.coords == nil || other == nil {
+		return
+	}
+
+	before := m.coords.GetCoordinate()
+	after, err := m.coords.Update(node, other, rtt)
+	if err != nil {
+		metrics.IncrCounter([]string{"memberlist", "coordinate", "rejected"}, 1)
+		m.logger.Printf("[DEBUG] memberlist: Rejected coordinate from %s: %v", node, err)
+		return
+	}
+
+	// Track the amount of churn we see in our own coordinate.
+	metrics.AddSample([]string{"memberlist", "coordinate", "adjustment-ms"},
+		float32(before.DistanceTo(after).Seconds()*1.0e3))
+
+	m.coordLock.Lock()
+	m.coordCache[node] = other
+	m.coordLock.Unlock()
+}
+
+// forgetCoordinate drops what we know about the coordinate of a node that
+// has left.
+func (m *Memberlist) forgetCoordinate(node string) {
+	if m.coords == nil {
+		return
+	}
+	m.coords.ForgetNode(node)
+	m.coordLock.Lock()
+	delete(m.coordCache, node)
+	m.coordLock.Unlock()
+}
@@ -0,0 +1,69 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist/coordinate"
+)
+
+func TestMemberlist_Coordinates(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 100 * time.Millisecond
+		c.ProbeInterval = time.Second
+		c.CoordinateConfig = coordinate.DefaultConfig()
+	})
+	defer m1.Shutdown()
+	m2 := HostMemberlist(addr2.String(), t, func(c *Config) {
+		c.CoordinateConfig = coordinate.DefaultConfig()
+	})
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	if _, err := m1.DistanceTo(addr2.String()); err == nil {
+		t.Fatalf("expected error before any probes")
+	}
+	if d, err := m1.DistanceTo(addr1.String()); err != nil || d != 0 {
+		t.Fatalf("bad: %v %v", d, err)
+	}
+
+	n := m1.nodeMap[addr2.String()]
+	m1.probeNode(n)
+
+	// The ack should have carried m2's coordinate.
+	if _, ok := m1.GetCachedCoordinate(addr2.String()); !ok {
+		t.Fatalf("missing coordinate for %s", addr2)
+	}
+	if _, err := m1.DistanceTo(addr2.String()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := m1.GetCoordinate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Dead nodes are forgotten.
+	m1.deadNode(&dead{Node: addr2.String(), Incarnation: 1})
+	if _, ok := m1.GetCachedCoordinate(addr2.String()); ok {
+		t.Fatalf("coordinate should be forgotten")
+	}
+}
+
+func TestMemberlist_CoordinatesDisabled(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	if _, err := m.GetCoordinate(); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, err := m.DistanceTo("foo"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,78 @@
+package memberlist
+
+/*
+Coordinator selection is a lightweight way to pick one member to carry out a
+task, without running a consensus protocol. Every member picks the eligible
+alive member with the lowest name, so once gossip has converged they all
+agree. Suspect members are passed over, since they may be gone, and so are
+paused members and members in maintenance, since they aren't taking on
+work.
+
+Before gossip has converged, and during partitions, two members may both
+believe they are the coordinator, so it's only suitable for work where the
+occasional duplicate is harmless.
+*/
+
+// coordinatorKey orders coordinator notifications on the delegate pool. The
+// NUL byte keeps it from sharing a name with a real node.
+const coordinatorKey = "\x00coordinator"
+
+// Coordinator returns the current coordinator: the alive member with the
+// lowest name among those accepted by Config.CoordinatorFilter. It returns
+// nil if no member is eligible.
+func (m *Memberlist) Coordinator() *Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	if state := m.pickCoordinator(); state != nil {
+		return &state.Node
+	}
+	return nil
+}
+
+// pickCoordinator returns the state of the eligible member with the lowest
+// name. The node lock must be held.
+func (m *Memberlist) pickCoordinator() *nodeState {
+	var best *nodeState
+	for _, n := range m.nodes {
+		// Members in maintenance still take part in gossip, but not in
+		// work like this.
+		if !n.State.active() || n.State == stateMaintenance {
+			continue
+		}
+		if best != nil && n.Name >= best.Name {
+			continue
+		}
+		if m.config.CoordinatorFilter != nil && !m.config.CoordinatorFilter(&n.Node) {
+			continue
+		}
+		best = n
+	}
+	return best
+}
+
+// updateCoordinator checks whether the coordinator has changed after a
+// change in membership, and notifies the CoordinatorDelegate if it has. The
+// node lock must be held.
+func (m *Memberlist) updateCoordinator() {
+	if m.config.Coordinator == nil {
+		return
+	}
+
+	state := m.pickCoordinator()
+	name := ""
+	if state != nil {
+		name = state.Name
+	}
+	if name == m.coordinator {
+		return
+	}
+	m.coordinator = name
+
+	var node *Node
+	if state != nil {
+		node = m.eventNode(state)
+	}
+	m.dispatchDelegate(coordinatorKey, "notify_coordinator", func() {
+		m.config.Coordinator.NotifyCoordinator(node)
+	})
+}
@@ -0,0 +1,10 @@
+package memberlist
+
+// CoordinatorDelegate is used to notify an observer when the coordinator
+// returned by Memberlist.Coordinator changes. Like the EventDelegate, it is
+// never called concurrently with itself, so changes arrive in order.
+type CoordinatorDelegate interface {
+	// NotifyCoordinator is invoked with the new coordinator, or nil if no
+	// member is eligible. The Node argument must not be modified.
+	NotifyCoordinator(*Node)
+}
@@ -0,0 +1,155 @@
+package memberlist
+
+import (
+	"bytes"
+	"testing"
+)
+
+type coordinatorRecorder struct {
+	names []string
+}
+
+func (c *coordinatorRecorder) NotifyCoordinator(n *Node) {
+	if n == nil {
+		c.names = append(c.names, "")
+		return
+	}
+	c.names = append(c.names, n.Name)
+}
+
+func TestMemberlist_Coordinator(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	rec := &coordinatorRecorder{}
+	m.config.Coordinator = rec
+
+	if n := m.Coordinator(); n != nil {
+		t.Fatalf("bad: %v", n)
+	}
+
+	b := alive{Node: "b", Addr: []byte{127, 0, 0, 2}, Incarnation: 1}
+	m.aliveNode(&b, nil, false)
+	if n := m.Coordinator(); n == nil || n.Name != "b" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// A lower name takes over, a higher one doesn't.
+	a := alive{Node: "a", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	c := alive{Node: "c", Addr: []byte{127, 0, 0, 3}, Incarnation: 1}
+	m.aliveNode(&c, nil, false)
+	if n := m.Coordinator(); n == nil || n.Name != "a" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Suspect and dead members lose it.
+	m.suspectNode(&suspect{Node: "a", Incarnation: 1})
+	if n := m.Coordinator(); n == nil || n.Name != "b" {
+		t.Fatalf("bad: %v", n)
+	}
+	m.deadNode(&dead{Node: "a", Incarnation: 1})
+	if n := m.Coordinator(); n == nil || n.Name != "b" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	expected := []string{"b", "a", "b"}
+	if len(rec.names) != len(expected) {
+		t.Fatalf("bad notifications: %v", rec.names)
+	}
+	for i := range expected {
+		if rec.names[i] != expected[i] {
+			t.Fatalf("bad notifications: %v", rec.names)
+		}
+	}
+}
+
+func TestMemberlist_CoordinatorFilter(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	rec := &coordinatorRecorder{}
+	m.config.Coordinator = rec
+	m.config.CoordinatorFilter = func(n *Node) bool {
+		return bytes.Equal(n.Meta, []byte("leader"))
+	}
+
+	a := alive{Node: "a", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	b := alive{Node: "b", Addr: []byte{127, 0, 0, 2}, Meta: []byte("leader"), Incarnation: 1}
+	m.aliveNode(&b, nil, false)
+	if n := m.Coordinator(); n == nil || n.Name != "b" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Gaining the role through a metadata update makes a member eligible.
+	a.Incarnation = 2
+	a.Meta = []byte("leader")
+	m.aliveNode(&a, nil, false)
+	if n := m.Coordinator(); n == nil || n.Name != "a" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// Losing it leaves nobody if no other member qualifies.
+	m.deadNode(&dead{Node: "b", Incarnation: 1})
+	a.Incarnation = 3
+	a.Meta = nil
+	m.aliveNode(&a, nil, false)
+	if n := m.Coordinator(); n != nil {
+		t.Fatalf("bad: %v", n)
+	}
+
+	expected := []string{"b", "a", ""}
+	if len(rec.names) != len(expected) {
+		t.Fatalf("bad notifications: %v", rec.names)
+	}
+	for i := range expected {
+		if rec.names[i] != expected[i] {
+			t.Fatalf("bad notifications: %v", rec.names)
+		}
+	}
+}
+
+func TestMemberlist_Coordinator_PausedMaintenance(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	rec := &coordinatorRecorder{}
+	m.config.Coordinator = rec
+
+	a := alive{Node: "a", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Paused: true}
+	m.aliveNode(&a, nil, false)
+	b := alive{Node: "b", Addr: []byte{127, 0, 0, 2}, Incarnation: 1, Maintenance: true}
+	m.aliveNode(&b, nil, false)
+	if n := m.Coordinator(); n != nil {
+		t.Fatalf("bad: %v", n)
+	}
+	c := alive{Node: "c", Addr: []byte{127, 0, 0, 3}, Incarnation: 1}
+	m.aliveNode(&c, nil, false)
+	if n := m.Coordinator(); n == nil || n.Name != "c" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// They're eligible again once they're back.
+	b.Incarnation = 2
+	b.Maintenance = false
+	m.aliveNode(&b, nil, false)
+	if n := m.Coordinator(); n == nil || n.Name != "b" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	// And lose it again on the way out.
+	b.Incarnation = 3
+	b.Maintenance = true
+	m.aliveNode(&b, nil, false)
+	if n := m.Coordinator(); n == nil || n.Name != "c" {
+		t.Fatalf("bad: %v", n)
+	}
+
+	expected := []string{"c", "b", "c"}
+	if len(rec.names) != len(expected) {
+		t.Fatalf("bad notifications: %v", rec.names)
+	}
+	for i := range expected {
+		if rec.names[i] != expected[i] {
+			t.Fatalf("bad notifications: %v", rec.names)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+/*
+The wire corpus is a set of encoded messages covering every message type,
+for checking that another implementation, or a fork of this one, stays
+compatible. Samples are encoded once, when a message is added or changes
+shape for a new protocol version, and never change after that, so they
+also stand in for what older members send.
+
+Msgpack can encode a value in more than one way, with an integer in any
+width that holds it for example, so VerifyWireSample compares messages by
+what they decode to rather than byte for byte. Framing, lengths and raw
+payloads have to match exactly, and msgpack bodies have to decode to the
+same fields with the same values. Extra fields are allowed, since older
+members skip them. Encrypted and signed samples were sealed with the
+sample's Key and Label and are compared by their plaintext, since each
+encryption uses a new nonce.
+
+Encrypted packets have no message type. They're sealed the same way as
+the payload of an encrypt sample, authenticating just the label, so they
+aren't listed separately.
+*/
+
+// WireSample is an encoded message from the wire corpus.
+type WireSample struct {
+	// Name identifies the sample.
+	Name string
+
+	// Protocol is the lowest protocol version that sends the message in
+	// this form.
+	Protocol uint8
+
+	// Stream is true for messages sent over a stream rather than in a
+	// packet.
+	Stream bool
+
+	// Key and Label are what encrypted and signed samples were sealed
+	// with.
+	Key   []byte
+	Label string
+
+	// Message is the encoded message, starting with its type.
+	Message []byte
+}
+
+// wireCorpusKey seals the encrypted and signed samples.
+var wireCorpusKey = []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// wireCorpusEntry is a sample as it's stored in corpus_data.go.
+type wireCorpusEntry struct {
+	name     string
+	protocol uint8
+	stream   bool
+	sealed   bool
+	message  string
+}
+
+// WireCorpus returns every sample in the wire corpus.
+func WireCorpus() []WireSample {
+	samples := make([]WireSample, 0, len(wireCorpus))
+	for _, e := range wireCorpus {
+		msg, err := hex.DecodeString(e.message)
+		if err != nil {
+			panic(fmt.Sprintf("Bad wire corpus sample %s: %v", e.name, err))
+		}
+		s := WireSample{
+			Name:     e.name,
+			Protocol: e.protocol,
+			Stream:   e.stream,
+			Message:  msg,
+		}
+		if e.sealed {
+			s.Key = append([]byte(nil), wireCorpusKey...)
+		}
+		samples = append(samples, s)
+	}
+	return samples
+}
+
+// WireCorpusFor returns the samples a member speaking the given protocol
+// version may send.
+func WireCorpusFor(protocol uint8) []WireSample {
+	var samples []WireSample
+	for _, s := range WireCorpus() {
+		if s.Protocol <= protocol {
+			samples = append(samples, s)
+		}
+	}
+	return samples
+}
+
+// VerifyWireSample checks that msg encodes the same message as the sample,
+// returning an error describing the first difference.
+func VerifyWireSample(s WireSample, msg []byte) error {
+	if err := compareWire(s, s.Message, msg); err != nil {
+		return fmt.Errorf("%s: %v", s.Name, err)
+	}
+	return nil
+}
+
+// wireBodies returns an empty struct for each message type that's a
+// single msgpack body.
+var wireBodies = map[messageType]func() interface{}{
+	pingMsg:            func() interface{} { return &ping{} },
+	indirectPingMsg:    func() interface{} { return &indirectPingReq{} },
+	ackRespMsg:         func() interface{} { return &ackResp{} },
+	nackRespMsg:        func() interface{} { return &nackResp{} },
+	suspectMsg:         func() interface{} { return &suspect{} },
+	aliveMsg:           func() interface{} { return &alive{} },
+	deadMsg:            func() interface{} { return &dead{} },
+	queryMsg:           func() interface{} { return &query{} },
+	queryRespMsg:       func() interface{} { return &queryResp{} },
+	markerMsg:          func() interface{} { return &marker{} },
+	markerReceiptMsg:   func() interface{} { return &markerReceipt{} },
+	banMsg:             func() interface{} { return &ban{} },
+	contentAnnounceMsg: func() interface{} { return &contentAnnounce{} },
+	contentPullMsg:     func() interface{} { return &contentPull{} },
+	contentRespMsg:     func() interface{} { return &contentResp{} },
+	mergeRejectMsg:     func() interface{} { return &mergeReject{} },
+	saltRespMsg:        func() interface{} { return &saltResp{} },
+	disconnectMsg:      func() interface{} { return &disconnect{} },
+	treeGossipMsg:      func() interface{} { return &treeGossip{} },
+	treeIHaveMsg:       func() interface{} { return &treeIHave{} },
+	treeGraftMsg:       func() interface{} { return &treeGraft{} },
+	treePruneMsg:       func() interface{} { return &treePrune{} },
+	replayReqMsg:       func() interface{} { return &replayReq{} },
+	replayRespMsg:      func() interface{} { return &replayResp{} },
+	leaveAckMsg:        func() interface{} { return &leaveAck{} },
+	ackPayloadReqMsg:   func() interface{} { return &ackPayloadReq{} },
+	ackPayloadRespMsg:  func() interface{} { return &ackPayloadResp{} },
+	healthAdvisoryMsg:  func() interface{} { return &healthAdvisory{} },
+}
+
+// compareWire compares two encodings of a message.
+func compareWire(s WireSample, want, got []byte) error {
+	if len(got) == 0 {
+		return fmt.Errorf("Message is empty")
+	}
+	if got[0] != want[0] {
+		return fmt.Errorf("Message type is %d, expected %d", got[0], want[0])
+	}
+
+	msgType := messageType(want[0])
+	switch msgType {
+	case compoundMsg, compound2Msg:
+		decodeParts := decodeCompoundMessage
+		if msgType == compound2Msg {
+			decodeParts = decodeCompound2Message
+		}
+		_, wantParts, err := decodeParts(want[1:])
+		if err != nil {
+			return err
+		}
+		_, gotParts, err := decodeParts(got[1:])
+		if err != nil {
+			return err
+		}
+		if len(gotParts) != len(wantParts) {
+			return fmt.Errorf("Compound message has %d parts, expected %d", len(gotParts), len(wantParts))
+		}
+		for i := range wantParts {
+			if err := compareWire(s, wantParts[i], gotParts[i]); err != nil {
+				return fmt.Errorf("Part %d: %v", i, err)
+			}
+		}
+		return nil
+
+	case compressMsg:
+		wantPlain, err := decompressPayload(want[1:])
+		if err != nil {
+			return err
+		}
+		gotPlain, err := decompressPayload(got[1:])
+		if err != nil {
+			return err
+		}
+		return compareWire(s, wantPlain, gotPlain)
+
+	case hasLabelMsg:
+		wantRest, wantLabel, err := removeLabelHeaderFromPacket(want)
+		if err != nil {
+			return err
+		}
+		gotRest, gotLabel, err := removeLabelHeaderFromPacket(got)
+		if err != nil {
+			return err
+		}
+		if gotLabel != wantLabel {
+			return fmt.Errorf("Label is '%s', expected '%s'", gotLabel, wantLabel)
+		}
+		return compareWire(s, wantRest, gotRest)
+
+	case authMsg, encryptMsg:
+		if msgType == encryptMsg && s.Stream && len(want) > 5 {
+			if len(got) <= 5 || got[5] != want[5] {
+				return fmt.Errorf("Encryption version differs, expected %d", want[5])
+			}
+		}
+		wantPlain, err := openWireSample(s, want)
+		if err != nil {
+			return fmt.Errorf("Failed to open sample: %v", err)
+		}
+		gotPlain, err := openWireSample(s, got)
+		if err != nil {
+			return err
+		}
+		return compareWire(s, wantPlain, gotPlain)
+
+	case sealedUserMsg:
+		var wantSealed, gotSealed sealedUser
+		if err := decode(want[1:], &wantSealed); err != nil {
+			return err
+		}
+		if err := decode(got[1:], &gotSealed); err != nil {
+			return err
+		}
+		if gotSealed.From != wantSealed.From || gotSealed.To != wantSealed.To {
+			return fmt.Errorf("Sealed message is from '%s' to '%s', expected '%s' to '%s'",
+				gotSealed.From, gotSealed.To, wantSealed.From, wantSealed.To)
+		}
+		wantPlain, err := openSealedUser([][]byte{s.Key}, &wantSealed)
+		if err != nil {
+			return fmt.Errorf("Failed to open sample: %v", err)
+		}
+		gotPlain, err := openSealedUser([][]byte{s.Key}, &gotSealed)
+		if err != nil {
+			return err
+		}
+		return compareRaw("Sealed payload", wantPlain, gotPlain)
+
+	case userMsg:
+		if !s.Stream {
+			return compareRaw("User message", want[1:], got[1:])
+		}
+		return compareWireSeq(want[1:], got[1:], func(next func(interface{}) error) error {
+			var header userMsgHeader
+			return next(&header)
+		})
+
+	case pushPullMsg:
+		return compareWireSeq(want[1:], got[1:], func(next func(interface{}) error) error {
+			var header pushPullHeader
+			if err := next(&header); err != nil {
+				return err
+			}
+			for i := 0; i < header.Nodes; i++ {
+				var state pushNodeState
+				if err := next(&state); err != nil {
+					return fmt.Errorf("Node state %d: %v", i, err)
+				}
+			}
+			return nil
+		})
+
+	case userExpiringMsg, userSeqMsg, saltReqMsg:
+		return compareRaw("Message", want[1:], got[1:])
+	}
+
+	body, ok := wireBodies[msgType]
+	if !ok {
+		return fmt.Errorf("Message type %d has no comparison", msgType)
+	}
+	wantBody, gotBody := body(), body()
+	if err := decode(want[1:], wantBody); err != nil {
+		return err
+	}
+	if err := decode(got[1:], gotBody); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(gotBody, wantBody) {
+		return fmt.Errorf("Decoded %+v, expected %+v", gotBody, wantBody)
+	}
+	return nil
+}
+
+// compareWireSeq compares two streams of msgpack bodies followed by raw
+// bytes. The read function decodes the bodies one at a time through next,
+// which checks that both streams hold the same values.
+func compareWireSeq(want, got []byte, read func(next func(interface{}) error) error) error {
+	hd := codec.MsgpackHandle{}
+	wantR, gotR := bytes.NewReader(want), bytes.NewReader(got)
+	wantDec, gotDec := codec.NewDecoder(wantR, &hd), codec.NewDecoder(gotR, &hd)
+
+	next := func(out interface{}) error {
+		gotOut := reflect.New(reflect.TypeOf(out).Elem()).Interface()
+		if err := decodeWire(wantDec, out); err != nil {
+			return fmt.Errorf("Failed to decode sample: %v", err)
+		}
+		if err := decodeWire(gotDec, gotOut); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(gotOut, out) {
+			return fmt.Errorf("Decoded %+v, expected %+v", gotOut, out)
+		}
+		return nil
+	}
+	if err := read(next); err != nil {
+		return err
+	}
+	return compareRaw("Trailing data", want[len(want)-wantR.Len():], got[len(got)-gotR.Len():])
+}
+
+// openWireSample verifies or decrypts an auth or encrypt message with the
+// sample's key. Streams authenticate their header as well as the label.
+func openWireSample(s WireSample, buf []byte) ([]byte, error) {
+	keys := [][]byte{s.Key}
+	data, payload := []byte(s.Label), buf[1:]
+	if s.Stream {
+		if len(buf) < 5 {
+			return nil, fmt.Errorf("Header is truncated")
+		}
+		if size := binary.BigEndian.Uint32(buf[1:5]); int(size) != len(buf)-5 {
+			return nil, fmt.Errorf("Header gives a length of %d, but %d bytes follow", size, len(buf)-5)
+		}
+		data = append(append([]byte(nil), buf[:5]...), s.Label...)
+		payload = buf[5:]
+	}
+
+	payload = append([]byte(nil), payload...)
+	if messageType(buf[0]) == authMsg {
+		plain, _, err := verifyPayload(keys, payload, data)
+		return plain, err
+	}
+	return decryptPayload(keys, payload, data)
+}
+
+// compareRaw compares bytes that must match exactly.
+func compareRaw(what string, want, got []byte) error {
+	if !bytes.Equal(got, want) {
+		return fmt.Errorf("%s is %x, expected %x", what, got, want)
+	}
+	return nil
+}
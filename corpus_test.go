@@ -0,0 +1,319 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+var updateCorpus = flag.Bool("update-corpus", false, "add missing samples to corpus_data.go")
+
+// corpusVsn is the version array the samples advertise.
+var corpusVsn = []uint8{1, 4, 2, 0, 1, 0}
+
+// corpusNonces gives the samples fixed nonces, so that they can be
+// regenerated exactly.
+func corpusNonces() nonceSource {
+	return randomNonces{bytes.NewReader(make([]byte, 1024))}
+}
+
+func corpusEncode(t *testing.T, msgType messageType, in interface{}) []byte {
+	t.Helper()
+	out, err := encode(msgType, in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return out.Bytes()
+}
+
+// corpusStream encodes a stream message made of msgpack bodies and raw
+// bytes.
+func corpusStream(t *testing.T, msgType messageType, parts ...interface{}) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer([]byte{byte(msgType)})
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(buf, &hd)
+	for _, p := range parts {
+		if raw, ok := p.([]byte); ok {
+			buf.Write(raw)
+			continue
+		}
+		if err := enc.Encode(p); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// corpusSealStream wraps a stream message in an encrypt or auth header,
+// as encryptLocalState and authLocalState do.
+func corpusSealStream(t *testing.T, msgType messageType, vsn encryptionVersion, msg []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	buf.WriteByte(byte(msgType))
+	size := len(msg) + authTagSize
+	if msgType == encryptMsg {
+		size = encryptedLength(vsn, len(msg))
+	}
+	var sizeBuf [4]byte
+	binary.BigEndian.PutUint32(sizeBuf[:], uint32(size))
+	buf.Write(sizeBuf[:])
+
+	data := append([]byte(nil), buf.Bytes()...)
+	if msgType == authMsg {
+		authPayload(wireCorpusKey, msg, data, &buf)
+		return buf.Bytes()
+	}
+	if err := encryptPayloadNonce(vsn, wireCorpusKey, msg, data, corpusNonces(), &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// buildWireCorpus encodes every sample with the current code.
+func buildWireCorpus(t *testing.T) []WireSample {
+	ping := corpusEncode(t, pingMsg, &ping{SeqNo: 1, Node: "b", SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7946, SourceNode: "a"})
+	sus := corpusEncode(t, suspectMsg, &suspect{Incarnation: 2, Node: "b", From: "a"})
+	live := corpusEncode(t, aliveMsg, &alive{Incarnation: 2, Node: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, Meta: []byte("meta"), Vsn: corpusVsn})
+	userStream := corpusStream(t, userMsg, &userMsgHeader{UserMsgLen: 5}, []byte("hello"))
+
+	compressed, err := compressPayload(live)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var authPacket bytes.Buffer
+	authPacket.WriteByte(byte(authMsg))
+	authPayload(wireCorpusKey, ping, nil, &authPacket)
+
+	expiring := make([]byte, 9, 9+5)
+	expiring[0] = byte(userExpiringMsg)
+	binary.BigEndian.PutUint64(expiring[1:], 1700000000000000000)
+	expiring = append(expiring, "hello"...)
+
+	seq := []byte{byte(userSeqMsg)}
+	seq = binary.AppendUvarint(seq, 7)
+	seq = binary.AppendUvarint(seq, 1)
+	seq = append(seq, "a"...)
+	seq = append(seq, "hello"...)
+
+	sealKey, err := userSealKey(wireCorpusKey, "a", "b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var sealed bytes.Buffer
+	if err := encryptPayloadNonce(1, sealKey, []byte("hello"), userSealData("a", "b"), corpusNonces(), &sealed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	report := &NodeReport{
+		Name:             "a",
+		Members:          []MemberReport{{Name: "a", Addr: net.IPv4(127, 0, 0, 1), Port: 7946, Incarnation: 2, Status: StatusAlive}},
+		HealthScore:      1,
+		QueuedBroadcasts: 2,
+	}
+
+	return []WireSample{
+		{Name: "ping", Protocol: 1, Message: ping},
+		{Name: "indirect_ping", Protocol: 1, Message: corpusEncode(t, indirectPingMsg, &indirectPingReq{SeqNo: 1, Target: []byte{127, 0, 0, 2}, Port: 7946, Node: "c"})},
+		{Name: "indirect_ping_nack", Protocol: 4, Message: corpusEncode(t, indirectPingMsg, &indirectPingReq{SeqNo: 1, Target: []byte{127, 0, 0, 2}, Port: 7946, Node: "c", Nack: true, SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7946})},
+		{Name: "ack", Protocol: 1, Message: corpusEncode(t, ackRespMsg, &ackResp{SeqNo: 1, Payload: []byte("payload")})},
+		{Name: "nack", Protocol: 4, Message: corpusEncode(t, nackRespMsg, &nackResp{SeqNo: 1})},
+		{Name: "suspect", Protocol: 1, Message: sus},
+		{Name: "alive", Protocol: 1, Message: live},
+		{Name: "dead", Protocol: 1, Message: corpusEncode(t, deadMsg, &dead{Incarnation: 2, Node: "b", From: "a"})},
+		{Name: "push_pull", Protocol: 1, Stream: true, Message: corpusStream(t, pushPullMsg,
+			&pushPullHeader{Nodes: 1, UserStateLen: 5, Join: true, Node: "a", Vsn: corpusVsn},
+			&pushNodeState{Name: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, Meta: []byte("meta"), Incarnation: 2, State: stateAlive, Vsn: corpusVsn},
+			[]byte("state"))},
+		{Name: "compound", Protocol: 1, Message: makeCompoundMessage([][]byte{ping, sus}).Bytes()},
+		{Name: "compound2", Protocol: 5, Message: makeCompound2Message([][]byte{ping, sus}).Bytes()},
+		{Name: "user", Protocol: 1, Message: append([]byte{byte(userMsg)}, "hello"...)},
+		{Name: "user_stream", Protocol: 1, Stream: true, Message: userStream},
+		{Name: "compress", Protocol: 1, Message: compressed.Bytes()},
+		{Name: "encrypt_v0", Protocol: 1, Stream: true, Key: wireCorpusKey, Message: corpusSealStream(t, encryptMsg, 0, userStream)},
+		{Name: "encrypt", Protocol: 2, Stream: true, Key: wireCorpusKey, Message: corpusSealStream(t, encryptMsg, 1, userStream)},
+		{Name: "has_label", Protocol: 1, Message: addLabelHeaderToPacket(ping, "cluster")},
+		{Name: "auth", Protocol: 1, Key: wireCorpusKey, Message: authPacket.Bytes()},
+		{Name: "auth_stream", Protocol: 1, Stream: true, Key: wireCorpusKey, Message: corpusSealStream(t, authMsg, 0, userStream)},
+		{Name: "query", Protocol: 1, Stream: true, Message: corpusEncode(t, queryMsg, &query{})},
+		{Name: "query_resp", Protocol: 1, Stream: true, Message: corpusEncode(t, queryRespMsg, &queryResp{Report: report})},
+		{Name: "marker", Protocol: 1, Message: corpusEncode(t, markerMsg, &marker{ID: "id", Origin: "a", Sent: 1700000000000000000, Hops: 1})},
+		{Name: "marker_receipt", Protocol: 1, Message: corpusEncode(t, markerReceiptMsg, &markerReceipt{ID: "id", Node: "b", Hops: 1, Latency: 2000000})},
+		{Name: "ban", Protocol: 1, Message: corpusEncode(t, banMsg, &ban{Node: "b", Issued: 1700000000000000000, TTL: 60000000000, From: "a"})},
+		{Name: "content_announce", Protocol: 1, Message: corpusEncode(t, contentAnnounceMsg, &contentAnnounce{ID: []byte{1, 2, 3}, Size: 5, Holder: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946})},
+		{Name: "content_pull", Protocol: 1, Stream: true, Message: corpusEncode(t, contentPullMsg, &contentPull{ID: []byte{1, 2, 3}})},
+		{Name: "content_resp", Protocol: 1, Stream: true, Message: corpusEncode(t, contentRespMsg, &contentResp{Body: []byte("hello")})},
+		{Name: "user_expiring", Protocol: 1, Message: expiring},
+		{Name: "user_sequenced", Protocol: 1, Message: seq},
+		{Name: "merge_reject", Protocol: 1, Stream: true, Message: corpusEncode(t, mergeRejectMsg, &mergeReject{Reason: "reason"})},
+		{Name: "merge_reject_retry", Protocol: 1, Stream: true, Message: corpusEncode(t, mergeRejectMsg, &mergeReject{Reason: "reason", RetryAfter: 1000000000})},
+		{Name: "sealed_user", Protocol: 1, Key: wireCorpusKey, Message: corpusEncode(t, sealedUserMsg, &sealedUser{From: "a", To: "b", Payload: sealed.Bytes()})},
+		{Name: "salt_req", Protocol: 1, Stream: true, Message: []byte{byte(saltReqMsg)}},
+		{Name: "salt_resp", Protocol: 1, Stream: true, Message: corpusEncode(t, saltRespMsg, &saltResp{KDF: "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA"})},
+		{Name: "disconnect", Protocol: 1, Message: corpusEncode(t, disconnectMsg, &disconnect{Node: "a"})},
+		{Name: "tree_gossip", Protocol: 1, Message: corpusEncode(t, treeGossipMsg, &treeGossip{Origin: "a", Seq: 1, Hops: 2, From: "b", Payload: []byte("hello")})},
+		{Name: "tree_ihave", Protocol: 1, Message: corpusEncode(t, treeIHaveMsg, &treeIHave{Origin: "a", Seq: 1, From: "b"})},
+		{Name: "tree_graft", Protocol: 1, Message: corpusEncode(t, treeGraftMsg, &treeGraft{Origin: "a", Seq: 1, From: "b"})},
+		{Name: "tree_prune", Protocol: 1, Message: corpusEncode(t, treePruneMsg, &treePrune{From: "a"})},
+		{Name: "replay_req", Protocol: 1, Stream: true, Message: corpusEncode(t, replayReqMsg, &replayReq{Origin: "a", First: 1, Last: 2})},
+		{Name: "replay_resp", Protocol: 1, Stream: true, Message: corpusEncode(t, replayRespMsg, &replayResp{Msgs: []replayMsg{{Seq: 1, Msg: []byte("hello")}}})},
+		{Name: "leave_ack", Protocol: 6, Message: corpusEncode(t, leaveAckMsg, &leaveAck{Node: "a", From: "b"})},
+		{Name: "ack_payload_req", Protocol: 1, Stream: true, Message: corpusEncode(t, ackPayloadReqMsg, &ackPayloadReq{Node: "a", SeqNo: 1})},
+		{Name: "ack_payload_resp", Protocol: 1, Stream: true, Message: corpusEncode(t, ackPayloadRespMsg, &ackPayloadResp{Payload: []byte("hello")})},
+		{Name: "health_advisory", Protocol: 1, Message: corpusEncode(t, healthAdvisoryMsg, &healthAdvisory{Node: "b", Reason: "hello", Issued: 1700000000000000000, TTL: 60000000000, From: "a"})},
+	}
+}
+
+// writeWireCorpus adds samples that aren't in corpus_data.go yet. Samples
+// already there are kept as they are.
+func writeWireCorpus(t *testing.T, current []WireSample) {
+	have := make(map[string]bool)
+	for _, e := range wireCorpus {
+		have[e.name] = true
+	}
+	entries := append([]wireCorpusEntry(nil), wireCorpus...)
+	for _, s := range current {
+		if !have[s.Name] {
+			entries = append(entries, wireCorpusEntry{s.Name, s.Protocol, s.Stream, s.Key != nil, fmt.Sprintf("%x", s.Message)})
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("// Code generated by go test -run TestWireCorpus -update-corpus. DO NOT EDIT.\n\n")
+	b.WriteString("package memberlist\n\n")
+	b.WriteString("// wireCorpus holds the samples returned by WireCorpus. Samples are only\n")
+	b.WriteString("// ever added; an existing one must never change.\n")
+	b.WriteString("var wireCorpus = []wireCorpusEntry{\n")
+	for _, e := range entries {
+		fmt.Fprintf(&b, "\t{%q, %d, %v, %v, %q},\n", e.name, e.protocol, e.stream, e.sealed, e.message)
+	}
+	b.WriteString("}\n")
+	if err := ioutil.WriteFile("corpus_data.go", []byte(b.String()), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestWireCorpus(t *testing.T) {
+	current := buildWireCorpus(t)
+	if *updateCorpus {
+		writeWireCorpus(t, current)
+		return
+	}
+
+	corpus := WireCorpus()
+	byName := make(map[string]WireSample)
+	for _, s := range corpus {
+		byName[s.Name] = s
+	}
+
+	// Every message we send still matches its sample.
+	for _, c := range current {
+		s, ok := byName[c.Name]
+		if !ok {
+			t.Fatalf("missing sample %s", c.Name)
+		}
+		if s.Protocol != c.Protocol || s.Stream != c.Stream {
+			t.Fatalf("sample %s has changed", c.Name)
+		}
+		if err := VerifyWireSample(s, c.Message); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// Every message type is covered.
+	types := make(map[messageType]bool)
+	for _, s := range corpus {
+		types[messageType(s.Message[0])] = true
+	}
+	for msgType := pingMsg; msgType <= healthAdvisoryMsg; msgType++ {
+		if !types[msgType] {
+			t.Fatalf("no sample for message type %d", msgType)
+		}
+	}
+}
+
+func TestWireCorpus_Verify(t *testing.T) {
+	corpus := WireCorpus()
+	sample := func(name string) WireSample {
+		for _, s := range corpus {
+			if s.Name == name {
+				return s
+			}
+		}
+		t.Fatalf("missing sample %s", name)
+		return WireSample{}
+	}
+
+	// Each sample matches itself.
+	for _, s := range corpus {
+		if err := VerifyWireSample(s, s.Message); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// A wider integer encoding decodes to the same message.
+	s := sample("nack")
+	wide := []byte{byte(nackRespMsg), 0x81, 0xa5}
+	wide = append(wide, "SeqNo"...)
+	wide = append(wide, 0xce, 0, 0, 0, 1)
+	if err := VerifyWireSample(s, wide); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A different value doesn't.
+	other := corpusEncode(t, nackRespMsg, &nackResp{SeqNo: 2})
+	if err := VerifyWireSample(s, other); err == nil || !strings.Contains(err.Error(), "nack") {
+		t.Fatalf("expected difference, got %v", err)
+	}
+
+	// Encrypted samples compare by plaintext, so a new nonce is fine.
+	s = sample("encrypt")
+	userStream := corpusStream(t, userMsg, &userMsgHeader{UserMsgLen: 5}, []byte("hello"))
+	var sealed bytes.Buffer
+	sealed.Write(s.Message[:5])
+	if err := encryptPayload(1, s.Key, userStream, s.Message[:5], &sealed); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := VerifyWireSample(s, sealed.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// But not the older encryption version.
+	if err := VerifyWireSample(s, sample("encrypt_v0").Message); err == nil {
+		t.Fatalf("expected version difference")
+	}
+
+	// Trailing user state must match exactly.
+	s = sample("push_pull")
+	changed := append([]byte(nil), s.Message...)
+	changed[len(changed)-1] ^= 1
+	if err := VerifyWireSample(s, changed); err == nil {
+		t.Fatalf("expected difference")
+	}
+}
+
+func TestWireCorpusFor(t *testing.T) {
+	var names []string
+	for _, s := range WireCorpusFor(1) {
+		if s.Protocol > 1 {
+			t.Fatalf("bad: %s", s.Name)
+		}
+		names = append(names, s.Name)
+	}
+	sort.Strings(names)
+	if i := sort.SearchStrings(names, "nack"); i < len(names) && names[i] == "nack" {
+		t.Fatalf("nack needs protocol 4")
+	}
+	if len(WireCorpusFor(ProtocolVersionMax)) != len(WireCorpus()) {
+		t.Fatalf("every sample should be sent at the newest version")
+	}
+}
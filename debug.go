@@ -0,0 +1,239 @@
+package memberlist
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+DumpInternals is for bug reports like "gossip just stopped", where the
+cluster looks fine from outside but something inside has wedged. It writes
+out, as plain text, what would otherwise take a debugger to find: when each
+periodic task last ran and whether it's stuck in a run, what the goroutines
+in memberlist are doing, how many acks and messages are waiting, and
+whether any of the main locks are being held for a long time.
+
+Goroutines are listed for the whole process, since they can't be told
+apart by Memberlist, and locks are only tried, never waited on, so dumping
+a wedged memberlist doesn't wedge the caller too.
+*/
+
+// lockProbeTimeout is how long DumpInternals keeps trying each lock before
+// reporting it as held.
+const lockProbeTimeout = 100 * time.Millisecond
+
+// taskStatus is how a periodic task has been running.
+type taskStatus struct {
+	runs     uint64
+	started  time.Time
+	finished time.Time
+	running  bool
+}
+
+// taskTracker records the runs of the periodic tasks wrapped by guard.
+type taskTracker struct {
+	sync.Mutex
+	tasks map[string]*taskStatus
+}
+
+// start records the start of a run.
+func (t *taskTracker) start(name string, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if t.tasks == nil {
+		t.tasks = make(map[string]*taskStatus)
+	}
+	s, ok := t.tasks[name]
+	if !ok {
+		s = &taskStatus{}
+		t.tasks[name] = s
+	}
+	s.runs++
+	s.started = now
+	s.running = true
+}
+
+// finish records the end of a run, whether or not it panicked.
+func (t *taskTracker) finish(name string, now time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if s, ok := t.tasks[name]; ok {
+		s.finished = now
+		s.running = false
+	}
+}
+
+// DumpInternals writes out the state of memberlist's background tasks,
+// goroutines, queues and locks, for debugging.
+func (m *Memberlist) DumpInternals(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	now := time.Now()
+	fmt.Fprintf(bw, "memberlist %s at %s\n", m.config.Name, now.Format(time.RFC3339Nano))
+
+	m.tickerLock.Lock()
+	tickers := len(m.tickers)
+	m.tickerLock.Unlock()
+	if tickers > 0 {
+		fmt.Fprintf(bw, "\nscheduler: running, %d tickers\n", tickers)
+	} else {
+		fmt.Fprintf(bw, "\nscheduler: stopped\n")
+	}
+	m.dumpTasks(bw, now)
+
+	fmt.Fprintf(bw, "\ngoroutines:\n")
+	dumpGoroutines(bw)
+
+	stats := m.inflight.wait(0) // Doesn't wait with no timeout
+	m.ackLock.Lock()
+	acks := len(m.ackHandlers)
+	m.ackLock.Unlock()
+	fmt.Fprintf(bw, "\nqueues:\n")
+	fmt.Fprintf(bw, "  ack handlers: %d\n", acks)
+	fmt.Fprintf(bw, "  in flight: %d probes, %d push/pulls, %d streams\n", stats.Probes, stats.PushPulls, stats.Streams)
+	fmt.Fprintf(bw, "  packet handoff: %d/%d\n", len(m.handoff), cap(m.handoff))
+	fmt.Fprintf(bw, "  broadcasts: %d\n", m.broadcasts.NumQueued())
+	if m.delegates != nil {
+		fmt.Fprintf(bw, "  delegate notifications: %d\n", m.delegates.Queued())
+	}
+
+	fmt.Fprintf(bw, "\nlocks:\n")
+	m.dumpLock(bw, "nodeLock", m.nodeLock.TryLock, m.nodeLock.Unlock)
+	m.dumpLock(bw, "ackLock", m.ackLock.TryLock, m.ackLock.Unlock)
+	m.dumpLock(bw, "tickerLock", m.tickerLock.TryLock, m.tickerLock.Unlock)
+	m.dumpLock(bw, "broadcasts", m.broadcasts.TryLock, m.broadcasts.Unlock)
+	m.dumpLock(bw, "scale", m.scale.TryLock, m.scale.Unlock)
+	m.dumpLock(bw, "coordLock", m.coordLock.TryLock, m.coordLock.Unlock)
+
+	if tryLockFor(m.nodeLock.TryRLock, lockProbeTimeout) {
+		fmt.Fprintf(bw, "\nnodes: %d, suspicion timers: %d\n", len(m.nodes), len(m.nodeTimers))
+		m.nodeLock.RUnlock()
+	}
+	return bw.Flush()
+}
+
+// dumpTasks writes out the status of each periodic task.
+func (m *Memberlist) dumpTasks(w io.Writer, now time.Time) {
+	m.tasks.Lock()
+	defer m.tasks.Unlock()
+
+	names := make([]string, 0, len(m.tasks.tasks))
+	for name := range m.tasks.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := m.tasks.tasks[name]
+		if s.running {
+			fmt.Fprintf(w, "  %s: %d runs, running for %v\n", name, s.runs, now.Sub(s.started))
+		} else {
+			fmt.Fprintf(w, "  %s: %d runs, last ran %v ago, took %v\n", name, s.runs, now.Sub(s.finished), s.finished.Sub(s.started))
+		}
+	}
+}
+
+// dumpLock writes out whether a lock could be taken, and how long it took.
+func (m *Memberlist) dumpLock(w io.Writer, name string, tryLock func() bool, unlock func()) {
+	start := time.Now()
+	if !tryLockFor(tryLock, lockProbeTimeout) {
+		fmt.Fprintf(w, "  %s: HELD, not free within %v\n", name, lockProbeTimeout)
+		return
+	}
+	waited := time.Since(start)
+	unlock()
+	fmt.Fprintf(w, "  %s: free, taken in %v\n", name, waited)
+}
+
+// tryLockFor keeps trying to take a lock until the timeout, returning true
+// if it was taken.
+func tryLockFor(tryLock func() bool, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !tryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+// dumpGoroutines writes out the goroutines running memberlist code, grouped
+// by the function they were started in and what they're waiting on, along
+// with where in memberlist they're waiting.
+func dumpGoroutines(w io.Writer) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	counts := make(map[string]int)
+	for _, g := range bytes.Split(buf, []byte("\n\n")) {
+		if key := goroutineRole(string(g)); key != "" {
+			counts[key]++
+		}
+	}
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "  %d x %s\n", counts[key], key)
+	}
+}
+
+// memberlistFrame is the prefix of stack frames in memberlist itself.
+const memberlistFrame = "github.com/hashicorp/memberlist."
+
+// goroutineRole describes a goroutine from its stack trace as its entry
+// point in memberlist, its state, and the innermost memberlist function
+// it's in, or returns "" if it isn't running memberlist code.
+func goroutineRole(stack string) string {
+	lines := strings.Split(stack, "\n")
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "goroutine ") {
+		return ""
+	}
+	state := ""
+	if i, j := strings.Index(lines[0], "["), strings.Index(lines[0], "]"); i >= 0 && j > i {
+		state = lines[0][i+1 : j]
+		if k := strings.Index(state, ","); k >= 0 {
+			state = state[:k]
+		}
+	}
+
+	var inner, entry string
+	for _, line := range lines[1:] {
+		if strings.HasPrefix(line, "created by ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+		if !strings.HasPrefix(line, memberlistFrame) {
+			continue
+		}
+		fn := strings.TrimPrefix(line, memberlistFrame)
+		if i := strings.LastIndex(fn, "("); i > 0 {
+			fn = fn[:i]
+		}
+		if inner == "" {
+			inner = fn
+		}
+		entry = fn
+	}
+	if entry == "" {
+		return ""
+	}
+	if inner == entry {
+		return fmt.Sprintf("%s [%s]", entry, state)
+	}
+	return fmt.Sprintf("%s [%s] in %s", entry, state, inner)
+}
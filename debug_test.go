@@ -0,0 +1,132 @@
+package memberlist
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGoroutineRole(t *testing.T) {
+	stack := `goroutine 21 [select, 2 minutes]:
+github.com/hashicorp/memberlist.(*Memberlist).gossip(0xc000180000)
+	/src/memberlist/state.go:620 +0x1a5
+github.com/hashicorp/memberlist.(*Memberlist).guard.func1()
+	/src/memberlist/recover.go:37 +0x7e
+github.com/hashicorp/memberlist.(*Memberlist).triggerFunc(0xc000180000, 0xbebc200, 0xc0000a2060, 0xc0000a2000, 0xc0000b8010)
+	/src/memberlist/state.go:153 +0x11c
+created by github.com/hashicorp/memberlist.(*Memberlist).schedule in goroutine 7
+	/src/memberlist/state.go:114 +0x3fa`
+	if role := goroutineRole(stack); role != "(*Memberlist).triggerFunc [select] in (*Memberlist).gossip" {
+		t.Fatalf("bad: %q", role)
+	}
+
+	stack = `goroutine 5 [IO wait]:
+internal/poll.runtime_pollWait(0x7f, 0x72)
+	/usr/local/go/src/runtime/netpoll.go:351 +0x85
+github.com/hashicorp/memberlist.(*Memberlist).udpHandler(0xc000180000)
+	/src/memberlist/net.go:680 +0x45`
+	if role := goroutineRole(stack); role != "(*Memberlist).udpHandler [IO wait]" {
+		t.Fatalf("bad: %q", role)
+	}
+
+	stack = `goroutine 1 [chan receive]:
+testing.(*T).Run(0xc000003340, {0x8e2c2a, 0x9}, 0x8fa2c8)
+	/usr/local/go/src/testing/testing.go:1751 +0x3ab`
+	if role := goroutineRole(stack); role != "" {
+		t.Fatalf("bad: %q", role)
+	}
+}
+
+func TestMemberlist_DumpInternals(t *testing.T) {
+	c := testConfig()
+	c.ProbeInterval = 10 * time.Millisecond
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	// Wait for the scheduler to get going.
+	deadline := time.Now().Add(time.Second)
+	for {
+		m.tasks.Lock()
+		s, ok := m.tasks.tasks["probe"]
+		ran := ok && s.runs > 1
+		m.tasks.Unlock()
+		if ran {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("probe never ran")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var buf bytes.Buffer
+	if err := m.DumpInternals(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"scheduler: running",
+		"probe: ",
+		"(*Memberlist).udpHandler [",
+		"ack handlers: ",
+		"nodeLock: free",
+		"nodes: 1, suspicion timers: 0",
+	} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("missing %q in:\n%s", want, out)
+		}
+	}
+
+	// A lock that's held is reported as such, without the dump getting
+	// stuck.
+	m.nodeLock.Lock()
+	buf.Reset()
+	err = m.DumpInternals(&buf)
+	m.nodeLock.Unlock()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out = buf.String()
+	if !strings.Contains(out, "nodeLock: HELD") || strings.Contains(out, "nodes: ") {
+		t.Fatalf("bad:\n%s", out)
+	}
+}
+
+func TestMemberlist_DumpInternals_StuckTask(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go m.guard("stuck", func() {
+		close(started)
+		<-release
+	})()
+	<-started
+
+	var buf bytes.Buffer
+	if err := m.DumpInternals(&buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out := buf.String(); !strings.Contains(out, "stuck: 1 runs, running for ") {
+		t.Fatalf("bad:\n%s", out)
+	}
+
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		buf.Reset()
+		m.DumpInternals(&buf)
+		if strings.Contains(buf.String(), "stuck: 1 runs, last ran ") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad:\n%s", buf.String())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,76 @@
+package memberlist
+
+import (
+	"container/list"
+	"net"
+	"sync"
+)
+
+// maxDecryptSources is how many source addresses we count decrypt failures
+// for. Anyone can send us garbage from any number of addresses, so we keep
+// the ones that failed most recently and forget the rest.
+const maxDecryptSources = 128
+
+// decryptFailures counts the messages no key could decrypt by the host
+// they came from, so that a node still using an old key can be found.
+type decryptFailures struct {
+	sync.Mutex
+	counts map[string]*list.Element
+	order  *list.List // Most recent failure first
+}
+
+// decryptSource is an entry in decryptFailures.
+type decryptSource struct {
+	host  string
+	count uint64
+}
+
+// record counts a failure from the given address, and returns how many
+// there have been from its host since we started tracking it.
+func (d *decryptFailures) record(from net.Addr) uint64 {
+	host := "unknown"
+	if from != nil {
+		host = from.String()
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	if d.counts == nil {
+		d.counts = make(map[string]*list.Element)
+		d.order = list.New()
+	}
+	if e, ok := d.counts[host]; ok {
+		d.order.MoveToFront(e)
+		s := e.Value.(*decryptSource)
+		s.count++
+		return s.count
+	}
+	if d.order.Len() >= maxDecryptSources {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.counts, oldest.Value.(*decryptSource).host)
+	}
+	d.counts[host] = d.order.PushFront(&decryptSource{host: host, count: 1})
+	return 1
+}
+
+// snapshot returns the failure counts by host.
+func (d *decryptFailures) snapshot() map[string]uint64 {
+	d.Lock()
+	defer d.Unlock()
+	out := make(map[string]uint64, len(d.counts))
+	for host, e := range d.counts {
+		out[host] = e.Value.(*decryptSource).count
+	}
+	return out
+}
+
+// DecryptFailures returns how many messages no installed key could decrypt,
+// by the host they came from, for the most recent sources. A member still
+// using a key we've removed shows up here.
+func (m *Memberlist) DecryptFailures() map[string]uint64 {
+	return m.decryptFails.snapshot()
+}
@@ -0,0 +1,34 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestDecryptFailures(t *testing.T) {
+	var d decryptFailures
+	a := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 7946}
+	b := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 1234}
+	if n := d.record(a); n != 1 {
+		t.Fatalf("bad: %d", n)
+	}
+	if n := d.record(b); n != 2 {
+		t.Fatalf("ports should count as the same host: %d", n)
+	}
+
+	// Only the most recent sources are kept.
+	for i := 0; i < maxDecryptSources; i++ {
+		d.record(&net.UDPAddr{IP: net.IPv4(10, 0, byte(i/256), byte(i%256)), Port: 7946})
+	}
+	got := d.snapshot()
+	if len(got) != maxDecryptSources {
+		t.Fatalf("bad: %d sources", len(got))
+	}
+	if _, ok := got["127.0.0.9"]; ok {
+		t.Fatalf("oldest source should have been dropped")
+	}
+	if got[fmt.Sprintf("10.0.0.%d", maxDecryptSources-1)] != 1 {
+		t.Fatalf("bad: %v", got)
+	}
+}
@@ -0,0 +1,71 @@
+package memberlist
+
+import (
+	"sync"
+	"time"
+)
+
+// dedupKey identifies a suspect or dead message for deduplication. The
+// sender is part of the key so that independent suspicions about the same
+// node from different peers still reach the suspicion timer as
+// confirmations.
+type dedupKey struct {
+	msgType     messageType
+	node        string
+	incarnation uint32
+	from        string
+}
+
+// dedupCache is a short-lived record of the suspect and dead messages we've
+// handled recently. The same message is gossiped to us many times over while
+// it propagates, and there's no point in taking the node lock, invoking
+// delegates, or considering a rebroadcast for a copy we've just processed.
+type dedupCache struct {
+	sync.Mutex
+
+	// ttl is how long a message is remembered for. A zero ttl disables
+	// the cache.
+	ttl time.Duration
+
+	// seen maps messages to when we first handled them.
+	seen map[dedupKey]time.Time
+
+	// lastSweep is when we last dropped expired entries.
+	lastSweep time.Time
+}
+
+// newDedupCache returns a cache that remembers messages for the given ttl.
+func newDedupCache(ttl time.Duration) *dedupCache {
+	return &dedupCache{
+		ttl:  ttl,
+		seen: make(map[dedupKey]time.Time),
+	}
+}
+
+// Seen returns true if the given message was already handled within the ttl.
+// Otherwise the message is recorded and false is returned, so the caller
+// should go on and process it.
+func (c *dedupCache) Seen(key dedupKey, now time.Time) bool {
+	if c.ttl <= 0 {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// Periodically drop expired entries to bound the size of the map.
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, at := range c.seen {
+			if now.Sub(at) >= c.ttl {
+				delete(c.seen, k)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if at, ok := c.seen[key]; ok && now.Sub(at) < c.ttl {
+		return true
+	}
+	c.seen[key] = now
+	return false
+}
@@ -0,0 +1,84 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupCache(t *testing.T) {
+	c := newDedupCache(time.Second)
+	now := time.Now()
+
+	key := dedupKey{suspectMsg, "foo", 1, "bar"}
+	if c.Seen(key, now) {
+		t.Fatalf("should not have seen message")
+	}
+	if !c.Seen(key, now.Add(10*time.Millisecond)) {
+		t.Fatalf("should have seen message")
+	}
+
+	// Any difference in the key is a different message.
+	others := []dedupKey{
+		{deadMsg, "foo", 1, "bar"},
+		{suspectMsg, "baz", 1, "bar"},
+		{suspectMsg, "foo", 2, "bar"},
+		{suspectMsg, "foo", 1, "baz"},
+	}
+	for _, other := range others {
+		if c.Seen(other, now.Add(10*time.Millisecond)) {
+			t.Fatalf("should not have seen %v", other)
+		}
+	}
+
+	// Entries expire after the ttl and get swept.
+	if c.Seen(key, now.Add(2*time.Second)) {
+		t.Fatalf("should have expired")
+	}
+	if len(c.seen) != 1 {
+		t.Fatalf("expected expired entries to be swept: %d", len(c.seen))
+	}
+}
+
+func TestDedupCache_Disabled(t *testing.T) {
+	c := newDedupCache(0)
+	key := dedupKey{deadMsg, "foo", 1, "bar"}
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if c.Seen(key, now) {
+			t.Fatalf("should never see messages when disabled")
+		}
+	}
+}
+
+func TestMemberList_HandleSuspect_Dedup(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	m.broadcasts.Reset()
+
+	s := suspect{Node: "test", Incarnation: 1, From: "other"}
+	buf, err := encode(suspectMsg, &s)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.handleSuspect(buf.Bytes()[1:], nil)
+	if m.nodeMap["test"].State != stateSuspect {
+		t.Fatalf("expected node to be suspect")
+	}
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("expected queued message")
+	}
+
+	// A repeat of the same message should be dropped before it gets
+	// anywhere near the state machine.
+	m.broadcasts.Reset()
+	m.handleSuspect(buf.Bytes()[1:], nil)
+	if m.broadcasts.NumQueued() != 0 {
+		t.Fatalf("expected duplicate to be dropped")
+	}
+	if len(m.dedup.seen) != 1 {
+		t.Fatalf("bad: %v", m.dedup.seen)
+	}
+}
@@ -35,3 +35,49 @@ type Delegate interface {
 	// boolean indicates this is for a join instead of a push/pull.
 	MergeRemoteState(buf []byte, join bool)
 }
+
+// SequencedMsgDelegate can also be implemented by a Delegate to be told
+// who sent each message queued with Memberlist.BroadcastSequenced, and its
+// sequence number. Those messages go here instead of to NotifyMsg. Each
+// origin numbers its messages from 1, so a gap means a message was missed
+// and a lower number than before means it arrived out of order, or that
+// the origin restarted. A message may arrive more than once.
+type SequencedMsgDelegate interface {
+	NotifySequencedMsg(origin string, seq uint64, msg []byte)
+}
+
+// ReplayDelegate can also be implemented by a Delegate that keeps a log of
+// the messages queued with Memberlist.BroadcastSequenced, both its own and
+// those it got, to replay them to members that missed them. See
+// Memberlist.Backfill.
+type ReplayDelegate interface {
+	// Replay returns the messages from origin with sequence numbers from
+	// first to last inclusive, in order. Messages no longer in the log are
+	// left out. Care should be taken that this method does not block for
+	// long, since the member asking is waiting on it.
+	Replay(origin string, first, last uint64) []ReplayedMsg
+}
+
+// ReplayedMsg is a message from a ReplayDelegate's log.
+type ReplayedMsg struct {
+	Seq uint64
+	Msg []byte
+}
+
+// LabeledMsgDelegate can also be implemented by a Delegate to be told the
+// cluster label each user message arrived with, which can differ from
+// Config.Label when Config.AcceptLabels is set. Messages go here instead
+// of to NotifyMsg.
+type LabeledMsgDelegate interface {
+	NotifyLabeledMsg(label string, msg []byte)
+}
+
+// notifyMsg passes a user message that arrived with the given label to the
+// delegate.
+func notifyMsg(d Delegate, label string, msg []byte) {
+	if ld, ok := d.(LabeledMsgDelegate); ok {
+		ld.NotifyLabeledMsg(label, msg)
+		return
+	}
+	d.NotifyMsg(msg)
+}
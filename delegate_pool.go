@@ -0,0 +1,173 @@
+package memberlist
+
+import (
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// delegatePool runs notification callbacks on a fixed set of goroutines so
+// that a slow delegate can't hold up the packet handler or the probe loop.
+//
+// Each worker has its own bounded queue, and callbacks are assigned to a
+// worker by a key, normally the name of the node they're about. Since
+// memberlist dispatches a node's events while holding the node lock, in the
+// order its state changes, this guarantees that the events for any one node
+// are delivered in order, while events for different nodes can proceed in
+// parallel. Once a worker's queue fills up, dispatching to it blocks until a
+// slot frees, which at least keeps memory in check when a delegate stops
+// making progress altogether.
+//
+// Only fire-and-forget callbacks go through the pool. Callbacks whose
+// results memberlist needs, such as NodeMeta or LocalState, are still
+// invoked inline.
+type delegatePool struct {
+	shards []chan delegateTask
+	next   uint32 // Used to spread unkeyed tasks over the shards
+	stopCh chan struct{}
+	stop   sync.Once
+	logger *log.Logger
+}
+
+// delegateTask is a single callback waiting to be run.
+type delegateTask struct {
+	name string
+	fn   func()
+}
+
+// newDelegatePool starts the given number of workers, splitting a total
+// queue depth of the given size between them. Each worker gets room for at
+// least one task.
+func newDelegatePool(workers, depth int, logger *log.Logger) *delegatePool {
+	perShard := (depth + workers - 1) / workers
+	if perShard < 1 {
+		perShard = 1
+	}
+	p := &delegatePool{
+		shards: make([]chan delegateTask, workers),
+		stopCh: make(chan struct{}),
+		logger: logger,
+	}
+	for i := range p.shards {
+		p.shards[i] = make(chan delegateTask, perShard)
+		go p.worker(p.shards[i])
+	}
+	return p
+}
+
+// worker runs the tasks in its queue in order until the pool is shut down,
+// at which point it runs whatever is left in the queue and exits.
+func (p *delegatePool) worker(tasks chan delegateTask) {
+	for {
+		select {
+		case t := <-tasks:
+			runDelegate(p.logger, t.name, t.fn)
+		case <-p.stopCh:
+			for {
+				select {
+				case t := <-tasks:
+					runDelegate(p.logger, t.name, t.fn)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// shard returns the queue for the given key. Tasks with the same non-empty
+// key always land on the same queue; tasks with an empty key aren't ordered
+// with respect to anything, so they're spread over all the queues.
+func (p *delegatePool) shard(key string) chan delegateTask {
+	var idx uint32
+	if key == "" {
+		idx = atomic.AddUint32(&p.next, 1)
+	} else {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		idx = h.Sum32()
+	}
+	return p.shards[idx%uint32(len(p.shards))]
+}
+
+// Dispatch queues the given callback behind any others with the same key.
+// If the pool has been shut down the callback is dropped.
+func (p *delegatePool) Dispatch(key, name string, fn func()) {
+	tasks := p.shard(key)
+	t := delegateTask{name, fn}
+	select {
+	case tasks <- t:
+		return
+	case <-p.stopCh:
+		return
+	default:
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "delegate", "queue_full"}, 1)
+	p.logger.Printf("[WARN] memberlist: Delegate queue is full, waiting to dispatch %s", name)
+	select {
+	case tasks <- t:
+	case <-p.stopCh:
+	}
+}
+
+// Queued returns the number of callbacks waiting to be run.
+func (p *delegatePool) Queued() int {
+	n := 0
+	for _, tasks := range p.shards {
+		n += len(tasks)
+	}
+	return n
+}
+
+// Shutdown stops the workers once they've drained their queues. It doesn't
+// wait for them, since it may itself be called from within a delegate.
+//
+// This method is safe to call multiple times.
+func (p *delegatePool) Shutdown() {
+	p.stop.Do(func() {
+		close(p.stopCh)
+	})
+}
+
+// runDelegate invokes a delegate callback, recovering from and logging any
+// panic so that a misbehaving delegate can't take down memberlist.
+func runDelegate(logger *log.Logger, name string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			metrics.IncrCounter([]string{"memberlist", "delegate", "panic"}, 1)
+			logger.Printf("[ERR] memberlist: Recovered from panic in delegate %s: %v", name, r)
+		}
+	}()
+
+	start := time.Now()
+	fn()
+	metrics.MeasureSince([]string{"memberlist", "delegate", name}, start)
+}
+
+// eventNode returns the node to hand to an EventDelegate for the given
+// state. Pooled callbacks run after the node lock has been released, so they
+// get a copy rather than a pointer into our state.
+func (m *Memberlist) eventNode(state *nodeState) *Node {
+	if m.delegates == nil {
+		return &state.Node
+	}
+	node := state.Node
+	return &node
+}
+
+// dispatchDelegate runs a notification callback, either on the delegate pool
+// if one is configured, or inline. Callbacks about a node should pass its
+// name as the key so they're delivered in order; others can pass an empty
+// key.
+func (m *Memberlist) dispatchDelegate(key, name string, fn func()) {
+	if m.delegates != nil {
+		m.delegates.Dispatch(key, name, fn)
+		return
+	}
+	runDelegate(m.logger, name, fn)
+}
@@ -0,0 +1,269 @@
+package memberlist
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDelegatePool_Dispatch(t *testing.T) {
+	p := newDelegatePool(2, 4, log.New(os.Stderr, "", log.LstdFlags))
+	defer p.Shutdown()
+
+	doneCh := make(chan struct{}, 3)
+	p.Dispatch("", "panic", func() {
+		panic("boom")
+	})
+	for i := 0; i < 3; i++ {
+		p.Dispatch("", "test", func() {
+			doneCh <- struct{}{}
+		})
+	}
+
+	// The panic should be contained, and the other tasks still run.
+	for i := 0; i < 3; i++ {
+		select {
+		case <-doneCh:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for task %d", i)
+		}
+	}
+}
+
+func TestDelegatePool_Ordering(t *testing.T) {
+	p := newDelegatePool(4, 64, log.New(os.Stderr, "", log.LstdFlags))
+	defer p.Shutdown()
+
+	const keys, perKey = 8, 100
+	type result struct {
+		key string
+		seq int
+	}
+	resultCh := make(chan result, keys*perKey)
+	for i := 0; i < perKey; i++ {
+		for k := 0; k < keys; k++ {
+			key, seq := fmt.Sprintf("node%d", k), i
+			p.Dispatch(key, "test", func() {
+				resultCh <- result{key, seq}
+			})
+		}
+	}
+
+	last := make(map[string]int)
+	for i := 0; i < keys*perKey; i++ {
+		select {
+		case r := <-resultCh:
+			if prev, ok := last[r.key]; ok && r.seq != prev+1 {
+				t.Fatalf("out of order for %s: %d after %d", r.key, r.seq, prev)
+			}
+			last[r.key] = r.seq
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for task %d", i)
+		}
+	}
+}
+
+func TestDelegatePool_Shutdown(t *testing.T) {
+	p := newDelegatePool(1, 1, log.New(os.Stderr, "", log.LstdFlags))
+
+	// Wedge the only worker, then fill the queue.
+	blockCh := make(chan struct{})
+	startCh := make(chan struct{})
+	p.Dispatch("", "block", func() {
+		close(startCh)
+		<-blockCh
+	})
+	<-startCh
+	ranCh := make(chan struct{}, 1)
+	p.Dispatch("", "queued", func() {
+		ranCh <- struct{}{}
+	})
+
+	// A dispatch onto a full queue should be released by shutdown.
+	doneCh := make(chan struct{})
+	go func() {
+		p.Dispatch("", "dropped", func() {
+			t.Errorf("should not run")
+		})
+		close(doneCh)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	p.Shutdown()
+	p.Shutdown()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("dispatch should not block after shutdown")
+	}
+
+	// What was already queued should still be delivered.
+	close(blockCh)
+	select {
+	case <-ranCh:
+	case <-time.After(time.Second):
+		t.Fatalf("queued task should run")
+	}
+}
+
+func TestDelegatePool_Inline_Panic(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	ran := false
+	m.dispatchDelegate("", "panic", func() {
+		ran = true
+		panic("boom")
+	})
+	if !ran {
+		t.Fatalf("should run inline")
+	}
+}
+
+// blockingEventDelegate is an EventDelegate that never returns until it's
+// released.
+type blockingEventDelegate struct {
+	releaseCh chan struct{}
+	joinCh    chan string
+}
+
+func (b *blockingEventDelegate) NotifyJoin(n *Node) {
+	<-b.releaseCh
+	b.joinCh <- n.Name
+}
+
+func (b *blockingEventDelegate) NotifyLeave(n *Node)  {}
+func (b *blockingEventDelegate) NotifyUpdate(n *Node) {}
+
+func TestMemberList_DelegateWorkers(t *testing.T) {
+	d := &blockingEventDelegate{
+		releaseCh: make(chan struct{}),
+		joinCh:    make(chan string, 1),
+	}
+	m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+		c.DelegateWorkers = 1
+		c.Events = d
+	})
+	defer m.Shutdown()
+
+	// This would hang if the delegate ran inline.
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	doneCh := make(chan struct{})
+	go func() {
+		m.aliveNode(&a, nil, false)
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("alive processing blocked on the delegate")
+	}
+
+	close(d.releaseCh)
+	select {
+	case name := <-d.joinCh:
+		if name != "test" {
+			t.Fatalf("bad: %s", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for join")
+	}
+}
+
+func TestMemberList_DelegateWorkers_Ordering(t *testing.T) {
+	ch := make(chan NodeEvent, 64)
+	m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+		c.DelegateWorkers = 4
+		c.Events = &ChannelEventDelegate{ch}
+	})
+	defer m.Shutdown()
+
+	// Run several nodes through join, update, leave and rejoin, interleaved
+	// with each other.
+	names := []string{"a", "b", "c", "d", "e", "f"}
+	for _, name := range names {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	for _, name := range names {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Meta: []byte("x"), Incarnation: 2}
+		m.aliveNode(&a, nil, false)
+	}
+	for _, name := range names {
+		d := dead{Node: name, Incarnation: 2}
+		m.deadNode(&d)
+	}
+	for _, name := range names {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 3}
+		m.aliveNode(&a, nil, false)
+	}
+
+	expected := []NodeEventType{NodeJoin, NodeUpdate, NodeLeave, NodeJoin}
+	seen := make(map[string][]NodeEventType)
+	for i := 0; i < len(names)*len(expected); i++ {
+		select {
+		case e := <-ch:
+			seen[e.Node.Name] = append(seen[e.Node.Name], e.Event)
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+	for _, name := range names {
+		if !reflect.DeepEqual(seen[name], expected) {
+			t.Fatalf("bad events for %s: %v", name, seen[name])
+		}
+	}
+}
+
+// chanSequencedDelegate passes sequenced messages on to a channel, taking
+// longer over odd ones so that any reordering shows.
+type chanSequencedDelegate struct {
+	MockDelegate
+	ch chan sequencedMsg
+}
+
+func (d *chanSequencedDelegate) NotifySequencedMsg(origin string, seq uint64, msg []byte) {
+	if seq%2 == 1 {
+		time.Sleep(time.Millisecond)
+	}
+	d.ch <- sequencedMsg{origin, seq, string(msg)}
+}
+
+func TestMemberList_DelegateWorkers_Sequenced(t *testing.T) {
+	d := &chanSequencedDelegate{ch: make(chan sequencedMsg, 128)}
+	m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+		c.DelegateWorkers = 4
+		c.Delegate = d
+	})
+	defer m.Shutdown()
+
+	// Interleave messages from several origins, each in sequence.
+	origins := []string{"a", "b", "c"}
+	const count = 20
+	for seq := uint64(1); seq <= count; seq++ {
+		for _, origin := range origins {
+			buf := make([]byte, 2*binary.MaxVarintLen64)
+			n := binary.PutUvarint(buf, seq)
+			n += binary.PutUvarint(buf[n:], uint64(len(origin)))
+			buf = append(buf[:n], origin...)
+			m.handleUserSequenced(buf, nil, "")
+		}
+	}
+
+	// Each origin's messages come out in the order they went in.
+	last := make(map[string]uint64)
+	for i := 0; i < len(origins)*count; i++ {
+		select {
+		case msg := <-d.ch:
+			if msg.seq != last[msg.origin]+1 {
+				t.Fatalf("%s: got %d after %d", msg.origin, msg.seq, last[msg.origin])
+			}
+			last[msg.origin] = msg.seq
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+}
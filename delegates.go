@@ -0,0 +1,155 @@
+package memberlist
+
+import (
+	"fmt"
+)
+
+// Delegates groups the delegates most applications set, to be put on a
+// Config in one go with Config.SetDelegates. Each is registered with a
+// method that takes its own interface, so a type that's missing a method
+// is caught by the compiler rather than silently left out, and mistakes
+// such as registering a nil delegate or two for the same role are
+// reported by SetDelegates. Any number of event delegates can be added,
+// and they're all told about every event, in the order they were added,
+// or each on its own goroutine if Config.EventQueueDepth is set.
+//
+// The methods return the Delegates so that calls can be chained.
+type Delegates struct {
+	delegate Delegate
+	conflict ConflictDelegate
+	merge    MergeDelegate
+	alive    AliveDelegate
+	ping     PingDelegate
+	events   []EventDelegate
+	eventsV2 []EventDelegateV2
+	errs     []error
+}
+
+// set records a single delegate, or an error if it's nil or one was
+// already registered for the role.
+func (d *Delegates) set(role string, isNil, isSet bool, set func()) *Delegates {
+	switch {
+	case isNil:
+		d.errs = append(d.errs, fmt.Errorf("%s delegate is nil", role))
+	case isSet:
+		d.errs = append(d.errs, fmt.Errorf("%s delegate is already registered", role))
+	default:
+		set()
+	}
+	return d
+}
+
+// WithDelegate registers the Delegate.
+func (d *Delegates) WithDelegate(del Delegate) *Delegates {
+	return d.set("Delegate", del == nil, d.delegate != nil, func() { d.delegate = del })
+}
+
+// WithConflict registers the ConflictDelegate.
+func (d *Delegates) WithConflict(c ConflictDelegate) *Delegates {
+	return d.set("Conflict", c == nil, d.conflict != nil, func() { d.conflict = c })
+}
+
+// WithMerge registers the MergeDelegate.
+func (d *Delegates) WithMerge(m MergeDelegate) *Delegates {
+	return d.set("Merge", m == nil, d.merge != nil, func() { d.merge = m })
+}
+
+// WithAlive registers the AliveDelegate.
+func (d *Delegates) WithAlive(a AliveDelegate) *Delegates {
+	return d.set("Alive", a == nil, d.alive != nil, func() { d.alive = a })
+}
+
+// WithPing registers the PingDelegate.
+func (d *Delegates) WithPing(p PingDelegate) *Delegates {
+	return d.set("Ping", p == nil, d.ping != nil, func() { d.ping = p })
+}
+
+// AddEvents adds an EventDelegate.
+func (d *Delegates) AddEvents(e EventDelegate) *Delegates {
+	return d.set("Events", e == nil, false, func() { d.events = append(d.events, e) })
+}
+
+// AddEventsV2 adds an EventDelegateV2.
+func (d *Delegates) AddEventsV2(e EventDelegateV2) *Delegates {
+	return d.set("EventsV2", e == nil, false, func() { d.eventsV2 = append(d.eventsV2, e) })
+}
+
+// SetDelegates checks the delegates registered with d and sets them on the
+// Config, replacing any it had for the same roles. Several event delegates
+// are combined into one that passes each event to them all. Nothing is
+// changed if there's an error.
+func (c *Config) SetDelegates(d *Delegates) error {
+	if len(d.errs) == 1 {
+		return d.errs[0]
+	}
+	if len(d.errs) > 1 {
+		return fmt.Errorf("%d errors in delegates, first: %v", len(d.errs), d.errs[0])
+	}
+
+	c.Delegate = d.delegate
+	c.Conflict = d.conflict
+	c.Merge = d.merge
+	c.Alive = d.alive
+	c.Ping = d.ping
+
+	c.Events = nil
+	switch len(d.events) {
+	case 0:
+	case 1:
+		c.Events = d.events[0]
+	default:
+		c.Events = eventFanout(append([]EventDelegate(nil), d.events...))
+	}
+
+	c.EventsV2 = nil
+	switch len(d.eventsV2) {
+	case 0:
+	case 1:
+		c.EventsV2 = d.eventsV2[0]
+	default:
+		c.EventsV2 = eventFanoutV2(append([]EventDelegateV2(nil), d.eventsV2...))
+	}
+	return nil
+}
+
+// eventFanout passes each event to several EventDelegates in turn.
+type eventFanout []EventDelegate
+
+func (f eventFanout) NotifyJoin(n *Node) {
+	for _, e := range f {
+		e.NotifyJoin(n)
+	}
+}
+
+func (f eventFanout) NotifyLeave(n *Node) {
+	for _, e := range f {
+		e.NotifyLeave(n)
+	}
+}
+
+func (f eventFanout) NotifyUpdate(n *Node) {
+	for _, e := range f {
+		e.NotifyUpdate(n)
+	}
+}
+
+// eventFanoutV2 passes each event to several EventDelegateV2s in turn.
+type eventFanoutV2 []EventDelegateV2
+
+func (f eventFanoutV2) NotifyJoin(n *Node) {
+	for _, e := range f {
+		e.NotifyJoin(n)
+	}
+}
+
+func (f eventFanoutV2) NotifyLeave(n *Node, reason LeaveReason) {
+	for _, e := range f {
+		e.NotifyLeave(n, reason)
+	}
+}
+
+func (f eventFanoutV2) NotifyUpdate(n *Node) {
+	for _, e := range f {
+		e.NotifyUpdate(n)
+	}
+}
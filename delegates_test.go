@@ -0,0 +1,86 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfig_SetDelegates(t *testing.T) {
+	d := &MockDelegate{}
+	conflict := &MockConflict{}
+	ch1 := &ChannelEventDelegate{Ch: make(chan NodeEvent, 1)}
+
+	c := testConfig()
+	err := c.SetDelegates(new(Delegates).
+		WithDelegate(d).
+		WithConflict(conflict).
+		AddEvents(ch1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if c.Delegate != d || c.Conflict != conflict || c.Events != ch1 || c.Merge != nil || c.EventsV2 != nil {
+		t.Fatalf("bad: %+v", c)
+	}
+
+	// Mistakes are reported, and nothing changes.
+	bad := []*Delegates{
+		new(Delegates).WithDelegate(nil),
+		new(Delegates).WithPing(&MockPing{}).WithPing(&MockPing{}),
+		new(Delegates).AddEvents(ch1).AddEvents(nil),
+	}
+	for i, b := range bad {
+		if err := c.SetDelegates(b); err == nil {
+			t.Fatalf("case %d: expected error", i)
+		}
+		if c.Delegate != d || c.Ping != nil {
+			t.Fatalf("case %d: config changed", i)
+		}
+	}
+}
+
+func TestMemberlist_EventFanout(t *testing.T) {
+	ch1 := make(chan NodeEvent, 16)
+	ch2 := make(chan NodeEvent, 16)
+
+	c1 := testConfig()
+	if err := c1.SetDelegates(new(Delegates).
+		AddEvents(&ChannelEventDelegate{Ch: ch1}).
+		AddEvents(&ChannelEventDelegate{Ch: ch2})); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = c1.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Both delegates hear about both nodes joining, in the same order.
+	for _, ch := range []chan NodeEvent{ch1, ch2} {
+		var names []string
+		for len(names) < 2 {
+			select {
+			case e := <-ch:
+				if e.Event != NodeJoin {
+					t.Fatalf("bad: %v", e)
+				}
+				names = append(names, e.Node.Name)
+			case <-time.After(time.Second):
+				t.Fatalf("timeout")
+			}
+		}
+		if names[0] != c1.Name || names[1] != c2.Name {
+			t.Fatalf("bad: %v", names)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package memberlist
+
+import (
+	"net"
+	"sync"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Downgrade protection stops an attacker quietly moving a peer onto weaker
+protocol versions, for example by replaying an alive message or push/pull
+from before it was upgraded. We remember the best each peer has offered:
+the highest protocol and delegate protocol versions each node has
+advertised, and the strongest protection on packets from each address,
+where encryption beats authentication alone and newer encryption versions
+beat older ones. Anything less is a downgrade.
+
+Downgrades are always counted and reported to Config.Downgrade. With
+Config.RefuseDowngrades set they're also dropped, which means a node that
+really is rolled back to an older version has to be let back in with
+AcceptDowngrade. Records are kept apart from the node map so that they
+outlive a node being reaped.
+*/
+
+// Sealing levels for packets, weakest first.
+const (
+	sealAuth      = 0
+	sealEncrypted = 1 // Plus the encryption version
+)
+
+// capabilityState is the best we've seen from each peer.
+type capabilityState struct {
+	sync.Mutex
+	versions map[string][2]uint8 // Node name to highest PMax, DMax
+	sealing  map[string]int      // Address to strongest sealing
+}
+
+// AcceptDowngrade forgets the best protocol versions we've seen from a
+// node, so that it can rejoin after being rolled back to an older version
+// while RefuseDowngrades is set.
+func (m *Memberlist) AcceptDowngrade(node string) {
+	m.caps.Lock()
+	defer m.caps.Unlock()
+	delete(m.caps.versions, node)
+}
+
+// checkVersions records the protocol versions a node advertises, returning
+// false if they're a downgrade that should be refused.
+func (m *Memberlist) checkVersions(node string, vsn []uint8, from net.Addr) bool {
+	if len(vsn) < 6 {
+		return true
+	}
+	offered := [2]uint8{vsn[1], vsn[4]}
+
+	m.caps.Lock()
+	if m.caps.versions == nil {
+		m.caps.versions = make(map[string][2]uint8)
+	}
+	best, ok := m.caps.versions[node]
+	var events []DowngradeEvent
+	for i, name := range []string{"protocol", "delegate_protocol"} {
+		if ok && offered[i] < best[i] {
+			events = append(events, DowngradeEvent{
+				Node:       node,
+				Capability: name,
+				Previous:   int(best[i]),
+				Current:    int(offered[i]),
+			})
+		} else {
+			best[i] = offered[i]
+		}
+	}
+	refuse := len(events) > 0 && m.config.RefuseDowngrades
+	if !refuse {
+		m.caps.versions[node] = best
+	}
+	m.caps.Unlock()
+
+	for _, e := range events {
+		if from != nil {
+			e.Addr = from.String()
+		}
+		e.Refused = refuse
+		m.notifyDowngrade(e, from)
+	}
+	return !refuse
+}
+
+// checkSealing records how a packet from an address was protected,
+// returning false if it's a downgrade that should be refused.
+func (m *Memberlist) checkSealing(from net.Addr, level int) bool {
+	if from == nil {
+		return true
+	}
+	addr := from.String()
+
+	m.caps.Lock()
+	if m.caps.sealing == nil {
+		m.caps.sealing = make(map[string]int)
+	}
+	best, ok := m.caps.sealing[addr]
+	downgrade := ok && level < best
+	if !downgrade {
+		m.caps.sealing[addr] = level
+	}
+	m.caps.Unlock()
+
+	if !downgrade {
+		return true
+	}
+	m.notifyDowngrade(DowngradeEvent{
+		Addr:       addr,
+		Capability: "sealing",
+		Previous:   best,
+		Current:    level,
+		Refused:    m.config.RefuseDowngrades,
+	}, from)
+	return !m.config.RefuseDowngrades
+}
+
+// notifyDowngrade logs and reports a downgrade.
+func (m *Memberlist) notifyDowngrade(e DowngradeEvent, from net.Addr) {
+	metrics.IncrCounter([]string{"memberlist", "downgrade", e.Capability}, 1)
+	action := "Allowing"
+	if e.Refused {
+		action = "Refusing"
+	}
+	if e.Node != "" {
+		m.packetLog.Printf("[WARN] memberlist: %s %s downgrade from %d to %d for node '%s' %s",
+			action, e.Capability, e.Previous, e.Current, e.Node, LogAddress(from))
+	} else {
+		m.packetLog.Printf("[WARN] memberlist: %s %s downgrade from %d to %d %s",
+			action, e.Capability, e.Previous, e.Current, LogAddress(from))
+	}
+
+	if d := m.config.Downgrade; d != nil {
+		m.dispatchDelegate(e.Node, "notify_downgrade", func() {
+			d.NotifyDowngrade(e)
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package memberlist
+
+// DowngradeEvent describes a peer offering less than it has before.
+type DowngradeEvent struct {
+	// Node is the node the downgrade is about, for protocol versions, and
+	// Addr is the address it came from, if known.
+	Node string
+	Addr string
+
+	// Capability is "protocol" or "delegate_protocol" for the highest
+	// version a node says it speaks, or "sealing" for how packets from an
+	// address are protected: 0 is authenticated only, and 1 and up are
+	// encrypted, higher being newer encryption versions.
+	Capability string
+
+	// Previous is the best we've seen, and Current what was just offered.
+	Previous int
+	Current  int
+
+	// Refused is set if the message was dropped because of
+	// Config.RefuseDowngrades.
+	Refused bool
+}
+
+// DowngradeDelegate is used to find out about possible protocol downgrade
+// attacks.
+type DowngradeDelegate interface {
+	// NotifyDowngrade is invoked when a peer offers older protocol versions
+	// or weaker protection than it has before.
+	NotifyDowngrade(DowngradeEvent)
+}
@@ -0,0 +1,116 @@
+package memberlist
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type mockDowngradeDelegate struct {
+	lock   sync.Mutex
+	events []DowngradeEvent
+}
+
+func (d *mockDowngradeDelegate) NotifyDowngrade(e DowngradeEvent) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.events = append(d.events, e)
+}
+
+func (d *mockDowngradeDelegate) getEvents() []DowngradeEvent {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]DowngradeEvent(nil), d.events...)
+}
+
+func TestMemberList_AliveNode_Downgrade(t *testing.T) {
+	for _, refuse := range []bool{false, true} {
+		d := &mockDowngradeDelegate{}
+		c := testConfig()
+		c.Downgrade = d
+		c.RefuseDowngrades = refuse
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer m.Shutdown()
+
+		a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Vsn: []uint8{1, 5, 5, 0, 2, 2}}
+		m.aliveNode(&a, nil, false)
+
+		// An upgrade is fine.
+		a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 2, Vsn: []uint8{1, 5, 5, 0, 3, 3}}
+		m.aliveNode(&a, nil, false)
+
+		// Dropping the maximum protocol version isn't.
+		a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 3, Vsn: []uint8{1, 4, 4, 0, 3, 3}}
+		m.aliveNode(&a, nil, false)
+
+		m.nodeLock.RLock()
+		state := *m.nodeMap["test"]
+		m.nodeLock.RUnlock()
+		if refuse && (state.Incarnation != 2 || state.PMax != 5) {
+			t.Fatalf("downgrade should be refused: %+v", state)
+		}
+		if !refuse && (state.Incarnation != 3 || state.PMax != 4) {
+			t.Fatalf("downgrade should be allowed: %+v", state)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+		events := d.getEvents()
+		if len(events) != 1 {
+			t.Fatalf("expected one event, got %v", events)
+		}
+		e := events[0]
+		if e.Node != "test" || e.Capability != "protocol" || e.Previous != 5 || e.Current != 4 || e.Refused != refuse {
+			t.Fatalf("bad event: %+v", e)
+		}
+
+		// Once accepted, the node can come back on the older version.
+		if refuse {
+			m.AcceptDowngrade("test")
+			a = alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 4, Vsn: []uint8{1, 4, 4, 0, 3, 3}}
+			m.aliveNode(&a, nil, false)
+			m.nodeLock.RLock()
+			inc := m.nodeMap["test"].Incarnation
+			m.nodeLock.RUnlock()
+			if inc != 4 {
+				t.Fatalf("accepted downgrade should apply, got incarnation %d", inc)
+			}
+		}
+	}
+}
+
+func TestMemberlist_CheckSealing(t *testing.T) {
+	d := &mockDowngradeDelegate{}
+	c := testConfig()
+	c.Downgrade = d
+	c.RefuseDowngrades = true
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1235}
+	if !m.checkSealing(from, sealEncrypted) || !m.checkSealing(from, sealEncrypted+1) {
+		t.Fatalf("upgrades should be allowed")
+	}
+	if m.checkSealing(from, sealEncrypted) {
+		t.Fatalf("older encryption should be refused")
+	}
+	if m.checkSealing(from, sealAuth) {
+		t.Fatalf("authentication only should be refused")
+	}
+	if !m.checkSealing(other, sealAuth) {
+		t.Fatalf("other peers are unaffected")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	events := d.getEvents()
+	if len(events) != 2 || events[1].Capability != "sealing" || events[1].Previous != 2 || events[1].Current != 0 {
+		t.Fatalf("bad events: %+v", events)
+	}
+}
@@ -0,0 +1,97 @@
+package memberlist
+
+import (
+	"sync"
+)
+
+/*
+With EnableECN we mark the packets we send as ECN capable, so a router
+with active queue management that would otherwise drop them as a link
+fills up can mark them congestion experienced (CE) instead, and we read
+those marks on the packets we receive.
+
+Members gossip to each other more or less evenly, so marks on what
+reaches us mostly come from the links near us, which carry our own gossip
+out too. Rather than echo the marks back to each sender as TCP does, which
+would need a new field on the wire, every member backs off its own gossip
+when it sees them. The response is AIMD, like TCP's: each gossip round
+after a mark halves our gossip rate, down to minGossipScale, and each
+round without one wins back gossipScaleStep of it. The rate is spread
+over the nodes gossiped to each round, so backing off first cuts the
+fanout and then, once that's down to a single node, skips rounds.
+
+Only gossip is throttled. Probes, acks and push/pulls are a small share of
+the traffic, and holding them back would make healthy nodes look failed
+just when the network is already struggling.
+*/
+
+const (
+	// The ECN codepoints, from the bottom two bits of the IPv4 TOS or IPv6
+	// traffic class field.
+	ecnMask = 0x03
+	ecnECT0 = 0x02
+	ecnCE   = 0x03
+
+	// minGossipScale is the smallest fraction of the configured gossip rate
+	// we back off to under congestion.
+	minGossipScale = 1.0 / 16
+
+	// gossipScaleStep is how much of the configured gossip rate each round
+	// without congestion wins back.
+	gossipScaleStep = 1.0 / 16
+)
+
+// gossipCongestion tracks the congestion marks we've seen, and how far
+// we've backed off our gossip because of them.
+type gossipCongestion struct {
+	sync.Mutex
+	marks  int     // CE-marked packets since the last round
+	scale  float64 // Fraction of the configured rate, with zero meaning 1
+	credit float64 // Nodes owed to later rounds
+}
+
+// mark records packets we received marked congestion experienced.
+func (c *gossipCongestion) mark(n int) {
+	c.Lock()
+	defer c.Unlock()
+	c.marks += n
+}
+
+// fanout starts a gossip round, adjusting the rate for any marks seen since
+// the last, and returns how many of the configured number of nodes to
+// gossip to.
+func (c *gossipCongestion) fanout(nodes int) int {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.scale == 0 {
+		c.scale = 1
+	}
+	if c.marks > 0 {
+		c.scale /= 2
+		if c.scale < minGossipScale {
+			c.scale = minGossipScale
+		}
+	} else if c.scale < 1 {
+		c.scale += gossipScaleStep
+		if c.scale > 1 {
+			c.scale = 1
+		}
+	}
+	c.marks = 0
+
+	c.credit += float64(nodes) * c.scale
+	n := int(c.credit)
+	c.credit -= float64(n)
+	return n
+}
+
+// rate returns the fraction of the configured gossip rate we're sending.
+func (c *gossipCongestion) rate() float64 {
+	c.Lock()
+	defer c.Unlock()
+	if c.scale == 0 {
+		return 1
+	}
+	return c.scale
+}
@@ -0,0 +1,47 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// enableECN marks the packets sent from the given socket as ECN capable,
+// and asks for the ECN field of the packets it receives. A socket bound to
+// an IPv4 address only takes the IPv4 options, so it's enough for either
+// family to work.
+func enableECN(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ok4, ok6 bool
+	err = raw.Control(func(fd uintptr) {
+		ok4 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, ecnECT0) == nil &&
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1) == nil
+		ok6 = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, ecnECT0) == nil &&
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_RECVTCLASS, 1) == nil
+	})
+	if err != nil {
+		return err
+	}
+	if !ok4 && !ok6 {
+		return fmt.Errorf("Failed to set ECN socket options")
+	}
+	return nil
+}
+
+// markedCE returns true if a control message carries the ECN field of a
+// packet marked congestion experienced.
+func markedCE(msg syscall.SocketControlMessage) bool {
+	switch {
+	case msg.Header.Level == syscall.IPPROTO_IP && msg.Header.Type == syscall.IP_TOS && len(msg.Data) >= 1:
+		return msg.Data[0]&ecnMask == ecnCE
+	case msg.Header.Level == syscall.IPPROTO_IPV6 && msg.Header.Type == syscall.IPV6_TCLASS && len(msg.Data) >= 4:
+		// The traffic class comes as an int rather than a byte.
+		return *(*int32)(unsafe.Pointer(&msg.Data[0]))&ecnMask == ecnCE
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package memberlist
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadPackets_ECN(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+	if err := enableECN(conn); err != nil {
+		t.Skip("ECN not supported")
+	}
+	to := conn.LocalAddr().(*net.UDPAddr)
+
+	// A packet from a socket with ECN enabled is marked ECN capable but
+	// not congestion experienced.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.WriteToUDP([]byte("capable"), to); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	packets, _, ce, err := readPackets(conn, make([]byte, udpBufSize), make([]byte, 64))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if ce || len(packets) != 1 || string(packets[0]) != "capable" {
+		t.Fatalf("bad: %q %v", packets, ce)
+	}
+
+	// Stand in for a router by marking one ourselves.
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer sender.Close()
+	raw, err := sender.SyscallConn()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, ecnCE)
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := sender.WriteToUDP([]byte("congested"), to); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	packets, _, ce, err = readPackets(conn, make([]byte, udpBufSize), make([]byte, 64))
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !ce || len(packets) != 1 || string(packets[0]) != "congested" {
+		t.Fatalf("bad: %q %v", packets, ce)
+	}
+}
+
+func TestMemberlist_ECN(t *testing.T) {
+	c := testConfig()
+	c.EnableECN = true
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m.Shutdown()
+
+	_, offload := m.packetConn()
+	if !offload.ecn {
+		t.Skip("ECN not supported")
+	}
+
+	// Marks on packets reaching the listener slow our gossip.
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP(c.BindAddr)})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer sender.Close()
+	raw, err := sender.SyscallConn()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	raw.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, ecnCE)
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	to := &net.UDPAddr{IP: net.ParseIP(c.BindAddr), Port: c.BindPort}
+	if _, err := sender.WriteToUDP([]byte{byte(userMsg)}, to); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for m.congestion.rate() == 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("should back off")
+		}
+		m.gossip()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
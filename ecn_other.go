@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package memberlist
+
+import (
+	"fmt"
+	"net"
+)
+
+// enableECN isn't supported off Linux.
+func enableECN(conn *net.UDPConn) error {
+	return fmt.Errorf("ECN is only supported on Linux")
+}
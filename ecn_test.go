@@ -0,0 +1,50 @@
+package memberlist
+
+import (
+	"testing"
+)
+
+func TestGossipCongestion(t *testing.T) {
+	var c gossipCongestion
+
+	// Nothing's held back without marks.
+	for i := 0; i < 3; i++ {
+		if n := c.fanout(3); n != 3 {
+			t.Fatalf("bad fanout: %d", n)
+		}
+	}
+
+	// Each round after a mark halves the rate.
+	c.mark(1)
+	if n := c.fanout(4); n != 2 || c.rate() != 0.5 {
+		t.Fatalf("bad fanout: %d at %v", n, c.rate())
+	}
+
+	// Down to the floor, where rounds are skipped.
+	for i := 0; i < 10; i++ {
+		c.mark(1)
+		c.fanout(4)
+	}
+	if c.rate() != minGossipScale {
+		t.Fatalf("bad rate: %v", c.rate())
+	}
+	sent := 0
+	for i := 0; i < 8; i++ {
+		c.mark(1)
+		sent += c.fanout(4)
+	}
+	if sent != 2 {
+		t.Fatalf("bad total: %d", sent)
+	}
+
+	// And back up once the marks stop.
+	for i := 0; i < 16; i++ {
+		c.fanout(4)
+	}
+	if c.rate() != 1 {
+		t.Fatalf("bad rate: %v", c.rate())
+	}
+	if n := c.fanout(4); n != 4 {
+		t.Fatalf("bad fanout: %d", n)
+	}
+}
@@ -0,0 +1,113 @@
+package memberlist
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrShutdown is returned by operations attempted after Shutdown has
+	// been called.
+	ErrShutdown = errors.New("memberlist is shut down")
+
+	// ErrNoMembers is returned by SyncNow when there are no other live
+	// members to sync with.
+	ErrNoMembers = errors.New("no other live members")
+
+	// ErrLeaveTimeout is returned by Leave if our departure wasn't
+	// broadcast before the timeout.
+	ErrLeaveTimeout = errors.New("timeout waiting for leave broadcast")
+
+	// ErrForceLeaveTimeout is returned by ForceLeave if the dead message
+	// wasn't broadcast before the timeout.
+	ErrForceLeaveTimeout = errors.New("timeout waiting for force leave broadcast")
+
+	// ErrUpdateTimeout is returned by UpdateNode if the new meta data
+	// wasn't broadcast before the timeout.
+	ErrUpdateTimeout = errors.New("timeout waiting for update broadcast")
+
+	// ErrUpdateRejected is returned by UpdateNode if the update wasn't
+	// applied, because the Alive delegate refused it or we're leaving.
+	ErrUpdateRejected = errors.New("update to the local node was rejected")
+
+	// ErrNoDecryptKey is returned when none of the installed keys could
+	// decrypt a message.
+	ErrNoDecryptKey = errors.New("No installed keys could decrypt the message")
+
+	// ErrNoVerifyKey is returned when none of the installed keys could
+	// verify an authenticated message.
+	ErrNoVerifyKey = errors.New("No installed keys could verify the message")
+
+	// ErrRemoteEncrypted is returned when a remote node sends encrypted
+	// state but encryption is not configured locally.
+	ErrRemoteEncrypted = errors.New("Remote state is encrypted and encryption is not configured")
+
+	// ErrRemoteNotEncrypted is returned when encryption is configured but
+	// a remote node sends its state in the clear.
+	ErrRemoteNotEncrypted = errors.New("Encryption is configured but remote state is not encrypted")
+)
+
+// JoinHostError describes why a single host given to Join couldn't be
+// joined.
+type JoinHostError struct {
+	// Host is the address as given to Join, or the resolved IP when Op
+	// is "join".
+	Host string
+
+	// Op is "resolve" if the host couldn't be resolved, or "join" if the
+	// push/pull with it failed.
+	Op string
+
+	Err error
+}
+
+func (e *JoinHostError) Error() string {
+	return fmt.Sprintf("Failed to %s %s: %v", e.Op, e.Host, e.Err)
+}
+
+func (e *JoinHostError) Unwrap() error {
+	return e.Err
+}
+
+// JoinError is returned by Join when no host could be joined. It holds
+// one error per failed attempt, each usually a *JoinHostError, and
+// errors.Is and errors.As look through all of them.
+type JoinError struct {
+	Errors []error
+}
+
+func (e *JoinError) Error() string {
+	if len(e.Errors) == 1 {
+		return fmt.Sprintf("1 error occurred:\n\n* %s", e.Errors[0])
+	}
+
+	points := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		points[i] = fmt.Sprintf("* %s", err)
+	}
+	return fmt.Sprintf("%d errors occurred:\n\n%s",
+		len(e.Errors), strings.Join(points, "\n"))
+}
+
+func (e *JoinError) Unwrap() []error {
+	return e.Errors
+}
+
+// InternalError describes a panic recovered in one of memberlist's
+// background goroutines, such as while handling a malformed packet. It's
+// passed to Config.OnInternalError.
+type InternalError struct {
+	// Routine names what was running: "packet", "stream", "handler",
+	// "probe", "gossip", "push_pull" or "reachability".
+	Routine string
+
+	// Panic is the value the goroutine panicked with, and Stack its stack
+	// trace at the time.
+	Panic interface{}
+	Stack []byte
+}
+
+func (e *InternalError) Error() string {
+	return fmt.Sprintf("Recovered from panic in %s: %v", e.Routine, e.Panic)
+}
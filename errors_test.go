@@ -0,0 +1,118 @@
+package memberlist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJoinError(t *testing.T) {
+	cause := fmt.Errorf("connection refused")
+	err := error(&JoinError{Errors: []error{
+		&JoinHostError{Host: "nope", Op: "resolve", Err: fmt.Errorf("no such host")},
+		&JoinHostError{Host: "127.0.0.1", Op: "join", Err: cause},
+	}})
+
+	expected := "2 errors occurred:\n\n" +
+		"* Failed to resolve nope: no such host\n" +
+		"* Failed to join 127.0.0.1: connection refused"
+	if err.Error() != expected {
+		t.Fatalf("bad: %q", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Fatalf("should find the cause")
+	}
+
+	var hostErr *JoinHostError
+	if !errors.As(err, &hostErr) || hostErr.Op != "resolve" {
+		t.Fatalf("bad: %v", hostErr)
+	}
+
+	single := &JoinError{Errors: []error{cause}}
+	if single.Error() != "1 error occurred:\n\n* connection refused" {
+		t.Fatalf("bad: %q", single.Error())
+	}
+}
+
+func TestMemberlist_Join_Error(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+	addr := fmt.Sprintf("%s:%d", m1.config.BindAddr, m1.config.BindPort)
+	m1.Shutdown()
+
+	c := testConfig()
+	c.BindPort = 0
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{addr})
+	if num != 0 || err == nil {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+
+	var joinErr *JoinError
+	if !errors.As(err, &joinErr) || len(joinErr.Errors) != 1 {
+		t.Fatalf("bad: %v", err)
+	}
+	var hostErr *JoinHostError
+	if !errors.As(err, &hostErr) {
+		t.Fatalf("bad: %v", err)
+	}
+	if hostErr.Op != "join" || hostErr.Host != m1.config.BindAddr {
+		t.Fatalf("bad: %#v", hostErr)
+	}
+	if !strings.HasPrefix(hostErr.Error(), "Failed to join ") {
+		t.Fatalf("bad: %v", hostErr)
+	}
+
+	// No hosts at all isn't an error.
+	if num, err := m2.Join(nil); num != 0 || err != nil {
+		t.Fatalf("bad: %d %v", num, err)
+	}
+}
+
+func TestMemberlist_Send_Shutdown(t *testing.T) {
+	m := GetMemberlist(t)
+	m.setAlive()
+	node := m.LocalNode()
+	m.Shutdown()
+
+	if err := m.SendTo(m.udpListener.LocalAddr(), []byte("hi")); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := m.SendToUDP(node, []byte("hi")); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := m.SendToTCP(node, []byte("hi")); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := m.dialTCP(m.tcpListener.Addr().String(), time.Now().Add(time.Second)); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestDecryptPayload_NoKey(t *testing.T) {
+	plaintext := []byte("this is a plain text message")
+	extra := []byte("random data")
+
+	var buf bytes.Buffer
+	if err := encryptPayload(1, TestKeys[2], plaintext, extra, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := decryptPayload(TestKeys[:2], buf.Bytes(), extra); !errors.Is(err, ErrNoDecryptKey) {
+		t.Fatalf("bad: %v", err)
+	}
+
+	buf.Reset()
+	authPayload(TestKeys[2], plaintext, extra, &buf)
+	if _, _, err := verifyPayload(TestKeys[:2], buf.Bytes(), extra); !errors.Is(err, ErrNoVerifyKey) {
+		t.Fatalf("bad: %v", err)
+	}
+}
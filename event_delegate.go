@@ -1,9 +1,21 @@
 package memberlist
 
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
 // EventDelegate is a simpler delegate that is used only to receive
 // notifications about members joining and leaving. The methods in this
 // delegate may be called by multiple goroutines, but never concurrently.
 // This allows you to reason about ordering.
+//
+// If Config.DelegateWorkers is set, events about different nodes may be
+// delivered concurrently, but the events for any single node are still
+// delivered one at a time, in the order its state changed.
 type EventDelegate interface {
 	// NotifyJoin is invoked when a node is detected to have joined.
 	// The Node argument must not be modified.
@@ -19,16 +31,135 @@ type EventDelegate interface {
 	NotifyUpdate(*Node)
 }
 
+// LeaveReason says why a node left the cluster.
+type LeaveReason int
+
+const (
+	// LeaveFailed means the node was declared dead by failure detection,
+	// or by a node too old to say otherwise.
+	LeaveFailed LeaveReason = iota
+
+	// LeaveGraceful means the node announced its own departure by calling
+	// Leave.
+	LeaveGraceful
+
+	// LeaveDemoted means the node was moved out of our active view in
+	// partial view mode. It's still alive, and may come back.
+	LeaveDemoted
+)
+
+func (r LeaveReason) String() string {
+	switch r {
+	case LeaveFailed:
+		return "failed"
+	case LeaveGraceful:
+		return "graceful"
+	case LeaveDemoted:
+		return "demoted"
+	default:
+		return "unknown"
+	}
+}
+
+// EventDelegateV2 is like EventDelegate, but NotifyLeave also says why the
+// node left. It's set with Config.EventsV2, and is delivered with the same
+// ordering guarantees as EventDelegate.
+type EventDelegateV2 interface {
+	// NotifyJoin is invoked when a node is detected to have joined.
+	// The Node argument must not be modified.
+	NotifyJoin(*Node)
+
+	// NotifyLeave is invoked when a node is detected to have left, with
+	// whether it left gracefully or failed. The Node argument must not be
+	// modified.
+	NotifyLeave(*Node, LeaveReason)
+
+	// NotifyUpdate is invoked when a node is detected to have
+	// updated, usually involving the meta data. The Node argument
+	// must not be modified.
+	NotifyUpdate(*Node)
+}
+
 // ChannelEventDelegate is used to enable an application to receive
 // events about joins and leaves over a channel instead of a direct
 // function call.
 //
 // Care must be taken that events are processed in a timely manner from
 // the channel, since this delegate will block until an event can be sent.
+// See BufferedEventDelegate for one that doesn't.
 type ChannelEventDelegate struct {
 	Ch chan<- NodeEvent
 }
 
+// OverflowPolicy says what a BufferedEventDelegate does with an event when
+// its channel is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until the event can be sent.
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowBlockTimeout waits up to the Timeout to send the event, and
+	// then drops it.
+	OverflowBlockTimeout
+
+	// OverflowDropNewest buffers the event, or drops it if the buffer is
+	// full.
+	OverflowDropNewest
+
+	// OverflowDropOldest buffers the event, dropping the oldest buffered
+	// event if the buffer is full.
+	OverflowDropOldest
+)
+
+// BufferedEventConfig sets how a BufferedEventDelegate handles a full
+// channel.
+type BufferedEventConfig struct {
+	// Overflow is what to do with an event when the channel is full.
+	Overflow OverflowPolicy
+
+	// Timeout is how long OverflowBlockTimeout waits to send an event.
+	Timeout time.Duration
+
+	// Buffer is how many events OverflowDropOldest and OverflowDropNewest
+	// hold while the channel is full, on top of its own capacity. They're
+	// sent on in order as it drains. With no buffer, both drop the event
+	// that doesn't fit.
+	Buffer int
+
+	// Coalesce merges an event with one for the same node still waiting in
+	// the buffer, so the buffer holds at most one event per node. The later
+	// event replaces the earlier, except that a join followed by an update
+	// is sent as a join with the updated node.
+	Coalesce bool
+}
+
+// BufferedEventDelegate is like ChannelEventDelegate, but chooses what to
+// do when the channel is full instead of always blocking, so a slow reader
+// needn't stall the whole of memberlist. Call Stop once the channel is no
+// longer read from.
+type BufferedEventDelegate struct {
+	ch   chan<- NodeEvent
+	conf BufferedEventConfig
+
+	lock     sync.Mutex
+	pending  []NodeEvent
+	flushing bool
+	dropped  uint64
+	stopCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewBufferedEventDelegate returns a delegate that sends events on ch,
+// handling a full channel as conf says.
+func NewBufferedEventDelegate(ch chan<- NodeEvent, conf BufferedEventConfig) *BufferedEventDelegate {
+	return &BufferedEventDelegate{
+		ch:     ch,
+		conf:   conf,
+		stopCh: make(chan struct{}),
+	}
+}
+
 // NodeEventType are the types of events that can be sent from the
 // ChannelEventDelegate.
 type NodeEventType int
@@ -59,3 +190,136 @@ func (c *ChannelEventDelegate) NotifyLeave(n *Node) {
 func (c *ChannelEventDelegate) NotifyUpdate(n *Node) {
 	c.Ch <- NodeEvent{NodeUpdate, n}
 }
+
+func (c *BufferedEventDelegate) NotifyJoin(n *Node) {
+	c.send(NodeEvent{NodeJoin, n})
+}
+
+func (c *BufferedEventDelegate) NotifyLeave(n *Node) {
+	c.send(NodeEvent{NodeLeave, n})
+}
+
+func (c *BufferedEventDelegate) NotifyUpdate(n *Node) {
+	c.send(NodeEvent{NodeUpdate, n})
+}
+
+// Stop drops any buffered events and any sent from then on, and releases
+// senders waiting on the channel. It's safe to call more than once.
+func (c *BufferedEventDelegate) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopCh)
+	})
+}
+
+// Dropped returns the number of events that were dropped because the
+// channel was full, or because the delegate was stopped.
+func (c *BufferedEventDelegate) Dropped() uint64 {
+	return atomic.LoadUint64(&c.dropped)
+}
+
+// drop counts an event that was dropped.
+func (c *BufferedEventDelegate) drop() {
+	atomic.AddUint64(&c.dropped, 1)
+	metrics.IncrCounter([]string{"memberlist", "events", "dropped"}, 1)
+}
+
+// send passes an event on according to the overflow policy.
+func (c *BufferedEventDelegate) send(e NodeEvent) {
+	select {
+	case <-c.stopCh:
+		c.drop()
+		return
+	default:
+	}
+
+	switch c.conf.Overflow {
+	case OverflowBlockTimeout:
+		timer := time.NewTimer(c.conf.Timeout)
+		defer timer.Stop()
+		select {
+		case c.ch <- e:
+		case <-timer.C:
+			c.drop()
+		case <-c.stopCh:
+			c.drop()
+		}
+		return
+	case OverflowDropNewest, OverflowDropOldest:
+	default:
+		select {
+		case c.ch <- e:
+		case <-c.stopCh:
+			c.drop()
+		}
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.conf.Coalesce {
+		for i := range c.pending {
+			if c.pending[i].Node.Name != e.Node.Name {
+				continue
+			}
+			if c.pending[i].Event == NodeJoin && e.Event == NodeUpdate {
+				e.Event = NodeJoin
+			}
+			c.pending[i] = e
+			return
+		}
+	}
+
+	// Events go straight out unless earlier ones are still waiting.
+	if !c.flushing {
+		select {
+		case c.ch <- e:
+			return
+		default:
+		}
+	}
+
+	switch {
+	case len(c.pending) < c.conf.Buffer:
+		c.pending = append(c.pending, e)
+	case c.conf.Overflow == OverflowDropOldest && len(c.pending) > 0:
+		c.pending = append(c.pending[1:], e)
+		c.drop()
+	default:
+		c.drop()
+	}
+	if len(c.pending) > 0 && !c.flushing {
+		c.flushing = true
+		go c.flush()
+	}
+}
+
+// flush sends the buffered events on, in order, until there are none left
+// or the delegate is stopped.
+func (c *BufferedEventDelegate) flush() {
+	for {
+		c.lock.Lock()
+		if len(c.pending) == 0 {
+			c.flushing = false
+			c.lock.Unlock()
+			return
+		}
+		e := c.pending[0]
+		c.pending = c.pending[1:]
+		c.lock.Unlock()
+
+		select {
+		case c.ch <- e:
+		case <-c.stopCh:
+			c.drop()
+			c.lock.Lock()
+			for range c.pending {
+				c.drop()
+			}
+			c.pending = nil
+			c.flushing = false
+			c.lock.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+// drainEvents reads the events waiting on a channel, giving buffered ones
+// a moment to be flushed through.
+func drainEvents(ch chan NodeEvent) []NodeEvent {
+	var events []NodeEvent
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		case <-time.After(50 * time.Millisecond):
+			return events
+		}
+	}
+}
+
+func eventNames(events []NodeEvent) []string {
+	var names []string
+	for _, e := range events {
+		names = append(names, e.Node.Name)
+	}
+	return names
+}
+
+func TestBufferedEventDelegate_Overflow(t *testing.T) {
+	cases := []struct {
+		policy OverflowPolicy
+		want   []string
+	}{
+		{OverflowDropNewest, []string{"a", "b", "c"}},
+		{OverflowDropOldest, []string{"a", "d", "e"}},
+	}
+	for _, tc := range cases {
+		ch := make(chan NodeEvent, 1)
+		c := NewBufferedEventDelegate(ch, BufferedEventConfig{Overflow: tc.policy, Buffer: 2})
+		for _, name := range []string{"a", "b", "c", "d", "e"} {
+			c.NotifyJoin(&Node{Name: name})
+		}
+		if n := c.Dropped(); n != 2 {
+			t.Fatalf("policy %d: dropped %d", tc.policy, n)
+		}
+		got := eventNames(drainEvents(ch))
+		if len(got) != len(tc.want) {
+			t.Fatalf("policy %d: got %v", tc.policy, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("policy %d: got %v", tc.policy, got)
+			}
+		}
+	}
+}
+
+func TestBufferedEventDelegate_BlockTimeout(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	c := NewBufferedEventDelegate(ch, BufferedEventConfig{Overflow: OverflowBlockTimeout, Timeout: 10 * time.Millisecond})
+	c.NotifyJoin(&Node{Name: "a"})
+
+	start := time.Now()
+	c.NotifyJoin(&Node{Name: "b"})
+	if time.Since(start) < 10*time.Millisecond || c.Dropped() != 1 {
+		t.Fatalf("should wait, then drop")
+	}
+
+	// Once there's room it goes through.
+	<-ch
+	c.NotifyLeave(&Node{Name: "a"})
+	if e := <-ch; e.Event != NodeLeave {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestBufferedEventDelegate_Coalesce(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	c := NewBufferedEventDelegate(ch, BufferedEventConfig{Overflow: OverflowDropNewest, Buffer: 4, Coalesce: true})
+
+	c.NotifyJoin(&Node{Name: "x"}) // Fills the channel
+	c.NotifyJoin(&Node{Name: "a"})
+	c.NotifyUpdate(&Node{Name: "a", Meta: []byte("new")})
+	c.NotifyJoin(&Node{Name: "b"})
+	c.NotifyLeave(&Node{Name: "b"})
+
+	events := drainEvents(ch)
+	if got := eventNames(events); len(got) != 3 || got[0] != "x" || got[1] != "a" || got[2] != "b" {
+		t.Fatalf("bad: %v", got)
+	}
+	if events[1].Event != NodeJoin || string(events[1].Node.Meta) != "new" {
+		t.Fatalf("bad: %v", events[1])
+	}
+	if events[2].Event != NodeLeave {
+		t.Fatalf("bad: %v", events[2])
+	}
+	if c.Dropped() != 0 {
+		t.Fatalf("nothing should be dropped")
+	}
+}
+
+func TestBufferedEventDelegate_Stop(t *testing.T) {
+	ch := make(chan NodeEvent, 1)
+	c := NewBufferedEventDelegate(ch, BufferedEventConfig{Overflow: OverflowDropNewest, Buffer: 2})
+	for _, name := range []string{"a", "b", "c"} {
+		c.NotifyJoin(&Node{Name: name})
+	}
+
+	// Nobody reads the channel, so the flush is stuck until we stop.
+	c.Stop()
+	deadline := time.Now().Add(time.Second)
+	for {
+		c.lock.Lock()
+		flushing := c.flushing
+		c.lock.Unlock()
+		if !flushing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("flush should give up once stopped")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := c.Dropped(); n != 2 {
+		t.Fatalf("should drop the buffered events: %d", n)
+	}
+
+	// Blocking sends give up too, and later events are dropped.
+	b := NewBufferedEventDelegate(ch, BufferedEventConfig{})
+	done := make(chan struct{})
+	go func() {
+		b.NotifyJoin(&Node{Name: "d"})
+		close(done)
+	}()
+	b.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("send should give up once stopped")
+	}
+	b.NotifyLeave(&Node{Name: "d"})
+	if n := b.Dropped(); n != 2 {
+		t.Fatalf("should drop both: %d", n)
+	}
+	if len(ch) != 1 {
+		t.Fatalf("only the first event should be sent")
+	}
+}
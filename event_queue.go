@@ -0,0 +1,160 @@
+package memberlist
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Event delegates are normally called one after another, inline or on the
+delegate pool, so one that's slow holds up the rest, and one that panics
+stops the rest hearing about that event. With EventQueueDepth set, each
+event delegate gets a goroutine and a bounded queue of its own instead,
+including each one added with Delegates.AddEvents. Every delegate still
+sees the events in order, and a panic in one is recovered without
+affecting the others. A delegate whose queue is full misses events rather
+than holding anything up, and each one it misses is counted in the
+memberlist.events.dropped metric.
+*/
+
+// eventSink is a single event delegate with its own queue.
+type eventSink struct {
+	index    int
+	join     func(*Node)
+	leave    func(*Node, LeaveReason)
+	update   func(*Node)
+	tasks    chan delegateTask
+	dropping int32 // Set while we're dropping events, atomically
+}
+
+// eventQueues runs each event delegate on its own goroutine.
+type eventQueues struct {
+	sinks  []*eventSink
+	stopCh chan struct{}
+	stop   sync.Once
+	logger *log.Logger
+}
+
+// newEventQueues starts a goroutine with a queue of the given depth for
+// each of the event delegates, splitting any that fan out. It returns nil
+// if there are none.
+func newEventQueues(events EventDelegate, eventsV2 EventDelegateV2, depth int, logger *log.Logger) *eventQueues {
+	var v1 []EventDelegate
+	if f, ok := events.(eventFanout); ok {
+		v1 = f
+	} else if events != nil {
+		v1 = []EventDelegate{events}
+	}
+	var v2 []EventDelegateV2
+	if f, ok := eventsV2.(eventFanoutV2); ok {
+		v2 = f
+	} else if eventsV2 != nil {
+		v2 = []EventDelegateV2{eventsV2}
+	}
+	if len(v1)+len(v2) == 0 {
+		return nil
+	}
+
+	q := &eventQueues{
+		stopCh: make(chan struct{}),
+		logger: logger,
+	}
+	for _, e := range v1 {
+		e := e
+		q.sinks = append(q.sinks, &eventSink{
+			join:   e.NotifyJoin,
+			leave:  func(n *Node, _ LeaveReason) { e.NotifyLeave(n) },
+			update: e.NotifyUpdate,
+		})
+	}
+	for _, e := range v2 {
+		q.sinks = append(q.sinks, &eventSink{
+			join:   e.NotifyJoin,
+			leave:  e.NotifyLeave,
+			update: e.NotifyUpdate,
+		})
+	}
+	for i, s := range q.sinks {
+		s.index = i
+		s.tasks = make(chan delegateTask, depth)
+		go q.worker(s.tasks)
+	}
+	return q
+}
+
+// worker runs a delegate's events in order until shutdown, at which point
+// it runs whatever is left in the queue and exits.
+func (q *eventQueues) worker(tasks chan delegateTask) {
+	for {
+		select {
+		case t := <-tasks:
+			runDelegate(q.logger, t.name, t.fn)
+		case <-q.stopCh:
+			for {
+				select {
+				case t := <-tasks:
+					runDelegate(q.logger, t.name, t.fn)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// push queues an event for a delegate, dropping it if the queue is full.
+func (q *eventQueues) push(s *eventSink, name string, fn func()) {
+	select {
+	case s.tasks <- delegateTask{name, fn}:
+		if atomic.CompareAndSwapInt32(&s.dropping, 1, 0) {
+			q.logger.Printf("[INFO] memberlist: Event delegate %d has caught up", s.index)
+		}
+		return
+	case <-q.stopCh:
+		return
+	default:
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "events", "dropped"}, 1)
+	if atomic.CompareAndSwapInt32(&s.dropping, 0, 1) {
+		q.logger.Printf("[WARN] memberlist: Event delegate %d is falling behind, dropping events", s.index)
+	}
+}
+
+// The node is copied, since the delegates may see it after our state has
+// moved on.
+func (q *eventQueues) notifyJoin(node *Node) {
+	n := *node
+	for _, s := range q.sinks {
+		s := s
+		q.push(s, "notify_join", func() { s.join(&n) })
+	}
+}
+
+func (q *eventQueues) notifyLeave(node *Node, reason LeaveReason) {
+	n := *node
+	for _, s := range q.sinks {
+		s := s
+		q.push(s, "notify_leave", func() { s.leave(&n, reason) })
+	}
+}
+
+func (q *eventQueues) notifyUpdate(node *Node) {
+	n := *node
+	for _, s := range q.sinks {
+		s := s
+		q.push(s, "notify_update", func() { s.update(&n) })
+	}
+}
+
+// Shutdown stops the goroutines once they've drained their queues.
+//
+// This method is safe to call multiple times.
+func (q *eventQueues) Shutdown() {
+	q.stop.Do(func() {
+		close(q.stopCh)
+	})
+}
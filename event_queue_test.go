@@ -0,0 +1,87 @@
+package memberlist
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+// panickingEventDelegate panics on every event.
+type panickingEventDelegate struct{}
+
+func (panickingEventDelegate) NotifyJoin(n *Node)   { panic("join") }
+func (panickingEventDelegate) NotifyLeave(n *Node)  { panic("leave") }
+func (panickingEventDelegate) NotifyUpdate(n *Node) { panic("update") }
+
+func TestEventQueues_Isolation(t *testing.T) {
+	blocked := &blockingEventDelegate{
+		releaseCh: make(chan struct{}),
+		joinCh:    make(chan string, 16),
+	}
+	ch := make(chan NodeEvent, 16)
+	fanout := eventFanout{blocked, panickingEventDelegate{}, &ChannelEventDelegate{Ch: ch}}
+	q := newEventQueues(fanout, nil, 2, log.New(os.Stderr, "", log.LstdFlags))
+	defer q.Shutdown()
+	if len(q.sinks) != 3 {
+		t.Fatalf("bad: %d", len(q.sinks))
+	}
+
+	// The healthy delegate gets every event, despite the others.
+	for i := 0; i < 10; i++ {
+		q.notifyJoin(&Node{Name: fmt.Sprintf("node%d", i)})
+		select {
+		case e := <-ch:
+			if want := fmt.Sprintf("node%d", i); e.Node.Name != want {
+				t.Fatalf("got %s, want %s", e.Node.Name, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+
+	// The blocked one only gets what fit in its queue.
+	close(blocked.releaseCh)
+	var got []string
+	timeout := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case name := <-blocked.joinCh:
+			got = append(got, name)
+		case <-timeout:
+			done = true
+		}
+	}
+	if len(got) == 0 || len(got) > 3 || got[0] != "node0" {
+		t.Fatalf("bad: %v", got)
+	}
+}
+
+func TestMemberlist_EventQueueDepth(t *testing.T) {
+	ch1 := make(chan NodeEvent, 16)
+	ch2 := make(chan NodeEvent, 16)
+	m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+		c.EventQueueDepth = 16
+		if err := c.SetDelegates(new(Delegates).
+			AddEvents(&ChannelEventDelegate{Ch: ch1}).
+			AddEvents(panickingEventDelegate{}).
+			AddEvents(&ChannelEventDelegate{Ch: ch2})); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	})
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	for _, ch := range []chan NodeEvent{ch1, ch2} {
+		select {
+		case e := <-ch:
+			if e.Event != NodeJoin || e.Node.Name != "test" {
+				t.Fatalf("bad: %v", e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
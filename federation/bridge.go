@@ -0,0 +1,339 @@
+/*
+Package federation connects separate memberlist clusters through bridge
+nodes, for hub-and-spoke topologies where running one cluster over the WAN
+would mean gossiping every membership change everywhere.
+
+A Bridge is a member of two clusters at once. It doesn't merge them: each
+cluster keeps its own membership and failure detection. Instead the bridge
+relays user broadcasts whose payload starts with one of the configured tags
+from one cluster into the other, and periodically broadcasts a short summary
+of each cluster's membership into the other, which members can read with
+DecodeSummary.
+
+Relayed messages are passed on unchanged. To stop messages bouncing back and
+forth, the bridge won't relay the same payload again within DedupWindow, so
+applications that need to send identical payloads in quick succession should
+include something unique, like a sequence number, in them.
+*/
+package federation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Cluster describes one of the clusters a bridge joins.
+type Cluster struct {
+	// Name identifies the cluster in summaries. It must differ between
+	// the two sides of a bridge.
+	Name string
+
+	// Config is used to create the bridge's member of this cluster. Any
+	// Delegate set on it is wrapped, and still sees every message.
+	Config *memberlist.Config
+}
+
+// Config configures a Bridge.
+type Config struct {
+	A, B Cluster
+
+	// RelayTags are the prefixes of user broadcasts to relay between the
+	// clusters. Messages that don't start with one of them stay put.
+	RelayTags [][]byte
+
+	// SummaryInterval is how often a summary of each cluster is broadcast
+	// into the other. Zero disables summaries.
+	SummaryInterval time.Duration
+
+	// DedupWindow is how long a relayed payload is remembered, so it isn't
+	// relayed again if it comes back.
+	DedupWindow time.Duration
+
+	// RelaySummaries passes on summaries the bridge hears as well as
+	// sending its own, so that they spread beyond the neighbouring
+	// cluster. A summary is only relayed again once it has changed or the
+	// dedup window has passed.
+	RelaySummaries bool
+
+	// Logger is used for the bridge's own logging. If nil, logs go to
+	// stderr.
+	Logger *log.Logger
+}
+
+// DefaultConfig returns a bridge config between two clusters, with the
+// given memberlist configs, relaying nothing until RelayTags are set.
+func DefaultConfig(a, b Cluster) *Config {
+	return &Config{
+		A:               a,
+		B:               b,
+		SummaryInterval: 10 * time.Second,
+		DedupWindow:     time.Minute,
+	}
+}
+
+// Bridge is a member of two clusters that relays between them.
+type Bridge struct {
+	config *Config
+	logger *log.Logger
+	sides  [2]*side
+
+	seenLock sync.Mutex
+	seen     map[[sha256.Size]byte]time.Time
+
+	shutdownCh chan struct{}
+	shutdown   sync.Once
+}
+
+// side is the bridge's presence in one of the clusters.
+type side struct {
+	name   string
+	list   *memberlist.Memberlist
+	queue  *memberlist.TransmitLimitedQueue
+	inner  memberlist.Delegate
+	bridge *Bridge
+	other  *side
+}
+
+// NewBridge creates members of both clusters and starts relaying between
+// them. Use Memberlist to get at each member to join its cluster.
+func NewBridge(conf *Config) (*Bridge, error) {
+	if conf.A.Name == "" || conf.B.Name == "" || conf.A.Name == conf.B.Name {
+		return nil, fmt.Errorf("Clusters must have distinct, non-empty names")
+	}
+	if conf.A.Config == nil || conf.B.Config == nil {
+		return nil, fmt.Errorf("Both clusters need a memberlist config")
+	}
+
+	logger := conf.Logger
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	b := &Bridge{
+		config:     conf,
+		logger:     logger,
+		seen:       make(map[[sha256.Size]byte]time.Time),
+		shutdownCh: make(chan struct{}),
+	}
+
+	for i, c := range []Cluster{conf.A, conf.B} {
+		b.sides[i] = &side{
+			name:   c.Name,
+			inner:  c.Config.Delegate,
+			bridge: b,
+			queue:  &memberlist.TransmitLimitedQueue{RetransmitMult: c.Config.RetransmitMult},
+		}
+	}
+	b.sides[0].other, b.sides[1].other = b.sides[1], b.sides[0]
+
+	for i, c := range []Cluster{conf.A, conf.B} {
+		s := b.sides[i]
+		c.Config.Delegate = s
+		list, err := memberlist.Create(c.Config)
+		if err != nil {
+			if i > 0 {
+				b.sides[0].list.Shutdown()
+			}
+			return nil, fmt.Errorf("Failed to create member of %s: %v", c.Name, err)
+		}
+		s.list = list
+		s.queue.NumNodes = list.NumMembers
+	}
+
+	if conf.SummaryInterval > 0 {
+		go b.summarize()
+	}
+	return b, nil
+}
+
+// Memberlist returns the bridge's member of the named cluster, or nil if
+// the bridge isn't part of it.
+func (b *Bridge) Memberlist(cluster string) *memberlist.Memberlist {
+	for _, s := range b.sides {
+		if s.name == cluster {
+			return s.list
+		}
+	}
+	return nil
+}
+
+// Leave leaves both clusters, waiting up to the timeout for each.
+func (b *Bridge) Leave(timeout time.Duration) error {
+	for _, s := range b.sides {
+		if err := s.list.Leave(timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown stops relaying and shuts down both members.
+func (b *Bridge) Shutdown() error {
+	b.shutdown.Do(func() {
+		close(b.shutdownCh)
+	})
+	for _, s := range b.sides {
+		if err := s.list.Shutdown(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// summarize periodically broadcasts each cluster's summary into the other.
+func (b *Bridge) summarize() {
+	ticker := time.NewTicker(b.config.SummaryInterval)
+	defer ticker.Stop()
+	for {
+		b.sendSummaries()
+		select {
+		case <-ticker.C:
+		case <-b.shutdownCh:
+			return
+		}
+	}
+}
+
+// sendSummaries queues a summary of each side in the other.
+func (b *Bridge) sendSummaries() {
+	for _, s := range b.sides {
+		msg, err := encodeSummary(s.summary())
+		if err != nil {
+			b.logger.Printf("[ERR] memberlist: Failed to encode summary of %s: %v", s.name, err)
+			continue
+		}
+		s.other.queue.QueueBroadcast(&summaryBroadcast{cluster: s.name, msg: msg})
+	}
+}
+
+// relayable reports whether a message carries one of the relay tags.
+// Summaries are only relayed when RelaySummaries is set, since otherwise
+// they're only about the neighbouring cluster.
+func (b *Bridge) relayable(msg []byte) bool {
+	if bytes.HasPrefix(msg, SummaryTag) {
+		return b.config.RelaySummaries
+	}
+	for _, tag := range b.config.RelayTags {
+		if bytes.HasPrefix(msg, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// firstSighting records a payload as relayed, and reports whether it's
+// the first time we've seen it within the dedup window.
+func (b *Bridge) firstSighting(msg []byte) bool {
+	sum := sha256.Sum256(msg)
+	now := time.Now()
+
+	b.seenLock.Lock()
+	defer b.seenLock.Unlock()
+	for k, t := range b.seen {
+		if now.Sub(t) > b.config.DedupWindow {
+			delete(b.seen, k)
+		}
+	}
+	if _, ok := b.seen[sum]; ok {
+		return false
+	}
+	b.seen[sum] = now
+	return true
+}
+
+// summary describes this side's cluster.
+func (s *side) summary() *Summary {
+	return &Summary{
+		Cluster: s.name,
+		Bridge:  s.list.LocalNode().Name,
+		Members: s.list.NumMembers(),
+	}
+}
+
+// NotifyMsg relays tagged messages to the other cluster before passing
+// every message on to the wrapped delegate.
+func (s *side) NotifyMsg(msg []byte) {
+	b := s.bridge
+	if b.relayable(msg) && b.firstSighting(msg) {
+		relayed := make([]byte, len(msg))
+		copy(relayed, msg)
+		s.other.queue.QueueBroadcast(&relayBroadcast{msg: relayed})
+	}
+	if s.inner != nil {
+		s.inner.NotifyMsg(msg)
+	}
+}
+
+// GetBroadcasts sends relayed messages and summaries first, and fills any
+// remaining space from the wrapped delegate.
+func (s *side) GetBroadcasts(overhead, limit int) [][]byte {
+	msgs := s.queue.GetBroadcasts(overhead, limit)
+	if s.inner == nil {
+		return msgs
+	}
+	for _, msg := range msgs {
+		limit -= overhead + len(msg)
+	}
+	return append(msgs, s.inner.GetBroadcasts(overhead, limit)...)
+}
+
+func (s *side) NodeMeta(limit int) []byte {
+	if s.inner == nil {
+		return nil
+	}
+	return s.inner.NodeMeta(limit)
+}
+
+func (s *side) LocalState(join bool) []byte {
+	if s.inner == nil {
+		return nil
+	}
+	return s.inner.LocalState(join)
+}
+
+func (s *side) MergeRemoteState(buf []byte, join bool) {
+	if s.inner != nil {
+		s.inner.MergeRemoteState(buf, join)
+	}
+}
+
+// relayBroadcast is a message relayed from the other cluster.
+type relayBroadcast struct {
+	msg []byte
+}
+
+func (r *relayBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (r *relayBroadcast) Message() []byte {
+	return r.msg
+}
+
+func (r *relayBroadcast) Finished() {
+}
+
+// summaryBroadcast is a cluster summary. A newer summary of a cluster
+// replaces any older one still in the queue.
+type summaryBroadcast struct {
+	cluster string
+	msg     []byte
+}
+
+func (s *summaryBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	o, ok := other.(*summaryBroadcast)
+	return ok && o.cluster == s.cluster
+}
+
+func (s *summaryBroadcast) Message() []byte {
+	return s.msg
+}
+
+func (s *summaryBroadcast) Finished() {
+}
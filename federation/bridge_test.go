@@ -0,0 +1,202 @@
+package federation
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// testDelegate records the messages it receives and gossips whatever is
+// put in its queue.
+type testDelegate struct {
+	sync.Mutex
+	msgs  [][]byte
+	queue memberlist.TransmitLimitedQueue
+}
+
+func (d *testDelegate) NodeMeta(limit int) []byte { return nil }
+
+func (d *testDelegate) NotifyMsg(msg []byte) {
+	d.Lock()
+	defer d.Unlock()
+	d.msgs = append(d.msgs, append([]byte{}, msg...))
+}
+
+func (d *testDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return d.queue.GetBroadcasts(overhead, limit)
+}
+
+func (d *testDelegate) LocalState(join bool) []byte            { return nil }
+func (d *testDelegate) MergeRemoteState(buf []byte, join bool) {}
+
+func (d *testDelegate) received(prefix []byte) [][]byte {
+	d.Lock()
+	defer d.Unlock()
+	var out [][]byte
+	for _, msg := range d.msgs {
+		if bytes.HasPrefix(msg, prefix) {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+func testConfig(name string) *memberlist.Config {
+	conf := memberlist.DefaultLocalConfig()
+	conf.Name = name
+	conf.BindAddr = "127.0.0.1"
+	conf.BindPort = 0
+	conf.GossipInterval = 10 * time.Millisecond
+	return conf
+}
+
+// testMember creates a plain member of a cluster with a recording delegate.
+func testMember(t *testing.T, name string) (*memberlist.Memberlist, *testDelegate) {
+	d := &testDelegate{}
+	conf := testConfig(name)
+	conf.Delegate = d
+	list, err := memberlist.Create(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.queue.NumNodes = list.NumMembers
+	d.queue.RetransmitMult = conf.RetransmitMult
+	return list, d
+}
+
+func join(t *testing.T, list, other *memberlist.Memberlist) {
+	n := other.LocalNode()
+	if _, err := list.Join([]string{fmt.Sprintf("%s:%d", n.Addr, n.Port)}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+type testBroadcast []byte
+
+func (b testBroadcast) Invalidates(memberlist.Broadcast) bool { return false }
+func (b testBroadcast) Message() []byte                       { return b }
+func (b testBroadcast) Finished()                             {}
+
+func waitFor(t *testing.T, what string, fn func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !fn() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBridge_Relay(t *testing.T) {
+	bridgeDelegate := &testDelegate{}
+	confA := testConfig("bridge-a")
+	confA.Delegate = bridgeDelegate
+	conf := DefaultConfig(
+		Cluster{Name: "a", Config: confA},
+		Cluster{Name: "b", Config: testConfig("bridge-b")},
+	)
+	conf.RelayTags = [][]byte{[]byte("relay:")}
+	conf.SummaryInterval = 50 * time.Millisecond
+	b, err := NewBridge(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer b.Shutdown()
+
+	listA, delegateA := testMember(t, "node-a")
+	defer listA.Shutdown()
+	listB, delegateB := testMember(t, "node-b")
+	defer listB.Shutdown()
+	join(t, listA, b.Memberlist("a"))
+	join(t, listB, b.Memberlist("b"))
+
+	// The clusters stay separate.
+	if n := listB.NumMembers(); n != 2 {
+		t.Fatalf("bad members: %d", n)
+	}
+
+	delegateA.queue.QueueBroadcast(testBroadcast("relay:hello"))
+	delegateA.queue.QueueBroadcast(testBroadcast("local:hello"))
+
+	waitFor(t, "relayed message", func() bool {
+		return len(delegateB.received([]byte("relay:"))) > 0
+	})
+	if got := delegateB.received([]byte("relay:")); string(got[0]) != "relay:hello" {
+		t.Fatalf("bad message: %q", got[0])
+	}
+
+	// The wrapped delegate still sees everything sent to the bridge.
+	waitFor(t, "local message", func() bool {
+		return len(bridgeDelegate.received([]byte("local:"))) > 0
+	})
+	if len(delegateB.received([]byte("local:"))) != 0 {
+		t.Fatalf("untagged message should not be relayed")
+	}
+
+	// Each side hears a summary of the other.
+	waitFor(t, "summary", func() bool {
+		for _, msg := range delegateB.received(SummaryTag) {
+			if s, ok := DecodeSummary(msg); ok && s.Cluster == "a" && s.Members == 2 {
+				return true
+			}
+		}
+		return false
+	})
+	waitFor(t, "summary", func() bool {
+		for _, msg := range delegateA.received(SummaryTag) {
+			if s, ok := DecodeSummary(msg); ok && s.Cluster == "b" && s.Bridge == "bridge-b" {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+func TestBridge_Dedup(t *testing.T) {
+	conf := DefaultConfig(
+		Cluster{Name: "a", Config: testConfig("bridge-a")},
+		Cluster{Name: "b", Config: testConfig("bridge-b")},
+	)
+	conf.RelayTags = [][]byte{[]byte("relay:")}
+	conf.SummaryInterval = 0
+	conf.DedupWindow = 50 * time.Millisecond
+	b, err := NewBridge(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer b.Shutdown()
+
+	msg := []byte("relay:once")
+	if !b.firstSighting(msg) {
+		t.Fatalf("should be new")
+	}
+	if b.firstSighting(msg) {
+		t.Fatalf("should be a repeat")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !b.firstSighting(msg) {
+		t.Fatalf("should have expired")
+	}
+
+	if b.relayable([]byte("other")) || !b.relayable(msg) {
+		t.Fatalf("bad relayable")
+	}
+	summary, _ := encodeSummary(&Summary{Cluster: "a"})
+	if b.relayable(summary) {
+		t.Fatalf("summaries should never be relayed")
+	}
+}
+
+func TestNewBridge_Invalid(t *testing.T) {
+	conf := DefaultConfig(
+		Cluster{Name: "a", Config: testConfig("bridge-a")},
+		Cluster{Name: "a", Config: testConfig("bridge-b")},
+	)
+	if _, err := NewBridge(conf); err == nil {
+		t.Fatalf("expected error for duplicate cluster names")
+	}
+}
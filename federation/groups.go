@@ -0,0 +1,323 @@
+package federation
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+/*
+Gossip groups split one very large cluster, tens of thousands of nodes, into
+smaller groups that each run as a memberlist cluster of their own, labelled
+with the cluster and group names. Members only probe and gossip within
+their group, so the state each one holds, and the work it does, grows with
+the size of its group rather than the whole cluster.
+
+A few members of each group are bridges, which are also members of a
+backbone cluster made up of the bridges of every group. Each bridge
+summarizes its group into the backbone, and passes on the summaries it
+hears there into its group, so that every member keeps a directory of the
+other groups: how many members each has, and which bridges lead to it.
+Broadcasts carrying one of the relay tags are passed on the same way, and
+reach every group.
+
+Each group needs at least one bridge for the rest of the cluster to see it,
+and two or more so that it stays visible when one fails. A group whose
+summaries stop arriving drops out of the directory after three summary
+intervals.
+*/
+
+// BackboneGroup is the name of the cluster the bridges of every group
+// belong to. It can't be used as the name of a group.
+const BackboneGroup = "backbone"
+
+// GroupLabel returns the memberlist label used by a group of a cluster.
+func GroupLabel(cluster, group string) string {
+	return cluster + "/" + group
+}
+
+// GroupFor spreads nodes evenly over the given number of groups by name,
+// returning the name of the group the node belongs in. The number of
+// groups must be positive.
+func GroupFor(name string, groups int) string {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return fmt.Sprintf("group-%d", h.Sum32()%uint32(groups))
+}
+
+// GroupConfig configures a member of a gossip group.
+type GroupConfig struct {
+	// Cluster and Group name the cluster as a whole and the group this
+	// member belongs to.
+	Cluster string
+	Group   string
+
+	// Config is used to create the member of the group. Its Label is
+	// replaced with the group's, and any Delegate set on it is wrapped, but
+	// still sees every message.
+	Config *memberlist.Config
+
+	// Backbone, if set, makes this member a bridge, and is used to create
+	// its member of the backbone in the same way.
+	Backbone *memberlist.Config
+
+	// RelayTags are the prefixes of user broadcasts that bridges pass
+	// between groups.
+	RelayTags [][]byte
+
+	// SummaryInterval is how often bridges summarize their group. Zero
+	// disables summaries, and with them the directory.
+	SummaryInterval time.Duration
+
+	// Logger is used for a bridge's own logging. If nil, logs go to
+	// stderr.
+	Logger *log.Logger
+}
+
+// DefaultGroupConfig returns the config for an ordinary member of a group,
+// created with the given memberlist config.
+func DefaultGroupConfig(cluster, group string, conf *memberlist.Config) *GroupConfig {
+	return &GroupConfig{
+		Cluster:         cluster,
+		Group:           group,
+		Config:          conf,
+		SummaryInterval: 10 * time.Second,
+	}
+}
+
+// GroupInfo describes another group of the cluster.
+type GroupInfo struct {
+	Group string
+
+	// Members is the number of live members its bridges last reported.
+	Members int
+
+	// Bridges are the names of the bridges that have reported on it
+	// recently, as members of the backbone.
+	Bridges []string
+
+	// Updated is when we last heard about it.
+	Updated time.Time
+}
+
+// GroupMember is a member of a gossip group, and possibly a bridge.
+type GroupMember struct {
+	list   *memberlist.Memberlist
+	bridge *Bridge
+	dir    *directory
+}
+
+// NewGroupMember creates a member of a group. Use Memberlist to get at it
+// to join the group, and Backbone for a bridge to join the backbone.
+func NewGroupMember(conf *GroupConfig) (*GroupMember, error) {
+	if conf.Cluster == "" || conf.Group == "" {
+		return nil, fmt.Errorf("Cluster and group names are required")
+	}
+	if conf.Group == BackboneGroup {
+		return nil, fmt.Errorf("Group name '%s' is reserved for the backbone", BackboneGroup)
+	}
+	if conf.Config == nil {
+		return nil, fmt.Errorf("A memberlist config is required")
+	}
+
+	dir := &directory{
+		group:  conf.Group,
+		expiry: 3 * conf.SummaryInterval,
+		groups: make(map[string]*groupEntry),
+	}
+	conf.Config.Label = GroupLabel(conf.Cluster, conf.Group)
+	conf.Config.Delegate = &directoryDelegate{dir: dir, inner: conf.Config.Delegate}
+
+	if conf.Backbone == nil {
+		list, err := memberlist.Create(conf.Config)
+		if err != nil {
+			return nil, err
+		}
+		return &GroupMember{list: list, dir: dir}, nil
+	}
+
+	conf.Backbone.Label = GroupLabel(conf.Cluster, BackboneGroup)
+	conf.Backbone.Delegate = &directoryDelegate{dir: dir, inner: conf.Backbone.Delegate}
+
+	bc := DefaultConfig(
+		Cluster{Name: conf.Group, Config: conf.Config},
+		Cluster{Name: BackboneGroup, Config: conf.Backbone},
+	)
+	bc.RelayTags = conf.RelayTags
+	bc.SummaryInterval = conf.SummaryInterval
+	bc.RelaySummaries = true
+	bc.Logger = conf.Logger
+
+	// Summaries are repeated every interval, and have to be relayed each
+	// time to keep directories fresh, so they mustn't be remembered for
+	// that long.
+	if conf.SummaryInterval > 0 {
+		bc.DedupWindow = conf.SummaryInterval / 2
+	}
+
+	b, err := NewBridge(bc)
+	if err != nil {
+		return nil, err
+	}
+	return &GroupMember{list: b.Memberlist(conf.Group), bridge: b, dir: dir}, nil
+}
+
+// Memberlist returns the member of the group.
+func (g *GroupMember) Memberlist() *memberlist.Memberlist {
+	return g.list
+}
+
+// Backbone returns a bridge's member of the backbone, or nil if this
+// member isn't a bridge.
+func (g *GroupMember) Backbone() *memberlist.Memberlist {
+	if g.bridge == nil {
+		return nil
+	}
+	return g.bridge.Memberlist(BackboneGroup)
+}
+
+// Groups returns the other groups we've heard about recently, sorted by
+// name.
+func (g *GroupMember) Groups() []GroupInfo {
+	return g.dir.list(time.Now())
+}
+
+// NumMembers estimates the number of live members across the whole
+// cluster, from our group and the directory.
+func (g *GroupMember) NumMembers() int {
+	n := g.list.NumMembers()
+	for _, info := range g.Groups() {
+		n += info.Members
+	}
+	return n
+}
+
+// Leave leaves the group, and the backbone if we're a bridge, waiting up
+// to the timeout for each.
+func (g *GroupMember) Leave(timeout time.Duration) error {
+	if g.bridge != nil {
+		return g.bridge.Leave(timeout)
+	}
+	return g.list.Leave(timeout)
+}
+
+// Shutdown shuts down the member, and its backbone member if it's a bridge.
+func (g *GroupMember) Shutdown() error {
+	if g.bridge != nil {
+		return g.bridge.Shutdown()
+	}
+	return g.list.Shutdown()
+}
+
+// directory tracks the other groups from their summaries.
+type directory struct {
+	group  string
+	expiry time.Duration
+
+	lock   sync.Mutex
+	groups map[string]*groupEntry
+}
+
+// groupEntry is what we know about one group.
+type groupEntry struct {
+	members int
+	bridges map[string]time.Time // Bridge name -> when we last heard from it
+	updated time.Time
+}
+
+// record notes a summary of a group.
+func (d *directory) record(s *Summary, now time.Time) {
+	if s.Cluster == d.group || s.Cluster == BackboneGroup {
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	e, ok := d.groups[s.Cluster]
+	if !ok {
+		e = &groupEntry{bridges: make(map[string]time.Time)}
+		d.groups[s.Cluster] = e
+	}
+	e.members = s.Members
+	e.bridges[s.Bridge] = now
+	e.updated = now
+}
+
+// list returns the groups heard from within the expiry, forgetting the
+// rest.
+func (d *directory) list(now time.Time) []GroupInfo {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	infos := make([]GroupInfo, 0, len(d.groups))
+	for name, e := range d.groups {
+		if d.expiry > 0 {
+			for bridge, seen := range e.bridges {
+				if now.Sub(seen) > d.expiry {
+					delete(e.bridges, bridge)
+				}
+			}
+			if len(e.bridges) == 0 {
+				delete(d.groups, name)
+				continue
+			}
+		}
+
+		info := GroupInfo{Group: name, Members: e.members, Updated: e.updated}
+		for bridge := range e.bridges {
+			info.Bridges = append(info.Bridges, bridge)
+		}
+		sort.Strings(info.Bridges)
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Group < infos[j].Group })
+	return infos
+}
+
+// directoryDelegate feeds summaries to the directory, and passes every
+// message on to the wrapped delegate.
+type directoryDelegate struct {
+	dir   *directory
+	inner memberlist.Delegate
+}
+
+func (d *directoryDelegate) NotifyMsg(msg []byte) {
+	if s, ok := DecodeSummary(msg); ok {
+		d.dir.record(s, time.Now())
+	}
+	if d.inner != nil {
+		d.inner.NotifyMsg(msg)
+	}
+}
+
+func (d *directoryDelegate) NodeMeta(limit int) []byte {
+	if d.inner == nil {
+		return nil
+	}
+	return d.inner.NodeMeta(limit)
+}
+
+func (d *directoryDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	if d.inner == nil {
+		return nil
+	}
+	return d.inner.GetBroadcasts(overhead, limit)
+}
+
+func (d *directoryDelegate) LocalState(join bool) []byte {
+	if d.inner == nil {
+		return nil
+	}
+	return d.inner.LocalState(join)
+}
+
+func (d *directoryDelegate) MergeRemoteState(buf []byte, join bool) {
+	if d.inner != nil {
+		d.inner.MergeRemoteState(buf, join)
+	}
+}
@@ -0,0 +1,119 @@
+package federation
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testGroupMember(t *testing.T, group, name string, bridge bool) (*GroupMember, *testDelegate) {
+	d := &testDelegate{}
+	conf := testConfig(name)
+	conf.Delegate = d
+	gc := DefaultGroupConfig("test", group, conf)
+	gc.RelayTags = [][]byte{[]byte("relay:")}
+	gc.SummaryInterval = 50 * time.Millisecond
+	if bridge {
+		gc.Backbone = testConfig(name + "-backbone")
+	}
+	g, err := NewGroupMember(gc)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	d.queue.NumNodes = g.Memberlist().NumMembers
+	d.queue.RetransmitMult = conf.RetransmitMult
+	return g, d
+}
+
+func TestGroupMember_Directory(t *testing.T) {
+	bridge1, _ := testGroupMember(t, "g1", "bridge-1", true)
+	defer bridge1.Shutdown()
+	bridge2, _ := testGroupMember(t, "g2", "bridge-2", true)
+	defer bridge2.Shutdown()
+	member1, delegate1 := testGroupMember(t, "g1", "member-1", false)
+	defer member1.Shutdown()
+	member2, delegate2 := testGroupMember(t, "g2", "member-2", false)
+	defer member2.Shutdown()
+	extra2, _ := testGroupMember(t, "g2", "extra-2", false)
+	defer extra2.Shutdown()
+
+	if member1.Backbone() != nil || bridge1.Backbone() == nil {
+		t.Fatalf("only bridges should have a backbone member")
+	}
+	if got := member1.Memberlist().LocalNode(); got.Name != "member-1" {
+		t.Fatalf("bad: %v", got.Name)
+	}
+
+	join(t, bridge2.Backbone(), bridge1.Backbone())
+	join(t, member1.Memberlist(), bridge1.Memberlist())
+	join(t, member2.Memberlist(), bridge2.Memberlist())
+	join(t, extra2.Memberlist(), bridge2.Memberlist())
+
+	// Groups stay separate.
+	if n := member1.Memberlist().NumMembers(); n != 2 {
+		t.Fatalf("bad members: %d", n)
+	}
+
+	// But each member hears about the other group through the bridges.
+	waitFor(t, "directory", func() bool {
+		groups := member1.Groups()
+		return len(groups) == 1 && groups[0].Group == "g2" && groups[0].Members == 3
+	})
+	if got := member1.Groups()[0].Bridges; len(got) != 1 || got[0] != "bridge-2" {
+		t.Fatalf("bad bridges: %v", got)
+	}
+	waitFor(t, "directory", func() bool {
+		groups := member2.Groups()
+		return len(groups) == 1 && groups[0].Group == "g1" && groups[0].Members == 2
+	})
+	if n := member1.NumMembers(); n != 5 {
+		t.Fatalf("bad total: %d", n)
+	}
+
+	// Tagged broadcasts reach the other group.
+	delegate2.queue.QueueBroadcast(testBroadcast("relay:hello"))
+	waitFor(t, "relayed message", func() bool {
+		return len(delegate1.received([]byte("relay:"))) > 0
+	})
+
+	// A group whose bridge goes away drops out of the directory.
+	bridge2.Shutdown()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(member1.Groups()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if groups := member1.Groups(); len(groups) != 0 {
+		t.Fatalf("bad: %v", groups)
+	}
+}
+
+func TestNewGroupMember_Invalid(t *testing.T) {
+	for _, gc := range []*GroupConfig{
+		DefaultGroupConfig("", "g1", testConfig("a")),
+		DefaultGroupConfig("test", "", testConfig("a")),
+		DefaultGroupConfig("test", BackboneGroup, testConfig("a")),
+		DefaultGroupConfig("test", "g1", nil),
+	} {
+		if _, err := NewGroupMember(gc); err == nil {
+			t.Fatalf("expected error for %+v", gc)
+		}
+	}
+}
+
+func TestGroupFor(t *testing.T) {
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[GroupFor(fmt.Sprintf("node-%d", i), 4)]++
+	}
+	if len(counts) != 4 {
+		t.Fatalf("bad: %v", counts)
+	}
+	for g, n := range counts {
+		if n < 150 {
+			t.Fatalf("group %s is too small: %v", g, counts)
+		}
+	}
+	if GroupFor("node", 4) != GroupFor("node", 4) {
+		t.Fatalf("should be stable")
+	}
+}
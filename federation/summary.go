@@ -0,0 +1,44 @@
+package federation
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// SummaryTag prefixes the user messages that carry cluster summaries.
+var SummaryTag = []byte("memberlist-federation-summary:")
+
+// Summary describes a cluster on the far side of a bridge.
+type Summary struct {
+	// Cluster is the name of the summarized cluster.
+	Cluster string
+
+	// Bridge is the name of the bridge's member in that cluster.
+	Bridge string
+
+	// Members is the number of live members the bridge sees there.
+	Members int
+}
+
+// encodeSummary encodes a summary as a user message.
+func encodeSummary(s *Summary) ([]byte, error) {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte{}, SummaryTag...), body...), nil
+}
+
+// DecodeSummary reads a cluster summary from a user message received by a
+// Delegate. It returns false for messages that aren't summaries, so it can
+// be called on every message.
+func DecodeSummary(msg []byte) (*Summary, bool) {
+	if !bytes.HasPrefix(msg, SummaryTag) {
+		return nil, false
+	}
+	var s Summary
+	if err := json.Unmarshal(msg[len(SummaryTag):], &s); err != nil {
+		return nil, false
+	}
+	return &s, true
+}
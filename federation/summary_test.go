@@ -0,0 +1,29 @@
+package federation
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummary_EncodeDecode(t *testing.T) {
+	s := &Summary{Cluster: "east", Bridge: "hub-1", Members: 42}
+	msg, err := encodeSummary(s)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out, ok := DecodeSummary(msg)
+	if !ok {
+		t.Fatalf("should decode")
+	}
+	if !reflect.DeepEqual(s, out) {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	if _, ok := DecodeSummary([]byte("something else")); ok {
+		t.Fatalf("should not decode")
+	}
+	if _, ok := DecodeSummary(append(append([]byte{}, SummaryTag...), '{')); ok {
+		t.Fatalf("should not decode garbage")
+	}
+}
@@ -0,0 +1,43 @@
+package memberlist
+
+import "fmt"
+
+/*
+FIPS mode restricts memberlist to FIPS 140 approved algorithms, and makes
+sure they're provided by a validated module. Everything memberlist needs
+for the protocol is already approved: AES-GCM for encryption, HMAC-SHA256
+for authentication, SHA-256 for content hashes and crypto/rand for nonces,
+all of which the standard library routes through its FIPS module when one
+is enabled. The exception is keyring files, which use scrypt, so in FIPS
+mode they're written with PBKDF2 instead and scrypt files are refused.
+
+FIPS mode is in force when memberlist is built with the fips tag, or when
+the program is running with Go's FIPS module enabled, either by building
+with GOEXPERIMENT=boringcrypto or, from Go 1.24, with GODEBUG=fips140=on.
+Setting Config.FIPSMode, or building with the fips tag, makes Create fail
+unless that module really is enabled, so a deployment that needs FIPS
+can't silently run without it.
+*/
+
+// FIPSEnabled reports whether Go's FIPS 140 crypto module is enabled in
+// this program.
+func FIPSEnabled() bool {
+	return fipsModuleEnabled()
+}
+
+// fipsEnforced returns true if only FIPS approved algorithms may be used.
+func fipsEnforced() bool {
+	return fipsBuild || fipsModuleEnabled()
+}
+
+// checkFIPS makes sure that a configuration that requires FIPS mode can
+// have it.
+func checkFIPS(conf *Config) error {
+	if !conf.FIPSMode && !fipsBuild {
+		return nil
+	}
+	if !fipsModuleEnabled() {
+		return fmt.Errorf("FIPS mode requires Go's FIPS 140 module: build with GOEXPERIMENT=boringcrypto, or run with GODEBUG=fips140=on on Go 1.24 or later")
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package memberlist
+
+import "crypto/boring"
+
+// fipsModuleEnabled reports whether BoringCrypto is in use.
+func fipsModuleEnabled() bool {
+	return boring.Enabled()
+}
@@ -0,0 +1,11 @@
+//go:build go1.24 && !boringcrypto
+// +build go1.24,!boringcrypto
+
+package memberlist
+
+import "crypto/fips140"
+
+// fipsModuleEnabled reports whether Go's native FIPS 140 module is enabled.
+func fipsModuleEnabled() bool {
+	return fips140.Enabled()
+}
@@ -0,0 +1,7 @@
+//go:build !fips
+// +build !fips
+
+package memberlist
+
+// fipsBuild is set when built with the fips tag.
+const fipsBuild = false
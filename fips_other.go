@@ -0,0 +1,10 @@
+//go:build !go1.24 && !boringcrypto
+// +build !go1.24,!boringcrypto
+
+package memberlist
+
+// fipsModuleEnabled reports whether a FIPS 140 module is enabled, which
+// needs BoringCrypto before Go 1.24.
+func fipsModuleEnabled() bool {
+	return false
+}
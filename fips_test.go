@@ -0,0 +1,31 @@
+package memberlist
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckFIPS(t *testing.T) {
+	conf := DefaultLANConfig()
+	if fipsBuild {
+		t.Skip("built with the fips tag")
+	}
+	if err := checkFIPS(conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf.FIPSMode = true
+	err := checkFIPS(conf)
+	if FIPSEnabled() {
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return
+	}
+	if err == nil || !strings.Contains(err.Error(), "FIPS") {
+		t.Fatalf("expected FIPS error, got %v", err)
+	}
+	if _, err := Create(conf); err == nil {
+		t.Fatalf("expected Create to fail")
+	}
+}
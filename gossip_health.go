@@ -0,0 +1,108 @@
+package memberlist
+
+import (
+	"math/rand"
+	"sync"
+)
+
+/*
+Gossip goes to random peers, but a peer that's been failing our probes is
+likely to drop the gossip too, wasting a slot that could have helped spread
+it. So we keep a running failure rate for each peer, from the results of
+direct probes, and weight the random choice of gossip targets against the
+ones that have been failing. Failing peers are never ruled out completely,
+so they keep hearing about the cluster and their weight recovers as soon as
+they start answering again.
+*/
+
+const (
+	// gossipHealthAlpha is how much each probe result counts towards a
+	// peer's failure rate, with the rest coming from earlier results.
+	gossipHealthAlpha = 0.25
+
+	// gossipMinWeight is the weight of a peer that has failed every recent
+	// probe, relative to one that has answered them all.
+	gossipMinWeight = 0.1
+)
+
+// gossipHealth tracks how reliably we've been able to reach each peer.
+type gossipHealth struct {
+	sync.Mutex
+	failures map[string]float64
+}
+
+// record adds the result of a direct probe of a node.
+func (h *gossipHealth) record(node string, ok bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	sample := 1.0
+	if ok {
+		sample = 0.0
+	}
+	rate := gossipHealthAlpha*sample + (1-gossipHealthAlpha)*h.failures[node]
+	if rate < 0.001 {
+		delete(h.failures, node)
+		return
+	}
+	if h.failures == nil {
+		h.failures = make(map[string]float64)
+	}
+	h.failures[node] = rate
+}
+
+// forget drops what we know about a node that's gone.
+func (h *gossipHealth) forget(node string) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.failures, node)
+}
+
+// weight returns how likely a node is to be picked for gossip, from
+// gossipMinWeight to 1.
+func (h *gossipHealth) weight(node string) float64 {
+	h.Lock()
+	defer h.Unlock()
+	return 1 - (1-gossipMinWeight)*h.failures[node]
+}
+
+// weightedRandomNodes is like kRandomNodes, but picks nodes in proportion
+// to the given weights. Like kRandomNodes it draws nodes at random, up to
+// 3*n times, keeping each with a chance of its weight. In a cluster too
+// small for that to find k, it makes up the rest from a pass over the
+// nodes, starting anywhere.
+func weightedRandomNodes(k int, excludes []string, nodes []*nodeState, weight func(string) float64) []*nodeState {
+	n := len(nodes)
+	kNodes := make([]*nodeState, 0, k)
+	eligible := func(node *nodeState) bool {
+		for _, exclude := range excludes {
+			if node.Name == exclude {
+				return false
+			}
+		}
+		if !node.State.active() {
+			return false
+		}
+		for _, picked := range kNodes {
+			if node == picked {
+				return false
+			}
+		}
+		return true
+	}
+
+	for i := 0; i < 3*n && len(kNodes) < k; i++ {
+		node := nodes[randomOffset(n)]
+		if eligible(node) && rand.Float64() < weight(node.Name) {
+			kNodes = append(kNodes, node)
+		}
+	}
+
+	start := randomOffset(n)
+	for i := 0; i < n && len(kNodes) < k; i++ {
+		if node := nodes[(start+i)%n]; eligible(node) {
+			kNodes = append(kNodes, node)
+		}
+	}
+	return kNodes
+}
@@ -0,0 +1,121 @@
+package memberlist
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGossipHealth_Weight(t *testing.T) {
+	var h gossipHealth
+	if w := h.weight("test"); w != 1 {
+		t.Fatalf("unknown nodes should have full weight: %v", w)
+	}
+
+	for i := 0; i < 50; i++ {
+		h.record("test", false)
+	}
+	if w := h.weight("test"); w > gossipMinWeight+0.01 {
+		t.Fatalf("failing node should be near the minimum: %v", w)
+	}
+
+	// It recovers once probes succeed again.
+	for i := 0; i < 50; i++ {
+		h.record("test", true)
+	}
+	if w := h.weight("test"); w != 1 {
+		t.Fatalf("should have recovered: %v", w)
+	}
+	if len(h.failures) != 0 {
+		t.Fatalf("should not track healthy nodes: %v", h.failures)
+	}
+
+	h.record("test", false)
+	h.forget("test")
+	if w := h.weight("test"); w != 1 {
+		t.Fatalf("should have forgotten: %v", w)
+	}
+}
+
+func TestWeightedRandomNodes(t *testing.T) {
+	nodes := []*nodeState{}
+	for i := 0; i < 90; i++ {
+		// A third of the nodes are dead, 60 should be alive
+		state := stateAlive
+		if i%3 == 0 {
+			state = stateDead
+		}
+		nodes = append(nodes, &nodeState{
+			Node: Node{
+				Name: fmt.Sprintf("test%d", i),
+			},
+			State: state,
+		})
+	}
+
+	filterFunc := func(n string) bool { return n == "test0" || n == "test1" }
+	weight := func(string) float64 { return 1 }
+
+	s1 := weightedRandomNodes(3, []string{"test0", "test1"}, nodes, weight)
+	s2 := weightedRandomNodes(3, []string{"test0", "test1"}, nodes, weight)
+	if len(s1) != 3 || len(s2) != 3 {
+		t.Fatalf("bad len")
+	}
+	for _, s := range append(s1, s2...) {
+		if filterFunc(s.Name) || s.State != stateAlive {
+			t.Fatalf("bad node: %v", s)
+		}
+	}
+	if s1[0] == s2[0] && s1[1] == s2[1] && s1[2] == s2[2] {
+		t.Fatalf("unlikely to pick the same nodes twice")
+	}
+
+	all := weightedRandomNodes(100, nil, nodes, weight)
+	if len(all) != 60 {
+		t.Fatalf("should return every live node: %d", len(all))
+	}
+}
+
+func TestWeightedRandomNodes_Bias(t *testing.T) {
+	nodes := []*nodeState{
+		{Node: Node{Name: "good"}, State: stateAlive},
+		{Node: Node{Name: "bad"}, State: stateAlive},
+	}
+	weight := func(n string) float64 {
+		if n == "bad" {
+			return gossipMinWeight
+		}
+		return 1
+	}
+
+	bad := 0
+	for i := 0; i < 1000; i++ {
+		if weightedRandomNodes(1, nil, nodes, weight)[0].Name == "bad" {
+			bad++
+		}
+	}
+
+	// The bad node should be picked about 1 time in 11, but not never.
+	if bad == 0 || bad > 250 {
+		t.Fatalf("bad node picked %d times out of 1000", bad)
+	}
+}
+
+func TestWeightedRandomNodes_Bounded(t *testing.T) {
+	nodes := make([]*nodeState, 10000)
+	for i := range nodes {
+		nodes[i] = &nodeState{Node: Node{Name: fmt.Sprintf("test%d", i)}, State: stateAlive}
+	}
+	calls := 0
+	weight := func(string) float64 {
+		calls++
+		return 1
+	}
+
+	// A few picks shouldn't weigh up the whole cluster.
+	if got := weightedRandomNodes(3, nil, nodes, weight); len(got) != 3 {
+		t.Fatalf("bad len: %d", len(got))
+	}
+	if calls > 100 {
+		t.Fatalf("weighed %d nodes for 3", calls)
+	}
+}
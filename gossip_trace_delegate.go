@@ -0,0 +1,31 @@
+package memberlist
+
+import "net"
+
+// GossipTraceDelegate is used to follow alive, suspect and dead messages as
+// they're gossiped through the cluster. Each message carries the node that
+// first broadcast it and how many times it has been passed on since, so by
+// collecting the traces from every member a debugging tool can reconstruct
+// the paths a message took, and spot loops or members it never reached.
+type GossipTraceDelegate interface {
+	// NotifyGossip is invoked for every state message received, including
+	// copies of messages we've already seen.
+	NotifyGossip(GossipTrace)
+}
+
+// GossipTrace describes a single state message as we received it.
+type GossipTrace struct {
+	// Type is "alive", "suspect" or "dead".
+	Type        string
+	Node        string
+	Incarnation uint32
+
+	// Origin is the node that first broadcast the message, and Hops the
+	// number of times it was passed on before reaching us. Origin is empty
+	// if the message came from a member that doesn't track them.
+	Origin string
+	Hops   int
+
+	// From is the address of the member that sent us this copy.
+	From net.Addr
+}
@@ -0,0 +1,251 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Health overrides let an external health checker, such as an orchestrator's
+readiness probe or a load balancer's health check, weigh in on failure
+detection. MarkUnhealthy holds a node suspect in our view for a while,
+whatever it says about itself: its alive messages still bring its
+incarnation and metadata up to date, but leave it suspect, so it's passed
+over as a gossip target and indirect probe helper. We keep probing it all
+the same, and if those probes fail, suspicion runs its usual course to
+dead. When the override expires, a node that's only suspect because of it
+is alive again, or back in maintenance if it said it was in maintenance.
+
+The override is local unless HealthAdvisories is set, in which case we
+gossip it as an advisory carrying the reason and the time left, and apply
+the advisories we hear about from others. Like bans, each advisory carries
+the time it was issued on the sender's clock, and the latest one for a node
+wins, which is how lifting an override gets past stale copies of it. An
+advisory never marks a node dead by itself, so a wrong one costs no more
+than the node being passed over until it expires.
+*/
+
+// healthAdvisory is broadcast to mark a node unhealthy, or to lift that.
+type healthAdvisory struct {
+	Node   string `codec:"Node"`
+	Reason string `codec:"Reason"`
+	Issued int64  `codec:"Issued"` // Unix nanoseconds on the issuer's clock
+	TTL    int64  `codec:"TTL"`    // Nanoseconds left, or zero to lift it
+	From   string `codec:"From"`
+}
+
+// HealthOverride describes a node held suspect by MarkUnhealthy.
+type HealthOverride struct {
+	Reason  string
+	From    string // The node that marked it
+	Expires time.Time
+}
+
+// healthOverride is an override we know about.
+type healthOverride struct {
+	HealthOverride
+	issued int64
+}
+
+// healthOverrides tracks the overrides we know about, including lifted
+// ones so that we can tell if an advisory we hear about later is stale.
+type healthOverrides struct {
+	sync.Mutex
+	entries map[string]healthOverride
+}
+
+// update records an override, returning false if we already knew about it
+// or about a later one.
+func (o *healthOverrides) update(h *healthAdvisory, now time.Time) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	if e, ok := o.entries[h.Node]; ok && e.issued >= h.Issued {
+		return false
+	}
+	if o.entries == nil {
+		o.entries = make(map[string]healthOverride)
+	}
+	o.entries[h.Node] = healthOverride{
+		HealthOverride: HealthOverride{
+			Reason:  h.Reason,
+			From:    h.From,
+			Expires: now.Add(time.Duration(h.TTL)),
+		},
+		issued: h.Issued,
+	}
+	return true
+}
+
+// unhealthy returns true if the given node is currently marked unhealthy.
+func (o *healthOverrides) unhealthy(node string, now time.Time) bool {
+	o.Lock()
+	defer o.Unlock()
+
+	e, ok := o.entries[node]
+	return ok && now.Before(e.Expires)
+}
+
+// prune forgets about overrides that expired or were lifted a while ago.
+func (o *healthOverrides) prune(now time.Time, keep time.Duration) {
+	o.Lock()
+	defer o.Unlock()
+
+	for node, e := range o.entries {
+		if now.Sub(e.Expires) > keep {
+			delete(o.entries, node)
+		}
+	}
+}
+
+// healthKey is the broadcast key for a health advisory, so that it doesn't
+// invalidate messages about the node itself.
+func healthKey(node string) string {
+	return "health:" + node
+}
+
+// MarkUnhealthy holds the named node suspect in our view for the given
+// time, for the given reason, whatever it says about itself. It's still
+// probed, and declared dead if it fails. With HealthAdvisories set, the
+// rest of the cluster is told too. A ttl of zero lifts an override early.
+// See the notes in health_override.go.
+func (m *Memberlist) MarkUnhealthy(node, reason string, ttl time.Duration) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+	if node == m.config.Name {
+		return fmt.Errorf("Cannot mark ourselves unhealthy")
+	}
+	if ttl < 0 {
+		return fmt.Errorf("Health override TTL must not be negative")
+	}
+
+	m.nodeLock.RLock()
+	_, ok := m.nodeMap[node]
+	m.nodeLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unknown node %s", node)
+	}
+
+	h := healthAdvisory{
+		Node:   node,
+		Reason: reason,
+		Issued: time.Now().UnixNano(),
+		TTL:    int64(ttl),
+		From:   m.config.Name,
+	}
+	m.applyHealthAdvisory(&h)
+	return nil
+}
+
+// HealthOverrides returns the nodes currently held suspect by
+// MarkUnhealthy, ours or, with HealthAdvisories, others'.
+func (m *Memberlist) HealthOverrides() map[string]HealthOverride {
+	now := time.Now()
+	m.overrides.Lock()
+	defer m.overrides.Unlock()
+
+	out := make(map[string]HealthOverride)
+	for node, e := range m.overrides.entries {
+		if now.Before(e.Expires) {
+			out[node] = e.HealthOverride
+		}
+	}
+	return out
+}
+
+// applyHealthAdvisory records an override and passes it on, if it's news
+// to us.
+func (m *Memberlist) applyHealthAdvisory(h *healthAdvisory) {
+	if h.Node == m.config.Name {
+		if h.TTL > 0 {
+			m.logger.Printf("[WARN] memberlist: We've been marked unhealthy for %v: %s (from: %s)",
+				time.Duration(h.TTL), h.Reason, h.From)
+		}
+		return
+	}
+
+	now := time.Now()
+	m.overrides.prune(now, banRetention)
+	if !m.overrides.update(h, now) {
+		return
+	}
+	if m.config.HealthAdvisories {
+		m.encodeAndBroadcast(healthKey(h.Node), healthAdvisoryMsg, h)
+	}
+
+	if h.TTL <= 0 {
+		m.logger.Printf("[INFO] memberlist: Health override on %s lifted (from: %s)", h.Node, h.From)
+		m.endHealthOverride(h.Node)
+		return
+	}
+	m.logger.Printf("[INFO] memberlist: Marked %s unhealthy for %v: %s (from: %s)",
+		h.Node, time.Duration(h.TTL), h.Reason, h.From)
+	metrics.IncrCounter([]string{"memberlist", "health", "override"}, 1)
+
+	m.nodeLock.Lock()
+	if state, ok := m.nodeMap[h.Node]; ok && state.State.active() {
+		state.State = stateSuspect
+		state.StateChange = now
+		m.updateCoordinator()
+	}
+	m.nodeLock.Unlock()
+
+	time.AfterFunc(time.Duration(h.TTL), func() {
+		m.endHealthOverride(h.Node)
+	})
+}
+
+// endHealthOverride makes a node alive again once it's no longer marked
+// unhealthy, unless it's under suspicion of its own.
+func (m *Memberlist) endHealthOverride(node string) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	if m.overrides.unhealthy(node, time.Now()) {
+		return
+	}
+	state, ok := m.nodeMap[node]
+	if !ok || state.State != stateSuspect {
+		return
+	}
+	if _, ok := m.nodeTimers[node]; ok {
+		return
+	}
+	state.State = stateAlive
+	if state.maintenance {
+		state.State = stateMaintenance
+	}
+	state.StateChange = time.Now()
+	m.updateCoordinator()
+}
+
+// heldSuspect returns true if a node is suspect only because it's marked
+// unhealthy. The node lock must be held.
+func (m *Memberlist) heldSuspect(state *nodeState) bool {
+	if state.State != stateSuspect {
+		return false
+	}
+	if _, ok := m.nodeTimers[state.Name]; ok {
+		return false
+	}
+	return m.overrides.unhealthy(state.Name, time.Now())
+}
+
+func (m *Memberlist) handleHealthAdvisory(buf []byte, from net.Addr) {
+	var h healthAdvisory
+	if err := decode(buf, &h); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode health advisory: %s %s", err, LogAddress(from))
+		return
+	}
+	if !m.config.HealthAdvisories {
+		return
+	}
+	m.applyHealthAdvisory(&h)
+}
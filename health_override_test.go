@@ -0,0 +1,179 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHealthOverrides(t *testing.T) {
+	var o healthOverrides
+	now := time.Now()
+
+	h := &healthAdvisory{Node: "test", Reason: "probe", Issued: 10, TTL: int64(time.Minute)}
+	if !o.update(h, now) {
+		t.Fatalf("should be new")
+	}
+	if o.update(h, now) {
+		t.Fatalf("should not be new")
+	}
+	if !o.unhealthy("test", now.Add(59*time.Second)) {
+		t.Fatalf("should be unhealthy")
+	}
+	if o.unhealthy("test", now.Add(time.Minute)) {
+		t.Fatalf("should have expired")
+	}
+	if o.unhealthy("other", now) {
+		t.Fatalf("should not be unhealthy")
+	}
+
+	// Lifting it needs a later advisory, and a stale copy of the original
+	// doesn't bring it back.
+	if o.update(&healthAdvisory{Node: "test", Issued: 5}, now) {
+		t.Fatalf("stale lift should be ignored")
+	}
+	if !o.update(&healthAdvisory{Node: "test", Issued: 20}, now) {
+		t.Fatalf("should be new")
+	}
+	if o.unhealthy("test", now) {
+		t.Fatalf("should have been lifted")
+	}
+	if o.update(h, now) {
+		t.Fatalf("stale advisory should be ignored")
+	}
+
+	o.prune(now.Add(2*time.Hour), time.Hour)
+	if len(o.entries) != 0 {
+		t.Fatalf("should have pruned: %v", o.entries)
+	}
+}
+
+func TestMemberlist_MarkUnhealthy(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	if err := m.MarkUnhealthy(m.config.Name, "probe", time.Minute); err == nil {
+		t.Fatalf("should not mark ourselves")
+	}
+	if err := m.MarkUnhealthy("nope", "probe", time.Minute); err == nil {
+		t.Fatalf("should not mark an unknown node")
+	}
+	if err := m.MarkUnhealthy("test", "probe", -time.Minute); err == nil {
+		t.Fatalf("should not take a negative TTL")
+	}
+
+	m.broadcasts.Reset()
+	if err := m.MarkUnhealthy("test", "probe", time.Minute); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state := m.nodeMap["test"]; state.State != stateSuspect {
+		t.Fatalf("should be suspect: %v", state.State)
+	}
+	if _, ok := m.nodeTimers["test"]; ok {
+		t.Fatalf("should not be suspected for real")
+	}
+	if o, ok := m.HealthOverrides()["test"]; !ok || o.Reason != "probe" || o.From != m.config.Name {
+		t.Fatalf("should be listed: %v", m.HealthOverrides())
+	}
+	if m.broadcasts.NumQueued() != 0 {
+		t.Fatalf("should stay local without HealthAdvisories")
+	}
+
+	// It stays suspect whatever it says about itself, but still takes in
+	// what's new.
+	a.Incarnation = 2
+	a.Meta = []byte("meta")
+	m.aliveNode(&a, nil, false)
+	state := m.nodeMap["test"]
+	if state.State != stateSuspect || state.Incarnation != 2 || string(state.Meta) != "meta" {
+		t.Fatalf("bad state: %v %d %q", state.State, state.Incarnation, state.Meta)
+	}
+
+	// Real suspicion still takes hold.
+	s := suspect{Node: "test", Incarnation: 2, From: "other"}
+	m.suspectNode(&s)
+	if _, ok := m.nodeTimers["test"]; !ok {
+		t.Fatalf("should be suspected")
+	}
+
+	// Refuting that leaves it held suspect until the override is lifted.
+	a.Incarnation = 3
+	m.aliveNode(&a, nil, false)
+	if state := m.nodeMap["test"]; state.State != stateSuspect {
+		t.Fatalf("should still be suspect: %v", state.State)
+	}
+	if err := m.MarkUnhealthy("test", "", 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state := m.nodeMap["test"]; state.State != stateAlive {
+		t.Fatalf("should be alive: %v", state.State)
+	}
+	if len(m.HealthOverrides()) != 0 {
+		t.Fatalf("should be lifted: %v", m.HealthOverrides())
+	}
+}
+
+func TestMemberlist_MarkUnhealthy_Expires(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	if err := m.MarkUnhealthy("test", "probe", 20*time.Millisecond); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.nodeLock.RLock()
+	held := m.heldSuspect(m.nodeMap["test"])
+	m.nodeLock.RUnlock()
+	if !held {
+		t.Fatalf("should be held suspect")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	m.nodeLock.RLock()
+	st := m.nodeMap["test"].State
+	m.nodeLock.RUnlock()
+	if st != stateAlive {
+		t.Fatalf("should be alive again: %v", st)
+	}
+}
+
+func TestMemberlist_HandleHealthAdvisory(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	h := healthAdvisory{Node: "test", Reason: "probe", Issued: time.Now().UnixNano(), TTL: int64(time.Minute), From: "other"}
+	buf, err := encode(healthAdvisoryMsg, &h)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Ignored unless we've opted in.
+	m.handleHealthAdvisory(buf.Bytes()[1:], nil)
+	if len(m.HealthOverrides()) != 0 {
+		t.Fatalf("should be ignored")
+	}
+
+	m.config.HealthAdvisories = true
+	m.broadcasts.Reset()
+	m.handleHealthAdvisory(buf.Bytes()[1:], nil)
+	if state := m.nodeMap["test"]; state.State != stateSuspect {
+		t.Fatalf("should be suspect: %v", state.State)
+	}
+	if m.broadcasts.NumQueued() != 1 {
+		t.Fatalf("should pass the advisory on")
+	}
+
+	// Hearing it again changes nothing.
+	m.broadcasts.Reset()
+	m.handleHealthAdvisory(buf.Bytes()[1:], nil)
+	if m.broadcasts.NumQueued() != 0 {
+		t.Fatalf("should not pass the advisory on again")
+	}
+}
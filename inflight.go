@@ -0,0 +1,89 @@
+package memberlist
+
+import (
+	"sync"
+	"time"
+)
+
+// inflightKind is a type of operation that Shutdown waits on.
+type inflightKind int
+
+const (
+	inflightProbe inflightKind = iota
+	inflightPushPull
+	inflightStream
+	numInflightKinds
+)
+
+// ShutdownStats describes the operations that were still running when
+// Shutdown stopped waiting for them. A zero value means everything finished
+// cleanly.
+type ShutdownStats struct {
+	Probes    int // Probes and pings of other nodes
+	PushPulls int // Push/pull syncs we initiated, including joins
+	Streams   int // Incoming TCP streams still being handled
+}
+
+// Abandoned returns the total number of operations left running.
+func (s ShutdownStats) Abandoned() int {
+	return s.Probes + s.PushPulls + s.Streams
+}
+
+// inflight counts the operations that are currently running so Shutdown can
+// wait for them to drain.
+type inflight struct {
+	lock   sync.Mutex
+	counts [numInflightKinds]int
+	total  int
+
+	// idleCh is closed when the total drops to zero, if anyone is waiting.
+	idleCh chan struct{}
+}
+
+// start records the beginning of an operation. Every call must be paired
+// with a call to done.
+func (i *inflight) start(kind inflightKind) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.counts[kind]++
+	i.total++
+}
+
+// done records the end of an operation.
+func (i *inflight) done(kind inflightKind) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.counts[kind]--
+	i.total--
+	if i.total == 0 && i.idleCh != nil {
+		close(i.idleCh)
+		i.idleCh = nil
+	}
+}
+
+// wait blocks until there are no operations running or the timeout expires,
+// and returns the operations that are still running.
+func (i *inflight) wait(timeout time.Duration) ShutdownStats {
+	i.lock.Lock()
+	if i.total > 0 && timeout > 0 {
+		if i.idleCh == nil {
+			i.idleCh = make(chan struct{})
+		}
+		idleCh := i.idleCh
+		i.lock.Unlock()
+
+		select {
+		case <-idleCh:
+		case <-time.After(timeout):
+		}
+
+		i.lock.Lock()
+	}
+	defer i.lock.Unlock()
+
+	return ShutdownStats{
+		Probes:    i.counts[inflightProbe],
+		PushPulls: i.counts[inflightPushPull],
+		Streams:   i.counts[inflightStream],
+	}
+}
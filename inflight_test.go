@@ -0,0 +1,114 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestInflight_Wait(t *testing.T) {
+	var i inflight
+
+	// Nothing running shouldn't wait at all.
+	if stats := i.wait(time.Hour); stats.Abandoned() != 0 {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	i.start(inflightProbe)
+	i.start(inflightStream)
+	i.start(inflightStream)
+	if stats := i.wait(10 * time.Millisecond); stats != (ShutdownStats{Probes: 1, Streams: 2}) {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		i.done(inflightProbe)
+		i.done(inflightStream)
+		i.done(inflightStream)
+	}()
+	start := time.Now()
+	if stats := i.wait(time.Second); stats.Abandoned() != 0 {
+		t.Fatalf("bad: %v", stats)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("should have returned once idle")
+	}
+}
+
+func TestMemberlist_ShutdownWithTimeout(t *testing.T) {
+	m := GetMemberlist(t)
+
+	// Open a stream and leave it idle so its handler stays busy.
+	addr := net.JoinHostPort(m.config.BindAddr, strconv.Itoa(m.config.BindPort))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	stats, err := m.ShutdownWithTimeout(50 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Streams != 1 || stats.Abandoned() != 1 {
+		t.Fatalf("bad: %v", stats)
+	}
+
+	// Later calls report the same thing.
+	stats, err = m.ShutdownWithTimeout(time.Second)
+	if err != nil || stats.Streams != 1 {
+		t.Fatalf("bad: %v %v", stats, err)
+	}
+}
+
+func TestMemberlist_Shutdown_NoWait(t *testing.T) {
+	m := GetMemberlist(t)
+
+	// By default, an idle stream doesn't hold up Shutdown.
+	addr := net.JoinHostPort(m.config.BindAddr, strconv.Itoa(m.config.BindPort))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	time.Sleep(20 * time.Millisecond)
+
+	start := time.Now()
+	if err := m.Shutdown(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("should not have waited")
+	}
+	if stats, _ := m.ShutdownWithTimeout(0); stats.Streams != 1 {
+		t.Fatalf("bad: %v", stats)
+	}
+}
+
+func TestMemberlist_Shutdown_Drained(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+
+	m2 := GetMemberlist(t)
+	m2.setAlive()
+	m2.schedule()
+	defer m2.Shutdown()
+
+	addr := fmt.Sprintf("%s:%d", m2.config.BindAddr, m2.config.BindPort)
+	if _, err := m1.Join([]string{addr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stats, err := m1.ShutdownWithTimeout(time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if stats.Abandoned() != 0 {
+		t.Fatalf("bad: %v", stats)
+	}
+}
@@ -0,0 +1,162 @@
+//go:build interop
+// +build interop
+
+package memberlist
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+These tests gossip with a reference node written in another language, to
+keep the protocol honest as it changes. They only build with the interop
+tag, and need docker and an image of the reference node:
+
+	INTEROP_IMAGE=example/swim-reference make interop
+
+The image runs a single node on the host network, configured through the
+environment:
+
+	MEMBERLIST_NAME       the node's name
+	MEMBERLIST_BIND_ADDR  the address to listen on, for UDP and TCP
+	MEMBERLIST_BIND_PORT  the port to listen on
+	MEMBERLIST_JOIN       the address of a node to join, host:port
+	MEMBERLIST_PROTOCOL   the protocol version to speak
+
+It should join, answer probes and push/pull, and gossip what it learns
+until it's stopped, when it should leave. INTEROP_PROTOCOL picks the
+protocol version for both sides, and defaults to the newest.
+*/
+
+const (
+	interopAddr    = "127.0.0.1"
+	interopPort    = 17946
+	interopRefPort = 17947
+	interopRefName = "reference"
+)
+
+// interopImage returns the reference image, skipping the test without one.
+func interopImage(t *testing.T) string {
+	image := os.Getenv("INTEROP_IMAGE")
+	if image == "" {
+		t.Skip("INTEROP_IMAGE is not set")
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("docker is not installed")
+	}
+	return image
+}
+
+// interopProtocol returns the protocol version to test.
+func interopProtocol(t *testing.T) uint8 {
+	v := os.Getenv("INTEROP_PROTOCOL")
+	if v == "" {
+		return ProtocolVersionMax
+	}
+	var p uint8
+	if _, err := fmt.Sscanf(v, "%d", &p); err != nil || p < ProtocolVersionMin || p > ProtocolVersionMax {
+		t.Fatalf("bad INTEROP_PROTOCOL: %q", v)
+	}
+	return p
+}
+
+// startReference runs the reference node, joining the given port, and
+// returns a function that stops it.
+func startReference(t *testing.T, image string, protocol uint8, join int) func() {
+	args := []string{"run", "--rm", "-d", "--network", "host",
+		"-e", "MEMBERLIST_NAME=" + interopRefName,
+		"-e", "MEMBERLIST_BIND_ADDR=" + interopAddr,
+		"-e", fmt.Sprintf("MEMBERLIST_BIND_PORT=%d", interopRefPort),
+		"-e", fmt.Sprintf("MEMBERLIST_JOIN=%s:%d", interopAddr, join),
+		"-e", fmt.Sprintf("MEMBERLIST_PROTOCOL=%d", protocol),
+		image,
+	}
+	out, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("failed to start reference node: %v: %s", err, out)
+	}
+	id := strings.TrimSpace(string(out))
+
+	stopped := false
+	stop := func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		if out, err := exec.Command("docker", "stop", id).CombinedOutput(); err != nil {
+			t.Logf("failed to stop reference node: %v: %s", err, out)
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func interopConfig(name string, port int, protocol uint8) *Config {
+	c := DefaultLANConfig()
+	c.Name = name
+	c.BindAddr = interopAddr
+	c.BindPort = port
+	c.ProtocolVersion = protocol
+	c.ProbeInterval = 200 * time.Millisecond
+	c.GossipInterval = 50 * time.Millisecond
+	c.PushPullInterval = time.Second
+	return c
+}
+
+// waitStatus waits for a node to reach the given status.
+func waitStatus(t *testing.T, m *Memberlist, name string, status NodeStatus, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if s, ok := m.MemberStatus(name); ok && s == status {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	s, ok := m.MemberStatus(name)
+	t.Fatalf("%s didn't become %v: %v %v", name, status, s, ok)
+}
+
+func TestInterop_Reference(t *testing.T) {
+	image := interopImage(t)
+	protocol := interopProtocol(t)
+
+	m1, err := Create(interopConfig("go-1", interopPort, protocol))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	// The reference node joins us.
+	stop := startReference(t, image, protocol, interopPort)
+	waitStatus(t, m1, interopRefName, StatusAlive, 30*time.Second)
+
+	for _, n := range m1.Members() {
+		if n.Name == interopRefName && (protocol < n.PMin || protocol > n.PMax) {
+			t.Fatalf("reference doesn't speak protocol %d: %d-%d", protocol, n.PMin, n.PMax)
+		}
+	}
+
+	// A node that only knows the reference learns about us through it,
+	// which needs push/pull in both directions.
+	m2, err := Create(interopConfig("go-2", interopPort+2, protocol))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m2.Join([]string{fmt.Sprintf("%s:%d", interopAddr, interopRefPort)}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitStatus(t, m2, "go-1", StatusAlive, 30*time.Second)
+	waitStatus(t, m1, "go-2", StatusAlive, 30*time.Second)
+
+	// Stopping the reference is seen by both, through its leave or by
+	// probing.
+	stop()
+	waitStatus(t, m1, interopRefName, StatusDead, time.Minute)
+	waitStatus(t, m2, interopRefName, StatusDead, time.Minute)
+}
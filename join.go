@@ -0,0 +1,276 @@
+package memberlist
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// JoinClass says how an attempt to join through one address turned out.
+type JoinClass int
+
+const (
+	// JoinSkipped means the address wasn't tried, because
+	// JoinOptions.StopOnSuccess was set and another address was joined
+	// first.
+	JoinSkipped JoinClass = iota
+
+	// JoinSuccess means the push/pull with the address completed.
+	JoinSuccess
+
+	// JoinResolveFailed means the host couldn't be resolved to any
+	// address.
+	JoinResolveFailed
+
+	// JoinUnreachable means the address couldn't be reached or stopped
+	// responding. These failures are retried.
+	JoinUnreachable
+
+	// JoinRejected means the remote node answered but the exchange failed,
+	// for example because of an encryption mismatch or because the merge
+	// was cancelled by a MergeDelegate. These failures are not retried.
+	JoinRejected
+
+	// JoinCanceled means memberlist was shut down during the attempt.
+	JoinCanceled
+
+	// JoinThrottled means the remote node had too many nodes joining
+	// through it and told us to come back later. These failures are
+	// retried after the time it asked for.
+	JoinThrottled
+)
+
+func (c JoinClass) String() string {
+	switch c {
+	case JoinSkipped:
+		return "skipped"
+	case JoinSuccess:
+		return "success"
+	case JoinResolveFailed:
+		return "resolve-failed"
+	case JoinUnreachable:
+		return "unreachable"
+	case JoinRejected:
+		return "rejected"
+	case JoinCanceled:
+		return "canceled"
+	case JoinThrottled:
+		return "throttled"
+	default:
+		return "unknown"
+	}
+}
+
+// JoinOptions tunes how JoinWithOptions contacts the given hosts. The
+// zero value contacts each address once, one at a time, like Join.
+type JoinOptions struct {
+	// Retries is how many more times an unreachable or throttled address
+	// is tried before giving up on it, waiting RetryInterval between
+	// attempts, or longer if a throttled address asked us to.
+	Retries       int
+	RetryInterval time.Duration
+
+	// MaxParallel is how many addresses may be contacted at once. Zero or
+	// one contacts them one at a time, in the order given.
+	MaxParallel int
+
+	// StopOnSuccess stops contacting further addresses once one has been
+	// joined. Attempts already under way are allowed to finish.
+	StopOnSuccess bool
+}
+
+// JoinResult describes the attempt to join through a single address.
+type JoinResult struct {
+	// Host is the host as it was given to Join, or the node name for a
+	// peer taken from the peer cache.
+	Host string
+
+	// Addr and Port are the address that was contacted. Addr is nil if
+	// the host couldn't be resolved.
+	Addr net.IP
+	Port uint16
+
+	Class JoinClass
+
+	// Err is the reason the last attempt failed, usually a
+	// *JoinHostError, or nil.
+	Err error
+
+	// Attempts is how many times the address was tried, and Latency is
+	// how long the last attempt took.
+	Attempts int
+	Latency  time.Duration
+}
+
+// JoinWithOptions is like Join, but reports the outcome for every address
+// it tried and lets the caller choose how the addresses are retried and
+// how many are contacted at once. The peer cache is used as a fallback in
+// the same way, and its peers are included in the results.
+//
+// The returned error is ErrShutdown if memberlist has been shut down, a
+// *JoinError if no address could be joined, and nil otherwise. The
+// results are returned in either case.
+func (m *Memberlist) JoinWithOptions(existing []string, opts JoinOptions) ([]JoinResult, error) {
+	select {
+	case <-m.shutdownCh:
+		return nil, ErrShutdown
+	default:
+	}
+
+	var results []JoinResult
+	for _, exist := range existing {
+		addrs, err := m.resolveAddr(exist)
+		if err != nil {
+			err = &JoinHostError{Host: exist, Op: "resolve", Err: err}
+			m.logger.Printf("[WARN] memberlist: %v", err)
+			results = append(results, JoinResult{Host: exist, Class: JoinResolveFailed, Err: err})
+			continue
+		}
+		for _, addr := range addrs {
+			results = append(results, JoinResult{Host: exist, Addr: addr.ip, Port: addr.port})
+		}
+	}
+	m.joinAddrs(results, opts)
+
+	if joinedCount(results) == 0 && m.peers != nil {
+		results = append(results, m.joinPeerCache()...)
+	}
+
+	if joinedCount(results) > 0 {
+		m.nodeLock.Lock()
+		m.advanceLifecycle(StateJoined)
+		m.nodeLock.Unlock()
+		m.savePeerCache()
+		return results, nil
+	}
+
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, r.Err)
+		}
+	}
+	if len(errs) > 0 {
+		return results, &JoinError{Errors: errs}
+	}
+	return results, nil
+}
+
+// joinAddrs contacts each resolved address in results, filling in the
+// outcome of each.
+func (m *Memberlist) joinAddrs(results []JoinResult, opts JoinOptions) {
+	parallel := opts.MaxParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var (
+		wg     sync.WaitGroup
+		sem    = make(chan struct{}, parallel)
+		joined int32
+	)
+	for i := range results {
+		if results[i].Addr == nil {
+			continue
+		}
+
+		sem <- struct{}{}
+		if opts.StopOnSuccess && atomic.LoadInt32(&joined) == 1 {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(r *JoinResult) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			m.joinAddr(r, opts)
+			if r.Class == JoinSuccess {
+				atomic.StoreInt32(&joined, 1)
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+}
+
+// joinAddr does a push/pull with a single address, retrying it according
+// to the options.
+func (m *Memberlist) joinAddr(r *JoinResult, opts JoinOptions) {
+	if err := m.learnPassphrase(r.Addr, r.Port); err != nil {
+		m.logger.Printf("[WARN] memberlist: Failed to learn passphrase parameters from %s: %v", r.Addr, err)
+	}
+	for {
+		r.Attempts++
+		start := time.Now()
+		err := m.pushPullNode(r.Addr, r.Port, true)
+		r.Latency = time.Since(start)
+		if err == nil {
+			r.Class, r.Err = JoinSuccess, nil
+			return
+		}
+
+		r.Class = m.classifyJoinError(err)
+		r.Err = &JoinHostError{Host: r.Addr.String(), Op: "join", Err: err}
+		m.logger.Printf("[DEBUG] memberlist: %v", r.Err)
+		if (r.Class != JoinUnreachable && r.Class != JoinThrottled) || r.Attempts > opts.Retries {
+			return
+		}
+
+		// Come back when we were asked to, give or take, so that the nodes
+		// turned away together don't all come back together.
+		wait := opts.RetryInterval
+		var rej *MergeRejection
+		if r.Class == JoinThrottled && errors.As(err, &rej) {
+			backoff := rej.RetryAfter + time.Duration(rand.Int63n(int64(rej.RetryAfter)+1))
+			if backoff > wait {
+				wait = backoff
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-m.shutdownCh:
+			r.Class = JoinCanceled
+			return
+		}
+	}
+}
+
+// classifyJoinError sorts a push/pull error into a JoinClass. Once we've
+// been shut down, whatever the error, the join was cancelled; closing the
+// transport under a push/pull otherwise looks like a network failure.
+func (m *Memberlist) classifyJoinError(err error) JoinClass {
+	select {
+	case <-m.shutdownCh:
+		return JoinCanceled
+	default:
+	}
+
+	var netErr net.Error
+	var rej *MergeRejection
+	switch {
+	case errors.Is(err, ErrShutdown):
+		return JoinCanceled
+	case errors.As(err, &netErr):
+		return JoinUnreachable
+	case errors.As(err, &rej) && rej.RetryAfter > 0:
+		return JoinThrottled
+	default:
+		return JoinRejected
+	}
+}
+
+// joinedCount returns the number of results that joined successfully.
+func joinedCount(results []JoinResult) int {
+	n := 0
+	for _, r := range results {
+		if r.Class == JoinSuccess {
+			n++
+		}
+	}
+	return n
+}
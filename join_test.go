@@ -0,0 +1,136 @@
+package memberlist
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func joinTestNode(t *testing.T) (*Memberlist, string) {
+	m := GetMemberlist(t)
+	m.setAlive()
+	m.schedule()
+	return m, fmt.Sprintf("%s:%d", m.config.BindAddr, m.config.BindPort)
+}
+
+func joinTestClient(t *testing.T) *Memberlist {
+	c := testConfig()
+	c.BindPort = 0
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	return m
+}
+
+func TestMemberlist_JoinWithOptions(t *testing.T) {
+	m1, addr1 := joinTestNode(t)
+	defer m1.Shutdown()
+	m2, addr2 := joinTestNode(t)
+	defer m2.Shutdown()
+
+	m3 := joinTestClient(t)
+	defer m3.Shutdown()
+
+	results, err := m3.JoinWithOptions([]string{addr1, addr2}, JoinOptions{MaxParallel: 2})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("bad: %v", results)
+	}
+	for i, addr := range []string{addr1, addr2} {
+		r := results[i]
+		if r.Host != addr || r.Class != JoinSuccess || r.Err != nil || r.Attempts != 1 {
+			t.Fatalf("bad: %#v", r)
+		}
+		if r.Latency <= 0 {
+			t.Fatalf("latency should be measured")
+		}
+	}
+	if m3.NumMembers() != 3 {
+		t.Fatalf("should have 3 nodes! %v", m3.Members())
+	}
+	if m3.State() != StateJoined {
+		t.Fatalf("bad: %v", m3.State())
+	}
+}
+
+func TestMemberlist_JoinWithOptions_StopOnSuccess(t *testing.T) {
+	m1, addr1 := joinTestNode(t)
+	defer m1.Shutdown()
+	m2, addr2 := joinTestNode(t)
+	defer m2.Shutdown()
+
+	m3 := joinTestClient(t)
+	defer m3.Shutdown()
+
+	results, err := m3.JoinWithOptions([]string{addr1, addr2}, JoinOptions{StopOnSuccess: true})
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if results[0].Class != JoinSuccess {
+		t.Fatalf("bad: %#v", results[0])
+	}
+	if results[1].Class != JoinSkipped || results[1].Attempts != 0 {
+		t.Fatalf("bad: %#v", results[1])
+	}
+}
+
+func TestMemberlist_JoinWithOptions_Retry(t *testing.T) {
+	m1, addr := joinTestNode(t)
+	m1.Shutdown()
+
+	m2 := joinTestClient(t)
+	defer m2.Shutdown()
+
+	opts := JoinOptions{Retries: 2, RetryInterval: 10 * time.Millisecond}
+	results, err := m2.JoinWithOptions([]string{addr, "127.0.0.1:notaport"}, opts)
+	if err == nil {
+		t.Fatalf("should fail")
+	}
+	if len(results) != 2 {
+		t.Fatalf("bad: %v", results)
+	}
+	if r := results[0]; r.Class != JoinUnreachable || r.Attempts != 3 || r.Err == nil {
+		t.Fatalf("bad: %#v", r)
+	}
+	if r := results[1]; r.Class != JoinResolveFailed || r.Attempts != 0 || r.Addr != nil {
+		t.Fatalf("bad: %#v", r)
+	}
+	if m2.State() != StateCreated {
+		t.Fatalf("bad: %v", m2.State())
+	}
+}
+
+func TestMemberlist_ClassifyJoinError(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	cases := []struct {
+		err   error
+		class JoinClass
+	}{
+		{ErrShutdown, JoinCanceled},
+		{&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, JoinUnreachable},
+		{ErrRemoteNotEncrypted, JoinRejected},
+		{io.EOF, JoinRejected},
+		{&MergeRejection{Reason: "no"}, JoinRejected},
+		{&MergeRejection{Reason: "busy", RetryAfter: time.Second}, JoinThrottled},
+	}
+	for _, c := range cases {
+		if class := m.classifyJoinError(c.err); class != c.class {
+			t.Errorf("%v: got %v, want %v", c.err, class, c.class)
+		}
+	}
+
+	// A network error from a push/pull cut short by shutdown isn't worth
+	// retrying.
+	m.Shutdown()
+	err := &net.OpError{Op: "read", Err: fmt.Errorf("use of closed network connection")}
+	if class := m.classifyJoinError(err); class != JoinCanceled {
+		t.Errorf("got %v, want %v", class, JoinCanceled)
+	}
+}
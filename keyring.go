@@ -2,6 +2,8 @@ package memberlist
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"sync"
 )
@@ -15,6 +17,27 @@ type Keyring struct {
 
 	// The keyring lock is used while performing IO operations on the keyring.
 	l sync.Mutex
+
+	// watcher, if set, is told about keys being installed, promoted and
+	// removed.
+	watcher func(event AuditEvent, key []byte)
+}
+
+// watch sets the function told about changes to the keys.
+func (k *Keyring) watch(fn func(event AuditEvent, key []byte)) {
+	k.l.Lock()
+	defer k.l.Unlock()
+	k.watcher = fn
+}
+
+// notify tells the watcher about a change to the keys.
+func (k *Keyring) notify(event AuditEvent, key []byte) {
+	k.l.Lock()
+	fn := k.watcher
+	k.l.Unlock()
+	if fn != nil {
+		fn(event, key)
+	}
 }
 
 // Init allocates substructures
@@ -58,6 +81,15 @@ func NewKeyring(keys [][]byte, primaryKey []byte) (*Keyring, error) {
 	return keyring, nil
 }
 
+// KeyID returns a short identifier for the given key, which is safe to log
+// and use in metrics. It's derived from a hash of the key, so it doesn't
+// reveal the key itself, but operators holding the key can compute it to
+// see which key is in use.
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
 // ValidateKey will check to see if the key is valid and returns an error if not.
 //
 // key should be either 16, 24, or 32 bytes to select AES-128,
@@ -93,6 +125,7 @@ func (k *Keyring) AddKey(key []byte) error {
 		primaryKey = key
 	}
 	k.installKeys(keys, primaryKey)
+	k.notify(AuditKeyInstall, key)
 	return nil
 }
 
@@ -102,6 +135,7 @@ func (k *Keyring) UseKey(key []byte) error {
 	for _, installedKey := range k.keys {
 		if bytes.Equal(key, installedKey) {
 			k.installKeys(k.keys, key)
+			k.notify(AuditKeyUse, key)
 			return nil
 		}
 	}
@@ -118,6 +152,7 @@ func (k *Keyring) RemoveKey(key []byte) error {
 		if bytes.Equal(key, installedKey) {
 			keys := append(k.keys[:i], k.keys[i+1:]...)
 			k.installKeys(keys, k.keys[0])
+			k.notify(AuditKeyRemove, key)
 		}
 	}
 	return nil
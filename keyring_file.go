@@ -0,0 +1,172 @@
+package memberlist
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+/*
+Keyring files hold the keys of a keyring encrypted under a passphrase, so
+they can be kept on disk without exposing the keys themselves. The format is:
+
+  [version byte][salt (16 bytes)][nonce (12 bytes)][ciphertext + tag]
+
+The file key is derived from the passphrase and salt with scrypt in version
+1, or with PBKDF2-HMAC-SHA256 in version 2, which is written instead when
+FIPS mode is in force since scrypt isn't an approved algorithm. The keys
+are sealed with AES-256-GCM, using the version and salt as additional
+data. The plaintext is a JSON list of the keys, primary key first.
+*/
+
+const (
+	keyringFileVersion     = 1
+	keyringFileVersionFIPS = 2
+	keyringSaltSize        = 16
+	keyringNonceSize       = 12
+	keyringHeaderSize      = 1 + keyringSaltSize + keyringNonceSize
+
+	// scrypt parameters, as recommended for interactive logins as of 2017.
+	keyringScryptN = 32768
+	keyringScryptR = 8
+	keyringScryptP = 1
+
+	// PBKDF2 iterations, as recommended for HMAC-SHA256 as of 2023, and
+	// the shortest passphrase FIPS allows.
+	keyringPBKDF2Iter    = 600000
+	keyringFIPSMinPhrase = 14
+)
+
+// Save writes the keys on the ring to the given path, encrypted with a key
+// derived from the passphrase. The file is written atomically and is only
+// readable by the owner. Use LoadKeyring to read it back.
+func (k *Keyring) Save(path string, passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return fmt.Errorf("Empty passphrase not allowed")
+	}
+	version := byte(keyringFileVersion)
+	if fipsEnforced() {
+		if len(passphrase) < keyringFIPSMinPhrase {
+			return fmt.Errorf("Passphrase must be at least %d bytes in FIPS mode", keyringFIPSMinPhrase)
+		}
+		version = keyringFileVersionFIPS
+	}
+
+	keys := k.GetKeys()
+	if len(keys) == 0 {
+		return fmt.Errorf("No keys to save")
+	}
+	plain, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, keyringHeaderSize)
+	header[0] = version
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return err
+	}
+	salt := header[1 : 1+keyringSaltSize]
+	nonce := header[1+keyringSaltSize:]
+
+	gcm, err := keyringFileCipher(version, passphrase, salt)
+	if err != nil {
+		return err
+	}
+	out := gcm.Seal(header, nonce, plain, header[:1+keyringSaltSize])
+
+	// Write to a temporary file and rename it into place so we never leave
+	// a truncated keyring behind.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(out); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadKeyring reads a keyring written by Keyring.Save, decrypting it with the
+// given passphrase. The first key in the file becomes the primary key.
+func LoadKeyring(path string, passphrase []byte) (*Keyring, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < keyringHeaderSize {
+		return nil, fmt.Errorf("Keyring file is truncated")
+	}
+	version := buf[0]
+	switch {
+	case version == keyringFileVersion && fipsEnforced():
+		return nil, fmt.Errorf("Keyring file uses scrypt, which isn't allowed in FIPS mode; save it again in FIPS mode")
+	case version == keyringFileVersionFIPS && fipsEnforced() && len(passphrase) < keyringFIPSMinPhrase:
+		return nil, fmt.Errorf("Passphrase must be at least %d bytes in FIPS mode", keyringFIPSMinPhrase)
+	case version != keyringFileVersion && version != keyringFileVersionFIPS:
+		return nil, fmt.Errorf("Unsupported keyring file version %d", version)
+	}
+	salt := buf[1 : 1+keyringSaltSize]
+	nonce := buf[1+keyringSaltSize : keyringHeaderSize]
+
+	gcm, err := keyringFileCipher(version, passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := gcm.Open(nil, nonce, buf[keyringHeaderSize:], buf[:1+keyringSaltSize])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt keyring file, wrong passphrase?")
+	}
+
+	var keys [][]byte
+	if err := json.Unmarshal(plain, &keys); err != nil {
+		return nil, fmt.Errorf("Failed to decode keyring file: %v", err)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Keyring file has no keys")
+	}
+	return NewKeyring(keys, keys[0])
+}
+
+// keyringFileCipher derives the file key from the passphrase and salt as
+// the file version says and returns an AES-GCM cipher using it.
+func keyringFileCipher(version byte, passphrase, salt []byte) (cipher.AEAD, error) {
+	var key []byte
+	if version == keyringFileVersionFIPS {
+		key = pbkdf2.Key(passphrase, salt, keyringPBKDF2Iter, 32, sha256.New)
+	} else {
+		var err error
+		key, err = scrypt.Key(passphrase, salt, keyringScryptN, keyringScryptR, keyringScryptP, 32)
+		if err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,115 @@
+package memberlist
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyring_SaveLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memberlist")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring")
+
+	keyring, err := NewKeyring(TestKeys, TestKeys[1])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	passphrase := []byte("correct horse battery staple")
+	if err := keyring.Save(path, passphrase); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The keys shouldn't be readable on disk.
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, key := range TestKeys {
+		if bytes.Contains(raw, key) {
+			t.Fatalf("key stored in plaintext")
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("bad: %v", fi.Mode())
+	}
+
+	loaded, err := LoadKeyring(path, passphrase)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(loaded.GetPrimaryKey(), TestKeys[1]) {
+		t.Fatalf("bad primary key")
+	}
+	if len(loaded.GetKeys()) != len(TestKeys) {
+		t.Fatalf("bad: %v", loaded.GetKeys())
+	}
+
+	if _, err := LoadKeyring(path, []byte("wrong")); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Tampering with the header should be detected.
+	raw[1] ^= 0xff
+	if err := ioutil.WriteFile(path, raw, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := LoadKeyring(path, passphrase); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestKeyring_Save_Invalid(t *testing.T) {
+	keyring, err := NewKeyring(nil, TestKeys[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := keyring.Save("unused", nil); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	empty, err := NewKeyring(nil, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := empty.Save("unused", []byte("pass")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestKeyring_FileCipher_Versions(t *testing.T) {
+	passphrase := []byte("correct horse battery staple")
+	salt := bytes.Repeat([]byte{1}, keyringSaltSize)
+	nonce := make([]byte, 12)
+
+	fips, err := keyringFileCipher(keyringFileVersionFIPS, passphrase, salt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sealed := fips.Seal(nil, nonce, []byte("keys"), nil)
+	out, err := fips.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "keys" {
+		t.Fatalf("bad: %q", out)
+	}
+
+	// The versions must derive different keys.
+	plain, err := keyringFileCipher(keyringFileVersion, passphrase, salt)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := plain.Open(nil, nonce, sealed, nil); err == nil {
+		t.Fatalf("expected scrypt key to fail on a PBKDF2 file")
+	}
+}
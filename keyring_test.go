@@ -152,3 +152,42 @@ func TestKeyRing_MultiKeyEncryptDecrypt(t *testing.T) {
 		t.Fatalf("Expected no keys to decrypt message")
 	}
 }
+
+func TestKeyRing_DecryptIndex(t *testing.T) {
+	plaintext := []byte("this is a plain text message")
+	extra := []byte("random data")
+
+	var buf bytes.Buffer
+	if err := encryptPayload(1, TestKeys[2], plaintext, extra, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	msg, idx, err := decryptPayloadIndex(TestKeys, buf.Bytes(), extra)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 2 || !bytes.Equal(msg, plaintext) {
+		t.Fatalf("bad: %d %v", idx, msg)
+	}
+
+	if _, idx, err = decryptPayloadIndex(TestKeys[:2], buf.Bytes(), extra); err == nil || idx != -1 {
+		t.Fatalf("bad: %d %v", idx, err)
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	ids := make(map[string]bool)
+	for _, key := range TestKeys {
+		id := KeyID(key)
+		if len(id) != 8 {
+			t.Fatalf("bad: %s", id)
+		}
+		if id != KeyID(key) {
+			t.Fatalf("should be deterministic")
+		}
+		if ids[id] {
+			t.Fatalf("duplicate id %s", id)
+		}
+		ids[id] = true
+	}
+}
@@ -0,0 +1,211 @@
+package kubernetes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// watchRetryInterval is how long WatchSeeds waits before reopening a
+	// watch that failed or was closed by the API server.
+	watchRetryInterval = 5 * time.Second
+)
+
+// Client is a minimal client for the Kubernetes API, enough to read the
+// endpoints of a service. The service account needs get and watch access
+// to endpoints in the namespace.
+type Client struct {
+	// Host is the base URL of the API server, like https://10.0.0.1:443.
+	Host string
+
+	// Token is the bearer token sent with each request, if any.
+	Token string
+
+	// HTTPClient is used for requests. It must trust the API server's
+	// certificate.
+	HTTPClient *http.Client
+}
+
+// InClusterClient returns a client using the service account that
+// Kubernetes mounts into every pod.
+func InClusterClient() (*Client, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("Not running in a Kubernetes cluster")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("Failed to parse the service account CA certificate")
+	}
+
+	return &Client{
+		Host:  "https://" + net.JoinHostPort(host, port),
+		Token: strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		},
+	}, nil
+}
+
+// endpoints is the part of a v1 Endpoints object we care about.
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Name string `json:"name"`
+			Port int    `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+// watchEvent is a single event from a watch on endpoints.
+type watchEvent struct {
+	Type   string    `json:"type"`
+	Object endpoints `json:"object"`
+}
+
+// seeds returns the ready addresses of the endpoints as host:port strings
+// for memberlist.Join. If portName is set only that port is used, otherwise
+// the first port of each subset.
+func (e *endpoints) seeds(portName string) []string {
+	var out []string
+	for _, subset := range e.Subsets {
+		port := 0
+		for _, p := range subset.Ports {
+			if portName == "" || p.Name == portName {
+				port = p.Port
+				break
+			}
+		}
+		if port == 0 {
+			continue
+		}
+		for _, addr := range subset.Addresses {
+			out = append(out, net.JoinHostPort(addr.IP, strconv.Itoa(port)))
+		}
+	}
+	return out
+}
+
+// get issues a GET against the API server.
+func (c *Client) get(path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", c.Host+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("Kubernetes API returned %s for %s", resp.Status, path)
+	}
+	return resp, nil
+}
+
+// endpointsPath is the API path of the endpoints in a namespace.
+func endpointsPath(namespace string) string {
+	return "/api/v1/namespaces/" + url.PathEscape(namespace) + "/endpoints"
+}
+
+// Seeds returns the addresses of the ready endpoints of a service, suitable
+// for passing to memberlist.Join. A headless service selecting the
+// memberlist pods is the usual choice. See endpoints.seeds for portName.
+func (c *Client) Seeds(namespace, service, portName string) ([]string, error) {
+	resp, err := c.get(endpointsPath(namespace)+"/"+url.PathEscape(service), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ep endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&ep); err != nil {
+		return nil, fmt.Errorf("Failed to decode endpoints: %v", err)
+	}
+	return ep.seeds(portName), nil
+}
+
+// WatchSeeds watches the endpoints of a service and calls fn with the full
+// set of seeds every time they change, until stopCh is closed. Failed or
+// expired watches are reopened after a short wait. fn is called from a
+// single goroutine, so calls never overlap.
+func (c *Client) WatchSeeds(namespace, service, portName string, stopCh <-chan struct{}, fn func([]string)) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("fieldSelector", "metadata.name="+service)
+
+	for {
+		resp, err := c.get(endpointsPath(namespace), query)
+		if err == nil {
+			c.readWatch(resp, portName, stopCh, fn)
+		}
+
+		select {
+		case <-stopCh:
+			return
+		case <-time.After(watchRetryInterval):
+		}
+	}
+}
+
+// readWatch delivers events from a watch response until it ends or stopCh
+// is closed.
+func (c *Client) readWatch(resp *http.Response, portName string, stopCh <-chan struct{}, fn func([]string)) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		// Closing the body is the only way to unblock the decoder.
+		select {
+		case <-stopCh:
+		case <-done:
+		}
+		resp.Body.Close()
+	}()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var event watchEvent
+		if err := dec.Decode(&event); err != nil {
+			return
+		}
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			fn(event.Object.seeds(portName))
+		case "DELETED":
+			fn(nil)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testEndpoints = `{
+  "kind": "Endpoints",
+  "metadata": {"name": "cache"},
+  "subsets": [{
+    "addresses": [{"ip": "10.1.0.1"}, {"ip": "10.1.0.2"}],
+    "notReadyAddresses": [{"ip": "10.1.0.3"}],
+    "ports": [{"name": "http", "port": 8080}, {"name": "memberlist", "port": 7946}]
+  }]
+}`
+
+func TestClient_Seeds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/default/endpoints/cache" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, testEndpoints)
+	}))
+	defer server.Close()
+
+	c := &Client{Host: server.URL, Token: "secret"}
+	seeds, err := c.Seeds("default", "cache", "memberlist")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected := []string{"10.1.0.1:7946", "10.1.0.2:7946"}
+	if !reflect.DeepEqual(seeds, expected) {
+		t.Fatalf("bad seeds: %v", seeds)
+	}
+
+	// Without a port name the first port is used.
+	seeds, err = c.Seeds("default", "cache", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expected = []string{"10.1.0.1:8080", "10.1.0.2:8080"}
+	if !reflect.DeepEqual(seeds, expected) {
+		t.Fatalf("bad seeds: %v", seeds)
+	}
+
+	if _, err := c.Seeds("default", "other", ""); err == nil {
+		t.Fatalf("expected error for a missing service")
+	}
+	c.Token = "wrong"
+	if _, err := c.Seeds("default", "cache", ""); err == nil {
+		t.Fatalf("expected error for a bad token")
+	}
+}
+
+func TestClient_WatchSeeds(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" ||
+			r.URL.Query().Get("fieldSelector") != "metadata.name=cache" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var obj json.RawMessage = []byte(testEndpoints)
+		enc := json.NewEncoder(w)
+		enc.Encode(map[string]interface{}{"type": "ADDED", "object": obj})
+		w.(http.Flusher).Flush()
+		enc.Encode(map[string]interface{}{"type": "DELETED", "object": obj})
+		w.(http.Flusher).Flush()
+
+		// Hold the watch open like the API server would.
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer server.Close()
+
+	c := &Client{Host: server.URL}
+	stopCh := make(chan struct{})
+	updates := make(chan []string, 4)
+	done := make(chan struct{})
+	go func() {
+		c.WatchSeeds("default", "cache", "memberlist", stopCh, func(seeds []string) {
+			updates <- seeds
+		})
+		close(done)
+	}()
+
+	select {
+	case seeds := <-updates:
+		if len(seeds) != 2 {
+			t.Fatalf("bad seeds: %v", seeds)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for update")
+	}
+	select {
+	case seeds := <-updates:
+		if len(seeds) != 0 {
+			t.Fatalf("bad seeds: %v", seeds)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for update")
+	}
+
+	close(stopCh)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("watch didn't stop")
+	}
+}
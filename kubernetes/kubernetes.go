@@ -0,0 +1,95 @@
+/*
+Package kubernetes wires memberlist up to Kubernetes without pulling in the
+Kubernetes client libraries.
+
+It covers the usual pieces of running a memberlist cluster as a set of pods:
+
+  - PodInfo reads the pod's name, namespace, IP and labels from the
+    downward API and uses them to fill in a memberlist.Config.
+
+  - Client talks to the API server from inside the cluster and turns the
+    endpoints of a (usually headless) service into join addresses, either
+    once with Seeds or continuously with WatchSeeds.
+
+  - Readiness is an http.Handler for a readiness probe that only reports
+    ready once the pod has joined the cluster.
+
+A typical pod spec exposes POD_NAME, POD_NAMESPACE and POD_IP as environment
+variables using fieldRef, and mounts the pod's labels with a downwardAPI
+volume at DefaultLabelsPath.
+*/
+package kubernetes
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hashicorp/memberlist"
+)
+
+const (
+	// EnvPodName, EnvPodNamespace and EnvPodIP are the environment variables
+	// PodInfoFromEnv reads. They should be set from metadata.name,
+	// metadata.namespace and status.podIP using the downward API.
+	EnvPodName      = "POD_NAME"
+	EnvPodNamespace = "POD_NAMESPACE"
+	EnvPodIP        = "POD_IP"
+
+	// DefaultLabelsPath is where PodInfoFromEnv looks for the pod's labels,
+	// as written by a downwardAPI volume for metadata.labels.
+	DefaultLabelsPath = "/etc/podinfo/labels"
+)
+
+// PodInfo describes the pod we're running in.
+type PodInfo struct {
+	Name      string
+	Namespace string
+	IP        string
+	Labels    map[string]string
+}
+
+// PodInfoFromEnv builds a PodInfo from the downward API environment variables
+// and, if present, the labels file at labelsPath. An empty labelsPath uses
+// DefaultLabelsPath. The pod IP is required; a missing labels file is not an
+// error.
+func PodInfoFromEnv(labelsPath string) (*PodInfo, error) {
+	p := &PodInfo{
+		Name:      os.Getenv(EnvPodName),
+		Namespace: os.Getenv(EnvPodNamespace),
+		IP:        os.Getenv(EnvPodIP),
+	}
+	if p.IP == "" {
+		return nil, fmt.Errorf("%s is not set, expose status.podIP through the downward API", EnvPodIP)
+	}
+
+	if labelsPath == "" {
+		labelsPath = DefaultLabelsPath
+	}
+	labels, err := ReadLabels(labelsPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	p.Labels = labels
+	return p, nil
+}
+
+// Configure applies the pod's details to a memberlist config. The pod IP
+// becomes the advertise address, since pods are reached by their IP rather
+// than whatever interface the process binds to, and the pod name becomes the
+// node name if there is one. If the config has no Delegate, one is installed
+// that publishes the given label keys as node metadata; see EncodeLabels.
+func (p *PodInfo) Configure(conf *memberlist.Config, metaKeys []string) error {
+	conf.AdvertiseAddr = p.IP
+	if p.Name != "" {
+		conf.Name = p.Name
+	}
+
+	if conf.Delegate == nil && len(metaKeys) > 0 {
+		meta, err := EncodeLabels(p.Labels, metaKeys, memberlist.MetaMaxSize)
+		if err != nil {
+			return err
+		}
+		conf.Delegate = &MetaDelegate{Meta: meta}
+	}
+	return nil
+}
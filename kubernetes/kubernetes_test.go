@@ -0,0 +1,93 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func TestPodInfoFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "podinfo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	labels := filepath.Join(dir, "labels")
+	if err := ioutil.WriteFile(labels, []byte("app=\"cache\"\nzone=\"us-east-1a\"\n"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	os.Setenv(EnvPodName, "cache-0")
+	os.Setenv(EnvPodNamespace, "default")
+	os.Setenv(EnvPodIP, "10.1.2.3")
+	defer os.Unsetenv(EnvPodName)
+	defer os.Unsetenv(EnvPodNamespace)
+	defer os.Unsetenv(EnvPodIP)
+
+	p, err := PodInfoFromEnv(labels)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if p.Name != "cache-0" || p.Namespace != "default" || p.IP != "10.1.2.3" {
+		t.Fatalf("bad: %#v", p)
+	}
+	if p.Labels["app"] != "cache" || p.Labels["zone"] != "us-east-1a" {
+		t.Fatalf("bad labels: %v", p.Labels)
+	}
+
+	// A missing labels file is fine.
+	p, err = PodInfoFromEnv(filepath.Join(dir, "missing"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(p.Labels) != 0 {
+		t.Fatalf("bad labels: %v", p.Labels)
+	}
+
+	// The pod IP is not.
+	os.Unsetenv(EnvPodIP)
+	if _, err := PodInfoFromEnv(labels); err == nil {
+		t.Fatalf("expected error without a pod IP")
+	}
+}
+
+func TestPodInfo_Configure(t *testing.T) {
+	p := &PodInfo{
+		Name:   "cache-0",
+		IP:     "10.1.2.3",
+		Labels: map[string]string{"app": "cache", "zone": "us-east-1a"},
+	}
+
+	conf := memberlist.DefaultLANConfig()
+	if err := p.Configure(conf, []string{"zone"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Name != "cache-0" || conf.AdvertiseAddr != "10.1.2.3" {
+		t.Fatalf("bad: %s %s", conf.Name, conf.AdvertiseAddr)
+	}
+	d, ok := conf.Delegate.(*MetaDelegate)
+	if !ok {
+		t.Fatalf("bad delegate: %#v", conf.Delegate)
+	}
+	labels, err := DecodeLabels(d.NodeMeta(memberlist.MetaMaxSize))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(labels) != 1 || labels["zone"] != "us-east-1a" {
+		t.Fatalf("bad labels: %v", labels)
+	}
+
+	// An existing delegate is left alone.
+	existing := &MetaDelegate{}
+	conf = memberlist.DefaultLANConfig()
+	conf.Delegate = existing
+	if err := p.Configure(conf, []string{"zone"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if conf.Delegate != existing {
+		t.Fatalf("delegate was replaced")
+	}
+}
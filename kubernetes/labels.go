@@ -0,0 +1,100 @@
+package kubernetes
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadLabels parses a labels file written by a downwardAPI volume. Each line
+// has the form key="value", with the value quoted Go-style.
+func ReadLabels(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	labels := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Malformed label line %q", line)
+		}
+		value, err := strconv.Unquote(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("Malformed label value %q: %v", line, err)
+		}
+		labels[parts[0]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// EncodeLabels picks the given keys out of the labels and encodes them as
+// node metadata, erroring if the result won't fit in limit bytes. Keys
+// without a label are left out. Use DecodeLabels to read them back from a
+// memberlist.Node.
+func EncodeLabels(labels map[string]string, keys []string, limit int) ([]byte, error) {
+	picked := make(map[string]string)
+	for _, k := range keys {
+		if v, ok := labels[k]; ok {
+			picked[k] = v
+		}
+	}
+	meta, err := json.Marshal(picked)
+	if err != nil {
+		return nil, err
+	}
+	if len(meta) > limit {
+		return nil, fmt.Errorf("Encoded labels are %d bytes, over the %d byte limit", len(meta), limit)
+	}
+	return meta, nil
+}
+
+// DecodeLabels reads labels from node metadata written by EncodeLabels.
+func DecodeLabels(meta []byte) (map[string]string, error) {
+	labels := make(map[string]string)
+	if len(meta) == 0 {
+		return labels, nil
+	}
+	if err := json.Unmarshal(meta, &labels); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+// MetaDelegate is a memberlist.Delegate that only publishes fixed node
+// metadata. It's installed by PodInfo.Configure when the application
+// doesn't provide its own delegate.
+type MetaDelegate struct {
+	Meta []byte
+}
+
+func (d *MetaDelegate) NodeMeta(limit int) []byte {
+	return d.Meta
+}
+
+func (d *MetaDelegate) NotifyMsg([]byte) {
+}
+
+func (d *MetaDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	return nil
+}
+
+func (d *MetaDelegate) LocalState(join bool) []byte {
+	return nil
+}
+
+func (d *MetaDelegate) MergeRemoteState(buf []byte, join bool) {
+}
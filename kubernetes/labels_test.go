@@ -0,0 +1,57 @@
+package kubernetes
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestReadLabels(t *testing.T) {
+	f, err := ioutil.TempFile("", "labels")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("app=\"cache\"\n\nnote=\"a \\\"quoted\\\" value\"\n")
+	f.Close()
+
+	labels, err := ReadLabels(f.Name())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(labels) != 2 || labels["app"] != "cache" || labels["note"] != `a "quoted" value` {
+		t.Fatalf("bad labels: %v", labels)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("app=cache\n"), 0644)
+	if _, err := ReadLabels(f.Name()); err == nil {
+		t.Fatalf("expected error for an unquoted value")
+	}
+}
+
+func TestEncodeDecodeLabels(t *testing.T) {
+	labels := map[string]string{"app": "cache", "zone": "us-east-1a", "team": "infra"}
+
+	meta, err := EncodeLabels(labels, []string{"zone", "app", "missing"}, 512)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := DecodeLabels(meta)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(out) != 2 || out["app"] != "cache" || out["zone"] != "us-east-1a" {
+		t.Fatalf("bad labels: %v", out)
+	}
+
+	big := map[string]string{"big": strings.Repeat("x", 600)}
+	if _, err := EncodeLabels(big, []string{"big"}, 512); err == nil {
+		t.Fatalf("expected error over the limit")
+	}
+
+	out, err = DecodeLabels(nil)
+	if err != nil || len(out) != 0 {
+		t.Fatalf("bad: %v %v", out, err)
+	}
+}
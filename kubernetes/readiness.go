@@ -0,0 +1,80 @@
+package kubernetes
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// Readiness is an http.Handler for a pod's readiness probe that reports
+// ready only once the memberlist has joined the cluster, so the pod isn't
+// sent traffic before it can see the rest of the cluster. It stops
+// reporting ready when the memberlist starts leaving.
+//
+// Join through Readiness.Join rather than Memberlist.Join so that the first
+// pod of a new cluster, which has nobody to join, still becomes ready.
+type Readiness struct {
+	list *memberlist.Memberlist
+
+	l     sync.Mutex
+	alone bool
+}
+
+// NewReadiness returns a readiness gate for the given memberlist.
+func NewReadiness(list *memberlist.Memberlist) *Readiness {
+	return &Readiness{list: list}
+}
+
+// Join joins the given seeds, leaving out our own address. Seeds without a
+// port are taken to be ours if the IP matches. If that leaves
+// no seeds we're the first member, and are ready straight away.
+func (r *Readiness) Join(seeds []string) (int, error) {
+	self := r.list.LocalNode()
+	var others []string
+	for _, seed := range seeds {
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil {
+			host, port = seed, ""
+		}
+		isSelf := port == "" || port == strconv.Itoa(int(self.Port))
+		if ip := net.ParseIP(host); isSelf && ip != nil && ip.Equal(self.Addr) {
+			continue
+		}
+		others = append(others, seed)
+	}
+
+	if len(others) == 0 {
+		r.l.Lock()
+		r.alone = true
+		r.l.Unlock()
+		return 0, nil
+	}
+	return r.list.Join(others)
+}
+
+// Ready reports whether the memberlist has joined and not yet left.
+func (r *Readiness) Ready() bool {
+	switch r.list.State() {
+	case memberlist.StateJoined:
+		return true
+	case memberlist.StateCreated:
+		r.l.Lock()
+		defer r.l.Unlock()
+		return r.alone
+	default:
+		return false
+	}
+}
+
+func (r *Readiness) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.Ready() {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(r.list.State().String() + "\n"))
+}
@@ -0,0 +1,72 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func testMemberlist(t *testing.T, name string) *memberlist.Memberlist {
+	conf := memberlist.DefaultLocalConfig()
+	conf.Name = name
+	conf.BindAddr = "127.0.0.1"
+	conf.BindPort = 0
+	list, err := memberlist.Create(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return list
+}
+
+func probe(r *Readiness) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	return w.Code
+}
+
+func TestReadiness(t *testing.T) {
+	m1 := testMemberlist(t, "m1")
+	defer m1.Shutdown()
+	m2 := testMemberlist(t, "m2")
+	defer m2.Shutdown()
+
+	r1, r2 := NewReadiness(m1), NewReadiness(m2)
+	if probe(r1) != http.StatusServiceUnavailable {
+		t.Fatalf("should not be ready before joining")
+	}
+
+	// The first pod only finds itself, and is ready without joining.
+	self := m1.LocalNode()
+	seed := fmt.Sprintf("%s:%d", self.Addr, self.Port)
+	if n, err := r1.Join([]string{seed}); n != 0 || err != nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if probe(r1) != http.StatusOK {
+		t.Fatalf("first member should be ready")
+	}
+
+	// The second pod is ready once it has joined the first.
+	if probe(r2) != http.StatusServiceUnavailable {
+		t.Fatalf("should not be ready before joining")
+	}
+	other := m2.LocalNode()
+	seeds := []string{seed, fmt.Sprintf("%s:%d", other.Addr, other.Port)}
+	if n, err := r2.Join(seeds); n != 1 || err != nil {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if probe(r2) != http.StatusOK {
+		t.Fatalf("should be ready after joining")
+	}
+
+	// Leaving drops out of readiness.
+	if err := m2.Leave(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if probe(r2) != http.StatusServiceUnavailable {
+		t.Fatalf("should not be ready after leaving")
+	}
+}
@@ -0,0 +1,252 @@
+package memberlist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+)
+
+/*
+Labels are used to separate the traffic of several logical clusters that
+may end up talking to each other, for example when they share a port via a
+Router or when an old node is pointed at the wrong seed. A label is written
+as a small header in front of every packet and at the start of every stream
+we initiate:
+
+  [hasLabelMsg][length byte][label bytes ...]
+
+When encryption is enabled the label is also fed to AES-GCM as additional
+authenticated data, so a peer holding the right key but claiming a
+different label can't inject traffic into our namespace.
+
+These are cluster labels, carried on packets and streams. They say nothing
+about the node that sent them; anything describing a node belongs in its
+meta data.
+
+A member normally sends and accepts just Config.Label, but it can accept
+others listed in Config.AcceptLabels, and send one of those to particular
+peers with SetPeerLabel. That lets it talk to members of clusters with
+other labels, for example while moving a cluster to a new label one node
+at a time. Replies on a stream use the label the stream arrived with.
+Delegates implementing LabeledMsgDelegate are told which label each user
+message came with.
+*/
+
+// LabelMaxSize is the maximum length of a label, in bytes.
+const LabelMaxSize = 255
+
+// validateLabel makes sure the given label will fit in a label header.
+func validateLabel(label string) error {
+	if len(label) > LabelMaxSize {
+		return fmt.Errorf("label is too long: %d bytes, max %d", len(label), LabelMaxSize)
+	}
+	return nil
+}
+
+// addLabelHeaderToPacket prefixes the given packet with a label header. An
+// empty label leaves the packet unmodified.
+func addLabelHeaderToPacket(buf []byte, label string) []byte {
+	if label == "" {
+		return buf
+	}
+	out := make([]byte, 2+len(label)+len(buf))
+	out[0] = byte(hasLabelMsg)
+	out[1] = byte(len(label))
+	copy(out[2:], label)
+	copy(out[2+len(label):], buf)
+	return out
+}
+
+// peekLabelFromPacket returns the label carried by the given packet and the
+// size of the label header, without modifying the packet. Packets without a
+// label header return an empty label and a zero header size.
+func peekLabelFromPacket(buf []byte) (string, int, error) {
+	if len(buf) == 0 || messageType(buf[0]) != hasLabelMsg {
+		return "", 0, nil
+	}
+	if len(buf) < 2 {
+		return "", 0, fmt.Errorf("label header is truncated")
+	}
+	size := int(buf[1])
+	if size < 1 {
+		return "", 0, fmt.Errorf("label header cannot be empty when present")
+	}
+	if len(buf) < 2+size {
+		return "", 0, fmt.Errorf("label header is truncated")
+	}
+	return string(buf[2 : 2+size]), 2 + size, nil
+}
+
+// removeLabelHeaderFromPacket strips any label header from the given packet
+// and returns the remaining payload along with the label.
+func removeLabelHeaderFromPacket(buf []byte) ([]byte, string, error) {
+	label, n, err := peekLabelFromPacket(buf)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf[n:], label, nil
+}
+
+// writeLabelHeaderToStream writes a label header to the given stream. An
+// empty label writes nothing.
+func writeLabelHeaderToStream(w io.Writer, label string) error {
+	if label == "" {
+		return nil
+	}
+	header := addLabelHeaderToPacket(nil, label)
+	_, err := w.Write(header)
+	return err
+}
+
+// peekedConn wraps a connection whose beginning has been buffered so that
+// subsequent reads see the buffered bytes first.
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// peekLabelFromStream looks for a label header at the start of the given
+// stream without consuming it. The returned connection must be used for
+// all further reads.
+func peekLabelFromStream(conn net.Conn) (*peekedConn, string, int, error) {
+	pc, ok := conn.(*peekedConn)
+	if !ok {
+		pc = &peekedConn{conn, bufio.NewReader(conn)}
+	}
+
+	peeked, err := pc.r.Peek(1)
+	if err != nil {
+		return pc, "", 0, err
+	}
+	if messageType(peeked[0]) != hasLabelMsg {
+		return pc, "", 0, nil
+	}
+
+	peeked, err = pc.r.Peek(2)
+	if err != nil {
+		return pc, "", 0, err
+	}
+	size := int(peeked[1])
+	if size < 1 {
+		return pc, "", 0, fmt.Errorf("label header cannot be empty when present")
+	}
+
+	peeked, err = pc.r.Peek(2 + size)
+	if err != nil {
+		return pc, "", 0, err
+	}
+	return pc, string(peeked[2:]), 2 + size, nil
+}
+
+// removeLabelHeaderFromStream strips any label header from the start of the
+// given stream and returns the label. The returned connection must be used
+// for all further reads.
+func removeLabelHeaderFromStream(conn net.Conn) (net.Conn, string, error) {
+	pc, label, n, err := peekLabelFromStream(conn)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := pc.r.Discard(n); err != nil {
+		return nil, "", err
+	}
+	return pc, label, nil
+}
+
+// labeledConn is a stream along with the label it uses.
+type labeledConn struct {
+	net.Conn
+	label string
+}
+
+// acceptsLabel returns true if we accept traffic with the given label.
+func (m *Memberlist) acceptsLabel(label string) bool {
+	if label == m.config.Label {
+		return true
+	}
+	for _, l := range m.config.AcceptLabels {
+		if label == l {
+			return true
+		}
+	}
+	return false
+}
+
+// statelessPacketMsg returns true for the packet message types we take
+// under one of Config.AcceptLabels. Anything about membership is left out,
+// so that clusters with different labels don't merge into one: they only
+// ping each other and exchange user messages. Compound and compressed
+// messages are checked part by part.
+func statelessPacketMsg(msgType messageType) bool {
+	switch msgType {
+	case compoundMsg, compound2Msg, compressMsg,
+		pingMsg, indirectPingMsg, ackRespMsg, nackRespMsg,
+		userMsg, sealedUserMsg:
+		return true
+	default:
+		return false
+	}
+}
+
+// statelessStreamMsg is statelessPacketMsg for streams.
+func statelessStreamMsg(msgType messageType) bool {
+	switch msgType {
+	case pingMsg, ackPayloadReqMsg, userMsg, sealedUserMsg:
+		return true
+	default:
+		return false
+	}
+}
+
+// labelFor returns the label to send to the given address with.
+func (m *Memberlist) labelFor(addr net.Addr) string {
+	if addr != nil {
+		m.peerLabelLock.RLock()
+		label, ok := m.peerLabels[addr.String()]
+		m.peerLabelLock.RUnlock()
+		if ok {
+			return label
+		}
+	}
+	return m.config.Label
+}
+
+// streamLabel returns the label to use on a stream: the one it arrived
+// with if the peer opened it, or the one for its address if we did.
+func (m *Memberlist) streamLabel(conn net.Conn) string {
+	if lc, ok := conn.(*labeledConn); ok {
+		return lc.label
+	}
+	return m.labelFor(conn.RemoteAddr())
+}
+
+// SetPeerLabel sets the label to use when sending to the given address, in
+// place of Config.Label. The label must be Config.Label or one of
+// Config.AcceptLabels, so that the peer's answers are accepted; setting
+// Config.Label goes back to the default. The address is resolved once,
+// now, and must be the one the peer is reached at.
+func (m *Memberlist) SetPeerLabel(addr string, label string) error {
+	if !m.acceptsLabel(label) {
+		return fmt.Errorf("Label '%s' isn't one we accept", label)
+	}
+	resolved, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+
+	m.peerLabelLock.Lock()
+	defer m.peerLabelLock.Unlock()
+	if label == m.config.Label {
+		delete(m.peerLabels, resolved.String())
+		return nil
+	}
+	if m.peerLabels == nil {
+		m.peerLabels = make(map[string]string)
+	}
+	m.peerLabels[resolved.String()] = label
+	return nil
+}
@@ -0,0 +1,297 @@
+package memberlist
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLabel_PacketRoundTrip(t *testing.T) {
+	payload := []byte{byte(pingMsg), 1, 2, 3}
+
+	// No label should be a no-op.
+	buf := addLabelHeaderToPacket(payload, "")
+	if !bytes.Equal(buf, payload) {
+		t.Fatalf("bad: %v", buf)
+	}
+	out, label, err := removeLabelHeaderFromPacket(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if label != "" || !bytes.Equal(out, payload) {
+		t.Fatalf("bad: %q %v", label, out)
+	}
+
+	buf = addLabelHeaderToPacket(payload, "foo")
+	expected := []byte{byte(hasLabelMsg), 3, 'f', 'o', 'o', byte(pingMsg), 1, 2, 3}
+	if !bytes.Equal(buf, expected) {
+		t.Fatalf("bad: %v", buf)
+	}
+	out, label, err = removeLabelHeaderFromPacket(buf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if label != "foo" || !bytes.Equal(out, payload) {
+		t.Fatalf("bad: %q %v", label, out)
+	}
+}
+
+func TestLabel_PacketTruncated(t *testing.T) {
+	cases := [][]byte{
+		[]byte{byte(hasLabelMsg)},
+		[]byte{byte(hasLabelMsg), 0},
+		[]byte{byte(hasLabelMsg), 4, 'f', 'o'},
+	}
+	for _, c := range cases {
+		if _, _, err := removeLabelHeaderFromPacket(c); err == nil {
+			t.Fatalf("expected error for %v", c)
+		}
+	}
+}
+
+func TestLabel_Validate(t *testing.T) {
+	if err := validateLabel(strings.Repeat("a", LabelMaxSize)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := validateLabel(strings.Repeat("a", LabelMaxSize+1)); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	c := testConfig()
+	c.Label = strings.Repeat("a", LabelMaxSize+1)
+	if _, err := NewMemberlistOnOpenPort(c); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestLabel_Stream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		writeLabelHeaderToStream(client, "foo")
+		client.Write([]byte{byte(pingMsg), 42})
+	}()
+
+	server.SetDeadline(time.Now().Add(time.Second))
+	conn, label, err := removeLabelHeaderFromStream(server)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if label != "foo" {
+		t.Fatalf("bad: %q", label)
+	}
+
+	buf := make([]byte, 2)
+	if _, err := conn.Read(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if buf[0] != byte(pingMsg) || buf[1] != 42 {
+		t.Fatalf("bad: %v", buf)
+	}
+}
+
+func TestMemberlist_Join_LabelMismatch(t *testing.T) {
+	c1 := testConfig()
+	c1.Label = "blue"
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.Label = "green"
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err == nil {
+		t.Fatalf("expected join to fail")
+	}
+	if len(m1.Members()) != 1 || len(m2.Members()) != 1 {
+		t.Fatalf("bad: %d %d", len(m1.Members()), len(m2.Members()))
+	}
+
+	// Now match the labels and try again.
+	c3 := testConfig()
+	c3.Label = "blue"
+	c3.BindPort = m1.config.BindPort
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m3.Shutdown()
+
+	num, err := m3.Join([]string{m1.config.BindAddr})
+	if num != 1 || err != nil {
+		t.Fatalf("unexpected: %d %v", num, err)
+	}
+	if len(m1.Members()) != 2 || len(m3.Members()) != 2 {
+		t.Fatalf("bad: %d %d", len(m1.Members()), len(m3.Members()))
+	}
+}
+
+func TestMemberlist_Label_Encrypted(t *testing.T) {
+	key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	c1 := testConfig()
+	c1.Label = "blue"
+	c1.SecretKey = key
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.Label = "blue"
+	c2.SecretKey = key
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 || err != nil {
+		t.Fatalf("unexpected: %d %v", num, err)
+	}
+
+	// Ping over UDP to make sure packets decrypt with the label.
+	addr := &net.UDPAddr{IP: net.ParseIP(m1.config.BindAddr), Port: m1.config.BindPort}
+	if _, err := m2.Ping(m1.config.Name, addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+// labeledDelegate records user messages along with their labels.
+type labeledDelegate struct {
+	MockDelegate
+	lock   sync.Mutex
+	labels []string
+}
+
+func (d *labeledDelegate) NotifyLabeledMsg(label string, msg []byte) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.labels = append(d.labels, label+":"+string(msg))
+}
+
+func (d *labeledDelegate) received() []string {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return append([]string(nil), d.labels...)
+}
+
+func TestMemberlist_AcceptLabels(t *testing.T) {
+	key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	d := &labeledDelegate{}
+	c1 := testConfig()
+	c1.Label = "blue"
+	c1.AcceptLabels = []string{"green"}
+	c1.SecretKey = key
+	c1.Delegate = d
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.Label = "green"
+	c2.SecretKey = key
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	// Membership stays separate, so a join is turned away.
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	var rej *MergeRejection
+	if num != 0 || !errors.As(err, &rej) {
+		t.Fatalf("unexpected: %d %v", num, err)
+	}
+	if m1.NumMembers() != 1 || m2.NumMembers() != 1 {
+		t.Fatalf("should not merge: %d %d", m1.NumMembers(), m2.NumMembers())
+	}
+
+	// Packets need the peer's label set, or our acks are dropped.
+	if err := m1.SetPeerLabel(m2.config.BindAddr+":"+strconv.Itoa(m2.config.BindPort), "red"); err == nil {
+		t.Fatalf("expected error for a label we don't accept")
+	}
+	if err := m1.SetPeerLabel(m2.config.BindAddr+":"+strconv.Itoa(m2.config.BindPort), "green"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr1 := &net.UDPAddr{IP: net.ParseIP(m1.config.BindAddr), Port: m1.config.BindPort}
+	if _, err := m2.Ping(m1.config.Name, addr1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr2 := &net.UDPAddr{IP: net.ParseIP(m2.config.BindAddr), Port: m2.config.BindPort}
+	if _, err := m1.Ping(m2.config.Name, addr2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The delegate hears which label user messages came with. Streams
+	// are answered with the label they arrived with.
+	n1 := &Node{Name: m1.config.Name, Addr: net.ParseIP(m1.config.BindAddr), Port: uint16(m1.config.BindPort)}
+	if err := m2.SendToUDP(n1, []byte("udp")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m2.SendToTCP(n1, []byte("tcp")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(d.received()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := d.received()
+	sort.Strings(got)
+	if !reflect.DeepEqual(got, []string{"green:tcp", "green:udp"}) {
+		t.Fatalf("bad: %v", got)
+	}
+	if len(d.msgs) != 0 {
+		t.Fatalf("NotifyMsg shouldn't be called: %v", d.msgs)
+	}
+
+	// Gossip about members is only taken under our own label.
+	a := alive{Node: "other", Addr: []byte{127, 0, 0, 99}, Port: 7946, Incarnation: 1}
+	buf, err := encode(aliveMsg, &a)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m1.handleCommand(buf.Bytes(), addr2, time.Now(), "green")
+	time.Sleep(20 * time.Millisecond)
+	if m1.NumMembers() != 1 {
+		t.Fatalf("should ignore gossip under an accepted label")
+	}
+	m1.handleCommand(buf.Bytes(), addr2, time.Now(), "blue")
+	deadline = time.Now().Add(time.Second)
+	for m1.NumMembers() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("should take gossip under our label")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Going back to our own label clears the override.
+	if err := m1.SetPeerLabel(addr2.String(), "blue"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if label := m1.labelFor(addr2); label != "blue" {
+		t.Fatalf("bad: %q", label)
+	}
+}
@@ -0,0 +1,142 @@
+package memberlist
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+By default Leave returns as soon as our dead message has been gossiped the
+usual number of times, which says nothing about how many members heard it.
+With LeaveQuorum set, the dead message asks for acknowledgements: each
+member that learns of our departure from it sends a leave ack straight
+back to us, and Leave waits until acks have come in from that fraction of
+the members that were alive when we started to leave. Paused members don't
+hear gossip, and members running an older version don't send acks, so
+only alive members that advertise leave acks count towards the quorum, and
+if there are none we just wait for the broadcast. Acks from anyone else,
+including members that joined since, are ignored.
+
+Acks go over UDP and can be lost, so members ack again each time they hear
+the dead message, while it's still being gossiped. Once our own broadcast
+is done we only wait another ProbeInterval for stragglers, so that Leave
+returns even with no timeout.
+*/
+
+// leaveAck tells a leaving node that we've heard it's leaving.
+type leaveAck struct {
+	Node string `codec:"Node"` // The node that's leaving
+	From string `codec:"From"`
+}
+
+// leaveQuorum counts the acks for our leave.
+type leaveQuorum struct {
+	sync.Mutex
+	members map[string]struct{} // Members whose acks count
+	acks    map[string]struct{}
+	needed  int
+	done    chan struct{} // Closed once needed acks are in, nil if not leaving
+}
+
+// startLeaveQuorum starts counting acks for our leave, and returns a
+// channel that's closed once there are enough of them. It returns nil if
+// LeaveQuorum isn't set, or no member can ack.
+func (m *Memberlist) startLeaveQuorum() chan struct{} {
+	if m.config.LeaveQuorum <= 0 {
+		return nil
+	}
+
+	m.nodeLock.RLock()
+	members := make(map[string]struct{})
+	for _, n := range m.nodes {
+		if n.Name != m.config.Name && n.State.active() && CapabilityLeaveAck.supportedBy(n) {
+			members[n.Name] = struct{}{}
+		}
+	}
+	m.nodeLock.RUnlock()
+
+	needed := int(math.Ceil(m.config.LeaveQuorum * float64(len(members))))
+	if needed == 0 {
+		return nil
+	}
+
+	q := &m.leaveQuorum
+	q.Lock()
+	defer q.Unlock()
+	q.members = members
+	q.acks = make(map[string]struct{})
+	q.needed = needed
+	q.done = make(chan struct{})
+	return q.done
+}
+
+// waitLeaveQuorum waits for enough acks for our leave, giving up a
+// ProbeInterval after our dead message has finished gossiping.
+func (m *Memberlist) waitLeaveQuorum(quorum <-chan struct{}, timeoutCh <-chan time.Time) error {
+	var graceCh <-chan time.Time
+	broadcastCh := m.leaveBroadcast
+	for {
+		select {
+		case <-quorum:
+			return nil
+		case <-broadcastCh:
+			broadcastCh = nil
+			graceCh = time.After(m.config.ProbeInterval)
+		case <-graceCh:
+			metrics.IncrCounter([]string{"memberlist", "leave", "quorum_missed"}, 1)
+			return ErrLeaveTimeout
+		case <-timeoutCh:
+			return ErrLeaveTimeout
+		case <-m.shutdownCh:
+			return ErrShutdown
+		}
+	}
+}
+
+// sendLeaveAck acknowledges a node's leave, if it asked. It's sent again
+// for each copy of the dead message we hear. The nodeLock must be held.
+func (m *Memberlist) sendLeaveAck(d *dead, state *nodeState) {
+	if !d.Ack || d.From != d.Node || d.Node == m.config.Name {
+		return
+	}
+	to := &net.UDPAddr{IP: state.Addr, Port: int(state.Port)}
+	ack := leaveAck{Node: d.Node, From: m.config.Name}
+	go func() {
+		if err := m.encodeAndSendMsg(to, leaveAckMsg, &ack); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send leave ack to %s: %s", to, err)
+		}
+	}()
+}
+
+func (m *Memberlist) handleLeaveAck(buf []byte, from net.Addr) {
+	var ack leaveAck
+	if err := decode(buf, &ack); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode leave ack: %s %s", err, LogAddress(from))
+		return
+	}
+	if ack.Node != m.config.Name {
+		return
+	}
+
+	q := &m.leaveQuorum
+	q.Lock()
+	defer q.Unlock()
+	if q.done == nil {
+		return
+	}
+	if _, ok := q.members[ack.From]; !ok {
+		return
+	}
+	if _, ok := q.acks[ack.From]; ok {
+		return
+	}
+	q.acks[ack.From] = struct{}{}
+	metrics.IncrCounter([]string{"memberlist", "leave", "ack"}, 1)
+	if len(q.acks) == q.needed {
+		close(q.done)
+	}
+}
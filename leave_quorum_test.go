@@ -0,0 +1,173 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemberlist_LeaveQuorum_Invalid(t *testing.T) {
+	c := testConfig()
+	c.LeaveQuorum = 1.5
+	if _, err := NewMemberlistOnOpenPort(c); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func leaveQuorumCluster(t *testing.T, n int) []*Memberlist {
+	var lists []*Memberlist
+	for i := 0; i < n; i++ {
+		c := testConfig()
+		c.LeaveQuorum = 1
+		if i > 0 {
+			c.BindPort = lists[0].config.BindPort
+		}
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if i > 0 {
+			if _, err := m.Join([]string{lists[0].config.BindAddr}); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		lists = append(lists, m)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, m := range lists {
+		for m.NumMembers() != n && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return lists
+}
+
+func TestMemberlist_LeaveQuorum(t *testing.T) {
+	lists := leaveQuorumCluster(t, 4)
+	for _, m := range lists {
+		defer m.Shutdown()
+	}
+
+	// Once Leave returns, everyone has heard.
+	leaver := lists[0]
+	if err := leaver.Leave(5 * time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, m := range lists[1:] {
+		if s, ok := m.MemberStatus(leaver.config.Name); ok && s != StatusDead {
+			t.Fatalf("%s hasn't heard: %v", m.config.Name, s)
+		}
+	}
+}
+
+func TestMemberlist_LeaveQuorum_Timeout(t *testing.T) {
+	lists := leaveQuorumCluster(t, 3)
+	for _, m := range lists {
+		defer m.Shutdown()
+	}
+
+	// A member that's gone quiet can't acknowledge.
+	lists[2].Shutdown()
+	if err := lists[0].Leave(200 * time.Millisecond); err != ErrLeaveTimeout {
+		t.Fatalf("expected timeout, got %v", err)
+	}
+}
+
+func TestMemberlist_LeaveQuorum_NoTimeout(t *testing.T) {
+	lists := leaveQuorumCluster(t, 3)
+	for _, m := range lists {
+		defer m.Shutdown()
+	}
+
+	// With no timeout, a member that never acks doesn't hold us forever.
+	lists[2].Shutdown()
+	errCh := make(chan error, 1)
+	go func() { errCh <- lists[0].Leave(0) }()
+	select {
+	case err := <-errCh:
+		if err != ErrLeaveTimeout {
+			t.Fatalf("expected timeout, got %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Leave never returned")
+	}
+}
+
+func TestMemberlist_LeaveQuorum_MixedVersions(t *testing.T) {
+	lists := leaveQuorumCluster(t, 3)
+	for _, m := range lists {
+		defer m.Shutdown()
+	}
+
+	// A member from before leave acks doesn't count towards the quorum.
+	old := lists[2]
+	leaver := lists[0]
+	leaver.nodeLock.Lock()
+	leaver.nodeMap[old.config.Name].PMax = CapabilityLeaveAck.MinProtocol - 1
+	leaver.nodeLock.Unlock()
+	old.Shutdown()
+
+	start := time.Now()
+	if err := leaver.Leave(5 * time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("waited for an old member")
+	}
+}
+
+func TestMemberlist_LeaveQuorum_Paused(t *testing.T) {
+	lists := leaveQuorumCluster(t, 3)
+	for _, m := range lists {
+		defer m.Shutdown()
+	}
+
+	// A paused member doesn't hear gossip, so it can't ack.
+	paused := lists[2]
+	leaver := lists[0]
+	leaver.nodeLock.Lock()
+	leaver.nodeMap[paused.config.Name].State = statePaused
+	leaver.nodeLock.Unlock()
+	paused.Shutdown()
+
+	start := time.Now()
+	if err := leaver.Leave(5 * time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("waited for a paused member")
+	}
+}
+
+func TestMemberlist_HandleLeaveAck_Members(t *testing.T) {
+	lists := leaveQuorumCluster(t, 2)
+	for _, m := range lists {
+		defer m.Shutdown()
+	}
+
+	m := lists[0]
+	quorum := m.startLeaveQuorum()
+	if quorum == nil {
+		t.Fatalf("expected a quorum")
+	}
+	ack := func(from string) {
+		buf, err := encode(leaveAckMsg, &leaveAck{Node: m.config.Name, From: from})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		m.handleLeaveAck(buf.Bytes()[1:], nil)
+	}
+
+	// Only acks from the members we started with count.
+	ack("stranger")
+	select {
+	case <-quorum:
+		t.Fatalf("counted an ack from a stranger")
+	default:
+	}
+	ack(lists[1].config.Name)
+	select {
+	case <-quorum:
+	default:
+		t.Fatalf("expected the quorum")
+	}
+}
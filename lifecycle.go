@@ -0,0 +1,57 @@
+package memberlist
+
+import "fmt"
+
+// LifecycleState describes where a Memberlist is in its lifetime. A
+// memberlist moves forward through these states and never goes back.
+type LifecycleState int
+
+const (
+	// StateCreated is the state after Create, before a successful Join.
+	StateCreated LifecycleState = iota
+
+	// StateJoined is the state once Join has contacted at least one node.
+	StateJoined
+
+	// StateLeaving is the state while Leave is broadcasting our departure.
+	StateLeaving
+
+	// StateLeft is the state once Leave has returned, whether or not the
+	// broadcast was confirmed before the timeout.
+	StateLeft
+
+	// StateShutdown is the state once Shutdown has been called.
+	StateShutdown
+)
+
+func (s LifecycleState) String() string {
+	switch s {
+	case StateCreated:
+		return "created"
+	case StateJoined:
+		return "joined"
+	case StateLeaving:
+		return "leaving"
+	case StateLeft:
+		return "left"
+	case StateShutdown:
+		return "shutdown"
+	default:
+		return fmt.Sprintf("LifecycleState(%d)", int(s))
+	}
+}
+
+// State returns the current lifecycle state of the memberlist.
+func (m *Memberlist) State() LifecycleState {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	return m.lifecycle
+}
+
+// advanceLifecycle moves to the given state if it's later than the current
+// one. The node lock must be held.
+func (m *Memberlist) advanceLifecycle(s LifecycleState) {
+	if s > m.lifecycle {
+		m.lifecycle = s
+	}
+}
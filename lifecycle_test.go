@@ -0,0 +1,94 @@
+package memberlist
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLifecycleState_String(t *testing.T) {
+	cases := map[LifecycleState]string{
+		StateCreated:       "created",
+		StateJoined:        "joined",
+		StateLeaving:       "leaving",
+		StateLeft:          "left",
+		StateShutdown:      "shutdown",
+		LifecycleState(42): "LifecycleState(42)",
+	}
+	for s, expected := range cases {
+		if s.String() != expected {
+			t.Fatalf("bad: %s", s.String())
+		}
+	}
+}
+
+func TestMemberlist_Lifecycle(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+
+	c := testConfig()
+	c.BindPort = m1.config.BindPort
+	c.GossipInterval = time.Millisecond
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	if s := m2.State(); s != StateCreated {
+		t.Fatalf("bad: %s", s)
+	}
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if s := m2.State(); s != StateJoined {
+		t.Fatalf("bad: %s", s)
+	}
+
+	// Leave from several goroutines at once; they should all agree.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errCh <- m2.Leave(time.Second)
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if s := m2.State(); s != StateLeft {
+		t.Fatalf("bad: %s", s)
+	}
+
+	// Same for shutdown.
+	wg = sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m2.Shutdown(); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if s := m2.State(); s != StateShutdown {
+		t.Fatalf("bad: %s", s)
+	}
+
+	// Everything after shutdown has a well-defined error.
+	if err := m2.Leave(time.Second); err != ErrShutdown {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != ErrShutdown {
+		t.Fatalf("bad: %v", err)
+	}
+}
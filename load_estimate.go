@@ -0,0 +1,169 @@
+package memberlist
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+/*
+EstimateLoad works out, from a config, roughly what a cluster of a given
+size will cost to run and how it will behave, so settings can be weighed
+up before they're deployed. It's arithmetic, not a simulation: message
+sizes come from encoding typical messages for this config, and the rest
+from the same formulas memberlist scales its timers and limits with.
+
+Every member probes one other each ProbeInterval and acks the probes of
+others, so in a quiet cluster that's all the packet traffic there is.
+Gossip only goes out while there's news to pass on, and is counted at its
+most, with every gossip packet full. Push/pull syncs go over TCP, so they
+count towards bytes but not packets, with each member both starting and
+answering a sync every scaled PushPullInterval.
+
+Node metadata, user state and user messages are up to the application, so
+they're left out.
+*/
+
+// estimatePacketLoss is the packet loss EstimateLoad assumes when working
+// out the false positive rate.
+const estimatePacketLoss = 0.01
+
+// LoadEstimate is the expected cost and behaviour of a cluster, as worked
+// out by Config.EstimateLoad.
+type LoadEstimate struct {
+	// ClusterSize is the number of members estimated for.
+	ClusterSize int
+
+	// PacketsPerSec and BytesPerSec are what each member sends, at most:
+	// probes and acks, gossip while there's news, and push/pull syncs.
+	// ProbePacketsPerSec is the part sent even in a quiet cluster.
+	PacketsPerSec      float64
+	BytesPerSec        float64
+	ProbePacketsPerSec float64
+
+	// ConvergenceTime is roughly how long news takes to reach every
+	// member by gossip.
+	ConvergenceTime time.Duration
+
+	// SuspicionTimeout is how long a failed member is suspected before
+	// it's declared dead, without any confirmations.
+	SuspicionTimeout time.Duration
+
+	// FalsePositiveProb is the chance that a probe of a healthy member
+	// fails, given PacketLoss, so that it's suspected and has to refute
+	// it. FalseSuspicionsPerHour is how often that happens across the
+	// cluster.
+	PacketLoss             float64
+	FalsePositiveProb      float64
+	FalseSuspicionsPerHour float64
+}
+
+// EstimateLoad works out the expected load and behaviour of a cluster of
+// the given size with this config.
+func (c *Config) EstimateLoad(clusterSize int) (*LoadEstimate, error) {
+	if clusterSize < 1 {
+		return nil, fmt.Errorf("Cluster size must be at least 1, got %d", clusterSize)
+	}
+	if c.ProbeInterval <= 0 || c.GossipInterval <= 0 {
+		return nil, fmt.Errorf("ProbeInterval and GossipInterval must be positive")
+	}
+	n := float64(clusterSize)
+
+	name := c.Name
+	if name == "" {
+		name = "node"
+	}
+	addr := []byte{127, 0, 0, 1}
+	vsn := []uint8{ProtocolVersionMin, ProtocolVersionMax, c.ProtocolVersion, 0, 0, 0}
+	pingSize, err := c.packetSize(pingMsg, &ping{SeqNo: 1, Node: name, SourceAddr: addr, SourcePort: 7946, SourceNode: name})
+	if err != nil {
+		return nil, err
+	}
+	ackSize, err := c.packetSize(ackRespMsg, &ackResp{SeqNo: 1})
+	if err != nil {
+		return nil, err
+	}
+	nodeState, err := encode(pushPullMsg, &pushNodeState{Name: name, Addr: addr, Port: 7946, Incarnation: 1, Vsn: vsn})
+	if err != nil {
+		return nil, err
+	}
+
+	est := &LoadEstimate{
+		ClusterSize: clusterSize,
+		PacketLoss:  estimatePacketLoss,
+	}
+
+	// Probes and acks. With one member there's nobody to probe.
+	probeRate := 1 / c.ProbeInterval.Seconds()
+	if clusterSize == 1 {
+		probeRate = 0
+	}
+	est.ProbePacketsPerSec = 2 * probeRate
+	probeBytes := probeRate * float64(pingSize+ackSize)
+
+	// Gossip, at its most.
+	gossipRate := 0.0
+	if clusterSize > 1 {
+		peers := math.Min(float64(c.GossipNodes), n-1)
+		gossipRate = peers / c.GossipInterval.Seconds()
+	}
+	gossipBytes := gossipRate * float64(udpSendBuf)
+
+	// Push/pull, both ways, for each sync we start and answer.
+	pushPullBytes := 0.0
+	if c.PushPullInterval > 0 && clusterSize > 1 {
+		interval := pushPullScale(c.PushPullInterval, clusterSize)
+		pushPullBytes = 2 * n * float64(nodeState.Len()) / interval.Seconds()
+	}
+
+	est.PacketsPerSec = est.ProbePacketsPerSec + gossipRate
+	est.BytesPerSec = probeBytes + gossipBytes + pushPullBytes
+
+	// Push gossip reaches everyone in about log(n) rounds to the base of
+	// the fan-out, plus ln(n)/fan-out to mop up the stragglers.
+	if clusterSize > 1 && c.GossipNodes > 0 {
+		k := float64(c.GossipNodes)
+		rounds := math.Ceil(math.Log(n)/math.Log(1+k) + math.Log(n)/k)
+		est.ConvergenceTime = time.Duration(rounds) * c.GossipInterval
+	}
+
+	est.SuspicionTimeout = time.Duration(c.SuspicionMaxTimeoutMult) * suspicionTimeout(c.SuspicionMult, clusterSize, c.ProbeInterval)
+
+	// A probe fails if the ping or its ack is lost, and so does every
+	// indirect probe, with its four packets, and the TCP fallback, which
+	// we count as a round trip.
+	p := estimatePacketLoss
+	roundTrip := 1 - math.Pow(1-p, 2)
+	fail := roundTrip
+	indirect := math.Min(float64(c.IndirectChecks), n-2)
+	if indirect > 0 {
+		fail *= math.Pow(1-math.Pow(1-p, 4), indirect)
+	}
+	if !c.DisableTcpPings {
+		fail *= roundTrip
+	}
+	est.FalsePositiveProb = fail
+	est.FalseSuspicionsPerHour = fail * probeRate * n * 3600
+	return est, nil
+}
+
+// packetSize returns the size of a message sent on its own in a packet,
+// with the label and any encryption.
+func (c *Config) packetSize(t messageType, msg interface{}) (int, error) {
+	buf, err := encode(t, msg)
+	if err != nil {
+		return 0, err
+	}
+	size := buf.Len()
+	if c.Label != "" {
+		size += len(addLabelHeaderToPacket(nil, c.Label))
+	}
+	if c.EncryptionEnabled() {
+		if c.AuthenticateOnly {
+			size += authOverhead
+		} else {
+			size = encryptedLength(1, size)
+		}
+	}
+	return size, nil
+}
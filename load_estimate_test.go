@@ -0,0 +1,84 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfig_EstimateLoad(t *testing.T) {
+	c := DefaultLANConfig()
+	if _, err := c.EstimateLoad(0); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// A lone member has nobody to talk to.
+	est, err := c.EstimateLoad(1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if est.PacketsPerSec != 0 || est.BytesPerSec != 0 || est.ConvergenceTime != 0 {
+		t.Fatalf("bad: %#v", est)
+	}
+
+	est, err = c.EstimateLoad(100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if est.ClusterSize != 100 || est.ProbePacketsPerSec != 2 {
+		t.Fatalf("bad: %#v", est)
+	}
+	if est.PacketsPerSec != 2+3/0.2 {
+		t.Fatalf("bad: %#v", est)
+	}
+	if est.SuspicionTimeout != 90*time.Second {
+		t.Fatalf("bad: %v", est.SuspicionTimeout)
+	}
+	if est.ConvergenceTime < time.Second || est.ConvergenceTime > 5*time.Second {
+		t.Fatalf("bad: %v", est.ConvergenceTime)
+	}
+	if est.FalsePositiveProb <= 0 || est.FalsePositiveProb > 1e-6 {
+		t.Fatalf("bad: %v", est.FalsePositiveProb)
+	}
+	if est.FalseSuspicionsPerHour != est.FalsePositiveProb*100*3600 {
+		t.Fatalf("bad: %#v", est)
+	}
+
+	// Bigger clusters sync more state, and take longer to converge.
+	big, err := c.EstimateLoad(1000)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if big.BytesPerSec <= est.BytesPerSec || big.ConvergenceTime <= est.ConvergenceTime {
+		t.Fatalf("bad: %#v", big)
+	}
+
+	// Without TCP pings or indirect checks, false positives are likelier.
+	c.DisableTcpPings = true
+	noTCP, err := c.EstimateLoad(100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.IndirectChecks = 0
+	direct, err := c.EstimateLoad(100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !(est.FalsePositiveProb < noTCP.FalsePositiveProb && noTCP.FalsePositiveProb < direct.FalsePositiveProb) {
+		t.Fatalf("bad: %v %v %v", est.FalsePositiveProb, noTCP.FalsePositiveProb, direct.FalsePositiveProb)
+	}
+
+	// Encryption makes every packet bigger.
+	c = DefaultLANConfig()
+	keyring, err := NewKeyring(nil, make([]byte, 16))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c.Keyring = keyring
+	encrypted, err := c.EstimateLoad(100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if encrypted.BytesPerSec <= est.BytesPerSec || encrypted.PacketsPerSec != est.PacketsPerSec {
+		t.Fatalf("bad: %#v", encrypted)
+	}
+}
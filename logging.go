@@ -2,7 +2,12 @@ package memberlist
 
 import (
 	"fmt"
+	"log"
 	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
 )
 
 func LogAddress(addr net.Addr) string {
@@ -20,3 +25,58 @@ func LogConn(conn net.Conn) string {
 
 	return LogAddress(conn.RemoteAddr())
 }
+
+// packetLogger rate limits the log messages about individual packets, which
+// a port scanner or a misconfigured peer can produce for every packet it
+// sends. At most burst messages are logged per interval, and the number
+// suppressed is logged when the first message of a later interval arrives.
+type packetLogger struct {
+	logger   *log.Logger
+	interval time.Duration
+	burst    int
+
+	lock       sync.Mutex
+	windowEnd  time.Time
+	logged     int
+	suppressed int
+}
+
+// newPacketLogger returns a packetLogger that writes to the given logger.
+func newPacketLogger(logger *log.Logger, interval time.Duration, burst int) *packetLogger {
+	return &packetLogger{
+		logger:   logger,
+		interval: interval,
+		burst:    burst,
+	}
+}
+
+// Printf logs a message if the rate limit allows it.
+func (p *packetLogger) Printf(format string, v ...interface{}) {
+	if p.interval <= 0 {
+		p.logger.Printf(format, v...)
+		return
+	}
+
+	p.lock.Lock()
+	now := time.Now()
+	if now.After(p.windowEnd) {
+		if p.suppressed > 0 {
+			p.logger.Printf("[WARN] memberlist: Suppressed %d packet warnings in the last %v", p.suppressed, p.interval)
+		}
+		p.windowEnd = now.Add(p.interval)
+		p.logged, p.suppressed = 0, 0
+	}
+	allow := p.logged < p.burst
+	if allow {
+		p.logged++
+	} else {
+		p.suppressed++
+	}
+	p.lock.Unlock()
+
+	if allow {
+		p.logger.Printf(format, v...)
+	} else {
+		metrics.IncrCounter([]string{"memberlist", "log", "suppressed"}, 1)
+	}
+}
@@ -1,9 +1,13 @@
 package memberlist
 
 import (
+	"bytes"
 	"fmt"
+	"log"
 	"net"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestLogging_Address(t *testing.T) {
@@ -45,3 +49,57 @@ func TestLogging_Conn(t *testing.T) {
 		t.Fatalf("bad: %s", s)
 	}
 }
+
+func TestPacketLogger_RateLimit(t *testing.T) {
+	var buf bytes.Buffer
+	p := newPacketLogger(log.New(&buf, "", 0), 50*time.Millisecond, 2)
+
+	for i := 0; i < 5; i++ {
+		p.Printf("[ERR] memberlist: bad packet %d", i)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || lines[1] != "[ERR] memberlist: bad packet 1" {
+		t.Fatalf("bad: %q", lines)
+	}
+
+	// The next interval starts by reporting what was suppressed.
+	time.Sleep(60 * time.Millisecond)
+	buf.Reset()
+	p.Printf("[ERR] memberlist: bad packet 5")
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.Contains(lines[0], "Suppressed 3 packet warnings") {
+		t.Fatalf("bad: %q", lines)
+	}
+}
+
+func TestPacketLogger_Unlimited(t *testing.T) {
+	var buf bytes.Buffer
+	p := newPacketLogger(log.New(&buf, "", 0), 0, 0)
+	for i := 0; i < 5; i++ {
+		p.Printf("[ERR] memberlist: bad packet %d", i)
+	}
+	if n := strings.Count(buf.String(), "\n"); n != 5 {
+		t.Fatalf("bad: %d", n)
+	}
+}
+
+func TestMemberlist_PacketLogger(t *testing.T) {
+	var regular, packets bytes.Buffer
+	c := testConfig()
+	c.LogOutput = &regular
+	c.PacketLogger = log.New(&packets, "", 0)
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m.Shutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	m.handleCommand([]byte{255}, from, time.Now(), "")
+	if !strings.Contains(packets.String(), "not supported") {
+		t.Fatalf("bad: %q", packets.String())
+	}
+	if strings.Contains(regular.String(), "not supported") {
+		t.Fatalf("bad: %q", regular.String())
+	}
+}
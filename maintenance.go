@@ -0,0 +1,76 @@
+package memberlist
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Maintenance marks a node as not to be given work, without taking it out
+of the cluster. Unlike a paused node, a node in maintenance carries on
+probing and gossiping, and is probed and suspected like any other, so a
+failure during maintenance is still detected. Only its state changes:
+it's listed with StatusMaintenance, and Config.Maintenance is told as it
+goes in and out, so that load balancers and the like can stop routing to
+it without needing a convention for the node's metadata.
+
+The state travels as a flag on alive messages, with a new incarnation
+each time it changes. Older members ignore the flag and see the node as
+alive.
+*/
+
+// EnterMaintenance puts us into maintenance and tells the cluster. Like
+// UpdateNode, it waits for the news to go out, for as long as the timeout
+// allows or forever if it's zero, and returns ErrUpdateTimeout if it
+// doesn't.
+func (m *Memberlist) EnterMaintenance(timeout time.Duration) error {
+	return m.setMaintenance(true, timeout)
+}
+
+// ExitMaintenance takes us out of maintenance and tells the cluster,
+// waiting for the news to go out as EnterMaintenance does.
+func (m *Memberlist) ExitMaintenance(timeout time.Duration) error {
+	return m.setMaintenance(false, timeout)
+}
+
+// InMaintenance returns true if we're in maintenance.
+func (m *Memberlist) InMaintenance() bool {
+	return atomic.LoadUint32(&m.maintenance) == 1
+}
+
+// MemberStatus returns the status of the named member, and false if we
+// don't know of it.
+func (m *Memberlist) MemberStatus(name string) (NodeStatus, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	state, ok := m.nodeMap[name]
+	if !ok {
+		return 0, false
+	}
+	return NodeStatus(state.State), true
+}
+
+func (m *Memberlist) setMaintenance(on bool, timeout time.Duration) error {
+	var flag uint32
+	if on {
+		flag = 1
+	}
+	if atomic.SwapUint32(&m.maintenance, flag) == flag {
+		return nil
+	}
+	if on {
+		metrics.IncrCounter([]string{"memberlist", "maintenance", "enter"}, 1)
+		m.logger.Printf("[INFO] memberlist: Entering maintenance")
+	} else {
+		metrics.IncrCounter([]string{"memberlist", "maintenance", "exit"}, 1)
+		m.logger.Printf("[INFO] memberlist: Leaving maintenance")
+	}
+
+	notifyCh, err := m.announceLocal(m.Paused())
+	if err != nil {
+		return err
+	}
+	return m.waitBroadcast(notifyCh, timeout)
+}
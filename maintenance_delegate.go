@@ -0,0 +1,10 @@
+package memberlist
+
+// MaintenanceDelegate is used to find out when nodes go into and come out
+// of maintenance, for example to stop routing traffic to them.
+type MaintenanceDelegate interface {
+	// NotifyMaintenance is invoked when a node enters maintenance, with
+	// entered set, or leaves it. A node that's suspected while in
+	// maintenance and then refutes it may be reported as entering again.
+	NotifyMaintenance(node *Node, entered bool)
+}
@@ -0,0 +1,155 @@
+package memberlist
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type maintenanceEvent struct {
+	node    string
+	entered bool
+}
+
+type testMaintenanceDelegate struct {
+	ch chan maintenanceEvent
+}
+
+func (d *testMaintenanceDelegate) NotifyMaintenance(node *Node, entered bool) {
+	d.ch <- maintenanceEvent{node.Name, entered}
+}
+
+func TestMemberlist_Maintenance(t *testing.T) {
+	d := &testMaintenanceDelegate{ch: make(chan maintenanceEvent, 16)}
+	c1 := testConfig()
+	c1.GossipInterval = 5 * time.Millisecond
+	c1.Maintenance = d
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.GossipInterval = 5 * time.Millisecond
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	expect := func(entered bool, status NodeStatus) {
+		select {
+		case e := <-d.ch:
+			if e.node != c2.Name || e.entered != entered {
+				t.Fatalf("bad event: %+v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for maintenance event")
+		}
+		if got, ok := m1.MemberStatus(c2.Name); !ok || got != status {
+			t.Fatalf("expected %s, got %s", status, got)
+		}
+	}
+
+	if err := m2.EnterMaintenance(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !m2.InMaintenance() {
+		t.Fatalf("should be in maintenance")
+	}
+	if got, _ := m2.MemberStatus(c2.Name); got != StatusMaintenance {
+		t.Fatalf("expected maintenance, got %s", got)
+	}
+	expect(true, StatusMaintenance)
+
+	// It still takes part in gossip.
+	m1.nodeLock.RLock()
+	nodes := kRandomNodes(1, []string{c1.Name}, m1.nodes)
+	m1.nodeLock.RUnlock()
+	if len(nodes) != 1 || nodes[0].Name != c2.Name {
+		t.Fatalf("node in maintenance should be a gossip target: %v", nodes)
+	}
+
+	if err := m2.ExitMaintenance(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expect(false, StatusAlive)
+
+	if _, ok := m1.MemberStatus("nope"); ok {
+		t.Fatalf("unknown node should not have a status")
+	}
+}
+
+func TestMemberlist_SendLocalState_OldPeer(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	for _, a := range []alive{
+		{Node: "paused", Addr: []byte{127, 0, 0, 2}, Port: 7946, Incarnation: 1, Paused: true},
+		{Node: "maint", Addr: []byte{127, 0, 0, 3}, Port: 7946, Incarnation: 1, Maintenance: true},
+	} {
+		a := a
+		m.aliveNode(&a, nil, false)
+	}
+
+	states := func(pmax uint8) map[string]nodeStateType {
+		client, server := net.Pipe()
+		defer client.Close()
+		defer server.Close()
+		errCh := make(chan error, 1)
+		go func() { errCh <- m.sendLocalState(client, false, pmax) }()
+
+		msgType, bufConn, dec, err := m.readTCP(server)
+		if err != nil || msgType != pushPullMsg {
+			t.Fatalf("bad: %v %v", msgType, err)
+		}
+		_, remote, _, err := m.readPushPull(bufConn, dec)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := <-errCh; err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out := make(map[string]nodeStateType)
+		for _, r := range remote {
+			out[r.Name] = r.State
+		}
+		return out
+	}
+
+	// Older versions drop states they don't know, so they're told alive.
+	old := states(5)
+	if old["paused"] != stateAlive || old["maint"] != stateAlive {
+		t.Fatalf("bad: %v", old)
+	}
+	cur := states(6)
+	if cur["paused"] != statePaused || cur["maint"] != stateMaintenance {
+		t.Fatalf("bad: %v", cur)
+	}
+}
+
+func TestMemberlist_MarkUnhealthy_Maintenance(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Maintenance: true}
+	m.aliveNode(&a, nil, false)
+
+	// A node in maintenance can be held suspect too, and goes back to
+	// maintenance once the override is over.
+	if err := m.MarkUnhealthy("test", "probe", 20*time.Millisecond); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, _ := m.MemberStatus("test"); got != StatusSuspect {
+		t.Fatalf("expected suspect, got %s", got)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got, _ := m.MemberStatus("test"); got != StatusMaintenance {
+		t.Fatalf("expected maintenance, got %s", got)
+	}
+}
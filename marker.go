@@ -0,0 +1,226 @@
+package memberlist
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Markers measure how long gossip really takes to reach the whole cluster.
+SendMarker broadcasts a marker stamped with our clock and a hop count of
+zero. Every node that hears it for the first time sends a receipt straight
+back to us, bumps the hop count and rebroadcasts it, exactly as it would
+an alive or dead message. The receipts we collect form the report.
+
+Latencies are measured by each receiver against the time on our clock in
+the marker, so they're only as accurate as the clocks are in sync. Members
+running a version without markers log and drop them.
+*/
+
+const (
+	// maxMarkerReports is how many of our own markers we keep reports for.
+	maxMarkerReports = 16
+
+	// maxSeenMarkers is how many marker IDs we remember so that we only
+	// handle and rebroadcast each marker once.
+	maxSeenMarkers = 256
+)
+
+// marker is broadcast to trace the spread of gossip through the cluster.
+type marker struct {
+	ID     string `codec:"ID"`
+	Origin string `codec:"Origin"`
+	Sent   int64  `codec:"Sent"` // Unix nanoseconds on the origin's clock
+	Hops   uint8  `codec:"Hops"`
+}
+
+// markerReceipt is sent back to a marker's origin by each node that
+// receives it.
+type markerReceipt struct {
+	ID      string `codec:"ID"`
+	Node    string `codec:"Node"`
+	Hops    uint8  `codec:"Hops"`
+	Latency int64  `codec:"Latency"` // Nanoseconds from Sent until it was received
+}
+
+// MarkerReceipt records a single node hearing about a marker.
+type MarkerReceipt struct {
+	Node string
+
+	// Hops is the number of nodes the marker was gossiped through before
+	// reaching this one, not counting us.
+	Hops int
+
+	// Latency is the time from sending the marker until the node heard
+	// about it.
+	Latency time.Duration
+}
+
+// MarkerReport is the set of receipts for a marker we sent.
+type MarkerReport struct {
+	ID   string
+	Sent time.Time
+
+	// Receipts are sorted by latency, so the last entry says how long it
+	// took to reach every node that has replied.
+	Receipts []MarkerReceipt
+}
+
+// markerState tracks the markers we've sent and seen.
+type markerState struct {
+	sync.Mutex
+	reports map[string]*MarkerReport
+	sent    []string // Our marker IDs, oldest first
+	seen    map[string]struct{}
+	order   []string // Seen marker IDs, oldest first
+}
+
+// markSeen records a marker ID, returning false if it was already seen.
+// The lock must be held.
+func (s *markerState) markSeen(id string) bool {
+	if _, ok := s.seen[id]; ok {
+		return false
+	}
+	if s.seen == nil {
+		s.seen = make(map[string]struct{})
+	}
+	s.seen[id] = struct{}{}
+	s.order = append(s.order, id)
+	if len(s.order) > maxSeenMarkers {
+		delete(s.seen, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// SendMarker broadcasts a new marker to the cluster and returns its ID.
+// Receipts arrive as the marker spreads, and can be read at any time
+// with MarkerReport.
+func (m *Memberlist) SendMarker() (string, error) {
+	select {
+	case <-m.shutdownCh:
+		return "", ErrShutdown
+	default:
+	}
+
+	now := time.Now()
+	mk := marker{
+		ID:     fmt.Sprintf("%s-%d", m.config.Name, m.nextSeqNo()),
+		Origin: m.config.Name,
+		Sent:   now.UnixNano(),
+	}
+
+	m.markers.Lock()
+	if m.markers.reports == nil {
+		m.markers.reports = make(map[string]*MarkerReport)
+	}
+	m.markers.markSeen(mk.ID)
+	m.markers.reports[mk.ID] = &MarkerReport{ID: mk.ID, Sent: now}
+	m.markers.sent = append(m.markers.sent, mk.ID)
+	if len(m.markers.sent) > maxMarkerReports {
+		delete(m.markers.reports, m.markers.sent[0])
+		m.markers.sent = m.markers.sent[1:]
+	}
+	m.markers.Unlock()
+
+	m.encodeAndBroadcast(markerKey(mk.ID), markerMsg, &mk)
+	return mk.ID, nil
+}
+
+// MarkerReport returns the receipts collected so far for a marker we
+// sent. It returns false if the ID is unknown, or the marker is too old
+// to still be tracked.
+func (m *Memberlist) MarkerReport(id string) (MarkerReport, bool) {
+	m.markers.Lock()
+	defer m.markers.Unlock()
+
+	report, ok := m.markers.reports[id]
+	if !ok {
+		return MarkerReport{}, false
+	}
+	out := *report
+	out.Receipts = make([]MarkerReceipt, len(report.Receipts))
+	copy(out.Receipts, report.Receipts)
+	return out, true
+}
+
+// markerKey is the broadcast key for a marker, so that its rebroadcasts
+// don't invalidate messages about a node.
+func markerKey(id string) string {
+	return "marker:" + id
+}
+
+func (m *Memberlist) handleMarker(buf []byte, from net.Addr) {
+	var mk marker
+	if err := decode(buf, &mk); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode marker: %s %s", err, LogAddress(from))
+		return
+	}
+
+	m.markers.Lock()
+	first := m.markers.markSeen(mk.ID)
+	m.markers.Unlock()
+	if !first {
+		return
+	}
+
+	latency := time.Since(time.Unix(0, mk.Sent))
+	metrics.AddSample([]string{"memberlist", "marker", "latency"}, float32(latency)/float32(time.Millisecond))
+	metrics.AddSample([]string{"memberlist", "marker", "hops"}, float32(mk.Hops))
+
+	// Tell the origin we got it.
+	m.nodeLock.RLock()
+	origin, ok := m.nodeMap[mk.Origin]
+	var addr net.Addr
+	if ok {
+		addr = &net.UDPAddr{IP: origin.Addr, Port: int(origin.Port)}
+	}
+	m.nodeLock.RUnlock()
+	if ok {
+		receipt := markerReceipt{ID: mk.ID, Node: m.config.Name, Hops: mk.Hops, Latency: int64(latency)}
+		if err := m.encodeAndSendMsg(addr, markerReceiptMsg, &receipt); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send marker receipt: %s", err)
+		}
+	}
+
+	// Pass it on.
+	if mk.Hops < math.MaxUint8 {
+		mk.Hops++
+	}
+	m.encodeAndBroadcast(markerKey(mk.ID), markerMsg, &mk)
+}
+
+func (m *Memberlist) handleMarkerReceipt(buf []byte, from net.Addr) {
+	var receipt markerReceipt
+	if err := decode(buf, &receipt); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode marker receipt: %s %s", err, LogAddress(from))
+		return
+	}
+
+	m.markers.Lock()
+	defer m.markers.Unlock()
+
+	report, ok := m.markers.reports[receipt.ID]
+	if !ok {
+		return
+	}
+	for _, r := range report.Receipts {
+		if r.Node == receipt.Node {
+			return
+		}
+	}
+	report.Receipts = append(report.Receipts, MarkerReceipt{
+		Node:    receipt.Node,
+		Hops:    int(receipt.Hops),
+		Latency: time.Duration(receipt.Latency),
+	})
+	sort.SliceStable(report.Receipts, func(i, j int) bool {
+		return report.Receipts[i].Latency < report.Receipts[j].Latency
+	})
+}
@@ -0,0 +1,121 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_SendMarker(t *testing.T) {
+	m1, addr1 := joinTestNode(t)
+	defer m1.Shutdown()
+	m2, _ := joinTestNode(t)
+	defer m2.Shutdown()
+	m3, _ := joinTestNode(t)
+	defer m3.Shutdown()
+
+	for _, m := range []*Memberlist{m2, m3} {
+		if _, err := m.Join([]string{addr1}); err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+	}
+
+	id, err := m1.SendMarker()
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	var report MarkerReport
+	for i := 0; i < 100; i++ {
+		var ok bool
+		if report, ok = m1.MarkerReport(id); !ok {
+			t.Fatalf("missing report for %s", id)
+		}
+		if len(report.Receipts) == 2 {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if len(report.Receipts) != 2 {
+		t.Fatalf("bad: %v", report.Receipts)
+	}
+	seen := make(map[string]bool)
+	for _, r := range report.Receipts {
+		if r.Latency < 0 || r.Hops > 1 {
+			t.Fatalf("bad: %#v", r)
+		}
+		seen[r.Node] = true
+	}
+	if !seen[m2.config.Name] || !seen[m3.config.Name] {
+		t.Fatalf("bad: %v", report.Receipts)
+	}
+
+	if _, ok := m2.MarkerReport(id); ok {
+		t.Fatalf("only the origin should have a report")
+	}
+}
+
+func TestMemberlist_MarkerReceipts(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	id, err := m.SendMarker()
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7946}
+	receipts := []markerReceipt{
+		{ID: id, Node: "slow", Hops: 2, Latency: int64(30 * time.Millisecond)},
+		{ID: id, Node: "fast", Hops: 0, Latency: int64(10 * time.Millisecond)},
+		{ID: id, Node: "fast", Hops: 1, Latency: int64(20 * time.Millisecond)},
+		{ID: "unknown", Node: "other"},
+	}
+	for _, r := range receipts {
+		buf, err := encode(markerReceiptMsg, &r)
+		if err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+		m.handleCommand(buf.Bytes(), from, time.Now(), "")
+	}
+
+	report, ok := m.MarkerReport(id)
+	if !ok {
+		t.Fatalf("missing report")
+	}
+	if len(report.Receipts) != 2 {
+		t.Fatalf("bad: %v", report.Receipts)
+	}
+	if r := report.Receipts[0]; r.Node != "fast" || r.Hops != 0 || r.Latency != 10*time.Millisecond {
+		t.Fatalf("bad: %#v", r)
+	}
+	if r := report.Receipts[1]; r.Node != "slow" || r.Hops != 2 {
+		t.Fatalf("bad: %#v", r)
+	}
+
+	// Only the most recent reports are kept.
+	for i := 0; i < maxMarkerReports; i++ {
+		if _, err := m.SendMarker(); err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+	}
+	if _, ok := m.MarkerReport(id); ok {
+		t.Fatalf("report should have been dropped")
+	}
+}
+
+func TestMarkerState_MarkSeen(t *testing.T) {
+	var s markerState
+	if !s.markSeen("a") || s.markSeen("a") {
+		t.Fatalf("should only see a marker once")
+	}
+	for i := 0; i < maxSeenMarkers; i++ {
+		s.markSeen(fmt.Sprintf("m%d", i))
+	}
+	if len(s.seen) != maxSeenMarkers || len(s.order) != maxSeenMarkers {
+		t.Fatalf("bad: %d %d", len(s.seen), len(s.order))
+	}
+	if !s.markSeen("a") {
+		t.Fatalf("oldest marker should have been forgotten")
+	}
+}
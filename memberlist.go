@@ -15,6 +15,7 @@ multiple routes.
 package memberlist
 
 import (
+	"encoding/binary"
 	"fmt"
 	"log"
 	"net"
@@ -22,32 +23,116 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/hashicorp/go-multierror"
+	"github.com/armon/go-metrics"
+	"github.com/hashicorp/memberlist/coordinate"
 	"github.com/miekg/dns"
 )
 
 type Memberlist struct {
+	userSeqNum  uint64 // Sequence number of BroadcastSequenced messages, first for 64-bit alignment
+	treeSeqNum  uint64 // Sequence number of BroadcastTree messages, seeded from the clock
 	sequenceNum uint32 // Local sequence number
 	incarnation uint32 // Local incarnation number
 	numNodes    uint32 // Number of known nodes (estimate)
+	maintenance uint32 // Set while we're in maintenance
 
 	config         *Config
+	tunables       atomic.Value // *Tunables, the part of config that can change
+	lifecycle      LifecycleState
 	shutdown       bool
 	shutdownCh     chan struct{}
+	shutdownDoneCh chan struct{}
+	shutdownStats  ShutdownStats
 	leave          bool
 	leaveBroadcast chan struct{}
+	leaveDoneCh    chan struct{}
+	leaveErr       error
 
+	listenLock  sync.RWMutex // Guards the listeners, which Rebind replaces
 	udpListener *net.UDPConn
+	udpOffload  udpOffload
 	tcpListener *net.TCPListener
 	handoff     chan msgHandoff
+	routed      *routerInstance // Set when sharing a Router
 
-	nodeLock   sync.RWMutex
-	nodes      []*nodeState          // Known nodes
-	nodeMap    map[string]*nodeState // Maps Addr.String() -> NodeState
-	nodeTimers map[string]*suspicion // Maps Addr.String() -> suspicion timer
-	awareness  *awareness
+	mcastListener *net.UDPConn
+	mcastAddr     *net.UDPAddr
+	lastAnnounce  time.Time // Only touched by gossip
+
+	nodeLock     sync.RWMutex
+	nodes        []*nodeState          // Known nodes
+	nodeMap      map[string]*nodeState // Maps Addr.String() -> NodeState
+	nodeTimers   map[string]*suspicion // Maps Addr.String() -> suspicion timer
+	coordinator  string                // Name of the last coordinator notified
+	awareness    *awareness
+	aliveLimit   *aliveLimiter
+	stateLimit   *rateLimiter
+	joinLimit    *rateLimiter
+	misbehavior  misbehaviorState
+	decryptFails decryptFailures
+	caps         capabilityState
+	nonces       nonceSource
+	passphrase   *passphraseState
+	dedup        *dedupCache
+	delegates    *delegatePool
+	events       *eventQueues
+	inflight     inflight
+
+	peers *peerCache
+
+	coords     *coordinate.Client
+	coordLock  sync.Mutex
+	coordCache map[string]*coordinate.Coordinate // Latest coordinate from each node
+
+	reachLock sync.Mutex
+	reach     map[reachPair]*PairReachability
+
+	peerLabelLock sync.RWMutex
+	peerLabels    map[string]string // Maps Addr.String() -> label to send
+
+	markers markerState
+
+	piggyLock sync.Mutex
+	piggy     PiggybackStats
+
+	scale scaleState
+
+	bans banList
+
+	propagation localPropagation
+
+	overrides healthOverrides
+
+	passive passiveView
+
+	tree treeState
+
+	userDedup userDedup
+
+	leaveQuorum leaveQuorum
+
+	gossipHealth gossipHealth
+
+	congestion gossipCongestion
+
+	suggested suggestions
+
+	heard    heardPeers
+	contacts contacts
+
+	tuning tuningStats
+
+	tasks taskTracker
+
+	content      contentStore
+	contentPulls chan struct{} // Semaphore for payload pulls
+
+	ackPayloads ackPayloads
+
+	transports peerTransports
 
 	tickerLock sync.Mutex
 	tickers    []*time.Ticker
@@ -56,10 +141,12 @@ type Memberlist struct {
 
 	ackLock     sync.Mutex
 	ackHandlers map[uint32]*ackHandler
+	ackWheel    ackWheel
 
 	broadcasts *TransmitLimitedQueue
 
-	logger *log.Logger
+	logger    *log.Logger
+	packetLog *packetLogger
 }
 
 // newMemberlist creates the network listeners.
@@ -73,46 +160,129 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 			conf.ProtocolVersion, ProtocolVersionMin, ProtocolVersionMax)
 	}
 
-	if len(conf.SecretKey) > 0 {
+	if err := checkFIPS(conf); err != nil {
+		return nil, err
+	}
+	nonces, err := newNonceSource(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	secretKey := conf.SecretKey
+	var passphrase *passphraseState
+	if len(conf.Passphrase) > 0 {
+		if passphrase, err = passphraseKey(conf); err != nil {
+			return nil, err
+		}
+		secretKey = passphrase.key
+	}
+
+	if len(secretKey) > 0 {
 		if conf.Keyring == nil {
-			keyring, err := NewKeyring(nil, conf.SecretKey)
+			keyring, err := NewKeyring(nil, secretKey)
 			if err != nil {
 				return nil, err
 			}
 			conf.Keyring = keyring
 		} else {
-			if err := conf.Keyring.AddKey(conf.SecretKey); err != nil {
+			if err := conf.Keyring.AddKey(secretKey); err != nil {
 				return nil, err
 			}
-			if err := conf.Keyring.UseKey(conf.SecretKey); err != nil {
+			if err := conf.Keyring.UseKey(secretKey); err != nil {
 				return nil, err
 			}
 		}
 	}
+	if conf.SealUserMessages && !conf.EncryptionEnabled() {
+		return nil, fmt.Errorf("Sealing user messages requires a keyring")
+	}
 
-	tcpAddr := &net.TCPAddr{IP: net.ParseIP(conf.BindAddr), Port: conf.BindPort}
-	tcpLn, err := net.ListenTCP("tcp", tcpAddr)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to start TCP listener. Err: %s", err)
+	if err := validateLabel(conf.Label); err != nil {
+		return nil, err
 	}
-	if conf.BindPort == 0 {
-		conf.BindPort = tcpLn.Addr().(*net.TCPAddr).Port
+	if conf.Router != nil && conf.Label == "" {
+		return nil, fmt.Errorf("A label is required when using a shared router")
 	}
-
-	udpAddr := &net.UDPAddr{IP: net.ParseIP(conf.BindAddr), Port: conf.BindPort}
-	udpLn, err := net.ListenUDP("udp", udpAddr)
-	if err != nil {
-		tcpLn.Close()
-		return nil, fmt.Errorf("Failed to start UDP listener. Err: %s", err)
+	for _, label := range conf.AcceptLabels {
+		if err := validateLabel(label); err != nil {
+			return nil, err
+		}
+		if conf.Router != nil && label == "" {
+			return nil, fmt.Errorf("A label is required when using a shared router")
+		}
+	}
+	if conf.LeaveQuorum < 0 || conf.LeaveQuorum > 1 {
+		return nil, fmt.Errorf("LeaveQuorum must be between 0 and 1")
+	}
+	if conf.PartialView && conf.ActiveViewSize < 1 {
+		return nil, fmt.Errorf("Partial view mode needs an active view of at least one node")
+	}
+	if conf.Router != nil && conf.MulticastAddr != "" {
+		return nil, fmt.Errorf("Multicast gossip is not supported with a shared router")
+	}
+	if conf.Router != nil && conf.AcceptProxyProtocol {
+		return nil, fmt.Errorf("Accepting the PROXY protocol is not supported with a shared router")
 	}
-
-	// Set the UDP receive window size
-	setUDPRecvBuf(udpLn)
 
 	if conf.LogOutput != nil && conf.Logger != nil {
 		return nil, fmt.Errorf("Cannot specify both LogOutput and Logger. Please choose a single log configuration setting.")
 	}
 
+	var peers *peerCache
+	if conf.PeerCachePath != "" {
+		peers = newPeerCache(conf.PeerCachePath, conf.PeerCacheMaxAge)
+	}
+
+	var coords *coordinate.Client
+	if conf.CoordinateConfig != nil {
+		var err error
+		coords, err = coordinate.NewClient(conf.CoordinateConfig)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid coordinate config: %v", err)
+		}
+	}
+
+	var tcpLn *net.TCPListener
+	var udpLn, mcastLn *net.UDPConn
+	var mcastAddr *net.UDPAddr
+	if conf.Router != nil {
+		// Borrow the router's listeners, which are only used for sending
+		// and for finding our bound address.
+		tcpLn = conf.Router.tcpListener
+		udpLn = conf.Router.udpListener
+		conf.BindAddr = conf.Router.Addr().IP.String()
+		conf.BindPort = conf.Router.Addr().Port
+	} else {
+		tcpAddr := &net.TCPAddr{IP: net.ParseIP(conf.BindAddr), Port: conf.BindPort}
+		var err error
+		tcpLn, err = net.ListenTCP("tcp", tcpAddr)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to start TCP listener. Err: %s", err)
+		}
+		if conf.BindPort == 0 {
+			conf.BindPort = tcpLn.Addr().(*net.TCPAddr).Port
+		}
+
+		udpAddr := &net.UDPAddr{IP: net.ParseIP(conf.BindAddr), Port: conf.BindPort}
+		udpLn, err = net.ListenUDP("udp", udpAddr)
+		if err != nil {
+			tcpLn.Close()
+			return nil, fmt.Errorf("Failed to start UDP listener. Err: %s", err)
+		}
+
+		// Set the UDP receive window size
+		setUDPRecvBuf(udpLn)
+
+		if conf.MulticastAddr != "" {
+			mcastLn, mcastAddr, err = listenMulticast(conf.MulticastAddr, conf.MulticastInterface)
+			if err != nil {
+				tcpLn.Close()
+				udpLn.Close()
+				return nil, fmt.Errorf("Failed to join multicast group. Err: %s", err)
+			}
+		}
+	}
+
 	logDest := conf.LogOutput
 	if logDest == nil {
 		logDest = os.Stderr
@@ -122,26 +292,87 @@ func newMemberlist(conf *Config) (*Memberlist, error) {
 	if logger == nil {
 		logger = log.New(logDest, "", log.LstdFlags)
 	}
+	packetLogger := conf.PacketLogger
+	if packetLogger == nil {
+		packetLogger = logger
+	}
 
 	m := &Memberlist{
 		config:         conf,
 		shutdownCh:     make(chan struct{}),
+		shutdownDoneCh: make(chan struct{}),
 		leaveBroadcast: make(chan struct{}, 1),
+		leaveDoneCh:    make(chan struct{}),
+		contentPulls:   make(chan struct{}, maxContentPulls),
 		udpListener:    udpLn,
 		tcpListener:    tcpLn,
+		mcastListener:  mcastLn,
+		mcastAddr:      mcastAddr,
 		handoff:        make(chan msgHandoff, 1024),
 		nodeMap:        make(map[string]*nodeState),
 		nodeTimers:     make(map[string]*suspicion),
 		awareness:      newAwareness(conf.AwarenessMaxMultiplier),
+		aliveLimit:     newAliveLimiter(conf.AliveCoalesceInterval),
+		stateLimit:     newRateLimiter(conf.MaxStateMsgRate, conf.StateMsgBurst),
+		joinLimit:      newRateLimiter(conf.MaxJoinRate, conf.JoinBurst),
+		dedup:          newDedupCache(conf.DedupInterval),
+		nonces:         nonces,
+		passphrase:     passphrase,
+		coords:         coords,
+		peers:          peers,
+		coordCache:     make(map[string]*coordinate.Coordinate),
+		treeSeqNum:     uint64(time.Now().UnixNano()),
 		ackHandlers:    make(map[uint32]*ackHandler),
-		broadcasts:     &TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult},
+		broadcasts:     &TransmitLimitedQueue{RetransmitMult: conf.RetransmitMult, Relayed: true},
 		logger:         logger,
+		packetLog:      newPacketLogger(packetLogger, conf.PacketLogInterval, conf.PacketLogBurst),
 	}
+	tunables := conf.tunables()
+	m.tunables.Store(&tunables)
 	m.broadcasts.NumNodes = func() int {
 		return m.estNumNodes()
 	}
-	go m.tcpListen()
-	go m.udpListen()
+	if conf.EnableUDPOffload && conf.Router == nil {
+		off, err := enableUDPOffload(udpLn)
+		if err != nil {
+			logger.Printf("[WARN] memberlist: Failed to enable UDP offload: %s", err)
+		}
+		m.udpOffload = off
+	}
+	if conf.EnableECN && conf.Router == nil {
+		if err := enableECN(udpLn); err != nil {
+			logger.Printf("[WARN] memberlist: Failed to enable ECN: %s", err)
+		} else {
+			m.udpOffload.ecn = true
+		}
+	}
+	if conf.MisbehaviorThreshold > 0 && !conf.EncryptionEnabled() {
+		logger.Printf("[WARN] memberlist: Quarantine is enabled without encryption, so forged packets can get peers quarantined")
+	}
+	if conf.ReplyToAdvertiseAddr && !conf.EncryptionEnabled() {
+		logger.Printf("[WARN] memberlist: ReplyToAdvertiseAddr is ignored without encryption")
+	}
+	if conf.DelegateWorkers > 0 {
+		m.delegates = newDelegatePool(conf.DelegateWorkers, conf.DelegateQueueDepth, logger)
+	}
+	if conf.EventQueueDepth > 0 {
+		m.events = newEventQueues(conf.Events, conf.EventsV2, conf.EventQueueDepth, logger)
+	}
+	m.auditKeys()
+
+	// With a shared router, the router runs the listeners and hands us
+	// our traffic.
+	if conf.Router != nil {
+		if err := conf.Router.register(m); err != nil {
+			return nil, err
+		}
+	} else {
+		go m.tcpListen(m.tcpListener)
+		go m.udpListen(m.udpListener)
+		if m.mcastListener != nil {
+			go m.udpListen(m.mcastListener)
+		}
+	}
 	go m.udpHandler()
 	return m, nil
 }
@@ -170,36 +401,17 @@ func Create(conf *Config) (*Memberlist, error) {
 // remote nodes to become aware of the existence of this node, effectively
 // joining the cluster.
 //
+// If none of the hosts can be reached and Config.PeerCachePath is set, the
+// peers we last saw alive are tried instead.
+//
 // This returns the number of hosts successfully contacted and an error if
 // none could be reached. If an error is returned, the node did not successfully
-// join the cluster.
+// join the cluster. The error is a *JoinError holding the reason each host
+// failed, which errors.Is and errors.As can look through. Use
+// JoinWithOptions for the outcome of each host, or to retry them.
 func (m *Memberlist) Join(existing []string) (int, error) {
-	numSuccess := 0
-	var errs error
-	for _, exist := range existing {
-		addrs, err := m.resolveAddr(exist)
-		if err != nil {
-			err = fmt.Errorf("Failed to resolve %s: %v", exist, err)
-			errs = multierror.Append(errs, err)
-			m.logger.Printf("[WARN] memberlist: %v", err)
-			continue
-		}
-
-		for _, addr := range addrs {
-			if err := m.pushPullNode(addr.ip, addr.port, true); err != nil {
-				err = fmt.Errorf("Failed to join %s: %v", addr.ip, err)
-				errs = multierror.Append(errs, err)
-				m.logger.Printf("[DEBUG] memberlist: %v", err)
-				continue
-			}
-			numSuccess++
-		}
-
-	}
-	if numSuccess > 0 {
-		errs = nil
-	}
-	return numSuccess, errs
+	results, err := m.JoinWithOptions(existing, JoinOptions{})
+	return joinedCount(results), err
 }
 
 // ipPort holds information about a node we want to try to join.
@@ -326,14 +538,45 @@ func (m *Memberlist) resolveAddr(hostStr string) ([]ipPort, error) {
 // as if we received an alive notification our own network channel for
 // ourself.
 func (m *Memberlist) setAlive() error {
+	advertiseAddr, advertisePort, err := m.advertiseAddr(m.config.BindAddr, m.config.AdvertiseAddr, m.config.AdvertisePort, m.streamListener())
+	if err != nil {
+		return err
+	}
+
+	// Get the node meta data
+	var meta []byte
+	if m.config.Delegate != nil {
+		meta = m.config.Delegate.NodeMeta(MetaMaxSize)
+		if len(meta) > MetaMaxSize {
+			panic("Node meta data provided is longer than the limit")
+		}
+	}
+
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        m.config.Name,
+		Addr:        advertiseAddr,
+		Port:        uint16(advertisePort),
+		Meta:        meta,
+		Vsn:         m.localVsn(),
+	}
+	m.aliveNode(&a, nil, true)
+
+	return nil
+}
+
+// advertiseAddr returns the address and port to advertise for ourselves,
+// given the address to advertise, if any, or else the address the given
+// listener is bound to.
+func (m *Memberlist) advertiseAddr(bindAddr, advertise string, port int, ln *net.TCPListener) (net.IP, int, error) {
 	var advertiseAddr []byte
 	var advertisePort int
-	if m.config.AdvertiseAddr != "" {
+	if advertise != "" {
 		// If AdvertiseAddr is not empty, then advertise
 		// the given address and port.
-		ip := net.ParseIP(m.config.AdvertiseAddr)
+		ip := net.ParseIP(advertise)
 		if ip == nil {
-			return fmt.Errorf("Failed to parse advertise address!")
+			return nil, 0, fmt.Errorf("Failed to parse advertise address!")
 		}
 
 		// Ensure IPv4 conversion if necessary
@@ -342,15 +585,15 @@ func (m *Memberlist) setAlive() error {
 		}
 
 		advertiseAddr = ip
-		advertisePort = m.config.AdvertisePort
+		advertisePort = port
 	} else {
-		if m.config.BindAddr == "0.0.0.0" {
+		if bindAddr == "0.0.0.0" {
 			// Otherwise, if we're not bound to a specific IP,
 			//let's list the interfaces on this machine and use
 			// the first private IP we find.
 			addresses, err := net.InterfaceAddrs()
 			if err != nil {
-				return fmt.Errorf("Failed to get interface addresses! Err: %v", err)
+				return nil, 0, fmt.Errorf("Failed to get interface addresses! Err: %v", err)
 			}
 
 			// Find private IPv4 address
@@ -378,17 +621,17 @@ func (m *Memberlist) setAlive() error {
 
 			// Failed to find private IP, error
 			if advertiseAddr == nil {
-				return fmt.Errorf("No private IP address found, and explicit IP not provided")
+				return nil, 0, fmt.Errorf("No private IP address found, and explicit IP not provided")
 			}
 
 		} else {
 			// Use the IP that we're bound to.
-			addr := m.tcpListener.Addr().(*net.TCPAddr)
+			addr := ln.Addr().(*net.TCPAddr)
 			advertiseAddr = addr.IP
 		}
 
 		// Use the port we are bound to.
-		advertisePort = m.tcpListener.Addr().(*net.TCPAddr).Port
+		advertisePort = ln.Addr().(*net.TCPAddr).Port
 	}
 
 	// Check if this is a public address without encryption
@@ -396,46 +639,43 @@ func (m *Memberlist) setAlive() error {
 	if !IsPrivateIP(addrStr) && !isLoopbackIP(addrStr) && !m.config.EncryptionEnabled() {
 		m.logger.Printf("[WARN] memberlist: Binding to public address without encryption!")
 	}
+	return advertiseAddr, advertisePort, nil
+}
 
-	// Get the node meta data
-	var meta []byte
-	if m.config.Delegate != nil {
-		meta = m.config.Delegate.NodeMeta(MetaMaxSize)
-		if len(meta) > MetaMaxSize {
-			panic("Node meta data provided is longer than the limit")
-		}
-	}
-
-	a := alive{
-		Incarnation: m.nextIncarnation(),
-		Node:        m.config.Name,
-		Addr:        advertiseAddr,
-		Port:        uint16(advertisePort),
-		Meta:        meta,
-		Vsn: []uint8{
-			ProtocolVersionMin, ProtocolVersionMax, m.config.ProtocolVersion,
-			m.config.DelegateProtocolMin, m.config.DelegateProtocolMax,
-			m.config.DelegateProtocolVersion,
-		},
+// localVsn returns the protocol and delegate versions we advertise.
+func (m *Memberlist) localVsn() []uint8 {
+	return []uint8{
+		ProtocolVersionMin, ProtocolVersionMax, m.config.ProtocolVersion,
+		m.config.DelegateProtocolMin, m.config.DelegateProtocolMax,
+		m.config.DelegateProtocolVersion,
 	}
-	m.aliveNode(&a, nil, true)
-
-	return nil
 }
 
-// LocalNode is used to return the local Node
+// LocalNode is used to return the local Node. It's a copy, which reflects
+// any update made by UpdateNode once that has returned.
 func (m *Memberlist) LocalNode() *Node {
 	m.nodeLock.RLock()
 	defer m.nodeLock.RUnlock()
-	state := m.nodeMap[m.config.Name]
-	return &state.Node
+	node := m.nodeMap[m.config.Name].Node
+	return &node
+}
+
+// LocalIncarnation returns the incarnation number the local node is
+// currently advertising, which goes up with every update.
+func (m *Memberlist) LocalIncarnation() uint32 {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	return m.nodeMap[m.config.Name].Incarnation
 }
 
 // UpdateNode is used to trigger re-advertising the local node. This is
 // primarily used with a Delegate to support dynamic updates to the local
 // meta data.  This will block until the update message is successfully
 // broadcasted to a member of the cluster, if any exist or until a specified
-// timeout is reached.
+// timeout is reached, in which case ErrUpdateTimeout is returned. The
+// update is applied locally before it's broadcast, so LocalNode and
+// LocalIncarnation reflect it as soon as this returns, even on a timeout.
+// Use AwaitPropagation to wait for it to reach more of the cluster.
 func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 	// Get the node meta data
 	var meta []byte
@@ -458,14 +698,15 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 		Addr:        state.Addr,
 		Port:        state.Port,
 		Meta:        meta,
-		Vsn: []uint8{
-			ProtocolVersionMin, ProtocolVersionMax, m.config.ProtocolVersion,
-			m.config.DelegateProtocolMin, m.config.DelegateProtocolMax,
-			m.config.DelegateProtocolVersion,
-		},
+		Vsn:         m.localVsn(),
+		Paused:      m.Paused(),
+		Maintenance: m.InMaintenance(),
 	}
 	notifyCh := make(chan struct{})
 	m.aliveNode(&a, notifyCh, true)
+	if m.LocalIncarnation() < a.Incarnation {
+		return ErrUpdateRejected
+	}
 
 	// Wait for the broadcast or a timeout
 	if m.anyAlive() {
@@ -476,7 +717,7 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 		select {
 		case <-notifyCh:
 		case <-timeoutCh:
-			return fmt.Errorf("timeout waiting for update broadcast")
+			return ErrUpdateTimeout
 		}
 	}
 	return nil
@@ -490,6 +731,12 @@ func (m *Memberlist) UpdateNode(timeout time.Duration) error {
 // message is the size of a single UDP datagram, after compression.
 // This method is DEPRECATED in favor or SendToUDP
 func (m *Memberlist) SendTo(to net.Addr, msg []byte) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
 	// Encode as a user message
 	buf := make([]byte, 1, len(msg)+1)
 	buf[0] = byte(userMsg)
@@ -504,16 +751,41 @@ func (m *Memberlist) SendTo(to net.Addr, msg []byte) error {
 // user-data message, which a delegate will receive through NotifyMsg
 // The actual data is transmitted over UDP, which means this is a
 // best-effort transmission mechanism, and the maximum size of the
-// message is the size of a single UDP datagram, after compression
+// message is the size of a single UDP datagram, after compression.
+// If we've learned that UDP doesn't get through to the node, or that the
+// message is too large to, it goes over TCP instead; see PeerTransports.
+// With PiggybackUserMessages set, the packet also carries membership
+// updates.
 func (m *Memberlist) SendToUDP(to *Node, msg []byte) error {
-	// Encode as a user message
-	buf := make([]byte, 1, len(msg)+1)
-	buf[0] = byte(userMsg)
-	buf = append(buf, msg...)
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
 
-	// Send the message
+	// Encode as a user message, sealed for the recipient if need be
+	var buf []byte
+	if m.config.SealUserMessages {
+		sealed, err := m.sealUserMsg(to.Name, msg)
+		if err != nil {
+			return err
+		}
+		buf = sealed
+	} else {
+		buf = make([]byte, 1, len(msg)+1)
+		buf[0] = byte(userMsg)
+		buf = append(buf, msg...)
+	}
+
+	// Send the message, over a stream if it wouldn't get through as a
+	// packet
+	if m.transports.preferStream(to.Name, len(buf)+m.securityOverhead()) {
+		metrics.IncrCounter([]string{"memberlist", "udp", "rerouted"}, 1)
+		destAddr := &net.TCPAddr{IP: to.Addr, Port: int(to.Port)}
+		return m.sendTCPUserMsg(destAddr, messageType(buf[0]), buf[1:])
+	}
 	destAddr := &net.UDPAddr{IP: to.Addr, Port: int(to.Port)}
-	return m.rawSendMsgUDP(destAddr, buf)
+	return m.sendUserMsgUDP(destAddr, buf)
 }
 
 // SendToTCP is used to directly send a message to another node, without
@@ -523,9 +795,114 @@ func (m *Memberlist) SendToUDP(to *Node, msg []byte) error {
 // is guaranteed if no error is returned. There is no limit
 // to the size of the message
 func (m *Memberlist) SendToTCP(to *Node, msg []byte) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
 	// Send the message
 	destAddr := &net.TCPAddr{IP: to.Addr, Port: int(to.Port)}
-	return m.sendTCPUserMsg(destAddr, msg)
+	if m.config.SealUserMessages {
+		sealed, err := m.sealUserMsg(to.Name, msg)
+		if err != nil {
+			return err
+		}
+		return m.sendTCPUserMsg(destAddr, sealedUserMsg, sealed[1:])
+	}
+	return m.sendTCPUserMsg(destAddr, userMsg, msg)
+}
+
+// BroadcastImmediate queues a broadcast on the given queue, which should be
+// the one the Delegate's GetBroadcasts draws from, and also sends it
+// straight away to GossipNodes random live members rather than waiting for
+// the next gossip round. This is for messages that can't wait up to a
+// GossipInterval to start spreading. Receivers get the message through
+// NotifyMsg, possibly more than once, and the message has to fit in a
+// single UDP datagram. If any sends fail, the first error is returned,
+// but the broadcast is still queued.
+func (m *Memberlist) BroadcastImmediate(q *TransmitLimitedQueue, b Broadcast) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
+	if q != nil {
+		q.QueueBroadcast(b)
+	}
+
+	// Encode as a user message
+	msg := b.Message()
+	buf := make([]byte, 1, len(msg)+1)
+	buf[0] = byte(userMsg)
+	buf = append(buf, msg...)
+
+	m.nodeLock.RLock()
+	excludes := []string{m.config.Name}
+	kNodes := weightedRandomNodes(m.tune().GossipNodes, excludes, m.nodes, m.gossipHealth.weight)
+	m.nodeLock.RUnlock()
+
+	var firstErr error
+	for _, node := range kNodes {
+		destAddr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
+		if err := m.sendMsg(destAddr, buf); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	metrics.IncrCounter([]string{"memberlist", "broadcast", "immediate"}, float32(len(kNodes)))
+	return firstErr
+}
+
+// BroadcastUntil gossips a user message to the cluster, like a broadcast
+// from the Delegate's queue, but with a deadline. The message is dropped
+// from our queue once the deadline passes, and members that get it after
+// then drop it rather than handing it to NotifyMsg, so that an obsolete
+// message isn't acted on when a partition heals. The deadline is checked
+// against each member's own clock, so clocks need to be roughly in sync.
+// Members running an older version don't understand the message and log
+// it as unknown.
+func (m *Memberlist) BroadcastUntil(msg []byte, expires time.Time) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
+	if !time.Now().Before(expires) {
+		return fmt.Errorf("Broadcast has already expired")
+	}
+
+	buf := make([]byte, 1+8, 1+8+len(msg))
+	buf[0] = byte(userExpiringMsg)
+	binary.BigEndian.PutUint64(buf[1:], uint64(expires.UnixNano()))
+	buf = append(buf, msg...)
+	m.broadcasts.QueueBroadcast(&userExpiringBroadcast{buf, expires})
+	return nil
+}
+
+// BroadcastSequenced gossips a user message to the cluster, like a
+// broadcast from the Delegate's queue, but stamped with our name and the
+// next of our sequence numbers, which it returns. Receivers whose Delegate
+// implements SequencedMsgDelegate get these with the message, so they can
+// spot messages they missed or got out of order. Members running an older
+// version don't understand the message and log it as unknown.
+func (m *Memberlist) BroadcastSequenced(msg []byte) (uint64, error) {
+	select {
+	case <-m.shutdownCh:
+		return 0, ErrShutdown
+	default:
+	}
+
+	seq := atomic.AddUint64(&m.userSeqNum, 1)
+	buf := make([]byte, 1+2*binary.MaxVarintLen64, 1+2*binary.MaxVarintLen64+len(m.config.Name)+len(msg))
+	buf[0] = byte(userSeqMsg)
+	n := 1 + binary.PutUvarint(buf[1:], seq)
+	n += binary.PutUvarint(buf[n:], uint64(len(m.config.Name)))
+	buf = append(buf[:n], m.config.Name...)
+	buf = append(buf, msg...)
+	m.broadcasts.QueueBroadcast(&userBroadcast{buf})
+	return seq, nil
 }
 
 // Members returns a list of all known live nodes. The node structures
@@ -568,10 +945,14 @@ func (m *Memberlist) NumMembers() (alive int) {
 //
 // This will block until the leave message is successfully broadcasted to
 // a member of the cluster, if any exist or until a specified timeout
-// is reached.
+// is reached, in which case ErrLeaveTimeout is returned. If
+// Config.LeaveQuorum is set, it instead blocks until that fraction of the
+// members have acknowledged it.
 //
-// This method is safe to call multiple times, but must not be called
-// after the cluster is already shut down.
+// This method is safe to call multiple times and from multiple goroutines.
+// Only the first call broadcasts; the others wait for it (up to their own
+// timeout) and then return the same result. Calling Leave after Shutdown
+// returns ErrShutdown.
 func (m *Memberlist) Leave(timeout time.Duration) error {
 	m.nodeLock.Lock()
 	// We can't defer m.nodeLock.Unlock() because m.deadNode will also try to
@@ -579,41 +960,172 @@ func (m *Memberlist) Leave(timeout time.Duration) error {
 
 	if m.shutdown {
 		m.nodeLock.Unlock()
-		panic("leave after shutdown")
+		return ErrShutdown
 	}
 
-	if !m.leave {
-		m.leave = true
-
-		state, ok := m.nodeMap[m.config.Name]
+	if m.leave {
 		m.nodeLock.Unlock()
-		if !ok {
-			m.logger.Printf("[WARN] memberlist: Leave but we're not in the node map.")
-			return nil
-		}
+		return m.waitLeave(timeout)
+	}
+
+	m.leave = true
+	m.advanceLifecycle(StateLeaving)
+	state, ok := m.nodeMap[m.config.Name]
+	paused := ok && state.State == statePaused
+	m.nodeLock.Unlock()
 
-		d := dead{
-			Incarnation: state.Incarnation,
-			Node:        state.Name,
+	// We need gossip running to get the word out.
+	if paused {
+		m.schedule()
+	}
+
+	err := m.broadcastLeave(state, ok, timeout)
+
+	m.nodeLock.Lock()
+	m.leaveErr = err
+	m.advanceLifecycle(StateLeft)
+	close(m.leaveDoneCh)
+	m.nodeLock.Unlock()
+	return err
+}
+
+// broadcastLeave marks ourselves as dead and waits for the news to go out.
+func (m *Memberlist) broadcastLeave(state *nodeState, ok bool, timeout time.Duration) error {
+	// Nobody knows about an observer, so there's nobody to tell.
+	if m.config.Observer {
+		return nil
+	}
+	if !ok {
+		m.logger.Printf("[WARN] memberlist: Leave but we're not in the node map.")
+		return nil
+	}
+
+	// Naming ourselves as the sender marks this as a graceful leave
+	// rather than a failure.
+	d := dead{
+		Incarnation: state.Incarnation,
+		Node:        state.Name,
+		From:        state.Name,
+		Ack:         m.config.LeaveQuorum > 0,
+	}
+	quorum := m.startLeaveQuorum()
+	m.deadNode(&d)
+
+	// Block until the broadcast goes out, or enough members acknowledge it
+	if m.anyAlive() {
+		var timeoutCh <-chan time.Time
+		if timeout > 0 {
+			timeoutCh = time.After(timeout)
+		}
+		if quorum != nil {
+			return m.waitLeaveQuorum(quorum, timeoutCh)
+		}
+		select {
+		case <-m.leaveBroadcast:
+		case <-timeoutCh:
+			return ErrLeaveTimeout
+		case <-m.shutdownCh:
+			return ErrShutdown
 		}
-		m.deadNode(&d)
+	}
+	return nil
+}
 
-		// Block until the broadcast goes out
-		if m.anyAlive() {
-			var timeoutCh <-chan time.Time
-			if timeout > 0 {
-				timeoutCh = time.After(timeout)
-			}
-			select {
-			case <-m.leaveBroadcast:
-			case <-timeoutCh:
-				return fmt.Errorf("timeout waiting for leave broadcast")
-			}
+// waitLeave waits for a Leave already in progress to finish, and returns
+// its result.
+func (m *Memberlist) waitLeave(timeout time.Duration) error {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timeoutCh = time.After(timeout)
+	}
+	select {
+	case <-m.leaveDoneCh:
+	case <-timeoutCh:
+		return ErrLeaveTimeout
+	}
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	return m.leaveErr
+}
+
+// ForceLeave declares an unresponsive member dead on behalf of the cluster,
+// rather than waiting for failure detection to get there. It first pings
+// the node, and refuses to go ahead if it answers. Otherwise it broadcasts
+// a dead message at the node's current incarnation, so that if the node is
+// actually alive it can still refute it with a higher one, and waits for
+// the broadcast to go out. A timeout of zero waits for as long as it takes.
+//
+// This is safe to call multiple times, and does nothing if the node is
+// already dead.
+func (m *Memberlist) ForceLeave(node string, timeout time.Duration) error {
+	if node == m.config.Name {
+		return fmt.Errorf("Cannot force ourselves to leave, use Leave instead")
+	}
+
+	m.nodeLock.RLock()
+	if m.shutdown {
+		m.nodeLock.RUnlock()
+		return ErrShutdown
+	}
+	state, ok := m.nodeMap[node]
+	var inc uint32
+	var isDead bool
+	if ok {
+		inc = state.Incarnation
+		isDead = state.State == stateDead
+	}
+	m.nodeLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("Unknown node %s", node)
+	}
+	if isDead {
+		return nil
+	}
+
+	// Make sure it really is unresponsive, using up to half the timeout.
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	pingTimeout := 2 * m.tune().ProbeTimeout
+	if timeout > 0 && timeout/2 < pingTimeout {
+		pingTimeout = timeout / 2
+	}
+	if _, err := m.PingNode(node, pingTimeout); err == nil {
+		return fmt.Errorf("Node %s is still responding to pings", node)
+	}
+
+	m.logger.Printf("[INFO] memberlist: Forcing node %s to leave", node)
+	notify := make(chan struct{}, 1)
+	d := dead{
+		Incarnation: inc,
+		Node:        node,
+		From:        m.config.Name,
+	}
+	// Block until the broadcast goes out, if there is one. The message is
+	// ignored if the node refuted or was removed since we looked.
+	if m.deadNodeNotify(&d, notify) && m.anyAlive() {
+		var timeoutCh <-chan time.Time
+		if timeout > 0 {
+			timeoutCh = time.After(time.Until(deadline))
+		}
+		select {
+		case <-notify:
+		case <-timeoutCh:
+			return ErrForceLeaveTimeout
+		case <-m.shutdownCh:
+			return ErrShutdown
 		}
-	} else {
-		m.nodeLock.Unlock()
 	}
 
+	// The broadcast is also finished early if it's invalidated by the node
+	// refuting it.
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	if state, ok := m.nodeMap[node]; ok && state.State != stateDead {
+		return fmt.Errorf("Node %s refuted the forced leave", node)
+	}
 	return nil
 }
 
@@ -622,7 +1134,7 @@ func (m *Memberlist) anyAlive() bool {
 	m.nodeLock.RLock()
 	defer m.nodeLock.RUnlock()
 	for _, n := range m.nodes {
-		if n.State != stateDead && n.Name != m.config.Name {
+		if n.State != stateDead && n.State != statePaused && n.Name != m.config.Name {
 			return true
 		}
 	}
@@ -651,19 +1163,71 @@ func (m *Memberlist) ProtocolVersion() uint8 {
 // to detect this node's shutdown using probing. If you wish to more
 // gracefully exit the cluster, call Leave prior to shutting down.
 //
+// Shutdown waits up to the configured ShutdownTimeout for in-flight
+// operations to finish. See ShutdownWithTimeout for details.
+//
 // This method is safe to call multiple times.
 func (m *Memberlist) Shutdown() error {
-	m.nodeLock.Lock()
-	defer m.nodeLock.Unlock()
+	_, err := m.ShutdownWithTimeout(m.config.ShutdownTimeout)
+	return err
+}
 
+// ShutdownWithTimeout is like Shutdown, but waits up to the given timeout
+// for in-flight probes, push/pulls and incoming streams to finish before
+// closing the listeners. New work stops being scheduled straight away, and
+// probes and outgoing connections are cut short, but anything that's still
+// running when the timeout expires is abandoned and reported in the
+// returned stats. A zero timeout doesn't wait at all.
+//
+// This method is safe to call multiple times and from multiple goroutines.
+// Only the first call does the work; the others wait for it to finish and
+// then return the same stats.
+func (m *Memberlist) ShutdownWithTimeout(timeout time.Duration) (ShutdownStats, error) {
+	m.nodeLock.Lock()
 	if m.shutdown {
-		return nil
+		m.nodeLock.Unlock()
+		<-m.shutdownDoneCh
+		return m.shutdownStats, nil
 	}
 
 	m.shutdown = true
+	m.advanceLifecycle(StateShutdown)
 	close(m.shutdownCh)
 	m.deschedule()
-	m.udpListener.Close()
-	m.tcpListener.Close()
-	return nil
+
+	// Stop taking new streams, but keep receiving packets while we drain
+	// so in-flight probes can still hear their acks.
+	if m.config.Router == nil {
+		m.streamListener().Close()
+	}
+	m.nodeLock.Unlock()
+
+	stats := m.inflight.wait(timeout)
+	if n := stats.Abandoned(); n > 0 {
+		metrics.IncrCounter([]string{"memberlist", "shutdown", "abandoned"}, float32(n))
+		m.logger.Printf("[WARN] memberlist: Shutdown abandoned %d probes, %d push/pulls and %d streams",
+			stats.Probes, stats.PushPulls, stats.Streams)
+	}
+
+	if m.delegates != nil {
+		m.delegates.Shutdown()
+	}
+	if m.events != nil {
+		m.events.Shutdown()
+	}
+
+	// Shared listeners belong to the router, so just stop receiving.
+	if m.config.Router != nil {
+		m.config.Router.deregister(m)
+	} else {
+		udp, _ := m.packetConn()
+		udp.Close()
+		if m.mcastListener != nil {
+			m.mcastListener.Close()
+		}
+	}
+
+	m.shutdownStats = stats
+	close(m.shutdownDoneCh)
+	return stats, nil
 }
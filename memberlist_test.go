@@ -2,12 +2,15 @@ package memberlist
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -44,6 +47,7 @@ func yield() {
 }
 
 type MockDelegate struct {
+	mu          sync.Mutex
 	meta        []byte
 	msgs        [][]byte
 	broadcasts  [][]byte
@@ -52,26 +56,43 @@ type MockDelegate struct {
 }
 
 func (m *MockDelegate) NodeMeta(limit int) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.meta
 }
 
 func (m *MockDelegate) NotifyMsg(msg []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	cp := make([]byte, len(msg))
 	copy(cp, msg)
 	m.msgs = append(m.msgs, cp)
 }
 
+// getMessages returns a copy of the messages received so far.
+func (m *MockDelegate) getMessages() [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([][]byte(nil), m.msgs...)
+}
+
 func (m *MockDelegate) GetBroadcasts(overhead, limit int) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	b := m.broadcasts
 	m.broadcasts = nil
 	return b
 }
 
 func (m *MockDelegate) LocalState(join bool) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	return m.state
 }
 
 func (m *MockDelegate) MergeRemoteState(s []byte, join bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.remoteState = s
 }
 
@@ -519,7 +540,13 @@ func TestMemberlist_Join_Cancel(t *testing.T) {
 	if num != 0 {
 		t.Fatalf("unexpected 0: %d", num)
 	}
-	if !strings.Contains(err.Error(), "Custom merge canceled") {
+	var rej *MergeRejection
+	if !errors.As(err, &rej) {
+		t.Fatalf("expected the peer's rejection: %s", err)
+	}
+
+	// The delegate's own error stays with the peer.
+	if rej.Reason != "Merge refused" || strings.Contains(err.Error(), "Custom merge canceled") {
 		t.Fatalf("unexpected err: %s", err)
 	}
 
@@ -531,12 +558,13 @@ func TestMemberlist_Join_Cancel(t *testing.T) {
 		t.Fatalf("should have 1 nodes! %v", m1.Members())
 	}
 
-	// Check delegate invocation
+	// Check delegate invocation. The peer turns us away with its reason
+	// before sending its state, so ours is never asked.
 	if !merge1.invoked {
 		t.Fatalf("should invoke delegate")
 	}
-	if !merge2.invoked {
-		t.Fatalf("should invoke delegate")
+	if merge2.invoked {
+		t.Fatalf("should not invoke delegate")
 	}
 }
 
@@ -643,6 +671,59 @@ func TestMemberlist_Join_protocolVersions(t *testing.T) {
 	}
 }
 
+func TestMemberlist_ForceLeave(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+
+	// Create a second node
+	c := DefaultLANConfig()
+	addr1 := getBindAddr()
+	c.Name = addr1.String()
+	c.BindAddr = addr1.String()
+	c.BindPort = m1.config.BindPort
+
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	if err := m1.ForceLeave(m1.config.Name, time.Second); err == nil {
+		t.Fatalf("should not force ourselves out")
+	}
+	if err := m1.ForceLeave("nope", time.Second); err == nil {
+		t.Fatalf("should fail for an unknown node")
+	}
+
+	// m2 still answers pings, so it's left alone
+	if err := m1.ForceLeave(m2.config.Name, time.Second); err == nil {
+		t.Fatalf("should refuse while the node is responding")
+	}
+	if len(m1.Members()) != 2 {
+		t.Fatalf("should have 2 nodes! %v", m1.Members())
+	}
+
+	// Once it's wedged it can be forced out
+	m2.Shutdown()
+	if err := m1.ForceLeave(m2.config.Name, time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if len(m1.Members()) != 1 {
+		t.Fatalf("should have 1 node! %v", m1.Members())
+	}
+
+	// Again is a no-op
+	if err := m1.ForceLeave(m2.config.Name, time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+}
+
 func TestMemberlist_Leave(t *testing.T) {
 	m1 := GetMemberlist(t)
 	m1.setAlive()
@@ -695,6 +776,47 @@ func TestMemberlist_Leave(t *testing.T) {
 	}
 }
 
+func TestMemberlist_Observer(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+
+	c := testConfig()
+	c.BindPort = m1.config.BindPort
+	c.Observer = true
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if err := m2.SyncNow(); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if err := m2.UpdateNode(time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	// The observer sees the member, but not the other way around.
+	if n := m2.NumMembers(); n != 2 {
+		t.Fatalf("expected 2 members, got %d", n)
+	}
+	if n := m1.NumMembers(); n != 1 {
+		t.Fatalf("expected 1 member, got %d", n)
+	}
+
+	if err := m2.Leave(time.Second); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if n := m1.NumMembers(); n != 1 {
+		t.Fatalf("expected 1 member, got %d", n)
+	}
+}
+
 func TestMemberlist_JoinShutdown(t *testing.T) {
 	m1 := GetMemberlist(t)
 	m1.setAlive()
@@ -947,6 +1069,173 @@ func TestMemberlist_UserData(t *testing.T) {
 	}
 }
 
+func TestMemberlist_BroadcastImmediate(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+
+	d2 := &MockDelegate{}
+
+	// Create a second node
+	c := DefaultLANConfig()
+	addr1 := getBindAddr()
+	c.Name = addr1.String()
+	c.BindAddr = addr1.String()
+	c.BindPort = m1.config.BindPort
+	c.Delegate = d2
+
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 2 }}
+	b := &memberlistBroadcast{"alert", []byte("alert"), nil}
+	if err := m1.BroadcastImmediate(q, b); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if q.NumQueued() != 1 {
+		t.Fatalf("should have queued the broadcast")
+	}
+
+	// m1 has no delegate to gossip the queue, so the message can only
+	// have come directly
+	time.Sleep(10 * time.Millisecond)
+	if msgs := d2.getMessages(); len(msgs) != 1 || !reflect.DeepEqual(msgs[0], []byte("alert")) {
+		t.Fatalf("bad msgs %v", msgs)
+	}
+}
+
+func TestMemberlist_BroadcastUntil(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	if err := m.BroadcastUntil([]byte("late"), time.Now()); err == nil {
+		t.Fatalf("should refuse an expired broadcast")
+	}
+
+	expires := time.Now().Add(time.Hour)
+	if err := m.BroadcastUntil([]byte("hello"), expires); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	msgs := m.broadcasts.GetBroadcasts(0, 100)
+	if len(msgs) != 1 {
+		t.Fatalf("expected a broadcast: %v", msgs)
+	}
+	msg := msgs[0]
+	if messageType(msg[0]) != userExpiringMsg {
+		t.Fatalf("bad type: %d", msg[0])
+	}
+	if got := time.Unix(0, int64(binary.BigEndian.Uint64(msg[1:9]))); !got.Equal(expires) {
+		t.Fatalf("bad expiry: %v", got)
+	}
+	if string(msg[9:]) != "hello" {
+		t.Fatalf("bad payload: %q", msg[9:])
+	}
+}
+
+func TestMemberlist_HandleUserExpiring(t *testing.T) {
+	m, d := GetMemberlistDelegate(t)
+	defer m.Shutdown()
+
+	frame := func(msg string, expires time.Time) []byte {
+		buf := make([]byte, 8, 8+len(msg))
+		binary.BigEndian.PutUint64(buf, uint64(expires.UnixNano()))
+		return append(buf, msg...)
+	}
+	m.handleUserExpiring(frame("stale", time.Now().Add(-time.Second)), nil, "")
+	m.handleUserExpiring(frame("fresh", time.Now().Add(time.Hour)), nil, "")
+	m.handleUserExpiring([]byte{1, 2}, nil, "")
+
+	if len(d.msgs) != 1 || string(d.msgs[0]) != "fresh" {
+		t.Fatalf("bad msgs: %q", d.msgs)
+	}
+}
+
+type sequencedMsg struct {
+	origin string
+	seq    uint64
+	msg    string
+}
+
+type MockSequencedDelegate struct {
+	MockDelegate
+	sequenced []sequencedMsg
+}
+
+func (m *MockSequencedDelegate) NotifySequencedMsg(origin string, seq uint64, msg []byte) {
+	m.sequenced = append(m.sequenced, sequencedMsg{origin, seq, string(msg)})
+}
+
+func TestMemberlist_BroadcastSequenced(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	for i := 1; i <= 2; i++ {
+		seq, err := m.BroadcastSequenced([]byte(fmt.Sprintf("msg%d", i)))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if seq != uint64(i) {
+			t.Fatalf("bad seq: %d", seq)
+		}
+	}
+	msgs := m.broadcasts.GetBroadcasts(0, 1000)
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 broadcasts: %v", msgs)
+	}
+
+	// Hand them to a sequenced delegate, and to a plain one.
+	sd := &MockSequencedDelegate{}
+	m.config.Delegate = sd
+	for _, msg := range msgs {
+		if messageType(msg[0]) != userSeqMsg {
+			t.Fatalf("bad type: %d", msg[0])
+		}
+		m.handleUserSequenced(msg[1:], nil, "")
+	}
+	sort.Slice(sd.sequenced, func(i, j int) bool { return sd.sequenced[i].seq < sd.sequenced[j].seq })
+	expected := []sequencedMsg{
+		{m.config.Name, 1, "msg1"},
+		{m.config.Name, 2, "msg2"},
+	}
+	if !reflect.DeepEqual(sd.sequenced, expected) {
+		t.Fatalf("bad: %v", sd.sequenced)
+	}
+	if len(sd.msgs) != 0 {
+		t.Fatalf("should not use NotifyMsg: %v", sd.msgs)
+	}
+
+	d := &MockDelegate{}
+	m.config.Delegate = d
+	m.handleUserSequenced(msgs[0][1:], nil, "")
+	if len(d.msgs) != 1 {
+		t.Fatalf("should fall back to NotifyMsg: %v", d.msgs)
+	}
+
+	// A labeled delegate hears which label the message came with.
+	ld := &labeledDelegate{}
+	m.config.Delegate = ld
+	m.handleUserSequenced(msgs[0][1:], nil, "green")
+	if got := ld.received(); len(got) != 1 || !strings.HasPrefix(got[0], "green:msg") {
+		t.Fatalf("should use NotifyLabeledMsg: %v", got)
+	}
+	m.config.Delegate = d
+
+	// Garbage is dropped.
+	m.handleUserSequenced([]byte{0x80}, nil, "")
+	m.handleUserSequenced([]byte{1, 50, 'a'}, nil, "")
+	if len(d.msgs) != 1 {
+		t.Fatalf("should drop bad messages: %v", d.msgs)
+	}
+}
+
 func TestMemberlist_SendTo(t *testing.T) {
 	m1, d1 := GetMemberlistDelegate(t)
 	m1.setAlive()
@@ -1035,7 +1324,7 @@ func TestMemberlistProtocolVersion(t *testing.T) {
 
 func TestMemberlist_Join_DeadNode(t *testing.T) {
 	m1 := GetMemberlist(t)
-	m1.config.TCPTimeout = 50 * time.Millisecond
+	setTunables(t, m1, func(tun *Tunables) { tun.TCPTimeout = 50 * time.Millisecond })
 	m1.setAlive()
 	m1.schedule()
 	defer m1.Shutdown()
@@ -1414,3 +1703,147 @@ func TestMemberlist_PingDelegate(t *testing.T) {
 //        t.Fatalf("bad role for %s: %s", c2.Name, r)
 //    }
 //}
+
+func TestMemberlist_AuthenticateOnly(t *testing.T) {
+	key := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+	c1 := testConfig()
+	c1.SecretKey = key
+	c1.AuthenticateOnly = true
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	// The second node encrypts, but should still interoperate.
+	c2 := testConfig()
+	c2.SecretKey = key
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 || err != nil {
+		t.Fatalf("unexpected: %d %v", num, err)
+	}
+
+	// Ping both ways over UDP.
+	addr1 := &net.UDPAddr{IP: net.ParseIP(m1.config.BindAddr), Port: m1.config.BindPort}
+	if _, err := m2.Ping(m1.config.Name, addr1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr2 := &net.UDPAddr{IP: net.ParseIP(m2.config.BindAddr), Port: m2.config.BindPort}
+	if _, err := m1.Ping(m2.config.Name, addr2); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A node with the wrong key should be rejected.
+	c3 := testConfig()
+	c3.SecretKey = []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	c3.AuthenticateOnly = true
+	c3.BindPort = m1.config.BindPort
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m3.Shutdown()
+
+	if _, err := m3.Join([]string{m1.config.BindAddr}); err == nil {
+		t.Fatalf("expected join to fail")
+	}
+}
+
+type identityMergeDelegate struct {
+	lock   sync.Mutex
+	ids    []RemoteIdentity
+	reject string
+}
+
+func (d *identityMergeDelegate) NotifyMerge(nodes []*Node) error {
+	return nil
+}
+
+func (d *identityMergeDelegate) NotifyMergeIdentity(id *RemoteIdentity) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.ids = append(d.ids, *id)
+	if d.reject != "" {
+		return &MergeRejection{Reason: d.reject}
+	}
+	return nil
+}
+
+func TestMemberlist_Join_MergeIdentity(t *testing.T) {
+	merge1 := &identityMergeDelegate{reject: "not on the guest list"}
+	c1 := testConfig()
+	c1.Merge = merge1
+	c1.DelegateProtocolVersion = 2
+	c1.DelegateProtocolMax = 3
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	merge2 := &identityMergeDelegate{}
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.Merge = merge2
+	c2.DelegateProtocolVersion = 2
+	c2.DelegateProtocolMax = 3
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// The rejection comes back to the joiner, and nobody merges.
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 0 {
+		t.Fatalf("unexpected join count: %d", num)
+	}
+	if err == nil || !strings.Contains(err.Error(), "not on the guest list") {
+		t.Fatalf("unexpected err: %v", err)
+	}
+	if len(m1.Members()) != 1 || len(m2.Members()) != 1 {
+		t.Fatalf("should not have merged: %v %v", m1.Members(), m2.Members())
+	}
+
+	merge1.lock.Lock()
+	if len(merge1.ids) != 1 {
+		t.Fatalf("expected one identity, got %v", merge1.ids)
+	}
+	id := merge1.ids[0]
+	merge1.lock.Unlock()
+	if id.Name != c2.Name || !id.Join || id.Label != c2.Label {
+		t.Fatalf("bad identity: %+v", id)
+	}
+	if id.PCur != c2.ProtocolVersion || id.DCur != 2 || id.DMax != 3 {
+		t.Fatalf("bad versions: %+v", id)
+	}
+	if id.Node == nil || id.Node.Name != c2.Name || id.Addr == nil {
+		t.Fatalf("bad node: %+v", id)
+	}
+	merge2.lock.Lock()
+	if len(merge2.ids) != 0 {
+		t.Fatalf("joiner should not have vetted anything: %v", merge2.ids)
+	}
+	merge2.lock.Unlock()
+
+	// Once allowed, both sides vet each other.
+	merge1.lock.Lock()
+	merge1.reject = ""
+	merge1.lock.Unlock()
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	merge2.lock.Lock()
+	defer merge2.lock.Unlock()
+	if len(merge2.ids) != 1 || merge2.ids[0].Name != c1.Name {
+		t.Fatalf("bad identity: %v", merge2.ids)
+	}
+}
@@ -1,5 +1,11 @@
 package memberlist
 
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
 // MergeDelegate is used to involve a client in
 // a potential cluster merge operation. Namely, when
 // a node does a TCP push/pull (as part of a join),
@@ -12,3 +18,144 @@ type MergeDelegate interface {
 	// the return value is non-nil, the merge is canceled.
 	NotifyMerge(peers []*Node) error
 }
+
+// MergeDiffDelegate can be implemented by a MergeDelegate that wants to
+// know how the peer's view of each node differs from ours. If it is,
+// NotifyMergeDiff is called in place of NotifyMerge.
+type MergeDiffDelegate interface {
+	MergeDelegate
+
+	// NotifyMergeDiff is invoked when a merge could take place, with one
+	// entry for each node known by the peer. If the return value is
+	// non-nil, the merge is canceled.
+	NotifyMergeDiff(diffs []*NodeDiff) error
+}
+
+// MergeIdentityDelegate can be implemented by a MergeDelegate that wants
+// to vet the peer itself before any state is exchanged. Unlike the rest
+// of the MergeDelegate, it's invoked for every push/pull, including
+// anti-entropy, and before NotifyMerge or NotifyMergeDiff.
+type MergeIdentityDelegate interface {
+	MergeDelegate
+
+	// NotifyMergeIdentity is invoked with what the peer claims about
+	// itself. If the return value is non-nil, the push/pull is canceled.
+	NotifyMergeIdentity(remote *RemoteIdentity) error
+}
+
+// RemoteIdentity is what a peer says about itself in a push/pull. Peers
+// running an older version only send their state, so Name and the
+// versions are empty.
+type RemoteIdentity struct {
+	// Name is the node name the peer claims.
+	Name string
+
+	// Addr is the address at the other end of the connection.
+	Addr net.Addr
+
+	// Node is the peer's own entry in the state it sent, or nil if there
+	// isn't one under Name. It must not be modified.
+	Node *Node
+
+	// The protocol and delegate versions the peer speaks.
+	PMin uint8
+	PMax uint8
+	PCur uint8
+	DMin uint8
+	DMax uint8
+	DCur uint8
+
+	// Label is the cluster label the peer used, which has already been
+	// checked against ours.
+	Label string
+
+	// Join is set if this push/pull is part of a join rather than
+	// anti-entropy.
+	Join bool
+}
+
+// MergeRejection is the error a push/pull fails with when the peer refuses
+// it, whether because its merge delegate said no, our protocol versions
+// are incompatible, or our label or keys don't match. A merge delegate can
+// return a MergeRejection itself to give a peer that starts a push/pull
+// with us the reason; any other error is only logged, and the peer is told
+// the merge was refused.
+type MergeRejection struct {
+	Reason string
+
+	// RetryAfter, if set, is how long the peer asked us to wait before
+	// trying again, such as when too many nodes are joining through it at
+	// once. See MaxJoinRate.
+	RetryAfter time.Duration
+}
+
+func (e *MergeRejection) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("Merge rejected by peer: %s (retry after %v)", e.Reason, e.RetryAfter)
+	}
+	return fmt.Sprintf("Merge rejected by peer: %s", e.Reason)
+}
+
+// NodeStatus is the state of a node as seen by failure detection.
+type NodeStatus int
+
+const (
+	StatusAlive NodeStatus = iota
+	StatusSuspect
+	StatusDead
+	StatusPaused
+	StatusMaintenance
+)
+
+func (s NodeStatus) String() string {
+	switch s {
+	case StatusAlive:
+		return "alive"
+	case StatusSuspect:
+		return "suspect"
+	case StatusDead:
+		return "dead"
+	case StatusPaused:
+		return "paused"
+	case StatusMaintenance:
+		return "maintenance"
+	default:
+		return "unknown"
+	}
+}
+
+// MergeChange is a set of flags describing how a peer's view of a node
+// differs from ours.
+type MergeChange int
+
+const (
+	// MergeNew means we don't know the node at all.
+	MergeNew MergeChange = 1 << iota
+
+	// MergeAddrChanged means the node's address or port differs.
+	MergeAddrChanged
+
+	// MergeMetaChanged means the node's meta data differs.
+	MergeMetaChanged
+
+	// MergeStateChanged means the node's status differs.
+	MergeStateChanged
+)
+
+// NodeDiff compares the peer's view of a node with ours. The nodes must
+// not be modified.
+type NodeDiff struct {
+	// Remote is the node as the peer knows it, and Local is the node as
+	// we know it, or nil if it's new to us.
+	Remote *Node
+	Local  *Node
+
+	RemoteStatus NodeStatus
+	LocalStatus  NodeStatus
+
+	RemoteIncarnation uint32
+	LocalIncarnation  uint32
+
+	// Changes is empty if both views agree.
+	Changes MergeChange
+}
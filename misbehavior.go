@@ -0,0 +1,214 @@
+package memberlist
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Misbehavior scoring catches peers that keep sending us garbage, whether
+they're broken or hostile. Each protocol violation from an address adds to
+its score: packets that fail to decrypt or verify, messages that don't
+decode, message types we know but don't take over UDP, and state messages
+with incarnations no well-behaved node would produce. Types newer than any
+we know aren't counted, since they come from newer peers. Scores halve
+every QuarantineDuration, so the odd corrupt packet is soon forgotten.
+
+A peer whose score reaches MisbehaviorThreshold is quarantined for
+QuarantineDuration. Its packets are dropped, and it isn't picked to help
+with indirect probes. It's still probed, and its acks and nacks for probes
+we have outstanding are let through, so it's only found dead if it's
+really down.
+
+Scores are kept by source address, which can be forged unless encryption
+is on. Without it, anyone who can send us packets can get an honest
+peer's address quarantined, which is why its probe replies still count.
+*/
+
+const (
+	// maxIncarnationJump is how far ahead of what we know a state message
+	// can put a node's incarnation. Nodes only bump their own incarnation
+	// by one at a time to refute, so anything further is a violation. It
+	// also stops a hostile peer pinning a node at an incarnation it can
+	// never refute.
+	maxIncarnationJump = 1 << 16
+)
+
+// Violation weights, added to a peer's score.
+const (
+	violationAuth        = 1.0
+	violationDecode      = 1.0
+	violationIncarnation = 5.0
+)
+
+// peerScore is the misbehavior record for one address.
+type peerScore struct {
+	score   float64
+	updated time.Time
+	until   time.Time // Quarantined until then
+}
+
+// misbehaviorState tracks scores by peer address.
+type misbehaviorState struct {
+	sync.Mutex
+	peers map[string]*peerScore
+}
+
+// decay brings a score up to date. The lock must be held.
+func (p *peerScore) decay(now time.Time, halfLife time.Duration) {
+	if halfLife > 0 && !p.updated.IsZero() {
+		p.score *= math.Pow(0.5, float64(now.Sub(p.updated))/float64(halfLife))
+	}
+	p.updated = now
+}
+
+// recordViolation scores a protocol violation against a peer, quarantining
+// it if it's reached the threshold.
+func (m *Memberlist) recordViolation(from net.Addr, reason string, weight float64) {
+	metrics.IncrCounter([]string{"memberlist", "misbehavior", reason}, 1)
+	threshold := m.config.MisbehaviorThreshold
+	if threshold <= 0 || from == nil {
+		return
+	}
+
+	addr := from.String()
+	now := time.Now()
+	halfLife := m.config.QuarantineDuration
+
+	m.misbehavior.Lock()
+	if m.misbehavior.peers == nil {
+		m.misbehavior.peers = make(map[string]*peerScore)
+	}
+
+	// Forget peers that have long since settled down.
+	for a, p := range m.misbehavior.peers {
+		if now.After(p.until) && now.Sub(p.updated) > 10*halfLife {
+			delete(m.misbehavior.peers, a)
+		}
+	}
+
+	p, ok := m.misbehavior.peers[addr]
+	if !ok {
+		p = &peerScore{}
+		m.misbehavior.peers[addr] = p
+	}
+	p.decay(now, halfLife)
+	p.score += weight
+	var event *QuarantineEvent
+	if p.score >= threshold && !now.Before(p.until) {
+		p.until = now.Add(halfLife)
+		event = &QuarantineEvent{Addr: addr, Reason: reason, Score: p.score, Until: p.until}
+	}
+	m.misbehavior.Unlock()
+
+	if event == nil {
+		return
+	}
+	metrics.IncrCounter([]string{"memberlist", "misbehavior", "quarantined"}, 1)
+	m.logger.Printf("[WARN] memberlist: Quarantining %s until %s after repeated protocol violations (%s)",
+		addr, event.Until.Format(time.RFC3339), reason)
+	if d := m.config.Quarantine; d != nil {
+		m.dispatchDelegate("", "notify_quarantine", func() {
+			d.NotifyQuarantine(*event)
+		})
+	}
+}
+
+// isQuarantined returns true if packets from the given address should be
+// dropped.
+func (m *Memberlist) isQuarantined(from net.Addr) bool {
+	if m.config.MisbehaviorThreshold <= 0 || from == nil {
+		return false
+	}
+
+	m.misbehavior.Lock()
+	defer m.misbehavior.Unlock()
+	p, ok := m.misbehavior.peers[from.String()]
+	return ok && time.Now().Before(p.until)
+}
+
+// quarantinePasses returns true if a message from a quarantined peer
+// should be handled anyway. That's only acks and nacks for probes we have
+// outstanding, and the compound and compressed messages they may arrive
+// in, whose parts are checked in turn.
+func (m *Memberlist) quarantinePasses(msgType messageType, buf []byte) bool {
+	var seqNo uint32
+	switch msgType {
+	case compoundMsg, compound2Msg, compressMsg:
+		return true
+	case ackRespMsg:
+		var ack ackResp
+		if err := decode(buf, &ack); err != nil {
+			return false
+		}
+		seqNo = ack.SeqNo
+	case nackRespMsg:
+		var nack nackResp
+		if err := decode(buf, &nack); err != nil {
+			return false
+		}
+		seqNo = nack.SeqNo
+	default:
+		return false
+	}
+
+	m.ackLock.Lock()
+	defer m.ackLock.Unlock()
+	_, ok := m.ackHandlers[seqNo]
+	return ok
+}
+
+// quarantinedNodes returns the names of nodes that are quarantined, to
+// exclude them from helping us. The node lock must be held.
+func (m *Memberlist) quarantinedNodes() []string {
+	if m.config.MisbehaviorThreshold <= 0 {
+		return nil
+	}
+
+	m.misbehavior.Lock()
+	defer m.misbehavior.Unlock()
+	now := time.Now()
+	quarantined := make(map[string]bool)
+	for addr, p := range m.misbehavior.peers {
+		if now.Before(p.until) {
+			quarantined[addr] = true
+		}
+	}
+	if len(quarantined) == 0 {
+		return nil
+	}
+
+	var names []string
+	for _, n := range m.nodes {
+		addr := &net.UDPAddr{IP: n.Addr, Port: int(n.Port)}
+		if quarantined[addr.String()] {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
+
+// checkIncarnation returns false, scoring a violation against from, if a
+// state message would jump a known node's incarnation further than it
+// could legitimately go.
+func (m *Memberlist) checkIncarnation(node string, incarnation uint32, from net.Addr) bool {
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[node]
+	var current uint32
+	if ok {
+		current = state.Incarnation
+	}
+	m.nodeLock.RUnlock()
+
+	if !ok || incarnation <= current || incarnation-current <= maxIncarnationJump {
+		return true
+	}
+	m.packetLog.Printf("[WARN] memberlist: Ignoring incarnation %d for %s, which is at %d %s",
+		incarnation, node, current, LogAddress(from))
+	m.recordViolation(from, "incarnation", violationIncarnation)
+	return false
+}
@@ -0,0 +1,199 @@
+package memberlist
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+type mockQuarantineDelegate struct {
+	events chan QuarantineEvent
+}
+
+func (d *mockQuarantineDelegate) NotifyQuarantine(e QuarantineEvent) {
+	d.events <- e
+}
+
+func TestMemberlist_RecordViolation_Quarantine(t *testing.T) {
+	d := &mockQuarantineDelegate{events: make(chan QuarantineEvent, 4)}
+	c := testConfig()
+	// Scores decay continuously, so three violations come to just under 3.
+	c.MisbehaviorThreshold = 2.5
+	c.QuarantineDuration = time.Minute
+	c.Quarantine = d
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	bad := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1235}
+
+	// Message types from a newer protocol aren't held against a peer.
+	for i := 0; i < 5; i++ {
+		m.ingestPacket([]byte{byte(maxMessageType) + 1, 1, 2, 3}, other, time.Now())
+	}
+	if m.isQuarantined(other) {
+		t.Fatalf("unknown message types should not count")
+	}
+
+	// A garbage packet isn't enough.
+	garbage := []byte{byte(pushPullMsg), 1, 2, 3}
+	m.ingestPacket(garbage, bad, time.Now())
+	if m.isQuarantined(bad) {
+		t.Fatalf("should not be quarantined yet")
+	}
+
+	m.ingestPacket(garbage, bad, time.Now())
+	m.ingestPacket(garbage, bad, time.Now())
+	if !m.isQuarantined(bad) {
+		t.Fatalf("should be quarantined")
+	}
+	if m.isQuarantined(other) {
+		t.Fatalf("other peers should be unaffected")
+	}
+
+	select {
+	case e := <-d.events:
+		if e.Addr != bad.String() || e.Reason != "decode" || e.Score < 2.5 {
+			t.Fatalf("bad event: %+v", e)
+		}
+		if until := time.Until(e.Until); until < 50*time.Second || until > time.Minute {
+			t.Fatalf("bad quarantine end: %v", e.Until)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected quarantine event")
+	}
+
+	// Packets from the quarantined peer are ignored, even good ones.
+	buf, err := encode(aliveMsg, &alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 7946, Incarnation: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.ingestPacket(buf.Bytes(), bad, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	m.nodeLock.RLock()
+	_, ok := m.nodeMap["test"]
+	m.nodeLock.RUnlock()
+	if ok {
+		t.Fatalf("alive from quarantined peer should be dropped")
+	}
+
+	// Quarantined nodes don't help with probes.
+	m.nodeLock.Lock()
+	state := &nodeState{Node: Node{Name: "bad", Addr: bad.IP, Port: uint16(bad.Port)}, State: stateAlive}
+	m.nodes = append(m.nodes, state)
+	m.nodeMap["bad"] = state
+	names := m.quarantinedNodes()
+	m.nodeLock.Unlock()
+	if len(names) != 1 || names[0] != "bad" {
+		t.Fatalf("bad quarantined nodes: %v", names)
+	}
+}
+
+func TestMemberlist_Quarantine_ProbeReplies(t *testing.T) {
+	c := testConfig()
+	c.MisbehaviorThreshold = 1
+	c.QuarantineDuration = time.Minute
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	bad := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	m.recordViolation(bad, "decode", violationDecode)
+	if !m.isQuarantined(bad) {
+		t.Fatalf("should be quarantined")
+	}
+
+	acked := make(chan uint32, 4)
+	nacked := make(chan struct{}, 4)
+	for _, seq := range []uint32{1, 2} {
+		seq := seq
+		m.addAckHandler(seq, &ackHandler{
+			ackFn:  func(ackResp, time.Time) { acked <- seq },
+			nackFn: func(nackReason) { nacked <- struct{}{} },
+		}, time.Minute)
+	}
+
+	// Replies to our probes get through, even in a compound message.
+	ack, err := encode(ackRespMsg, &ackResp{SeqNo: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	nack, err := encode(nackRespMsg, &nackResp{SeqNo: 2})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	compound := makeCompoundMessage([][]byte{nack.Bytes()})
+	m.ingestPacket(ack.Bytes(), bad, time.Now())
+	m.ingestPacket(compound.Bytes(), bad, time.Now())
+	select {
+	case seq := <-acked:
+		if seq != 1 {
+			t.Fatalf("bad seq: %d", seq)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the ack to get through")
+	}
+	select {
+	case <-nacked:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the nack to get through")
+	}
+
+	// Anything else is dropped, including acks we aren't waiting for, and
+	// alive messages riding along with replies.
+	stray, err := encode(ackRespMsg, &ackResp{SeqNo: 4})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if m.quarantinePasses(ackRespMsg, stray.Bytes()[1:]) {
+		t.Fatalf("stray ack should be dropped")
+	}
+	a, err := encode(aliveMsg, &alive{Node: "test", Addr: []byte{127, 0, 0, 2}, Port: 7946, Incarnation: 1})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.ingestPacket(makeCompoundMessage([][]byte{a.Bytes()}).Bytes(), bad, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	m.nodeLock.RLock()
+	_, ok := m.nodeMap["test"]
+	m.nodeLock.RUnlock()
+	if ok {
+		t.Fatalf("alive from quarantined peer should be dropped")
+	}
+}
+
+func TestPeerScore_Decay(t *testing.T) {
+	now := time.Now()
+	p := &peerScore{score: 8, updated: now}
+	p.decay(now.Add(2*time.Minute), time.Minute)
+	if p.score < 1.99 || p.score > 2.01 {
+		t.Fatalf("expected score to halve twice, got %v", p.score)
+	}
+}
+
+func TestMemberlist_CheckIncarnation(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 10}
+	m.aliveNode(&a, nil, false)
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	if !m.checkIncarnation("test", 11, from) {
+		t.Fatalf("next incarnation should be fine")
+	}
+	if !m.checkIncarnation("test", 3, from) {
+		t.Fatalf("old incarnations are left to the usual checks")
+	}
+	if !m.checkIncarnation("unknown", 1<<31, from) {
+		t.Fatalf("unknown nodes can't be judged")
+	}
+	if m.checkIncarnation("test", 10+maxIncarnationJump+1, from) {
+		t.Fatalf("big jump should be refused")
+	}
+}
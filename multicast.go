@@ -0,0 +1,103 @@
+package memberlist
+
+import (
+	"net"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Multicast gossip is an optional extra for clusters on a single LAN. Each
+gossip round sends one more compound packet to the multicast group, on top
+of the usual unicast fan-out, so every member on the segment hears pending
+broadcasts at once. Members can also announce their own alive message to the
+group periodically, which lets nodes on the LAN find each other without a
+Join.
+
+Packets to and from the group are labelled, compressed and encrypted just
+like unicast gossip, and are processed by the same packet handler.
+*/
+
+// listenMulticast joins the given multicast group, on the named interface if
+// one is given, and returns the connection to read group traffic from along
+// with the group's address.
+func listenMulticast(group, iface string) (*net.UDPConn, *net.UDPAddr, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ifi *net.Interface
+	if iface != "" {
+		ifi, err = net.InterfaceByName(iface)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp", ifi, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	setUDPRecvBuf(conn)
+	return conn, addr, nil
+}
+
+// gossipMulticast sends pending broadcasts, and our own alive message when
+// an announcement is due, to the multicast group.
+func (m *Memberlist) gossipMulticast(bytesAvail int) {
+	var msgs [][]byte
+	if interval := m.config.MulticastAnnounceInterval; interval > 0 && time.Since(m.lastAnnounce) >= interval {
+		if msg, err := m.encodeLocalAlive(); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to encode multicast announcement: %s", err)
+		} else if msg != nil {
+			msgs = append(msgs, msg)
+			bytesAvail -= compoundOverhead + len(msg)
+			m.lastAnnounce = time.Now()
+		}
+	}
+
+	msgs = append(msgs, m.getBroadcasts(compoundOverhead, bytesAvail)...)
+	if len(msgs) == 0 {
+		return
+	}
+	m.recordPiggyback(bytesAvail, msgs, compoundOverhead)
+
+	if err := m.rawSendMsgsUDP(m.mcastAddr, makeCompoundMessages(msgs, false)); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send multicast gossip to %s: %s", m.mcastAddr, err)
+		return
+	}
+	metrics.IncrCounter([]string{"memberlist", "multicast", "sent"}, 1)
+}
+
+// encodeLocalAlive encodes an alive message describing our current state, or
+// returns nil if we haven't set ourselves alive yet.
+func (m *Memberlist) encodeLocalAlive() ([]byte, error) {
+	m.nodeLock.RLock()
+	me, ok := m.nodeMap[m.config.Name]
+	if !ok {
+		m.nodeLock.RUnlock()
+		return nil, nil
+	}
+	a := alive{
+		Incarnation: me.Incarnation,
+		Node:        me.Name,
+		Addr:        me.Addr,
+		Port:        me.Port,
+		Meta:        me.Meta,
+		Vsn: []uint8{
+			me.PMin, me.PMax, me.PCur,
+			me.DMin, me.DMax, me.DCur,
+		},
+		MetaTime: me.metaTime,
+		Moved:    me.moved,
+	}
+	m.nodeLock.RUnlock()
+
+	buf, err := encode(aliveMsg, &a)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
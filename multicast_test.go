@@ -0,0 +1,67 @@
+package memberlist
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_MulticastDiscovery(t *testing.T) {
+	group := fmt.Sprintf("239.255.77.46:%d", 20000+rand.Intn(20000))
+	if conn, _, err := listenMulticast(group, ""); err != nil {
+		t.Skipf("multicast not available: %v", err)
+	} else {
+		conn.Close()
+	}
+
+	// Multicast won't leave a socket bound to a loopback address, so bind
+	// to all interfaces and advertise loopback for the unicast traffic.
+	create := func() *Memberlist {
+		port := 20000 + rand.Intn(20000)
+		c := DefaultLANConfig()
+		c.Name = fmt.Sprintf("node-%d", port)
+		c.BindAddr = "0.0.0.0"
+		c.BindPort = port
+		c.AdvertiseAddr = "127.0.0.1"
+		c.AdvertisePort = port
+		c.MulticastAddr = group
+		c.MulticastAnnounceInterval = 10 * time.Millisecond
+		c.GossipInterval = 10 * time.Millisecond
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return m
+	}
+	m1 := create()
+	defer m1.Shutdown()
+	m2 := create()
+	defer m2.Shutdown()
+
+	// The members should find each other without a join.
+	deadline := time.Now().Add(2 * time.Second)
+	for m1.NumMembers() != 2 || m2.NumMembers() != 2 {
+		if time.Now().After(deadline) {
+			t.Skipf("multicast traffic isn't delivered here: %d %d members",
+				m1.NumMembers(), m2.NumMembers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMemberlist_MulticastRouter(t *testing.T) {
+	r, err := NewRouter("127.0.0.1", 0, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+
+	c := testConfig()
+	c.Router = r
+	c.Label = "test"
+	c.MulticastAddr = "239.255.77.46:7947"
+	if _, err := Create(c); err == nil {
+		t.Fatalf("expected error using multicast with a router")
+	}
+}
@@ -3,14 +3,18 @@ package memberlist
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"time"
 
 	"github.com/armon/go-metrics"
 	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/memberlist/coordinate"
 )
 
 // This is the minimum and maximum protocol version that we can
@@ -30,9 +34,19 @@ const (
 	// nacks from another memberlist who understands version 4 or
 	// greater, and likewise nacks will be sent to memberlists who
 	// understand version 4 or greater.
+	//
+	// Version 5 added compound2Msg, which has no limit on the number of
+	// messages it holds. A memberlist speaking version 2 of the protocol
+	// will gossip with compound2Msgs to another memberlist who understands
+	// version 5 or greater, and keep to compoundMsgs with anyone else.
+	//
+	// Version 6 added leave acks, and the paused and maintenance states in
+	// push/pulls. A leaving memberlist only waits for acks from memberlists
+	// who understand version 6 or greater, and push/pulls to anyone else
+	// list paused and maintenance nodes as alive.
 	ProtocolVersion2Compatible = 2
 
-	ProtocolVersionMax = 4
+	ProtocolVersionMax = 6
 )
 
 // messageType is an integer ID of a type of message that can be received
@@ -53,8 +67,40 @@ const (
 	compressMsg
 	encryptMsg
 	nackRespMsg
+	hasLabelMsg
+	authMsg
+	queryMsg
+	queryRespMsg
+	markerMsg
+	markerReceiptMsg
+	compound2Msg
+	banMsg
+	contentAnnounceMsg
+	contentPullMsg
+	contentRespMsg
+	userExpiringMsg
+	userSeqMsg
+	mergeRejectMsg
+	sealedUserMsg
+	saltReqMsg
+	saltRespMsg
+	disconnectMsg
+	treeGossipMsg
+	treeIHaveMsg
+	treeGraftMsg
+	treePruneMsg
+	replayReqMsg
+	replayRespMsg
+	leaveAckMsg
+	ackPayloadReqMsg
+	ackPayloadRespMsg
+	healthAdvisoryMsg
 )
 
+// maxMessageType is the newest message type we know. Anything above it
+// comes from a newer version of the protocol.
+const maxMessageType = healthAdvisoryMsg
+
 // compressionType is used to specify the compression algorithm
 type compressionType uint8
 
@@ -76,95 +122,231 @@ const (
 
 // ping request sent directly to node
 type ping struct {
-	SeqNo uint32
+	SeqNo uint32 `codec:"SeqNo"`
 
 	// Node is sent so the target can verify they are
 	// the intended recipient. This is to protect again an agent
 	// restart with a new name.
-	Node string
+	Node string `codec:"Node"`
+
+	// Source is the advertised address of the sender, where the ack
+	// should go if Config.ReplyToAdvertiseAddr is set. This may differ
+	// from the packet's source address when the sender is behind a load
+	// balancer. Older versions don't send it, in which case we reply to
+	// the packet's source.
+	SourceAddr []byte `codec:"SourceAddr,omitempty"`
+	SourcePort uint16 `codec:"SourcePort,omitempty"`
+	SourceNode string `codec:"SourceNode,omitempty"`
+
+	// FetchPayload is set if the sender can fetch an ack payload too
+	// large for the ack over a stream, see ackPayloadReq.
+	FetchPayload bool `codec:"FetchPayload,omitempty"`
+
+	// Pad fills the ping out to a given size, to see whether packets that
+	// large get through. It's ignored.
+	Pad []byte `codec:"Pad,omitempty"`
+
+	// Introduce asks the target to send us its alive message ahead of the
+	// ack, see Memberlist.SuggestMember.
+	Introduce bool `codec:"Introduce,omitempty"`
 }
 
 // indirect ping sent to an indirect ndoe
 type indirectPingReq struct {
-	SeqNo  uint32
-	Target []byte
-	Port   uint16
-	Node   string
-	Nack   bool // true if we'd like a nack back
+	SeqNo  uint32 `codec:"SeqNo"`
+	Target []byte `codec:"Target"`
+	Port   uint16 `codec:"Port"`
+	Node   string `codec:"Node"`
+	Nack   bool   `codec:"Nack"` // true if we'd like a nack back
+
+	// Source is the advertised address of the requester, where the ack or
+	// nack should go. See ping.
+	SourceAddr []byte `codec:"SourceAddr,omitempty"`
+	SourcePort uint16 `codec:"SourcePort,omitempty"`
+
+	// TCP asks the helper to try the target over TCP if it doesn't answer
+	// over UDP, forwarding the ack if it gets one, for when UDP is
+	// filtered between the target and some of its peers.
+	TCP bool `codec:"TCP,omitempty"`
 }
 
 // ack response is sent for a ping
 type ackResp struct {
-	SeqNo   uint32
-	Payload []byte
+	SeqNo   uint32 `codec:"SeqNo"`
+	Payload []byte `codec:"Payload"`
+
+	// Coord is the responder's network coordinate, if it has coordinates
+	// enabled.
+	Coord *coordinate.Coordinate `codec:"Coord,omitempty"`
+
+	// PayloadLen is set in place of Payload when the payload was too
+	// large for the packet, and is held for the prober to fetch.
+	PayloadLen uint32 `codec:"PayloadLen,omitempty"`
 }
 
 // nack response is sent for an indirect ping when the pinger doesn't hear from
 // the ping-ee within the configured timeout. This lets the original node know
 // that the indirect ping attempt happened but didn't succeed.
 type nackResp struct {
-	SeqNo uint32
+	SeqNo uint32 `codec:"SeqNo"`
+
+	// Reason says why the indirect ping failed. Older versions don't send
+	// it, which reads as a timeout.
+	Reason nackReason `codec:"Reason,omitempty"`
+}
+
+// nackReason says why an indirect ping failed, so the prober can tell a
+// target that didn't answer from a helper that couldn't ask it.
+type nackReason uint8
+
+const (
+	// nackTimeout means the target didn't answer in time.
+	nackTimeout nackReason = iota
+
+	// nackUnreachable means the helper couldn't send the ping at all,
+	// which says more about the helper's network than about the target.
+	//
+	// There's no reason for a refused ping: we send from an unconnected
+	// socket, which practically never hears about the ICMP error, so a
+	// target with nothing listening just times out.
+	nackUnreachable
+)
+
+func (r nackReason) String() string {
+	switch r {
+	case nackTimeout:
+		return "timeout"
+	case nackUnreachable:
+		return "unreachable"
+	default:
+		return "unknown"
+	}
 }
 
 // suspect is broadcast when we suspect a node is dead
 type suspect struct {
-	Incarnation uint32
-	Node        string
-	From        string // Include who is suspecting
+	Incarnation uint32 `codec:"Incarnation"`
+	Node        string `codec:"Node"`
+	From        string `codec:"From"` // Include who is suspecting
+
+	// Origin is the node that first broadcast the message, and Hops the
+	// number of times it has been passed on since. They're only used for
+	// tracing, and older versions leave them out.
+	Origin string `codec:"Origin,omitempty"`
+	Hops   uint8  `codec:"Hops,omitempty"`
 }
 
 // alive is broadcast when we know a node is alive.
 // Overloaded for nodes joining
 type alive struct {
-	Incarnation uint32
-	Node        string
-	Addr        []byte
-	Port        uint16
-	Meta        []byte
+	Incarnation uint32 `codec:"Incarnation"`
+	Node        string `codec:"Node"`
+	Addr        []byte `codec:"Addr"`
+	Port        uint16 `codec:"Port"`
+	Meta        []byte `codec:"Meta"`
 
 	// The versions of the protocol/delegate that are being spoken, order:
 	// pmin, pmax, pcur, dmin, dmax, dcur
-	Vsn []uint8
+	Vsn []uint8 `codec:"Vsn"`
+
+	// Origin and Hops trace the message's path, see suspect.
+	Origin string `codec:"Origin,omitempty"`
+	Hops   uint8  `codec:"Hops,omitempty"`
+
+	// Paused and Maintenance are set while the node is paused or in
+	// maintenance. Older versions ignore them, and see the node as alive.
+	Paused      bool `codec:"Paused,omitempty"`
+	Maintenance bool `codec:"Maintenance,omitempty"`
+
+	// MetaTime is when the node last changed its Meta, in Unix
+	// nanoseconds on its clock, see Config.MetaMergeLWW.
+	MetaTime int64 `codec:"MetaTime,omitempty"`
+
+	// Moved is set once the node has changed its address with Rebind, so
+	// that the new address is taken in place of the old one, rather than
+	// as a conflict. Older versions ignore it.
+	Moved bool `codec:"Moved,omitempty"`
 }
 
 // dead is broadcast when we confirm a node is dead
 // Overloaded for nodes leaving
 type dead struct {
-	Incarnation uint32
-	Node        string
-	From        string // Include who is suspecting
+	Incarnation uint32 `codec:"Incarnation"`
+	Node        string `codec:"Node"`
+	From        string `codec:"From"` // Include who is suspecting
+
+	// Origin and Hops trace the message's path, see suspect.
+	Origin string `codec:"Origin,omitempty"`
+	Hops   uint8  `codec:"Hops,omitempty"`
+
+	// Ack asks members to acknowledge a graceful leave, see LeaveQuorum.
+	Ack bool `codec:"Ack,omitempty"`
 }
 
 // pushPullHeader is used to inform the
 // otherside how many states we are transferring
 type pushPullHeader struct {
-	Nodes        int
-	UserStateLen int  // Encodes the byte lengh of user state
-	Join         bool // Is this a join request or a anti-entropy run
+	Nodes        int  `codec:"Nodes"`
+	UserStateLen int  `codec:"UserStateLen"` // Encodes the byte lengh of user state
+	Join         bool `codec:"Join"`         // Is this a join request or a anti-entropy run
+
+	// Node and Vsn identify the sender. Older versions don't send them.
+	Node string  `codec:"Node"`
+	Vsn  []uint8 `codec:"Vsn"`
+}
+
+// mergeReject is sent in place of our state when we refuse a push/pull,
+// saying why.
+type mergeReject struct {
+	Reason     string `codec:"Reason"`
+	RetryAfter int64  `codec:"RetryAfter,omitempty"` // Nanoseconds, if it's worth trying again
+}
+
+// saltResp answers a saltReqMsg with our passphrase parameters.
+type saltResp struct {
+	KDF string `codec:"KDF"`
 }
 
 // userMsgHeader is used to encapsulate a userMsg
 type userMsgHeader struct {
-	UserMsgLen int // Encodes the byte lengh of user state
+	UserMsgLen int `codec:"UserMsgLen"` // Encodes the byte lengh of user state
 }
 
 // pushNodeState is used for pushPullReq when we are
 // transferring out node states
 type pushNodeState struct {
-	Name        string
-	Addr        []byte
-	Port        uint16
-	Meta        []byte
-	Incarnation uint32
-	State       nodeStateType
-	Vsn         []uint8 // Protocol versions
+	Name        string        `codec:"Name"`
+	Addr        []byte        `codec:"Addr"`
+	Port        uint16        `codec:"Port"`
+	Meta        []byte        `codec:"Meta"`
+	Incarnation uint32        `codec:"Incarnation"`
+	State       nodeStateType `codec:"State"`
+	Vsn         []uint8       `codec:"Vsn"` // Protocol versions
+	MetaTime    int64         `codec:"MetaTime,omitempty"`
+	Moved       bool          `codec:"Moved,omitempty"`
+}
+
+// node returns the Node described by the state.
+func (n *pushNodeState) node() *Node {
+	return &Node{
+		Name: n.Name,
+		Addr: n.Addr,
+		Port: n.Port,
+		Meta: n.Meta,
+		PMin: n.Vsn[0],
+		PMax: n.Vsn[1],
+		PCur: n.Vsn[2],
+		DMin: n.Vsn[3],
+		DMax: n.Vsn[4],
+		DCur: n.Vsn[5],
+	}
 }
 
 // compress is used to wrap an underlying payload
 // using a specified compression algorithm
 type compress struct {
-	Algo compressionType
-	Buf  []byte
+	Algo compressionType `codec:"Algo"`
+	Buf  []byte          `codec:"Buf"`
 }
 
 // msgHandoff is used to transfer a message between goroutines
@@ -172,6 +354,25 @@ type msgHandoff struct {
 	msgType messageType
 	buf     []byte
 	from    net.Addr
+	label   string
+}
+
+// authenticateOnly returns true if messages should be signed with the
+// keyring rather than encrypted.
+func (m *Memberlist) authenticateOnly() bool {
+	return m.config.AuthenticateOnly && m.config.EncryptionEnabled()
+}
+
+// securityOverhead returns the number of bytes that encrypting or signing
+// adds to a packet, if either is enabled.
+func (m *Memberlist) securityOverhead() int {
+	if m.authenticateOnly() {
+		return authOverhead
+	}
+	if m.config.EncryptionEnabled() {
+		return encryptOverhead(m.encryptionVersion())
+	}
+	return 0
 }
 
 // encryptionVersion returns the encryption version to use
@@ -197,12 +398,13 @@ func setUDPRecvBuf(c *net.UDPConn) {
 	}
 }
 
-// tcpListen listens for and handles incoming connections
-func (m *Memberlist) tcpListen() {
+// tcpListen listens for and handles incoming connections on the given
+// listener, until it's closed.
+func (m *Memberlist) tcpListen(ln *net.TCPListener) {
 	for {
-		conn, err := m.tcpListener.AcceptTCP()
+		conn, err := ln.AcceptTCP()
 		if err != nil {
-			if m.shutdown {
+			if errors.Is(err, net.ErrClosed) {
 				break
 			}
 			m.logger.Printf("[ERR] memberlist: Error accepting TCP connection: %s", err)
@@ -213,46 +415,130 @@ func (m *Memberlist) tcpListen() {
 }
 
 // handleConn handles a single incoming TCP connection
-func (m *Memberlist) handleConn(conn *net.TCPConn) {
+func (m *Memberlist) handleConn(conn net.Conn) {
 	m.logger.Printf("[DEBUG] memberlist: TCP connection %s", LogConn(conn))
 
 	defer conn.Close()
+	defer m.recoverInternal("stream")
 	metrics.IncrCounter([]string{"memberlist", "tcp", "accept"}, 1)
+	m.inflight.start(inflightStream)
+	defer m.inflight.done(inflightStream)
 
-	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
-	msgType, bufConn, dec, err := m.readTCP(conn)
+	stages := m.newStreamStages(conn)
+
+	// Learn the real peer address if we're behind a proxy.
+	if m.config.AcceptProxyProtocol {
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			stages.recordError(err)
+			m.packetLog.Printf("[ERR] memberlist: Failed to read PROXY protocol header: %s %s", err, LogConn(conn))
+			return
+		}
+		conn = proxied
+	}
+
+	// Make sure the stream belongs to our cluster before looking at it.
+	conn, streamLabel, err := removeLabelHeaderFromStream(conn)
 	if err != nil {
+		stages.recordError(err)
 		if err != io.EOF {
-			m.logger.Printf("[ERR] memberlist: failed to receive: %s %s", err, LogConn(conn))
+			m.packetLog.Printf("[ERR] memberlist: failed to receive and remove the stream label header: %s %s", err, LogConn(conn))
 		}
 		return
 	}
+	if !m.acceptsLabel(streamLabel) {
+		metrics.IncrCounter([]string{"memberlist", "tcp", "label_mismatch"}, 1)
+		m.packetLog.Printf("[ERR] memberlist: Discarding stream with unacceptable label '%s' %s", streamLabel, LogConn(conn))
+		m.rejectStream(conn, "Cluster label doesn't match", true)
+		return
+	}
+
+	// Answer with the label the stream arrived with.
+	conn = &labeledConn{Conn: conn, label: streamLabel}
+
+	msgType, bufConn, dec, err := m.readStream(conn, stages.headerDone, plainStreamMsg)
+	if err != nil {
+		stages.recordError(err)
+		if err != io.EOF {
+			m.packetLog.Printf("[ERR] memberlist: failed to receive: %s %s", err, LogConn(conn))
+		}
+		switch err {
+		case ErrRemoteEncrypted, ErrRemoteNotEncrypted, ErrNoDecryptKey, ErrNoVerifyKey:
+			m.rejectStream(conn, "Encryption settings don't match", true)
+		}
+		return
+	}
+	if streamLabel != m.config.Label && !statelessStreamMsg(msgType) {
+		metrics.IncrCounter([]string{"memberlist", "tcp", "label_restricted"}, 1)
+		m.packetLog.Printf("[WARN] memberlist: Discarding stream (%d) with accepted label '%s' %s", msgType, streamLabel, LogConn(conn))
+		m.rejectStream(conn, "Cluster label only accepted for user messages", false)
+		return
+	}
 
 	switch msgType {
 	case userMsg:
-		if err := m.readUserMsg(bufConn, dec); err != nil {
+		if err := m.readUserMsg(bufConn, dec, streamLabel); err != nil {
+			stages.recordError(err)
 			m.logger.Printf("[ERR] memberlist: Failed to receive user message: %s %s", err, LogConn(conn))
 		}
+	case sealedUserMsg:
+		buf, err := m.readUserBuf(bufConn, dec)
+		if err != nil {
+			stages.recordError(err)
+			m.logger.Printf("[ERR] memberlist: Failed to receive sealed user message: %s %s", err, LogConn(conn))
+			return
+		}
+		m.handleSealedUser(buf, conn.RemoteAddr(), streamLabel)
 	case pushPullMsg:
-		join, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
+		header, remoteNodes, userState, err := m.readPushPull(bufConn, dec)
 		if err != nil {
+			stages.recordError(err)
 			m.logger.Printf("[ERR] memberlist: Failed to read remote state: %s %s", err, LogConn(conn))
 			return
 		}
 
-		if err := m.sendLocalState(conn, join); err != nil {
-			m.logger.Printf("[ERR] memberlist: Failed to push local state: %s %s", err, LogConn(conn))
+		// Check the peer out before we share our state, so that if we
+		// won't merge we can tell it why instead.
+		// Only a MergeRejection's reason is meant for the peer; anything
+		// else just says which check failed.
+		id := remoteIdentity(header, remoteNodes, conn.RemoteAddr(), streamLabel)
+		rej := mergeReject{Reason: "Incompatible protocol versions"}
+		err = m.verifyProtocol(remoteNodes)
+		if err == nil {
+			rej.Reason = "Merge refused"
+			err = m.vetMerge(id, remoteNodes)
+		}
+		if err == nil && header.Join {
+			err = m.admitJoiner(id.Name)
+			if err == nil {
+				err = m.admitJoin()
+			}
+		}
+		if err != nil {
+			m.logger.Printf("[WARN] memberlist: Rejecting push/pull: %s %s", err, LogConn(conn))
+			m.audit(AuditMergeRejected, id.Name, conn.RemoteAddr(), err.Error())
+			if mr, ok := err.(*MergeRejection); ok {
+				rej = mergeReject{Reason: mr.Reason, RetryAfter: int64(mr.RetryAfter)}
+			}
+			m.sendRejection(conn, &rej, false)
 			return
 		}
 
-		if err := m.mergeRemoteState(join, remoteNodes, userState); err != nil {
-			m.logger.Printf("[ERR] memberlist: Failed push/pull merge: %s %s", err, LogConn(conn))
+		var pmax uint8
+		if len(header.Vsn) > 1 {
+			pmax = header.Vsn[1]
+		}
+		if err := m.sendLocalState(conn, header.Join, pmax); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to push local state: %s %s", err, LogConn(conn))
 			return
 		}
+		m.applyRemoteState(id, remoteNodes, userState)
+	case saltReqMsg:
+		m.sendPassphraseKDF(conn)
 	case pingMsg:
 		var p ping
 		if err := dec.Decode(&p); err != nil {
-			m.logger.Printf("[ERR] memberlist: Failed to decode TCP ping: %s %s", err, LogConn(conn))
+			m.packetLog.Printf("[ERR] memberlist: Failed to decode TCP ping: %s %s", err, LogConn(conn))
 			return
 		}
 
@@ -261,7 +547,7 @@ func (m *Memberlist) handleConn(conn *net.TCPConn) {
 			return
 		}
 
-		ack := ackResp{p.SeqNo, nil}
+		ack := ackResp{SeqNo: p.SeqNo}
 		out, err := encode(ackRespMsg, &ack)
 		if err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to encode TCP ack: %s", err)
@@ -273,17 +559,42 @@ func (m *Memberlist) handleConn(conn *net.TCPConn) {
 			m.logger.Printf("[ERR] memberlist: Failed to send TCP ack: %s %s", err, LogConn(conn))
 			return
 		}
+	case queryMsg:
+		if err := m.handleQuery(conn, dec); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to answer query: %s %s", err, LogConn(conn))
+		}
+	case contentPullMsg:
+		if err := m.handleContentPull(conn, dec); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to serve payload: %s %s", err, LogConn(conn))
+		}
+	case replayReqMsg:
+		if err := m.handleReplayReq(conn, dec); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to replay messages: %s %s", err, LogConn(conn))
+		}
+	case ackPayloadReqMsg:
+		if err := m.handleAckPayloadReq(conn, dec); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to serve ack payload: %s %s", err, LogConn(conn))
+		}
 	default:
-		m.logger.Printf("[ERR] memberlist: Received invalid msgType (%d) %s", msgType, LogConn(conn))
+		m.packetLog.Printf("[ERR] memberlist: Received invalid msgType (%d) %s", msgType, LogConn(conn))
 	}
 }
 
-// udpListen listens for and handles incoming UDP packets
-func (m *Memberlist) udpListen() {
+// udpListen listens for and handles incoming UDP packets on the given
+// connection, which is either our UDP listener or the multicast group,
+// until it's closed.
+func (m *Memberlist) udpListen(conn *net.UDPConn) {
 	var n int
 	var addr net.Addr
 	var err error
 	var lastPacket time.Time
+	var oob []byte
+	udp, offload := m.packetConn()
+	gro := conn == udp && offload.gro
+	ecn := conn == udp && offload.ecn
+	if gro || ecn {
+		oob = make([]byte, 64)
+	}
 	for {
 		// Do a check for potentially blocking operations
 		if !lastPacket.IsZero() && time.Now().Sub(lastPacket) > blockingWarning {
@@ -295,12 +606,22 @@ func (m *Memberlist) udpListen() {
 
 		// Create a new buffer
 		// TODO: Use Sync.Pool eventually
-		buf := make([]byte, udpBufSize)
-
-		// Read a packet
-		n, addr, err = m.udpListener.ReadFrom(buf)
+		var packets [][]byte
+		var ce bool
+		if gro {
+			// Read what may be several packets merged by the kernel
+			packets, addr, ce, err = readPackets(conn, make([]byte, groBufSize), oob)
+		} else if ecn {
+			// Read a packet along with its ECN marks
+			packets, addr, ce, err = readPackets(conn, make([]byte, udpBufSize), oob)
+		} else {
+			// Read a packet
+			buf := make([]byte, udpBufSize)
+			n, addr, err = conn.ReadFrom(buf)
+			packets = [][]byte{buf[:n]}
+		}
 		if err != nil {
-			if m.shutdown {
+			if errors.Is(err, net.ErrClosed) {
 				break
 			}
 			m.logger.Printf("[ERR] memberlist: Error reading UDP packet: %s", err)
@@ -311,48 +632,117 @@ func (m *Memberlist) udpListen() {
 		// system calls as possible.
 		lastPacket = time.Now()
 
-		// Check the length
-		if n < 1 {
-			m.logger.Printf("[ERR] memberlist: UDP packet too short (%d bytes) %s",
-				len(buf), LogAddress(addr))
-			continue
+		if ce {
+			metrics.IncrCounter([]string{"memberlist", "udp", "ecn_ce"}, float32(len(packets)))
+			m.congestion.mark(len(packets))
 		}
 
-		// Ingest this packet
-		metrics.IncrCounter([]string{"memberlist", "udp", "received"}, float32(n))
-		m.ingestPacket(buf[:n], addr, lastPacket)
+		for _, buf := range packets {
+			// Check the length
+			if len(buf) < 1 {
+				m.packetLog.Printf("[ERR] memberlist: UDP packet too short (%d bytes) %s",
+					len(buf), LogAddress(addr))
+				continue
+			}
+
+			// Ingest this packet
+			metrics.IncrCounter([]string{"memberlist", "udp", "received"}, float32(len(buf)))
+			m.ingestPacket(buf, addr, lastPacket)
+		}
 	}
 }
 
 func (m *Memberlist) ingestPacket(buf []byte, from net.Addr, timestamp time.Time) {
+	defer m.recoverInternal("packet")
+
+	// Make sure the packet belongs to our cluster before looking at it.
+	buf, packetLabel, err := removeLabelHeaderFromPacket(buf)
+	if err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to remove packet label header: %v %s", err, LogAddress(from))
+		return
+	}
+	if !m.acceptsLabel(packetLabel) {
+		metrics.IncrCounter([]string{"memberlist", "udp", "label_mismatch"}, 1)
+		m.packetLog.Printf("[ERR] memberlist: Discarding packet with unacceptable label '%s' %s", packetLabel, LogAddress(from))
+		return
+	}
+	if len(buf) < 1 {
+		m.packetLog.Printf("[ERR] memberlist: UDP packet has no payload after label %s", LogAddress(from))
+		return
+	}
+
 	// Check if encryption is enabled
 	if m.config.EncryptionEnabled() {
-		// Decrypt the payload
-		plain, err := decryptPayload(m.config.Keyring.GetKeys(), buf, nil)
-		if err != nil {
-			m.logger.Printf("[ERR] memberlist: Decrypt packet failed: %v %s", err, LogAddress(from))
+		keys := m.config.Keyring.GetKeys()
+		if messageType(buf[0]) == authMsg {
+			// Verify the payload, which was sent in the clear
+			plain, idx, err := verifyPayload(keys, buf[1:], []byte(packetLabel))
+			m.recordDecrypt(keys, idx, from)
+			if err != nil {
+				m.packetLog.Printf("[ERR] memberlist: Verify packet failed: %v %s", err, LogAddress(from))
+				m.recordViolation(from, "auth", violationAuth)
+				return
+			}
+			if !m.checkSealing(from, sealAuth) {
+				return
+			}
+			buf = plain
+		} else {
+			// Decrypt the payload
+			plain, idx, err := decryptPayloadIndex(keys, buf, []byte(packetLabel))
+			m.recordDecrypt(keys, idx, from)
+			if err != nil {
+				m.packetLog.Printf("[ERR] memberlist: Decrypt packet failed: %v %s", err, LogAddress(from))
+				m.recordViolation(from, "auth", violationAuth)
+				return
+			}
+			if !m.checkSealing(from, sealEncrypted+int(buf[0])) {
+				return
+			}
+
+			// Continue processing the plaintext buffer
+			buf = plain
+		}
+		if len(buf) < 1 {
+			m.packetLog.Printf("[ERR] memberlist: UDP packet has no payload after decryption %s", LogAddress(from))
 			return
 		}
-
-		// Continue processing the plaintext buffer
-		buf = plain
 	}
 
 	// Handle the command
-	m.handleCommand(buf, from, timestamp)
+	if !m.isQuarantined(from) {
+		m.observeTraffic(from, timestamp)
+	}
+	m.handleCommand(buf, from, timestamp, packetLabel)
 }
 
-func (m *Memberlist) handleCommand(buf []byte, from net.Addr, timestamp time.Time) {
+// handleCommand handles a message from a packet that arrived with the given
+// label.
+func (m *Memberlist) handleCommand(buf []byte, from net.Addr, timestamp time.Time, label string) {
 	// Decode the message type
 	msgType := messageType(buf[0])
 	buf = buf[1:]
 
+	// Drop anything from peers we've quarantined, apart from replies to
+	// our own probes.
+	if m.isQuarantined(from) && !m.quarantinePasses(msgType, buf) {
+		metrics.IncrCounter([]string{"memberlist", "misbehavior", "dropped"}, 1)
+		return
+	}
+	if label != m.config.Label && !statelessPacketMsg(msgType) {
+		metrics.IncrCounter([]string{"memberlist", "udp", "label_restricted"}, 1)
+		m.packetLog.Printf("[WARN] memberlist: Discarding message (%d) with accepted label '%s' %s", msgType, label, LogAddress(from))
+		return
+	}
+
 	// Switch on the msgType
 	switch msgType {
 	case compoundMsg:
-		m.handleCompound(buf, from, timestamp)
+		m.handleCompound(buf, from, timestamp, label, decodeCompoundMessage)
+	case compound2Msg:
+		m.handleCompound(buf, from, timestamp, label, decodeCompound2Message)
 	case compressMsg:
-		m.handleCompressed(buf, from, timestamp)
+		m.handleCompressed(buf, from, timestamp, label)
 
 	case pingMsg:
 		m.handlePing(buf, from)
@@ -362,6 +752,10 @@ func (m *Memberlist) handleCommand(buf []byte, from net.Addr, timestamp time.Tim
 		m.handleAck(buf, from, timestamp)
 	case nackRespMsg:
 		m.handleNack(buf, from)
+	case markerReceiptMsg:
+		m.handleMarkerReceipt(buf, from)
+	case leaveAckMsg:
+		m.handleLeaveAck(buf, from)
 
 	case suspectMsg:
 		fallthrough
@@ -369,15 +763,45 @@ func (m *Memberlist) handleCommand(buf []byte, from net.Addr, timestamp time.Tim
 		fallthrough
 	case deadMsg:
 		fallthrough
+	case markerMsg:
+		fallthrough
+	case banMsg:
+		fallthrough
+	case healthAdvisoryMsg:
+		fallthrough
+	case contentAnnounceMsg:
+		fallthrough
+	case userExpiringMsg:
+		fallthrough
+	case userSeqMsg:
+		fallthrough
+	case sealedUserMsg:
+		fallthrough
+	case disconnectMsg:
+		fallthrough
+	case treeGossipMsg:
+		fallthrough
+	case treeIHaveMsg:
+		fallthrough
+	case treeGraftMsg:
+		fallthrough
+	case treePruneMsg:
+		fallthrough
 	case userMsg:
+		if (msgType == aliveMsg || msgType == suspectMsg || msgType == deadMsg) && !m.admitStateMsg(msgType, from) {
+			return
+		}
 		select {
-		case m.handoff <- msgHandoff{msgType, buf, from}:
+		case m.handoff <- msgHandoff{msgType, buf, from, label}:
 		default:
 			m.logger.Printf("[WARN] memberlist: UDP handler queue full, dropping message (%d) %s", msgType, LogAddress(from))
 		}
 
 	default:
-		m.logger.Printf("[ERR] memberlist: UDP msg type (%d) not supported %s", msgType, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: UDP msg type (%d) not supported %s", msgType, LogAddress(from))
+		if msgType <= maxMessageType {
+			m.recordViolation(from, "decode", violationDecode)
+		}
 	}
 }
 
@@ -388,22 +812,7 @@ func (m *Memberlist) udpHandler() {
 	for {
 		select {
 		case msg := <-m.handoff:
-			msgType := msg.msgType
-			buf := msg.buf
-			from := msg.from
-
-			switch msgType {
-			case suspectMsg:
-				m.handleSuspect(buf, from)
-			case aliveMsg:
-				m.handleAlive(buf, from)
-			case deadMsg:
-				m.handleDead(buf, from)
-			case userMsg:
-				m.handleUser(buf, from)
-			default:
-				m.logger.Printf("[ERR] memberlist: UDP msg type (%d) not supported %s (handler)", msgType, LogAddress(from))
-			}
+			m.handleHandoff(msg)
 
 		case <-m.shutdownCh:
 			return
@@ -411,29 +820,78 @@ func (m *Memberlist) udpHandler() {
 	}
 }
 
-func (m *Memberlist) handleCompound(buf []byte, from net.Addr, timestamp time.Time) {
+// handleHandoff processes a single message queued by the packet listener.
+func (m *Memberlist) handleHandoff(msg msgHandoff) {
+	defer m.recoverInternal("handler")
+
+	msgType := msg.msgType
+	buf := msg.buf
+	from := msg.from
+
+	switch msgType {
+	case suspectMsg:
+		m.handleSuspect(buf, from)
+	case aliveMsg:
+		m.handleAlive(buf, from)
+	case deadMsg:
+		m.handleDead(buf, from)
+	case markerMsg:
+		m.handleMarker(buf, from)
+	case banMsg:
+		m.handleBan(buf, from)
+	case healthAdvisoryMsg:
+		m.handleHealthAdvisory(buf, from)
+	case contentAnnounceMsg:
+		m.handleContentAnnounce(buf, from)
+	case userMsg:
+		m.handleUser(buf, from, msg.label)
+	case userExpiringMsg:
+		m.handleUserExpiring(buf, from, msg.label)
+	case userSeqMsg:
+		m.handleUserSequenced(buf, from, msg.label)
+	case sealedUserMsg:
+		m.handleSealedUser(buf, from, msg.label)
+	case disconnectMsg:
+		m.handleDisconnect(buf, from)
+	case treeGossipMsg:
+		m.handleTreeGossip(buf, from, msg.label)
+	case treeIHaveMsg:
+		m.handleTreeIHave(buf, from)
+	case treeGraftMsg:
+		m.handleTreeGraft(buf, from)
+	case treePruneMsg:
+		m.handleTreePrune(buf, from)
+	default:
+		m.packetLog.Printf("[ERR] memberlist: UDP msg type (%d) not supported %s (handler)", msgType, LogAddress(from))
+	}
+}
+
+func (m *Memberlist) handleCompound(buf []byte, from net.Addr, timestamp time.Time, label string,
+	decode func([]byte) (int, [][]byte, error)) {
 	// Decode the parts
-	trunc, parts, err := decodeCompoundMessage(buf)
+	trunc, parts, err := decode(buf)
 	if err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode compound request: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode compound request: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
 		return
 	}
 
 	// Log any truncation
 	if trunc > 0 {
-		m.logger.Printf("[WARN] memberlist: Compound request had %d truncated messages %s", trunc, LogAddress(from))
+		m.packetLog.Printf("[WARN] memberlist: Compound request had %d truncated messages %s", trunc, LogAddress(from))
 	}
 
 	// Handle each message
 	for _, part := range parts {
-		m.handleCommand(part, from, timestamp)
+		m.handleCommand(part, from, timestamp, label)
 	}
 }
 
 func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 	var p ping
 	if err := decode(buf, &p); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode ping request: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode ping request: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
 		return
 	}
 	// If node is provided, verify that it is for us
@@ -446,15 +904,27 @@ func (m *Memberlist) handlePing(buf []byte, from net.Addr) {
 	if m.config.Ping != nil {
 		ack.Payload = m.config.Ping.AckPayload()
 	}
-	if err := m.encodeAndSendMsg(from, ackRespMsg, &ack); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to send ack: %s %s", err, LogAddress(from))
+	if m.coords != nil {
+		ack.Coord = m.coords.GetCoordinate()
+	}
+	addr := m.replyAddr(from, p.SourceAddr, p.SourcePort)
+	if len(ack.Payload) > 0 {
+		m.fitAckPayload(&ack, &p, addr)
+	}
+	if p.Introduce {
+		m.introduce(addr)
 	}
+	if err := m.encodeAndSendMsg(addr, ackRespMsg, &ack); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send ack: %s %s", err, LogAddress(addr))
+	}
+	m.checkActivePeer(p.SourceNode, addr)
 }
 
 func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 	var ind indirectPingReq
 	if err := decode(buf, &ind); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode indirect ping request: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode indirect ping request: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
 		return
 	}
 
@@ -464,9 +934,13 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 		ind.Port = uint16(m.config.BindPort)
 	}
 
+	// Work out where the requester wants to hear back.
+	replyTo := m.replyAddr(from, ind.SourceAddr, ind.SourcePort)
+	start := time.Now()
+
 	// Send a ping to the correct host.
 	localSeqNo := m.nextSeqNo()
-	ping := ping{SeqNo: localSeqNo, Node: ind.Node}
+	ping := m.newPing(localSeqNo, ind.Node)
 	destAddr := &net.UDPAddr{IP: ind.Target, Port: int(ind.Port)}
 
 	// Setup a response handler to relay the ack
@@ -476,38 +950,96 @@ func (m *Memberlist) handleIndirectPing(buf []byte, from net.Addr) {
 		close(cancelCh)
 
 		// Forward the ack back to the requestor.
-		ack := ackResp{ind.SeqNo, nil}
-		if err := m.encodeAndSendMsg(from, ackRespMsg, &ack); err != nil {
-			m.logger.Printf("[ERR] memberlist: Failed to forward ack: %s %s", err, LogAddress(from))
+		ack := ackResp{SeqNo: ind.SeqNo}
+		if err := m.encodeAndSendMsg(replyTo, ackRespMsg, &ack); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to forward ack: %s %s", err, LogAddress(replyTo))
 		}
 	}
-	m.setAckHandler(localSeqNo, respHandler, m.config.ProbeTimeout)
+	m.setAckHandler(localSeqNo, respHandler, m.tune().ProbeTimeout)
 
-	// Send the ping.
+	// Send the ping. If it can't be sent there's no ack coming, so say why
+	// straight away.
 	if err := m.encodeAndSendMsg(destAddr, pingMsg, &ping); err != nil {
 		m.logger.Printf("[ERR] memberlist: Failed to send ping: %s %s", err, LogAddress(from))
+		if ind.Nack {
+			m.sendNack(replyTo, ind.SeqNo, nackUnreachable)
+		}
+		return
 	}
 
-	// Setup a timer to fire off a nack if no ack is seen in time.
-	if ind.Nack {
+	// Setup a timer to fire off a nack if no ack is seen in time, and then
+	// try the target over TCP if we were asked to.
+	tcp := ind.TCP && !m.config.DisableTcpPings
+	if ind.Nack || tcp {
 		go func() {
+			defer m.recoverInternal("probe")
 			select {
 			case <-cancelCh:
 				return
-			case <-time.After(m.config.ProbeTimeout):
-				nack := nackResp{ind.SeqNo}
-				if err := m.encodeAndSendMsg(from, nackRespMsg, &nack); err != nil {
-					m.logger.Printf("[ERR] memberlist: Failed to send nack: %s %s", err, LogAddress(from))
-				}
+			case <-time.After(m.tune().ProbeTimeout):
+			}
+			if ind.Nack {
+				m.sendNack(replyTo, ind.SeqNo, nackTimeout)
+			}
+			if tcp {
+				m.indirectPingTCP(&ind, ping, replyTo, start.Add(m.config.ProbeInterval))
 			}
 		}()
 	}
 }
 
+// indirectPingTCP tries the target of an indirect ping that didn't answer
+// over UDP with a TCP ping, forwarding the ack to the requester if it
+// answers. The requester still takes the ack after our nack, up until its
+// probe is over, which is about when the deadline is.
+func (m *Memberlist) indirectPingTCP(ind *indirectPingReq, ping ping, replyTo net.Addr, deadline time.Time) {
+	destAddr := &net.TCPAddr{IP: ind.Target, Port: int(ind.Port)}
+	didContact, err := m.sendPingAndWaitForAck(destAddr, ping, deadline)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed TCP ping for indirect ping: %s", err)
+		return
+	}
+	if !didContact {
+		metrics.IncrCounter([]string{"memberlist", "indirect", "tcp", "failed"}, 1)
+		return
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "indirect", "tcp", "acked"}, 1)
+	m.logger.Printf("[DEBUG] memberlist: Reached %s via TCP but not UDP for an indirect ping", ind.Node)
+	ack := ackResp{SeqNo: ind.SeqNo}
+	if err := m.encodeAndSendMsg(replyTo, ackRespMsg, &ack); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to forward ack: %s %s", err, LogAddress(replyTo))
+	}
+}
+
+// sendNack tells the requester of an indirect ping that it failed.
+func (m *Memberlist) sendNack(to net.Addr, seqNo uint32, reason nackReason) {
+	nack := nackResp{SeqNo: seqNo, Reason: reason}
+	if err := m.encodeAndSendMsg(to, nackRespMsg, &nack); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send nack: %s %s", err, LogAddress(to))
+	}
+}
+
+// replyAddr returns where to send the response to a ping or indirect ping.
+// Normally that's the packet's source. With Config.ReplyToAdvertiseAddr
+// and encryption, if the sender told us its advertised address we use
+// that, since the packet's source may be a load balancer that can't be
+// reached directly.
+func (m *Memberlist) replyAddr(from net.Addr, sourceAddr []byte, sourcePort uint16) net.Addr {
+	if !m.config.ReplyToAdvertiseAddr || !m.config.EncryptionEnabled() {
+		return from
+	}
+	if len(sourceAddr) > 0 && sourcePort > 0 {
+		return &net.UDPAddr{IP: sourceAddr, Port: int(sourcePort)}
+	}
+	return from
+}
+
 func (m *Memberlist) handleAck(buf []byte, from net.Addr, timestamp time.Time) {
 	var ack ackResp
 	if err := decode(buf, &ack); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode ack response: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode ack response: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
 		return
 	}
 	m.invokeAckHandler(ack, timestamp)
@@ -516,7 +1048,8 @@ func (m *Memberlist) handleAck(buf []byte, from net.Addr, timestamp time.Time) {
 func (m *Memberlist) handleNack(buf []byte, from net.Addr) {
 	var nack nackResp
 	if err := decode(buf, &nack); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode nack response: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode nack response: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
 		return
 	}
 	m.invokeNackHandler(nack)
@@ -525,7 +1058,15 @@ func (m *Memberlist) handleNack(buf []byte, from net.Addr) {
 func (m *Memberlist) handleSuspect(buf []byte, from net.Addr) {
 	var sus suspect
 	if err := decode(buf, &sus); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode suspect message: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode suspect message: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
+		return
+	}
+	if !m.checkIncarnation(sus.Node, sus.Incarnation, from) {
+		return
+	}
+	m.traceGossip("suspect", sus.Node, sus.Incarnation, sus.Origin, &sus.Hops, from)
+	if m.isDuplicate(suspectMsg, sus.Node, sus.Incarnation, sus.From) {
 		return
 	}
 	m.suspectNode(&sus)
@@ -534,7 +1075,8 @@ func (m *Memberlist) handleSuspect(buf []byte, from net.Addr) {
 func (m *Memberlist) handleAlive(buf []byte, from net.Addr) {
 	var live alive
 	if err := decode(buf, &live); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode alive message: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode alive message: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
 		return
 	}
 
@@ -544,37 +1086,155 @@ func (m *Memberlist) handleAlive(buf []byte, from net.Addr) {
 		live.Port = uint16(m.config.BindPort)
 	}
 
+	if !m.checkIncarnation(live.Node, live.Incarnation, from) {
+		return
+	}
+	m.traceGossip("alive", live.Node, live.Incarnation, live.Origin, &live.Hops, from)
 	m.aliveNode(&live, nil, false)
 }
 
+// traceGossip reports a state message to the trace delegate and counts the
+// hop to us, so that the message is passed on with the right hop count.
+func (m *Memberlist) traceGossip(msgType, node string, inc uint32, origin string, hops *uint8, from net.Addr) {
+	if d := m.config.GossipTrace; d != nil {
+		trace := GossipTrace{
+			Type:        msgType,
+			Node:        node,
+			Incarnation: inc,
+			Origin:      origin,
+			Hops:        int(*hops),
+			From:        from,
+		}
+		m.dispatchDelegate(node, "notify_gossip", func() {
+			d.NotifyGossip(trace)
+		})
+	}
+
+	if origin == "" {
+		return
+	}
+	metrics.AddSample([]string{"memberlist", "gossip", "hops"}, float32(*hops))
+	if *hops < math.MaxUint8 {
+		*hops++
+	}
+}
+
 func (m *Memberlist) handleDead(buf []byte, from net.Addr) {
 	var d dead
 	if err := decode(buf, &d); err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decode dead message: %s %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode dead message: %s %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
+		return
+	}
+	if !m.checkIncarnation(d.Node, d.Incarnation, from) {
+		return
+	}
+	m.traceGossip("dead", d.Node, d.Incarnation, d.Origin, &d.Hops, from)
+	if m.isDuplicate(deadMsg, d.Node, d.Incarnation, d.From) {
 		return
 	}
 	m.deadNode(&d)
 }
 
+// isDuplicate checks the dedup cache for a suspect or dead message we've
+// recently handled. Messages about ourselves always go through, since we may
+// need to refute them.
+func (m *Memberlist) isDuplicate(t messageType, node string, incarnation uint32, from string) bool {
+	if node == m.config.Name {
+		return false
+	}
+	key := dedupKey{t, node, incarnation, from}
+	if !m.dedup.Seen(key, time.Now()) {
+		return false
+	}
+	switch t {
+	case suspectMsg:
+		metrics.IncrCounter([]string{"memberlist", "msg", "suspect", "duplicate"}, 1)
+	case deadMsg:
+		metrics.IncrCounter([]string{"memberlist", "msg", "dead", "duplicate"}, 1)
+	}
+	return true
+}
+
 // handleUser is used to notify channels of incoming user data
-func (m *Memberlist) handleUser(buf []byte, from net.Addr) {
+func (m *Memberlist) handleUser(buf []byte, from net.Addr, label string) {
+	d := m.config.Delegate
+	if d != nil && !m.duplicateUserMsg(buf) {
+		m.dispatchDelegate("", "notify_msg", func() {
+			notifyMsg(d, label, buf)
+		})
+	}
+}
+
+// handleUserExpiring is used to notify channels of incoming user data
+// that was sent with a deadline, unless it's passed.
+func (m *Memberlist) handleUserExpiring(buf []byte, from net.Addr, label string) {
+	if len(buf) < 8 {
+		m.packetLog.Printf("[ERR] memberlist: Truncated expiring user message %s", LogAddress(from))
+		return
+	}
+	expires := time.Unix(0, int64(binary.BigEndian.Uint64(buf)))
+	msg := buf[8:]
+
 	d := m.config.Delegate
-	if d != nil {
-		d.NotifyMsg(buf)
+	if d == nil || m.duplicateUserMsg(msg) {
+		return
 	}
+	m.dispatchDelegate("", "notify_msg", func() {
+		// Check now in case it waited in the delegate queue.
+		if !time.Now().Before(expires) {
+			metrics.IncrCounter([]string{"memberlist", "msg", "user", "expired"}, 1)
+			return
+		}
+		notifyMsg(d, label, msg)
+	})
+}
+
+// handleUserSequenced is used to notify channels of incoming user data
+// stamped with its origin and sequence number.
+func (m *Memberlist) handleUserSequenced(buf []byte, from net.Addr, label string) {
+	// Copies are spotted by the origin and sequence number as well as the
+	// message, so that a message sent twice is delivered twice.
+	whole := buf
+	seq, n := binary.Uvarint(buf)
+	if n <= 0 {
+		m.packetLog.Printf("[ERR] memberlist: Bad sequence number in user message %s", LogAddress(from))
+		return
+	}
+	buf = buf[n:]
+	originLen, n := binary.Uvarint(buf)
+	if n <= 0 || originLen > uint64(len(buf)-n) {
+		m.packetLog.Printf("[ERR] memberlist: Bad origin in user message %s", LogAddress(from))
+		return
+	}
+	origin := string(buf[n : n+int(originLen)])
+	msg := buf[n+int(originLen):]
+
+	d := m.config.Delegate
+	if d == nil || m.duplicateUserMsg(whole) {
+		return
+	}
+	m.dispatchDelegate(origin, "notify_msg", func() {
+		if sd, ok := d.(SequencedMsgDelegate); ok {
+			sd.NotifySequencedMsg(origin, seq, msg)
+		} else {
+			notifyMsg(d, label, msg)
+		}
+	})
 }
 
 // handleCompressed is used to unpack a compressed message
-func (m *Memberlist) handleCompressed(buf []byte, from net.Addr, timestamp time.Time) {
+func (m *Memberlist) handleCompressed(buf []byte, from net.Addr, timestamp time.Time, label string) {
 	// Try to decode the payload
 	payload, err := decompressPayload(buf)
 	if err != nil {
-		m.logger.Printf("[ERR] memberlist: Failed to decompress payload: %v %s", err, LogAddress(from))
+		m.packetLog.Printf("[ERR] memberlist: Failed to decompress payload: %v %s", err, LogAddress(from))
+		m.recordViolation(from, "decode", violationDecode)
 		return
 	}
 
 	// Recursively handle the payload
-	m.handleCommand(payload, from, timestamp)
+	m.handleCommand(payload, from, timestamp, label)
 }
 
 // encodeAndSendMsg is used to combine the encoding and sending steps
@@ -593,11 +1253,9 @@ func (m *Memberlist) encodeAndSendMsg(to net.Addr, msgType messageType, msg inte
 // create a compoundMsg and piggy back other broadcasts
 func (m *Memberlist) sendMsg(to net.Addr, msg []byte) error {
 	// Check if we can piggy back any messages
-	bytesAvail := udpSendBuf - len(msg) - compoundHeaderOverhead
-	if m.config.EncryptionEnabled() {
-		bytesAvail -= encryptOverhead(m.encryptionVersion())
-	}
+	bytesAvail := m.packetBudget(to) - len(msg) - compoundHeaderOverhead - m.securityOverhead()
 	extra := m.getBroadcasts(compoundOverhead, bytesAvail)
+	m.recordPiggyback(bytesAvail, extra, compoundOverhead)
 
 	// Fast path if nothing to piggypack
 	if len(extra) == 0 {
@@ -609,15 +1267,36 @@ func (m *Memberlist) sendMsg(to net.Addr, msg []byte) error {
 	msgs = append(msgs, msg)
 	msgs = append(msgs, extra...)
 
-	// Create a compound message
-	compound := makeCompoundMessage(msgs)
+	// Create compound messages, we don't know if the peer understands the
+	// newer format
+	return m.rawSendMsgsUDP(to, makeCompoundMessages(msgs, false))
+}
 
-	// Send the message
-	return m.rawSendMsgUDP(to, compound.Bytes())
+// rawSendMsgsUDP sends several UDP messages to the same host without
+// modification.
+func (m *Memberlist) rawSendMsgsUDP(to net.Addr, msgs []*bytes.Buffer) error {
+	for _, msg := range msgs {
+		if err := m.rawSendMsgUDP(to, msg.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // rawSendMsgUDP is used to send a UDP message to another host without modification
 func (m *Memberlist) rawSendMsgUDP(to net.Addr, msg []byte) error {
+	packet, err := m.packUDP(to, msg)
+	if err != nil {
+		return err
+	}
+	return m.writeUDP(to, packet)
+}
+
+// packUDP compresses, encrypts and labels a message as configured, ready
+// to send as a packet to the given address.
+func (m *Memberlist) packUDP(to net.Addr, msg []byte) ([]byte, error) {
+	label := m.labelFor(to)
+
 	// Check if we have compression enabled
 	if m.config.EnableCompression {
 		buf, err := compressPayload(msg)
@@ -632,20 +1311,37 @@ func (m *Memberlist) rawSendMsgUDP(to net.Addr, msg []byte) error {
 	}
 
 	// Check if we have encryption enabled
-	if m.config.EncryptionEnabled() {
+	if m.authenticateOnly() {
+		// Sign the payload but leave it in the clear
+		var buf bytes.Buffer
+		buf.WriteByte(byte(authMsg))
+		authPayload(m.config.Keyring.GetPrimaryKey(), msg, []byte(label), &buf)
+		msg = buf.Bytes()
+	} else if m.config.EncryptionEnabled() {
 		// Encrypt the payload
 		var buf bytes.Buffer
 		primaryKey := m.config.Keyring.GetPrimaryKey()
-		err := encryptPayload(m.encryptionVersion(), primaryKey, msg, nil, &buf)
+		err := encryptPayloadNonce(m.encryptionVersion(), primaryKey, msg, []byte(label), m.nonces, &buf)
 		if err != nil {
 			m.logger.Printf("[ERR] memberlist: Encryption of message failed: %v", err)
-			return err
+			return nil, err
 		}
 		msg = buf.Bytes()
 	}
 
-	metrics.IncrCounter([]string{"memberlist", "udp", "sent"}, float32(len(msg)))
-	_, err := m.udpListener.WriteTo(msg, to)
+	// Tag the packet with our label so the receiver can tell which cluster
+	// it belongs to.
+	return addLabelHeaderToPacket(msg, label), nil
+}
+
+// writeUDP sends a packed message.
+func (m *Memberlist) writeUDP(to net.Addr, packet []byte) error {
+	metrics.IncrCounter([]string{"memberlist", "udp", "sent"}, float32(len(packet)))
+	udp, _ := m.packetConn()
+	_, err := udp.WriteTo(packet, to)
+	if err == nil && m.routed != nil {
+		m.routed.sent(len(packet))
+	}
 	return err
 }
 
@@ -662,8 +1358,10 @@ func (m *Memberlist) rawSendMsgTCP(conn net.Conn, sendBuf []byte) error {
 	}
 
 	// Check if encryption is enabled
-	if m.config.EncryptionEnabled() {
-		crypt, err := m.encryptLocalState(sendBuf)
+	if m.authenticateOnly() {
+		sendBuf = m.authLocalState(sendBuf, m.streamLabel(conn))
+	} else if m.config.EncryptionEnabled() {
+		crypt, err := m.encryptLocalState(sendBuf, m.streamLabel(conn))
 		if err != nil {
 			m.logger.Printf("[ERROR] memberlist: Failed to encrypt local state: %v", err)
 			return err
@@ -683,18 +1381,57 @@ func (m *Memberlist) rawSendMsgTCP(conn net.Conn, sendBuf []byte) error {
 	return nil
 }
 
-// sendTCPUserMsg is used to send a TCP userMsg to another host
-func (m *Memberlist) sendTCPUserMsg(to net.Addr, sendBuf []byte) error {
-	dialer := net.Dialer{Timeout: m.config.TCPTimeout}
-	conn, err := dialer.Dial("tcp", to.String())
+// dialTCP opens a stream to the given address. The attempt is abandoned if
+// the deadline passes or memberlist is shut down in the meantime, so that
+// Shutdown doesn't have to wait out slow connection attempts.
+func (m *Memberlist) dialTCP(addr string, deadline time.Time) (net.Conn, error) {
+	select {
+	case <-m.shutdownCh:
+		return nil, ErrShutdown
+	default:
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.shutdownCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.config.EmitProxyProtocol {
+		if err := writeProxyHeader(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// sendTCPUserMsg is used to send a TCP userMsg, or a sealedUserMsg, to
+// another host
+func (m *Memberlist) sendTCPUserMsg(to net.Addr, msgType messageType, sendBuf []byte) error {
+	conn, err := m.dialTCP(to.String(), time.Now().Add(m.tune().TCPTimeout))
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return err
+	}
+
 	bufConn := bytes.NewBuffer(nil)
 
-	if err := bufConn.WriteByte(byte(userMsg)); err != nil {
+	if err := bufConn.WriteByte(byte(msgType)); err != nil {
 		return err
 	}
 
@@ -715,44 +1452,103 @@ func (m *Memberlist) sendTCPUserMsg(to net.Addr, sendBuf []byte) error {
 }
 
 // sendAndReceiveState is used to initiate a push/pull over TCP with a remote node
-func (m *Memberlist) sendAndReceiveState(addr []byte, port uint16, join bool) ([]pushNodeState, []byte, error) {
+func (m *Memberlist) sendAndReceiveState(addr []byte, port uint16, join bool) (*RemoteIdentity, []pushNodeState, []byte, error) {
 	// Attempt to connect
-	dialer := net.Dialer{Timeout: m.config.TCPTimeout}
 	dest := net.TCPAddr{IP: addr, Port: int(port)}
-	conn, err := dialer.Dial("tcp", dest.String())
+	conn, err := m.dialTCP(dest.String(), time.Now().Add(m.tune().TCPTimeout))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	defer conn.Close()
 	m.logger.Printf("[DEBUG] memberlist: Initiating push/pull sync with: %s", conn.RemoteAddr())
 	metrics.IncrCounter([]string{"memberlist", "tcp", "connect"}, 1)
 
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return nil, nil, nil, err
+	}
+
 	// Send our state
-	if err := m.sendLocalState(conn, join); err != nil {
-		return nil, nil, err
+	if err := m.sendLocalState(conn, join, m.protocolMaxAt(addr, port)); err != nil {
+		return nil, nil, nil, err
 	}
 
-	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+	conn.SetDeadline(time.Now().Add(m.tune().TCPTimeout))
 	msgType, bufConn, dec, err := m.readTCP(conn)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+
+	// See if we were turned away
+	if msgType == mergeRejectMsg {
+		var rej mergeReject
+		if err := dec.Decode(&rej); err != nil {
+			return nil, nil, nil, err
+		}
+		return nil, nil, nil, &MergeRejection{Reason: rej.Reason, RetryAfter: time.Duration(rej.RetryAfter)}
 	}
 
 	// Quit if not push/pull
 	if msgType != pushPullMsg {
 		err := fmt.Errorf("received invalid msgType (%d), expected pushPullMsg (%d) %s", msgType, pushPullMsg, LogConn(conn))
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Read remote state
-	_, remoteNodes, userState, err := m.readRemoteState(bufConn, dec)
-	return remoteNodes, userState, err
+	header, remoteNodes, userState, err := m.readPushPull(bufConn, dec)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	header.Join = join
+	return remoteIdentity(header, remoteNodes, conn.RemoteAddr(), m.streamLabel(conn)), remoteNodes, userState, nil
+}
+
+// rejectStream tells the other end of a stream why we're refusing it, so
+// that a joining node's error says why. Rejections for label and key
+// problems are sent in the clear, since the peer can't read anything else
+// from us, so their reasons are kept generic. A peer that has already sent
+// us something encrypted won't take them.
+func (m *Memberlist) rejectStream(conn net.Conn, reason string, plain bool) {
+	m.sendRejection(conn, &mergeReject{Reason: reason}, plain)
+}
+
+// sendRejection is like rejectStream, but sends the rejection as given.
+func (m *Memberlist) sendRejection(conn net.Conn, rej *mergeReject, plain bool) {
+	metrics.IncrCounter([]string{"memberlist", "tcp", "rejected"}, 1)
+	out, err := encode(mergeRejectMsg, rej)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to encode rejection: %s", err)
+		return
+	}
+	if plain {
+		_, err = conn.Write(out.Bytes())
+	} else {
+		err = m.rawSendMsgTCP(conn, out.Bytes())
+	}
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send rejection: %s %s", err, LogConn(conn))
+	}
+}
+
+// protocolMaxAt returns the highest protocol version the node at the given
+// address understands, or zero if we don't know it.
+func (m *Memberlist) protocolMaxAt(addr []byte, port uint16) uint8 {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	for _, n := range m.nodes {
+		if n.Port == port && n.Addr.Equal(addr) {
+			return n.PMax
+		}
+	}
+	return 0
 }
 
-// sendLocalState is invoked to send our local state over a tcp connection
-func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
+// sendLocalState is invoked to send our local state over a tcp connection.
+// Peers that don't understand protocol version 6, or that we know nothing
+// about, are told paused and maintenance nodes are alive, since older
+// versions drop states they don't know.
+func (m *Memberlist) sendLocalState(conn net.Conn, join bool, peerPMax uint8) error {
 	// Setup a deadline
-	conn.SetDeadline(time.Now().Add(m.config.TCPTimeout))
+	conn.SetDeadline(time.Now().Add(m.tune().TCPTimeout))
 
 	// Prepare the local node state
 	m.nodeLock.RLock()
@@ -763,7 +1559,20 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 		localNodes[idx].Port = n.Port
 		localNodes[idx].Incarnation = n.Incarnation
 		localNodes[idx].State = n.State
+		if m.heldSuspect(n) {
+			// A health override isn't suspicion, so don't pass it off as
+			// such; advisories carry it instead.
+			localNodes[idx].State = stateAlive
+			if n.maintenance {
+				localNodes[idx].State = stateMaintenance
+			}
+		}
+		if peerPMax < 6 && (localNodes[idx].State == statePaused || localNodes[idx].State == stateMaintenance) {
+			localNodes[idx].State = stateAlive
+		}
 		localNodes[idx].Meta = n.Meta
+		localNodes[idx].MetaTime = n.metaTime
+		localNodes[idx].Moved = n.moved
 		localNodes[idx].Vsn = []uint8{
 			n.PMin, n.PMax, n.PCur,
 			n.DMin, n.DMax, n.DCur,
@@ -771,6 +1580,17 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	}
 	m.nodeLock.RUnlock()
 
+	// An observer leaves itself out, so the other side doesn't learn of it.
+	if m.config.Observer {
+		kept := localNodes[:0]
+		for _, n := range localNodes {
+			if n.Name != m.config.Name {
+				kept = append(kept, n)
+			}
+		}
+		localNodes = kept
+	}
+
 	// Get the delegate state
 	var userData []byte
 	if m.config.Delegate != nil {
@@ -781,7 +1601,13 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	bufConn := bytes.NewBuffer(nil)
 
 	// Send our node state
-	header := pushPullHeader{Nodes: len(localNodes), UserStateLen: len(userData), Join: join}
+	header := pushPullHeader{
+		Nodes:        len(localNodes),
+		UserStateLen: len(userData),
+		Join:         join,
+		Node:         m.config.Name,
+		Vsn:          m.localVsn(),
+	}
 	hd := codec.MsgpackHandle{}
 	enc := codec.NewEncoder(bufConn, &hd)
 
@@ -810,8 +1636,9 @@ func (m *Memberlist) sendLocalState(conn net.Conn, join bool) error {
 	return m.rawSendMsgTCP(conn, bufConn.Bytes())
 }
 
-// encryptLocalState is used to help encrypt local state before sending
-func (m *Memberlist) encryptLocalState(sendBuf []byte) ([]byte, error) {
+// encryptLocalState is used to help encrypt local state before sending on
+// a stream with the given label
+func (m *Memberlist) encryptLocalState(sendBuf []byte, label string) ([]byte, error) {
 	var buf bytes.Buffer
 
 	// Write the encryptMsg byte
@@ -824,52 +1651,146 @@ func (m *Memberlist) encryptLocalState(sendBuf []byte) ([]byte, error) {
 	binary.BigEndian.PutUint32(sizeBuf, uint32(encLen))
 	buf.Write(sizeBuf)
 
-	// Write the encrypted cipher text to the buffer
+	// Write the encrypted cipher text to the buffer, authenticating the
+	// header and our label along with it
 	key := m.config.Keyring.GetPrimaryKey()
-	err := encryptPayload(encVsn, key, sendBuf, buf.Bytes()[:5], &buf)
+	data := append(append([]byte(nil), buf.Bytes()[:5]...), label...)
+	err := encryptPayloadNonce(encVsn, key, sendBuf, data, m.nonces, &buf)
 	if err != nil {
 		return nil, err
 	}
 	return buf.Bytes(), nil
 }
 
-// decryptRemoteState is used to help decrypt the remote state
-func (m *Memberlist) decryptRemoteState(bufConn io.Reader) ([]byte, error) {
+// authLocalState is used to sign local state before sending, when we're
+// only authenticating messages
+func (m *Memberlist) authLocalState(sendBuf []byte, label string) []byte {
+	var buf bytes.Buffer
+
+	// Write the authMsg byte and the size of the message
+	buf.WriteByte(byte(authMsg))
+	sizeBuf := make([]byte, 4)
+	binary.BigEndian.PutUint32(sizeBuf, uint32(len(sendBuf)+authTagSize))
+	buf.Write(sizeBuf)
+
+	// Write the payload and its tag, covering the header and our label
+	key := m.config.Keyring.GetPrimaryKey()
+	data := append(append([]byte(nil), buf.Bytes()[:5]...), label...)
+	authPayload(key, sendBuf, data, &buf)
+	return buf.Bytes()
+}
+
+// readSealedState reads an encrypted or authenticated message of the given
+// type off the stream, including the header.
+func readSealedState(bufConn io.Reader, msgType messageType) (*bytes.Buffer, error) {
 	// Read in enough to determine message length
-	cipherText := bytes.NewBuffer(nil)
-	cipherText.WriteByte(byte(encryptMsg))
-	_, err := io.CopyN(cipherText, bufConn, 4)
+	sealed := bytes.NewBuffer(nil)
+	sealed.WriteByte(byte(msgType))
+	_, err := io.CopyN(sealed, bufConn, 4)
 	if err != nil {
 		return nil, err
 	}
 
 	// Ensure we aren't asked to download too much. This is to guard against
 	// an attack vector where a huge amount of state is sent
-	moreBytes := binary.BigEndian.Uint32(cipherText.Bytes()[1:5])
-	if moreBytes > maxPushStateBytes {
-		return nil, fmt.Errorf("Remote node state is larger than limit (%d)", moreBytes)
+	moreBytes := binary.BigEndian.Uint32(sealed.Bytes()[1:5])
+	if err := checkStreamLen("node state", int64(moreBytes)); err != nil {
+		return nil, err
 	}
 
 	// Read in the rest of the payload
-	_, err = io.CopyN(cipherText, bufConn, int64(moreBytes))
+	_, err = io.CopyN(sealed, bufConn, int64(moreBytes))
+	if err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// verifyRemoteState is used to help verify authenticated remote state
+func (m *Memberlist) verifyRemoteState(bufConn io.Reader, from net.Addr, label string) ([]byte, error) {
+	sealed, err := readSealedState(bufConn, authMsg)
+	if err != nil {
+		return nil, err
+	}
+
+	dataBytes := append(append([]byte(nil), sealed.Bytes()[:5]...), label...)
+	keys := m.config.Keyring.GetKeys()
+	plain, idx, err := verifyPayload(keys, sealed.Bytes()[5:], dataBytes)
+	m.recordDecrypt(keys, idx, from)
+	return plain, err
+}
+
+// decryptRemoteState is used to help decrypt the remote state
+func (m *Memberlist) decryptRemoteState(bufConn io.Reader, from net.Addr, label string) ([]byte, error) {
+	cipherText, err := readSealedState(bufConn, encryptMsg)
 	if err != nil {
 		return nil, err
 	}
 
 	// Decrypt the cipherText
-	dataBytes := cipherText.Bytes()[:5]
+	dataBytes := append(append([]byte(nil), cipherText.Bytes()[:5]...), label...)
 	cipherBytes := cipherText.Bytes()[5:]
 
 	// Decrypt the payload
 	keys := m.config.Keyring.GetKeys()
-	return decryptPayload(keys, cipherBytes, dataBytes)
+	plain, idx, err := decryptPayloadIndex(keys, cipherBytes, dataBytes)
+	m.recordDecrypt(keys, idx, from)
+	return plain, err
+}
+
+// recordDecrypt updates the key usage metrics after an attempt to decrypt a
+// message from the given peer. A negative index means no key worked. The
+// failure metric doesn't name the peer, since anyone can send us garbage
+// from any number of addresses; failures are counted by source for the
+// most recent ones instead, see DecryptFailures, and audited with the
+// count.
+func (m *Memberlist) recordDecrypt(keys [][]byte, idx int, from net.Addr) {
+	if idx < 0 {
+		metrics.IncrCounter([]string{"memberlist", "keyring", "decrypt_failed"}, 1)
+		count := m.decryptFails.record(from)
+		m.audit(AuditDecryptFailed, "", from, fmt.Sprintf("failures=%d", count))
+		return
+	}
+
+	id := KeyID(keys[idx])
+	metrics.IncrCounter([]string{"memberlist", "keyring", "decrypt", id}, 1)
+	if idx > 0 {
+		m.logger.Printf("[DEBUG] memberlist: Message decrypted with non-primary key %s %s", id, LogAddress(from))
+	}
+}
+
+// plainStreamMsg returns true for the message types we accept unencrypted
+// at the start of an incoming stream even when encryption is enabled.
+func plainStreamMsg(msgType messageType) bool {
+	return msgType == saltReqMsg
+}
+
+// plainReplyMsg returns true for the replies we accept unencrypted to a
+// request for passphrase parameters, which comes before anything
+// encrypted. Any other reply has to be encrypted once we've sent something
+// that is, so a rejection in the clear can't be forged.
+func plainReplyMsg(msgType messageType) bool {
+	switch msgType {
+	case mergeRejectMsg, saltRespMsg:
+		return true
+	default:
+		return false
+	}
 }
 
 // readTCP is used to read the start of a TCP stream.
 // it decrypts and decompresses the stream if necessary
 func (m *Memberlist) readTCP(conn net.Conn) (messageType, io.Reader, *codec.Decoder, error) {
+	return m.readStream(conn, nil, nil)
+}
+
+// readStream is readTCP, calling headerDone if given once the message type
+// and any sealed length have been read and checked, and taking the message
+// types plain says yes to in the clear even when encryption is enabled.
+func (m *Memberlist) readStream(conn net.Conn, headerDone func(), plain func(messageType) bool) (messageType, io.Reader, *codec.Decoder, error) {
 	// Created a buffered reader
-	var bufConn io.Reader = bufio.NewReader(conn)
+	br := bufio.NewReader(conn)
+	var bufConn io.Reader = br
 
 	// Read the message type
 	buf := [1]byte{0}
@@ -879,23 +1800,50 @@ func (m *Memberlist) readTCP(conn net.Conn) (messageType, io.Reader, *codec.Deco
 	msgType := messageType(buf[0])
 
 	// Check if the message is encrypted
-	if msgType == encryptMsg {
+	if msgType == encryptMsg || msgType == authMsg {
 		if !m.config.EncryptionEnabled() {
-			return 0, nil, nil,
-				fmt.Errorf("Remote state is encrypted and encryption is not configured")
+			return 0, nil, nil, ErrRemoteEncrypted
+		}
+
+		// Check the sealed length before waiting on the payload.
+		sizeBuf, err := br.Peek(4)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if err := checkStreamLen("node state", int64(binary.BigEndian.Uint32(sizeBuf))); err != nil {
+			return 0, nil, nil, err
+		}
+		if headerDone != nil {
+			headerDone()
 		}
 
-		plain, err := m.decryptRemoteState(bufConn)
+		var plain []byte
+		if msgType == authMsg {
+			plain, err = m.verifyRemoteState(bufConn, conn.RemoteAddr(), m.streamLabel(conn))
+		} else {
+			plain, err = m.decryptRemoteState(bufConn, conn.RemoteAddr(), m.streamLabel(conn))
+		}
 		if err != nil {
 			return 0, nil, nil, err
 		}
+		if len(plain) < 1 {
+			return 0, nil, nil, fmt.Errorf("Remote state has no payload")
+		}
 
 		// Reset message type and bufConn
 		msgType = messageType(plain[0])
 		bufConn = bytes.NewReader(plain[1:])
-	} else if m.config.EncryptionEnabled() {
-		return 0, nil, nil,
-			fmt.Errorf("Encryption is configured but remote state is not encrypted")
+	} else if m.config.EncryptionEnabled() && (plain == nil || !plain(msgType)) {
+		// Passphrase parameters have to come in the clear, since they're
+		// needed to get the key.
+		return 0, nil, nil, ErrRemoteNotEncrypted
+	} else {
+		if headerDone != nil {
+			headerDone()
+		}
+
+		// Hold plain streams to the same limit as sealed ones.
+		bufConn = io.LimitReader(br, maxPushStateBytes)
 	}
 
 	// Get the msgPack decoders
@@ -928,20 +1876,40 @@ func (m *Memberlist) readTCP(conn net.Conn) (messageType, io.Reader, *codec.Deco
 
 // readRemoteState is used to read the remote state from a connection
 func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (bool, []pushNodeState, []byte, error) {
+	header, remoteNodes, userBuf, err := m.readPushPull(bufConn, dec)
+	return header.Join, remoteNodes, userBuf, err
+}
+
+// readPushPull is like readRemoteState, but returns the whole header.
+func (m *Memberlist) readPushPull(bufConn io.Reader, dec *codec.Decoder) (pushPullHeader, []pushNodeState, []byte, error) {
 	// Read the push/pull header
 	var header pushPullHeader
-	if err := dec.Decode(&header); err != nil {
-		return false, nil, nil, err
+	if err := decodeWire(dec, &header); err != nil {
+		return header, nil, nil, err
 	}
 
-	// Allocate space for the transfer
-	remoteNodes := make([]pushNodeState, header.Nodes)
+	if err := checkStreamLen("node count", int64(header.Nodes)); err != nil {
+		return header, nil, nil, err
+	}
+	if err := checkStreamLen("user state", int64(header.UserStateLen)); err != nil {
+		return header, nil, nil, err
+	}
+
+	// Allocate space for the transfer, but only as much as a reasonable
+	// cluster needs until the states actually arrive.
+	prealloc := header.Nodes
+	if prealloc > maxPreallocNodes {
+		prealloc = maxPreallocNodes
+	}
+	remoteNodes := make([]pushNodeState, 0, prealloc)
 
 	// Try to decode all the states
 	for i := 0; i < header.Nodes; i++ {
-		if err := dec.Decode(&remoteNodes[i]); err != nil {
-			return false, nil, nil, err
+		var state pushNodeState
+		if err := decodeWire(dec, &state); err != nil {
+			return header, nil, nil, err
 		}
+		remoteNodes = append(remoteNodes, state)
 	}
 
 	// Read the remote user state into a buffer
@@ -955,7 +1923,7 @@ func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (boo
 				bytes, header.UserStateLen)
 		}
 		if err != nil {
-			return false, nil, nil, err
+			return header, nil, nil, err
 		}
 	}
 
@@ -967,53 +1935,122 @@ func (m *Memberlist) readRemoteState(bufConn io.Reader, dec *codec.Decoder) (boo
 		}
 	}
 
-	return header.Join, remoteNodes, userBuf, nil
+	return header, remoteNodes, userBuf, nil
+}
+
+// remoteIdentity collects what a push/pull says about its sender.
+func remoteIdentity(header pushPullHeader, remoteNodes []pushNodeState, addr net.Addr, label string) *RemoteIdentity {
+	id := &RemoteIdentity{Name: header.Node, Addr: addr, Label: label, Join: header.Join}
+	if len(header.Vsn) >= 6 {
+		id.PMin, id.PMax, id.PCur = header.Vsn[0], header.Vsn[1], header.Vsn[2]
+		id.DMin, id.DMax, id.DCur = header.Vsn[3], header.Vsn[4], header.Vsn[5]
+	}
+	if header.Node != "" {
+		for _, n := range remoteNodes {
+			if n.Name == header.Node {
+				id.Node = n.node()
+				break
+			}
+		}
+	}
+	return id
 }
 
 // mergeRemoteState is used to merge the remote state with our local state
-func (m *Memberlist) mergeRemoteState(join bool, remoteNodes []pushNodeState, userBuf []byte) error {
+func (m *Memberlist) mergeRemoteState(id *RemoteIdentity, remoteNodes []pushNodeState, userBuf []byte) error {
 	if err := m.verifyProtocol(remoteNodes); err != nil {
 		return err
 	}
+	if err := m.vetMerge(id, remoteNodes); err != nil {
+		return err
+	}
+	m.applyRemoteState(id, remoteNodes, userBuf)
+	return nil
+}
 
-	// Invoke the merge delegate if any
-	if join && m.config.Merge != nil {
-		nodes := make([]*Node, len(remoteNodes))
-		for idx, n := range remoteNodes {
-			nodes[idx] = &Node{
-				Name: n.Name,
-				Addr: n.Addr,
-				Port: n.Port,
-				Meta: n.Meta,
-				PMin: n.Vsn[0],
-				PMax: n.Vsn[1],
-				PCur: n.Vsn[2],
-				DMin: n.Vsn[3],
-				DMax: n.Vsn[4],
-				DCur: n.Vsn[5],
-			}
+// vetMerge asks the merge delegate whether we should go ahead with a
+// push/pull.
+func (m *Memberlist) vetMerge(id *RemoteIdentity, remoteNodes []pushNodeState) error {
+	if id.Name != "" && id.Name != m.config.Name {
+		vsn := []uint8{id.PMin, id.PMax, id.PCur, id.DMin, id.DMax, id.DCur}
+		if !m.checkVersions(id.Name, vsn, id.Addr) {
+			return &MergeRejection{Reason: "Protocol downgrade refused"}
 		}
-		if err := m.config.Merge.NotifyMerge(nodes); err != nil {
+	}
+
+	if err := m.vetActiveView(id); err != nil {
+		return err
+	}
+
+	if md, ok := m.config.Merge.(MergeIdentityDelegate); ok {
+		if err := md.NotifyMergeIdentity(id); err != nil {
 			return err
 		}
 	}
 
+	// Invoke the merge delegate if any
+	if id.Join && m.config.Merge != nil {
+		if md, ok := m.config.Merge.(MergeDiffDelegate); ok {
+			if err := md.NotifyMergeDiff(m.diffState(remoteNodes)); err != nil {
+				return err
+			}
+		} else {
+			nodes := make([]*Node, len(remoteNodes))
+			for idx, n := range remoteNodes {
+				nodes[idx] = n.node()
+			}
+			if err := m.config.Merge.NotifyMerge(nodes); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// applyRemoteState merges a peer's state into ours once it's been vetted.
+func (m *Memberlist) applyRemoteState(id *RemoteIdentity, remoteNodes []pushNodeState, userBuf []byte) {
+	m.settlePassphrase()
+
+	// The peer gets into our active view in partial view mode
+	defer m.openActiveView(id)()
+
 	// Merge the membership state
 	m.mergeState(remoteNodes)
 
 	// Invoke the delegate for user state
 	if userBuf != nil && m.config.Delegate != nil {
-		m.config.Delegate.MergeRemoteState(userBuf, join)
+		m.config.Delegate.MergeRemoteState(userBuf, id.Join)
+	}
+}
+
+// readUserMsg is used to decode a userMsg from a TCP stream with the given
+// label
+func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder, label string) error {
+	userBuf, err := m.readUserBuf(bufConn, dec)
+	if err != nil {
+		return err
+	}
+	if len(userBuf) > 0 {
+		d := m.config.Delegate
+		if d != nil && !m.duplicateUserMsg(userBuf) {
+			m.dispatchDelegate("", "notify_msg", func() {
+				notifyMsg(d, label, userBuf)
+			})
+		}
 	}
 	return nil
 }
 
-// readUserMsg is used to decode a userMsg from a TCP stream
-func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder) error {
+// readUserBuf reads the body of a user message from a TCP stream
+func (m *Memberlist) readUserBuf(bufConn io.Reader, dec *codec.Decoder) ([]byte, error) {
 	// Read the user message header
 	var header userMsgHeader
 	if err := dec.Decode(&header); err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := checkStreamLen("user message", int64(header.UserMsgLen)); err != nil {
+		return nil, err
 	}
 
 	// Read the user message into a buffer
@@ -1027,16 +2064,11 @@ func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder) error {
 				bytes, header.UserMsgLen)
 		}
 		if err != nil {
-			return err
-		}
-
-		d := m.config.Delegate
-		if d != nil {
-			d.NotifyMsg(userBuf)
+			return nil, err
 		}
 	}
 
-	return nil
+	return userBuf, nil
 }
 
 // sendPingAndWaitForAck makes a TCP connection to the given address, sends
@@ -1044,8 +2076,7 @@ func (m *Memberlist) readUserMsg(bufConn io.Reader, dec *codec.Decoder) error {
 // operations, given the deadline. The bool return parameter is true if we
 // we able to round trip a ping to the other node.
 func (m *Memberlist) sendPingAndWaitForAck(destAddr net.Addr, ping ping, deadline time.Time) (bool, error) {
-	dialer := net.Dialer{Deadline: deadline}
-	conn, err := dialer.Dial("tcp", destAddr.String())
+	conn, err := m.dialTCP(destAddr.String(), deadline)
 	if err != nil {
 		// If the node is actually dead we expect this to fail, so we
 		// shouldn't spam the logs with it. After this point, errors
@@ -1056,6 +2087,10 @@ func (m *Memberlist) sendPingAndWaitForAck(destAddr net.Addr, ping ping, deadlin
 	defer conn.Close()
 	conn.SetDeadline(deadline)
 
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return false, err
+	}
+
 	out, err := encode(pingMsg, &ping)
 	if err != nil {
 		return false, err
@@ -3,6 +3,7 @@ package memberlist
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/go-msgpack/codec"
 	"io"
@@ -188,8 +189,12 @@ func TestHandlePing_WrongNode(t *testing.T) {
 }
 
 func TestHandleIndirectPing(t *testing.T) {
-	m := GetMemberlist(t)
-	m.config.EnableCompression = false
+	c := testConfig()
+	c.EnableCompression = false
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
 	defer m.Shutdown()
 
 	var udp *net.UDPConn
@@ -255,6 +260,126 @@ func TestHandleIndirectPing(t *testing.T) {
 	doneCh <- struct{}{}
 }
 
+func TestHandleIndirectPing_Unreachable(t *testing.T) {
+	c := testConfig()
+	c.EnableCompression = false
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer udp.Close()
+
+	// Our listener can't send to an IPv6 target, so the nack comes back
+	// straight away saying so, rather than after the probe timeout.
+	ind := indirectPingReq{
+		SeqNo:  100,
+		Target: net.ParseIP("2001:db8::1"),
+		Port:   uint16(m.config.BindPort),
+		Nack:   true,
+	}
+	buf, err := encode(indirectPingMsg, &ind)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(m.config.BindAddr), Port: m.config.BindPort}
+	if _, err := udp.WriteTo(buf.Bytes(), addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	udp.SetReadDeadline(time.Now().Add(m.config.ProbeTimeout / 2))
+	in := make([]byte, 1500)
+	n, _, err := udp.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if messageType(in[0]) != nackRespMsg {
+		t.Fatalf("bad response %v", in[:n])
+	}
+	var nack nackResp
+	if err := decode(in[1:n], &nack); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if nack.SeqNo != 100 || nack.Reason != nackUnreachable {
+		t.Fatalf("bad: %#v", nack)
+	}
+}
+
+func TestHandleIndirectPing_TCP(t *testing.T) {
+	c := testConfig()
+	c.EnableCompression = false
+	c.ProbeTimeout = 50 * time.Millisecond
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	// The target only answers over TCP.
+	target := GetMemberlist(t)
+	defer target.Shutdown()
+	if err := target.udpListener.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer udp.Close()
+
+	ind := indirectPingReq{
+		SeqNo:  100,
+		Target: net.ParseIP(target.config.BindAddr),
+		Port:   uint16(target.config.BindPort),
+		Node:   target.config.Name,
+		Nack:   true,
+		TCP:    true,
+	}
+	buf, err := encode(indirectPingMsg, &ind)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(m.config.BindAddr), Port: m.config.BindPort}
+	if _, err := udp.WriteTo(buf.Bytes(), addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// We hear the nack for the UDP ping, then the ack from TCP.
+	udp.SetReadDeadline(time.Now().Add(m.config.ProbeInterval))
+	for _, want := range []messageType{nackRespMsg, ackRespMsg} {
+		in := make([]byte, 1500)
+		n, _, err := udp.ReadFrom(in)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if messageType(in[0]) != want {
+			t.Fatalf("bad response %v", in[:n])
+		}
+		var resp nackResp
+		if err := decode(in[1:n], &resp); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if resp.SeqNo != 100 {
+			t.Fatalf("bad: %#v", resp)
+		}
+	}
+}
+
+func TestFormatNacks(t *testing.T) {
+	if s := formatNacks([]int{1, 2}); s != " (nacks: 1 timeout, 2 unreachable)" {
+		t.Fatalf("bad: %q", s)
+	}
+	if s := formatNacks([]int{0, 0}); s != "" {
+		t.Fatalf("bad: %q", s)
+	}
+}
+
 func TestTCPPing(t *testing.T) {
 	var tcp *net.TCPListener
 	var tcpAddr *net.TCPAddr
@@ -310,7 +435,7 @@ func TestTCPPing(t *testing.T) {
 			t.Fatalf("node name isn't correct (%s) vs (%s)", pingIn.Node, pingOut.Node)
 		}
 
-		ack := ackResp{pingIn.SeqNo, nil}
+		ack := ackResp{SeqNo: pingIn.SeqNo}
 		out, err := encode(ackRespMsg, &ack)
 		if err != nil {
 			t.Fatalf("failed to encode ack: %s", err)
@@ -349,7 +474,7 @@ func TestTCPPing(t *testing.T) {
 			t.Fatalf("failed to decode ping: %s", err)
 		}
 
-		ack := ackResp{pingIn.SeqNo + 1, nil}
+		ack := ackResp{SeqNo: pingIn.SeqNo + 1}
 		out, err := encode(ackRespMsg, &ack)
 		if err != nil {
 			t.Fatalf("failed to encode ack: %s", err)
@@ -647,7 +772,7 @@ func TestEncryptDecryptState(t *testing.T) {
 	}
 	defer m.Shutdown()
 
-	crypt, err := m.encryptLocalState(state)
+	crypt, err := m.encryptLocalState(state, "")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -656,7 +781,7 @@ func TestEncryptDecryptState(t *testing.T) {
 	buf := bytes.NewReader(crypt)
 	buf.Seek(1, 0)
 
-	plain, err := m.decryptRemoteState(buf)
+	plain, err := m.decryptRemoteState(buf, nil, "")
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -665,3 +790,364 @@ func TestEncryptDecryptState(t *testing.T) {
 		t.Fatalf("Decrypt failed: %v", plain)
 	}
 }
+
+func TestDialTCP_Shutdown(t *testing.T) {
+	m := GetMemberlist(t)
+	addr := fmt.Sprintf("%s:%d", m.config.BindAddr, m.config.BindPort)
+
+	conn, err := m.dialTCP(addr, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	conn.Close()
+
+	m.Shutdown()
+	if _, err := m.dialTCP(addr, time.Now().Add(time.Second)); err == nil {
+		t.Fatalf("expected dial to fail after shutdown")
+	}
+}
+
+func TestHandlePing_SourceAddr(t *testing.T) {
+	c := testConfig()
+	c.EnableCompression = false
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	// The ping asks for the ack to go to another socket, as it would when
+	// the sender is behind a load balancer, but without encryption the
+	// address can't be trusted, so the ack goes back where the ping came
+	// from.
+	sender, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer sender.Close()
+	receiver, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer receiver.Close()
+	recvAddr := receiver.LocalAddr().(*net.UDPAddr)
+
+	ping := ping{
+		SeqNo:      42,
+		SourceAddr: recvAddr.IP.To4(),
+		SourcePort: uint16(recvAddr.Port),
+		SourceNode: "test",
+	}
+	buf, err := encode(pingMsg, ping)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	addr := &net.UDPAddr{IP: net.ParseIP(m.config.BindAddr), Port: m.config.BindPort}
+	sender.WriteTo(buf.Bytes(), addr)
+
+	sender.SetReadDeadline(time.Now().Add(2 * time.Second))
+	in := make([]byte, 1500)
+	n, _, err := sender.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	in = in[0:n]
+	if messageType(in[0]) != ackRespMsg {
+		t.Fatalf("bad response %v", in)
+	}
+	var ack ackResp
+	if err := decode(in[1:], &ack); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if ack.SeqNo != 42 {
+		t.Fatalf("bad sequence no")
+	}
+
+	receiver.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := receiver.ReadFrom(in); err == nil {
+		t.Fatalf("should not have replied to the advertised address")
+	}
+}
+
+func TestReplyAddr(t *testing.T) {
+	m := &Memberlist{config: DefaultLANConfig()}
+	from := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+
+	// Off by default.
+	if addr := m.replyAddr(from, []byte{10, 0, 0, 2}, 7946); addr != from {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	// Ignored without encryption.
+	m.config.ReplyToAdvertiseAddr = true
+	if addr := m.replyAddr(from, []byte{10, 0, 0, 2}, 7946); addr != from {
+		t.Fatalf("bad: %v", addr)
+	}
+
+	keyring, err := NewKeyring(nil, TestKeys[0])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.config.Keyring = keyring
+	if addr := m.replyAddr(from, nil, 0); addr != from {
+		t.Fatalf("bad: %v", addr)
+	}
+	if addr := m.replyAddr(from, []byte{10, 0, 0, 2}, 0); addr != from {
+		t.Fatalf("bad: %v", addr)
+	}
+	addr := m.replyAddr(from, []byte{10, 0, 0, 2}, 7946)
+	if addr.String() != "10.0.0.2:7946" {
+		t.Fatalf("bad: %v", addr)
+	}
+}
+
+func TestMemberlist_NewPing_Source(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	p := m.newPing(1, "other")
+	self := m.LocalNode()
+	if !bytes.Equal(p.SourceAddr, self.Addr) || p.SourcePort != self.Port || p.SourceNode != self.Name {
+		t.Fatalf("bad: %#v", p)
+	}
+}
+
+type diffMergeDelegate struct {
+	diffs []*NodeDiff
+}
+
+func (d *diffMergeDelegate) NotifyMerge(peers []*Node) error {
+	return fmt.Errorf("NotifyMergeDiff should be used instead")
+}
+
+func (d *diffMergeDelegate) NotifyMergeDiff(diffs []*NodeDiff) error {
+	d.diffs = diffs
+	return fmt.Errorf("Custom merge canceled")
+}
+
+func TestMemberList_MergeRemoteState_Diff(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	merge := &diffMergeDelegate{}
+	m.config.Merge = merge
+
+	vsn := []uint8{
+		ProtocolVersionMin,
+		ProtocolVersionMax,
+		m.config.ProtocolVersion,
+		m.config.DelegateProtocolMin,
+		m.config.DelegateProtocolMax,
+		m.config.DelegateProtocolVersion,
+	}
+	ip := []byte{127, 0, 0, 1}
+	for _, name := range []string{"same", "moved", "meta", "sick"} {
+		a := alive{Node: name, Addr: ip, Port: 7946, Incarnation: 1, Vsn: vsn}
+		m.aliveNode(&a, nil, false)
+	}
+
+	remote := []pushNodeState{
+		{Name: "same", Addr: ip, Port: 7946, Incarnation: 1, State: stateAlive, Vsn: vsn},
+		{Name: "moved", Addr: ip, Port: 7947, Incarnation: 2, State: stateAlive, Vsn: vsn},
+		{Name: "meta", Addr: ip, Port: 7946, Meta: []byte("new"), Incarnation: 2, State: stateAlive, Vsn: vsn},
+		{Name: "sick", Addr: ip, Port: 7946, Incarnation: 1, State: stateSuspect, Vsn: vsn},
+		{Name: "new", Addr: ip, Port: 7946, Incarnation: 1, State: stateAlive, Vsn: vsn},
+	}
+	err := m.mergeRemoteState(&RemoteIdentity{Join: true}, remote, nil)
+	if err == nil || err.Error() != "Custom merge canceled" {
+		t.Fatalf("bad: %v", err)
+	}
+	if _, ok := m.nodeMap["new"]; ok {
+		t.Fatalf("merge should be canceled")
+	}
+
+	expected := []MergeChange{0, MergeAddrChanged, MergeMetaChanged, MergeStateChanged, MergeNew}
+	if len(merge.diffs) != len(expected) {
+		t.Fatalf("bad: %v", merge.diffs)
+	}
+	for i, diff := range merge.diffs {
+		if diff.Remote.Name != remote[i].Name || diff.Changes != expected[i] {
+			t.Fatalf("bad: %d %#v", i, diff)
+		}
+	}
+
+	moved := merge.diffs[1]
+	if moved.Local.Port != 7946 || moved.Remote.Port != 7947 {
+		t.Fatalf("bad: %#v", moved)
+	}
+	if moved.LocalIncarnation != 1 || moved.RemoteIncarnation != 2 {
+		t.Fatalf("bad: %#v", moved)
+	}
+	sick := merge.diffs[3]
+	if sick.LocalStatus != StatusAlive || sick.RemoteStatus != StatusSuspect {
+		t.Fatalf("bad: %#v", sick)
+	}
+	if merge.diffs[4].Local != nil {
+		t.Fatalf("new node should have no local view")
+	}
+
+	// Without a merge delegate the same state merges cleanly.
+	m.config.Merge = nil
+	if err := m.mergeRemoteState(&RemoteIdentity{Join: true}, remote, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := m.nodeMap["new"]; !ok {
+		t.Fatalf("should have merged")
+	}
+}
+
+type gossipTraceRecorder struct {
+	traces []GossipTrace
+}
+
+func (r *gossipTraceRecorder) NotifyGossip(trace GossipTrace) {
+	r.traces = append(r.traces, trace)
+}
+
+func TestMemberList_TraceGossip(t *testing.T) {
+	rec := &gossipTraceRecorder{}
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.GossipTrace = rec
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 7946}
+
+	gone := alive{Node: "gone", Addr: []byte{127, 0, 0, 3}, Incarnation: 1}
+	m.aliveNode(&gone, nil, false)
+	m.broadcasts.Reset()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Origin: "test", Hops: 2}
+	buf, err := encode(aliveMsg, &a)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	m.handleAlive(buf.Bytes()[1:], from)
+
+	// Older members don't send an origin.
+	d := dead{Node: "gone", Incarnation: 1, From: "other"}
+	if buf, err = encode(deadMsg, &d); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	m.handleDead(buf.Bytes()[1:], from)
+
+	expected := []GossipTrace{
+		{Type: "alive", Node: "test", Incarnation: 1, Origin: "test", Hops: 2, From: from},
+		{Type: "dead", Node: "gone", Incarnation: 1, From: from},
+	}
+	if !reflect.DeepEqual(rec.traces, expected) {
+		t.Fatalf("bad: %#v", rec.traces)
+	}
+
+	// The alive message was passed on with the hop to us counted, and the
+	// dead message without any tracing added.
+	sent := make(map[messageType][]interface{})
+	for _, b := range m.broadcasts.bcQueue {
+		msg := b.b.Message()
+		switch messageType(msg[0]) {
+		case aliveMsg:
+			var out alive
+			if err := decode(msg[1:], &out); err != nil {
+				t.Fatalf("unexpected err: %s", err)
+			}
+			sent[aliveMsg] = []interface{}{out.Origin, out.Hops}
+		case deadMsg:
+			var out dead
+			if err := decode(msg[1:], &out); err != nil {
+				t.Fatalf("unexpected err: %s", err)
+			}
+			sent[deadMsg] = []interface{}{out.Origin, out.Hops}
+		}
+	}
+	if !reflect.DeepEqual(sent[aliveMsg], []interface{}{"test", uint8(3)}) {
+		t.Fatalf("bad: %v", sent)
+	}
+	if !reflect.DeepEqual(sent[deadMsg], []interface{}{"", uint8(0)}) {
+		t.Fatalf("bad: %v", sent)
+	}
+}
+
+func TestMemberlist_Join_RejectionReason(t *testing.T) {
+	key1 := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	key2 := []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+
+	cases := []struct {
+		name   string
+		setup1 func(c *Config)
+		setup2 func(c *Config)
+		reason string
+	}{
+		{
+			"label",
+			func(c *Config) { c.Label = "blue" },
+			func(c *Config) { c.Label = "green" },
+			"Cluster label",
+		},
+		{
+			// We sent encrypted state, so the rejection in the clear
+			// isn't taken.
+			"wrong key",
+			func(c *Config) { c.SecretKey = key1 },
+			func(c *Config) { c.SecretKey = key2 },
+			"",
+		},
+		{
+			"not encrypted",
+			func(c *Config) { c.SecretKey = key1 },
+			func(c *Config) {},
+			"Encryption settings",
+		},
+		{
+			"encrypted",
+			func(c *Config) {},
+			func(c *Config) { c.SecretKey = key1 },
+			"",
+		},
+		{
+			"version",
+			func(c *Config) {
+				c.DelegateProtocolMin, c.DelegateProtocolMax, c.DelegateProtocolVersion = 2, 2, 2
+			},
+			func(c *Config) {},
+			"protocol versions",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c1 := testConfig()
+			tc.setup1(c1)
+			m1, err := Create(c1)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer m1.Shutdown()
+
+			c2 := testConfig()
+			c2.BindPort = m1.config.BindPort
+			tc.setup2(c2)
+			m2, err := Create(c2)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			defer m2.Shutdown()
+
+			_, err = m2.Join([]string{m1.config.BindAddr})
+			var rej *MergeRejection
+			if tc.reason == "" {
+				if errors.As(err, &rej) || !errors.Is(err, ErrRemoteNotEncrypted) {
+					t.Fatalf("should not take the rejection, got %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &rej) {
+				t.Fatalf("expected a rejection, got %v", err)
+			}
+			if !strings.Contains(rej.Reason, tc.reason) {
+				t.Fatalf("expected reason to mention %q, got %q", tc.reason, rej.Reason)
+			}
+			if len(m1.Members()) != 1 || len(m2.Members()) != 1 {
+				t.Fatalf("bad: %d %d", len(m1.Members()), len(m2.Members()))
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package memberlist
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+/*
+Every encrypted message carries a 12 byte GCM nonce, which must never be
+repeated under the same key. By default each nonce is read from the
+entropy source, crypto/rand unless Config.Entropy says otherwise, which
+can be swapped for a hardware RNG or, in tests, a fixed stream.
+
+Counter nonces only need the entropy source once, at startup: the nonce is
+a random 4 byte prefix followed by a 64 bit count of the messages we've
+sent. That's cheaper on devices where randomness is slow, but every member
+sharing a key picks its own prefix, so it's only safe while the number of
+members using a key stays well short of the 2^16 or so where prefixes
+start colliding. Receivers don't care which strategy the sender used.
+*/
+
+// NonceStrategy selects how nonces for encrypted messages are generated.
+type NonceStrategy int
+
+const (
+	// NonceRandom reads every nonce from the entropy source.
+	NonceRandom NonceStrategy = iota
+
+	// NonceCounter uses a random per-process prefix followed by a message
+	// counter.
+	NonceCounter
+)
+
+// nonceSource fills in nonces for encrypted messages.
+type nonceSource interface {
+	nonce(b []byte) error
+}
+
+// randomNonces reads each nonce from a random source.
+type randomNonces struct {
+	r io.Reader
+}
+
+func (n randomNonces) nonce(b []byte) error {
+	_, err := io.ReadFull(n.r, b)
+	return err
+}
+
+// counterNonces builds each nonce from a fixed prefix and a counter.
+type counterNonces struct {
+	count  uint64 // First for 64-bit alignment
+	prefix [nonceSize - 8]byte
+}
+
+func (n *counterNonces) nonce(b []byte) error {
+	c := atomic.AddUint64(&n.count, 1)
+	if c == 0 {
+		return fmt.Errorf("Nonce counter exhausted")
+	}
+	copy(b, n.prefix[:])
+	binary.BigEndian.PutUint64(b[len(n.prefix):], c)
+	return nil
+}
+
+// newNonceSource returns the nonce source the config asks for.
+func newNonceSource(conf *Config) (nonceSource, error) {
+	r := conf.Entropy
+	if r == nil {
+		r = rand.Reader
+	}
+	switch conf.NonceStrategy {
+	case NonceRandom:
+		return randomNonces{r}, nil
+	case NonceCounter:
+		n := &counterNonces{}
+		if _, err := io.ReadFull(r, n.prefix[:]); err != nil {
+			return nil, fmt.Errorf("Failed to read nonce prefix: %v", err)
+		}
+		return n, nil
+	default:
+		return nil, fmt.Errorf("Unknown nonce strategy %d", conf.NonceStrategy)
+	}
+}
@@ -0,0 +1,74 @@
+package memberlist
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNonceSource_Random(t *testing.T) {
+	conf := DefaultLANConfig()
+	conf.Entropy = bytes.NewReader(bytes.Repeat([]byte{7}, 2*nonceSize))
+	nonces, err := newNonceSource(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The nonce should come straight from the entropy source.
+	var buf bytes.Buffer
+	if err := encryptPayloadNonce(1, TestKeys[0], []byte("hi"), nil, nonces, &buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(buf.Bytes()[versionSize:versionSize+nonceSize], bytes.Repeat([]byte{7}, nonceSize)) {
+		t.Fatalf("bad nonce: %v", buf.Bytes()[:versionSize+nonceSize])
+	}
+	plain, err := decryptPayload([][]byte{TestKeys[0]}, buf.Bytes(), nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(plain) != "hi" {
+		t.Fatalf("bad: %q", plain)
+	}
+
+	// Running out of entropy is an error, not a zero nonce.
+	nonce := make([]byte, nonceSize)
+	if err := nonces.nonce(nonce); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := nonces.nonce(nonce); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestNonceSource_Counter(t *testing.T) {
+	conf := DefaultLANConfig()
+	conf.NonceStrategy = NonceCounter
+	conf.Entropy = bytes.NewReader([]byte{1, 2, 3, 4})
+	nonces, err := newNonceSource(conf)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	a, b := make([]byte, nonceSize), make([]byte, nonceSize)
+	if err := nonces.nonce(a); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := nonces.nonce(b); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !bytes.Equal(a, []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 1}) {
+		t.Fatalf("bad: %v", a)
+	}
+	if !bytes.Equal(b, []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 2}) {
+		t.Fatalf("bad: %v", b)
+	}
+
+	// Without enough entropy for the prefix we can't start.
+	conf.Entropy = bytes.NewReader(nil)
+	if _, err := newNonceSource(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+	conf.NonceStrategy = 99
+	if _, err := newNonceSource(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
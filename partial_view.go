@@ -0,0 +1,371 @@
+package memberlist
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Partial view mode, modelled on HyParView, is for clusters too big for every
+member to keep track of every other. Instead of the full membership, each
+member keeps a small active view, of up to ActiveViewSize nodes, and a
+larger passive view, of up to PassiveViewSize names and addresses.
+
+The active view is what the rest of memberlist works with: these are the
+only nodes we probe, gossip to, push/pull with, and report from Members, so
+the state we hold and the events we deliver are bounded by its size.
+Broadcasts still reach the whole cluster, since every member passes them
+on to its own active view.
+
+Active views are kept symmetric, so that if we're gossiping to a node, it's
+gossiping to us, and nobody is left out. Nodes only get into the active
+view through a push/pull with them. A push/pull from a node that isn't in
+our active view is refused if there's no room, unless it's joining, or has
+nobody else and says it's joining. Then it's let in, and a random live node
+is pushed out, and sent a disconnect message so it drops us from its own
+active view too. A node that probes us without being in our active view is
+sent one as well, in case an earlier one went missing.
+
+The passive view is a reserve. Nodes we hear about by gossip or push/pull
+go there, and alive messages about them are still passed on. When an active
+node dies, or the active view is short after the dead are reaped, we
+push/pull with a random passive node to take its place, trying the next one
+if it can't be reached. Since every push/pull brings in the peer's active
+view, the periodic push/pull keeps the passive view fresh.
+
+A node dropped from the active view is still alive, so event delegates are
+told it left with LeaveDemoted rather than LeaveFailed.
+*/
+
+// activeViewFull is the reason given for refusing a push/pull for want of
+// room in the active view.
+const activeViewFull = "Active view is full"
+
+// disconnect tells a node that we've dropped it from our active view.
+type disconnect struct {
+	Node string `codec:"Node"`
+}
+
+// passivePeer is a node in the passive view.
+type passivePeer struct {
+	name string
+	addr net.IP
+	port uint16
+}
+
+// passiveView is the bounded reserve of nodes for partial view mode, along
+// with the push/pull peers being let into the active view. It's guarded by
+// the nodeLock.
+type passiveView struct {
+	peers     []passivePeer
+	admitting map[string]struct{}
+	promoting int32 // Set while a promotion is in progress, atomically
+}
+
+// add remembers a node, replacing a random one if the view is full.
+func (v *passiveView) add(p passivePeer, size int) {
+	if size <= 0 {
+		return
+	}
+	for i := range v.peers {
+		if v.peers[i].name == p.name {
+			v.peers[i] = p
+			return
+		}
+	}
+	if len(v.peers) < size {
+		v.peers = append(v.peers, p)
+		return
+	}
+	v.peers[randomOffset(len(v.peers))] = p
+}
+
+// remove forgets a node, returning whether it was there.
+func (v *passiveView) remove(name string) bool {
+	for i := range v.peers {
+		if v.peers[i].name == name {
+			last := len(v.peers) - 1
+			v.peers[i] = v.peers[last]
+			v.peers = v.peers[:last]
+			return true
+		}
+	}
+	return false
+}
+
+// take removes and returns a random node.
+func (v *passiveView) take() (passivePeer, bool) {
+	if len(v.peers) == 0 {
+		return passivePeer{}, false
+	}
+	p := v.peers[randomOffset(len(v.peers))]
+	v.remove(p.name)
+	return p, true
+}
+
+// PassiveView returns the nodes in the passive view in partial view mode,
+// with just their names and addresses. It's empty otherwise.
+func (m *Memberlist) PassiveView() []*Node {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	nodes := make([]*Node, 0, len(m.passive.peers))
+	for _, p := range m.passive.peers {
+		nodes = append(nodes, &Node{Name: p.name, Addr: p.addr, Port: p.port})
+	}
+	return nodes
+}
+
+// activeViewLen returns the number of nodes in the active view, which is
+// the live nodes other than us. The nodeLock must be held.
+func (m *Memberlist) activeViewLen() int {
+	live := 0
+	for _, n := range m.nodes {
+		if n.Name != m.config.Name && n.State != stateDead {
+			live++
+		}
+	}
+	return live
+}
+
+// passiveAlive returns true if an alive message is about a node that
+// belongs in the passive view, in which case it's been kept there and
+// passed on. The nodeLock must be held.
+func (m *Memberlist) passiveAlive(a *alive, notify chan struct{}) bool {
+	if !m.config.PartialView || a.Node == m.config.Name {
+		return false
+	}
+	if _, ok := m.passive.admitting[a.Node]; ok {
+		return false
+	}
+
+	m.passive.add(passivePeer{name: a.Node, addr: a.Addr, port: a.Port}, m.config.PassiveViewSize)
+	if m.aliveLimit.Allow(a.Node, a.Incarnation, time.Now()) {
+		m.encodeBroadcastNotify(a.Node, aliveMsg, a, notify)
+	}
+	return true
+}
+
+// vetActiveView turns away a push/pull from a node that isn't in our
+// active view when there's no room for it, unless it's joining.
+func (m *Memberlist) vetActiveView(id *RemoteIdentity) error {
+	if !m.config.PartialView || id.Join || id.Name == "" || id.Name == m.config.Name {
+		return nil
+	}
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	if _, ok := m.nodeMap[id.Name]; ok || m.activeViewLen() < m.config.ActiveViewSize {
+		return nil
+	}
+	return &MergeRejection{Reason: activeViewFull}
+}
+
+// openActiveView lets a push/pull peer into our active view while its
+// state is merged, pushing out a random node if there's no room. It
+// returns a function to call once the merge is done.
+func (m *Memberlist) openActiveView(id *RemoteIdentity) func() {
+	if !m.config.PartialView || id.Name == "" || id.Name == m.config.Name {
+		return func() {}
+	}
+
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	if _, ok := m.nodeMap[id.Name]; ok {
+		return func() {}
+	}
+	if m.activeViewLen() >= m.config.ActiveViewSize {
+		m.demoteRandom()
+	}
+	if m.passive.admitting == nil {
+		m.passive.admitting = make(map[string]struct{})
+	}
+	m.passive.admitting[id.Name] = struct{}{}
+	return func() {
+		m.nodeLock.Lock()
+		delete(m.passive.admitting, id.Name)
+		m.nodeLock.Unlock()
+	}
+}
+
+// demoteRandom moves a random alive node from the active view to the
+// passive view, and tells it so. Suspect nodes are left alone, for failure
+// detection to settle. The nodeLock must be held.
+func (m *Memberlist) demoteRandom() {
+	var candidates []*nodeState
+	for _, n := range m.nodes {
+		if n.Name != m.config.Name && n.State == stateAlive {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) == 0 {
+		return
+	}
+	state := candidates[randomOffset(len(candidates))]
+	m.demote(state)
+	m.sendDisconnect(state.Addr, state.Port)
+}
+
+// demote drops a node from the active view into the passive view, as if
+// it had been reaped. The nodeLock must be held.
+func (m *Memberlist) demote(state *nodeState) {
+	for i, n := range m.nodes {
+		if n == state {
+			last := len(m.nodes) - 1
+			m.nodes[i] = m.nodes[last]
+			m.nodes[last] = nil
+			m.nodes = m.nodes[:last]
+			break
+		}
+	}
+	delete(m.nodeMap, state.Name)
+	m.endSuspicion(state.Name, SuspicionRefuted, false)
+	m.gossipHealth.forget(state.Name)
+	m.contacts.forget(state.Name)
+	m.transports.forget(state.Name)
+	m.forgetCoordinate(state.Name)
+	atomic.StoreUint32(&m.numNodes, uint32(len(m.nodes)))
+	m.rescale()
+
+	m.passive.add(passivePeer{name: state.Name, addr: state.Addr, port: state.Port}, m.config.PassiveViewSize)
+	metrics.IncrCounter([]string{"memberlist", "partial_view", "demoted"}, 1)
+
+	if m.config.Events != nil || m.config.EventsV2 != nil {
+		node := m.eventNode(state)
+		m.dispatchDelegate(node.Name, "notify_leave", func() {
+			m.notifyLeave(node, LeaveDemoted)
+		})
+	}
+	m.updateCoordinator()
+}
+
+// sendDisconnect tells a node we've dropped it from our active view.
+func (m *Memberlist) sendDisconnect(addr net.IP, port uint16) {
+	to := &net.UDPAddr{IP: addr, Port: int(port)}
+	d := disconnect{Node: m.config.Name}
+	go func() {
+		if err := m.encodeAndSendMsg(to, disconnectMsg, &d); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to send disconnect to %s: %s", to, err)
+		}
+	}()
+}
+
+// handleDisconnect drops a node from the active view at its request. The
+// message has to come from the node's own address. The empty slot is
+// filled the next time the active view is topped up, rather than straight
+// away, so that a full cluster doesn't churn.
+func (m *Memberlist) handleDisconnect(buf []byte, from net.Addr) {
+	var d disconnect
+	if err := decode(buf, &d); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode disconnect message: %s %s", err, LogAddress(from))
+		return
+	}
+	if !m.config.PartialView || d.Node == m.config.Name {
+		return
+	}
+
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	state, ok := m.nodeMap[d.Node]
+	if !ok || state.State == stateDead {
+		return
+	}
+	if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(state.Addr) {
+		m.packetLog.Printf("[WARN] memberlist: Ignoring disconnect for %s from another address %s", d.Node, LogAddress(from))
+		return
+	}
+	m.demote(state)
+}
+
+// checkActivePeer is called when a node probes us. If it isn't in our
+// active view, it has us in its own by mistake, so we send it a disconnect.
+func (m *Memberlist) checkActivePeer(name string, addr net.Addr) {
+	if !m.config.PartialView || name == "" || name == m.config.Name {
+		return
+	}
+	udp, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return
+	}
+
+	m.nodeLock.RLock()
+	_, known := m.nodeMap[name]
+	_, admitting := m.passive.admitting[name]
+	m.nodeLock.RUnlock()
+	if !known && !admitting {
+		m.sendDisconnect(udp.IP, uint16(udp.Port))
+	}
+}
+
+// refusedByActive handles a push/pull refused for want of room by a node
+// in our active view. It must have dropped us, and missed telling us, so
+// we drop it too.
+func (m *Memberlist) refusedByActive(addr net.IP, port uint16) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	for _, n := range m.nodes {
+		if n.Name != m.config.Name && n.State != stateDead && n.Addr.Equal(addr) && n.Port == port {
+			m.demote(n)
+			return
+		}
+	}
+}
+
+// fillActiveView starts promoting a passive node if the active view has
+// room, unless we are leaving. The nodeLock must be held.
+func (m *Memberlist) fillActiveView() {
+	if !m.config.PartialView || m.leave {
+		return
+	}
+	active := m.activeViewLen()
+	if active >= m.config.ActiveViewSize {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&m.passive.promoting, 0, 1) {
+		return
+	}
+	p, ok := m.passive.take()
+	if !ok {
+		atomic.StoreInt32(&m.passive.promoting, 0)
+		return
+	}
+	go m.promote(p, active == 0)
+}
+
+// promote does a push/pull with a passive node to bring it into the active
+// view, forcing its way in like a join if we have no one else. A node that
+// turns us away goes back in the passive view until the next top-up, and
+// one that can't be reached is forgotten, and we try another.
+func (m *Memberlist) promote(p passivePeer, force bool) {
+	err := m.pushPullNode(p.addr, p.port, force)
+	atomic.StoreInt32(&m.passive.promoting, 0)
+
+	select {
+	case <-m.shutdownCh:
+		return
+	default:
+	}
+
+	if err == nil {
+		metrics.IncrCounter([]string{"memberlist", "partial_view", "promoted"}, 1)
+		return
+	}
+	m.logger.Printf("[DEBUG] memberlist: Failed to promote passive node %s: %v", p.name, err)
+	metrics.IncrCounter([]string{"memberlist", "partial_view", "promote_failed"}, 1)
+
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+	var rej *MergeRejection
+	if errors.As(err, &rej) {
+		m.passive.add(p, m.config.PassiveViewSize)
+		return
+	}
+	m.fillActiveView()
+}
@@ -0,0 +1,168 @@
+package memberlist
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPassiveView_Bounds(t *testing.T) {
+	var v passiveView
+	for _, name := range []string{"a", "b", "c", "d"} {
+		v.add(passivePeer{name: name}, 3)
+	}
+	if len(v.peers) != 3 {
+		t.Fatalf("bad: %v", v.peers)
+	}
+
+	// Adding a node we have updates it in place.
+	name := v.peers[0].name
+	v.add(passivePeer{name: name, port: 42}, 3)
+	if len(v.peers) != 3 || v.peers[0].port != 42 {
+		t.Fatalf("bad: %v", v.peers)
+	}
+
+	if !v.remove(name) || v.remove(name) {
+		t.Fatalf("should remove once")
+	}
+	for len(v.peers) > 0 {
+		if _, ok := v.take(); !ok {
+			t.Fatalf("should take")
+		}
+	}
+	if _, ok := v.take(); ok {
+		t.Fatalf("should be empty")
+	}
+
+	v.add(passivePeer{name: "a"}, 0)
+	if len(v.peers) != 0 {
+		t.Fatalf("bad: %v", v.peers)
+	}
+}
+
+func TestMemberlist_PartialView_Invalid(t *testing.T) {
+	c := testConfig()
+	c.PartialView = true
+	c.ActiveViewSize = 0
+	if _, err := NewMemberlistOnOpenPort(c); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func partialViewConfig() *Config {
+	c := testConfig()
+	c.PartialView = true
+	c.ActiveViewSize = 2
+	c.PassiveViewSize = 10
+	c.ProbeInterval = 20 * time.Millisecond
+	c.ProbeTimeout = 10 * time.Millisecond
+	c.GossipInterval = 5 * time.Millisecond
+	c.SuspicionMult = 1
+	return c
+}
+
+// partialViewCovered returns an error unless the active views are
+// symmetric, every live node is in one, and none are over their size.
+func partialViewCovered(lists []*Memberlist) error {
+	active := make(map[string]map[string]bool)
+	for _, m := range lists {
+		peers := make(map[string]bool)
+		for _, n := range m.Members() {
+			if n.Name != m.config.Name {
+				peers[n.Name] = true
+			}
+		}
+		if len(peers) == 0 || len(peers) > m.config.ActiveViewSize {
+			return fmt.Errorf("%s has active view %v", m.config.Name, peers)
+		}
+		active[m.config.Name] = peers
+	}
+	for name, peers := range active {
+		for peer := range peers {
+			if !active[peer][name] {
+				return fmt.Errorf("%s has %s, but not the other way around", name, peer)
+			}
+		}
+	}
+	return nil
+}
+
+func TestMemberlist_PartialView(t *testing.T) {
+	c1 := partialViewConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	lists := []*Memberlist{m1}
+	for i := 0; i < 4; i++ {
+		c := partialViewConfig()
+		c.BindPort = c1.BindPort
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer m.Shutdown()
+		if _, err := m.Join([]string{c1.BindAddr}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		lists = append(lists, m)
+	}
+
+	// The seed, which everyone joined, keeps the nodes it had to push out
+	// in reserve.
+	if n := len(m1.PassiveView()); n < 2 {
+		t.Fatalf("bad passive view: %v", nodeNames(m1.PassiveView()))
+	}
+
+	waitCovered := func(lists []*Memberlist) {
+		deadline := time.Now().Add(5 * time.Second)
+		err := partialViewCovered(lists)
+		for err != nil && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			err = partialViewCovered(lists)
+		}
+		if err != nil {
+			for _, m := range lists {
+				t.Logf("%s: %v passive %v", m.config.Name, nodeNames(m.Members()), nodeNames(m.PassiveView()))
+			}
+			t.Fatalf("err: %v", err)
+		}
+	}
+	waitCovered(lists)
+
+	// When an active node fails, the nodes it leaves short fill up from
+	// their passive views, and the failed node is forgotten.
+	var failed *Memberlist
+	for _, m := range lists[1:] {
+		if _, ok := m1.MemberStatus(m.config.Name); ok {
+			failed = m
+		}
+	}
+	if failed == nil {
+		t.Fatalf("no active nodes")
+	}
+	failed.Shutdown()
+
+	var live []*Memberlist
+	for _, m := range lists {
+		if m != failed {
+			live = append(live, m)
+		}
+	}
+	waitCovered(live)
+	for _, m := range live {
+		if s, ok := m.MemberStatus(failed.config.Name); ok && s != StatusDead {
+			t.Fatalf("%s still has the failed node: %v", m.config.Name, s)
+		}
+	}
+}
+
+func nodeNames(nodes []*Node) []string {
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
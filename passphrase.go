@@ -0,0 +1,321 @@
+package memberlist
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"golang.org/x/crypto/argon2"
+)
+
+/*
+A cluster can be keyed with a passphrase instead of a raw key. The key is
+derived from the passphrase with Argon2id, using a salt and cost
+parameters that every member must share. They aren't secret, and are
+written as a single string in the usual PHC form:
+
+  $argon2id$v=19$m=65536,t=3,p=4$<base64 salt>
+
+If Config.PassphraseKDF fixes the salt, the key is derived from it at
+startup and never changes. Otherwise we pick a random salt. If
+Config.PassphraseAdopt is set, before our first join we ask the node we're
+joining for its parameters, in the clear since we can't decrypt anything
+yet. If they differ from ours we derive the cluster's key from them and
+swap it in for our own. Once we've merged state with anyone our salt is in
+use, so we stop adopting others.
+
+Since the parameters aren't authenticated, a forged answer could hand us
+cheap ones, making our traffic easier to attack offline, or ruinously
+expensive ones, exhausting our memory or CPU while we derive the key. We
+only adopt parameters at least as costly as our own, and no more than
+passphraseAdoptFactor times as costly, so neither works. Argon2 isn't FIPS
+approved, so passphrases can't be used in FIPS mode.
+*/
+
+const (
+	// Argon2id defaults, as RFC 9106 recommends where memory is limited.
+	passphraseTime    = 3
+	passphraseMemory  = 64 * 1024 // KiB
+	passphraseThreads = 4
+
+	// The most we'll ever spend deriving a key, whatever we're told.
+	passphraseMaxTime    = 64
+	passphraseMaxMemory  = 4 * 1024 * 1024 // KiB
+	passphraseMaxThreads = 64
+
+	// passphraseAdoptFactor caps the costs we'll adopt from a peer at this
+	// multiple of our configured ones.
+	passphraseAdoptFactor = 4
+
+	passphraseSaltSize = 16
+	passphraseKeySize  = 32
+)
+
+// PassphraseKDF holds the Argon2id parameters used to derive the cluster
+// key from Config.Passphrase.
+type PassphraseKDF struct {
+	// Salt is shared by every member. If it's empty, a random one is
+	// used until we learn the cluster's when we first join.
+	Salt []byte
+
+	// Time, Memory (in KiB) and Threads are the Argon2id costs.
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultPassphraseKDF returns the default Argon2id parameters, with no
+// salt.
+func DefaultPassphraseKDF() *PassphraseKDF {
+	return &PassphraseKDF{
+		Time:    passphraseTime,
+		Memory:  passphraseMemory,
+		Threads: passphraseThreads,
+	}
+}
+
+// String encodes the parameters in PHC form.
+func (p *PassphraseKDF) String() string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads, base64.RawStdEncoding.EncodeToString(p.Salt))
+}
+
+// ParsePassphraseKDF decodes parameters in the PHC form written by String.
+func ParsePassphraseKDF(s string) (*PassphraseKDF, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 5 || parts[0] != "" || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("Passphrase parameters '%s' aren't argon2id", s)
+	}
+	var vsn int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &vsn); err != nil || vsn != argon2.Version {
+		return nil, fmt.Errorf("Unsupported argon2id version '%s'", parts[2])
+	}
+	p := &PassphraseKDF{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return nil, fmt.Errorf("Bad argon2id costs '%s': %v", parts[3], err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("Bad argon2id salt: %v", err)
+	}
+	if len(salt) > 0 {
+		p.Salt = salt
+	}
+	return p, p.validate()
+}
+
+func (p *PassphraseKDF) validate() error {
+	if p.Time < 1 || p.Memory < 8*uint32(p.Threads) || p.Threads < 1 {
+		return fmt.Errorf("Argon2id costs m=%d,t=%d,p=%d are invalid", p.Memory, p.Time, p.Threads)
+	}
+	if p.Time > passphraseMaxTime || p.Memory > passphraseMaxMemory || p.Threads > passphraseMaxThreads {
+		return fmt.Errorf("Argon2id costs m=%d,t=%d,p=%d exceed the maximum m=%d,t=%d,p=%d",
+			p.Memory, p.Time, p.Threads, passphraseMaxMemory, passphraseMaxTime, passphraseMaxThreads)
+	}
+	if len(p.Salt) > 0 && len(p.Salt) < passphraseSaltSize {
+		return fmt.Errorf("Argon2id salt must be at least %d bytes", passphraseSaltSize)
+	}
+	return nil
+}
+
+// atLeast returns true if the parameters cost at least as much as floor.
+func (p *PassphraseKDF) atLeast(floor *PassphraseKDF) bool {
+	return p.Time >= floor.Time && p.Memory >= floor.Memory
+}
+
+// atMost returns true if the parameters cost no more than factor times
+// ceil.
+func (p *PassphraseKDF) atMost(ceil *PassphraseKDF, factor uint64) bool {
+	return uint64(p.Time) <= factor*uint64(ceil.Time) &&
+		uint64(p.Memory) <= factor*uint64(ceil.Memory) &&
+		uint64(p.Threads) <= factor*uint64(ceil.Threads)
+}
+
+// deriveKey derives a cluster key from a passphrase.
+func (p *PassphraseKDF) deriveKey(passphrase []byte) []byte {
+	return argon2.IDKey(passphrase, p.Salt, p.Time, p.Memory, p.Threads, passphraseKeySize)
+}
+
+// passphraseState tracks the parameters our key was derived with.
+type passphraseState struct {
+	sync.Mutex
+	kdf       *PassphraseKDF
+	floor     *PassphraseKDF // The configured costs, which adopted ones must meet
+	key       []byte
+	adoptable bool
+}
+
+// passphraseKey works out the parameters and derives the initial key for
+// a passphrase config.
+func passphraseKey(conf *Config) (*passphraseState, error) {
+	if fipsEnforced() {
+		return nil, fmt.Errorf("Passphrase keys use Argon2, which isn't allowed in FIPS mode")
+	}
+	if len(conf.SecretKey) > 0 {
+		return nil, fmt.Errorf("Passphrase and SecretKey can't both be set")
+	}
+
+	floor := conf.PassphraseKDF
+	if floor == nil {
+		floor = DefaultPassphraseKDF()
+	}
+	if err := floor.validate(); err != nil {
+		return nil, err
+	}
+	kdf := *floor
+	s := &passphraseState{kdf: &kdf, floor: floor}
+	if len(kdf.Salt) == 0 {
+		r := conf.Entropy
+		if r == nil {
+			r = rand.Reader
+		}
+		kdf.Salt = make([]byte, passphraseSaltSize)
+		if _, err := io.ReadFull(r, kdf.Salt); err != nil {
+			return nil, fmt.Errorf("Failed to read passphrase salt: %v", err)
+		}
+		s.adoptable = conf.PassphraseAdopt
+	}
+	s.key = kdf.deriveKey(conf.Passphrase)
+	return s, nil
+}
+
+// PassphraseKDF returns the parameters the cluster key was derived from
+// the passphrase with, in PHC form, or an empty string if we aren't using
+// a passphrase. Other members can be configured with them to avoid having
+// to learn them on join.
+func (m *Memberlist) PassphraseKDF() string {
+	if m.passphrase == nil {
+		return ""
+	}
+	m.passphrase.Lock()
+	defer m.passphrase.Unlock()
+	return m.passphrase.kdf.String()
+}
+
+// settlePassphrase stops us adopting another salt once ours is in use.
+func (m *Memberlist) settlePassphrase() {
+	if m.passphrase == nil {
+		return
+	}
+	m.passphrase.Lock()
+	m.passphrase.adoptable = false
+	m.passphrase.Unlock()
+}
+
+// learnPassphrase asks a node we're about to join for its passphrase
+// parameters, and switches our key over to them if we can.
+func (m *Memberlist) learnPassphrase(addr []byte, port uint16) error {
+	if m.passphrase == nil {
+		return nil
+	}
+	m.passphrase.Lock()
+	adoptable := m.passphrase.adoptable
+	m.passphrase.Unlock()
+	if !adoptable {
+		return nil
+	}
+
+	dest := net.TCPAddr{IP: addr, Port: int(port)}
+	kdf, err := m.fetchPassphraseKDF(dest.String())
+	if err != nil {
+		return err
+	}
+	return m.adoptPassphrase(kdf)
+}
+
+// adoptPassphrase derives the key for another member's parameters and
+// makes it our primary key.
+func (m *Memberlist) adoptPassphrase(kdf *PassphraseKDF) error {
+	s := m.passphrase
+	s.Lock()
+	defer s.Unlock()
+	if !s.adoptable || kdf.String() == s.kdf.String() {
+		return nil
+	}
+	if len(kdf.Salt) == 0 {
+		return fmt.Errorf("Peer's passphrase parameters have no salt")
+	}
+	if !kdf.atLeast(s.floor) {
+		metrics.IncrCounter([]string{"memberlist", "passphrase", "weak"}, 1)
+		return fmt.Errorf("Peer's passphrase parameters %s are weaker than ours", kdf)
+	}
+	if !kdf.atMost(s.floor, passphraseAdoptFactor) {
+		metrics.IncrCounter([]string{"memberlist", "passphrase", "costly"}, 1)
+		return fmt.Errorf("Peer's passphrase parameters %s are too costly to adopt", kdf)
+	}
+
+	key := kdf.deriveKey(m.config.Passphrase)
+	if err := m.config.Keyring.AddKey(key); err != nil {
+		return err
+	}
+	if err := m.config.Keyring.UseKey(key); err != nil {
+		return err
+	}
+	if err := m.config.Keyring.RemoveKey(s.key); err != nil {
+		return err
+	}
+	s.kdf, s.key, s.adoptable = kdf, key, false
+	m.logger.Printf("[INFO] memberlist: Adopted cluster passphrase parameters %s", kdf)
+	return nil
+}
+
+// fetchPassphraseKDF asks a node for its passphrase parameters.
+func (m *Memberlist) fetchPassphraseKDF(addr string) (*PassphraseKDF, error) {
+	conn, err := m.dialTCP(addr, time.Now().Add(m.tune().TCPTimeout))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(m.tune().TCPTimeout))
+
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{byte(saltReqMsg)}); err != nil {
+		return nil, err
+	}
+
+	msgType, _, dec, err := m.readStream(conn, nil, plainReplyMsg)
+	if err != nil {
+		return nil, err
+	}
+	switch msgType {
+	case mergeRejectMsg:
+		var rej mergeReject
+		if err := dec.Decode(&rej); err != nil {
+			return nil, err
+		}
+		return nil, &MergeRejection{Reason: rej.Reason}
+	case saltRespMsg:
+		var resp saltResp
+		if err := dec.Decode(&resp); err != nil {
+			return nil, err
+		}
+		return ParsePassphraseKDF(resp.KDF)
+	default:
+		return nil, fmt.Errorf("received invalid msgType (%d), expected saltRespMsg (%d) %s", msgType, saltRespMsg, LogConn(conn))
+	}
+}
+
+// sendPassphraseKDF answers a request for our passphrase parameters, in
+// the clear.
+func (m *Memberlist) sendPassphraseKDF(conn net.Conn) {
+	if m.passphrase == nil {
+		m.rejectStream(conn, "Not using a passphrase", true)
+		return
+	}
+	out, err := encode(saltRespMsg, &saltResp{KDF: m.PassphraseKDF()})
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to encode passphrase parameters: %s", err)
+		return
+	}
+	if _, err := conn.Write(out.Bytes()); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send passphrase parameters: %s %s", err, LogConn(conn))
+	}
+}
@@ -0,0 +1,188 @@
+package memberlist
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testPassphraseKDF() *PassphraseKDF {
+	return &PassphraseKDF{Time: 1, Memory: 1024, Threads: 1}
+}
+
+func TestPassphraseKDF_ParseString(t *testing.T) {
+	p := testPassphraseKDF()
+	p.Salt = bytes.Repeat([]byte{9}, passphraseSaltSize)
+	s := p.String()
+	if !strings.HasPrefix(s, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Fatalf("bad: %s", s)
+	}
+	out, err := ParsePassphraseKDF(s)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.String() != s {
+		t.Fatalf("bad: %s", out)
+	}
+
+	for _, bad := range []string{
+		"",
+		"$argon2i$v=19$m=1024,t=1,p=1$",
+		"$argon2id$v=16$m=1024,t=1,p=1$",
+		"$argon2id$v=19$m=1024,t=0,p=1$",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$",
+		"$argon2id$v=19$m=1024,t=1000000,p=1$",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2hvcnQ",
+		"$argon2id$v=19$m=1024,t=1,p=1$!!",
+	} {
+		if _, err := ParsePassphraseKDF(bad); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestPassphraseKDF_Config(t *testing.T) {
+	if fipsEnforced() {
+		t.Skip("passphrases aren't allowed in FIPS mode")
+	}
+
+	c := testConfig()
+	c.Passphrase = []byte("correct horse battery staple")
+	c.PassphraseKDF = testPassphraseKDF()
+	c.SecretKey = TestKeys[0]
+	if _, err := Create(c); err == nil || !strings.Contains(err.Error(), "both") {
+		t.Fatalf("expected conflict error, got %v", err)
+	}
+
+	// A fixed salt always gives the same key.
+	c = testConfig()
+	c.Passphrase = []byte("correct horse battery staple")
+	c.PassphraseKDF = testPassphraseKDF()
+	c.PassphraseKDF.Salt = bytes.Repeat([]byte{9}, passphraseSaltSize)
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+	want := c.PassphraseKDF.deriveKey(c.Passphrase)
+	if !bytes.Equal(m.config.Keyring.GetPrimaryKey(), want) {
+		t.Fatalf("bad key")
+	}
+	if m.PassphraseKDF() != c.PassphraseKDF.String() {
+		t.Fatalf("bad: %s", m.PassphraseKDF())
+	}
+}
+
+func TestMemberlist_Join_Passphrase(t *testing.T) {
+	if fipsEnforced() {
+		t.Skip("passphrases aren't allowed in FIPS mode")
+	}
+
+	c1 := testConfig()
+	c1.Passphrase = []byte("correct horse battery staple")
+	c1.PassphraseKDF = testPassphraseKDF()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	// A member that insists on higher costs won't adopt ours.
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.Passphrase = c1.Passphrase
+	c2.PassphraseKDF = testPassphraseKDF()
+	c2.PassphraseKDF.Time = 2
+	c2.PassphraseAdopt = true
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err == nil {
+		t.Fatalf("expected join to fail")
+	}
+	if m2.PassphraseKDF() == m1.PassphraseKDF() {
+		t.Fatalf("should not have adopted weaker parameters")
+	}
+
+	// One with matching costs picks up our salt and joins.
+	c3 := testConfig()
+	c3.BindPort = m1.config.BindPort
+	c3.Passphrase = c1.Passphrase
+	c3.PassphraseKDF = testPassphraseKDF()
+	c3.PassphraseAdopt = true
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m3.Shutdown()
+	if m3.PassphraseKDF() == m1.PassphraseKDF() {
+		t.Fatalf("salts should start out different")
+	}
+	if _, err := m3.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if m3.PassphraseKDF() != m1.PassphraseKDF() {
+		t.Fatalf("bad: %s != %s", m3.PassphraseKDF(), m1.PassphraseKDF())
+	}
+	if m3.NumMembers() != 2 {
+		t.Fatalf("expected 2 members, got %d", m3.NumMembers())
+	}
+
+	// One that hasn't opted in keeps its own salt and can't join.
+	c4 := testConfig()
+	c4.BindPort = m1.config.BindPort
+	c4.Passphrase = c1.Passphrase
+	c4.PassphraseKDF = testPassphraseKDF()
+	m4, err := Create(c4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m4.Shutdown()
+	if _, err := m4.Join([]string{m1.config.BindAddr}); err == nil {
+		t.Fatalf("expected join to fail")
+	}
+	if m4.PassphraseKDF() == m1.PassphraseKDF() {
+		t.Fatalf("should not have adopted without opting in")
+	}
+
+	// Once merged, our salt is settled.
+	other := testPassphraseKDF()
+	other.Salt = bytes.Repeat([]byte{1}, passphraseSaltSize)
+	if err := m3.adoptPassphrase(other); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if m3.PassphraseKDF() != m1.PassphraseKDF() {
+		t.Fatalf("should not adopt after merging")
+	}
+}
+
+func TestMemberlist_AdoptPassphrase_TooCostly(t *testing.T) {
+	if fipsEnforced() {
+		t.Skip("passphrases aren't allowed in FIPS mode")
+	}
+
+	c := testConfig()
+	c.Passphrase = []byte("correct horse battery staple")
+	c.PassphraseKDF = testPassphraseKDF()
+	c.PassphraseAdopt = true
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	// A forged answer asking for far more memory than we're configured
+	// with is refused before we derive anything.
+	costly := testPassphraseKDF()
+	costly.Memory = (passphraseAdoptFactor + 1) * c.PassphraseKDF.Memory
+	costly.Salt = bytes.Repeat([]byte{1}, passphraseSaltSize)
+	before := m.PassphraseKDF()
+	if err := m.adoptPassphrase(costly); err == nil || !strings.Contains(err.Error(), "costly") {
+		t.Fatalf("expected costly error, got %v", err)
+	}
+	if m.PassphraseKDF() != before {
+		t.Fatalf("should not have adopted costly parameters")
+	}
+}
@@ -0,0 +1,128 @@
+package memberlist
+
+import (
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Pausing takes a node out of failure detection for maintenance without it
+leaving. A paused node gossips an alive message with the Paused flag set
+and a new incarnation, waits for it to go out, and then stops probing,
+gossiping and push/pulls of its own. Its listeners keep running, so it
+still answers pings and push/pulls from others.
+
+Other members mark it paused rather than alive: they don't probe it,
+suspect it or pick it for gossip, but still list it as a member. Resuming
+gossips an ordinary alive message with another new incarnation, which moves
+it straight back to alive without a join, so maintenance doesn't cause any
+churn. A node that's paused for longer than PauseTimeout is probed again,
+so that one that fails while paused is still found. Older members ignore
+the flag and see a paused node as alive, which is harmless since it still
+answers their probes.
+*/
+
+// Pause stops us probing and gossiping, and tells the cluster we're
+// paused so that we aren't suspected while we're not taking part. Like
+// UpdateNode, it waits for the news to go out, for as long as the timeout
+// allows or forever if it's zero, and returns ErrUpdateTimeout if it
+// doesn't, though we're paused all the same. Pausing when already paused
+// does nothing.
+func (m *Memberlist) Pause(timeout time.Duration) error {
+	if m.Paused() {
+		return nil
+	}
+	notifyCh, err := m.announceLocal(true)
+	if err != nil {
+		return err
+	}
+
+	// Wait for the broadcast, since it won't be gossiped once we stop. We
+	// stop whether or not it goes out in time, as we're already paused in
+	// our own state, and others pick that up from push/pulls.
+	err = m.waitBroadcast(notifyCh, timeout)
+	m.deschedule()
+	metrics.IncrCounter([]string{"memberlist", "paused"}, 1)
+	m.logger.Printf("[INFO] memberlist: Paused")
+	return err
+}
+
+// Resume undoes Pause, starting probing and gossip again and telling the
+// cluster we're back. It doesn't wait for the news to go out, as gossip
+// carries it once we're running again.
+func (m *Memberlist) Resume() error {
+	if !m.Paused() {
+		return nil
+	}
+	if _, err := m.announceLocal(false); err != nil {
+		return err
+	}
+	m.schedule()
+	m.logger.Printf("[INFO] memberlist: Resumed")
+	return nil
+}
+
+// Paused returns true if we're paused.
+func (m *Memberlist) Paused() bool {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	state, ok := m.nodeMap[m.config.Name]
+	return ok && state.State == statePaused
+}
+
+// announceLocal gossips an alive message for ourselves with the paused
+// flag set as given, and the maintenance flag as it stands, returning a
+// channel that's closed once it's gone out.
+func (m *Memberlist) announceLocal(paused bool) (chan struct{}, error) {
+	select {
+	case <-m.shutdownCh:
+		return nil, ErrShutdown
+	default:
+	}
+
+	m.nodeLock.RLock()
+	state := m.nodeMap[m.config.Name]
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        state.Name,
+		Addr:        state.Addr,
+		Port:        state.Port,
+		Meta:        state.Meta,
+		Vsn:         m.localVsn(),
+		Paused:      paused,
+		Maintenance: m.InMaintenance(),
+	}
+	m.nodeLock.RUnlock()
+
+	notifyCh := make(chan struct{})
+	m.aliveNode(&a, notifyCh, true)
+	return notifyCh, nil
+}
+
+// waitBroadcast waits for a broadcast to go out, like UpdateNode, if there
+// are any members to send it to.
+func (m *Memberlist) waitBroadcast(notifyCh chan struct{}, timeout time.Duration) error {
+	if !m.anyAlive() {
+		return nil
+	}
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timeoutCh = time.After(timeout)
+	}
+	select {
+	case <-notifyCh:
+		return nil
+	case <-timeoutCh:
+		return ErrUpdateTimeout
+	case <-m.shutdownCh:
+		return ErrShutdown
+	}
+}
+
+// pauseExpired returns true if a node has been paused for longer than
+// PauseTimeout, and should be checked on again.
+func (m *Memberlist) pauseExpired(state *nodeState) bool {
+	return state.State == statePaused && m.config.PauseTimeout > 0 &&
+		time.Since(state.StateChange) > m.config.PauseTimeout
+}
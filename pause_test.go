@@ -0,0 +1,150 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemberlist_PauseResume(t *testing.T) {
+	c1 := testConfig()
+	c1.GossipInterval = 5 * time.Millisecond
+	events := make(chan NodeEvent, 16)
+	c1.Events = &ChannelEventDelegate{Ch: events}
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.GossipInterval = 5 * time.Millisecond
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stateOf := func(name string) nodeStateType {
+		m1.nodeLock.RLock()
+		defer m1.nodeLock.RUnlock()
+		return m1.nodeMap[name].State
+	}
+	waitFor := func(name string, want nodeStateType) {
+		deadline := time.Now().Add(2 * time.Second)
+		for stateOf(name) != want && time.Now().Before(deadline) {
+			yield()
+		}
+		if got := stateOf(name); got != want {
+			t.Fatalf("expected state %d, got %d", want, got)
+		}
+	}
+	waitFor(c2.Name, stateAlive)
+	for len(events) > 0 {
+		<-events
+	}
+
+	if err := m2.Pause(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !m2.Paused() {
+		t.Fatalf("should be paused")
+	}
+	if err := m2.Pause(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitFor(c2.Name, statePaused)
+	if m1.NumMembers() != 2 {
+		t.Fatalf("paused node should still be a member")
+	}
+
+	// Paused nodes can't be suspected.
+	m1.nodeLock.RLock()
+	inc := m1.nodeMap[c2.Name].Incarnation
+	m1.nodeLock.RUnlock()
+	m1.suspectNode(&suspect{Node: c2.Name, Incarnation: inc, From: c1.Name})
+	if got := stateOf(c2.Name); got != statePaused {
+		t.Fatalf("expected paused, got %d", got)
+	}
+
+	if err := m2.Resume(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if m2.Paused() {
+		t.Fatalf("should not be paused")
+	}
+	waitFor(c2.Name, stateAlive)
+
+	// Coming back isn't a join.
+	select {
+	case e := <-events:
+		if e.Event == NodeJoin || e.Event == NodeLeave {
+			t.Fatalf("unexpected event: %v", e)
+		}
+	default:
+	}
+}
+
+func TestMemberlist_PauseExpired(t *testing.T) {
+	m := &Memberlist{config: DefaultLANConfig()}
+	m.config.PauseTimeout = time.Minute
+
+	state := &nodeState{State: statePaused, StateChange: time.Now()}
+	if m.pauseExpired(state) {
+		t.Fatalf("should not have expired")
+	}
+	state.StateChange = time.Now().Add(-2 * time.Minute)
+	if !m.pauseExpired(state) {
+		t.Fatalf("should have expired")
+	}
+	state.State = stateSuspect
+	if m.pauseExpired(state) {
+		t.Fatalf("only paused nodes expire")
+	}
+	state.State = statePaused
+	m.config.PauseTimeout = 0
+	if m.pauseExpired(state) {
+		t.Fatalf("zero timeout never expires")
+	}
+}
+
+func TestMemberlist_Pause_Timeout(t *testing.T) {
+	c := testConfig()
+	c.GossipInterval = 0
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	// Nothing gossips the news, so it doesn't go out in time.
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	if err := m.Pause(10 * time.Millisecond); err != ErrUpdateTimeout {
+		t.Fatalf("should time out: %v", err)
+	}
+
+	// We're paused and stopped all the same.
+	if !m.Paused() {
+		t.Fatalf("should be paused")
+	}
+	m.tickerLock.Lock()
+	tickers := len(m.tickers)
+	m.tickerLock.Unlock()
+	if tickers != 0 {
+		t.Fatalf("should have stopped: %d tickers", tickers)
+	}
+
+	if err := m.Resume(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m.tickerLock.Lock()
+	tickers = len(m.tickers)
+	m.tickerLock.Unlock()
+	if tickers == 0 {
+		t.Fatalf("should have started again")
+	}
+}
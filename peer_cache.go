@@ -0,0 +1,264 @@
+package memberlist
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+The peer cache remembers members we've seen recently in a file, so that a
+node restarting while its seeds are down can still find its way back into
+the cluster. If none of the addresses given to Join work, the cached peers
+are tried instead, most recently seen first, until one of them lets us in.
+A push/pull with one member brings in the whole cluster, so there's no
+point in going on, and the number tried is capped so that a cache full of
+stale addresses doesn't hold up the join for long.
+
+Cached peers are trusted on reuse only if they still are who we remember:
+the node answering at a cached address must list itself under the cached
+name in its push/pull state, or its state is thrown away and the entry is
+dropped from the cache.
+*/
+
+// maxCachedPeers limits the number of peers kept in the cache file.
+const maxCachedPeers = 64
+
+// maxCachedPeerJoins limits the number of cached peers tried in one join.
+const maxCachedPeerJoins = 8
+
+// cachedPeer is an entry in the peer cache.
+type cachedPeer struct {
+	Name     string
+	Addr     net.IP
+	Port     uint16
+	LastSeen time.Time
+}
+
+// peerCache is the on-disk cache of recently seen peers.
+type peerCache struct {
+	path   string
+	maxAge time.Duration
+	l      sync.Mutex
+}
+
+// newPeerCache returns a cache backed by the given file.
+func newPeerCache(path string, maxAge time.Duration) *peerCache {
+	return &peerCache{path: path, maxAge: maxAge}
+}
+
+// Peers returns the unexpired peers in the cache, most recently seen first.
+// A missing cache file is the same as an empty cache.
+func (c *peerCache) Peers(now time.Time) ([]cachedPeer, error) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.read(now)
+}
+
+// read loads the cache file. The lock must be held.
+func (c *peerCache) read(now time.Time) ([]cachedPeer, error) {
+	buf, err := ioutil.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var peers []cachedPeer
+	if err := json.Unmarshal(buf, &peers); err != nil {
+		return nil, fmt.Errorf("Failed to decode peer cache: %v", err)
+	}
+	return c.prune(peers, now), nil
+}
+
+// prune sorts peers newest first and drops expired and excess entries.
+func (c *peerCache) prune(peers []cachedPeer, now time.Time) []cachedPeer {
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen.After(peers[j].LastSeen)
+	})
+	n := 0
+	for _, p := range peers {
+		if c.maxAge > 0 && now.Sub(p.LastSeen) > c.maxAge {
+			continue
+		}
+		peers[n] = p
+		n++
+	}
+	peers = peers[:n]
+	if len(peers) > maxCachedPeers {
+		peers = peers[:maxCachedPeers]
+	}
+	return peers
+}
+
+// Update records the given peers as seen now, keeping other unexpired
+// entries, and writes the cache back out.
+func (c *peerCache) Update(seen []cachedPeer, now time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	old, err := c.read(now)
+	if err != nil {
+		// Don't let a corrupt cache stop us from writing a good one.
+		old = nil
+	}
+	byName := make(map[string]cachedPeer, len(old)+len(seen))
+	for _, p := range old {
+		byName[p.Name] = p
+	}
+	for _, p := range seen {
+		p.LastSeen = now
+		byName[p.Name] = p
+	}
+
+	peers := make([]cachedPeer, 0, len(byName))
+	for _, p := range byName {
+		peers = append(peers, p)
+	}
+	return c.write(c.prune(peers, now))
+}
+
+// Remove drops a peer from the cache.
+func (c *peerCache) Remove(name string, now time.Time) error {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	peers, err := c.read(now)
+	if err != nil {
+		return err
+	}
+	n := 0
+	for _, p := range peers {
+		if p.Name != name {
+			peers[n] = p
+			n++
+		}
+	}
+	return c.write(peers[:n])
+}
+
+// write replaces the cache file atomically. The lock must be held.
+func (c *peerCache) write(peers []cachedPeer) error {
+	buf, err := json.Marshal(peers)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(c.path), filepath.Base(c.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), c.path)
+}
+
+// savePeerCache records the live members we know about in the peer cache.
+func (m *Memberlist) savePeerCache() {
+	if m.peers == nil {
+		return
+	}
+
+	m.nodeLock.RLock()
+	seen := make([]cachedPeer, 0, len(m.nodes))
+	for _, n := range m.nodes {
+		if !n.State.active() || n.Name == m.config.Name {
+			continue
+		}
+		seen = append(seen, cachedPeer{Name: n.Name, Addr: n.Addr, Port: n.Port})
+	}
+	m.nodeLock.RUnlock()
+
+	if len(seen) == 0 {
+		return
+	}
+	if err := m.peers.Update(seen, time.Now()); err != nil {
+		m.logger.Printf("[WARN] memberlist: Failed to update peer cache: %v", err)
+	}
+}
+
+// joinPeerCache tries to join through the cached peers, stopping at the
+// first that works, and returns the outcome for each one tried.
+func (m *Memberlist) joinPeerCache() []JoinResult {
+	peers, err := m.peers.Peers(time.Now())
+	if err != nil {
+		m.logger.Printf("[WARN] memberlist: Failed to read peer cache: %v", err)
+		return nil
+	}
+
+	var results []JoinResult
+	for _, p := range peers {
+		if p.Name == m.config.Name {
+			continue
+		}
+		if len(results) == maxCachedPeerJoins {
+			m.logger.Printf("[DEBUG] memberlist: Gave up on the peer cache after %d peers", len(results))
+			break
+		}
+
+		r := JoinResult{Host: p.Name, Addr: p.Addr, Port: p.Port, Attempts: 1}
+		start := time.Now()
+		err := m.joinCachedPeer(p)
+		r.Latency = time.Since(start)
+		if err != nil {
+			r.Class = m.classifyJoinError(err)
+			r.Err = &JoinHostError{Host: p.Name, Op: "join", Err: err}
+			m.logger.Printf("[DEBUG] memberlist: Failed to join cached peer %s: %v", p.Name, err)
+		} else {
+			r.Class = JoinSuccess
+		}
+		results = append(results, r)
+		if err == nil {
+			break
+		}
+	}
+	if n := joinedCount(results); n > 0 {
+		metrics.IncrCounter([]string{"memberlist", "peer_cache", "joined"}, float32(n))
+	}
+	return results
+}
+
+// joinCachedPeer does a push/pull with a cached peer, provided it still
+// answers under the cached name.
+func (m *Memberlist) joinCachedPeer(p cachedPeer) error {
+	id, remote, userState, err := m.sendAndReceiveState(p.Addr, p.Port, true)
+	if err != nil {
+		return err
+	}
+	if !claimsIdentity(remote, p) {
+		metrics.IncrCounter([]string{"memberlist", "peer_cache", "distrusted"}, 1)
+		m.logger.Printf("[WARN] memberlist: Node at %s is no longer '%s', dropping it from the peer cache",
+			net.JoinHostPort(p.Addr.String(), fmt.Sprintf("%d", p.Port)), p.Name)
+		if err := m.peers.Remove(p.Name, time.Now()); err != nil {
+			m.logger.Printf("[WARN] memberlist: Failed to update peer cache: %v", err)
+		}
+		return fmt.Errorf("Node is no longer '%s'", p.Name)
+	}
+	return m.mergeRemoteState(id, remote, userState)
+}
+
+// claimsIdentity reports whether a node's push/pull state lists the cached
+// peer under its name and address.
+func claimsIdentity(remote []pushNodeState, p cachedPeer) bool {
+	for _, r := range remote {
+		if r.Name == p.Name {
+			return r.State.active() && net.IP(r.Addr).Equal(p.Addr) && r.Port == p.Port
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+package memberlist
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPeerCache_UpdateAndPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercache")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newPeerCache(filepath.Join(dir, "peers.json"), time.Hour)
+	now := time.Now()
+
+	// A missing file is an empty cache.
+	peers, err := c.Peers(now)
+	if err != nil || len(peers) != 0 {
+		t.Fatalf("bad: %v %v", peers, err)
+	}
+
+	a := cachedPeer{Name: "a", Addr: net.IPv4(127, 0, 0, 1), Port: 1}
+	b := cachedPeer{Name: "b", Addr: net.IPv4(127, 0, 0, 2), Port: 2}
+	if err := c.Update([]cachedPeer{a}, now.Add(-30*time.Minute)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := c.Update([]cachedPeer{b}, now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Newest first.
+	peers, err = c.Peers(now)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(peers) != 2 || peers[0].Name != "b" || peers[1].Name != "a" {
+		t.Fatalf("bad: %v", peers)
+	}
+
+	// Old entries expire.
+	peers, err = c.Peers(now.Add(45 * time.Minute))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(peers) != 1 || peers[0].Name != "b" {
+		t.Fatalf("bad: %v", peers)
+	}
+
+	if err := c.Remove("b", now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	peers, _ = c.Peers(now)
+	if len(peers) != 1 || peers[0].Name != "a" {
+		t.Fatalf("bad: %v", peers)
+	}
+
+	// The cache is capped.
+	var many []cachedPeer
+	for i := 0; i < 2*maxCachedPeers; i++ {
+		many = append(many, cachedPeer{Name: fmt.Sprintf("n%d", i), Addr: net.IPv4(127, 0, 0, 1)})
+	}
+	if err := c.Update(many, now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	peers, _ = c.Peers(now)
+	if len(peers) != maxCachedPeers {
+		t.Fatalf("bad len: %d", len(peers))
+	}
+}
+
+func TestClaimsIdentity(t *testing.T) {
+	p := cachedPeer{Name: "a", Addr: net.IPv4(127, 0, 0, 1).To4(), Port: 7946}
+	remote := []pushNodeState{
+		{Name: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, State: stateAlive},
+	}
+	if !claimsIdentity(remote, p) {
+		t.Fatalf("should match")
+	}
+	remote[0].Port = 7947
+	if claimsIdentity(remote, p) {
+		t.Fatalf("should not match a different port")
+	}
+	remote[0].Name = "b"
+	remote[0].Port = 7946
+	if claimsIdentity(remote, p) {
+		t.Fatalf("should not match a different name")
+	}
+}
+
+func TestMemberlist_JoinPeerCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercache")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+
+	c1 := testConfig()
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.PeerCachePath = path
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	// Join normally, which fills the cache.
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	peers, err := m2.peers.Peers(time.Now())
+	if err != nil || len(peers) != 1 || peers[0].Name != c1.Name {
+		t.Fatalf("bad: %v %v", peers, err)
+	}
+
+	// A fresh node with the same cache gets in even though its seed is
+	// unreachable.
+	c3 := testConfig()
+	c3.PeerCachePath = path
+	m3, err := Create(c3)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m3.Shutdown()
+
+	n, err := m3.Join([]string{"127.0.0.1:1"})
+	if err != nil || n != 1 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if m3.NumMembers() < 2 {
+		t.Fatalf("should have joined through the cache")
+	}
+
+	// A peer whose address now answers under another name is dropped.
+	os.Remove(path)
+	if err := m3.peers.Update([]cachedPeer{{Name: "impostor", Addr: peers[0].Addr, Port: peers[0].Port}}, time.Now()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := joinedCount(m3.joinPeerCache()); n != 0 {
+		t.Fatalf("should not trust the impostor entry")
+	}
+	left, _ := m3.peers.Peers(time.Now())
+	for _, p := range left {
+		if p.Name == "impostor" {
+			t.Fatalf("impostor entry should be dropped")
+		}
+	}
+}
+
+func TestMemberlist_JoinPeerCache_Unreachable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "peercache")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	m1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.PeerCachePath = filepath.Join(dir, "peers.json")
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	// Cache a few dead addresses, then the live one, then more dead ones,
+	// newest first.
+	now := time.Now()
+	cache := func(i int, p cachedPeer) {
+		if err := m2.peers.Update([]cachedPeer{p}, now.Add(-time.Duration(i)*time.Second)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	for i := 0; i < 2*maxCachedPeerJoins; i++ {
+		cache(i, cachedPeer{Name: fmt.Sprintf("dead-%d", i), Addr: net.IPv4(127, 0, 0, 1), Port: uint16(i + 1)})
+	}
+	local := m1.LocalNode()
+	cache(-1, cachedPeer{Name: local.Name, Addr: local.Addr, Port: local.Port})
+	cache(-2, cachedPeer{Name: "dead-a", Addr: net.IPv4(127, 0, 0, 1), Port: 100})
+	cache(-3, cachedPeer{Name: "dead-b", Addr: net.IPv4(127, 0, 0, 1), Port: 101})
+
+	// We're in at the live one, and don't try the rest.
+	results := m2.joinPeerCache()
+	if len(results) != 3 || joinedCount(results) != 1 || results[2].Class != JoinSuccess {
+		t.Fatalf("bad: %v", results)
+	}
+
+	// Without one, we give up after a few.
+	if err := m2.peers.Remove(local.Name, now); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	results = m2.joinPeerCache()
+	if len(results) != maxCachedPeerJoins || joinedCount(results) != 0 {
+		t.Fatalf("bad: %v", results)
+	}
+}
@@ -0,0 +1,360 @@
+package memberlist
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+We learn how each peer can be reached as we go. A direct ack shows UDP gets
+through, and a TCP fallback ping or push/pull that succeeds shows TCP does.
+A probe that only got an answer over TCP shows UDP doesn't, and a push/pull
+we couldn't dial shows TCP doesn't. With DiscoverPacketSize we also find
+the largest packet that gets through to each peer, by sending it pings
+padded out to a few sizes, largest first, and keeping the first that's
+acked. This is packetization layer path MTU discovery (RFC 8899) in
+miniature, so it works without setting don't-fragment: a packet that's
+fragmented and put back together counts as getting through.
+
+Each fixed size is a step down from the last, so once one gets through
+we search between it and the one above that didn't, to within
+packetSizeStep bytes. On a VPN or tunnel with an MTU just short of what we
+assume, that keeps most of the room a packet would otherwise lose.
+
+SendToUDP uses what we've learned to pick the path: the message goes over
+a stream instead if UDP isn't getting through to the peer, or if it's
+larger than the largest packet known to get there. Gossip, and the
+broadcasts piggybacked on pings and acks, are packed to fit the largest
+packet known to get to the address they're sent to, so they aren't
+silently lost on paths with a smaller MTU. Peers we haven't measured get
+udpSendBuf as before.
+*/
+
+// packetSizes are the packet sizes tried when finding the largest that
+// gets through to a peer, largest first. 1232 is what fits the minimum
+// IPv6 MTU once the headers are taken off, and 508 what fits the smallest
+// datagram every IPv4 host must accept.
+var packetSizes = []int{udpSendBuf, 1232, 1024, 508}
+
+// packetSizeRecheck is how long we go before measuring a peer's largest
+// packet again.
+const packetSizeRecheck = 10 * time.Minute
+
+// packetSizeStep is how close the search between two of packetSizes gets
+// to the largest packet that gets through.
+const packetSizeStep = 32
+
+// TransportState says whether a transport is known to reach a peer.
+type TransportState int
+
+const (
+	// TransportUnknown means we haven't learned anything yet.
+	TransportUnknown TransportState = iota
+
+	// TransportUp means the last we heard, it got through.
+	TransportUp
+
+	// TransportDown means the last we heard, it didn't get through while
+	// the other transport did.
+	TransportDown
+)
+
+func (s TransportState) String() string {
+	switch s {
+	case TransportUnknown:
+		return "unknown"
+	case TransportUp:
+		return "up"
+	case TransportDown:
+		return "down"
+	default:
+		return "invalid"
+	}
+}
+
+// PeerTransport is what we've learned about reaching a peer.
+type PeerTransport struct {
+	Name string
+	UDP  TransportState
+	TCP  TransportState
+
+	// MaxPacket is the largest packet in bytes known to get through to the
+	// peer, or zero if it hasn't been measured. See DiscoverPacketSize.
+	MaxPacket int
+
+	// Updated is when we last learned something about the peer.
+	Updated time.Time
+}
+
+// peerTransport is a PeerTransport and the state of its measurement.
+type peerTransport struct {
+	PeerTransport
+	addr   string    // Where MaxPacket was measured to
+	sized  time.Time // When MaxPacket was last measured
+	sizing bool      // A measurement is under way
+}
+
+// peerTransports tracks what we've learned about reaching each peer.
+type peerTransports struct {
+	sync.Mutex
+	peers  map[string]*peerTransport
+	byAddr map[string]*peerTransport // Measured peers by address
+}
+
+// peer returns the entry for a node, creating it if need be. The lock must
+// be held.
+func (p *peerTransports) peer(node string) *peerTransport {
+	if p.peers == nil {
+		p.peers = make(map[string]*peerTransport)
+	}
+	t, ok := p.peers[node]
+	if !ok {
+		t = &peerTransport{PeerTransport: PeerTransport{Name: node}}
+		p.peers[node] = t
+	}
+	t.Updated = time.Now()
+	return t
+}
+
+// setUDP records whether UDP got through to a node.
+func (p *peerTransports) setUDP(node string, state TransportState) {
+	p.Lock()
+	defer p.Unlock()
+	p.peer(node).UDP = state
+}
+
+// setTCP records whether TCP got through to a node.
+func (p *peerTransports) setTCP(node string, state TransportState) {
+	p.Lock()
+	defer p.Unlock()
+	p.peer(node).TCP = state
+}
+
+// startSizing returns true if a node's largest packet is due to be
+// measured, marking the measurement as under way.
+func (p *peerTransports) startSizing(node string, now time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	t := p.peer(node)
+	if t.sizing || (!t.sized.IsZero() && now.Sub(t.sized) < packetSizeRecheck) {
+		return false
+	}
+	t.sizing = true
+	return true
+}
+
+// doneSizing records the largest packet found to get through to a node at
+// the given address, or zero if none did.
+func (p *peerTransports) doneSizing(node, addr string, size int) {
+	p.Lock()
+	defer p.Unlock()
+
+	t := p.peer(node)
+	t.sizing = false
+	t.sized = time.Now()
+	if size <= 0 {
+		return
+	}
+	t.MaxPacket = size
+
+	if p.byAddr == nil {
+		p.byAddr = make(map[string]*peerTransport)
+	}
+	if t.addr != addr {
+		delete(p.byAddr, t.addr)
+		t.addr = addr
+	}
+	p.byAddr[addr] = t
+}
+
+// packetLimit returns the largest packet we should send to an address,
+// which is udpSendBuf unless a smaller one was measured.
+func (p *peerTransports) packetLimit(addr string) int {
+	p.Lock()
+	defer p.Unlock()
+
+	if t, ok := p.byAddr[addr]; ok && t.MaxPacket > 0 && t.MaxPacket < udpSendBuf {
+		return t.MaxPacket
+	}
+	return udpSendBuf
+}
+
+// preferStream returns true if a message of the given size should go to a
+// node over a stream rather than as a packet.
+func (p *peerTransports) preferStream(node string, size int) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	t, ok := p.peers[node]
+	if !ok || t.TCP == TransportDown {
+		return false
+	}
+	return t.UDP == TransportDown || (t.MaxPacket > 0 && size > t.MaxPacket)
+}
+
+// get returns what we know about a node.
+func (p *peerTransports) get(node string) (PeerTransport, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	t, ok := p.peers[node]
+	if !ok {
+		return PeerTransport{}, false
+	}
+	return t.PeerTransport, true
+}
+
+// forget drops what we know about a node that's gone.
+func (p *peerTransports) forget(node string) {
+	p.Lock()
+	defer p.Unlock()
+	if t, ok := p.peers[node]; ok && t.addr != "" {
+		delete(p.byAddr, t.addr)
+	}
+	delete(p.peers, node)
+}
+
+// PeerTransport returns what we've learned about reaching the named node,
+// and false if we haven't learned anything yet.
+func (m *Memberlist) PeerTransport(node string) (PeerTransport, bool) {
+	return m.transports.get(node)
+}
+
+// PeerTransports returns what we've learned about reaching each node,
+// sorted by name.
+func (m *Memberlist) PeerTransports() []PeerTransport {
+	m.transports.Lock()
+	defer m.transports.Unlock()
+
+	out := make([]PeerTransport, 0, len(m.transports.peers))
+	for _, t := range m.transports.peers {
+		out = append(out, t.PeerTransport)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
+
+// packetBudget returns the largest packet we should send to an address.
+func (m *Memberlist) packetBudget(to net.Addr) int {
+	return m.transports.packetLimit(to.String())
+}
+
+// isDialError returns true if an error is from failing to connect, rather
+// than from what happened once we had.
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// discoverPacketSize measures the largest packet that gets through to a
+// node.
+func (m *Memberlist) discoverPacketSize(node Node) {
+	defer m.recoverInternal("probe")
+
+	found, err := searchPacketSize(func(size int) (bool, error) {
+		return m.pingPadded(&node, size)
+	})
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send padded ping to %s: %s", node.Name, err)
+	}
+	addr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
+	m.transports.doneSizing(node.Name, addr.String(), found)
+
+	if found == 0 {
+		metrics.IncrCounter([]string{"memberlist", "packet_size", "failed"}, 1)
+		m.logger.Printf("[WARN] memberlist: None of the padded pings got through to %s", node.Name)
+	} else if found < udpSendBuf {
+		m.logger.Printf("[WARN] memberlist: Only packets of up to %d bytes get through to %s", found, node.Name)
+	}
+}
+
+// searchPacketSize returns the largest packet size that fits, trying each
+// of packetSizes in turn and then searching between the first that fits
+// and the one above it. It returns zero if none fit, and the best found
+// so far along with the error if fits fails.
+func searchPacketSize(fits func(size int) (bool, error)) (int, error) {
+	for i, size := range packetSizes {
+		ok, err := fits(size)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			continue
+		}
+		if i == 0 {
+			return size, nil
+		}
+
+		// Bisect between what fits and what doesn't
+		lo, hi := size, packetSizes[i-1]
+		for hi-lo > packetSizeStep {
+			mid := (lo + hi) / 2
+			ok, err := fits(mid)
+			if err != nil {
+				return lo, err
+			}
+			if ok {
+				lo = mid
+			} else {
+				hi = mid
+			}
+		}
+		return lo, nil
+	}
+	return 0, nil
+}
+
+// pingPadded sends a node a ping padded out to a packet of the given size,
+// and returns true if it's acked within the probe timeout.
+func (m *Memberlist) pingPadded(node *Node, size int) (bool, error) {
+	addr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
+	p := m.newPing(m.nextSeqNo(), node.Name)
+
+	// Pad with random bytes, so compression can't shrink it, and measure
+	// again in case the padding's header grew.
+	var packet []byte
+	for i := 0; ; i++ {
+		out, err := encode(pingMsg, &p)
+		if err != nil {
+			return false, err
+		}
+		if packet, err = m.packUDP(addr, out.Bytes()); err != nil {
+			return false, err
+		}
+		short := size - len(packet)
+		if short == 0 || i == 2 || (short < 0 && len(p.Pad) == 0) {
+			break
+		}
+		pad := len(p.Pad) + short
+		if i == 0 && len(p.Pad) == 0 {
+			pad -= len("Pad") + 4 // The field's key and header
+		}
+		if pad < 0 {
+			pad = 0
+		}
+		p.Pad = make([]byte, pad)
+		rand.Read(p.Pad)
+	}
+
+	ackCh := make(chan ackMessage, 1)
+	m.setProbeChannels(p.SeqNo, ackCh, nil, m.tune().ProbeTimeout)
+	if err := m.writeUDP(addr, packet); err != nil {
+		return false, err
+	}
+
+	select {
+	case v := <-ackCh:
+		return v.Complete, nil
+	case <-m.shutdownCh:
+		return false, ErrShutdown
+	}
+}
@@ -0,0 +1,232 @@
+package memberlist
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerTransports(t *testing.T) {
+	var p peerTransports
+	if p.preferStream("a", 2000) {
+		t.Fatalf("should use UDP for unknown peers")
+	}
+
+	p.setUDP("a", TransportUp)
+	p.setTCP("a", TransportUp)
+	if p.preferStream("a", 2000) {
+		t.Fatalf("should use UDP")
+	}
+
+	// Messages too large for the peer go over a stream.
+	now := time.Now()
+	if !p.startSizing("a", now) || p.startSizing("a", now) {
+		t.Fatalf("should start sizing once")
+	}
+	p.doneSizing("a", "127.0.0.1:7946", 1232)
+	if p.startSizing("a", now.Add(time.Minute)) || !p.startSizing("a", now.Add(2*packetSizeRecheck)) {
+		t.Fatalf("should size again once it's due")
+	}
+	if p.preferStream("a", 1000) || !p.preferStream("a", 1300) {
+		t.Fatalf("should size messages by MaxPacket")
+	}
+	if got := p.packetLimit("127.0.0.1:7946"); got != 1232 {
+		t.Fatalf("bad limit: %d", got)
+	}
+	if got := p.packetLimit("127.0.0.2:7946"); got != udpSendBuf {
+		t.Fatalf("bad limit: %d", got)
+	}
+
+	// A new address replaces the old one.
+	p.doneSizing("a", "127.0.0.3:7946", 1024)
+	if p.packetLimit("127.0.0.1:7946") != udpSendBuf || p.packetLimit("127.0.0.3:7946") != 1024 {
+		t.Fatalf("should move the limit to the new address")
+	}
+
+	// Everything goes over a stream when UDP is down, unless TCP is too.
+	p.setUDP("a", TransportDown)
+	if !p.preferStream("a", 100) {
+		t.Fatalf("should use TCP")
+	}
+	p.setTCP("a", TransportDown)
+	if p.preferStream("a", 100) {
+		t.Fatalf("should use UDP")
+	}
+
+	got, ok := p.get("a")
+	if !ok || got.Name != "a" || got.UDP != TransportDown || got.TCP != TransportDown || got.MaxPacket != 1024 {
+		t.Fatalf("bad: %#v", got)
+	}
+	p.forget("a")
+	if _, ok := p.get("a"); ok {
+		t.Fatalf("should be forgotten")
+	}
+	if got := p.packetLimit("127.0.0.3:7946"); got != udpSendBuf {
+		t.Fatalf("bad limit: %d", got)
+	}
+}
+
+func TestMemberlist_DiscoverPacketSize(t *testing.T) {
+	c1 := testConfig()
+	c1.DiscoverPacketSize = true
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	m2, d2 := GetMemberlistDelegate(t)
+	m2.setAlive()
+	m2.schedule()
+	defer m2.Shutdown()
+
+	if _, err := m1.Join([]string{fmt.Sprintf("%s:%d", m2.config.BindAddr, m2.config.BindPort)}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	m1.nodeLock.RLock()
+	n, ok := m1.nodeMap[m2.config.Name]
+	m1.nodeLock.RUnlock()
+	if !ok {
+		t.Fatalf("should know about %s", m2.config.Name)
+	}
+	m1.probeNode(n)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		pt, ok := m1.PeerTransport(m2.config.Name)
+		if ok && pt.MaxPacket == udpSendBuf {
+			if pt.UDP != TransportUp {
+				t.Fatalf("bad: %#v", pt)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("bad: %#v", pt)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if all := m1.PeerTransports(); len(all) != 1 || all[0].Name != m2.config.Name {
+		t.Fatalf("bad: %#v", all)
+	}
+
+	// Once UDP is known not to get through, messages go over a stream,
+	// so even ones too large for a packet arrive.
+	m1.transports.setUDP(m2.config.Name, TransportDown)
+	msg := bytes.Repeat([]byte("x"), 70000)
+	if err := m1.SendToUDP(&n.Node, msg); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if msgs := d2.getMessages(); len(msgs) != 1 || !bytes.Equal(msgs[0], msg) {
+		t.Fatalf("bad msgs: %d", len(msgs))
+	}
+}
+
+func TestSearchPacketSize(t *testing.T) {
+	for _, mtu := range []int{udpSendBuf, 1300, 1232, 700, 508, 100} {
+		var tries int
+		got, err := searchPacketSize(func(size int) (bool, error) {
+			tries++
+			return size <= mtu, nil
+		})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got > mtu || (mtu >= packetSizes[len(packetSizes)-1] && mtu-got > packetSizeStep) {
+			t.Fatalf("bad size for %d: %d", mtu, got)
+		}
+		if mtu < packetSizes[len(packetSizes)-1] && got != 0 {
+			t.Fatalf("bad size for %d: %d", mtu, got)
+		}
+		if tries > 8 {
+			t.Fatalf("too many tries for %d: %d", mtu, tries)
+		}
+	}
+
+	// What fit before the error is kept.
+	errBoom := errors.New("boom")
+	got, err := searchPacketSize(func(size int) (bool, error) {
+		if size != udpSendBuf && size != 1232 {
+			return false, errBoom
+		}
+		return size == 1232, nil
+	})
+	if err != errBoom || got != 1232 {
+		t.Fatalf("bad: %d %v", got, err)
+	}
+}
+
+func TestSendMsg_PacketBudget(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	// Queue more broadcasts than fit in a packet
+	for i := 0; i < 30; i++ {
+		a := alive{
+			Incarnation: 1,
+			Node:        fmt.Sprintf("node-%d", i),
+			Addr:        []byte{127, 0, 0, 1},
+			Meta:        make([]byte, 60),
+		}
+		rand.Read(a.Meta)
+		m.encodeAndBroadcast(a.Node, aliveMsg, &a)
+	}
+
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer udp.Close()
+	to := udp.LocalAddr()
+
+	// Only 600 bytes get through to the peer
+	m.transports.doneSizing("peer", to.String(), 600)
+
+	out, err := encode(pingMsg, &ping{SeqNo: 42})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m.sendMsg(to, out.Bytes()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	udp.SetReadDeadline(time.Now().Add(2 * time.Second))
+	in := make([]byte, 65536)
+	n, _, err := udp.ReadFrom(in)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n > 600 {
+		t.Fatalf("packet of %d bytes is too large", n)
+	}
+	buf := in[:n]
+	if messageType(buf[0]) == compressMsg {
+		if buf, err = decompressPayload(buf[1:]); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if messageType(buf[0]) != compoundMsg {
+		t.Fatalf("should piggyback broadcasts: %v", buf[0])
+	}
+	_, parts, err := decodeCompoundMessage(buf[1:])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(parts) < 3 {
+		t.Fatalf("should fill the packet: %d parts", len(parts))
+	}
+}
+
+func TestIsDialError(t *testing.T) {
+	if !isDialError(fmt.Errorf("wrapped: %w", &net.OpError{Op: "dial"})) {
+		t.Fatalf("should be a dial error")
+	}
+	if isDialError(&net.OpError{Op: "read"}) {
+		t.Fatalf("should not be a dial error")
+	}
+}
@@ -0,0 +1,111 @@
+package memberlist
+
+import (
+	"net"
+
+	"github.com/armon/go-metrics"
+)
+
+// PiggybackStats totals up how the spare room in outgoing packets has been
+// used to piggyback broadcasts. Comparing Available with the sum of Used
+// shows whether broadcasts are being held back by a lack of room, and the
+// split by class shows who's using it.
+type PiggybackStats struct {
+	// Packets is the number of packets sent with room for broadcasts, and
+	// Available the total bytes of room they had.
+	Packets   uint64
+	Available uint64
+
+	// Used is the bytes of that room taken by each class of broadcast,
+	// including framing: "alive", "suspect" and "dead" for our own state
+	// messages, "user" for the delegate's broadcasts, and "other" for
+	// anything else.
+	Used map[string]uint64
+}
+
+// PiggybackStats returns totals of the piggyback space in the packets
+// we've sent so far.
+func (m *Memberlist) PiggybackStats() PiggybackStats {
+	m.piggyLock.Lock()
+	defer m.piggyLock.Unlock()
+
+	stats := m.piggy
+	stats.Used = make(map[string]uint64, len(m.piggy.Used))
+	for class, n := range m.piggy.Used {
+		stats.Used[class] = n
+	}
+	return stats
+}
+
+// recordPiggyback adds a packet with the given room and the broadcasts that
+// were piggybacked in it to the stats.
+func (m *Memberlist) recordPiggyback(avail int, msgs [][]byte, overhead int) {
+	if avail < 0 {
+		avail = 0
+	}
+
+	used := make(map[string]int)
+	total := 0
+	for _, msg := range msgs {
+		n := len(msg) + overhead
+		used[piggybackClass(msg)] += n
+		total += n
+	}
+
+	metrics.AddSample([]string{"memberlist", "piggyback", "available"}, float32(avail))
+	metrics.AddSample([]string{"memberlist", "piggyback", "used"}, float32(total))
+	for class, n := range used {
+		metrics.IncrCounter([]string{"memberlist", "piggyback", class}, float32(n))
+	}
+
+	m.piggyLock.Lock()
+	defer m.piggyLock.Unlock()
+
+	if m.piggy.Used == nil {
+		m.piggy.Used = make(map[string]uint64)
+	}
+	m.piggy.Packets++
+	m.piggy.Available += uint64(avail)
+	for class, n := range used {
+		m.piggy.Used[class] += uint64(n)
+	}
+}
+
+// sendUserMsgUDP sends a user message as a packet, with our queued
+// membership updates in the room left over if PiggybackUserMessages is set.
+func (m *Memberlist) sendUserMsgUDP(to net.Addr, msg []byte) error {
+	if !m.tune().PiggybackUserMessages {
+		return m.rawSendMsgUDP(to, msg)
+	}
+
+	bytesAvail := m.packetBudget(to) - len(msg) - compoundHeaderOverhead - m.securityOverhead()
+	extra := m.broadcasts.peekBroadcasts(compoundOverhead, bytesAvail)
+	m.recordPiggyback(bytesAvail, extra, compoundOverhead)
+	if len(extra) == 0 {
+		return m.rawSendMsgUDP(to, msg)
+	}
+
+	msgs := make([][]byte, 0, 1+len(extra))
+	msgs = append(msgs, msg)
+	msgs = append(msgs, extra...)
+	return m.rawSendMsgsUDP(to, makeCompoundMessages(msgs, false))
+}
+
+// piggybackClass returns the class of a broadcast for the stats.
+func piggybackClass(msg []byte) string {
+	if len(msg) == 0 {
+		return "other"
+	}
+	switch messageType(msg[0]) {
+	case aliveMsg:
+		return "alive"
+	case suspectMsg:
+		return "suspect"
+	case deadMsg:
+		return "dead"
+	case userMsg, userExpiringMsg, userSeqMsg:
+		return "user"
+	default:
+		return "other"
+	}
+}
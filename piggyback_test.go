@@ -0,0 +1,122 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemberlist_RecordPiggyback(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	m.recordPiggyback(100, [][]byte{
+		{byte(aliveMsg), 0, 0},
+		{byte(userMsg), 0},
+		{byte(deadMsg)},
+	}, 2)
+	m.recordPiggyback(50, [][]byte{{byte(userMsg), 0, 0, 0}}, 2)
+	m.recordPiggyback(20, nil, 2)
+
+	stats := m.PiggybackStats()
+	if stats.Packets != 3 {
+		t.Fatalf("bad packets: %d", stats.Packets)
+	}
+	if stats.Available != 170 {
+		t.Fatalf("bad available: %d", stats.Available)
+	}
+	expected := map[string]uint64{"alive": 5, "user": 10, "dead": 3}
+	if len(stats.Used) != len(expected) {
+		t.Fatalf("bad used: %v", stats.Used)
+	}
+	for class, n := range expected {
+		if stats.Used[class] != n {
+			t.Fatalf("bad used for %s: %v", class, stats.Used)
+		}
+	}
+
+	// The stats returned are a copy.
+	stats.Used["alive"] = 0
+	if m.PiggybackStats().Used["alive"] != 5 {
+		t.Fatalf("stats should be copied")
+	}
+}
+
+func TestPiggybackClass(t *testing.T) {
+	cases := map[string][]byte{
+		"alive":   {byte(aliveMsg)},
+		"suspect": {byte(suspectMsg)},
+		"dead":    {byte(deadMsg)},
+		"user":    {byte(userMsg)},
+		"other":   {byte(markerMsg)},
+	}
+	for class, msg := range cases {
+		if got := piggybackClass(msg); got != class {
+			t.Fatalf("expected %s, got %s", class, got)
+		}
+	}
+	if got := piggybackClass(nil); got != "other" {
+		t.Fatalf("expected other, got %s", got)
+	}
+}
+
+func TestMemberlist_SendToUDP_Piggyback(t *testing.T) {
+	c1 := testConfig()
+	c1.GossipInterval = 0
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1, Vsn: m1.localVsn()}
+	m1.aliveNode(&a, nil, false)
+
+	// Without piggybacking the message goes out on its own.
+	to := &Node{Name: c2.Name, Addr: m2.LocalNode().Addr, Port: m2.LocalNode().Port}
+	if err := m1.SendToUDP(to, []byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if m2.NumMembers() != 1 {
+		t.Fatalf("should not have heard about anyone: %v", m2.Members())
+	}
+
+	// It can be turned on at runtime.
+	tune := m1.Tunables()
+	tune.PiggybackUserMessages = true
+	if err := m1.SetTunables(tune); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m1.SendToUDP(to, []byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// m2 hears about m1 and the other node without any gossip.
+	deadline := time.Now().Add(2 * time.Second)
+	for m2.NumMembers() != 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("should have heard about everyone: %v", m2.Members())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Nothing was counted against the retransmit limits.
+	m1.broadcasts.Lock()
+	defer m1.broadcasts.Unlock()
+	if len(m1.broadcasts.bcQueue) != 2 {
+		t.Fatalf("should still be queued: %d", len(m1.broadcasts.bcQueue))
+	}
+	for _, b := range m1.broadcasts.bcQueue {
+		if b.transmits != 0 {
+			t.Fatalf("should not count as transmitted: %d", b.transmits)
+		}
+	}
+}
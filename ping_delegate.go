@@ -7,8 +7,10 @@ import "time"
 // into ack messages. Note that in order to be meaningful for RTT estimates, this
 // delegate does not apply to indirect pings, nor fallback pings sent over TCP.
 type PingDelegate interface {
-	// AckPayload is invoked when an ack is being sent; the returned bytes will be appended to the ack
+	// AckPayload is invoked when an ack is being sent; the returned bytes will be appended to the ack.
+	// A payload too large to fit in the packet is fetched by the prober over a stream instead.
 	AckPayload() []byte
-	// NotifyPing is invoked when an ack for a ping is received
+	// NotifyPing is invoked when an ack for a ping is received, or once its payload has been
+	// fetched if it didn't fit in the ack. If the fetch fails, the payload is nil.
 	NotifyPingComplete(other *Node, rtt time.Duration, payload []byte)
 }
@@ -0,0 +1,183 @@
+package memberlist
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+)
+
+/*
+Updates to the local node, from UpdateNode, Pause or maintenance, are
+applied to our own state before they're gossiped, so LocalNode shows them as
+soon as the call returns. AwaitPropagation then waits for the update to
+reach the rest of the cluster.
+
+We can't know who has heard an update without asking, so we estimate it
+from how often we've sent it. Gossip spreads like an epidemic: every node
+that has heard a message passes it on to random peers about as often as we
+do, so after we've sent it t times the fraction of the cluster that has
+heard it is roughly what estimatedReach says. Once fewer than half a node
+is expected to have missed it, we call it everyone. Refutations and
+push/pulls spread our state too, so the estimate errs on the low side. In a
+large cluster the last few nodes are usually left to push/pull, so the
+estimate may never quite get to everyone.
+
+Applications' own broadcasts are handed to NotifyMsg and go no further,
+unless the application sends them on itself. So a PropagatedBroadcast is
+only given the epidemic estimate once its queue is done with it if the
+queue is marked Relayed. Otherwise it's given directReach, which only
+counts the nodes we sent it to: about transmits out of n-1 in a large
+cluster.
+*/
+
+// transmitObserver is a Broadcast that's told how far it has probably
+// reached each time the queue sends it.
+type transmitObserver interface {
+	transmitted(reach float64)
+}
+
+// estimatedReach estimates the fraction of a cluster of n nodes that has
+// heard a message sent transmits times, assuming each node that has heard
+// it passes it on as often as we have, each time to a random peer.
+func estimatedReach(transmits, n int) float64 {
+	if n <= 1 {
+		return 1
+	}
+
+	// A node that hasn't heard it misses each send with probability
+	// 1 - 1/(n-1), and there are reach*n senders each time.
+	reach := 1 / float64(n)
+	miss := 1 - 1/float64(n-1)
+	for i := 0; i < transmits && reach < 1; i++ {
+		reach = 1 - (1-reach)*math.Pow(miss, reach*float64(n))
+	}
+	if (1-reach)*float64(n) < 0.5 {
+		return 1
+	}
+	return reach
+}
+
+// directReach estimates the fraction of a cluster of n nodes that has heard
+// a message sent transmits times, each time to a random peer, when the
+// peers don't pass it on.
+func directReach(transmits, n int) float64 {
+	if n <= 1 {
+		return 1
+	}
+	others := float64(n - 1)
+	missed := others * math.Pow(1-1/others, float64(transmits))
+	if missed < 0.5 {
+		return 1
+	}
+	return (float64(n) - missed) / float64(n)
+}
+
+// localPropagation tracks how far the latest update to the local node has
+// probably spread.
+type localPropagation struct {
+	sync.Mutex
+	incarnation uint32
+	reach       float64
+	changed     chan struct{} // Closed when reach changes
+}
+
+// update records the reach of the update at the given incarnation. Older
+// updates are ignored, since a newer one carries everything they did.
+func (p *localPropagation) update(incarnation uint32, reach float64) {
+	p.Lock()
+	defer p.Unlock()
+
+	if incarnation < p.incarnation || (incarnation == p.incarnation && reach <= p.reach) {
+		return
+	}
+	p.incarnation = incarnation
+	p.reach = reach
+	if p.changed != nil {
+		close(p.changed)
+		p.changed = nil
+	}
+}
+
+// reached returns true if the latest update has probably reached the given
+// fraction of the cluster, and if not, a channel that's closed when that
+// might have changed.
+func (p *localPropagation) reached(fraction float64) (bool, chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.reach >= fraction {
+		return true, nil
+	}
+	if p.changed == nil {
+		p.changed = make(chan struct{})
+	}
+	return false, p.changed
+}
+
+// localAliveBroadcast is an alive message about ourselves, which reports
+// how far it has spread.
+type localAliveBroadcast struct {
+	memberlistBroadcast
+	incarnation uint32
+	propagation *localPropagation
+}
+
+func (b *localAliveBroadcast) transmitted(reach float64) {
+	b.propagation.update(b.incarnation, reach)
+}
+
+// broadcastLocalAlive queues an alive message about ourselves, tracking
+// how far it spreads.
+func (m *Memberlist) broadcastLocalAlive(a *alive, notify chan struct{}) {
+	// An observer keeps itself to itself.
+	if m.config.Observer {
+		if notify != nil {
+			close(notify)
+		}
+		return
+	}
+
+	buf, err := encode(aliveMsg, a)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to encode message for broadcast: %s", err)
+		return
+	}
+	m.propagation.update(a.Incarnation, 0)
+	m.broadcasts.QueueBroadcast(&localAliveBroadcast{
+		memberlistBroadcast: memberlistBroadcast{a.Node, buf.Bytes(), notify},
+		incarnation:         a.Incarnation,
+		propagation:         &m.propagation,
+	})
+}
+
+// AwaitPropagation waits until the latest update to the local node has
+// probably reached the given fraction of the cluster, from 0 to 1, or the
+// context is done. It returns at once if there are no other members. The
+// fraction is estimated from how many times we've gossiped the update; see
+// the notes in propagation.go. An update that's dropped from the broadcast
+// queue before it's done spreading, say because the queue overflowed,
+// stops counting, and in a large cluster the estimate may never reach 1,
+// so the context should have a deadline.
+func (m *Memberlist) AwaitPropagation(ctx context.Context, fraction float64) error {
+	if fraction <= 0 || fraction > 1 {
+		return fmt.Errorf("Fraction must be greater than 0 and at most 1, not %v", fraction)
+	}
+	if !m.anyAlive() {
+		return nil
+	}
+
+	for {
+		done, changed := m.propagation.reached(fraction)
+		if done {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.shutdownCh:
+			return ErrShutdown
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package memberlist
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEstimatedReach(t *testing.T) {
+	if r := estimatedReach(0, 1); r != 1 {
+		t.Fatalf("should reach a cluster of one: %v", r)
+	}
+	if r := estimatedReach(1, 2); r != 1 {
+		t.Fatalf("one send should reach a cluster of two: %v", r)
+	}
+	if r := estimatedReach(0, 100); r != 0.01 {
+		t.Fatalf("should only have reached us: %v", r)
+	}
+
+	// It grows with every send, and the retransmit limit is enough to
+	// reach nearly everyone.
+	last := 0.0
+	for i := 0; i < 5; i++ {
+		r := estimatedReach(i, 1000)
+		if r <= last {
+			t.Fatalf("should grow: %v after %d", r, i)
+		}
+		last = r
+	}
+	if r := estimatedReach(retransmitLimit(4, 1000), 1000); r < 0.99 {
+		t.Fatalf("should reach nearly everyone: %v", r)
+	}
+	if r := estimatedReach(retransmitLimit(4, 10), 10); r != 1 {
+		t.Fatalf("should reach everyone: %v", r)
+	}
+}
+
+func TestDirectReach(t *testing.T) {
+	if r := directReach(0, 1); r != 1 {
+		t.Fatalf("should reach a cluster of one: %v", r)
+	}
+	if r := directReach(1, 2); r != 1 {
+		t.Fatalf("one send should reach a cluster of two: %v", r)
+	}
+	if r := directReach(0, 100); r != 0.01 {
+		t.Fatalf("should only have reached us: %v", r)
+	}
+
+	// Without relays it gets no further than the sends, and falls well
+	// short of the epidemic estimate.
+	limit := retransmitLimit(4, 1000)
+	r := directReach(limit, 1000)
+	if r > float64(limit+1)/1000 {
+		t.Fatalf("should reach at most the nodes sent to: %v", r)
+	}
+	if r >= estimatedReach(limit, 1000) {
+		t.Fatalf("should be below the epidemic estimate: %v", r)
+	}
+}
+
+func TestLocalPropagation(t *testing.T) {
+	var p localPropagation
+
+	p.update(2, 0)
+	done, changed := p.reached(0.5)
+	if done {
+		t.Fatalf("should not be done")
+	}
+	p.update(2, 0.6)
+	select {
+	case <-changed:
+	default:
+		t.Fatalf("should signal the change")
+	}
+	if done, _ := p.reached(0.5); !done {
+		t.Fatalf("should be done")
+	}
+
+	// Old updates don't count, and a new one starts over.
+	p.update(1, 1)
+	if done, _ := p.reached(0.9); done {
+		t.Fatalf("should ignore an older update")
+	}
+	p.update(3, 0)
+	if done, _ := p.reached(0.5); done {
+		t.Fatalf("should start over")
+	}
+}
+
+func TestMemberlist_UpdateNode_ReadYourWrites(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An update that loses a race with a refutation still applies.
+	inc := m.LocalIncarnation()
+	a := alive{
+		Incarnation: inc - 1,
+		Node:        m.config.Name,
+		Addr:        m.LocalNode().Addr,
+		Port:        m.LocalNode().Port,
+		Meta:        []byte("new"),
+		Vsn:         m.localVsn(),
+	}
+	m.aliveNode(&a, nil, true)
+	if got := m.LocalIncarnation(); got <= inc {
+		t.Fatalf("should have taken a new incarnation: %d", got)
+	}
+	if string(m.LocalNode().Meta) != "new" {
+		t.Fatalf("should have applied: %q", m.LocalNode().Meta)
+	}
+
+	// LocalNode is a copy.
+	node := m.LocalNode()
+	node.Meta = []byte("changed")
+	if string(m.LocalNode().Meta) != "new" {
+		t.Fatalf("should not change our state")
+	}
+
+	// UpdateNode reports an update that isn't applied.
+	m.config.Alive = &CustomAliveDelegate{Ignore: "other"}
+	if err := m.UpdateNode(0); err != ErrUpdateRejected {
+		t.Fatalf("should be rejected: %v", err)
+	}
+}
+
+func TestMemberlist_AwaitPropagation(t *testing.T) {
+	c1 := testConfig()
+	c1.GossipInterval = 10 * time.Millisecond
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	if err := m1.AwaitPropagation(context.Background(), 2); err == nil {
+		t.Fatalf("should reject a bad fraction")
+	}
+	if err := m1.AwaitPropagation(context.Background(), 1); err != nil {
+		t.Fatalf("should not wait without other members: %v", err)
+	}
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	c1.Delegate = &MockDelegate{meta: []byte("new")}
+	if err := m1.UpdateNode(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m1.AwaitPropagation(ctx, 1); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Two nodes are reached with one send, so m2 has it.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m2.nodeLock.RLock()
+		meta := string(m2.nodeMap[c1.Name].Meta)
+		m2.nodeLock.RUnlock()
+		if meta == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("should have the update: %q", meta)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,142 @@
+package memberlist
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+/*
+Streams may be prefixed with a PROXY protocol version 2 header, as written
+by L4 proxies such as HAProxy, so that we can learn the real address of the
+peer behind the proxy. The header is binary:
+
+  [signature (12 bytes)][version/command][family/protocol][length (2 bytes)][addresses ...]
+
+We only handle TCP over IPv4 and IPv6. LOCAL commands, which proxies send
+for their own health checks, carry no addresses and leave the connection's
+addresses as they are.
+*/
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyV2HeaderSize = 16 // Signature, version/command, family and length
+	proxyV2Local      = 0x20
+	proxyV2Proxy      = 0x21
+	proxyV2TCP4       = 0x11
+	proxyV2TCP6       = 0x21
+	proxyV2TCP4Len    = 12
+	proxyV2TCP6Len    = 36
+)
+
+// proxiedConn is a connection whose remote address was given to us by a
+// proxy.
+type proxiedConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// readProxyHeader consumes a PROXY protocol v2 header from the start of the
+// given stream, if there is one, and returns a connection reporting the
+// proxied peer's address. Streams without a header are returned with their
+// addresses untouched. The returned connection must be used for all
+// further reads.
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	r := bufio.NewReader(conn)
+	pc := &proxiedConn{Conn: conn, r: r, remote: conn.RemoteAddr()}
+
+	// Match the signature a byte at a time, so we don't wait around for
+	// more data on a short stream that was never going to have a header.
+	for i := 1; i <= len(proxyV2Signature); i++ {
+		peeked, err := r.Peek(i)
+		if err != nil || !bytes.Equal(peeked, proxyV2Signature[:i]) {
+			// Not a header; let the caller deal with whatever is there.
+			return pc, nil
+		}
+	}
+
+	header := make([]byte, proxyV2HeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	cmd, fam := header[12], header[13]
+	size := int(binary.BigEndian.Uint16(header[14:16]))
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	switch cmd {
+	case proxyV2Local:
+		return pc, nil
+	case proxyV2Proxy:
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol version/command 0x%02x", cmd)
+	}
+
+	switch fam {
+	case proxyV2TCP4:
+		if size < proxyV2TCP4Len {
+			return nil, fmt.Errorf("PROXY protocol header is truncated")
+		}
+		pc.remote = &net.TCPAddr{
+			IP:   net.IP(body[0:4]),
+			Port: int(binary.BigEndian.Uint16(body[8:10])),
+		}
+	case proxyV2TCP6:
+		if size < proxyV2TCP6Len {
+			return nil, fmt.Errorf("PROXY protocol header is truncated")
+		}
+		pc.remote = &net.TCPAddr{
+			IP:   net.IP(body[0:16]),
+			Port: int(binary.BigEndian.Uint16(body[32:34])),
+		}
+	default:
+		// Unknown families are allowed by the spec; keep the real address.
+	}
+	return pc, nil
+}
+
+// writeProxyHeader writes a PROXY protocol v2 header describing the given
+// connection to it.
+func writeProxyHeader(conn net.Conn) error {
+	src, ok1 := conn.LocalAddr().(*net.TCPAddr)
+	dst, ok2 := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok1 || !ok2 {
+		return fmt.Errorf("PROXY protocol requires a TCP connection")
+	}
+
+	var buf bytes.Buffer
+	buf.Write(proxyV2Signature)
+	buf.WriteByte(proxyV2Proxy)
+	if src4, dst4 := src.IP.To4(), dst.IP.To4(); src4 != nil && dst4 != nil {
+		buf.WriteByte(proxyV2TCP4)
+		binary.Write(&buf, binary.BigEndian, uint16(proxyV2TCP4Len))
+		buf.Write(src4)
+		buf.Write(dst4)
+	} else {
+		buf.WriteByte(proxyV2TCP6)
+		binary.Write(&buf, binary.BigEndian, uint16(proxyV2TCP6Len))
+		buf.Write(src.IP.To16())
+		buf.Write(dst.IP.To16())
+	}
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
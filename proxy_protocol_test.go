@@ -0,0 +1,173 @@
+package memberlist
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocol_RoundTrip(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer ln.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		writeProxyHeader(conn)
+		conn.Write([]byte("hello"))
+	}()
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	proxied, err := readProxyHeader(conn)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if proxied.RemoteAddr().String() != conn.RemoteAddr().String() {
+		t.Fatalf("bad: %v", proxied.RemoteAddr())
+	}
+	buf := make([]byte, 5)
+	if _, err := proxied.Read(buf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(buf) != "hello" {
+		t.Fatalf("bad: %s", buf)
+	}
+}
+
+func TestProxyProtocol_Read(t *testing.T) {
+	tcp4 := append(append([]byte(nil), proxyV2Signature...),
+		proxyV2Proxy, proxyV2TCP4, 0, 12,
+		10, 0, 0, 1, // Source
+		10, 0, 0, 2, // Destination
+		0x1f, 0x0a, // Source port 7946
+		0x1f, 0x0a, // Destination port 7946
+		'x')
+	local := append(append([]byte(nil), proxyV2Signature...),
+		proxyV2Local, 0, 0, 0, 'x')
+	truncated := append(append([]byte(nil), proxyV2Signature...),
+		proxyV2Proxy, proxyV2TCP4, 0, 4, 10, 0, 0, 1)
+	badCmd := append(append([]byte(nil), proxyV2Signature...),
+		0x22, 0, 0, 0, 'x')
+
+	cases := []struct {
+		name   string
+		input  []byte
+		remote string // Empty means the pipe's own address
+		err    bool
+	}{
+		{"tcp4", tcp4, "10.0.0.1:7946", false},
+		{"local", local, "", false},
+		{"none", []byte("x"), "", false},
+		{"truncated", truncated, "", true},
+		{"bad command", badCmd, "", true},
+	}
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(c.input)
+			client.Close()
+		}()
+
+		conn, err := readProxyHeader(server)
+		if c.err {
+			if err == nil {
+				t.Fatalf("%s: expected error", c.name)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: err: %v", c.name, err)
+		}
+		expected := server.RemoteAddr().String()
+		if c.remote != "" {
+			expected = c.remote
+		}
+		if conn.RemoteAddr().String() != expected {
+			t.Fatalf("%s: bad: %v", c.name, conn.RemoteAddr())
+		}
+		rest := make([]byte, 1)
+		if _, err := conn.Read(rest); err != nil || !bytes.Equal(rest, []byte("x")) {
+			t.Fatalf("%s: bad: %v %v", c.name, rest, err)
+		}
+		server.Close()
+	}
+}
+
+func TestMemberlist_ProxyProtocol(t *testing.T) {
+	c1 := testConfig()
+	c1.AcceptProxyProtocol = true
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.EmitProxyProtocol = true
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	num, err := m2.Join([]string{m1.config.BindAddr})
+	if num != 1 || err != nil {
+		t.Fatalf("unexpected: %d %v", num, err)
+	}
+	if len(m1.Members()) != 2 {
+		t.Fatalf("bad: %v", m1.Members())
+	}
+}
+
+func TestMemberlist_ProxyProtocolRouter(t *testing.T) {
+	r, err := NewRouter("127.0.0.1", 0, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+
+	c := testConfig()
+	c.Router = r
+	c.Label = "test"
+	c.AcceptProxyProtocol = true
+	if _, err := Create(c); err == nil {
+		t.Fatalf("expected error accepting the PROXY protocol with a router")
+	}
+}
+
+func TestProxyProtocol_ShortStream(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// A short stream that isn't a header shouldn't block waiting for more.
+	go client.Write([]byte{0x0D, 0x00})
+	doneCh := make(chan error, 1)
+	go func() {
+		_, err := readProxyHeader(server)
+		doneCh <- err
+	}()
+	select {
+	case err := <-doneCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("blocked on a short stream")
+	}
+}
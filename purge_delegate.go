@@ -0,0 +1,13 @@
+package memberlist
+
+// PurgeDelegate is used to find out when memberlist forgets about a dead
+// node altogether, so that any resources held for it can be released.
+// Dead nodes are kept around, and gossiped about, until the next time
+// we've probed our way through the whole list of nodes, and are purged
+// then.
+type PurgeDelegate interface {
+	// NotifyPurge is invoked once a dead node has been removed from our
+	// state. The Node argument must not be modified. If the node comes
+	// back after this, it'll be treated as a new join.
+	NotifyPurge(*Node)
+}
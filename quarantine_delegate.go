@@ -0,0 +1,26 @@
+package memberlist
+
+import "time"
+
+// QuarantineEvent describes a peer we've stopped listening to because of
+// repeated protocol violations.
+type QuarantineEvent struct {
+	// Addr is the peer's address, as its packets arrive from.
+	Addr string
+
+	// Reason is the violation that pushed the peer over the threshold.
+	Reason string
+
+	// Score is the peer's misbehavior score at the time.
+	Score float64
+
+	// Until is when the quarantine lifts.
+	Until time.Time
+}
+
+// QuarantineDelegate is used to find out when a misbehaving peer is
+// quarantined, so that operators can investigate it.
+type QuarantineDelegate interface {
+	// NotifyQuarantine is invoked when a peer is quarantined.
+	NotifyQuarantine(QuarantineEvent)
+}
@@ -0,0 +1,146 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+// query is sent over a stream to ask a node for a NodeReport. It has no
+// fields yet, but is encoded like any other message so that filters can be
+// added later without a new message type.
+type query struct{}
+
+// queryResp answers a query with either a report or the reason there
+// isn't one.
+type queryResp struct {
+	Error  string      `codec:"Error,omitempty"`
+	Report *NodeReport `codec:"Report,omitempty"`
+}
+
+// NodeReport is a node's own view of the cluster, as returned by
+// Memberlist.QueryNode.
+type NodeReport struct {
+	// Name is the name of the node that answered.
+	Name string
+
+	// Members is every node it knows about, including those it considers
+	// dead.
+	Members []MemberReport
+
+	// HealthScore is its awareness score; see Memberlist.GetHealthScore.
+	HealthScore int
+
+	// QueuedBroadcasts is the number of broadcasts waiting to be gossiped,
+	// and QueuedCallbacks the number of delegate callbacks waiting to run
+	// when Config.DelegateWorkers is set.
+	QueuedBroadcasts int
+	QueuedCallbacks  int
+}
+
+// MemberReport describes a single member in a NodeReport.
+type MemberReport struct {
+	Name        string
+	Addr        net.IP
+	Port        uint16
+	Meta        []byte
+	Incarnation uint32
+	Status      NodeStatus
+}
+
+// QueryNode asks the node listening at the given host:port for its view
+// of the cluster. The node must have Config.EnableQueries set. This
+// doesn't need the queried node to be a member of our cluster, only to
+// share our label and keys, so it can be used by operator tooling that
+// creates a memberlist without joining.
+func (m *Memberlist) QueryNode(addr string, timeout time.Duration) (*NodeReport, error) {
+	deadline := time.Now().Add(timeout)
+	conn, err := m.dialTCP(addr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return nil, err
+	}
+
+	out, err := encode(queryMsg, &query{})
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rawSendMsgTCP(conn, out.Bytes()); err != nil {
+		return nil, err
+	}
+
+	msgType, _, dec, err := m.readTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != queryRespMsg {
+		return nil, fmt.Errorf("Unexpected msgType (%d) from query %s", msgType, LogConn(conn))
+	}
+
+	var resp queryResp
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("Query refused by %s: %s", addr, resp.Error)
+	}
+	if resp.Report == nil {
+		return nil, fmt.Errorf("Empty query response from %s", addr)
+	}
+	return resp.Report, nil
+}
+
+// handleQuery answers a query read from a stream.
+func (m *Memberlist) handleQuery(conn net.Conn, dec *codec.Decoder) error {
+	var q query
+	if err := dec.Decode(&q); err != nil {
+		return err
+	}
+
+	var resp queryResp
+	if m.config.EnableQueries {
+		resp.Report = m.nodeReport()
+	} else {
+		resp.Error = "queries are not enabled"
+	}
+
+	out, err := encode(queryRespMsg, &resp)
+	if err != nil {
+		return err
+	}
+	return m.rawSendMsgTCP(conn, out.Bytes())
+}
+
+// nodeReport builds the report sent in answer to a query.
+func (m *Memberlist) nodeReport() *NodeReport {
+	report := &NodeReport{
+		Name:             m.config.Name,
+		HealthScore:      m.GetHealthScore(),
+		QueuedBroadcasts: m.broadcasts.NumQueued(),
+	}
+	if m.delegates != nil {
+		report.QueuedCallbacks = m.delegates.Queued()
+	}
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	report.Members = make([]MemberReport, len(m.nodes))
+	for i, n := range m.nodes {
+		report.Members[i] = MemberReport{
+			Name:        n.Name,
+			Addr:        n.Addr,
+			Port:        n.Port,
+			Meta:        n.Meta,
+			Incarnation: n.Incarnation,
+			Status:      NodeStatus(n.State),
+		}
+	}
+	return report
+}
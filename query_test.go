@@ -0,0 +1,88 @@
+package memberlist
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_QueryNode(t *testing.T) {
+	c1 := testConfig()
+	c1.EnableQueries = true
+	m1, err := NewMemberlistOnOpenPort(c1)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+
+	m2 := GetMemberlist(t)
+	m2.setAlive()
+	m2.schedule()
+	defer m2.Shutdown()
+
+	addr1 := fmt.Sprintf("%s:%d", m1.config.BindAddr, m1.config.BindPort)
+	if _, err := m2.Join([]string{addr1}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	report, err := m2.QueryNode(addr1, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Name != m1.config.Name {
+		t.Fatalf("bad: %#v", report)
+	}
+	if len(report.Members) != 2 {
+		t.Fatalf("bad: %#v", report.Members)
+	}
+	for _, member := range report.Members {
+		if member.Status != StatusAlive || member.Port == 0 || member.Addr == nil {
+			t.Fatalf("bad: %#v", member)
+		}
+	}
+
+	// m2 doesn't answer queries.
+	addr2 := fmt.Sprintf("%s:%d", m2.config.BindAddr, m2.config.BindPort)
+	_, err = m1.QueryNode(addr2, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "queries are not enabled") {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMemberlist_QueryNode_Encrypted(t *testing.T) {
+	c1 := testConfig()
+	c1.EnableQueries = true
+	c1.SecretKey = TestKeys[0]
+	m1, err := NewMemberlistOnOpenPort(c1)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	m1.setAlive()
+	defer m1.Shutdown()
+	addr1 := fmt.Sprintf("%s:%d", m1.config.BindAddr, m1.config.BindPort)
+
+	// Without the key the query is refused.
+	m2 := GetMemberlist(t)
+	defer m2.Shutdown()
+	if _, err := m2.QueryNode(addr1, time.Second); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	c3 := testConfig()
+	c3.SecretKey = TestKeys[0]
+	m3, err := NewMemberlistOnOpenPort(c3)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m3.Shutdown()
+	report, err := m3.QueryNode(addr1, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if report.Name != m1.config.Name || len(report.Members) != 1 {
+		t.Fatalf("bad: %#v", report)
+	}
+}
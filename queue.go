@@ -3,6 +3,7 @@ package memberlist
 import (
 	"sort"
 	"sync"
+	"time"
 )
 
 // TransmitLimitedQueue is used to queue messages to broadcast to
@@ -19,12 +20,21 @@ type TransmitLimitedQueue struct {
 	// number of retransmissions attempted.
 	RetransmitMult int
 
+	// Relayed is set if every node that receives a broadcast from the
+	// queue passes it on in turn, as memberlist does with its own
+	// messages, or an application does that rebroadcasts the user
+	// messages it gets. The reach given to a PropagatedBroadcast then
+	// assumes the broadcast spread like an epidemic. Otherwise it only
+	// counts the nodes we sent it to ourselves.
+	Relayed bool
+
 	sync.Mutex
 	bcQueue limitedBroadcasts
 }
 
 type limitedBroadcast struct {
-	transmits int // Number of transmissions attempted.
+	transmits int  // Number of transmissions attempted.
+	priority  bool // Sent ahead of everything else.
 	b         Broadcast
 }
 type limitedBroadcasts []*limitedBroadcast
@@ -45,8 +55,45 @@ type Broadcast interface {
 	Finished()
 }
 
+// ExpiringBroadcast is a Broadcast that is dropped from the queue once it
+// expires, even if it hasn't been sent as many times as it would have been
+// otherwise. Finished is still invoked when it's dropped.
+type ExpiringBroadcast interface {
+	Broadcast
+
+	// Expires returns the time after which the broadcast is no longer
+	// worth sending.
+	Expires() time.Time
+}
+
+// PropagatedBroadcast is a Broadcast that's told how far it probably got
+// once it's finished, so the sender knows whether it's likely to be
+// everywhere or should be sent again.
+type PropagatedBroadcast interface {
+	Broadcast
+
+	// Propagated is invoked just before Finished with the fraction of the
+	// cluster, from 0 to 1, that has probably heard the broadcast. It's
+	// estimated from how many times the broadcast was sent and the size of
+	// the cluster, counting only the nodes we sent it to unless the queue
+	// is Relayed; see the notes in propagation.go. A broadcast that was
+	// invalidated or dropped early gets whatever it had reached by then.
+	Propagated(fraction float64)
+}
+
 // QueueBroadcast is used to enqueue a broadcast
 func (q *TransmitLimitedQueue) QueueBroadcast(b Broadcast) {
+	q.queueBroadcast(b, false)
+}
+
+// QueuePriorityBroadcast is used to enqueue a broadcast that is sent ahead
+// of all the others, however many times they've been transmitted, for as
+// long as it stays in the queue.
+func (q *TransmitLimitedQueue) QueuePriorityBroadcast(b Broadcast) {
+	q.queueBroadcast(b, true)
+}
+
+func (q *TransmitLimitedQueue) queueBroadcast(b Broadcast, priority bool) {
 	q.Lock()
 	defer q.Unlock()
 
@@ -54,7 +101,7 @@ func (q *TransmitLimitedQueue) QueueBroadcast(b Broadcast) {
 	n := len(q.bcQueue)
 	for i := 0; i < n; i++ {
 		if b.Invalidates(q.bcQueue[i].b) {
-			q.bcQueue[i].b.Finished()
+			q.finish(q.bcQueue[i])
 			copy(q.bcQueue[i:], q.bcQueue[i+1:])
 			q.bcQueue[n-1] = nil
 			q.bcQueue = q.bcQueue[:n-1]
@@ -62,8 +109,18 @@ func (q *TransmitLimitedQueue) QueueBroadcast(b Broadcast) {
 		}
 	}
 
-	// Append to the queue
-	q.bcQueue = append(q.bcQueue, &limitedBroadcast{0, b})
+	// Append to the queue. Broadcasts are sent from the end, where the
+	// priority ones are kept, so others go just in front of those.
+	lb := &limitedBroadcast{transmits: 0, priority: priority, b: b}
+	idx := len(q.bcQueue)
+	if !priority {
+		for idx > 0 && q.bcQueue[idx-1].priority {
+			idx--
+		}
+	}
+	q.bcQueue = append(q.bcQueue, nil)
+	copy(q.bcQueue[idx+1:], q.bcQueue[idx:])
+	q.bcQueue[idx] = lb
 }
 
 // GetBroadcasts is used to get a number of broadcasts, up to a byte limit
@@ -77,13 +134,26 @@ func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
 		return nil
 	}
 
-	transmitLimit := retransmitLimit(q.RetransmitMult, q.NumNodes())
+	numNodes := q.NumNodes()
+	transmitLimit := retransmitLimit(q.RetransmitMult, numNodes)
 	bytesUsed := 0
 	var toSend [][]byte
+	now := time.Now()
+	expired := false
 
 	for i := len(q.bcQueue) - 1; i >= 0; i-- {
-		// Check if this is within our limits
+		// Drop it if it's expired
 		b := q.bcQueue[i]
+		if eb, ok := b.b.(ExpiringBroadcast); ok && !now.Before(eb.Expires()) {
+			q.finish(b)
+			n := len(q.bcQueue)
+			q.bcQueue[i], q.bcQueue[n-1] = q.bcQueue[n-1], nil
+			q.bcQueue = q.bcQueue[:n-1]
+			expired = true
+			continue
+		}
+
+		// Check if this is within our limits
 		msg := b.b.Message()
 		if bytesUsed+overhead+len(msg) > limit {
 			continue
@@ -95,22 +165,49 @@ func (q *TransmitLimitedQueue) GetBroadcasts(overhead, limit int) [][]byte {
 
 		// Check if we should stop transmission
 		b.transmits++
+		if o, ok := b.b.(transmitObserver); ok {
+			o.transmitted(q.reach(b.transmits, numNodes))
+		}
 		if b.transmits >= transmitLimit {
-			b.b.Finished()
+			q.finish(b)
 			n := len(q.bcQueue)
 			q.bcQueue[i], q.bcQueue[n-1] = q.bcQueue[n-1], nil
 			q.bcQueue = q.bcQueue[:n-1]
 		}
 	}
 
-	// If we are sending anything, we need to re-sort to deal
+	// If we are sending or dropped anything, we need to re-sort to deal
 	// with adjusted transmit counts
-	if len(toSend) > 0 {
+	if len(toSend) > 0 || expired {
 		q.bcQueue.Sort()
 	}
 	return toSend
 }
 
+// peekBroadcasts is like GetBroadcasts, but the broadcasts it returns
+// aren't counted as transmitted, and none are dropped from the queue.
+func (q *TransmitLimitedQueue) peekBroadcasts(overhead, limit int) [][]byte {
+	q.Lock()
+	defer q.Unlock()
+
+	bytesUsed := 0
+	var toSend [][]byte
+	now := time.Now()
+	for i := len(q.bcQueue) - 1; i >= 0; i-- {
+		b := q.bcQueue[i]
+		if eb, ok := b.b.(ExpiringBroadcast); ok && !now.Before(eb.Expires()) {
+			continue
+		}
+		msg := b.b.Message()
+		if bytesUsed+overhead+len(msg) > limit {
+			continue
+		}
+		bytesUsed += overhead + len(msg)
+		toSend = append(toSend, msg)
+	}
+	return toSend
+}
+
 // NumQueued returns the number of queued messages
 func (q *TransmitLimitedQueue) NumQueued() int {
 	q.Lock()
@@ -123,7 +220,7 @@ func (q *TransmitLimitedQueue) Reset() {
 	q.Lock()
 	defer q.Unlock()
 	for _, b := range q.bcQueue {
-		b.b.Finished()
+		q.finish(b)
 	}
 	q.bcQueue = nil
 }
@@ -142,7 +239,7 @@ func (q *TransmitLimitedQueue) Prune(maxRetain int) {
 
 	// Invalidate the messages we will be removing
 	for i := 0; i < n-maxRetain; i++ {
-		q.bcQueue[i].b.Finished()
+		q.finish(q.bcQueue[i])
 	}
 
 	// Move the messages, and retain only the last maxRetain
@@ -150,11 +247,32 @@ func (q *TransmitLimitedQueue) Prune(maxRetain int) {
 	q.bcQueue = q.bcQueue[:maxRetain]
 }
 
+// finish tells a broadcast it won't be sent again, and how far it got if
+// it wants to know.
+func (q *TransmitLimitedQueue) finish(b *limitedBroadcast) {
+	if pb, ok := b.b.(PropagatedBroadcast); ok {
+		pb.Propagated(q.reach(b.transmits, q.NumNodes()))
+	}
+	b.b.Finished()
+}
+
+// reach estimates the fraction of a cluster of n nodes that has heard a
+// broadcast sent transmits times.
+func (q *TransmitLimitedQueue) reach(transmits, n int) float64 {
+	if q.Relayed {
+		return estimatedReach(transmits, n)
+	}
+	return directReach(transmits, n)
+}
+
 func (b limitedBroadcasts) Len() int {
 	return len(b)
 }
 
 func (b limitedBroadcasts) Less(i, j int) bool {
+	if b[i].priority != b[j].priority {
+		return b[i].priority
+	}
 	return b[i].transmits < b[j].transmits
 }
 
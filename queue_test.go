@@ -2,6 +2,7 @@ package memberlist
 
 import (
 	"testing"
+	"time"
 )
 
 func TestTransmitLimited_Queue(t *testing.T) {
@@ -170,3 +171,113 @@ func TestLimitedBroadcastSort(t *testing.T) {
 		t.Fatalf("bad val %v", bc[4])
 	}
 }
+
+func TestTransmitLimited_QueuePriorityBroadcast(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 10 }}
+
+	// 18 bytes per message, so only one fits in each call
+	q.QueuePriorityBroadcast(&memberlistBroadcast{"test", []byte("1. this is a test."), nil})
+	q.QueueBroadcast(&memberlistBroadcast{"foo", []byte("2. this is a test."), nil})
+	q.QueueBroadcast(&memberlistBroadcast{"bar", []byte("3. this is a test."), nil})
+
+	// The priority message goes first even after it has been sent more
+	// often than the others, until it hits the limit of 6 transmits
+	for i := 0; i < 6; i++ {
+		out := q.GetBroadcasts(2, 20)
+		if len(out) != 1 || string(out[0]) != "1. this is a test." {
+			t.Fatalf("expected priority message: %q", out)
+		}
+	}
+
+	// Once it's done the newest message is next
+	out := q.GetBroadcasts(2, 20)
+	if len(out) != 1 || string(out[0]) != "3. this is a test." {
+		t.Fatalf("expected newest message: %q", out)
+	}
+}
+
+type expiringTestBroadcast struct {
+	memberlistBroadcast
+	expires time.Time
+}
+
+func (b *expiringTestBroadcast) Expires() time.Time {
+	return b.expires
+}
+
+func TestTransmitLimited_GetBroadcasts_Expired(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 3, NumNodes: func() int { return 10 }}
+
+	notify := make(chan struct{}, 1)
+	q.QueueBroadcast(&expiringTestBroadcast{memberlistBroadcast{"old", []byte("old"), notify}, time.Now().Add(-time.Second)})
+	q.QueueBroadcast(&expiringTestBroadcast{memberlistBroadcast{"new", []byte("new"), nil}, time.Now().Add(time.Hour)})
+	q.QueueBroadcast(&memberlistBroadcast{"plain", []byte("plain"), nil})
+
+	out := q.GetBroadcasts(2, 100)
+	if len(out) != 2 {
+		t.Fatalf("expected the expired broadcast to be dropped: %q", out)
+	}
+	for _, msg := range out {
+		if string(msg) == "old" {
+			t.Fatalf("expired broadcast was sent")
+		}
+	}
+	if q.NumQueued() != 2 {
+		t.Fatalf("bad queue len: %d", q.NumQueued())
+	}
+	select {
+	case <-notify:
+	default:
+		t.Fatalf("expected the expired broadcast to be finished")
+	}
+}
+
+type propagatedTestBroadcast struct {
+	memberlistBroadcast
+	fraction float64
+	calls    int
+}
+
+func (b *propagatedTestBroadcast) Propagated(fraction float64) {
+	b.fraction = fraction
+	b.calls++
+}
+
+func TestTransmitLimited_Propagated(t *testing.T) {
+	q := &TransmitLimitedQueue{RetransmitMult: 4, NumNodes: func() int { return 10 }}
+
+	sent := &propagatedTestBroadcast{memberlistBroadcast: memberlistBroadcast{"sent", []byte("sent"), nil}}
+	q.QueueBroadcast(sent)
+	limit := retransmitLimit(q.RetransmitMult, 10)
+	for i := 0; i < limit; i++ {
+		if sent.calls != 0 {
+			t.Fatalf("should not be finished after %d sends", i)
+		}
+		q.GetBroadcasts(2, 100)
+	}
+	if sent.calls != 1 || sent.fraction != directReach(limit, 10) {
+		t.Fatalf("bad propagation: %d %v", sent.calls, sent.fraction)
+	}
+	if sent.fraction == 1 {
+		t.Fatalf("should not count nodes that weren't sent it: %v", sent.fraction)
+	}
+
+	// Once receivers pass it on, the retransmit limit reaches everyone.
+	q.Relayed = true
+	relayed := &propagatedTestBroadcast{memberlistBroadcast: memberlistBroadcast{"relayed", []byte("relayed"), nil}}
+	q.QueueBroadcast(relayed)
+	for i := 0; i < limit; i++ {
+		q.GetBroadcasts(2, 100)
+	}
+	if relayed.calls != 1 || relayed.fraction != 1 {
+		t.Fatalf("bad propagation: %d %v", relayed.calls, relayed.fraction)
+	}
+
+	// One dropped before it's sent has only reached us.
+	old := &propagatedTestBroadcast{memberlistBroadcast: memberlistBroadcast{"test", []byte("old"), nil}}
+	q.QueueBroadcast(old)
+	q.Reset()
+	if old.calls != 1 || old.fraction != 0.1 {
+		t.Fatalf("bad propagation: %d %v", old.calls, old.fraction)
+	}
+}
@@ -0,0 +1,192 @@
+package memberlist
+
+import (
+	"net"
+	"sort"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Reachability sampling checks whether other members can reach each other,
+not just whether we can reach them. SWIM hides one-way packet loss between
+two peers: if A can't reach B, A's indirect probes still get through via
+others and B is never suspected. To see this, every ReachabilityInterval we
+pick two random members A and B and send A an indirect ping request for B,
+just as a probe would. An ack from B relayed by A means A reached B, a nack
+from A means A is up but couldn't reach B, and hearing nothing leaves the
+sample inconclusive.
+
+Samples are counted per ordered pair. Once a pair has had
+reachabilityWindow conclusive samples its counts are halved, so the report
+favours recent behaviour.
+*/
+
+const reachabilityWindow = 32
+
+// reachPair identifies an ordered pair of members, From sending to To.
+type reachPair struct {
+	from, to string
+}
+
+// PairReachability summarizes the samples taken between two members.
+type PairReachability struct {
+	From string
+	To   string
+
+	// Acks is the number of samples where From reached To, Nacks the
+	// number where From answered but couldn't reach To, and Lost the
+	// number where From didn't answer at all.
+	Acks  int
+	Nacks int
+	Lost  int
+}
+
+// Ratio returns the fraction of conclusive samples in which From reached
+// To, or 1 if there haven't been any.
+func (p PairReachability) Ratio() float64 {
+	if p.Acks+p.Nacks == 0 {
+		return 1
+	}
+	return float64(p.Acks) / float64(p.Acks+p.Nacks)
+}
+
+// ReachabilityReport is the aggregated result of reachability sampling.
+type ReachabilityReport struct {
+	// Pairs has an entry for each ordered pair of current members that has
+	// been sampled, sorted by From and then To.
+	Pairs []PairReachability
+
+	// Asymmetric lists the pairs where From mostly fails to reach To, but
+	// To mostly reaches From, which usually points at a firewall or
+	// routing problem on one side.
+	Asymmetric []PairReachability
+}
+
+// Reachability returns a report of the reachability samples taken so far.
+// It's empty unless Config.ReachabilityInterval is set.
+func (m *Memberlist) Reachability() ReachabilityReport {
+	m.nodeLock.RLock()
+	live := make(map[string]bool, len(m.nodes))
+	for _, n := range m.nodes {
+		if n.State != stateDead {
+			live[n.Name] = true
+		}
+	}
+	m.nodeLock.RUnlock()
+
+	m.reachLock.Lock()
+	defer m.reachLock.Unlock()
+
+	var report ReachabilityReport
+	for pair, counts := range m.reach {
+		if !live[pair.from] || !live[pair.to] {
+			delete(m.reach, pair)
+			continue
+		}
+		report.Pairs = append(report.Pairs, *counts)
+	}
+	sort.Slice(report.Pairs, func(i, j int) bool {
+		a, b := report.Pairs[i], report.Pairs[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.To < b.To
+	})
+
+	for _, p := range report.Pairs {
+		reverse, ok := m.reach[reachPair{p.To, p.From}]
+		if !ok || p.Acks+p.Nacks == 0 || reverse.Acks+reverse.Nacks == 0 {
+			continue
+		}
+		if p.Ratio() < 0.5 && reverse.Ratio() >= 0.5 {
+			report.Asymmetric = append(report.Asymmetric, p)
+		}
+	}
+	return report
+}
+
+// sampleReachability asks one random member to ping another, and records
+// the outcome.
+func (m *Memberlist) sampleReachability() {
+	m.nodeLock.RLock()
+	excludes := []string{m.config.Name}
+	nodes := kRandomNodes(2, excludes, m.nodes)
+	m.nodeLock.RUnlock()
+	if len(nodes) < 2 {
+		return
+	}
+	relay, target := nodes[0], nodes[1]
+
+	// Relays that don't understand nacks can't tell us about failures, so
+	// there's no point in sampling through them.
+	if relay.PMax < 4 {
+		return
+	}
+
+	m.inflight.start(inflightProbe)
+	defer m.inflight.done(inflightProbe)
+
+	ping := m.newPing(m.nextSeqNo(), target.Name)
+	ackCh := make(chan ackMessage, 1)
+	nackCh := make(chan nackReason, 1)
+	m.setProbeChannels(ping.SeqNo, ackCh, nackCh, m.config.ProbeInterval)
+
+	ind := indirectPingReq{SeqNo: ping.SeqNo, Target: target.Addr, Port: target.Port, Node: target.Name, Nack: true}
+	ind.SourceAddr, ind.SourcePort = ping.SourceAddr, ping.SourcePort
+
+	destAddr := &net.UDPAddr{IP: relay.Addr, Port: int(relay.Port)}
+	if err := m.encodeAndSendMsg(destAddr, indirectPingMsg, &ind); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send reachability sample: %s", err)
+		return
+	}
+
+	var outcome string
+	select {
+	case v := <-ackCh:
+		if v.Complete {
+			outcome = "ack"
+		} else if len(nackCh) > 0 {
+			outcome = "nack"
+		} else {
+			outcome = "lost"
+		}
+	case <-nackCh:
+		outcome = "nack"
+	case <-m.shutdownCh:
+		return
+	}
+	metrics.IncrCounter([]string{"memberlist", "reachability", outcome}, 1)
+	m.recordReachability(relay.Name, target.Name, outcome)
+}
+
+// recordReachability adds a sample to the counts for a pair.
+func (m *Memberlist) recordReachability(from, to, outcome string) {
+	m.reachLock.Lock()
+	defer m.reachLock.Unlock()
+
+	if m.reach == nil {
+		m.reach = make(map[reachPair]*PairReachability)
+	}
+	pair := reachPair{from, to}
+	counts, ok := m.reach[pair]
+	if !ok {
+		counts = &PairReachability{From: from, To: to}
+		m.reach[pair] = counts
+	}
+
+	switch outcome {
+	case "ack":
+		counts.Acks++
+	case "nack":
+		counts.Nacks++
+	default:
+		counts.Lost++
+	}
+
+	if counts.Acks+counts.Nacks >= reachabilityWindow {
+		counts.Acks /= 2
+		counts.Nacks /= 2
+		counts.Lost /= 2
+	}
+}
@@ -0,0 +1,111 @@
+package memberlist
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestMemberlist_Reachability_Report(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	for _, name := range []string{"a", "b", "c"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+
+	// a can't reach b, but b reaches a.
+	for i := 0; i < 3; i++ {
+		m.recordReachability("a", "b", "nack")
+		m.recordReachability("b", "a", "ack")
+	}
+	m.recordReachability("a", "c", "ack")
+	m.recordReachability("a", "c", "lost")
+	m.recordReachability("c", "a", "ack")
+
+	report := m.Reachability()
+	if len(report.Pairs) != 4 {
+		t.Fatalf("bad: %v", report.Pairs)
+	}
+	first := report.Pairs[0]
+	if first.From != "a" || first.To != "b" || first.Nacks != 3 || first.Ratio() != 0 {
+		t.Fatalf("bad: %#v", first)
+	}
+	ac := report.Pairs[1]
+	if ac.To != "c" || ac.Acks != 1 || ac.Lost != 1 || ac.Ratio() != 1 {
+		t.Fatalf("bad: %#v", ac)
+	}
+	if len(report.Asymmetric) != 1 || report.Asymmetric[0].From != "a" || report.Asymmetric[0].To != "b" {
+		t.Fatalf("bad: %v", report.Asymmetric)
+	}
+
+	// Pairs involving dead members are dropped.
+	m.deadNode(&dead{Node: "c", Incarnation: 1, From: m.config.Name})
+	if report := m.Reachability(); len(report.Pairs) != 2 {
+		t.Fatalf("bad: %v", report.Pairs)
+	}
+}
+
+func TestMemberlist_Reachability_Window(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	for i := 0; i < reachabilityWindow/2; i++ {
+		m.recordReachability("a", "b", "nack")
+		m.recordReachability("a", "b", "ack")
+	}
+
+	// The counts were halved once they filled the window.
+	counts := m.reach[reachPair{"a", "b"}]
+	if counts.Acks != reachabilityWindow/4 || counts.Nacks != reachabilityWindow/4 {
+		t.Fatalf("bad: %#v", counts)
+	}
+}
+
+func TestMemberlist_SampleReachability(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	m1.schedule()
+	defer m1.Shutdown()
+	addr1 := fmt.Sprintf("%s:%d", m1.config.BindAddr, m1.config.BindPort)
+
+	for i := 0; i < 2; i++ {
+		m := GetMemberlist(t)
+		m.setAlive()
+		m.schedule()
+		defer m.Shutdown()
+		if _, err := m.Join([]string{addr1}); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if m1.NumMembers() != 3 {
+		t.Fatalf("should have 3 nodes! %v", m1.Members())
+	}
+
+	// A sample is skipped now and then when the random pick comes up
+	// short, so keep going until there are a few.
+	sampled := func() int {
+		n := 0
+		for _, p := range m1.Reachability().Pairs {
+			n += p.Acks + p.Nacks + p.Lost
+		}
+		return n
+	}
+	for i := 0; i < 20 && sampled() < 4; i++ {
+		m1.sampleReachability()
+	}
+
+	report := m1.Reachability()
+	if sampled() < 4 {
+		t.Fatalf("should have sampled something: %v", report)
+	}
+	for _, p := range report.Pairs {
+		if p.From == m1.config.Name || p.To == m1.config.Name {
+			t.Fatalf("bad: %#v", p)
+		}
+		if p.Nacks != 0 || p.Lost != 0 {
+			t.Fatalf("bad: %#v", p)
+		}
+	}
+	if len(report.Asymmetric) != 0 {
+		t.Fatalf("bad: %v", report)
+	}
+}
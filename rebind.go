@@ -0,0 +1,172 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Rebind moves us to a new address or port while we're running, for
+environments where ports are leased and can be taken back. It opens the
+new listeners before touching the old ones, so a failure leaves us as we
+were, then starts sending from the new address and tells the cluster we've
+moved with a new alive message.
+
+Normally a node turning up at a new address is taken as a conflict, two
+nodes with the same name, and ignored. An alive message marked Moved with a
+newer incarnation is taken as the node moving instead. Once we've moved,
+everything we send about ourselves is marked, and nodes remember and pass
+on the mark, so nodes that missed the move take the new address whenever
+they hear of it. Older versions don't know the mark, and see a conflict.
+Only a move the node announced itself is taken. If anyone else claims
+we've moved, we refute it from our real address, marked, so that nodes
+that took the claim take our address back.
+
+The old listeners stay open until the news has gone out, so that acks and
+streams already on their way to the old address aren't lost.
+*/
+
+// RebindConfig is where to move to with Rebind.
+type RebindConfig struct {
+	// BindAddr and BindPort are the new address and port to listen on,
+	// as for Config. BindAddr defaults to Config.BindAddr, and a zero
+	// BindPort picks a free port.
+	BindAddr string
+	BindPort int
+
+	// AdvertiseAddr and AdvertisePort, if set, are the address and port
+	// to advertise, as for Config. Otherwise the address we're bound to
+	// is advertised.
+	AdvertiseAddr string
+	AdvertisePort int
+
+	// Timeout is how long to wait for the news to go out, like UpdateNode,
+	// before closing the old listeners. Zero waits forever.
+	Timeout time.Duration
+}
+
+// packetConn returns our UDP listener and the offloads enabled on it.
+func (m *Memberlist) packetConn() (*net.UDPConn, udpOffload) {
+	m.listenLock.RLock()
+	defer m.listenLock.RUnlock()
+	return m.udpListener, m.udpOffload
+}
+
+// streamListener returns our TCP listener.
+func (m *Memberlist) streamListener() *net.TCPListener {
+	m.listenLock.RLock()
+	defer m.listenLock.RUnlock()
+	return m.tcpListener
+}
+
+// acceptMove returns true if an alive message with a different address for
+// a node we know is the node moving, rather than a conflict. We only move
+// ourselves through Rebind, and others only on their own word, not a third
+// party's. The nodeLock must be held.
+func (m *Memberlist) acceptMove(a *alive, state *nodeState, bootstrap bool) bool {
+	if state.Name == m.config.Name {
+		return bootstrap && a.Moved
+	}
+	return a.Moved && a.Origin == a.Node && a.Incarnation > state.Incarnation
+}
+
+// Rebind moves us to a new address or port while running, telling the
+// cluster, and waiting for the news to go out as UpdateNode does. It
+// returns ErrUpdateTimeout if the news didn't go out in time, though we've
+// moved all the same. It isn't available with a Router.
+func (m *Memberlist) Rebind(cfg RebindConfig) error {
+	if m.config.Router != nil {
+		return fmt.Errorf("Can't rebind with a shared router")
+	}
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
+	bindAddr := cfg.BindAddr
+	if bindAddr == "" {
+		bindAddr = m.config.BindAddr
+	}
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP(bindAddr), Port: cfg.BindPort}
+	tcpLn, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to start TCP listener. Err: %s", err)
+	}
+
+	// Work out what to advertise before we let go of the old listeners, so
+	// that a bad address leaves us where we were.
+	addr, port, err := m.advertiseAddr(bindAddr, cfg.AdvertiseAddr, cfg.AdvertisePort, tcpLn)
+	if err != nil {
+		tcpLn.Close()
+		return err
+	}
+
+	udpAddr := &net.UDPAddr{IP: net.ParseIP(bindAddr), Port: tcpLn.Addr().(*net.TCPAddr).Port}
+	udpLn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		tcpLn.Close()
+		return fmt.Errorf("Failed to start UDP listener. Err: %s", err)
+	}
+	setUDPRecvBuf(udpLn)
+	var off udpOffload
+	if m.config.EnableUDPOffload {
+		if off, err = enableUDPOffload(udpLn); err != nil {
+			m.logger.Printf("[WARN] memberlist: Failed to enable UDP offload: %s", err)
+		}
+	}
+	if m.config.EnableECN {
+		if err := enableECN(udpLn); err != nil {
+			m.logger.Printf("[WARN] memberlist: Failed to enable ECN: %s", err)
+		} else {
+			off.ecn = true
+		}
+	}
+
+	m.listenLock.Lock()
+	oldTCP, oldUDP := m.tcpListener, m.udpListener
+	m.tcpListener, m.udpListener, m.udpOffload = tcpLn, udpLn, off
+	m.listenLock.Unlock()
+	go m.tcpListen(tcpLn)
+	go m.udpListen(udpLn)
+
+	defer func() {
+		oldTCP.Close()
+		oldUDP.Close()
+	}()
+
+	// Shutdown may have closed the old listeners as we swapped them.
+	select {
+	case <-m.shutdownCh:
+		tcpLn.Close()
+		udpLn.Close()
+		return ErrShutdown
+	default:
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "rebind"}, 1)
+	m.logger.Printf("[INFO] memberlist: Rebound to %s, advertising %s", tcpLn.Addr(),
+		net.JoinHostPort(addr.String(), fmt.Sprint(port)))
+
+	m.nodeLock.RLock()
+	meta := m.nodeMap[m.config.Name].Meta
+	m.nodeLock.RUnlock()
+	a := alive{
+		Incarnation: m.nextIncarnation(),
+		Node:        m.config.Name,
+		Addr:        addr,
+		Port:        uint16(port),
+		Meta:        meta,
+		Vsn:         m.localVsn(),
+		Paused:      m.Paused(),
+		Maintenance: m.InMaintenance(),
+		Moved:       true,
+	}
+
+	notifyCh := make(chan struct{})
+	m.aliveNode(&a, notifyCh, true)
+	return m.waitBroadcast(notifyCh, cfg.Timeout)
+}
@@ -0,0 +1,182 @@
+package memberlist
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_Rebind(t *testing.T) {
+	c1 := testConfig()
+	c1.GossipInterval = 10 * time.Millisecond
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	conflict := &MockConflict{}
+	events := make(chan NodeEvent, 16)
+	c2 := testConfig()
+	c2.GossipInterval = 10 * time.Millisecond
+	c2.Conflict = conflict
+	c2.Events = &ChannelEventDelegate{Ch: events}
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	if err := m1.Rebind(RebindConfig{Timeout: time.Second}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	port := m1.streamListener().Addr().(*net.TCPAddr).Port
+	if port == c1.BindPort {
+		t.Fatalf("should have moved from %d", port)
+	}
+	if m1.LocalNode().Port != uint16(port) {
+		t.Fatalf("bad: %v", m1.LocalNode())
+	}
+
+	// The other side takes the move as an update, not a conflict.
+	deadline := time.After(5 * time.Second)
+	for moved := false; !moved; {
+		select {
+		case e := <-events:
+			moved = e.Event == NodeUpdate && e.Node.Name == c1.Name && e.Node.Port == uint16(port)
+		case <-deadline:
+			t.Fatalf("never saw the move")
+		}
+	}
+	if conflict.existing != nil {
+		t.Fatalf("should not conflict: %v %v", conflict.existing, conflict.other)
+	}
+	if _, err := m2.PingNode(c1.Name, time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// News of the old address from before the move is ignored.
+	stale := alive{
+		Node:        c1.Name,
+		Addr:        m1.LocalNode().Addr,
+		Port:        uint16(c1.BindPort),
+		Incarnation: 1,
+	}
+	m2.aliveNode(&stale, nil, false)
+	m2.nodeLock.RLock()
+	got := m2.nodeMap[c1.Name].Port
+	m2.nodeLock.RUnlock()
+	if got != uint16(port) {
+		t.Fatalf("bad port %d", got)
+	}
+	if conflict.existing != nil {
+		t.Fatalf("should not conflict: %v %v", conflict.existing, conflict.other)
+	}
+
+	m1.Shutdown()
+	if err := m1.Rebind(RebindConfig{}); err != ErrShutdown {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
+func TestMemberlist_Rebind_Router(t *testing.T) {
+	r, err := NewRouter(getBindAddr().String(), 0, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+
+	c := DefaultLANConfig()
+	c.Name = "a"
+	c.Label = "a"
+	c.Router = r
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	if err := m.Rebind(RebindConfig{}); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
+func TestMemberlist_Rebind_BadAdvertise(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	before := m.LocalNode()
+	ln := m.streamListener()
+
+	if err := m.Rebind(RebindConfig{AdvertiseAddr: "not an address"}); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// We're still where we were, and still listening there.
+	if m.streamListener() != ln {
+		t.Fatalf("should not have swapped listeners")
+	}
+	if after := m.LocalNode(); !after.Addr.Equal(before.Addr) || after.Port != before.Port {
+		t.Fatalf("should not have moved: %v", after)
+	}
+	conn, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatalf("should still listen: %v", err)
+	}
+	conn.Close()
+}
+
+func TestMemberlist_Rebind_ForgedMove(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&a, nil, true)
+	other := alive{Node: "other", Addr: []byte{127, 0, 0, 2}, Port: 7946, Incarnation: 1}
+	m.aliveNode(&other, nil, false)
+	m.broadcasts.Reset()
+
+	// A third party can't move another node.
+	forged := alive{
+		Node:        "other",
+		Addr:        []byte{127, 0, 0, 3},
+		Port:        7946,
+		Incarnation: 2,
+		Origin:      "mallory",
+		Moved:       true,
+	}
+	m.aliveNode(&forged, nil, false)
+	if got := m.nodeMap["other"]; !got.Addr.Equal(net.IP{127, 0, 0, 2}) || got.Incarnation != 1 {
+		t.Fatalf("should not have moved: %v", got)
+	}
+
+	// Nor us, and we refute it from our real address, marked as moved.
+	forged = alive{
+		Node:        m.config.Name,
+		Addr:        []byte{127, 0, 0, 3},
+		Port:        7946,
+		Incarnation: 2,
+		Origin:      "mallory",
+		Moved:       true,
+	}
+	m.aliveNode(&forged, nil, false)
+	me := m.nodeMap[m.config.Name]
+	if !me.Addr.Equal(net.IP{127, 0, 0, 1}) || me.Incarnation <= 2 || !me.moved {
+		t.Fatalf("bad: %v %d %v", me.Addr, me.Incarnation, me.moved)
+	}
+	if num := m.broadcasts.NumQueued(); num != 1 {
+		t.Fatalf("expected a refute, got %d queued", num)
+	}
+	var refute alive
+	msg := m.broadcasts.bcQueue[0].b.Message()
+	if err := decode(msg[1:], &refute); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !refute.Moved || !net.IP(refute.Addr).Equal(net.IP{127, 0, 0, 1}) || refute.Incarnation <= 2 {
+		t.Fatalf("bad refute: %+v", refute)
+	}
+}
@@ -0,0 +1,39 @@
+package memberlist
+
+import (
+	"runtime/debug"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// recoverInternal stops a panic in a background goroutine from taking down
+// the whole process, logging it and passing it to Config.OnInternalError
+// instead. It must be called directly by defer. The goroutine's current
+// unit of work, such as a packet or a probe, is abandoned, but memberlist
+// carries on with the next one.
+func (m *Memberlist) recoverInternal(routine string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	err := &InternalError{Routine: routine, Panic: r, Stack: debug.Stack()}
+	metrics.IncrCounter([]string{"memberlist", "internal_error", routine}, 1)
+	m.logger.Printf("[ERR] memberlist: %v\n%s", err, err.Stack)
+
+	if fn := m.config.OnInternalError; fn != nil {
+		fn(err)
+	}
+}
+
+// guard wraps a periodic task so that a panic in one run is recovered and
+// reported, and the next run goes ahead as usual.
+func (m *Memberlist) guard(routine string, fn func()) func() {
+	return func() {
+		m.tasks.start(routine, time.Now())
+		defer func() { m.tasks.finish(routine, time.Now()) }()
+		defer m.recoverInternal(routine)
+		fn()
+	}
+}
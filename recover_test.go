@@ -0,0 +1,80 @@
+package memberlist
+
+import (
+	"net"
+	"testing"
+)
+
+type panicAliveDelegate struct{}
+
+func (d *panicAliveDelegate) NotifyAlive(peer *Node) error {
+	if peer.Name == "hostile" {
+		panic("boom")
+	}
+	return nil
+}
+
+func TestMemberlist_RecoverInternal(t *testing.T) {
+	var errs []error
+	c := testConfig()
+	c.Alive = &panicAliveDelegate{}
+	c.OnInternalError = func(err error) {
+		errs = append(errs, err)
+	}
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	defer m.Shutdown()
+
+	from := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 7946}
+	for _, name := range []string{"hostile", "friendly"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Port: 7946, Incarnation: 1,
+			Vsn: []uint8{ProtocolVersionMin, ProtocolVersionMax, c.ProtocolVersion, 0, 0, 0}}
+		buf, err := encode(aliveMsg, &a)
+		if err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+		m.handleHandoff(msgHandoff{aliveMsg, buf.Bytes()[1:], from, ""})
+	}
+
+	if len(errs) != 1 {
+		t.Fatalf("bad: %v", errs)
+	}
+	ie, ok := errs[0].(*InternalError)
+	if !ok || ie.Routine != "handler" || ie.Panic != "boom" || len(ie.Stack) == 0 {
+		t.Fatalf("bad: %#v", errs[0])
+	}
+
+	// The panic didn't leave the node lock held, and later messages are
+	// still handled.
+	if m.NumMembers() != 2 {
+		t.Fatalf("bad: %v", m.Members())
+	}
+}
+
+func TestMemberlist_Guard(t *testing.T) {
+	var errs []error
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	m.config.OnInternalError = func(err error) {
+		errs = append(errs, err)
+	}
+
+	runs := 0
+	fn := m.guard("gossip", func() {
+		runs++
+		if runs == 1 {
+			panic("boom")
+		}
+	})
+	fn()
+	fn()
+
+	if runs != 2 || len(errs) != 1 {
+		t.Fatalf("bad: %d %v", runs, errs)
+	}
+	if err := errs[0].Error(); err != "Recovered from panic in gossip: boom" {
+		t.Fatalf("bad: %s", err)
+	}
+}
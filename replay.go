@@ -0,0 +1,176 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+/*
+Messages queued with BroadcastSequenced are gossiped like any other, so a
+member that was partitioned away, or down for a short while, misses those
+sent in the meantime. If the Delegate keeps a log of them and implements
+ReplayDelegate, a member that sees a gap in an origin's sequence numbers
+can call Backfill to have a peer stream it the missing range, which is
+delivered just as if it had arrived by gossip.
+
+A peer replays at most maxReplayMsgs messages, or maxReplayBytes of them,
+per request. Since the delegate sees the sequence number of each, it can
+ask again from where the last one left off.
+*/
+
+const (
+	// maxReplayMsgs is the most messages replayed for one request.
+	maxReplayMsgs = 1024
+
+	// maxReplayBytes caps the size of the messages replayed for one
+	// request, well within the maxPushStateBytes a stream is cut off at.
+	// The first message is always sent, so that a large one can't stall a
+	// backfill.
+	maxReplayBytes = 4 * 1024 * 1024
+
+	// replayMsgOverhead is the most a replayMsg adds to the encoded
+	// response beyond its message.
+	replayMsgOverhead = 32
+)
+
+// replayReq asks for the messages from an origin in a sequence range.
+type replayReq struct {
+	Origin string `codec:"Origin"`
+	First  uint64 `codec:"First"`
+	Last   uint64 `codec:"Last"`
+}
+
+// replayMsg is a replayed message.
+type replayMsg struct {
+	Seq uint64 `codec:"Seq"`
+	Msg []byte `codec:"Msg"`
+}
+
+// replayResp answers a replayReq.
+type replayResp struct {
+	Error string      `codec:"Error"`
+	Msgs  []replayMsg `codec:"Msgs"`
+}
+
+// Backfill asks a node to replay the messages from origin, sent with
+// BroadcastSequenced, with sequence numbers from first to last inclusive,
+// and delivers them to our Delegate as if they had been gossiped. It
+// returns how many were delivered, which can be fewer than asked for if
+// the node's log doesn't have them all, or has more than it replays at
+// once. The node's Delegate must implement ReplayDelegate.
+func (m *Memberlist) Backfill(node *Node, origin string, first, last uint64) (int, error) {
+	select {
+	case <-m.shutdownCh:
+		return 0, ErrShutdown
+	default:
+	}
+	if first == 0 || last < first {
+		return 0, fmt.Errorf("Invalid sequence range %d to %d", first, last)
+	}
+
+	addr := net.JoinHostPort(node.Addr.String(), strconv.Itoa(int(node.Port)))
+	msgs, err := m.fetchReplay(addr, &replayReq{Origin: origin, First: first, Last: last})
+	if err != nil {
+		return 0, err
+	}
+
+	d := m.config.Delegate
+	if d == nil {
+		return 0, nil
+	}
+	delivered := 0
+	for _, r := range msgs {
+		if r.Seq < first || r.Seq > last {
+			continue
+		}
+		seq, msg := r.Seq, r.Msg
+		m.dispatchDelegate("", "notify_msg", func() {
+			if sd, ok := d.(SequencedMsgDelegate); ok {
+				sd.NotifySequencedMsg(origin, seq, msg)
+			} else {
+				d.NotifyMsg(msg)
+			}
+		})
+		delivered++
+	}
+	return delivered, nil
+}
+
+// fetchReplay sends a replay request to the node listening at the given
+// address and returns the messages it sends back.
+func (m *Memberlist) fetchReplay(addr string, req *replayReq) ([]replayMsg, error) {
+	deadline := time.Now().Add(m.tune().TCPTimeout)
+	conn, err := m.dialTCP(addr, deadline)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if err := writeLabelHeaderToStream(conn, m.streamLabel(conn)); err != nil {
+		return nil, err
+	}
+
+	out, err := encode(replayReqMsg, req)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.rawSendMsgTCP(conn, out.Bytes()); err != nil {
+		return nil, err
+	}
+
+	msgType, _, dec, err := m.readTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msgType != replayRespMsg {
+		return nil, fmt.Errorf("Unexpected msgType (%d) from replay request %s", msgType, LogConn(conn))
+	}
+
+	var resp replayResp
+	if err := dec.Decode(&resp); err != nil {
+		return nil, err
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("Replay refused: %s", resp.Error)
+	}
+	return resp.Msgs, nil
+}
+
+// handleReplayReq answers a replay request read from a stream.
+func (m *Memberlist) handleReplayReq(conn net.Conn, dec *codec.Decoder) error {
+	var req replayReq
+	if err := dec.Decode(&req); err != nil {
+		return err
+	}
+
+	var resp replayResp
+	if rd, ok := m.config.Delegate.(ReplayDelegate); !ok {
+		resp.Error = "no replay log"
+	} else if req.First == 0 || req.Last < req.First {
+		resp.Error = "invalid sequence range"
+	} else {
+		var msgs []ReplayedMsg
+		runDelegate(m.logger, "replay", func() {
+			msgs = rd.Replay(req.Origin, req.First, req.Last)
+		})
+		size := 0
+		for _, r := range msgs {
+			size += len(r.Msg) + replayMsgOverhead
+			if len(resp.Msgs) == maxReplayMsgs || (len(resp.Msgs) > 0 && size > maxReplayBytes) {
+				break
+			}
+			resp.Msgs = append(resp.Msgs, replayMsg{Seq: r.Seq, Msg: r.Msg})
+		}
+	}
+
+	out, err := encode(replayRespMsg, &resp)
+	if err != nil {
+		return err
+	}
+	return m.rawSendMsgTCP(conn, out.Bytes())
+}
@@ -0,0 +1,163 @@
+package memberlist
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replayDelegate logs sequenced messages and replays them.
+type replayDelegate struct {
+	MockDelegate
+	sync.Mutex
+	log map[string][]ReplayedMsg
+}
+
+func (d *replayDelegate) NotifySequencedMsg(origin string, seq uint64, msg []byte) {
+	d.Lock()
+	defer d.Unlock()
+	if d.log == nil {
+		d.log = make(map[string][]ReplayedMsg)
+	}
+	cp := make([]byte, len(msg))
+	copy(cp, msg)
+	d.log[origin] = append(d.log[origin], ReplayedMsg{Seq: seq, Msg: cp})
+}
+
+func (d *replayDelegate) Replay(origin string, first, last uint64) []ReplayedMsg {
+	d.Lock()
+	defer d.Unlock()
+	var msgs []ReplayedMsg
+	for _, r := range d.log[origin] {
+		if r.Seq >= first && r.Seq <= last {
+			msgs = append(msgs, r)
+		}
+	}
+	return msgs
+}
+
+func (d *replayDelegate) seqs(origin string) []uint64 {
+	d.Lock()
+	defer d.Unlock()
+	var seqs []uint64
+	for _, r := range d.log[origin] {
+		seqs = append(seqs, r.Seq)
+	}
+	return seqs
+}
+
+func TestMemberlist_Backfill(t *testing.T) {
+	d1, d2 := &replayDelegate{}, &replayDelegate{}
+	c1 := testConfig()
+	c1.Delegate = d1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = c1.BindPort
+	c2.Delegate = d2
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	// m1 has a log with a gap in it.
+	for _, seq := range []uint64{1, 2, 4, 5} {
+		d1.NotifySequencedMsg("x", seq, []byte{byte(seq)})
+	}
+
+	n, err := m2.Backfill(m1.LocalNode(), "x", 2, 5)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("delivered %d", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(d2.seqs("x")) < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if seqs := d2.seqs("x"); !reflect.DeepEqual(seqs, []uint64{2, 4, 5}) {
+		t.Fatalf("bad: %v", seqs)
+	}
+	if d2.log["x"][0].Msg[0] != 2 {
+		t.Fatalf("bad: %v", d2.log["x"][0])
+	}
+
+	if n, err := m2.Backfill(m1.LocalNode(), "y", 1, 10); err != nil || n != 0 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if _, err := m2.Backfill(m1.LocalNode(), "x", 5, 2); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMemberlist_Backfill_NoLog(t *testing.T) {
+	c1 := testConfig()
+	c1.Delegate = &MockDelegate{}
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = c1.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Backfill(m1.LocalNode(), "x", 1, 2); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMemberlist_Backfill_ByteLimit(t *testing.T) {
+	d1 := &replayDelegate{}
+	c1 := testConfig()
+	c1.Delegate = d1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = c1.BindPort
+	c2.Delegate = &replayDelegate{}
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	msg := make([]byte, maxReplayBytes/4)
+	for seq := uint64(1); seq <= 6; seq++ {
+		d1.NotifySequencedMsg("x", seq, msg)
+	}
+
+	// Only as many as fit are sent, and the rest can be asked for again.
+	n, err := m2.Backfill(m1.LocalNode(), "x", 1, 6)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n != 3 {
+		t.Fatalf("delivered %d", n)
+	}
+	if n, err := m2.Backfill(m1.LocalNode(), "x", 4, 6); err != nil || n != 3 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+
+	// A message too big on its own is still sent.
+	d1.NotifySequencedMsg("y", 1, make([]byte, maxReplayBytes))
+	if n, err := m2.Backfill(m1.LocalNode(), "y", 1, 1); err != nil || n != 1 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Package ring maintains a consistent hash ring over the live members of a
+memberlist cluster.
+
+A Ring is a memberlist.EventDelegate, so it's kept up to date by installing
+it as Config.Events (or by feeding it events from your own delegate). Each
+member is placed on the ring many times as virtual nodes, which evens out
+the share of keys each member owns and limits how many keys move when
+members come and go.
+
+When members are spread across failure domains, such as racks or
+availability zones, a ZoneFunc lets GetN spread replicas of a key across as
+many zones as it can before placing two in the same zone.
+*/
+package ring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/hashicorp/memberlist"
+)
+
+// DefaultVirtualNodes is the number of points each member gets on the ring
+// if Config.VirtualNodes isn't set.
+const DefaultVirtualNodes = 128
+
+// Config configures a Ring.
+type Config struct {
+	// VirtualNodes is the number of points each member is given on the ring.
+	// More points spread keys more evenly at the cost of memory and slower
+	// membership changes.
+	VirtualNodes int
+
+	// ZoneFunc returns the zone a member is in, usually from its metadata.
+	// If nil, all members are in the same zone.
+	ZoneFunc func(*memberlist.Node) string
+
+	// HashFunc hashes keys and virtual node names onto the ring. If nil,
+	// 64-bit FNV-1a with a final mixing step is used. All members of a
+	// cluster must agree on it for their rings to agree.
+	HashFunc func([]byte) uint64
+}
+
+// point is a single virtual node on the ring.
+type point struct {
+	hash uint64
+	name string
+}
+
+// member is a node placed on the ring.
+type member struct {
+	node memberlist.Node
+	zone string
+}
+
+// Ring is a consistent hash ring. It's safe for concurrent use.
+type Ring struct {
+	config Config
+
+	l       sync.RWMutex
+	members map[string]*member
+	zones   map[string]int // Number of members in each zone
+	points  []point        // Sorted by hash, then name
+}
+
+// New returns an empty ring. A nil config uses the defaults.
+func New(conf *Config) *Ring {
+	r := &Ring{members: make(map[string]*member), zones: make(map[string]int)}
+	if conf != nil {
+		r.config = *conf
+	}
+	if r.config.VirtualNodes <= 0 {
+		r.config.VirtualNodes = DefaultVirtualNodes
+	}
+	if r.config.HashFunc == nil {
+		r.config.HashFunc = fnvHash
+	}
+	return r
+}
+
+// fnvHash is the default hash function. FNV alone leaves similar inputs,
+// like the names of a member's virtual nodes, bunched together, so the
+// result is run through the MurmurHash3 finalizer to spread it out.
+func fnvHash(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// NotifyJoin adds the node to the ring.
+func (r *Ring) NotifyJoin(n *memberlist.Node) {
+	r.Add(n)
+}
+
+// NotifyLeave removes the node from the ring.
+func (r *Ring) NotifyLeave(n *memberlist.Node) {
+	r.Remove(n.Name)
+}
+
+// NotifyUpdate refreshes the node's details, which may move it to a new
+// zone. Its place on the ring doesn't change.
+func (r *Ring) NotifyUpdate(n *memberlist.Node) {
+	r.Add(n)
+}
+
+// Add places a node on the ring, or updates it if it's already there.
+func (r *Ring) Add(n *memberlist.Node) {
+	// Take a copy, since memberlist may reuse the node it gave us.
+	m := &member{node: *n}
+	if r.config.ZoneFunc != nil {
+		m.zone = r.config.ZoneFunc(n)
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	old, exists := r.members[n.Name]
+	r.members[n.Name] = m
+	if exists {
+		r.removeZone(old.zone)
+	}
+	r.zones[m.zone]++
+	if exists {
+		return
+	}
+
+	for i := 0; i < r.config.VirtualNodes; i++ {
+		r.points = append(r.points, point{r.vnodeHash(n.Name, i), n.Name})
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].name < r.points[j].name
+	})
+}
+
+// vnodeHash returns where the given virtual node of a member sits.
+func (r *Ring) vnodeHash(name string, i int) uint64 {
+	return r.config.HashFunc([]byte(name + "#" + strconv.Itoa(i)))
+}
+
+// removeZone counts a member out of the given zone. The lock must be held.
+func (r *Ring) removeZone(zone string) {
+	if r.zones[zone]--; r.zones[zone] <= 0 {
+		delete(r.zones, zone)
+	}
+}
+
+// Remove takes a node off the ring.
+func (r *Ring) Remove(name string) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	m, ok := r.members[name]
+	if !ok {
+		return
+	}
+	delete(r.members, name)
+	r.removeZone(m.zone)
+
+	n := 0
+	for _, p := range r.points {
+		if p.name != name {
+			r.points[n] = p
+			n++
+		}
+	}
+	r.points = r.points[:n]
+}
+
+// Len returns the number of members on the ring.
+func (r *Ring) Len() int {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	return len(r.members)
+}
+
+// Members returns the members on the ring, in no particular order.
+func (r *Ring) Members() []*memberlist.Node {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	nodes := make([]*memberlist.Node, 0, len(r.members))
+	for _, m := range r.members {
+		node := m.node
+		nodes = append(nodes, &node)
+	}
+	return nodes
+}
+
+// Get returns the member that owns the given key, or nil if the ring is
+// empty.
+func (r *Ring) Get(key []byte) *memberlist.Node {
+	nodes := r.GetN(key, 1)
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[0]
+}
+
+// GetN returns up to n distinct members for the given key, starting with
+// its owner and walking clockwise around the ring. Members in zones that
+// haven't been used yet are picked first, so replicas land in as many
+// zones as possible; once every zone has been used the remaining members
+// are taken in ring order.
+func (r *Ring) GetN(key []byte, n int) []*memberlist.Node {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	// Find the first point at or after the key's hash, wrapping around.
+	hash := r.config.HashFunc(key)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+
+	// Walk the ring, taking members from new zones as we find them. We can
+	// stop once we've picked n, or once every zone has been used and we've
+	// passed enough members to fill up the rest in ring order.
+	picked := make([]*member, 0, n)
+	order := make([]*member, 0, n)
+	seen := make(map[string]struct{}, n)
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if _, ok := seen[p.name]; ok {
+			continue
+		}
+		seen[p.name] = struct{}{}
+		m := r.members[p.name]
+		order = append(order, m)
+
+		if !zoneUsed(picked, m.zone) {
+			picked = append(picked, m)
+			if len(picked) == n {
+				break
+			}
+		}
+		if len(picked) == len(r.zones) && len(order) >= n {
+			break
+		}
+	}
+
+	// Fill up with the members we passed over, in ring order.
+	for _, m := range order {
+		if len(picked) == n {
+			break
+		}
+		if !contains(picked, m) {
+			picked = append(picked, m)
+		}
+	}
+
+	nodes := make([]*memberlist.Node, len(picked))
+	for i, m := range picked {
+		node := m.node
+		nodes[i] = &node
+	}
+	return nodes
+}
+
+// zoneUsed returns true if one of the members is in the given zone.
+func zoneUsed(members []*member, zone string) bool {
+	for _, m := range members {
+		if m.zone == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// contains returns true if the member is in the list.
+func contains(members []*member, m *member) bool {
+	for _, other := range members {
+		if other == m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,240 @@
+package ring
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/memberlist"
+)
+
+func testRing(names ...string) *Ring {
+	r := New(nil)
+	for _, name := range names {
+		r.NotifyJoin(&memberlist.Node{Name: name})
+	}
+	return r
+}
+
+func TestRing_Empty(t *testing.T) {
+	r := New(nil)
+	if n := r.Get([]byte("key")); n != nil {
+		t.Fatalf("bad: %v", n)
+	}
+	if nodes := r.GetN([]byte("key"), 3); len(nodes) != 0 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestRing_Get(t *testing.T) {
+	r := testRing("a", "b", "c")
+	if r.Len() != 3 || len(r.Members()) != 3 {
+		t.Fatalf("bad len")
+	}
+
+	// Keys always map to the same owner, and every member owns some.
+	owners := make(map[string]int)
+	for i := 0; i < 3000; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		n := r.Get(key)
+		if n == nil {
+			t.Fatalf("no owner for %s", key)
+		}
+		if again := r.Get(key); again.Name != n.Name {
+			t.Fatalf("owner changed: %s != %s", again.Name, n.Name)
+		}
+		owners[n.Name]++
+	}
+	for _, name := range []string{"a", "b", "c"} {
+		if owners[name] < 500 {
+			t.Fatalf("uneven spread: %v", owners)
+		}
+	}
+}
+
+func TestRing_Remove(t *testing.T) {
+	r := testRing("a", "b", "c")
+
+	before := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		before[key] = r.Get([]byte(key)).Name
+	}
+
+	r.NotifyLeave(&memberlist.Node{Name: "b"})
+	if r.Len() != 2 {
+		t.Fatalf("bad len")
+	}
+
+	// Only the keys owned by the departed member move.
+	for key, owner := range before {
+		now := r.Get([]byte(key)).Name
+		if now == "b" {
+			t.Fatalf("key %s still owned by removed member", key)
+		}
+		if owner != "b" && now != owner {
+			t.Fatalf("key %s moved from %s to %s", key, owner, now)
+		}
+	}
+
+	// Removing an unknown member is a no-op.
+	r.Remove("nope")
+	if r.Len() != 2 {
+		t.Fatalf("bad len")
+	}
+}
+
+func TestRing_GetN(t *testing.T) {
+	r := testRing("a", "b", "c", "d")
+
+	nodes := r.GetN([]byte("key"), 3)
+	if len(nodes) != 3 {
+		t.Fatalf("bad: %v", nodes)
+	}
+	if nodes[0].Name != r.Get([]byte("key")).Name {
+		t.Fatalf("first node should be the owner")
+	}
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if seen[n.Name] {
+			t.Fatalf("duplicate node %s", n.Name)
+		}
+		seen[n.Name] = true
+	}
+
+	if nodes := r.GetN([]byte("key"), 10); len(nodes) != 4 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+func TestRing_Zones(t *testing.T) {
+	r := New(&Config{
+		VirtualNodes: 16,
+		ZoneFunc: func(n *memberlist.Node) string {
+			return string(n.Meta)
+		},
+	})
+	r.NotifyJoin(&memberlist.Node{Name: "a1", Meta: []byte("a")})
+	r.NotifyJoin(&memberlist.Node{Name: "a2", Meta: []byte("a")})
+	r.NotifyJoin(&memberlist.Node{Name: "a3", Meta: []byte("a")})
+	r.NotifyJoin(&memberlist.Node{Name: "b1", Meta: []byte("b")})
+	r.NotifyJoin(&memberlist.Node{Name: "c1", Meta: []byte("c")})
+
+	for i := 0; i < 100; i++ {
+		nodes := r.GetN([]byte(fmt.Sprintf("key%d", i)), 3)
+		zones := make(map[string]bool)
+		for _, n := range nodes {
+			zones[string(n.Meta)] = true
+		}
+		if len(zones) != 3 {
+			t.Fatalf("replicas not spread across zones: %v", nodes)
+		}
+	}
+
+	// With more replicas than zones, the rest are filled in.
+	if nodes := r.GetN([]byte("key"), 5); len(nodes) != 5 {
+		t.Fatalf("bad: %v", nodes)
+	}
+
+	// Updates can move a member to another zone.
+	r.NotifyUpdate(&memberlist.Node{Name: "b1", Meta: []byte("a")})
+	nodes := r.GetN([]byte("key"), 3)
+	zones := make(map[string]bool)
+	for _, n := range nodes {
+		zones[string(n.Meta)] = true
+	}
+	if len(zones) != 2 || r.Len() != 5 {
+		t.Fatalf("bad: %v", nodes)
+	}
+}
+
+// fullWalkGetN is GetN done the long way, walking the whole ring, to check
+// that stopping early picks the same members.
+func fullWalkGetN(r *Ring, key []byte, n int) []string {
+	r.l.RLock()
+	defer r.l.RUnlock()
+	if n > len(r.members) {
+		n = len(r.members)
+	}
+	hash := r.config.HashFunc(key)
+	start := 0
+	for start < len(r.points) && r.points[start].hash < hash {
+		start++
+	}
+
+	var order []*member
+	seen := make(map[string]bool)
+	for i := 0; i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.name] {
+			seen[p.name] = true
+			order = append(order, r.members[p.name])
+		}
+	}
+	var picked []string
+	used := make(map[string]bool)
+	zones := make(map[string]bool)
+	for _, m := range order {
+		if len(picked) < n && !zones[m.zone] {
+			zones[m.zone] = true
+			used[m.node.Name] = true
+			picked = append(picked, m.node.Name)
+		}
+	}
+	for _, m := range order {
+		if len(picked) < n && !used[m.node.Name] {
+			picked = append(picked, m.node.Name)
+		}
+	}
+	return picked
+}
+
+func TestRing_GetN_StopsEarly(t *testing.T) {
+	r := New(&Config{
+		VirtualNodes: 16,
+		ZoneFunc: func(n *memberlist.Node) string {
+			return string(n.Meta)
+		},
+	})
+	for i := 0; i < 20; i++ {
+		zone := "a"
+		if i%7 == 0 {
+			zone = fmt.Sprintf("z%d", i)
+		}
+		r.NotifyJoin(&memberlist.Node{Name: fmt.Sprintf("node%d", i), Meta: []byte(zone)})
+	}
+	r.NotifyUpdate(&memberlist.Node{Name: "node7", Meta: []byte("a")})
+	r.NotifyLeave(&memberlist.Node{Name: "node14"})
+	if len(r.zones) != 2 {
+		t.Fatalf("bad zones: %v", r.zones)
+	}
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		for _, n := range []int{1, 2, 3, 5, 19, 25} {
+			want := fullWalkGetN(r, key, n)
+			got := r.GetN(key, n)
+			if len(got) != len(want) {
+				t.Fatalf("%s/%d: expected %v, got %v", key, n, want, got)
+			}
+			for j := range want {
+				if got[j].Name != want[j] {
+					t.Fatalf("%s/%d: expected %v, got %v", key, n, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestRing_CopiesNodes(t *testing.T) {
+	r := New(nil)
+	n := &memberlist.Node{Name: "a", Port: 1}
+	r.NotifyJoin(n)
+	n.Port = 2
+	if got := r.Get([]byte("key")); got.Port != 1 {
+		t.Fatalf("ring should hold its own copy")
+	}
+}
+
+func TestRing_Events(t *testing.T) {
+	var _ memberlist.EventDelegate = New(nil)
+}
@@ -0,0 +1,149 @@
+package memberlist
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Rolling upgrades are safe when a feature is only switched on once every
+member understands it. Each member advertises the range of protocol and
+delegate protocol versions it understands, so a capability is just a
+minimum on each: a cluster supports it once every member that isn't dead
+advertises at least those maxima.
+
+ProtocolVersions reports how the members are spread across versions, for
+watching an upgrade's progress, and WaitForCapability blocks until the
+whole cluster supports a capability, so that switching a feature on can
+follow the upgrade automatically. Applications describe their own
+features with a minimum delegate protocol version.
+
+Support is checked against the members we know of at the time. A member
+running an older version can still join later, so features that must
+never meet an old member should also be refused at merge time, with a
+MergeIdentityDelegate.
+*/
+
+// Capability is a feature that needs every member to understand at least
+// the given protocol and delegate protocol versions.
+type Capability struct {
+	Name        string
+	MinProtocol uint8
+	MinDelegate uint8
+}
+
+// Capabilities that come with protocol versions.
+var (
+	CapabilityTCPPing   = Capability{Name: "tcp_ping", MinProtocol: 3}
+	CapabilityNack      = Capability{Name: "nack", MinProtocol: 4}
+	CapabilityCompound2 = Capability{Name: "compound2", MinProtocol: 5}
+	CapabilityLeaveAck  = Capability{Name: "leave_ack", MinProtocol: 6}
+)
+
+// builtinCapabilities are reported by ProtocolVersions.
+var builtinCapabilities = []Capability{CapabilityTCPPing, CapabilityNack, CapabilityCompound2, CapabilityLeaveAck}
+
+// supportedBy returns true if a node understands the capability.
+func (c Capability) supportedBy(n *nodeState) bool {
+	return n.PMax >= c.MinProtocol && n.DMax >= c.MinDelegate
+}
+
+// VersionReport describes the protocol versions understood across the
+// members that aren't dead, including us.
+type VersionReport struct {
+	Members int
+
+	// Protocol and Delegate count members by the highest protocol and
+	// delegate protocol version they understand.
+	Protocol map[uint8]int
+	Delegate map[uint8]int
+
+	// MinProtocol and MinDelegate are the lowest of those, which is the
+	// newest version every member understands.
+	MinProtocol uint8
+	MinDelegate uint8
+
+	// Capabilities counts the members supporting each built-in
+	// capability, by name.
+	Capabilities map[string]int
+}
+
+// ProtocolVersions reports the protocol versions understood across the
+// cluster.
+func (m *Memberlist) ProtocolVersions() VersionReport {
+	r := VersionReport{
+		Protocol:     make(map[uint8]int),
+		Delegate:     make(map[uint8]int),
+		Capabilities: make(map[string]int),
+	}
+
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	for _, n := range m.nodes {
+		if n.State == stateDead {
+			continue
+		}
+		if r.Members == 0 || n.PMax < r.MinProtocol {
+			r.MinProtocol = n.PMax
+		}
+		if r.Members == 0 || n.DMax < r.MinDelegate {
+			r.MinDelegate = n.DMax
+		}
+		r.Members++
+		r.Protocol[n.PMax]++
+		r.Delegate[n.DMax]++
+		for _, c := range builtinCapabilities {
+			if c.supportedBy(n) {
+				r.Capabilities[c.Name]++
+			}
+		}
+	}
+	return r
+}
+
+// ClusterSupports returns true if every member that isn't dead supports
+// the capability, along with the names of any that don't.
+func (m *Memberlist) ClusterSupports(c Capability) (bool, []string) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	var lacking []string
+	for _, n := range m.nodes {
+		if n.State != stateDead && !c.supportedBy(n) {
+			lacking = append(lacking, n.Name)
+		}
+	}
+	return len(lacking) == 0, lacking
+}
+
+// WaitForCapability blocks until every member that isn't dead supports
+// the capability, checking every GossipInterval, so that a feature can be
+// switched on as soon as a rolling upgrade completes. A timeout of zero
+// waits for as long as it takes. If the timeout passes first, the error
+// names the members holding it up.
+func (m *Memberlist) WaitForCapability(c Capability, timeout time.Duration) error {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timeoutCh = time.After(timeout)
+	}
+	interval := m.config.GossipInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		ok, lacking := m.ClusterSupports(c)
+		if ok {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-timeoutCh:
+			return fmt.Errorf("Timed out waiting for %d members to support %s: %v", len(lacking), c.Name, lacking)
+		case <-m.shutdownCh:
+			return ErrShutdown
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package memberlist
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func rolloutTestNode(m *Memberlist, name string, pmax, dmax uint8) {
+	a := alive{
+		Node:        name,
+		Addr:        []byte{127, 0, 0, 1},
+		Port:        7946,
+		Incarnation: 1,
+		Vsn:         []uint8{ProtocolVersionMin, pmax, ProtocolVersionMin, 0, dmax, 0},
+	}
+	m.aliveNode(&a, nil, false)
+}
+
+func TestMemberlist_ProtocolVersions(t *testing.T) {
+	c := testConfig()
+	c.DelegateProtocolMax = 2
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	rolloutTestNode(m, "old", 3, 1)
+	rolloutTestNode(m, "new", ProtocolVersionMax, 2)
+	rolloutTestNode(m, "gone", 2, 0)
+	m.deadNode(&dead{Node: "gone", Incarnation: 1, From: c.Name})
+
+	r := m.ProtocolVersions()
+	if r.Members != 3 {
+		t.Fatalf("bad members: %d", r.Members)
+	}
+	if r.Protocol[3] != 1 || r.Protocol[ProtocolVersionMax] != 2 {
+		t.Fatalf("bad protocols: %v", r.Protocol)
+	}
+	if r.Delegate[1] != 1 || r.Delegate[2] != 2 {
+		t.Fatalf("bad delegates: %v", r.Delegate)
+	}
+	if r.MinProtocol != 3 || r.MinDelegate != 1 {
+		t.Fatalf("bad minimums: %d %d", r.MinProtocol, r.MinDelegate)
+	}
+	if r.Capabilities["tcp_ping"] != 3 || r.Capabilities["nack"] != 2 {
+		t.Fatalf("bad capabilities: %v", r.Capabilities)
+	}
+}
+
+func TestMemberlist_WaitForCapability(t *testing.T) {
+	c := testConfig()
+	c.GossipInterval = time.Millisecond
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	rolloutTestNode(m, "old", 3, 0)
+	if ok, lacking := m.ClusterSupports(CapabilityNack); ok || len(lacking) != 1 || lacking[0] != "old" {
+		t.Fatalf("bad: %v %v", ok, lacking)
+	}
+	err = m.WaitForCapability(CapabilityNack, 10*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "old") {
+		t.Fatalf("expected timeout naming old, got %v", err)
+	}
+
+	// Upgrading the last member lets the wait finish.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- m.WaitForCapability(CapabilityNack, 0)
+	}()
+	a := alive{
+		Node:        "old",
+		Addr:        []byte{127, 0, 0, 1},
+		Port:        7946,
+		Incarnation: 2,
+		Vsn:         []uint8{ProtocolVersionMin, ProtocolVersionMax, ProtocolVersionMin, 0, 0, 0},
+	}
+	m.aliveNode(&a, nil, false)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out")
+	}
+
+	// Application capabilities use the delegate protocol.
+	feature := Capability{Name: "feature", MinDelegate: 1}
+	if ok, _ := m.ClusterSupports(feature); ok {
+		t.Fatalf("should not be supported")
+	}
+}
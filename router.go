@@ -0,0 +1,372 @@
+package memberlist
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+// routerPeekTimeout bounds how long the router will wait for a new stream
+// to present its label header before giving up on it.
+const routerPeekTimeout = 10 * time.Second
+
+// routerQueueDepth is how many packets the router holds for each instance
+// while it's busy with earlier ones.
+const routerQueueDepth = 1024
+
+// Router allows several memberlist instances, each belonging to a different
+// logical cluster, to share a single UDP and TCP port. Every instance must
+// be configured with a distinct, non-empty Label, and should use its own
+// Keyring so the namespaces are separated cryptographically as well as by
+// label. Traffic carrying an unknown label, or no label at all, is dropped
+// by the router before it reaches any instance's state machine.
+//
+// The router only reads each packet's label before queueing it for its
+// instance, and every instance works through its own queue, so a busy
+// cluster can't hold up another's probes and acks: once its queue is full
+// its own packets are dropped, while the others' keep flowing. Stats
+// reports the traffic carried and dropped for each instance.
+//
+// To use a router, create it with NewRouter and set Config.Router before
+// calling Create. The router must outlive the instances registered on it.
+type Router struct {
+	udpListener *net.UDPConn
+	tcpListener *net.TCPListener
+
+	lock      sync.RWMutex
+	instances map[string]*routerInstance // Maps Label -> instance
+
+	shutdown   bool
+	shutdownCh chan struct{}
+
+	logger *log.Logger
+}
+
+// NewRouter creates the shared network listeners on the given address and
+// port. A port of zero will pick a free port, which can be retrieved via
+// Addr. If logger is nil, logs will go to stderr.
+func NewRouter(bindAddr string, bindPort int, logger *log.Logger) (*Router, error) {
+	tcpAddr := &net.TCPAddr{IP: net.ParseIP(bindAddr), Port: bindPort}
+	tcpLn, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to start TCP listener. Err: %s", err)
+	}
+	if bindPort == 0 {
+		bindPort = tcpLn.Addr().(*net.TCPAddr).Port
+	}
+
+	udpAddr := &net.UDPAddr{IP: net.ParseIP(bindAddr), Port: bindPort}
+	udpLn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		tcpLn.Close()
+		return nil, fmt.Errorf("Failed to start UDP listener. Err: %s", err)
+	}
+
+	// Set the UDP receive window size
+	setUDPRecvBuf(udpLn)
+
+	if logger == nil {
+		logger = log.New(os.Stderr, "", log.LstdFlags)
+	}
+
+	r := &Router{
+		udpListener: udpLn,
+		tcpListener: tcpLn,
+		instances:   make(map[string]*routerInstance),
+		shutdownCh:  make(chan struct{}),
+		logger:      logger,
+	}
+	go r.tcpListen()
+	go r.udpListen()
+	return r, nil
+}
+
+// Addr returns the address the router's listeners are bound to.
+func (r *Router) Addr() *net.TCPAddr {
+	return r.tcpListener.Addr().(*net.TCPAddr)
+}
+
+// Labels returns the labels of all the instances currently registered.
+func (r *Router) Labels() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	labels := make([]string, 0, len(r.instances))
+	for label := range r.instances {
+		labels = append(labels, label)
+	}
+	return labels
+}
+
+// RouterStats is the traffic a router has carried for one instance.
+type RouterStats struct {
+	PacketsIn  uint64
+	BytesIn    uint64
+	PacketsOut uint64
+	BytesOut   uint64
+
+	// Dropped is the number of packets dropped because the instance was
+	// too far behind with its queue.
+	Dropped uint64
+
+	// Streams is the number of incoming streams handed to the instance.
+	Streams uint64
+}
+
+// Stats returns the traffic carried for each instance registered, by the
+// instance's Label.
+func (r *Router) Stats() map[string]RouterStats {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	stats := make(map[string]RouterStats)
+	for _, inst := range r.instances {
+		stats[inst.m.config.Label] = inst.stats()
+	}
+	return stats
+}
+
+// Shutdown closes the shared listeners. Any instances still registered will
+// no longer receive traffic, so they should be shut down first.
+//
+// This method is safe to call multiple times.
+func (r *Router) Shutdown() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.shutdown {
+		return nil
+	}
+
+	r.shutdown = true
+	close(r.shutdownCh)
+	r.udpListener.Close()
+	r.tcpListener.Close()
+	return nil
+}
+
+// register adds an instance to the router under its configured label, and
+// any others it accepts.
+func (r *Router) register(m *Memberlist) error {
+	labels := append([]string{m.config.Label}, m.config.AcceptLabels...)
+	for _, label := range labels {
+		if label == "" {
+			return fmt.Errorf("A label is required to share a router")
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.shutdown {
+		return fmt.Errorf("Router is shut down")
+	}
+	for _, label := range labels {
+		if _, ok := r.instances[label]; ok {
+			return fmt.Errorf("Label '%s' is already registered with the router", label)
+		}
+	}
+	inst := &routerInstance{
+		m:      m,
+		queue:  make(chan routedPacket, routerQueueDepth),
+		stopCh: make(chan struct{}),
+	}
+	for _, label := range labels {
+		r.instances[label] = inst
+	}
+	m.routed = inst
+	go inst.run()
+	return nil
+}
+
+// deregister removes an instance from the router. Packets still queued for
+// it are dropped.
+func (r *Router) deregister(m *Memberlist) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for label, inst := range r.instances {
+		if inst.m == m {
+			delete(r.instances, label)
+		}
+	}
+	if m.routed != nil {
+		close(m.routed.stopCh)
+	}
+}
+
+// lookup returns the instance registered under the given label, if any.
+func (r *Router) lookup(label string) (*routerInstance, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	inst, ok := r.instances[label]
+	return inst, ok
+}
+
+// isShutdown is used to check if the router has been shut down.
+func (r *Router) isShutdown() bool {
+	select {
+	case <-r.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// tcpListen listens for incoming connections and hands them off to the
+// instance that owns their label.
+func (r *Router) tcpListen() {
+	for {
+		conn, err := r.tcpListener.AcceptTCP()
+		if err != nil {
+			if r.isShutdown() {
+				break
+			}
+			r.logger.Printf("[ERR] memberlist: Error accepting TCP connection: %s", err)
+			continue
+		}
+		go r.handleConn(conn)
+	}
+}
+
+// handleConn reads the label header of a new stream and passes the stream
+// on to the right instance, or closes it.
+func (r *Router) handleConn(conn *net.TCPConn) {
+	conn.SetDeadline(time.Now().Add(routerPeekTimeout))
+	pc, label, _, err := peekLabelFromStream(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	inst, ok := r.lookup(label)
+	if !ok {
+		metrics.IncrCounter([]string{"memberlist", "router", "tcp", "dropped"}, 1)
+		r.logger.Printf("[WARN] memberlist: Router dropping stream with unknown label '%s' %s", label, LogConn(conn))
+		conn.Close()
+		return
+	}
+
+	// The instance verifies and strips the label itself, so it's safe to
+	// hand over the stream as-is.
+	atomic.AddUint64(&inst.streams, 1)
+	inst.m.handleConn(pc)
+}
+
+// udpListen reads packets off the shared socket and hands them off to the
+// instance that owns their label.
+func (r *Router) udpListen() {
+	for {
+		// Create a new buffer
+		buf := make([]byte, udpBufSize)
+
+		// Read a packet
+		n, addr, err := r.udpListener.ReadFrom(buf)
+		if err != nil {
+			if r.isShutdown() {
+				break
+			}
+			r.logger.Printf("[ERR] memberlist: Error reading UDP packet: %s", err)
+			continue
+		}
+
+		// Capture the reception time of the packet as close to the
+		// system calls as possible.
+		timestamp := time.Now()
+
+		// Check the length
+		if n < 1 {
+			r.logger.Printf("[ERR] memberlist: UDP packet too short (%d bytes) %s",
+				len(buf), LogAddress(addr))
+			continue
+		}
+
+		label, _, err := peekLabelFromPacket(buf[:n])
+		if err != nil {
+			r.logger.Printf("[ERR] memberlist: Router failed to read packet label: %v %s", err, LogAddress(addr))
+			continue
+		}
+
+		inst, ok := r.lookup(label)
+		if !ok {
+			metrics.IncrCounter([]string{"memberlist", "router", "udp", "dropped"}, 1)
+			continue
+		}
+		inst.enqueue(routedPacket{buf[:n], addr, timestamp})
+	}
+}
+
+// routedPacket is a packet waiting for its instance.
+type routedPacket struct {
+	buf       []byte
+	from      net.Addr
+	timestamp time.Time
+}
+
+// routerInstance is an instance registered with a router, along with its
+// queue of packets and the traffic carried for it.
+type routerInstance struct {
+	// These are updated atomically, so they come first to keep them
+	// aligned on 32-bit platforms.
+	packetsIn  uint64
+	bytesIn    uint64
+	packetsOut uint64
+	bytesOut   uint64
+	dropped    uint64
+	streams    uint64
+
+	m      *Memberlist
+	queue  chan routedPacket
+	stopCh chan struct{}
+}
+
+// enqueue queues a packet for the instance, dropping it if the instance is
+// too far behind.
+func (inst *routerInstance) enqueue(p routedPacket) {
+	select {
+	case inst.queue <- p:
+		atomic.AddUint64(&inst.packetsIn, 1)
+		atomic.AddUint64(&inst.bytesIn, uint64(len(p.buf)))
+	default:
+		atomic.AddUint64(&inst.dropped, 1)
+		metrics.IncrCounter([]string{"memberlist", "router", "udp", "queue_full"}, 1)
+	}
+}
+
+// sent records a packet the instance sent through the router's socket.
+func (inst *routerInstance) sent(n int) {
+	atomic.AddUint64(&inst.packetsOut, 1)
+	atomic.AddUint64(&inst.bytesOut, uint64(n))
+}
+
+// run hands queued packets to the instance until it's deregistered.
+func (inst *routerInstance) run() {
+	for {
+		select {
+		case p := <-inst.queue:
+			metrics.IncrCounter([]string{"memberlist", "udp", "received"}, float32(len(p.buf)))
+			inst.m.ingestPacket(p.buf, p.from, p.timestamp)
+		case <-inst.stopCh:
+			return
+		}
+	}
+}
+
+// stats returns the traffic carried for the instance.
+func (inst *routerInstance) stats() RouterStats {
+	return RouterStats{
+		PacketsIn:  atomic.LoadUint64(&inst.packetsIn),
+		BytesIn:    atomic.LoadUint64(&inst.bytesIn),
+		PacketsOut: atomic.LoadUint64(&inst.packetsOut),
+		BytesOut:   atomic.LoadUint64(&inst.bytesOut),
+		Dropped:    atomic.LoadUint64(&inst.dropped),
+		Streams:    atomic.LoadUint64(&inst.streams),
+	}
+}
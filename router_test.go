@@ -0,0 +1,205 @@
+package memberlist
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRouter_SharedPort(t *testing.T) {
+	r1, err := NewRouter(getBindAddr().String(), 0, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r1.Shutdown()
+
+	r2, err := NewRouter(getBindAddr().String(), r1.Addr().Port, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r2.Shutdown()
+
+	// Set up two clusters, each with one member on each router.
+	blueKey := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	greenKey := []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	create := func(r *Router, name, label string, key []byte) *Memberlist {
+		c := DefaultLANConfig()
+		c.Name = name
+		c.Label = label
+		c.SecretKey = key
+		c.Router = r
+		c.ProbeInterval = 50 * time.Millisecond
+		c.GossipInterval = 10 * time.Millisecond
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return m
+	}
+	blue1 := create(r1, "blue1", "blue", blueKey)
+	defer blue1.Shutdown()
+	blue2 := create(r2, "blue2", "blue", blueKey)
+	defer blue2.Shutdown()
+	green1 := create(r1, "green1", "green", greenKey)
+	defer green1.Shutdown()
+	green2 := create(r2, "green2", "green", greenKey)
+	defer green2.Shutdown()
+
+	if len(r1.Labels()) != 2 {
+		t.Fatalf("bad: %v", r1.Labels())
+	}
+
+	// Registering the same label twice isn't allowed.
+	c := DefaultLANConfig()
+	c.Name = "blue3"
+	c.Label = "blue"
+	c.Router = r1
+	if _, err := Create(c); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	if _, err := blue2.Join([]string{r1.Addr().String()}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := green2.Join([]string{r1.Addr().String()}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Let a few rounds of probes and gossip go by.
+	time.Sleep(250 * time.Millisecond)
+
+	for _, m := range []*Memberlist{blue1, blue2, green1, green2} {
+		members := m.Members()
+		if len(members) != 2 {
+			t.Fatalf("%s: bad: %v", m.config.Name, members)
+		}
+		for _, n := range members {
+			if n.Name[:len(m.config.Label)] != m.config.Label {
+				t.Fatalf("%s: leaked member %s", m.config.Name, n.Name)
+			}
+		}
+	}
+
+	// An unlabeled instance can't get in through the router.
+	plain := testConfig()
+	plain.BindPort = r1.Addr().Port
+	m, err := Create(plain)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+	if _, err := m.Join([]string{r1.Addr().String()}); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Shutting down an instance releases its label but not the port.
+	blue1.Shutdown()
+	if len(r1.Labels()) != 1 {
+		t.Fatalf("bad: %v", r1.Labels())
+	}
+	if _, err := green2.Join([]string{r1.Addr().String()}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRouter_AcceptLabels(t *testing.T) {
+	r, err := NewRouter(getBindAddr().String(), 0, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+
+	c := DefaultLANConfig()
+	c.Name = "blue1"
+	c.Label = "blue"
+	c.AcceptLabels = []string{"azure"}
+	c.Router = r
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got, ok := r.lookup("azure"); !ok || got.m != m {
+		t.Fatalf("should be registered under azure")
+	}
+
+	// An unlabelled accept can't be routed.
+	c = DefaultLANConfig()
+	c.Name = "green1"
+	c.Label = "green"
+	c.AcceptLabels = []string{""}
+	c.Router = r
+	if _, err := Create(c); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	m.Shutdown()
+	if len(r.Labels()) != 0 {
+		t.Fatalf("bad: %v", r.Labels())
+	}
+}
+
+func TestRouter_Fairness(t *testing.T) {
+	r, err := NewRouter(getBindAddr().String(), 0, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Shutdown()
+
+	create := func(name, label string) *Memberlist {
+		c := DefaultLANConfig()
+		c.Name = name
+		c.Label = label
+		c.Router = r
+		c.MisbehaviorThreshold = 100
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return m
+	}
+	busy := create("busy1", "busy")
+	defer busy.Shutdown()
+	quiet := create("quiet1", "quiet")
+	defer quiet.Shutdown()
+
+	// A peer of the quiet cluster with its own port.
+	c := testConfig()
+	c.Label = "quiet"
+	peer, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer peer.Shutdown()
+
+	// Stall the busy instance, and flood it with more than it can queue.
+	busy.misbehavior.Lock()
+	defer busy.misbehavior.Unlock()
+	flood, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer flood.Close()
+	packet := addLabelHeaderToPacket([]byte{byte(userMsg), 'x'}, "busy")
+	to := &net.UDPAddr{IP: r.Addr().IP, Port: r.Addr().Port}
+	for i := 0; i < 2*routerQueueDepth; i++ {
+		if _, err := flood.WriteTo(packet, to); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	// The quiet cluster's probes still get through.
+	addr := &net.UDPAddr{IP: net.ParseIP(c.BindAddr), Port: c.BindPort}
+	if _, err := quiet.Ping(peer.config.Name, addr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stats := r.Stats()
+	if s := stats["busy"]; s.Dropped == 0 || s.PacketsIn > routerQueueDepth+1 {
+		t.Fatalf("bad: %#v", s)
+	}
+	// The peer may gossip to the quiet instance once it's heard from it,
+	// so there can be more than the ack.
+	if s := stats["quiet"]; s.PacketsIn == 0 || s.PacketsOut == 0 || s.Dropped != 0 {
+		t.Fatalf("bad: %#v", s)
+	}
+}
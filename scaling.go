@@ -0,0 +1,83 @@
+package memberlist
+
+import (
+	"sync"
+
+	"github.com/armon/go-metrics"
+)
+
+const (
+	// scaleBaseNodes is the cluster size at which the multipliers are first
+	// raised when AdaptiveMultipliers is set. They're raised again every
+	// time the cluster grows tenfold from there.
+	scaleBaseNodes = 100
+
+	// scaleHysteresis is the fraction of a boundary the cluster has to
+	// shrink below before the multipliers are lowered again.
+	scaleHysteresis = 0.8
+)
+
+// scaleState tracks how far the multipliers have been raised above the
+// configured ones.
+type scaleState struct {
+	sync.Mutex
+	step int
+}
+
+// scaleBoundary returns the cluster size at which the given step is reached.
+func scaleBoundary(step int) int {
+	boundary := scaleBaseNodes
+	for i := 1; i < step; i++ {
+		boundary *= 10
+	}
+	return boundary
+}
+
+// scaleStep returns the step to use for a cluster of n nodes, moving on
+// from the current one.
+func scaleStep(n, step int) int {
+	for n >= scaleBoundary(step+1) {
+		step++
+	}
+	for step > 0 && float64(n) < scaleHysteresis*float64(scaleBoundary(step)) {
+		step--
+	}
+	return step
+}
+
+// rescale is invoked when the number of nodes changes, to adapt the
+// multipliers to the new size of the cluster.
+func (m *Memberlist) rescale() {
+	if !m.config.AdaptiveMultipliers {
+		return
+	}
+
+	n := m.estNumNodes()
+	m.scale.Lock()
+	defer m.scale.Unlock()
+
+	step := scaleStep(n, m.scale.step)
+	if step == m.scale.step {
+		return
+	}
+	m.scale.step = step
+
+	retransmit := m.tune().RetransmitMult + step
+	suspicion := m.tune().SuspicionMult + step
+	m.broadcasts.Lock()
+	m.broadcasts.RetransmitMult = retransmit
+	m.broadcasts.Unlock()
+
+	m.logger.Printf("[INFO] memberlist: Cluster has %d nodes, using retransmit multiplier %d and suspicion multiplier %d",
+		n, retransmit, suspicion)
+	metrics.SetGauge([]string{"memberlist", "scale", "retransmit_mult"}, float32(retransmit))
+	metrics.SetGauge([]string{"memberlist", "scale", "suspicion_mult"}, float32(suspicion))
+}
+
+// suspicionMult returns the suspicion multiplier for the current size of
+// the cluster.
+func (m *Memberlist) suspicionMult() int {
+	m.scale.Lock()
+	defer m.scale.Unlock()
+	return m.tune().SuspicionMult + m.scale.step
+}
@@ -0,0 +1,81 @@
+package memberlist
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestScaleStep(t *testing.T) {
+	cases := []struct {
+		n, step, expected int
+	}{
+		{10, 0, 0},
+		{99, 0, 0},
+		{100, 0, 1},
+		{999, 0, 1},
+		{1000, 0, 2},
+		{20000, 0, 3},
+
+		// Shrinking back below a boundary doesn't lower the step until
+		// the cluster is well below it.
+		{99, 1, 1},
+		{80, 1, 1},
+		{79, 1, 0},
+		{850, 2, 2},
+		{799, 2, 1},
+		{10, 3, 0},
+	}
+	for _, c := range cases {
+		if got := scaleStep(c.n, c.step); got != c.expected {
+			t.Fatalf("scaleStep(%d, %d): expected %d, got %d", c.n, c.step, c.expected, got)
+		}
+	}
+}
+
+func TestMemberlist_Rescale(t *testing.T) {
+	c := testConfig()
+	c.AdaptiveMultipliers = true
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	atomic.StoreUint32(&m.numNodes, 150)
+	m.rescale()
+	if m.broadcasts.RetransmitMult != c.RetransmitMult+1 {
+		t.Fatalf("bad retransmit mult: %d", m.broadcasts.RetransmitMult)
+	}
+	if mult := m.suspicionMult(); mult != c.SuspicionMult+1 {
+		t.Fatalf("bad suspicion mult: %d", mult)
+	}
+
+	atomic.StoreUint32(&m.numNodes, 90)
+	m.rescale()
+	if m.broadcasts.RetransmitMult != c.RetransmitMult+1 {
+		t.Fatalf("should not have lowered retransmit mult: %d", m.broadcasts.RetransmitMult)
+	}
+
+	atomic.StoreUint32(&m.numNodes, 5)
+	m.rescale()
+	if m.broadcasts.RetransmitMult != c.RetransmitMult {
+		t.Fatalf("bad retransmit mult: %d", m.broadcasts.RetransmitMult)
+	}
+	if mult := m.suspicionMult(); mult != c.SuspicionMult {
+		t.Fatalf("bad suspicion mult: %d", mult)
+	}
+}
+
+func TestMemberlist_Rescale_Disabled(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	atomic.StoreUint32(&m.numNodes, 5000)
+	m.rescale()
+	if m.broadcasts.RetransmitMult != m.config.RetransmitMult {
+		t.Fatalf("bad retransmit mult: %d", m.broadcasts.RetransmitMult)
+	}
+	if mult := m.suspicionMult(); mult != m.config.SuspicionMult {
+		t.Fatalf("bad suspicion mult: %d", mult)
+	}
+}
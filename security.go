@@ -4,7 +4,10 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 )
@@ -86,6 +89,12 @@ func encryptedLength(vsn encryptionVersion, inp int) int {
 // We make use of AES-128 in GCM mode. New byte buffer is the version,
 // nonce, ciphertext and tag
 func encryptPayload(vsn encryptionVersion, key []byte, msg []byte, data []byte, dst *bytes.Buffer) error {
+	return encryptPayloadNonce(vsn, key, msg, data, randomNonces{rand.Reader}, dst)
+}
+
+// encryptPayloadNonce is encryptPayload with nonces taken from the given
+// source.
+func encryptPayloadNonce(vsn encryptionVersion, key []byte, msg []byte, data []byte, nonces nonceSource, dst *bytes.Buffer) error {
 	// Get the AES block cipher
 	aesBlock, err := aes.NewCipher(key)
 	if err != nil {
@@ -105,8 +114,12 @@ func encryptPayload(vsn encryptionVersion, key []byte, msg []byte, data []byte,
 	// Write the encryption version
 	dst.WriteByte(byte(vsn))
 
-	// Add a random nonce
-	io.CopyN(dst, rand.Reader, nonceSize)
+	// Add the nonce
+	var nonceBuf [nonceSize]byte
+	if err := nonces.nonce(nonceBuf[:]); err != nil {
+		return err
+	}
+	dst.Write(nonceBuf[:])
 	afterNonce := dst.Len()
 
 	// Ensure we are correctly padded (only version 0)
@@ -166,33 +179,91 @@ func decryptMessage(key, msg []byte, data []byte) ([]byte, error) {
 // and verify it's contents. Any padding will be removed, and a
 // slice to the plaintext is returned. Decryption is done IN PLACE!
 func decryptPayload(keys [][]byte, msg []byte, data []byte) ([]byte, error) {
+	plain, _, err := decryptPayloadIndex(keys, msg, data)
+	return plain, err
+}
+
+// decryptPayloadIndex is like decryptPayload, but also returns the index of
+// the key that decrypted the message.
+func decryptPayloadIndex(keys [][]byte, msg []byte, data []byte) ([]byte, int, error) {
 	// Ensure we have at least one byte
 	if len(msg) == 0 {
-		return nil, fmt.Errorf("Cannot decrypt empty payload")
+		return nil, -1, fmt.Errorf("Cannot decrypt empty payload")
 	}
 
 	// Verify the version
 	vsn := encryptionVersion(msg[0])
 	if vsn > maxEncryptionVersion {
-		return nil, fmt.Errorf("Unsupported encryption version %d", msg[0])
+		return nil, -1, fmt.Errorf("Unsupported encryption version %d", msg[0])
 	}
 
 	// Ensure the length is sane
 	if len(msg) < encryptedLength(vsn, 0) {
-		return nil, fmt.Errorf("Payload is too small to decrypt: %d", len(msg))
+		return nil, -1, fmt.Errorf("Payload is too small to decrypt: %d", len(msg))
 	}
 
-	for _, key := range keys {
+	for i, key := range keys {
 		plain, err := decryptMessage(key, msg, data)
 		if err == nil {
 			// Remove the PKCS7 padding for vsn 0
 			if vsn == 0 {
-				return pkcs7decode(plain, aes.BlockSize), nil
+				return pkcs7decode(plain, aes.BlockSize), i, nil
 			} else {
-				return plain, nil
+				return plain, i, nil
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("No installed keys could decrypt the message")
+	return nil, -1, ErrNoDecryptKey
+}
+
+/*
+
+Authenticated messages are used when Config.AuthenticateOnly is set. The
+payload is sent in the clear, prefixed with an authMsg byte and followed
+by an HMAC-SHA256 tag over the additional data and the payload, computed
+with the primary key. The receiver accepts the message if any installed
+key produces the same tag.
+
+*/
+
+const authTagSize = sha256.Size
+
+// authOverhead is the number of bytes added to a packet by authPayload.
+const authOverhead = 1 + authTagSize
+
+// authTag computes the tag for the given payload and additional data. The
+// length of the data is mixed in so the boundary between the two can't be
+// shifted.
+func authTag(key, msg, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(data)))
+	h.Write(size[:])
+	h.Write(data)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// authPayload writes the given payload to dst followed by its tag.
+func authPayload(key, msg, data []byte, dst *bytes.Buffer) {
+	dst.Write(msg)
+	dst.Write(authTag(key, msg, data))
+}
+
+// verifyPayload checks the tag at the end of msg against each of the keys,
+// and returns the payload without the tag along with the index of the key
+// that verified it.
+func verifyPayload(keys [][]byte, msg, data []byte) ([]byte, int, error) {
+	if len(msg) < authTagSize {
+		return nil, -1, fmt.Errorf("Payload is too small to verify: %d", len(msg))
+	}
+	payload := msg[:len(msg)-authTagSize]
+	tag := msg[len(msg)-authTagSize:]
+	for i, key := range keys {
+		if hmac.Equal(tag, authTag(key, payload, data)) {
+			return payload, i, nil
+		}
+	}
+	return nil, -1, ErrNoVerifyKey
 }
@@ -68,3 +68,43 @@ func encryptDecryptVersioned(vsn encryptionVersion, t *testing.T) {
 		t.Fatalf("encrypt/decrypt failed! %d '%s' '%s'", cmp, msg, plaintext)
 	}
 }
+
+func TestAuthVerify(t *testing.T) {
+	k1 := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	k2 := []byte{15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0}
+	plaintext := []byte("this is a plain text message")
+	extra := []byte("random data")
+
+	var buf bytes.Buffer
+	authPayload(k1, plaintext, extra, &buf)
+	if buf.Len() != len(plaintext)+authTagSize {
+		t.Fatalf("bad: %d", buf.Len())
+	}
+	if !bytes.HasPrefix(buf.Bytes(), plaintext) {
+		t.Fatalf("payload should be in the clear")
+	}
+
+	msg, idx, err := verifyPayload([][]byte{k2, k1}, buf.Bytes(), extra)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if idx != 1 || !bytes.Equal(msg, plaintext) {
+		t.Fatalf("bad: %d %s", idx, msg)
+	}
+
+	// Wrong key, wrong data and tampering should all fail.
+	if _, _, err := verifyPayload([][]byte{k2}, buf.Bytes(), extra); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, _, err := verifyPayload([][]byte{k1}, buf.Bytes(), []byte("other data")); err == nil {
+		t.Fatalf("expected error")
+	}
+	tampered := append([]byte(nil), buf.Bytes()...)
+	tampered[0] ^= 0xff
+	if _, _, err := verifyPayload([][]byte{k1}, tampered, extra); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, _, err := verifyPayload([][]byte{k1}, []byte("short"), extra); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -2,24 +2,35 @@ package memberlist
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"math/rand"
 	"net"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/armon/go-metrics"
+	"github.com/hashicorp/memberlist/coordinate"
 )
 
 type nodeStateType int
 
 const (
-	stateAlive nodeStateType = iota
+	stateAlive nodeStateType = iota // The order matches NodeStatus
 	stateSuspect
 	stateDead
+	statePaused
+	stateMaintenance
 )
 
+// active returns true for the states in which a node takes part in
+// failure detection and gossip: alive, and in maintenance.
+func (s nodeStateType) active() bool {
+	return s == stateAlive || s == stateMaintenance
+}
+
 // Node represents a node in the cluster.
 type Node struct {
 	Name string
@@ -40,13 +51,25 @@ type nodeState struct {
 	Incarnation uint32        // Last known incarnation number
 	State       nodeStateType // Current state
 	StateChange time.Time     // Time last state change happened
+	metaTime    int64         // When the node last changed its Meta, see MetaMergeLWW
+	probeSkips  int32         // Turns passed over, see ProbeIntervalMult, atomically
+	lastTurn    int64         // When it last came up to be probed, atomically
+	moved       bool          // Has changed its address, see Rebind
+	unsettled   bool          // Last probe's helpers couldn't ping it, see probeNode
+	maintenance bool          // Last said it's in maintenance, even if held suspect
 }
 
 // ackHandler is used to register handlers for incoming acks and nacks.
+// If neither arrives in time, the handler is dropped and its timeoutFn, if
+// any, is invoked.
 type ackHandler struct {
-	ackFn  func([]byte, time.Time)
-	nackFn func()
-	timer  *time.Timer
+	ackFn     func(ackResp, time.Time)
+	nackFn    func(nackReason)
+	timeoutFn func()
+
+	// seqNo and rounds are used by the ackWheel to expire the handler.
+	seqNo  uint32
+	rounds int
 }
 
 // NoPingResponseError is used to indicate a 'ping' packet was
@@ -76,10 +99,10 @@ func (m *Memberlist) schedule() {
 	// when we should stop the tickers.
 	stopCh := make(chan struct{})
 
-	// Create a new probeTicker
-	if m.config.ProbeInterval > 0 {
+	// Create a new probeTicker, unless we're only observing
+	if m.config.ProbeInterval > 0 && !m.config.Observer {
 		t := time.NewTicker(m.config.ProbeInterval)
-		go m.triggerFunc(m.config.ProbeInterval, t.C, stopCh, m.probe)
+		go m.triggerFunc(m.config.ProbeInterval, t.C, stopCh, m.guard("probe", m.probe))
 		m.tickers = append(m.tickers, t)
 	}
 
@@ -89,9 +112,23 @@ func (m *Memberlist) schedule() {
 	}
 
 	// Create a gossip ticker if needed
-	if m.config.GossipInterval > 0 && m.config.GossipNodes > 0 {
+	if m.config.GossipInterval > 0 && m.tune().GossipNodes > 0 {
 		t := time.NewTicker(m.config.GossipInterval)
-		go m.triggerFunc(m.config.GossipInterval, t.C, stopCh, m.gossip)
+		go m.triggerFunc(m.config.GossipInterval, t.C, stopCh, m.guard("gossip", m.gossip))
+		m.tickers = append(m.tickers, t)
+	}
+
+	// Create an auto-tuning ticker if needed
+	if m.config.AutoTune && m.config.AutoTuneInterval > 0 {
+		t := time.NewTicker(m.config.AutoTuneInterval)
+		go m.triggerFunc(m.config.AutoTuneInterval, t.C, stopCh, m.guard("autotune", m.autoTune))
+		m.tickers = append(m.tickers, t)
+	}
+
+	// Create a reachability sampling ticker if needed
+	if m.config.ReachabilityInterval > 0 {
+		t := time.NewTicker(m.config.ReachabilityInterval)
+		go m.triggerFunc(m.config.ReachabilityInterval, t.C, stopCh, m.guard("reachability", m.sampleReachability))
 		m.tickers = append(m.tickers, t)
 	}
 
@@ -128,6 +165,7 @@ func (m *Memberlist) triggerFunc(stagger time.Duration, C <-chan time.Time, stop
 // saturation
 func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
 	interval := m.config.PushPullInterval
+	pushPull := m.guard("push_pull", m.pushPull)
 
 	// Use a random stagger to avoid syncronizing
 	randStagger := time.Duration(uint64(rand.Int63()) % uint64(interval))
@@ -142,7 +180,7 @@ func (m *Memberlist) pushPullTrigger(stop <-chan struct{}) {
 		tickTime := pushPullScale(interval, m.estNumNodes())
 		select {
 		case <-time.After(tickTime):
-			m.pushPull()
+			pushPull()
 		case <-stop:
 			return
 		}
@@ -202,6 +240,12 @@ START:
 		skip = true
 	} else if node.State == stateDead {
 		skip = true
+	} else if node.State == statePaused && !m.pauseExpired(&node) {
+		skip = true
+	} else if m.deferProbe(m.nodes[m.probeIndex]) {
+		skip = true
+	} else if m.spareProbe(m.nodes[m.probeIndex]) {
+		skip = true
 	}
 
 	// Potentially skip
@@ -216,9 +260,29 @@ START:
 	m.probeNode(&node)
 }
 
+// deferProbe returns true if a node's turn to be probed should be passed
+// over, because its ProbeIntervalMult says it's probed less often. The node
+// lock must be held.
+func (m *Memberlist) deferProbe(state *nodeState) bool {
+	if m.config.ProbeIntervalMult == nil {
+		return false
+	}
+	mult := m.config.ProbeIntervalMult(&state.Node)
+	if mult <= 1 {
+		return false
+	}
+	if atomic.AddInt32(&state.probeSkips, 1) < int32(mult) {
+		return true
+	}
+	atomic.StoreInt32(&state.probeSkips, 0)
+	return false
+}
+
 // probeNode handles a single round of failure checking on a node.
 func (m *Memberlist) probeNode(node *nodeState) {
 	defer metrics.MeasureSince([]string{"memberlist", "probeNode"}, time.Now())
+	m.inflight.start(inflightProbe)
+	defer m.inflight.done(inflightProbe)
 
 	// We use our health awareness to scale the overall probe interval, so we
 	// slow down if we detect problems. The ticker that calls us can handle
@@ -229,9 +293,10 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	}
 
 	// Prepare a ping message and setup an ack handler.
-	ping := ping{SeqNo: m.nextSeqNo(), Node: node.Name}
-	ackCh := make(chan ackMessage, m.config.IndirectChecks+1)
-	nackCh := make(chan struct{}, m.config.IndirectChecks+1)
+	ping := m.newPing(m.nextSeqNo(), node.Name)
+	ping.FetchPayload = m.config.Ping != nil
+	ackCh := make(chan ackMessage, m.tune().IndirectChecks+1)
+	nackCh := make(chan nackReason, m.tune().IndirectChecks+1)
 	m.setProbeChannels(ping.SeqNo, ackCh, nackCh, probeInterval)
 
 	// Send a ping to the node. If this node looks like it's suspect or dead,
@@ -239,7 +304,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	// soon as possible.
 	deadline := time.Now().Add(probeInterval)
 	destAddr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
-	if node.State == stateAlive {
+	if node.State.active() {
 		if err := m.encodeAndSendMsg(destAddr, pingMsg, &ping); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to send ping: %s", err)
 			return
@@ -286,9 +351,19 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	select {
 	case v := <-ackCh:
 		if v.Complete == true {
+			rtt := v.Timestamp.Sub(sent)
+			m.updateCoordinate(node.Name, v.Coord, rtt)
 			if m.config.Ping != nil {
-				rtt := v.Timestamp.Sub(sent)
-				m.config.Ping.NotifyPingComplete(&node.Node, rtt, v.Payload)
+				m.notifyPingComplete(&node.Node, ping.SeqNo, rtt, v)
+			}
+			m.gossipHealth.record(node.Name, true)
+			m.tuning.recordProbe(false, rtt)
+			m.transports.setUDP(node.Name, TransportUp)
+			if m.config.DiscoverPacketSize && m.transports.startSizing(node.Name, time.Now()) {
+				go m.discoverPacketSize(node.Node)
+			}
+			if node.unsettled {
+				m.setUnsettled(node.Name, false)
 			}
 			return
 		}
@@ -298,7 +373,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		if v.Complete == false {
 			ackCh <- v
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-time.After(m.tune().ProbeTimeout):
 		// Note that we don't scale this timeout based on awareness and
 		// the health score. That's because we don't really expect waiting
 		// longer to help get UDP through. Since health does extend the
@@ -306,17 +381,24 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		// is more active in dealing with lost packets, and it gives more
 		// time to wait for indirect acks/nacks.
 		m.logger.Printf("[DEBUG] memberlist: Failed UDP ping: %v (timeout reached)", node.Name)
+	case <-m.shutdownCh:
+		// There's no point in going on to suspect the node.
+		awarenessDelta = 0
+		return
 	}
+	m.gossipHealth.record(node.Name, false)
 
 	// Get some random live nodes.
 	m.nodeLock.RLock()
-	excludes := []string{m.config.Name, node.Name}
-	kNodes := kRandomNodes(m.config.IndirectChecks, excludes, m.nodes)
+	excludes := append([]string{m.config.Name, node.Name}, m.quarantinedNodes()...)
+	kNodes := kRandomNodes(m.tune().IndirectChecks, excludes, m.nodes)
 	m.nodeLock.RUnlock()
 
 	// Attempt an indirect ping.
 	expectedNacks := 0
 	ind := indirectPingReq{SeqNo: ping.SeqNo, Target: node.Addr, Port: node.Port, Node: node.Name}
+	ind.SourceAddr, ind.SourcePort = ping.SourceAddr, ping.SourcePort
+	ind.TCP = !m.config.DisableTcpPings && node.PMax >= 3
 	for _, peer := range kNodes {
 		// We only expect nack to be sent from peers who understand
 		// version 4 of the protocol.
@@ -345,6 +427,7 @@ func (m *Memberlist) probeNode(node *nodeState) {
 		destAddr := &net.TCPAddr{IP: node.Addr, Port: int(node.Port)}
 		go func() {
 			defer close(fallbackCh)
+			defer m.recoverInternal("probe")
 			didContact, err := m.sendPingAndWaitForAck(destAddr, ping, deadline)
 			if err != nil {
 				m.logger.Printf("[ERR] memberlist: Failed TCP fallback ping: %s", err)
@@ -363,8 +446,15 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	select {
 	case v := <-ackCh:
 		if v.Complete == true {
+			m.tuning.recordProbe(true, 0)
+			if node.unsettled {
+				m.setUnsettled(node.Name, false)
+			}
 			return
 		}
+	case <-m.shutdownCh:
+		awarenessDelta = 0
+		return
 	}
 
 	// Finally, poll the fallback channel. The timeouts are set such that
@@ -373,37 +463,168 @@ func (m *Memberlist) probeNode(node *nodeState) {
 	for didContact := range fallbackCh {
 		if didContact {
 			m.logger.Printf("[WARN] memberlist: Was able to reach %s via TCP but not UDP, network may be misconfigured and not allowing bidirectional UDP", node.Name)
+			m.tuning.recordProbe(true, 0)
+			m.transports.setUDP(node.Name, TransportDown)
+			m.transports.setTCP(node.Name, TransportUp)
+			if node.unsettled {
+				m.setUnsettled(node.Name, false)
+			}
 			return
 		}
 	}
 
+	// The nacks say why the indirect pings failed. A helper that couldn't
+	// send its ping at all didn't test the target, so its nack is no
+	// evidence either way.
+	nackCount := len(nackCh)
+	var nacks [nackUnreachable + 1]int
+	for i := 0; i < nackCount; i++ {
+		reason := <-nackCh
+		if reason > nackUnreachable {
+			reason = nackTimeout
+		}
+		nacks[reason]++
+		metrics.IncrCounter([]string{"memberlist", "nack", reason.String()}, 1)
+	}
+	tested := nackCount - nacks[nackUnreachable]
+
 	// Update our self-awareness based on the results of this failed probe.
 	// If we don't have peers who will send nacks then we penalize for any
 	// failed probe as a simple health metric. If we do have peers to nack
 	// verify, then we can use that as a more sophisticated measure of self-
 	// health because we assume them to be working, and they can help us
 	// decide if the probed node was really dead or if it was something wrong
-	// with ourselves.
+	// with ourselves. Only the helpers that tested the target can vouch
+	// that the failure wasn't ours.
 	awarenessDelta = 0
 	if expectedNacks > 0 {
-		if nackCount := len(nackCh); nackCount < expectedNacks {
-			awarenessDelta += 2 * (expectedNacks - nackCount)
+		if tested < expectedNacks {
+			awarenessDelta += 2 * (expectedNacks - tested)
 		}
 	} else {
 		awarenessDelta += 1
 	}
 
+	// If every helper that answered couldn't send its ping, only our own
+	// probe failed, which may be our fault as much as the target's. Give
+	// it one more round before suspecting it, unless the last one went
+	// the same way.
+	if nackCount > 0 && tested == 0 && !node.unsettled {
+		m.logger.Printf("[WARN] memberlist: None of the %d helpers could send indirect pings to %s, probing it again before suspecting it", nackCount, node.Name)
+		m.setUnsettled(node.Name, true)
+		return
+	}
+	if node.unsettled {
+		m.setUnsettled(node.Name, false)
+	}
+
 	// No acks received from target, suspect it as failed.
-	m.logger.Printf("[INFO] memberlist: Suspect %s has failed, no acks received", node.Name)
+	m.logger.Printf("[INFO] memberlist: Suspect %s has failed, no acks received%s", node.Name, formatNacks(nacks[:]))
 	s := suspect{Incarnation: node.Incarnation, Node: node.Name, From: m.config.Name}
 	m.suspectNode(&s)
 }
 
+// setUnsettled records whether the helpers for the latest probe of a node
+// all failed to ping it.
+func (m *Memberlist) setUnsettled(name string, unsettled bool) {
+	m.nodeLock.Lock()
+	defer m.nodeLock.Unlock()
+
+	if state, ok := m.nodeMap[name]; ok {
+		state.unsettled = unsettled
+	}
+}
+
+// formatNacks describes the nacks for a failed probe, counted by reason, for
+// the log.
+func formatNacks(nacks []int) string {
+	var parts []string
+	for reason, n := range nacks {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, nackReason(reason)))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (nacks: " + strings.Join(parts, ", ") + ")"
+}
+
+// newPing builds a ping for the given node, telling it to reply to our
+// advertised address.
+func (m *Memberlist) newPing(seqNo uint32, node string) ping {
+	p := ping{SeqNo: seqNo, Node: node}
+
+	m.nodeLock.RLock()
+	if self, ok := m.nodeMap[m.config.Name]; ok {
+		p.SourceAddr = self.Addr
+		p.SourcePort = self.Port
+		p.SourceNode = self.Name
+	}
+	m.nodeLock.RUnlock()
+	return p
+}
+
 // Ping initiates a ping to the node with the specified name.
 func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
+	return m.pingUDP(node, addr, m.tune().ProbeTimeout)
+}
+
+// PingNode checks whether the named member is reachable right now, outside
+// the regular probe cycle, and returns the round trip time. The ping goes
+// over UDP first; if there's no ack within the probe timeout, it's retried
+// over TCP for the rest of the given timeout, unless TCP pings are
+// disabled or the node is too old to answer them.
+func (m *Memberlist) PingNode(node string, timeout time.Duration) (time.Duration, error) {
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[node]
+	var n Node
+	if ok {
+		n = state.Node
+	}
+	m.nodeLock.RUnlock()
+	if !ok {
+		return 0, fmt.Errorf("Unknown node %s", node)
+	}
+
+	deadline := time.Now().Add(timeout)
+	udpTimeout := m.tune().ProbeTimeout
+	if timeout < udpTimeout {
+		udpTimeout = timeout
+	}
+	addr := &net.UDPAddr{IP: n.Addr, Port: int(n.Port)}
+	rtt, err := m.pingUDP(node, addr, udpTimeout)
+	if _, ok := err.(NoPingResponseError); !ok {
+		return rtt, err
+	}
+	if m.config.DisableTcpPings || n.PMax < 3 || !time.Now().Before(deadline) {
+		return 0, err
+	}
+
+	m.inflight.start(inflightProbe)
+	defer m.inflight.done(inflightProbe)
+
+	ping := m.newPing(m.nextSeqNo(), node)
+	sent := time.Now()
+	didContact, tcpErr := m.sendPingAndWaitForAck(addr, ping, deadline)
+	if tcpErr != nil {
+		return 0, tcpErr
+	}
+	if !didContact {
+		return 0, err
+	}
+	return time.Since(sent), nil
+}
+
+// pingUDP sends a single ping over UDP and waits up to the given timeout
+// for the ack.
+func (m *Memberlist) pingUDP(node string, addr net.Addr, timeout time.Duration) (time.Duration, error) {
+	m.inflight.start(inflightProbe)
+	defer m.inflight.done(inflightProbe)
+
 	// Prepare a ping message and setup an ack handler.
-	ping := ping{SeqNo: m.nextSeqNo(), Node: node}
-	ackCh := make(chan ackMessage, m.config.IndirectChecks+1)
+	ping := m.newPing(m.nextSeqNo(), node)
+	ackCh := make(chan ackMessage, m.tune().IndirectChecks+1)
 	m.setProbeChannels(ping.SeqNo, ackCh, nil, m.config.ProbeInterval)
 
 	// Send a ping to the node.
@@ -422,7 +643,7 @@ func (m *Memberlist) Ping(node string, addr net.Addr) (time.Duration, error) {
 		if v.Complete == true {
 			return v.Timestamp.Sub(sent), nil
 		}
-	case <-time.After(m.config.ProbeTimeout):
+	case <-time.After(timeout):
 		// Timeout, return an error below.
 	}
 
@@ -441,6 +662,10 @@ func (m *Memberlist) resetNodes() {
 
 	// Deregister the dead nodes
 	for i := deadIdx; i < len(m.nodes); i++ {
+		m.notifyPurge(m.nodes[i])
+		m.gossipHealth.forget(m.nodes[i].Name)
+		m.contacts.forget(m.nodes[i].Name)
+		m.transports.forget(m.nodes[i].Name)
 		delete(m.nodeMap, m.nodes[i].Name)
 		m.nodes[i] = nil
 	}
@@ -450,9 +675,26 @@ func (m *Memberlist) resetNodes() {
 
 	// Update numNodes after we've trimmed the dead nodes
 	atomic.StoreUint32(&m.numNodes, uint32(deadIdx))
+	m.rescale()
 
 	// Shuffle live nodes
 	shuffleNodes(m.nodes)
+
+	// Top up the active view from the passive view, in partial view mode
+	m.fillActiveView()
+}
+
+// notifyPurge tells the PurgeDelegate, if any, that a dead node is being
+// forgotten. The nodeLock must be held.
+func (m *Memberlist) notifyPurge(state *nodeState) {
+	metrics.IncrCounter([]string{"memberlist", "purged"}, 1)
+	if m.config.Purge == nil {
+		return
+	}
+	node := m.eventNode(state)
+	m.dispatchDelegate(node.Name, "notify_purge", func() {
+		m.config.Purge.NotifyPurge(node)
+	})
 }
 
 // gossip is invoked every GossipInterval period to broadcast our gossip
@@ -460,31 +702,47 @@ func (m *Memberlist) resetNodes() {
 func (m *Memberlist) gossip() {
 	defer metrics.MeasureSince([]string{"memberlist", "gossip"}, time.Now())
 
-	// Get some random live nodes
+	// Back off if the network has signalled congestion
+	fanout := m.tune().GossipNodes
+	if m.config.EnableECN {
+		fanout = m.congestion.fanout(fanout)
+		metrics.SetGauge([]string{"memberlist", "gossip", "ecn_rate"}, float32(m.congestion.rate()))
+	}
+
+	// Get some random live nodes, favouring the ones we can reach. The
+	// states can change once we let go of the lock, so copy out what we
+	// need.
+	type gossipTarget struct {
+		addr *net.UDPAddr
+		v2   bool
+	}
 	m.nodeLock.RLock()
 	excludes := []string{m.config.Name}
-	kNodes := kRandomNodes(m.config.GossipNodes, excludes, m.nodes)
+	kNodes := weightedRandomNodes(fanout, excludes, m.nodes, m.gossipHealth.weight)
+	targets := make([]gossipTarget, 0, len(kNodes))
+	for _, node := range kNodes {
+		addr := &net.UDPAddr{IP: append(net.IP(nil), node.Addr...), Port: int(node.Port)}
+		targets = append(targets, gossipTarget{addr, node.PMax >= 5})
+	}
 	m.nodeLock.RUnlock()
 
-	// Compute the bytes available
-	bytesAvail := udpSendBuf - compoundHeaderOverhead
-	if m.config.EncryptionEnabled() {
-		bytesAvail -= encryptOverhead(m.encryptionVersion())
+	if m.mcastAddr != nil {
+		m.gossipMulticast(udpSendBuf - compoundHeaderOverhead - m.securityOverhead())
 	}
 
-	for _, node := range kNodes {
-		// Get any pending broadcasts
+	for _, target := range targets {
+		// Get any pending broadcasts that fit in a packet to the node
+		destAddr := target.addr
+		bytesAvail := m.packetBudget(destAddr) - compoundHeaderOverhead - m.securityOverhead()
 		msgs := m.getBroadcasts(compoundOverhead, bytesAvail)
 		if len(msgs) == 0 {
-			return
+			continue
 		}
+		m.recordPiggyback(bytesAvail, msgs, compoundOverhead)
 
-		// Create a compound message
-		compound := makeCompoundMessage(msgs)
-
-		// Send the compound message
-		destAddr := &net.UDPAddr{IP: node.Addr, Port: int(node.Port)}
-		if err := m.rawSendMsgUDP(destAddr, compound.Bytes()); err != nil {
+		// Create a compound message, or several if the node doesn't
+		// understand the newer format
+		if err := m.rawSendMsgsUDP(destAddr, makeCompoundMessages(msgs, target.v2)); err != nil {
 			m.logger.Printf("[ERR] memberlist: Failed to send gossip to %s: %s", destAddr, err)
 		}
 	}
@@ -495,35 +753,75 @@ func (m *Memberlist) gossip() {
 // reasonably expensive as the entire state of this node is exchanged
 // with the other node.
 func (m *Memberlist) pushPull() {
-	// Get a random live node
+	if err := m.SyncNow(); err != nil && err != ErrNoMembers && err != ErrShutdown {
+		m.logger.Printf("[ERR] memberlist: %s", err)
+	}
+}
+
+// SyncNow does a complete state exchange with a random live member right
+// away, instead of waiting for the next PushPullInterval. It returns
+// ErrNoMembers if we don't know of any other live members.
+func (m *Memberlist) SyncNow() error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
+	// Get a random live node. kRandomNodes gives up after a few misses,
+	// which is fine for the periodic push/pull but not for an explicit
+	// request, so collect the candidates first.
 	m.nodeLock.RLock()
-	excludes := []string{m.config.Name}
-	nodes := kRandomNodes(1, excludes, m.nodes)
+	var live []*nodeState
+	for _, n := range m.nodes {
+		if n.Name != m.config.Name && n.State.active() {
+			live = append(live, n)
+		}
+	}
 	m.nodeLock.RUnlock()
 
 	// If no nodes, bail
-	if len(nodes) == 0 {
-		return
+	if len(live) == 0 {
+		return ErrNoMembers
 	}
-	node := nodes[0]
+	node := live[randomOffset(len(live))]
 
 	// Attempt a push pull
 	if err := m.pushPullNode(node.Addr, node.Port, false); err != nil {
-		m.logger.Printf("[ERR] memberlist: Push/Pull with %s failed: %s", node.Name, err)
+		if isDialError(err) {
+			m.transports.setTCP(node.Name, TransportDown)
+		}
+		return fmt.Errorf("Push/Pull with %s failed: %w", node.Name, err)
 	}
+	m.transports.setTCP(node.Name, TransportUp)
+
+	// Take the opportunity to refresh the peer cache.
+	m.savePeerCache()
+	return nil
 }
 
 // pushPullNode does a complete state exchange with a specific node.
 func (m *Memberlist) pushPullNode(addr []byte, port uint16, join bool) error {
 	defer metrics.MeasureSince([]string{"memberlist", "pushPullNode"}, time.Now())
+	m.inflight.start(inflightPushPull)
+	defer m.inflight.done(inflightPushPull)
 
 	// Attempt to send and receive with the node
-	remote, userState, err := m.sendAndReceiveState(addr, port, join)
+	id, remote, userState, err := m.sendAndReceiveState(addr, port, join)
 	if err != nil {
+		var rej *MergeRejection
+		if errors.As(err, &rej) {
+			dest := &net.TCPAddr{IP: addr, Port: int(port)}
+			m.audit(AuditMergeRejected, "", dest, "Rejected by peer: "+rej.Reason)
+			if m.config.PartialView && rej.Reason == activeViewFull {
+				m.refusedByActive(addr, port)
+			}
+		}
 		return err
 	}
 
-	if err := m.mergeRemoteState(join, remote, userState); err != nil {
+	if err := m.mergeRemoteState(id, remote, userState); err != nil {
+		m.audit(AuditMergeRejected, id.Name, id.Addr, err.Error())
 		return err
 	}
 	return nil
@@ -555,7 +853,7 @@ func (m *Memberlist) verifyProtocol(remote []pushNodeState) error {
 
 	for _, rn := range remote {
 		// If the node isn't alive, then skip it
-		if rn.State != stateAlive {
+		if !rn.State.active() {
 			continue
 		}
 
@@ -584,7 +882,7 @@ func (m *Memberlist) verifyProtocol(remote []pushNodeState) error {
 
 	for _, n := range m.nodes {
 		// Ignore non-alive nodes
-		if n.State != stateAlive {
+		if !n.State.active() {
 			continue
 		}
 
@@ -669,46 +967,42 @@ func (m *Memberlist) estNumNodes() int {
 }
 
 type ackMessage struct {
-	Complete  bool
-	Payload   []byte
-	Timestamp time.Time
+	Complete   bool
+	Payload    []byte
+	Coord      *coordinate.Coordinate
+	Timestamp  time.Time
+	PayloadLen uint32 // Of a payload held for us to fetch
 }
 
 // setProbeChannels is used to attach the ackCh to receive a message when an ack
 // with a given sequence number is received. The `complete` field of the message
 // will be false on timeout. Any nack messages will cause an empty struct to be
 // passed to the nackCh, which can be nil if not needed.
-func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackCh chan struct{}, timeout time.Duration) {
+func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackCh chan nackReason, timeout time.Duration) {
 	// Create handler functions for acks and nacks
-	ackFn := func(payload []byte, timestamp time.Time) {
+	ackFn := func(ack ackResp, timestamp time.Time) {
 		select {
-		case ackCh <- ackMessage{true, payload, timestamp}:
+		case ackCh <- ackMessage{true, ack.Payload, ack.Coord, timestamp, ack.PayloadLen}:
 		default:
 		}
 	}
-	nackFn := func() {
+	nackFn := func(reason nackReason) {
 		select {
-		case nackCh <- struct{}{}:
+		case nackCh <- reason:
 		default:
 		}
 	}
 
-	// Add the handlers
-	ah := &ackHandler{ackFn, nackFn, nil}
-	m.ackLock.Lock()
-	m.ackHandlers[seqNo] = ah
-	m.ackLock.Unlock()
-
-	// Setup a reaping routing
-	ah.timer = time.AfterFunc(timeout, func() {
-		m.ackLock.Lock()
-		delete(m.ackHandlers, seqNo)
-		m.ackLock.Unlock()
+	timeoutFn := func() {
 		select {
-		case ackCh <- ackMessage{false, nil, time.Now()}:
+		case ackCh <- ackMessage{false, nil, nil, time.Now(), 0}:
 		default:
 		}
-	})
+	}
+
+	// Add the handlers
+	ah := &ackHandler{ackFn: ackFn, nackFn: nackFn, timeoutFn: timeoutFn}
+	m.addAckHandler(seqNo, ah, timeout)
 }
 
 // setAckHandler is used to attach a handler to be invoked when an ack with a
@@ -717,17 +1011,10 @@ func (m *Memberlist) setProbeChannels(seqNo uint32, ackCh chan ackMessage, nackC
 // for nacks.
 func (m *Memberlist) setAckHandler(seqNo uint32, ackFn func([]byte, time.Time), timeout time.Duration) {
 	// Add the handler
-	ah := &ackHandler{ackFn, nil, nil}
-	m.ackLock.Lock()
-	m.ackHandlers[seqNo] = ah
-	m.ackLock.Unlock()
-
-	// Setup a reaping routing
-	ah.timer = time.AfterFunc(timeout, func() {
-		m.ackLock.Lock()
-		delete(m.ackHandlers, seqNo)
-		m.ackLock.Unlock()
-	})
+	respFn := func(ack ackResp, timestamp time.Time) {
+		ackFn(ack.Payload, timestamp)
+	}
+	m.addAckHandler(seqNo, &ackHandler{ackFn: respFn}, timeout)
 }
 
 // Invokes an ack handler if any is associated, and reaps the handler immediately
@@ -739,8 +1026,7 @@ func (m *Memberlist) invokeAckHandler(ack ackResp, timestamp time.Time) {
 	if !ok {
 		return
 	}
-	ah.timer.Stop()
-	ah.ackFn(ack.Payload, timestamp)
+	ah.ackFn(ack, timestamp)
 }
 
 // Invokes nack handler if any is associated.
@@ -751,7 +1037,7 @@ func (m *Memberlist) invokeNackHandler(nack nackResp) {
 	if !ok || ah.nackFn == nil {
 		return
 	}
-	ah.nackFn()
+	ah.nackFn(nack.Reason)
 }
 
 // refute gossips an alive message in response to incoming information that we
@@ -759,7 +1045,11 @@ func (m *Memberlist) invokeNackHandler(nack nackResp) {
 // accusedInc value, or you can supply 0 to just get the next incarnation number.
 // This alters the node state that's passed in so this MUST be called while the
 // nodeLock is held.
-func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
+//
+// The alive message goes ahead of everything else in the broadcast queue,
+// and is also sent straight to the accuser, if known, and RefuteFanout
+// random peers rather than waiting for them to be gossiped to.
+func (m *Memberlist) refute(me *nodeState, accusedInc uint32, accuser string) {
 	// Make sure the incarnation number beats the accusation.
 	inc := m.nextIncarnation()
 	if accusedInc >= inc {
@@ -769,6 +1059,7 @@ func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
 
 	// Decrease our health because we are being asked to refute a problem.
 	m.awareness.ApplyDelta(1)
+	m.tuning.recordRefute(time.Now())
 
 	// Format and broadcast an alive message.
 	a := alive{
@@ -781,8 +1072,44 @@ func (m *Memberlist) refute(me *nodeState, accusedInc uint32) {
 			me.PMin, me.PMax, me.PCur,
 			me.DMin, me.DMax, me.DCur,
 		},
+		Origin:      m.config.Name,
+		Paused:      me.State == statePaused,
+		Maintenance: m.InMaintenance(),
+		MetaTime:    me.metaTime,
+		Moved:       me.moved,
+	}
+	buf, err := encode(aliveMsg, a)
+	if err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to encode alive message for refutation: %s", err)
+		return
+	}
+	msg := buf.Bytes()
+	m.broadcasts.QueuePriorityBroadcast(&memberlistBroadcast{me.Addr.String(), msg, nil})
+
+	// Pick who to tell directly.
+	var targets []net.Addr
+	excludes := []string{m.config.Name}
+	if node, ok := m.nodeMap[accuser]; ok && accuser != m.config.Name {
+		targets = append(targets, &net.UDPAddr{IP: node.Addr, Port: int(node.Port)})
+		excludes = append(excludes, accuser)
 	}
-	m.encodeAndBroadcast(me.Addr.String(), aliveMsg, a)
+	for _, node := range kRandomNodes(m.tune().RefuteFanout, excludes, m.nodes) {
+		targets = append(targets, &net.UDPAddr{IP: node.Addr, Port: int(node.Port)})
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	// Send outside of the nodeLock.
+	go func() {
+		defer m.recoverInternal("refute")
+		for _, addr := range targets {
+			if err := m.rawSendMsgUDP(addr, msg); err != nil {
+				m.logger.Printf("[ERR] memberlist: Failed to send refutation to %s: %s", addr, err)
+			}
+		}
+		metrics.IncrCounter([]string{"memberlist", "refute", "direct"}, float32(len(targets)))
+	}()
 }
 
 // aliveNode is invoked by the network layer when we get a message about a
@@ -800,6 +1127,11 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		return
 	}
 
+	// Keep banned nodes out.
+	if m.checkBanned(a.Node) {
+		return
+	}
+
 	// Invoke the Alive delegate if any. This can be used to filter out
 	// alive messages based on custom logic. For example, using a cluster name.
 	// Using a merge delegate is not enough, as it is possible for passive
@@ -827,6 +1159,13 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 	// Check if we've never seen this node before, and if not, then
 	// store this node in our node map.
 	if !ok {
+		if m.passiveAlive(a, notify) {
+			return
+		}
+		if !m.admitMember(a.Node) {
+			return
+		}
+		m.passive.remove(a.Node)
 		state = &nodeState{
 			Node: Node{
 				Name: a.Node,
@@ -853,12 +1192,22 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 
 		// Update numNodes after we've added a new node
 		atomic.AddUint32(&m.numNodes, 1)
+		m.rescale()
 	}
 
-	// Check if this address is different than the existing node
-	if !bytes.Equal([]byte(state.Addr), a.Addr) || state.Port != a.Port {
+	// Check if this address is different than the existing node, unless
+	// the node has moved
+	addrChanged := !bytes.Equal([]byte(state.Addr), a.Addr) || state.Port != a.Port
+	if addrChanged && !m.acceptMove(a, state, bootstrap) {
+		// Old news about a node from before it moved isn't a conflict.
+		if state.moved && a.Incarnation <= state.Incarnation {
+			return
+		}
 		m.logger.Printf("[ERR] memberlist: Conflicting address for %s. Mine: %v:%d Theirs: %v:%d",
 			state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
+		mine := &net.UDPAddr{IP: state.Addr, Port: int(state.Port)}
+		theirs := &net.UDPAddr{IP: a.Addr, Port: int(a.Port)}
+		m.audit(AuditConflict, state.Name, mine, theirs.String())
 
 		// Inform the conflict delegate if provided
 		if m.config.Conflict != nil {
@@ -870,26 +1219,62 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 			}
 			m.config.Conflict.NotifyConflict(&state.Node, &other)
 		}
+
+		// Someone is claiming we've moved. Peers that believe it would
+		// ignore our unmarked refutes, so mark them from now on and put
+		// our real address back.
+		if state.Name == m.config.Name && !bootstrap && a.Moved {
+			state.moved = true
+			m.refute(state, a.Incarnation, a.Origin)
+			m.logger.Printf("[WARN] memberlist: Refuting a move to %v:%d", net.IP(a.Addr), a.Port)
+		}
 		return
 	}
 
-	// Bail if the incarnation number is older, and this is not about us
+	// Bail if the incarnation number is older, and this is not about us,
+	// unless it settles differing metadata for the same incarnation
 	isLocalNode := state.Name == m.config.Name
-	if a.Incarnation <= state.Incarnation && !isLocalNode {
+	metaWins := !isLocalNode && m.metaWins(a, state)
+	if a.Incarnation <= state.Incarnation && !isLocalNode && !metaWins {
 		return
 	}
 
-	// Bail if strictly less and this is about us
+	// Bail if strictly less and this is about us, unless it's an update of
+	// our own that lost a race with a refutation, which takes a fresh
+	// incarnation instead so it isn't lost
 	if a.Incarnation < state.Incarnation && isLocalNode {
+		if !bootstrap {
+			return
+		}
+		a.Incarnation = m.nextIncarnation()
+	}
+
+	// Don't let a node be quietly moved onto older protocol versions.
+	if !isLocalNode && !m.checkVersions(a.Node, a.Vsn, nil) {
 		return
 	}
 
 	// Clear out any suspicion timer that may be in effect.
-	delete(m.nodeTimers, a.Node)
+	m.endSuspicion(a.Node, SuspicionRefuted, false)
 
 	// Store the old state and meta data
 	oldState := state.State
 	oldMeta := state.Meta
+	oldMaintenance := state.maintenance
+
+	// Once we've moved, say so in everything we send about ourselves, so
+	// that nodes that missed the move still take our new address.
+	if bootstrap && isLocalNode && state.moved {
+		a.Moved = true
+	}
+
+	// Stamp our own metadata with when it last changed.
+	if bootstrap && isLocalNode && m.config.MetaMergeLWW {
+		a.MetaTime = state.metaTime
+		if a.MetaTime == 0 || !bytes.Equal(a.Meta, state.Meta) {
+			a.MetaTime = time.Now().UnixNano()
+		}
+	}
 
 	// If this is us we need to refute, otherwise re-broadcast
 	if !bootstrap && isLocalNode {
@@ -912,14 +1297,29 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		//
 		if a.Incarnation == state.Incarnation &&
 			bytes.Equal(a.Meta, state.Meta) &&
-			bytes.Equal(a.Vsn, versions) {
+			bytes.Equal(a.Vsn, versions) &&
+			a.Paused == (state.State == statePaused) &&
+			a.Maintenance == m.InMaintenance() {
 			return
 		}
 
-		m.refute(state, a.Incarnation)
+		m.refute(state, a.Incarnation, "")
 		m.logger.Printf("[WARN] memberlist: Refuting an alive message")
 	} else {
-		m.encodeBroadcastNotify(a.Node, aliveMsg, a, notify)
+		// Don't forward copies of an alive message we've recently sent on
+		// already, but always send our own.
+		if isLocalNode || metaWins || m.aliveLimit.Allow(a.Node, a.Incarnation, time.Now()) {
+			if isLocalNode && a.Origin == "" {
+				a.Origin = m.config.Name
+			}
+			if isLocalNode {
+				m.broadcastLocalAlive(a, notify)
+			} else {
+				m.encodeBroadcastNotify(a.Node, aliveMsg, a, notify)
+			}
+		} else {
+			metrics.IncrCounter([]string{"memberlist", "msg", "alive", "suppressed"}, 1)
+		}
 
 		// Update protocol versions if it arrived
 		if len(a.Vsn) > 0 {
@@ -934,8 +1334,27 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 		// Update the state and incarnation number
 		state.Incarnation = a.Incarnation
 		state.Meta = a.Meta
-		if state.State != stateAlive {
-			state.State = stateAlive
+		state.metaTime = a.MetaTime
+		if addrChanged {
+			m.logger.Printf("[INFO] memberlist: %s moved from %v:%d to %v:%d",
+				state.Name, state.Addr, state.Port, net.IP(a.Addr), a.Port)
+			state.Addr = a.Addr
+			state.Port = a.Port
+		}
+		state.moved = state.moved || a.Moved
+		state.maintenance = a.Maintenance
+		m.suggested.arrived(a.Node)
+		newState := stateAlive
+		if a.Paused {
+			newState = statePaused
+		} else if m.overrides.unhealthy(a.Node, time.Now()) {
+			// Marked unhealthy, so it stays suspect whatever it says.
+			newState = stateSuspect
+		} else if a.Maintenance {
+			newState = stateMaintenance
+		}
+		if state.State != newState {
+			state.State = newState
 			state.StateChange = time.Now()
 		}
 	}
@@ -943,17 +1362,52 @@ func (m *Memberlist) aliveNode(a *alive, notify chan struct{}, bootstrap bool) {
 	// Update metrics
 	metrics.IncrCounter([]string{"memberlist", "msg", "alive"}, 1)
 
+	if oldState == stateDead {
+		m.audit(AuditJoin, state.Name, &net.UDPAddr{IP: state.Addr, Port: int(state.Port)}, "")
+	}
+
 	// Notify the delegate of any relevant updates
-	if m.config.Events != nil {
+	if m.config.Events != nil || m.config.EventsV2 != nil {
+		node := m.eventNode(state)
 		if oldState == stateDead {
 			// if Dead -> Alive, notify of join
-			m.config.Events.NotifyJoin(&state.Node)
-
-		} else if !bytes.Equal(oldMeta, state.Meta) {
-			// if Meta changed, trigger an update notification
-			m.config.Events.NotifyUpdate(&state.Node)
+			m.dispatchDelegate(node.Name, "notify_join", func() {
+				m.notifyJoin(node)
+			})
+
+		} else if !bytes.Equal(oldMeta, state.Meta) || addrChanged {
+			// if Meta or the address changed, trigger an update notification
+			m.dispatchDelegate(node.Name, "notify_update", func() {
+				m.notifyUpdate(node)
+			})
 		}
 	}
+	if md := m.config.Maintenance; md != nil && oldMaintenance != state.maintenance {
+		node := m.eventNode(state)
+		entered := state.maintenance
+		m.dispatchDelegate(node.Name, "notify_maintenance", func() {
+			md.NotifyMaintenance(node, entered)
+		})
+	}
+
+	m.updateCoordinator()
+}
+
+// metaWins returns true if MetaMergeLWW is set and an alive message has
+// the same incarnation as a node we have, but newer metadata. A suspect
+// node still has to refute with a new incarnation. The nodeLock must be
+// held.
+func (m *Memberlist) metaWins(a *alive, state *nodeState) bool {
+	if !m.config.MetaMergeLWW || a.Incarnation != state.Incarnation {
+		return false
+	}
+	if state.State == stateDead || state.State == stateSuspect {
+		return false
+	}
+	if a.MetaTime != state.metaTime {
+		return a.MetaTime > state.metaTime
+	}
+	return bytes.Compare(a.Meta, state.Meta) > 0
 }
 
 // suspectNode is invoked by the network layer when we get a message
@@ -984,17 +1438,22 @@ func (m *Memberlist) suspectNode(s *suspect) {
 		return
 	}
 
-	// Ignore non-alive nodes
-	if state.State != stateAlive {
+	// Ignore non-alive nodes, and paused ones until they've been paused
+	// for too long. Nodes only held suspect by a health override can still
+	// be suspected for real.
+	if !state.State.active() && !m.pauseExpired(state) && !m.heldSuspect(state) {
 		return
 	}
 
 	// If this is us we need to refute, otherwise re-broadcast
 	if state.Name == m.config.Name {
-		m.refute(state, s.Incarnation)
+		m.refute(state, s.Incarnation, s.From)
 		m.logger.Printf("[WARN] memberlist: Refuting a suspect message (from: %s)", s.From)
 		return // Do not mark ourself suspect
 	} else {
+		if s.From == m.config.Name && s.Origin == "" {
+			s.Origin = m.config.Name
+		}
 		m.encodeAndBroadcast(s.Node, suspectMsg, s)
 	}
 
@@ -1011,7 +1470,8 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	// relationship with our peers, we set up k such that we hit the nominal
 	// timeout two probe intervals short of what we expect given the suspicion
 	// multiplier.
-	k := m.config.SuspicionMult - 2
+	mult := m.suspicionMult()
+	k := mult - 2
 
 	// If there aren't enough nodes to give the expected confirmations, just
 	// set k to 0 to say that we don't expect any. Note we subtract 2 from n
@@ -1022,8 +1482,8 @@ func (m *Memberlist) suspectNode(s *suspect) {
 	}
 
 	// Compute the timeouts based on the size of the cluster.
-	min := suspicionTimeout(m.config.SuspicionMult, n, m.config.ProbeInterval)
-	max := time.Duration(m.config.SuspicionMaxTimeoutMult) * min
+	min := suspicionTimeout(mult, n, m.config.ProbeInterval)
+	max := time.Duration(m.tune().SuspicionMaxTimeoutMult) * min
 	fn := func(numConfirmations int) {
 		m.nodeLock.Lock()
 		state, ok := m.nodeMap[s.Node]
@@ -1042,46 +1502,97 @@ func (m *Memberlist) suspectNode(s *suspect) {
 		}
 	}
 	m.nodeTimers[s.Node] = newSuspicion(s.From, k, min, max, fn)
+	m.updateCoordinator()
+}
+
+// endSuspicion clears any suspicion timer for the given node, reporting
+// how the suspicion ended. The node lock must be held.
+func (m *Memberlist) endSuspicion(node string, outcome SuspicionOutcome, timedOut bool) {
+	timer, ok := m.nodeTimers[node]
+	if !ok {
+		return
+	}
+	delete(m.nodeTimers, node)
+
+	expected := int(timer.k)
+	if expected < 0 {
+		expected = 0
+	}
+	ev := SuspicionEvent{
+		Node:          node,
+		From:          timer.from,
+		Confirmations: int(atomic.LoadInt32(&timer.n)),
+		Expected:      expected,
+		Outcome:       outcome,
+		TimedOut:      timedOut,
+		Start:         timer.start,
+		Duration:      time.Since(timer.start),
+	}
+	metrics.MeasureSince([]string{"memberlist", "suspicion", outcome.String()}, timer.start)
+	metrics.AddSample([]string{"memberlist", "suspicion", "confirmations"}, float32(ev.Confirmations))
+
+	if m.config.Suspicion != nil {
+		m.dispatchDelegate(node, "notify_suspicion", func() {
+			m.config.Suspicion.NotifySuspicion(ev)
+		})
+	}
 }
 
 // deadNode is invoked by the network layer when we get a message
 // about a dead node
 func (m *Memberlist) deadNode(d *dead) {
+	m.deadNodeNotify(d, nil)
+}
+
+// deadNodeNotify is like deadNode, but notifies the given channel once the
+// dead message about another node has been fully broadcast. It returns
+// false if the message was ignored, in which case nothing is broadcast.
+func (m *Memberlist) deadNodeNotify(d *dead, notify chan struct{}) bool {
 	m.nodeLock.Lock()
 	defer m.nodeLock.Unlock()
 	state, ok := m.nodeMap[d.Node]
 
-	// If we've never heard about this node before, ignore it
+	// If we've never heard about this node before, ignore it, beyond
+	// dropping it from the passive view
 	if !ok {
-		return
+		m.passive.remove(d.Node)
+		return false
 	}
 
 	// Ignore old incarnation numbers
 	if d.Incarnation < state.Incarnation {
-		return
+		return false
 	}
 
 	// Clear out any suspicion timer that may be in effect.
-	delete(m.nodeTimers, d.Node)
+	m.endSuspicion(d.Node, SuspicionDead, d.From == m.config.Name)
 
-	// Ignore if node is already dead
+	// Ignore if node is already dead, but ack a leave again in case our
+	// first ack was lost
 	if state.State == stateDead {
-		return
+		if d.Incarnation == state.Incarnation {
+			m.sendLeaveAck(d, state)
+		}
+		return false
+	}
+
+	if d.From == m.config.Name && d.Origin == "" {
+		d.Origin = m.config.Name
 	}
 
 	// Check if this is us
 	if state.Name == m.config.Name {
 		// If we are not leaving we need to refute
 		if !m.leave {
-			m.refute(state, d.Incarnation)
+			m.refute(state, d.Incarnation, d.From)
 			m.logger.Printf("[WARN] memberlist: Refuting a dead message (from: %s)", d.From)
-			return // Do not mark ourself dead
+			return false // Do not mark ourself dead
 		}
 
 		// If we are leaving, we broadcast and wait
 		m.encodeBroadcastNotify(d.Node, deadMsg, d, m.leaveBroadcast)
 	} else {
-		m.encodeAndBroadcast(d.Node, deadMsg, d)
+		m.encodeBroadcastNotify(d.Node, deadMsg, d, notify)
 	}
 
 	// Update metrics
@@ -1092,10 +1603,110 @@ func (m *Memberlist) deadNode(d *dead) {
 	state.State = stateDead
 	state.StateChange = time.Now()
 
+	m.forgetCoordinate(d.Node)
+	m.fillActiveView()
+	m.sendLeaveAck(d, state)
+
+	leave := "failed"
+	if d.From == d.Node {
+		leave = "graceful"
+	}
+	m.audit(AuditLeave, state.Name, &net.UDPAddr{IP: state.Addr, Port: int(state.Port)}, leave)
+
 	// Notify of death
+	if m.config.Events != nil || m.config.EventsV2 != nil {
+		node := m.eventNode(state)
+		reason := LeaveFailed
+		if d.From == d.Node {
+			reason = LeaveGraceful
+		}
+		m.dispatchDelegate(node.Name, "notify_leave", func() {
+			m.notifyLeave(node, reason)
+		})
+	}
+
+	m.updateCoordinator()
+	return true
+}
+
+// notifyJoin, notifyLeave and notifyUpdate pass an event on to both
+// kinds of event delegate, whichever are configured, or queue it for each
+// if EventQueueDepth is set.
+func (m *Memberlist) notifyJoin(node *Node) {
+	if m.events != nil {
+		m.events.notifyJoin(node)
+		return
+	}
+	if m.config.Events != nil {
+		m.config.Events.NotifyJoin(node)
+	}
+	if m.config.EventsV2 != nil {
+		m.config.EventsV2.NotifyJoin(node)
+	}
+}
+
+func (m *Memberlist) notifyLeave(node *Node, reason LeaveReason) {
+	if m.events != nil {
+		m.events.notifyLeave(node, reason)
+		return
+	}
+	if m.config.Events != nil {
+		m.config.Events.NotifyLeave(node)
+	}
+	if m.config.EventsV2 != nil {
+		m.config.EventsV2.NotifyLeave(node, reason)
+	}
+}
+
+func (m *Memberlist) notifyUpdate(node *Node) {
+	if m.events != nil {
+		m.events.notifyUpdate(node)
+		return
+	}
 	if m.config.Events != nil {
-		m.config.Events.NotifyLeave(&state.Node)
+		m.config.Events.NotifyUpdate(node)
+	}
+	if m.config.EventsV2 != nil {
+		m.config.EventsV2.NotifyUpdate(node)
+	}
+}
+
+// diffState compares a Push/Pull state transfer with our own view of each
+// node, for a MergeDiffDelegate.
+func (m *Memberlist) diffState(remote []pushNodeState) []*NodeDiff {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	diffs := make([]*NodeDiff, len(remote))
+	for idx, r := range remote {
+		diff := &NodeDiff{
+			Remote:            r.node(),
+			RemoteStatus:      NodeStatus(r.State),
+			RemoteIncarnation: r.Incarnation,
+		}
+		diffs[idx] = diff
+
+		local, ok := m.nodeMap[r.Name]
+		if !ok {
+			diff.Changes = MergeNew
+			continue
+		}
+		node := local.Node
+		diff.Local = &node
+		diff.LocalStatus = NodeStatus(local.State)
+		diff.LocalIncarnation = local.Incarnation
+
+		if !local.Addr.Equal(net.IP(r.Addr)) || local.Port != r.Port {
+			diff.Changes |= MergeAddrChanged
+		}
+		if !bytes.Equal(local.Meta, r.Meta) {
+			diff.Changes |= MergeMetaChanged
+		}
+		if local.State != r.State {
+			diff.Changes |= MergeStateChanged
+		}
 	}
+	return diffs
 }
 
 // mergeState is invoked by the network layer when we get a Push/Pull
@@ -1103,7 +1714,7 @@ func (m *Memberlist) deadNode(d *dead) {
 func (m *Memberlist) mergeState(remote []pushNodeState) {
 	for _, r := range remote {
 		switch r.State {
-		case stateAlive:
+		case stateAlive, statePaused, stateMaintenance:
 			a := alive{
 				Incarnation: r.Incarnation,
 				Node:        r.Name,
@@ -1111,6 +1722,14 @@ func (m *Memberlist) mergeState(remote []pushNodeState) {
 				Port:        r.Port,
 				Meta:        r.Meta,
 				Vsn:         r.Vsn,
+				Paused:      r.State == statePaused,
+				Maintenance: r.State == stateMaintenance,
+				MetaTime:    r.MetaTime,
+				Moved:       r.Moved,
+			}
+			if r.Moved {
+				// The sender only took the move from the node itself.
+				a.Origin = r.Name
 			}
 			m.aliveNode(&a, nil, false)
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -62,6 +63,56 @@ func TestMemberList_Probe(t *testing.T) {
 	}
 }
 
+func TestMemberList_Probe_IntervalMult(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	turns := 0
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 10 * time.Millisecond
+		c.ProbeIntervalMult = func(n *Node) int {
+			if string(n.Meta) == "battery" {
+				turns++
+				return 3
+			}
+			return 1
+		}
+	})
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m1.Shutdown()
+	defer m2.Shutdown()
+
+	a1 := alive{
+		Node:        addr1.String(),
+		Addr:        []byte(addr1),
+		Port:        uint16(m1.config.BindPort),
+		Incarnation: 1,
+	}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{
+		Node:        addr2.String(),
+		Addr:        []byte(addr2),
+		Port:        uint16(m2.config.BindPort),
+		Meta:        []byte("battery"),
+		Incarnation: 1,
+	}
+	m1.aliveNode(&a2, nil, false)
+
+	// The node is only probed every third time its turn comes round.
+	for i := 0; turns < 6; i++ {
+		if i > 100 {
+			t.Fatalf("node never came up")
+		}
+		m1.probe()
+		if m1.sequenceNum != uint32(turns/3) {
+			t.Fatalf("bad seqno %v after %d turns", m1.sequenceNum, turns)
+		}
+	}
+	if n := m1.nodeMap[addr2.String()]; n.State != stateAlive {
+		t.Fatalf("Expect node to be alive")
+	}
+}
+
 func TestMemberList_ProbeNode_Suspect(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -103,6 +154,87 @@ func TestMemberList_ProbeNode_Suspect(t *testing.T) {
 	}
 }
 
+func TestMemberList_ProbeNode_Suspect_Unreachable(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	addr3 := getBindAddr()
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = time.Millisecond
+		c.ProbeInterval = 50 * time.Millisecond
+		c.IndirectChecks = 1
+		c.DisableTcpPings = true
+		c.EnableCompression = false
+	})
+	defer m1.Shutdown()
+
+	// Stand in for a helper that can't send any indirect pings.
+	helper, err := net.ListenUDP("udp", &net.UDPAddr{IP: addr2})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer helper.Close()
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, from, err := helper.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			msg := buf[:n]
+			if messageType(msg[0]) == compoundMsg {
+				_, parts, err := decodeCompoundMessage(msg[1:])
+				if err != nil {
+					continue
+				}
+				msg = parts[0]
+			}
+			var ind indirectPingReq
+			if messageType(msg[0]) != indirectPingMsg || decode(msg[1:], &ind) != nil {
+				continue
+			}
+			out, err := encode(nackRespMsg, &nackResp{SeqNo: ind.SeqNo, Reason: nackUnreachable})
+			if err != nil {
+				continue
+			}
+			helper.WriteTo(out.Bytes(), from)
+		}
+	}()
+
+	vsn := []uint8{
+		ProtocolVersionMin,
+		ProtocolVersionMax,
+		m1.config.ProtocolVersion,
+		m1.config.DelegateProtocolMin,
+		m1.config.DelegateProtocolMax,
+		m1.config.DelegateProtocolVersion,
+	}
+	a1 := alive{Node: addr1.String(), Addr: []byte(addr1), Port: uint16(m1.config.BindPort), Incarnation: 1, Vsn: vsn}
+	m1.aliveNode(&a1, nil, true)
+	port := uint16(helper.LocalAddr().(*net.UDPAddr).Port)
+	a2 := alive{Node: addr2.String(), Addr: []byte(addr2), Port: port, Incarnation: 1, Vsn: vsn}
+	m1.aliveNode(&a2, nil, false)
+	a3 := alive{Node: addr3.String(), Addr: []byte(addr3), Port: 7946, Incarnation: 1, Vsn: vsn}
+	m1.aliveNode(&a3, nil, false)
+
+	// The helper's nack doesn't vouch for us, and doesn't count against
+	// the target, so the first failed probe only leaves it unsettled.
+	n := m1.nodeMap[addr3.String()]
+	m1.probeNode(n)
+	if n.State != stateAlive || !n.unsettled {
+		t.Fatalf("should not suspect yet: %v %v", n.State, n.unsettled)
+	}
+	if score := m1.awareness.GetHealthScore(); score != 2 {
+		t.Fatalf("bad health score: %d", score)
+	}
+
+	// The second one suspects it.
+	m1.probeNode(n)
+	if n.State != stateSuspect || n.unsettled {
+		t.Fatalf("should suspect: %v %v", n.State, n.unsettled)
+	}
+}
+
 func TestMemberList_ProbeNode_Suspect_Dogpile(t *testing.T) {
 	cases := []struct {
 		numPeers      int
@@ -851,6 +983,75 @@ func TestMemberList_Ping(t *testing.T) {
 	}
 }
 
+func TestMemberList_PingNode(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, func(c *Config) {
+		c.ProbeTimeout = 10 * time.Millisecond
+		c.ProbeInterval = 10 * time.Second
+	})
+	defer m1.Shutdown()
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{
+		Node:        addr2.String(),
+		Addr:        ip2,
+		Port:        7946,
+		Incarnation: 1,
+		Vsn: []uint8{
+			ProtocolVersionMin,
+			ProtocolVersionMax,
+			m1.config.ProtocolVersion,
+			m1.config.DelegateProtocolMin,
+			m1.config.DelegateProtocolMax,
+			m1.config.DelegateProtocolVersion,
+		},
+	}
+	m1.aliveNode(&a2, nil, false)
+
+	rtt, err := m1.PingNode(addr2.String(), time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !(rtt > 0) {
+		t.Fatalf("bad: %v", rtt)
+	}
+
+	if _, err := m1.PingNode("nope", time.Second); err == nil {
+		t.Fatalf("should fail for an unknown node")
+	}
+
+	// Isolate m2 from UDP traffic so the TCP fallback has to answer.
+	if err = m2.udpListener.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	udpAddr := &net.UDPAddr{IP: ip2, Port: 9999}
+	if m2.udpListener, err = net.ListenUDP("udp", udpAddr); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	rtt, err = m1.PingNode(addr2.String(), time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !(rtt > 0) {
+		t.Fatalf("bad: %v", rtt)
+	}
+
+	// Without the fallback it times out.
+	m1.config.DisableTcpPings = true
+	_, err = m1.PingNode(addr2.String(), time.Second)
+	if _, ok := err.(NoPingResponseError); !ok {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
 func TestMemberList_ResetNodes(t *testing.T) {
 	m := GetMemberlist(t)
 	a1 := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -871,6 +1072,48 @@ func TestMemberList_ResetNodes(t *testing.T) {
 	}
 }
 
+type purgeRecorder struct {
+	nodes []string
+}
+
+func (p *purgeRecorder) NotifyPurge(n *Node) {
+	p.nodes = append(p.nodes, n.Name)
+}
+
+func TestMemberList_ResetNodes_Purge(t *testing.T) {
+	p := &purgeRecorder{}
+	c := testConfig()
+	c.Purge = p
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("failed to start: %v", err)
+	}
+	defer m.Shutdown()
+
+	a1 := alive{Node: "test1", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a1, nil, false)
+	a2 := alive{Node: "test2", Addr: []byte{127, 0, 0, 2}, Incarnation: 1}
+	m.aliveNode(&a2, nil, false)
+	d := dead{Node: "test2", Incarnation: 1}
+	m.deadNode(&d)
+
+	// Nothing is purged until the nodes are reset.
+	if len(p.nodes) != 0 {
+		t.Fatalf("bad: %v", p.nodes)
+	}
+
+	m.resetNodes()
+	if !reflect.DeepEqual(p.nodes, []string{"test2"}) {
+		t.Fatalf("bad: %v", p.nodes)
+	}
+
+	// Only once.
+	m.resetNodes()
+	if len(p.nodes) != 1 {
+		t.Fatalf("bad: %v", p.nodes)
+	}
+}
+
 func TestMemberList_NextSeq(t *testing.T) {
 	m := &Memberlist{}
 	if m.nextSeqNo() != 1 {
@@ -924,7 +1167,7 @@ func TestMemberList_invokeAckHandler(t *testing.T) {
 	m.setAckHandler(0, f, 10*time.Millisecond)
 
 	// Should set b
-	m.invokeAckHandler(ackResp{0, nil}, time.Now())
+	m.invokeAckHandler(ackResp{SeqNo: 0}, time.Now())
 	if !b {
 		t.Fatalf("b not set")
 	}
@@ -937,13 +1180,13 @@ func TestMemberList_invokeAckHandler(t *testing.T) {
 func TestMemberList_invokeAckHandler_Channel_Ack(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
-	ack := ackResp{0, []byte{0, 0, 0}}
+	ack := ackResp{SeqNo: 0, Payload: []byte{0, 0, 0}}
 
 	// Does nothing
 	m.invokeAckHandler(ack, time.Now())
 
 	ackCh := make(chan ackMessage, 1)
-	nackCh := make(chan struct{}, 1)
+	nackCh := make(chan nackReason, 1)
 	m.setProbeChannels(0, ackCh, nackCh, 10*time.Millisecond)
 
 	// Should send message
@@ -973,13 +1216,13 @@ func TestMemberList_invokeAckHandler_Channel_Ack(t *testing.T) {
 func TestMemberList_invokeAckHandler_Channel_Nack(t *testing.T) {
 	m := &Memberlist{ackHandlers: make(map[uint32]*ackHandler)}
 
-	nack := nackResp{0}
+	nack := nackResp{SeqNo: 0}
 
 	// Does nothing.
 	m.invokeNackHandler(nack)
 
 	ackCh := make(chan ackMessage, 1)
-	nackCh := make(chan struct{}, 1)
+	nackCh := make(chan nackReason, 1)
 	m.setProbeChannels(0, ackCh, nackCh, 10*time.Millisecond)
 
 	// Should send message.
@@ -1002,7 +1245,7 @@ func TestMemberList_invokeAckHandler_Channel_Nack(t *testing.T) {
 		t.Fatalf("handler should not be reaped")
 	}
 
-	ack := ackResp{0, []byte{0, 0, 0}}
+	ack := ackResp{SeqNo: 0, Payload: []byte{0, 0, 0}}
 	m.invokeAckHandler(ack, time.Now())
 
 	select {
@@ -1198,6 +1441,75 @@ func TestMemberList_AliveNode_ChangeMeta(t *testing.T) {
 
 }
 
+func TestMemberList_AliveNode_MetaMergeLWW(t *testing.T) {
+	msgs := []alive{
+		{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("a"), MetaTime: 100},
+		{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("c"), MetaTime: 200},
+		{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("b"), MetaTime: 200},
+		{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1, Meta: []byte("d"), MetaTime: 50},
+	}
+
+	// Whatever order the messages arrive in, the newest metadata wins,
+	// with ties going to the greater metadata.
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		m := GetMemberlist(t)
+		m.config.MetaMergeLWW = true
+		for _, i := range order {
+			a := msgs[i]
+			m.aliveNode(&a, nil, false)
+		}
+		if meta := string(m.nodeMap["test"].Meta); meta != "c" {
+			t.Fatalf("order %v: got %q", order, meta)
+		}
+		m.Shutdown()
+	}
+
+	// Otherwise the first one wins.
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	for _, i := range []int{3, 1} {
+		a := msgs[i]
+		m.aliveNode(&a, nil, false)
+	}
+	if meta := string(m.nodeMap["test"].Meta); meta != "d" {
+		t.Fatalf("got %q", meta)
+	}
+}
+
+func TestMemberList_AliveNode_MetaMergeLWW_Local(t *testing.T) {
+	meta := []byte("one")
+	m := HostMemberlist(getBindAddr().String(), t, func(c *Config) {
+		c.MetaMergeLWW = true
+		c.Delegate = &MockDelegate{meta: meta}
+	})
+	defer m.Shutdown()
+	if err := m.setAlive(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	state := m.nodeMap[m.config.Name]
+	stamp := state.metaTime
+	if stamp == 0 {
+		t.Fatalf("should stamp our metadata")
+	}
+
+	// The stamp only moves when the metadata changes.
+	if err := m.UpdateNode(0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state.metaTime != stamp {
+		t.Fatalf("stamp moved")
+	}
+	m.config.Delegate.(*MockDelegate).meta = []byte("two")
+	time.Sleep(time.Millisecond)
+	if err := m.UpdateNode(0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if state.metaTime <= stamp {
+		t.Fatalf("stamp should move")
+	}
+}
+
 func TestMemberList_AliveNode_Refute(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: m.config.Name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
@@ -1247,7 +1559,7 @@ func TestMemberList_SuspectNode_NoNode(t *testing.T) {
 func TestMemberList_SuspectNode(t *testing.T) {
 	m := GetMemberlist(t)
 	m.config.ProbeInterval = time.Millisecond
-	m.config.SuspicionMult = 1
+	setTunables(t, m, func(tun *Tunables) { tun.SuspicionMult = 1 })
 	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
 	m.aliveNode(&a, nil, false)
 
@@ -1453,6 +1765,53 @@ func TestMemberList_DeadNode(t *testing.T) {
 	}
 }
 
+type leaveReasonDelegate struct {
+	joins   []string
+	leaves  []string
+	reasons []LeaveReason
+}
+
+func (d *leaveReasonDelegate) NotifyJoin(n *Node) {
+	d.joins = append(d.joins, n.Name)
+}
+
+func (d *leaveReasonDelegate) NotifyLeave(n *Node, reason LeaveReason) {
+	d.leaves = append(d.leaves, n.Name)
+	d.reasons = append(d.reasons, reason)
+}
+
+func (d *leaveReasonDelegate) NotifyUpdate(n *Node) {}
+
+func TestMemberList_DeadNode_LeaveReason(t *testing.T) {
+	ch := make(chan NodeEvent, 4)
+	events := &leaveReasonDelegate{}
+	m := GetMemberlist(t)
+	m.config.Events = &ChannelEventDelegate{ch}
+	m.config.EventsV2 = events
+
+	for _, name := range []string{"failed", "graceful"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	m.deadNode(&dead{Node: "failed", Incarnation: 1, From: m.config.Name})
+	m.deadNode(&dead{Node: "graceful", Incarnation: 1, From: "graceful"})
+
+	if !reflect.DeepEqual(events.joins, []string{"failed", "graceful"}) {
+		t.Fatalf("bad: %v", events.joins)
+	}
+	if !reflect.DeepEqual(events.leaves, []string{"failed", "graceful"}) {
+		t.Fatalf("bad: %v", events.leaves)
+	}
+	if !reflect.DeepEqual(events.reasons, []LeaveReason{LeaveFailed, LeaveGraceful}) {
+		t.Fatalf("bad: %v", events.reasons)
+	}
+
+	// The original delegate still hears about everything.
+	if len(ch) != 4 {
+		t.Fatalf("bad: %d", len(ch))
+	}
+}
+
 func TestMemberList_DeadNode_Double(t *testing.T) {
 	ch := make(chan NodeEvent, 1)
 	m := GetMemberlist(t)
@@ -1503,6 +1862,28 @@ func TestMemberList_DeadNode_OldDead(t *testing.T) {
 	}
 }
 
+func TestMemberList_DeadNodeNotify_Ignored(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 10}
+	m.aliveNode(&a, nil, false)
+
+	// Nothing is broadcast for an ignored message, so there's nothing to
+	// wait on.
+	notify := make(chan struct{}, 1)
+	if m.deadNodeNotify(&dead{Node: "test", Incarnation: 1}, notify) {
+		t.Fatalf("should ignore an old incarnation")
+	}
+	if m.deadNodeNotify(&dead{Node: "nope", Incarnation: 10}, notify) {
+		t.Fatalf("should ignore an unknown node")
+	}
+	if !m.deadNodeNotify(&dead{Node: "test", Incarnation: 10}, notify) {
+		t.Fatalf("should apply")
+	}
+	if m.deadNodeNotify(&dead{Node: "test", Incarnation: 10}, notify) {
+		t.Fatalf("should ignore a node already dead")
+	}
+}
+
 func TestMemberList_DeadNode_AliveReplay(t *testing.T) {
 	m := GetMemberlist(t)
 	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 10}
@@ -1680,6 +2061,62 @@ func TestMemberlist_Gossip(t *testing.T) {
 	}
 }
 
+func TestMemberlist_Gossip_MixedVersions(t *testing.T) {
+	c := testConfig()
+	c.GossipInterval = 0
+	c.EnableCompression = false
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	// Stand in for a node from before compound2 and one that has it.
+	listen := func(name string, pmax uint8) *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: getBindAddr()})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		addr := conn.LocalAddr().(*net.UDPAddr)
+		a := alive{
+			Node:        name,
+			Addr:        addr.IP,
+			Port:        uint16(addr.Port),
+			Incarnation: 1,
+			Vsn:         []uint8{ProtocolVersionMin, pmax, ProtocolVersion2Compatible, 0, 0, 0},
+		}
+		m.aliveNode(&a, nil, false)
+		return conn
+	}
+	old := listen("old", 4)
+	defer old.Close()
+	cur := listen("new", ProtocolVersionMax)
+	defer cur.Close()
+
+	m.gossip()
+
+	expect := map[*net.UDPConn]messageType{old: compoundMsg, cur: compound2Msg}
+	for conn, msgType := range expect {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, udpBufSize)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if messageType(buf[0]) != msgType {
+			t.Fatalf("expected message type %d, got %d", msgType, buf[0])
+		}
+		decodeParts := decodeCompoundMessage
+		if msgType == compound2Msg {
+			decodeParts = decodeCompound2Message
+		}
+		// Each gets our alive message and both of theirs.
+		if _, parts, err := decodeParts(buf[1:n]); err != nil || len(parts) != 3 {
+			t.Fatalf("bad compound: %d parts, %v", len(parts), err)
+		}
+	}
+}
+
 func TestMemberlist_PushPull(t *testing.T) {
 	addr1 := getBindAddr()
 	addr2 := getBindAddr()
@@ -1717,6 +2154,48 @@ func TestMemberlist_PushPull(t *testing.T) {
 	}
 }
 
+func TestMemberlist_SyncNow(t *testing.T) {
+	m1 := GetMemberlist(t)
+	m1.setAlive()
+	defer m1.Shutdown()
+
+	if err := m1.SyncNow(); err != ErrNoMembers {
+		t.Fatalf("bad: %v", err)
+	}
+
+	m2 := GetMemberlist(t)
+	m2.setAlive()
+	defer m2.Shutdown()
+
+	// Tell m1 about m2 without m2 hearing about m1.
+	m1.aliveNode(&alive{
+		Node:        m2.config.Name,
+		Addr:        net.ParseIP(m2.config.BindAddr),
+		Port:        uint16(m2.config.BindPort),
+		Incarnation: 1,
+		Vsn: []uint8{
+			ProtocolVersionMin,
+			ProtocolVersionMax,
+			m2.config.ProtocolVersion,
+			m2.config.DelegateProtocolMin,
+			m2.config.DelegateProtocolMax,
+			m2.config.DelegateProtocolVersion,
+		},
+	}, nil, false)
+
+	if err := m1.SyncNow(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if m2.NumMembers() != 2 {
+		t.Fatalf("should have 2 nodes! %v", m2.Members())
+	}
+
+	m1.Shutdown()
+	if err := m1.SyncNow(); err != ErrShutdown {
+		t.Fatalf("bad: %v", err)
+	}
+}
+
 func TestVerifyProtocol(t *testing.T) {
 	cases := []struct {
 		Anodes   [][3]uint8
@@ -1838,3 +2317,174 @@ func testVerifyProtocolSingle(t *testing.T, A [][6]uint8, B [][6]uint8, expect b
 		t.Fatalf("bad:\nA: %v\nB: %v\nErr: %s", A, B, err)
 	}
 }
+
+type suspicionRecorder struct {
+	ch chan SuspicionEvent
+}
+
+func (r *suspicionRecorder) NotifySuspicion(ev SuspicionEvent) {
+	r.ch <- ev
+}
+
+func TestMemberList_SuspicionDelegate_Refuted(t *testing.T) {
+	rec := &suspicionRecorder{ch: make(chan SuspicionEvent, 1)}
+	m := GetMemberlist(t)
+	setTunables(t, m, func(tun *Tunables) { tun.SuspicionMult = 4 })
+	m.config.Suspicion = rec
+	for _, name := range []string{"test", "a", "b", "c", "d"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "a"})
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "b"})
+	m.aliveNode(&alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 2}, nil, false)
+
+	select {
+	case ev := <-rec.ch:
+		if ev.Node != "test" || ev.From != "a" || ev.Outcome != SuspicionRefuted || ev.TimedOut {
+			t.Fatalf("bad: %#v", ev)
+		}
+		if ev.Confirmations != 1 || ev.Expected != 2 {
+			t.Fatalf("bad: %#v", ev)
+		}
+		if ev.Start.IsZero() || ev.Duration < 0 {
+			t.Fatalf("bad: %#v", ev)
+		}
+	default:
+		t.Fatalf("should have been notified")
+	}
+}
+
+func TestMemberList_SuspicionDelegate_TimedOut(t *testing.T) {
+	rec := &suspicionRecorder{ch: make(chan SuspicionEvent, 1)}
+	m := GetMemberlist(t)
+	m.config.ProbeInterval = time.Millisecond
+	setTunables(t, m, func(tun *Tunables) { tun.SuspicionMult = 1 })
+	m.config.Suspicion = rec
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: m.config.Name})
+
+	select {
+	case ev := <-rec.ch:
+		if ev.From != m.config.Name || ev.Outcome != SuspicionDead || !ev.TimedOut {
+			t.Fatalf("bad: %#v", ev)
+		}
+		if ev.Confirmations != 0 || ev.Expected != 0 {
+			t.Fatalf("bad: %#v", ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("should have been notified")
+	}
+}
+
+func TestMemberList_SuspicionInfo(t *testing.T) {
+	m := GetMemberlist(t)
+	setTunables(t, m, func(tun *Tunables) { tun.SuspicionMult = 4 })
+	for _, name := range []string{"test", "a", "b", "c", "d"} {
+		a := alive{Node: name, Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+		m.aliveNode(&a, nil, false)
+	}
+	if _, ok := m.SuspicionInfo("test"); ok {
+		t.Fatalf("should not be suspect")
+	}
+
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "a"})
+	info, ok := m.SuspicionInfo("test")
+	if !ok {
+		t.Fatalf("should be suspect")
+	}
+	if info.From != "a" || info.Confirmations != 0 || info.Expected != 2 {
+		t.Fatalf("bad: %#v", info)
+	}
+	timer := m.nodeTimers["test"]
+	if info.Start != timer.start || info.Deadline != timer.start.Add(timer.max) {
+		t.Fatalf("bad: %#v", info)
+	}
+	if r := info.Remaining(); r <= 0 || r > timer.max {
+		t.Fatalf("bad: %v", r)
+	}
+
+	// A confirmation brings the deadline in, and enough of them bring it
+	// down to the minimum.
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "b"})
+	confirmed, _ := m.SuspicionInfo("test")
+	if confirmed.Confirmations != 1 || !confirmed.Deadline.Before(info.Deadline) {
+		t.Fatalf("bad: %#v", confirmed)
+	}
+	m.suspectNode(&suspect{Node: "test", Incarnation: 1, From: "c"})
+	confirmed, _ = m.SuspicionInfo("test")
+	if confirmed.Confirmations != 2 || confirmed.Deadline != timer.start.Add(timer.min) {
+		t.Fatalf("bad: %#v", confirmed)
+	}
+
+	// Once refuted, there's no more suspicion.
+	m.aliveNode(&alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 2}, nil, false)
+	if _, ok := m.SuspicionInfo("test"); ok {
+		t.Fatalf("should not be suspect")
+	}
+
+	if r := (SuspicionInfo{Deadline: time.Now().Add(-time.Second)}).Remaining(); r != 0 {
+		t.Fatalf("bad: %v", r)
+	}
+}
+
+func TestMemberList_SuspectNode_Origin(t *testing.T) {
+	m := GetMemberlist(t)
+	a := alive{Node: "test", Addr: []byte{127, 0, 0, 1}, Incarnation: 1}
+	m.aliveNode(&a, nil, false)
+	m.broadcasts.Reset()
+
+	// Our own suspicion is stamped with us as its origin.
+	s := suspect{Node: "test", Incarnation: 1, From: m.config.Name}
+	m.suspectNode(&s)
+
+	msg := m.broadcasts.bcQueue[0].b.Message()
+	var out suspect
+	if err := decode(msg[1:], &out); err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if out.Origin != m.config.Name || out.Hops != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestMemberList_SuspectNode_RefuteDirect(t *testing.T) {
+	addr1 := getBindAddr()
+	addr2 := getBindAddr()
+	ip1 := []byte(addr1)
+	ip2 := []byte(addr2)
+
+	m1 := HostMemberlist(addr1.String(), t, nil)
+	defer m1.Shutdown()
+	m2 := HostMemberlist(addr2.String(), t, nil)
+	defer m2.Shutdown()
+
+	a1 := alive{Node: addr1.String(), Addr: ip1, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a1, nil, true)
+	a2 := alive{Node: addr2.String(), Addr: ip2, Port: 7946, Incarnation: 1}
+	m1.aliveNode(&a2, nil, false)
+
+	// m2 accuses m1, which isn't gossiping, so the refutation can only
+	// reach m2 by being sent directly.
+	s := suspect{Node: addr1.String(), Incarnation: 1, From: addr2.String()}
+	m1.suspectNode(&s)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		m2.nodeLock.RLock()
+		state, ok := m2.nodeMap[addr1.String()]
+		inc := uint32(0)
+		if ok {
+			inc = state.Incarnation
+		}
+		m2.nodeLock.RUnlock()
+		if inc > 1 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("refutation was not sent to the accuser")
+}
@@ -0,0 +1,92 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Streams are read from peers we haven't authenticated yet, so everything a
+peer claims about the size of what follows is checked before we act on it.
+Sealed payloads, push/pull and user message lengths, node counts and
+decompressed sizes are all capped at maxPushStateBytes, and plain streams
+are cut off there too.
+
+Reading an incoming stream happens in two stages. The header stage covers
+any PROXY protocol header, the label, the message type and, for a sealed
+stream, its length, and has to finish within StreamHeaderTimeout. Only then
+does the peer get the rest of TCPTimeout to send the payload, so a peer
+that connects and trickles bytes can't hold a handler for long.
+*/
+
+const (
+	// maxPreallocNodes caps how many node states we allocate up front for
+	// a push/pull, whatever the header claims.
+	maxPreallocNodes = 1024
+)
+
+// errStreamTooLarge is returned when a peer claims more than we'll read.
+type errStreamTooLarge struct {
+	what string
+	size int64
+}
+
+func (e errStreamTooLarge) Error() string {
+	return fmt.Sprintf("Remote %s is larger than limit (%d)", e.what, e.size)
+}
+
+// checkStreamLen makes sure a length read from a stream is within limits,
+// counting it in the oversized metric if not. It isn't scored as a
+// misbehavior violation, since streams come from ephemeral ports and the
+// score wouldn't follow the peer's packets.
+func checkStreamLen(what string, size int64) error {
+	if size < 0 || size > maxPushStateBytes {
+		metrics.IncrCounter([]string{"memberlist", "stream", "oversized"}, 1)
+		return errStreamTooLarge{what, size}
+	}
+	return nil
+}
+
+// streamStages moves an incoming stream's deadline from the header stage
+// to the payload stage.
+type streamStages struct {
+	conn    net.Conn
+	start   time.Time
+	timeout time.Duration
+	payload bool
+}
+
+// newStreamStages sets the header stage deadline on conn.
+func (m *Memberlist) newStreamStages(conn net.Conn) *streamStages {
+	s := &streamStages{conn: conn, start: time.Now(), timeout: m.tune().TCPTimeout}
+	header := m.config.StreamHeaderTimeout
+	if header <= 0 || header > s.timeout {
+		header = s.timeout
+	}
+	conn.SetDeadline(s.start.Add(header))
+	return s
+}
+
+// headerDone starts the payload stage.
+func (s *streamStages) headerDone() {
+	if s.payload {
+		return
+	}
+	s.payload = true
+	s.conn.SetDeadline(s.start.Add(s.timeout))
+}
+
+// recordError counts err if it's a timeout, by the stage it happened in.
+func (s *streamStages) recordError(err error) {
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		return
+	}
+	stage := "header"
+	if s.payload {
+		stage = "payload"
+	}
+	metrics.IncrCounter([]string{"memberlist", "stream", "timeout", stage}, 1)
+}
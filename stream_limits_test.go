@@ -0,0 +1,98 @@
+package memberlist
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+func TestMemberlist_ReadRemoteState_Limits(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	headers := []pushPullHeader{
+		{Nodes: 1 << 30},
+		{Nodes: -1},
+		{UserStateLen: maxPushStateBytes + 1},
+	}
+	for _, header := range headers {
+		var buf bytes.Buffer
+		hd := codec.MsgpackHandle{}
+		if err := codec.NewEncoder(&buf, &hd).Encode(&header); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		r := bytes.NewReader(buf.Bytes())
+		_, _, _, err := m.readRemoteState(r, codec.NewDecoder(r, &hd))
+		if _, ok := err.(errStreamTooLarge); !ok {
+			t.Fatalf("expected limit error for %+v, got %v", header, err)
+		}
+	}
+}
+
+func TestMemberlist_ReadUserMsg_Limit(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+
+	var buf bytes.Buffer
+	hd := codec.MsgpackHandle{}
+	header := userMsgHeader{UserMsgLen: maxPushStateBytes + 1}
+	if err := codec.NewEncoder(&buf, &hd).Encode(&header); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	r := bytes.NewReader(buf.Bytes())
+	if _, ok := m.readUserMsg(r, codec.NewDecoder(r, &hd), "").(errStreamTooLarge); !ok {
+		t.Fatalf("expected limit error")
+	}
+}
+
+func TestDecompressBuffer_Limit(t *testing.T) {
+	compressed, err := compressPayload(make([]byte, maxPushStateBytes+1))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := decompressPayload(compressed.Bytes()[1:]); err == nil {
+		t.Fatalf("expected decompressed size to be limited")
+	}
+
+	compressed, err = compressPayload(make([]byte, 1024))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	out, err := decompressPayload(compressed.Bytes()[1:])
+	if err != nil || len(out) != 1024 {
+		t.Fatalf("bad: %d %v", len(out), err)
+	}
+}
+
+func TestMemberlist_HandleConn_HeaderTimeout(t *testing.T) {
+	c := testConfig()
+	c.TCPTimeout = 10 * time.Second
+	c.StreamHeaderTimeout = 50 * time.Millisecond
+	m, err := NewMemberlistOnOpenPort(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(m.config.BindAddr, strconv.Itoa(m.config.BindPort)))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	// Send nothing; we should be hung up on well before TCPTimeout.
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatalf("expected the connection to be closed")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("connection held for %v", elapsed)
+	}
+}
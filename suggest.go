@@ -0,0 +1,217 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+SuggestMember lets an integration that already knows the cluster's
+membership, say from a service registry or an orchestrator, hand us members
+directly instead of leaving us to learn about them through gossip or a
+push/pull.
+
+A suggestion is only a lead: nothing about the node goes into our state
+until it has answered us. We ping it by name with Introduce set, sending
+our own alive message along in the same packet so it learns of us as it
+would from a multicast announcement. A node that knows about introductions
+sends its own alive message back ahead of the ack, and that goes through
+the same checks as any other (the Alive delegate, bans, admission), so the
+node joins our view with its real incarnation, metadata and versions, and
+is gossiped on from there.
+
+A node too old to introduce itself only acks. We never make up state for
+it, since anything we took in would be gossiped on as if the node had said
+it. Instead we push/pull with it, as a join would, and take in whatever it
+tells us about itself from there. Until one or the other happens, the
+suggestion stays ours alone: it's only pinged, never gossiped.
+
+A suggestion that isn't answered, or whose push/pull fails, is tried
+suggestAttempts times, a probe interval apart, in case the node is still
+starting up, and then dropped.
+*/
+
+// suggestAttempts is how many times we ping a suggested member before
+// giving up on it.
+const suggestAttempts = 3
+
+// suggestions tracks the suggested members we're waiting to hear from.
+type suggestions struct {
+	sync.Mutex
+	pending map[string]chan struct{} // Closed once the node's alive arrives
+}
+
+// add starts waiting for a node, returning false if we already are.
+func (s *suggestions) add(node string) (chan struct{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.pending == nil {
+		s.pending = make(map[string]chan struct{})
+	}
+	if _, ok := s.pending[node]; ok {
+		return nil, false
+	}
+	ch := make(chan struct{})
+	s.pending[node] = ch
+	return ch, true
+}
+
+// arrived notes that a node's alive message has been taken in.
+func (s *suggestions) arrived(node string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if ch, ok := s.pending[node]; ok {
+		close(ch)
+		delete(s.pending, node)
+	}
+}
+
+// remove stops waiting for a node.
+func (s *suggestions) remove(node string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.pending, node)
+}
+
+// SuggestMember hands us a member learned outside the cluster, named name
+// and listening at addr, a host:port that defaults to our BindPort. The
+// node is pinged and asked to introduce itself, joining our view once it
+// has, without a push/pull. A node too old to introduce itself is
+// push/pulled with instead. See the notes in suggest.go.
+//
+// This returns once the suggestion is under way. Suggesting ourselves, a
+// member we already consider alive, or one already suggested does nothing.
+func (m *Memberlist) SuggestMember(addr, name string) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+	if name == m.config.Name {
+		return nil
+	}
+
+	m.nodeLock.RLock()
+	state, ok := m.nodeMap[name]
+	known := ok && state.State.active()
+	m.nodeLock.RUnlock()
+	if known {
+		return nil
+	}
+
+	addrs, err := m.resolveAddr(addr)
+	if err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("No addresses found for %s", addr)
+	}
+
+	arrived, ok := m.suggested.add(name)
+	if !ok {
+		return nil
+	}
+	go m.introduceSuggested(name, addrs[0], arrived)
+	return nil
+}
+
+// introduceSuggested pings a suggested member until it introduces itself,
+// push/pulling with it instead if it acks without doing so.
+func (m *Memberlist) introduceSuggested(name string, addr ipPort, arrived chan struct{}) {
+	defer m.suggested.remove(name)
+	to := &net.UDPAddr{IP: addr.ip, Port: int(addr.port)}
+
+	for i := 0; i < suggestAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(m.config.ProbeInterval):
+			case <-m.shutdownCh:
+				return
+			}
+		}
+
+		acked, err := m.pingIntroduce(name, to)
+		if err == ErrShutdown {
+			return
+		} else if err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to ping suggested member %s: %s %s", name, err, LogAddress(to))
+			return
+		}
+		if !acked {
+			continue
+		}
+
+		// The alive message is sent ahead of the ack, but it's handled
+		// off the packet listener, so give it a moment to land.
+		select {
+		case <-arrived:
+			metrics.IncrCounter([]string{"memberlist", "suggest", "introduced"}, 1)
+			return
+		case <-time.After(m.tune().ProbeTimeout):
+		case <-m.shutdownCh:
+			return
+		}
+
+		m.logger.Printf("[DEBUG] memberlist: Suggested member %s didn't introduce itself, pushing/pulling with it", name)
+		if err := m.pushPullNode(addr.ip, addr.port, false); err != nil {
+			m.logger.Printf("[DEBUG] memberlist: Failed to push/pull with suggested member %s: %s %s", name, err, LogAddress(to))
+			continue
+		}
+		metrics.IncrCounter([]string{"memberlist", "suggest", "synced"}, 1)
+		return
+	}
+
+	metrics.IncrCounter([]string{"memberlist", "suggest", "failed"}, 1)
+	m.logger.Printf("[WARN] memberlist: Suggested member %s didn't answer %s", name, LogAddress(to))
+}
+
+// pingIntroduce pings a node by name, asking it to introduce itself and
+// introducing ourselves, and returns true if it acks within the probe
+// timeout.
+func (m *Memberlist) pingIntroduce(name string, to net.Addr) (bool, error) {
+	m.inflight.start(inflightProbe)
+	defer m.inflight.done(inflightProbe)
+
+	p := m.newPing(m.nextSeqNo(), name)
+	p.Introduce = true
+	out, err := encode(pingMsg, &p)
+	if err != nil {
+		return false, err
+	}
+	msgs := [][]byte{out.Bytes()}
+	if me, err := m.encodeLocalAlive(); err != nil {
+		return false, err
+	} else if me != nil {
+		msgs = append(msgs, me)
+	}
+
+	ackCh := make(chan ackMessage, 1)
+	m.setProbeChannels(p.SeqNo, ackCh, nil, m.tune().ProbeTimeout)
+	if err := m.rawSendMsgsUDP(to, makeCompoundMessages(msgs, false)); err != nil {
+		return false, err
+	}
+
+	select {
+	case v := <-ackCh:
+		return v.Complete, nil
+	case <-m.shutdownCh:
+		return false, ErrShutdown
+	}
+}
+
+// introduce sends our alive message to a node that asked for it.
+func (m *Memberlist) introduce(to net.Addr) {
+	me, err := m.encodeLocalAlive()
+	if err != nil || me == nil {
+		return
+	}
+	if err := m.rawSendMsgUDP(to, me); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to send introduction: %s %s", err, LogAddress(to))
+	}
+}
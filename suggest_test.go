@@ -0,0 +1,211 @@
+package memberlist
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_SuggestMember(t *testing.T) {
+	m1, err := Create(testConfig())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if err := m2.UpdateNode(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The port defaults to ours, which m2 shares.
+	if err := m1.SuggestMember(c2.BindAddr, c2.Name); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Each learns the other from its own alive message, without a push/pull.
+	deadline := time.Now().Add(2 * time.Second)
+	for m1.NumMembers() != 2 || m2.NumMembers() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("should know each other: %v %v", m1.Members(), m2.Members())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m1.nodeLock.RLock()
+	state := m1.nodeMap[c2.Name]
+	inc, meta, pmax := state.Incarnation, state.Meta, state.PMax
+	m1.nodeLock.RUnlock()
+	if inc != m2.incarnation || len(meta) != 0 || pmax == 0 {
+		t.Fatalf("bad: %d %q %d", inc, meta, pmax)
+	}
+}
+
+// ackOnly answers pings on conn with a bare ack, standing in for a node
+// that doesn't know about introductions.
+func ackOnly(conn *net.UDPConn) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if messageType(buf[0]) != compoundMsg {
+			continue
+		}
+		_, parts, err := decodeCompoundMessage(buf[1:n])
+		if err != nil || messageType(parts[0][0]) != pingMsg {
+			continue
+		}
+		var p ping
+		if err := decode(parts[0][1:], &p); err != nil {
+			continue
+		}
+		out, err := encode(ackRespMsg, &ackResp{SeqNo: p.SeqNo})
+		if err != nil {
+			continue
+		}
+		conn.WriteTo(out.Bytes(), from)
+	}
+}
+
+func TestMemberlist_SuggestMember_Old(t *testing.T) {
+	// Keep pings plain so the stand-in below can read them.
+	c := testConfig()
+	c.EnableCompression = false
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	c2 := testConfig()
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if err := m2.UpdateNode(time.Second); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Stand in for m2 as a node that acks but doesn't know about
+	// introductions, passing streams through to the real thing so a
+	// push/pull gets its state.
+	ip := getBindAddr()
+	old, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer old.Close()
+	go ackOnly(old)
+	stream, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: old.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer stream.Close()
+	go func() {
+		for {
+			in, err := stream.Accept()
+			if err != nil {
+				return
+			}
+			out, err := net.Dial("tcp", net.JoinHostPort(c2.BindAddr, strconv.Itoa(m2.config.BindPort)))
+			if err != nil {
+				in.Close()
+				continue
+			}
+			go func() {
+				io.Copy(out, in)
+				out.Close()
+			}()
+			go func() {
+				io.Copy(in, out)
+				in.Close()
+			}()
+		}
+	}()
+
+	if err := m.SuggestMember(old.LocalAddr().String(), c2.Name); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It's taken in as it says it is, not as suggested.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m.nodeLock.RLock()
+		var n Node
+		var inc uint32
+		state, ok := m.nodeMap[c2.Name]
+		alive := ok && state.State == stateAlive
+		if alive {
+			n, inc = state.Node, state.Incarnation
+		}
+		m.nodeLock.RUnlock()
+		if alive {
+			if inc != m2.incarnation || n.Port != uint16(m2.config.BindPort) {
+				t.Fatalf("bad: %d %#v", inc, n)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("should take in the suggestion")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Suggesting a member we have alive does nothing.
+	if err := m.SuggestMember(old.LocalAddr().String(), c2.Name); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, ok := m.suggested.add(c2.Name); !ok {
+		t.Fatalf("should not be pending")
+	}
+}
+
+func TestMemberlist_SuggestMember_OldNoPushPull(t *testing.T) {
+	c := testConfig()
+	c.EnableCompression = false
+	c.ProbeInterval = 20 * time.Millisecond
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	old, err := net.ListenUDP("udp", &net.UDPAddr{IP: getBindAddr()})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer old.Close()
+	go ackOnly(old)
+
+	if err := m.SuggestMember(old.LocalAddr().String(), "old"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Nothing is made up for it, and the suggestion is dropped.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := m.suggested.add("old"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("should drop the suggestion")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m.nodeLock.RLock()
+	_, ok := m.nodeMap["old"]
+	m.nodeLock.RUnlock()
+	if ok {
+		t.Fatalf("should not take in the suggestion")
+	}
+}
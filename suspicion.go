@@ -40,6 +40,9 @@ type suspicion struct {
 	// confirmations is a map of "from" nodes that have confirmed a given
 	// node is suspect. This prevents double counting.
 	confirmations map[string]struct{}
+
+	// from is the node that first suspected the node, for telemetry.
+	from string
 }
 
 // newSuspicion returns a timer started with the max time, and that will drive
@@ -53,6 +56,7 @@ func newSuspicion(from string, k int, min time.Duration, max time.Duration, fn f
 		min:           min,
 		max:           max,
 		confirmations: make(map[string]struct{}),
+		from:          from,
 	}
 
 	// Exclude the from node from any confirmations.
@@ -96,6 +100,16 @@ func remainingSuspicionTime(n, k int32, elapsed time.Duration, min, max time.Dur
 	return timeout - elapsed
 }
 
+// timeout returns the overall time from the start of the suspicion until
+// the node will be declared dead, given the confirmations seen so far.
+func (s *suspicion) timeout() time.Duration {
+	if s.k < 1 {
+		return s.min
+	}
+	n := atomic.LoadInt32(&s.n)
+	return remainingSuspicionTime(n, s.k, 0, s.min, s.max)
+}
+
 // Confirm registers that a possibly new peer has also determined the given
 // node is suspect. This returns true if this was new information, and false
 // if it was a duplicate confirmation, or if we've got enough confirmations to
@@ -0,0 +1,110 @@
+package memberlist
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SuspicionDelegate is used to report how each suspicion of another node
+// turned out, which is the data needed to tune SuspicionMult and
+// SuspicionMaxTimeoutMult.
+type SuspicionDelegate interface {
+	// NotifySuspicion is invoked once a node we suspected has either
+	// refuted the suspicion or been declared dead.
+	NotifySuspicion(SuspicionEvent)
+}
+
+// SuspicionOutcome says how a suspicion ended.
+type SuspicionOutcome int
+
+const (
+	// SuspicionRefuted means the node proved it was alive.
+	SuspicionRefuted SuspicionOutcome = iota
+
+	// SuspicionDead means the node was declared dead.
+	SuspicionDead
+)
+
+func (o SuspicionOutcome) String() string {
+	switch o {
+	case SuspicionRefuted:
+		return "refuted"
+	case SuspicionDead:
+		return "dead"
+	default:
+		return "unknown"
+	}
+}
+
+// SuspicionEvent describes a single suspicion, from the time we started
+// suspecting a node until it was resolved.
+type SuspicionEvent struct {
+	// Node is the suspected node, and From the node that first suspected
+	// it, which may be us.
+	Node string
+	From string
+
+	// Confirmations is the number of other nodes that independently
+	// suspected it, and Expected the number that would have brought the
+	// timeout down to its minimum.
+	Confirmations int
+	Expected      int
+
+	Outcome SuspicionOutcome
+
+	// TimedOut is true if the node was declared dead because our own
+	// suspicion timer ran out, rather than because we were told it was
+	// dead.
+	TimedOut bool
+
+	Start    time.Time
+	Duration time.Duration
+}
+
+// SuspicionInfo describes a suspicion that's still running.
+type SuspicionInfo struct {
+	// From is the node that first suspected the node, which may be us.
+	From string
+
+	// Confirmations and Expected are as for SuspicionEvent so far.
+	Confirmations int
+	Expected      int
+
+	// Start is when we began suspecting the node, and Deadline when it
+	// will be declared dead unless it refutes the suspicion first. The
+	// deadline comes in as more confirmations arrive.
+	Start    time.Time
+	Deadline time.Time
+}
+
+// Remaining returns how long is left until the deadline, or zero if it has
+// already passed.
+func (i SuspicionInfo) Remaining() time.Duration {
+	if d := time.Until(i.Deadline); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// SuspicionInfo returns the suspicion timer for the named node, and false if
+// we don't currently suspect it.
+func (m *Memberlist) SuspicionInfo(node string) (SuspicionInfo, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	timer, ok := m.nodeTimers[node]
+	if !ok {
+		return SuspicionInfo{}, false
+	}
+	expected := int(timer.k)
+	if expected < 0 {
+		expected = 0
+	}
+	return SuspicionInfo{
+		From:          timer.from,
+		Confirmations: int(atomic.LoadInt32(&timer.n)),
+		Expected:      expected,
+		Start:         timer.start,
+		Deadline:      timer.start.Add(timer.timeout()),
+	}, true
+}
@@ -0,0 +1,404 @@
+package memberlist
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Tree broadcasts are user messages spread along a spanning tree, after
+Plumtree, instead of by gossip, so that in a large, stable cluster each
+member gets each message about once rather than several times.
+
+Each member keeps a set of eager peers, starting with GossipNodes random
+members. A message is pushed in full to the eager peers straight away, and
+only announced, by its origin and sequence number, to GossipNodes other
+members. When a message turns up a second time, the member that sent the
+copy is pruned: both sides drop each other from their eager peers. Over the
+first few messages the eager links thin out to a tree, and from then on
+messages follow it.
+
+The announcements repair the tree. A member that hears about a message it
+doesn't get within TreeGraftTimeout grafts the member that told it: it
+asks for the message, and both sides add each other as eager peers again.
+If that doesn't work either, it tries the next member that announced it.
+
+Sequence numbers start from the clock rather than zero, so that after a
+restart our messages aren't taken for ones peers already have.
+
+Members keep the last few messages to answer grafts from. Receivers get
+messages through the delegate's NotifyMsg, and messages have to fit in a
+single UDP packet. Members running an older version don't understand tree
+broadcasts, and log them as unknown.
+*/
+
+// maxTreeMessages is how many tree broadcasts we remember, to spot
+// duplicates and answer grafts.
+const maxTreeMessages = 1024
+
+// treeGossip carries a tree broadcast.
+type treeGossip struct {
+	Origin  string `codec:"Origin"`
+	Seq     uint64 `codec:"Seq"`
+	Hops    int    `codec:"Hops"`
+	From    string `codec:"From"`
+	Payload []byte `codec:"Payload"`
+}
+
+// treeIHave announces a tree broadcast to a member that isn't an eager
+// peer.
+type treeIHave struct {
+	Origin string `codec:"Origin"`
+	Seq    uint64 `codec:"Seq"`
+	From   string `codec:"From"`
+}
+
+// treeGraft asks for a tree broadcast we've missed, and makes the sender
+// an eager peer of the receiver.
+type treeGraft struct {
+	Origin string `codec:"Origin"`
+	Seq    uint64 `codec:"Seq"`
+	From   string `codec:"From"`
+}
+
+// treePrune asks the receiver to stop pushing tree broadcasts to the
+// sender.
+type treePrune struct {
+	From string `codec:"From"`
+}
+
+// treeMessage is a tree broadcast we've had, or heard about.
+type treeMessage struct {
+	msg        *treeGossip // Nil until we have it
+	announcers []string    // Members that announced it, in order
+	timer      *time.Timer
+}
+
+// treeState is our side of the broadcast tree.
+type treeState struct {
+	sync.Mutex
+	started  bool
+	eager    map[string]struct{}
+	messages map[string]*treeMessage
+	order    []string // Message keys, oldest first
+}
+
+// treeKey identifies a tree broadcast.
+func treeKey(origin string, seq uint64) string {
+	return origin + "/" + strconv.FormatUint(seq, 10)
+}
+
+// BroadcastTree sends a user message to every member of the cluster along
+// a broadcast tree, which receive it through the delegate's NotifyMsg.
+// It suits large clusters that send a steady stream of messages, where it
+// sends far fewer copies than gossip once the tree has formed. The message
+// has to fit in a single UDP packet.
+func (m *Memberlist) BroadcastTree(msg []byte) error {
+	select {
+	case <-m.shutdownCh:
+		return ErrShutdown
+	default:
+	}
+
+	g := &treeGossip{
+		Origin:  m.config.Name,
+		Seq:     atomic.AddUint64(&m.treeSeqNum, 1),
+		From:    m.config.Name,
+		Payload: msg,
+	}
+	out, err := encode(treeGossipMsg, g)
+	if err != nil {
+		return err
+	}
+	if avail := udpSendBuf - m.securityOverhead(); out.Len() > avail {
+		return fmt.Errorf("Message of %d bytes is larger than the %d that fit in a packet", out.Len(), avail)
+	}
+
+	m.tree.Lock()
+	m.rememberTree(treeKey(g.Origin, g.Seq)).msg = g
+	m.tree.Unlock()
+
+	m.forwardTree(g, "")
+	return nil
+}
+
+// rememberTree returns the entry for a message, adding it if it's new and
+// forgetting the oldest one to make room. The tree lock must be held.
+func (m *Memberlist) rememberTree(key string) *treeMessage {
+	if e, ok := m.tree.messages[key]; ok {
+		return e
+	}
+	if m.tree.messages == nil {
+		m.tree.messages = make(map[string]*treeMessage)
+	}
+	e := &treeMessage{}
+	m.tree.messages[key] = e
+	m.tree.order = append(m.tree.order, key)
+	if len(m.tree.order) > maxTreeMessages {
+		if old := m.tree.messages[m.tree.order[0]]; old.timer != nil {
+			old.timer.Stop()
+		}
+		delete(m.tree.messages, m.tree.order[0])
+		m.tree.order = m.tree.order[1:]
+	}
+	return e
+}
+
+// treeTargets returns the eager peers to push a message to, and the
+// members to announce it to, leaving out the member we got it from. The
+// first time there are other members, some are picked at random to be
+// eager peers. Peers that are no longer alive are dropped.
+func (m *Memberlist) treeTargets(from string) (eager, lazy []*nodeState) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+	m.tree.Lock()
+	defer m.tree.Unlock()
+
+	if !m.tree.started {
+		if m.tree.eager == nil {
+			m.tree.eager = make(map[string]struct{})
+		}
+		for _, n := range kRandomNodes(m.tune().GossipNodes, []string{m.config.Name}, m.nodes) {
+			m.tree.eager[n.Name] = struct{}{}
+			m.tree.started = true
+		}
+	}
+
+	excludes := []string{m.config.Name, from}
+	for name := range m.tree.eager {
+		n, ok := m.nodeMap[name]
+		if !ok || n.State == stateDead {
+			delete(m.tree.eager, name)
+			continue
+		}
+		excludes = append(excludes, name)
+		if name != from {
+			eager = append(eager, n)
+		}
+	}
+	lazy = kRandomNodes(m.tune().GossipNodes, excludes, m.nodes)
+	return eager, lazy
+}
+
+// forwardTree pushes a message to our eager peers and announces it to
+// some other members.
+func (m *Memberlist) forwardTree(g *treeGossip, from string) {
+	eager, lazy := m.treeTargets(from)
+
+	push := *g
+	push.From = m.config.Name
+	if from != "" {
+		push.Hops++
+	}
+	for _, n := range eager {
+		addr := &net.UDPAddr{IP: n.Addr, Port: int(n.Port)}
+		if err := m.encodeAndSendMsg(addr, treeGossipMsg, &push); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to push tree broadcast to %s: %s", n.Name, err)
+		}
+	}
+
+	have := treeIHave{Origin: g.Origin, Seq: g.Seq, From: m.config.Name}
+	for _, n := range lazy {
+		addr := &net.UDPAddr{IP: n.Addr, Port: int(n.Port)}
+		if err := m.encodeAndSendMsg(addr, treeIHaveMsg, &have); err != nil {
+			m.logger.Printf("[ERR] memberlist: Failed to announce tree broadcast to %s: %s", n.Name, err)
+		}
+	}
+	metrics.IncrCounter([]string{"memberlist", "tree", "eager"}, float32(len(eager)))
+	metrics.IncrCounter([]string{"memberlist", "tree", "lazy"}, float32(len(lazy)))
+}
+
+// treePeer looks up a live member by name, for sending tree messages to.
+func (m *Memberlist) treePeer(name string) (*net.UDPAddr, bool) {
+	m.nodeLock.RLock()
+	defer m.nodeLock.RUnlock()
+
+	n, ok := m.nodeMap[name]
+	if !ok || n.State == stateDead || name == m.config.Name {
+		return nil, false
+	}
+	return &net.UDPAddr{IP: n.Addr, Port: int(n.Port)}, true
+}
+
+// handleTreeGossip delivers and forwards a tree broadcast we haven't seen
+// before, and prunes the sender if we have.
+func (m *Memberlist) handleTreeGossip(buf []byte, from net.Addr, label string) {
+	var g treeGossip
+	if err := decode(buf, &g); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode tree broadcast: %s %s", err, LogAddress(from))
+		return
+	}
+
+	key := treeKey(g.Origin, g.Seq)
+	m.tree.Lock()
+	e := m.rememberTree(key)
+	duplicate := e.msg != nil
+	if !duplicate {
+		e.msg = &g
+		if e.timer != nil {
+			e.timer.Stop()
+			e.timer = nil
+		}
+	}
+	if g.From != "" && g.From != m.config.Name {
+		if m.tree.eager == nil {
+			m.tree.eager = make(map[string]struct{})
+		}
+		if duplicate {
+			delete(m.tree.eager, g.From)
+		} else {
+			m.tree.eager[g.From] = struct{}{}
+		}
+	}
+	m.tree.Unlock()
+
+	if duplicate {
+		metrics.IncrCounter([]string{"memberlist", "tree", "duplicate"}, 1)
+		if addr, ok := m.treePeer(g.From); ok {
+			if err := m.encodeAndSendMsg(addr, treePruneMsg, &treePrune{From: m.config.Name}); err != nil {
+				m.logger.Printf("[ERR] memberlist: Failed to prune %s: %s", g.From, err)
+			}
+		}
+		return
+	}
+
+	if d := m.config.Delegate; d != nil {
+		payload := g.Payload
+		m.dispatchDelegate("", "notify_msg", func() {
+			notifyMsg(d, label, payload)
+		})
+	}
+	m.forwardTree(&g, g.From)
+}
+
+// handleTreeIHave notes an announcement of a tree broadcast, and starts
+// waiting for it if we don't have it.
+func (m *Memberlist) handleTreeIHave(buf []byte, from net.Addr) {
+	var h treeIHave
+	if err := decode(buf, &h); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode tree announcement: %s %s", err, LogAddress(from))
+		return
+	}
+
+	key := treeKey(h.Origin, h.Seq)
+	m.tree.Lock()
+	defer m.tree.Unlock()
+
+	e := m.rememberTree(key)
+	if e.msg != nil {
+		return
+	}
+	e.announcers = append(e.announcers, h.From)
+	if e.timer == nil {
+		e.timer = time.AfterFunc(m.config.TreeGraftTimeout, func() {
+			m.treeGraftTimeout(key)
+		})
+	}
+}
+
+// treeGraftTimeout grafts the next member that announced a message we
+// still don't have.
+func (m *Memberlist) treeGraftTimeout(key string) {
+	select {
+	case <-m.shutdownCh:
+		return
+	default:
+	}
+
+	m.tree.Lock()
+	e, ok := m.tree.messages[key]
+	if !ok || e.msg != nil || len(e.announcers) == 0 {
+		if ok {
+			e.timer = nil
+		}
+		m.tree.Unlock()
+		return
+	}
+	peer := e.announcers[0]
+	e.announcers = e.announcers[1:]
+	e.timer = time.AfterFunc(m.config.TreeGraftTimeout, func() {
+		m.treeGraftTimeout(key)
+	})
+	if m.tree.eager == nil {
+		m.tree.eager = make(map[string]struct{})
+	}
+	m.tree.eager[peer] = struct{}{}
+	m.tree.Unlock()
+
+	addr, ok := m.treePeer(peer)
+	if !ok {
+		return
+	}
+	origin, seq := splitTreeKey(key)
+	metrics.IncrCounter([]string{"memberlist", "tree", "graft"}, 1)
+	graft := treeGraft{Origin: origin, Seq: seq, From: m.config.Name}
+	if err := m.encodeAndSendMsg(addr, treeGraftMsg, &graft); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to graft %s: %s", peer, err)
+	}
+}
+
+// splitTreeKey undoes treeKey.
+func splitTreeKey(key string) (string, uint64) {
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] == '/' {
+			seq, _ := strconv.ParseUint(key[i+1:], 10, 64)
+			return key[:i], seq
+		}
+	}
+	return key, 0
+}
+
+// handleTreeGraft makes the sender an eager peer, and sends it the message
+// it asked for if we have it.
+func (m *Memberlist) handleTreeGraft(buf []byte, from net.Addr) {
+	var g treeGraft
+	if err := decode(buf, &g); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode tree graft: %s %s", err, LogAddress(from))
+		return
+	}
+	addr, ok := m.treePeer(g.From)
+	if !ok {
+		return
+	}
+
+	m.tree.Lock()
+	if m.tree.eager == nil {
+		m.tree.eager = make(map[string]struct{})
+	}
+	m.tree.eager[g.From] = struct{}{}
+	var push treeGossip
+	e, ok := m.tree.messages[treeKey(g.Origin, g.Seq)]
+	if ok && e.msg != nil {
+		push = *e.msg
+		push.From = m.config.Name
+		push.Hops++
+	}
+	m.tree.Unlock()
+
+	if push.From == "" {
+		return
+	}
+	if err := m.encodeAndSendMsg(addr, treeGossipMsg, &push); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to answer tree graft from %s: %s", g.From, err)
+	}
+}
+
+// handleTreePrune drops the sender from our eager peers.
+func (m *Memberlist) handleTreePrune(buf []byte, from net.Addr) {
+	var p treePrune
+	if err := decode(buf, &p); err != nil {
+		m.packetLog.Printf("[ERR] memberlist: Failed to decode tree prune: %s %s", err, LogAddress(from))
+		return
+	}
+	metrics.IncrCounter([]string{"memberlist", "tree", "prune"}, 1)
+
+	m.tree.Lock()
+	delete(m.tree.eager, p.From)
+	m.tree.Unlock()
+}
@@ -0,0 +1,240 @@
+package memberlist
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// treeDelegate counts the user messages it gets.
+type treeDelegate struct {
+	MockDelegate
+	sync.Mutex
+	counts map[string]int
+}
+
+func (d *treeDelegate) NotifyMsg(msg []byte) {
+	d.Lock()
+	defer d.Unlock()
+	if d.counts == nil {
+		d.counts = make(map[string]int)
+	}
+	d.counts[string(msg)]++
+}
+
+func (d *treeDelegate) count(msg string) int {
+	d.Lock()
+	defer d.Unlock()
+	return d.counts[msg]
+}
+
+func treeConfig(d *treeDelegate) *Config {
+	c := testConfig()
+	c.Delegate = d
+	c.GossipNodes = 3
+	c.TreeGraftTimeout = 50 * time.Millisecond
+	return c
+}
+
+func treeEager(m *Memberlist) map[string]struct{} {
+	m.tree.Lock()
+	defer m.tree.Unlock()
+	eager := make(map[string]struct{})
+	for name := range m.tree.eager {
+		eager[name] = struct{}{}
+	}
+	return eager
+}
+
+// treeLinks counts the eager links across the members, returning an error
+// if any of them is one-sided.
+func treeLinks(lists []*Memberlist) (int, error) {
+	links := 0
+	for _, m := range lists {
+		eager := treeEager(m)
+		links += len(eager)
+		for name := range eager {
+			for _, other := range lists {
+				if other.config.Name != name {
+					continue
+				}
+				if _, ok := treeEager(other)[m.config.Name]; !ok {
+					return links, fmt.Errorf("%s has %s as an eager peer, but not the other way around", m.config.Name, name)
+				}
+			}
+		}
+	}
+	return links, nil
+}
+
+func TestMemberlist_BroadcastTree(t *testing.T) {
+	var lists []*Memberlist
+	var delegates []*treeDelegate
+	for i := 0; i < 6; i++ {
+		d := &treeDelegate{}
+		c := treeConfig(d)
+		if i > 0 {
+			c.BindPort = lists[0].config.BindPort
+		}
+		m, err := Create(c)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		defer m.Shutdown()
+		if i > 0 {
+			if _, err := m.Join([]string{lists[0].config.BindAddr}); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		lists = append(lists, m)
+		delegates = append(delegates, d)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for _, m := range lists {
+		for m.NumMembers() != len(lists) && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitDelivered := func(msg string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for _, d := range delegates[1:] {
+			for d.count(msg) == 0 && time.Now().Before(deadline) {
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+	}
+
+	// Every member gets every message once.
+	for i := 0; i < 5; i++ {
+		msg := fmt.Sprintf("msg-%d", i)
+		if err := lists[0].BroadcastTree([]byte(msg)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		waitDelivered(msg)
+	}
+
+	// The eager links get pruned to a tree, and they're symmetric. A prune
+	// can cross paths with a message that adds the link back, and it takes
+	// more messages to settle that, so keep sending until it does.
+	deadline = time.Now().Add(5 * time.Second)
+	sent := 5
+	for {
+		links, err := treeLinks(lists)
+		if err == nil && links == 2*(len(lists)-1) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a tree, got %d links: %v", links, err)
+		}
+		msg := fmt.Sprintf("msg-%d", sent)
+		if err := lists[0].BroadcastTree([]byte(msg)); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		waitDelivered(msg)
+		sent++
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i, d := range delegates[1:] {
+		for j := 0; j < sent; j++ {
+			if n := d.count(fmt.Sprintf("msg-%d", j)); n != 1 {
+				t.Fatalf("member %d got msg-%d %d times", i+1, j, n)
+			}
+		}
+	}
+
+	// Messages from other members follow the same tree.
+	if err := lists[3].BroadcastTree([]byte("other")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for i, d := range delegates {
+		for i != 3 && d.count("other") == 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if n := d.count("other"); i != 3 && n != 1 {
+			t.Fatalf("member %d got the message %d times", i, n)
+		}
+	}
+
+	big := bytes.Repeat([]byte("a"), udpSendBuf)
+	if err := lists[0].BroadcastTree(big); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestMemberlist_BroadcastTree_Graft(t *testing.T) {
+	d1, d2 := &treeDelegate{}, &treeDelegate{}
+	c1 := treeConfig(d1)
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := treeConfig(d2)
+	c2.BindPort = c1.BindPort
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m2.Join([]string{c1.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// m1 has a message that m2 only hears about.
+	g := &treeGossip{Origin: c1.Name, Seq: 1, From: c1.Name, Payload: []byte("missed")}
+	m1.tree.Lock()
+	m1.rememberTree(treeKey(g.Origin, g.Seq)).msg = g
+	m1.tree.Unlock()
+	addr, ok := m1.treePeer(c2.Name)
+	if !ok {
+		t.Fatalf("no peer")
+	}
+	have := treeIHave{Origin: g.Origin, Seq: g.Seq, From: c1.Name}
+	if err := m1.encodeAndSendMsg(addr, treeIHaveMsg, &have); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// It grafts m1 and gets the message, and they're now eager peers.
+	deadline := time.Now().Add(5 * time.Second)
+	for d2.count("missed") == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := d2.count("missed"); n != 1 {
+		t.Fatalf("got the message %d times", n)
+	}
+	if _, ok := treeEager(m1)[c2.Name]; !ok {
+		t.Fatalf("m1 should push to m2")
+	}
+	if _, ok := treeEager(m2)[c1.Name]; !ok {
+		t.Fatalf("m2 should push to m1")
+	}
+}
+
+func TestMemberlist_BroadcastTree_Restart(t *testing.T) {
+	c := testConfig()
+	m1, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	m1.Shutdown()
+	first := atomic.LoadUint64(&m1.treeSeqNum)
+
+	// Coming back under the same name carries on past the old sequence
+	// numbers, so peers don't take our messages for duplicates.
+	c = testConfig()
+	c.Name = m1.config.Name
+	m2, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if next := atomic.LoadUint64(&m2.treeSeqNum); next <= first {
+		t.Fatalf("sequence went backwards: %d <= %d", next, first)
+	}
+}
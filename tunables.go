@@ -0,0 +1,57 @@
+package memberlist
+
+import (
+	"fmt"
+)
+
+// Validate returns an error if any of the settings are out of range.
+func (t *Tunables) Validate() error {
+	if t.TCPTimeout <= 0 {
+		return fmt.Errorf("TCPTimeout must be positive")
+	}
+	if t.ProbeTimeout <= 0 {
+		return fmt.Errorf("ProbeTimeout must be positive")
+	}
+	if t.IndirectChecks < 0 || t.GossipNodes < 0 || t.RefuteFanout < 0 || t.UserBroadcastReserve < 0 {
+		return fmt.Errorf("IndirectChecks, GossipNodes, RefuteFanout and UserBroadcastReserve can't be negative")
+	}
+	if t.RetransmitMult < 1 || t.SuspicionMult < 1 || t.SuspicionMaxTimeoutMult < 1 {
+		return fmt.Errorf("RetransmitMult, SuspicionMult and SuspicionMaxTimeoutMult must be at least one")
+	}
+	return nil
+}
+
+// tune returns the current tunables. They must not be modified.
+func (m *Memberlist) tune() *Tunables {
+	return m.tunables.Load().(*Tunables)
+}
+
+// Tunables returns the settings currently in use that can be changed with
+// SetTunables.
+func (m *Memberlist) Tunables() Tunables {
+	return *m.tune()
+}
+
+// SetTunables changes settings while running, after checking them. Each
+// takes effect the next time it's used: a new ProbeTimeout applies from
+// the next probe, and a new SuspicionMult to the next node suspected.
+func (m *Memberlist) SetTunables(t Tunables) error {
+	if err := t.Validate(); err != nil {
+		return err
+	}
+
+	m.scale.Lock()
+	defer m.scale.Unlock()
+	if (t.GossipNodes == 0) != (m.tune().GossipNodes == 0) {
+		return fmt.Errorf("GossipNodes can't be changed to or from zero while running")
+	}
+	m.tunables.Store(&t)
+
+	// The queue also picks up the multiplier for the cluster's size.
+	m.broadcasts.Lock()
+	m.broadcasts.RetransmitMult = t.RetransmitMult + m.scale.step
+	m.broadcasts.Unlock()
+
+	m.logger.Printf("[INFO] memberlist: Updated tunables")
+	return nil
+}
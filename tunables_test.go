@@ -0,0 +1,86 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+// setTunables changes some of a Memberlist's tunables.
+func setTunables(t *testing.T, m *Memberlist, fn func(*Tunables)) {
+	t.Helper()
+	tun := m.Tunables()
+	fn(&tun)
+	if err := m.SetTunables(tun); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTunables_Validate(t *testing.T) {
+	base := DefaultLANConfig().tunables()
+	if err := base.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := []func(*Tunables){
+		func(t *Tunables) { t.TCPTimeout = 0 },
+		func(t *Tunables) { t.ProbeTimeout = -time.Second },
+		func(t *Tunables) { t.IndirectChecks = -1 },
+		func(t *Tunables) { t.UserBroadcastReserve = -1 },
+		func(t *Tunables) { t.RetransmitMult = 0 },
+		func(t *Tunables) { t.SuspicionMaxTimeoutMult = 0 },
+	}
+	for i, fn := range cases {
+		tun := DefaultLANConfig().tunables()
+		fn(&tun)
+		if err := tun.Validate(); err == nil {
+			t.Fatalf("case %d: expected error", i)
+		}
+	}
+}
+
+func TestMemberlist_SetTunables(t *testing.T) {
+	c := testConfig()
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	if tun := m.Tunables(); tun != c.tunables() {
+		t.Fatalf("bad: %+v", tun)
+	}
+
+	tun := m.Tunables()
+	tun.RetransmitMult = 7
+	tun.SuspicionMult = 9
+	if err := m.SetTunables(tun); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if got := m.Tunables(); got != tun {
+		t.Fatalf("bad: %+v", got)
+	}
+	m.broadcasts.Lock()
+	retransmit := m.broadcasts.RetransmitMult
+	m.broadcasts.Unlock()
+	if retransmit != 7 {
+		t.Fatalf("bad: %d", retransmit)
+	}
+	if mult := m.suspicionMult(); mult != 9 {
+		t.Fatalf("bad: %d", mult)
+	}
+
+	// Bad settings, or turning gossip off, are refused, and nothing changes.
+	bad := tun
+	bad.ProbeTimeout = 0
+	if err := m.SetTunables(bad); err == nil {
+		t.Fatalf("expected error")
+	}
+	bad = tun
+	bad.GossipNodes = 0
+	if err := m.SetTunables(bad); err == nil {
+		t.Fatalf("expected error")
+	}
+	if got := m.Tunables(); got != tun {
+		t.Fatalf("bad: %+v", got)
+	}
+}
@@ -0,0 +1,286 @@
+package memberlist
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+We keep rolling statistics on how our probes go, so that Recommendations
+can suggest changes to the tunables that suit the network we're actually
+on. The statistics are the last maxTuneSamples probes of nodes that
+answered, recording whether the direct UDP ping was answered in time and
+how long it took, and the times we've had to refute a suspicion of
+ourselves over the last hour.
+
+A probe answered only indirectly or over TCP counts as a lost packet, since
+the node was alive all along. Probes that nobody answered are left out, as
+the node may well have failed.
+
+Recommendations only ever move a tunable between the value it was given in
+the Config and twice that, so tuning can make us more patient on a lossy or
+slow network, and back again once it has recovered, but never less patient
+than configured. With AutoTune, we apply them ourselves every
+AutoTuneInterval.
+*/
+
+const (
+	// maxTuneSamples is how many recent probes the statistics cover.
+	maxTuneSamples = 256
+
+	// minTuneSamples is how many probes we need before recommending
+	// anything.
+	minTuneSamples = 50
+
+	// refuteWindow is how far back refutes are counted.
+	refuteWindow = time.Hour
+
+	// maxRefutes is the most refutes we remember.
+	maxRefutes = 1024
+)
+
+// tuneSample is the result of probing a node that answered.
+type tuneSample struct {
+	lost bool
+	rtt  time.Duration
+}
+
+// tuningStats holds the rolling statistics.
+type tuningStats struct {
+	sync.Mutex
+	samples []tuneSample // Ring buffer
+	next    int
+	refutes []time.Time // Oldest first
+}
+
+// recordProbe notes the result of a probe that was answered, either
+// directly in the given time, or not directly, in which case it was lost.
+func (s *tuningStats) recordProbe(lost bool, rtt time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	sample := tuneSample{lost: lost, rtt: rtt}
+	if len(s.samples) < maxTuneSamples {
+		s.samples = append(s.samples, sample)
+		return
+	}
+	s.samples[s.next] = sample
+	s.next = (s.next + 1) % maxTuneSamples
+}
+
+// recordRefute notes that we had to refute a suspicion of ourselves.
+func (s *tuningStats) recordRefute(now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.refutes) >= maxRefutes {
+		s.refutes = s.refutes[1:]
+	}
+	s.refutes = append(s.refutes, now)
+}
+
+// TuningStats summarises how our recent probes went.
+type TuningStats struct {
+	// Probes is the number of recent probes of nodes that answered.
+	Probes int
+
+	// LossRate is the fraction of those that weren't answered directly
+	// within the ProbeTimeout.
+	LossRate float64
+
+	// RTT is the 95th percentile of the round trip times of the direct
+	// answers.
+	RTT time.Duration
+
+	// RefutesPerHour is how many times we've had to refute a suspicion
+	// of ourselves in the last hour.
+	RefutesPerHour int
+}
+
+// summary returns the statistics as of now.
+func (s *tuningStats) summary(now time.Time) TuningStats {
+	s.Lock()
+	defer s.Unlock()
+
+	expired := 0
+	for expired < len(s.refutes) && now.Sub(s.refutes[expired]) >= refuteWindow {
+		expired++
+	}
+	s.refutes = s.refutes[expired:]
+
+	st := TuningStats{Probes: len(s.samples), RefutesPerHour: len(s.refutes)}
+	var lost int
+	var rtts []time.Duration
+	for _, sample := range s.samples {
+		if sample.lost {
+			lost++
+		} else {
+			rtts = append(rtts, sample.rtt)
+		}
+	}
+	if st.Probes > 0 {
+		st.LossRate = float64(lost) / float64(st.Probes)
+	}
+	if len(rtts) > 0 {
+		sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+		st.RTT = rtts[(len(rtts)*95-1)/100]
+	}
+	return st
+}
+
+// TuningStats returns the statistics that Recommendations are based on.
+func (m *Memberlist) TuningStats() TuningStats {
+	return m.tuning.summary(time.Now())
+}
+
+// Recommendation is a suggested change to one of the tunables.
+type Recommendation struct {
+	// Tunable is the name of the field in Tunables.
+	Tunable string
+
+	// Current and Suggested are its value now and the one suggested,
+	// formatted for display.
+	Current   string
+	Suggested string
+
+	// Reason says what in the statistics prompted it.
+	Reason string
+
+	apply func(*Tunables)
+}
+
+// Apply makes the suggested change to the given tunables.
+func (r *Recommendation) Apply(t *Tunables) {
+	r.apply(t)
+}
+
+// Recommendations suggests changes to the tunables in use, based on the
+// TuningStats. There are none until enough probes have been made, and
+// none once the tunables suit the network.
+func (m *Memberlist) Recommendations() []Recommendation {
+	base := m.config.tunables()
+	return recommend(m.TuningStats(), m.tune(), &base, m.config.ProbeInterval)
+}
+
+// recommend works out the recommendations for the given statistics and
+// current tunables, keeping them between the base tunables and twice
+// those.
+func recommend(st TuningStats, cur, base *Tunables, probeInterval time.Duration) []Recommendation {
+	if st.Probes < minTuneSamples {
+		return nil
+	}
+	var recs []Recommendation
+	lossy := st.LossRate > 0.05
+	calm := st.LossRate < 0.01 && st.RefutesPerHour == 0
+
+	// Acks should come back well within the ProbeTimeout, which has to
+	// leave time for indirect probes within the ProbeInterval.
+	timeout := cur.ProbeTimeout
+	if st.RTT > 0 && (st.RTT > cur.ProbeTimeout/2 || st.RTT < cur.ProbeTimeout/4) {
+		timeout = 2 * st.RTT
+	}
+	timeout = timeout.Round(time.Millisecond)
+	if max := probeInterval / 2; timeout > max {
+		timeout = max
+	}
+	timeout = clampDuration(timeout, base.ProbeTimeout, 2*base.ProbeTimeout)
+	if timeout != cur.ProbeTimeout {
+		recs = append(recs, Recommendation{
+			Tunable:   "ProbeTimeout",
+			Current:   cur.ProbeTimeout.String(),
+			Suggested: timeout.String(),
+			Reason:    fmt.Sprintf("95th percentile round trip time is %v", st.RTT),
+			apply:     func(t *Tunables) { t.ProbeTimeout = timeout },
+		})
+	}
+
+	// Lost packets and refutes mean healthy nodes are being suspected, so
+	// give them longer to refute, and more ways to be reached.
+	mult := cur.SuspicionMult
+	var reason string
+	switch {
+	case lossy:
+		mult++
+		reason = fmt.Sprintf("%.1f%% of direct pings are lost", 100*st.LossRate)
+	case st.RefutesPerHour >= 3:
+		mult++
+		reason = fmt.Sprintf("we refuted %d suspicions of ourselves in the last hour", st.RefutesPerHour)
+	case calm:
+		mult--
+		reason = "the network has recovered"
+	}
+	mult = clampInt(mult, base.SuspicionMult, 2*base.SuspicionMult)
+	if mult != cur.SuspicionMult {
+		recs = append(recs, Recommendation{
+			Tunable:   "SuspicionMult",
+			Current:   fmt.Sprint(cur.SuspicionMult),
+			Suggested: fmt.Sprint(mult),
+			Reason:    reason,
+			apply:     func(t *Tunables) { t.SuspicionMult = mult },
+		})
+	}
+
+	checks := cur.IndirectChecks
+	if lossy {
+		checks++
+	} else if calm {
+		checks--
+	}
+	checks = clampInt(checks, base.IndirectChecks, 2*base.IndirectChecks)
+	if checks != cur.IndirectChecks {
+		reason := fmt.Sprintf("%.1f%% of direct pings are lost", 100*st.LossRate)
+		if !lossy {
+			reason = "the network has recovered"
+		}
+		recs = append(recs, Recommendation{
+			Tunable:   "IndirectChecks",
+			Current:   fmt.Sprint(cur.IndirectChecks),
+			Suggested: fmt.Sprint(checks),
+			Reason:    reason,
+			apply:     func(t *Tunables) { t.IndirectChecks = checks },
+		})
+	}
+	return recs
+}
+
+func clampInt(v, min, max int) int {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+func clampDuration(v, min, max time.Duration) time.Duration {
+	if v > max {
+		v = max
+	}
+	if v < min {
+		v = min
+	}
+	return v
+}
+
+// autoTune applies the current recommendations, for AutoTune.
+func (m *Memberlist) autoTune() {
+	recs := m.Recommendations()
+	if len(recs) == 0 {
+		return
+	}
+	t := m.Tunables()
+	for i := range recs {
+		recs[i].Apply(&t)
+	}
+	if err := m.SetTunables(t); err != nil {
+		m.logger.Printf("[ERR] memberlist: Failed to apply tuning recommendations: %v", err)
+		return
+	}
+	for _, r := range recs {
+		m.logger.Printf("[INFO] memberlist: Changed %s from %s to %s, since %s", r.Tunable, r.Current, r.Suggested, r.Reason)
+	}
+	metrics.IncrCounter([]string{"memberlist", "autotune", "applied"}, float32(len(recs)))
+}
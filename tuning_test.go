@@ -0,0 +1,148 @@
+package memberlist
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTuningStats(t *testing.T) {
+	var s tuningStats
+	now := time.Now()
+	if st := s.summary(now); st.Probes != 0 || st.LossRate != 0 || st.RTT != 0 {
+		t.Fatalf("bad: %#v", st)
+	}
+
+	for i := 1; i <= 100; i++ {
+		s.recordProbe(false, time.Duration(i)*time.Millisecond)
+	}
+	for i := 0; i < 25; i++ {
+		s.recordProbe(true, 0)
+	}
+	st := s.summary(now)
+	if st.Probes != 125 || st.LossRate != 0.2 || st.RTT != 95*time.Millisecond {
+		t.Fatalf("bad: %#v", st)
+	}
+
+	// Only the most recent probes count.
+	for i := 0; i < maxTuneSamples; i++ {
+		s.recordProbe(false, time.Millisecond)
+	}
+	st = s.summary(now)
+	if st.Probes != maxTuneSamples || st.LossRate != 0 || st.RTT != time.Millisecond {
+		t.Fatalf("bad: %#v", st)
+	}
+
+	// Refutes are counted over the last hour.
+	s.recordRefute(now.Add(-2 * time.Hour))
+	s.recordRefute(now.Add(-time.Minute))
+	s.recordRefute(now)
+	if st := s.summary(now); st.RefutesPerHour != 2 {
+		t.Fatalf("bad: %#v", st)
+	}
+}
+
+func TestRecommend(t *testing.T) {
+	base := DefaultLANConfig().tunables()
+	probeInterval := time.Second
+
+	find := func(recs []Recommendation, name string) *Recommendation {
+		for i := range recs {
+			if recs[i].Tunable == name {
+				return &recs[i]
+			}
+		}
+		return nil
+	}
+	apply := func(recs []Recommendation, cur Tunables) Tunables {
+		for i := range recs {
+			recs[i].Apply(&cur)
+		}
+		return cur
+	}
+
+	// Nothing until there are enough probes.
+	st := TuningStats{Probes: minTuneSamples - 1, LossRate: 0.5}
+	if recs := recommend(st, &base, &base, probeInterval); len(recs) != 0 {
+		t.Fatalf("bad: %v", recs)
+	}
+
+	// A healthy network needs no changes.
+	st = TuningStats{Probes: 100, RTT: base.ProbeTimeout / 3}
+	if recs := recommend(st, &base, &base, probeInterval); len(recs) != 0 {
+		t.Fatalf("bad: %v", recs)
+	}
+
+	// Loss raises SuspicionMult and IndirectChecks, but no more than
+	// twice their base values.
+	st = TuningStats{Probes: 100, LossRate: 0.1, RTT: base.ProbeTimeout / 3}
+	cur := base
+	for i := 0; i < 10; i++ {
+		cur = apply(recommend(st, &cur, &base, probeInterval), cur)
+	}
+	if cur.SuspicionMult != 2*base.SuspicionMult || cur.IndirectChecks != 2*base.IndirectChecks {
+		t.Fatalf("bad: %#v", cur)
+	}
+	if cur.ProbeTimeout != base.ProbeTimeout {
+		t.Fatalf("bad: %#v", cur)
+	}
+
+	// Once the network recovers, they come back down to the base.
+	st = TuningStats{Probes: 100, RTT: base.ProbeTimeout / 3}
+	recs := recommend(st, &cur, &base, probeInterval)
+	if r := find(recs, "SuspicionMult"); r == nil || r.Suggested != "9" || r.Reason != "the network has recovered" {
+		t.Fatalf("bad: %#v", recs)
+	}
+	for i := 0; i < 10; i++ {
+		cur = apply(recommend(st, &cur, &base, probeInterval), cur)
+	}
+	if cur != base {
+		t.Fatalf("bad: %#v", cur)
+	}
+
+	// Refutes alone raise SuspicionMult.
+	st = TuningStats{Probes: 100, RTT: base.ProbeTimeout / 3, RefutesPerHour: 3}
+	recs = recommend(st, &base, &base, probeInterval)
+	if len(recs) != 1 || recs[0].Tunable != "SuspicionMult" {
+		t.Fatalf("bad: %#v", recs)
+	}
+
+	// Slow acks raise the ProbeTimeout, up to twice its base, and half
+	// the ProbeInterval.
+	st = TuningStats{Probes: 100, RTT: 2 * base.ProbeTimeout}
+	recs = recommend(st, &base, &base, 5*time.Second)
+	r := find(recs, "ProbeTimeout")
+	if r == nil || r.Current != base.ProbeTimeout.String() || r.Suggested != (2*base.ProbeTimeout).String() {
+		t.Fatalf("bad: %#v", recs)
+	}
+	st = TuningStats{Probes: 100, RTT: base.ProbeTimeout * 3 / 4}
+	recs = recommend(st, &base, &base, 5*time.Second)
+	if r := find(recs, "ProbeTimeout"); r == nil || r.Suggested != (base.ProbeTimeout*3/2).String() {
+		t.Fatalf("bad: %#v", recs)
+	}
+	if recs := recommend(st, &base, &base, 2*base.ProbeTimeout); len(recs) != 0 {
+		t.Fatalf("bad: %#v", recs)
+	}
+}
+
+func TestMemberlist_AutoTune(t *testing.T) {
+	m := GetMemberlist(t)
+	defer m.Shutdown()
+	base := m.Tunables()
+
+	m.autoTune()
+	if m.Tunables() != base {
+		t.Fatalf("should not have changed")
+	}
+
+	for i := 0; i < 100; i++ {
+		m.tuning.recordProbe(i%5 == 0, base.ProbeTimeout/3)
+	}
+	if recs := m.Recommendations(); len(recs) != 2 {
+		t.Fatalf("bad: %#v", recs)
+	}
+	m.autoTune()
+	tuned := m.Tunables()
+	if tuned.SuspicionMult != base.SuspicionMult+1 || tuned.IndirectChecks != base.IndirectChecks+1 {
+		t.Fatalf("bad: %#v", tuned)
+	}
+}
@@ -0,0 +1,17 @@
+package memberlist
+
+// groBufSize is the read buffer used with GRO, big enough for the largest
+// datagram the kernel will coalesce packets into.
+const groBufSize = 65535
+
+// udpOffload records whether receive offload is enabled on our UDP
+// socket, and whether ECN is.
+type udpOffload struct {
+	// gro is set if the kernel may hand us several packets from the same
+	// source in one read.
+	gro bool
+
+	// ecn is set if our packets are marked ECN capable and we can read the
+	// marks on those we receive. See EnableECN.
+	ecn bool
+}
@@ -0,0 +1,64 @@
+package memberlist
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// Socket options for UDP receive offload, from linux/udp.h. They aren't in
+// the syscall package.
+const (
+	solUDP = 17
+	udpGRO = 104
+)
+
+// enableUDPOffload turns on GRO for the given socket if the kernel
+// supports it.
+func enableUDPOffload(conn *net.UDPConn) (udpOffload, error) {
+	var off udpOffload
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return off, err
+	}
+	err = raw.Control(func(fd uintptr) {
+		if err := syscall.SetsockoptInt(int(fd), solUDP, udpGRO, 1); err == nil {
+			off.gro = true
+		}
+	})
+	return off, err
+}
+
+// readPackets reads from a socket with GRO or ECN enabled, returning the
+// packets the kernel may have merged into a single read, and whether they
+// were marked congestion experienced.
+func readPackets(conn *net.UDPConn, buf, oob []byte) ([][]byte, net.Addr, bool, error) {
+	n, oobn, _, addr, err := conn.ReadMsgUDP(buf, oob)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	size := 0
+	ce := false
+	if msgs, err := syscall.ParseSocketControlMessage(oob[:oobn]); err == nil {
+		for _, msg := range msgs {
+			if msg.Header.Level == solUDP && msg.Header.Type == udpGRO && len(msg.Data) >= 4 {
+				size = int(*(*int32)(unsafe.Pointer(&msg.Data[0])))
+			}
+			ce = ce || markedCE(msg)
+		}
+	}
+	if size <= 0 || size >= n {
+		return [][]byte{buf[:n]}, addr, ce, nil
+	}
+
+	var packets [][]byte
+	for off := 0; off < n; off += size {
+		end := off + size
+		if end > n {
+			end = n
+		}
+		packets = append(packets, buf[off:end:end])
+	}
+	return packets, addr, ce, nil
+}
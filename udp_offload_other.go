@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package memberlist
+
+import (
+	"fmt"
+	"net"
+)
+
+// enableUDPOffload isn't supported off Linux.
+func enableUDPOffload(conn *net.UDPConn) (udpOffload, error) {
+	return udpOffload{}, fmt.Errorf("UDP offload is only supported on Linux")
+}
+
+func readPackets(conn *net.UDPConn, buf, oob []byte) ([][]byte, net.Addr, bool, error) {
+	n, addr, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	return [][]byte{buf[:n]}, addr, false, nil
+}
@@ -0,0 +1,97 @@
+package memberlist
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemberlist_RawSendMsgsUDP_Offload(t *testing.T) {
+	c1 := testConfig()
+	c1.EnableUDPOffload = true
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m1.Shutdown()
+
+	d := &MockDelegate{}
+	c2 := testConfig()
+	c2.BindPort = c1.BindPort
+	c2.EnableUDPOffload = true
+	c2.Delegate = d
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer m2.Shutdown()
+
+	// A burst of messages to an offload-enabled node, which the kernel
+	// may hand it in a single read.
+	var msgs []*bytes.Buffer
+	for _, payload := range []string{"aaaa", "bbbb", "cccc", "dd"} {
+		msgs = append(msgs, bytes.NewBuffer(append([]byte{byte(userMsg)}, payload...)))
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP(m2.config.BindAddr), Port: m2.config.BindPort}
+	if err := m1.rawSendMsgsUDP(addr, msgs); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(d.getMessages()) < 4 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	got := d.getMessages()
+	if len(got) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(got))
+	}
+	for i, want := range []string{"aaaa", "bbbb", "cccc", "dd"} {
+		if string(got[i]) != want {
+			t.Fatalf("message %d: expected %q, got %q", i, want, got[i])
+		}
+	}
+}
+
+func TestReadPackets(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer conn.Close()
+	off, err := enableUDPOffload(conn)
+	if err != nil || !off.gro {
+		t.Skip("UDP offload not supported")
+	}
+	to := conn.LocalAddr().(*net.UDPAddr)
+
+	packets := [][]byte{
+		bytes.Repeat([]byte{1}, 100),
+		bytes.Repeat([]byte{2}, 100),
+		bytes.Repeat([]byte{3}, 40),
+	}
+	for _, p := range packets {
+		if _, err := conn.WriteToUDP(p, to); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var got [][]byte
+	for len(got) < len(packets) {
+		bufs, _, _, err := readPackets(conn, make([]byte, groBufSize), make([]byte, 64))
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		got = append(got, bufs...)
+	}
+	if len(got) != len(packets) {
+		t.Fatalf("expected %d packets, got %d", len(packets), len(got))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Fatalf("packet %d mismatch: %v", i, got[i])
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package memberlist
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+
+	"github.com/armon/go-metrics"
+)
+
+/*
+Applications commonly rebroadcast the user messages they get, so that they
+reach the whole cluster, which means each member sees several copies of
+the same message. When UserMsgDedupWindow is set, we remember the SHA-256
+of each user message we hand to the delegate, and drop any copy that
+arrives within the window after the first, so the delegate sees each
+message once.
+
+This covers messages that arrive as user messages over UDP or a stream,
+expiring and sealed ones included. Sequenced messages carry their own
+origin and sequence number for the delegate to check, and reliable and
+tree broadcasts are already delivered once, so they're left alone. An
+application that sends the same payload on purpose, like a heartbeat,
+must send it less often than the window, or vary it.
+*/
+
+// maxUserDedup is the most message hashes we remember, dropping the oldest
+// first, however busy the cluster.
+const maxUserDedup = 65536
+
+// userDedupEntry is a message hash and when we delivered it.
+type userDedupEntry struct {
+	sum [sha256.Size]byte
+	at  time.Time
+}
+
+// userDedup remembers the user messages delivered within the dedup window.
+type userDedup struct {
+	sync.Mutex
+	seen  map[[sha256.Size]byte]struct{}
+	order []userDedupEntry // Oldest first
+}
+
+// duplicate returns true if a message with the given hash was delivered
+// within the window, and otherwise remembers it as delivered now.
+func (u *userDedup) duplicate(sum [sha256.Size]byte, now time.Time, window time.Duration) bool {
+	u.Lock()
+	defer u.Unlock()
+
+	expired := 0
+	for expired < len(u.order) && now.Sub(u.order[expired].at) >= window {
+		delete(u.seen, u.order[expired].sum)
+		expired++
+	}
+	u.order = u.order[expired:]
+
+	if _, ok := u.seen[sum]; ok {
+		return true
+	}
+	if len(u.order) >= maxUserDedup {
+		delete(u.seen, u.order[0].sum)
+		u.order = u.order[1:]
+	}
+	if u.seen == nil {
+		u.seen = make(map[[sha256.Size]byte]struct{})
+	}
+	u.seen[sum] = struct{}{}
+	u.order = append(u.order, userDedupEntry{sum, now})
+	return false
+}
+
+// duplicateUserMsg returns true if a user message should be dropped as a
+// copy of one we've already delivered.
+func (m *Memberlist) duplicateUserMsg(msg []byte) bool {
+	if m.config.UserMsgDedupWindow <= 0 {
+		return false
+	}
+	if !m.userDedup.duplicate(sha256.Sum256(msg), time.Now(), m.config.UserMsgDedupWindow) {
+		return false
+	}
+	metrics.IncrCounter([]string{"memberlist", "msg", "user", "duplicate"}, 1)
+	return true
+}
@@ -0,0 +1,142 @@
+package memberlist
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+)
+
+func TestUserDedup_Window(t *testing.T) {
+	var u userDedup
+	now := time.Now()
+	a, b := sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b"))
+
+	if u.duplicate(a, now, time.Second) {
+		t.Fatalf("first copy isn't a duplicate")
+	}
+	if !u.duplicate(a, now.Add(500*time.Millisecond), time.Second) {
+		t.Fatalf("should be a duplicate")
+	}
+	if u.duplicate(b, now.Add(500*time.Millisecond), time.Second) {
+		t.Fatalf("another message isn't a duplicate")
+	}
+
+	// The window runs from the first copy, and then it's forgotten.
+	if u.duplicate(a, now.Add(time.Second), time.Second) {
+		t.Fatalf("should have expired")
+	}
+	if len(u.order) != 2 || len(u.seen) != 2 {
+		t.Fatalf("bad: %d %d", len(u.order), len(u.seen))
+	}
+}
+
+func TestMemberlist_UserMsgDedup(t *testing.T) {
+	d1, d2 := &treeDelegate{}, &treeDelegate{}
+	c1 := testConfig()
+	c1.Delegate = d1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = c1.BindPort
+	c2.Delegate = d2
+	c2.UserMsgDedupWindow = time.Minute
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+	if _, err := m1.Join([]string{c2.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var to *Node
+	for _, n := range m1.Members() {
+		if n.Name == c2.Name {
+			to = n
+		}
+	}
+	if to == nil {
+		t.Fatalf("missing node")
+	}
+
+	// Copies over UDP and over a stream count the same.
+	for i := 0; i < 3; i++ {
+		if err := m1.SendToUDP(to, []byte("hello")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := m1.SendToTCP(to, []byte("hello")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if err := m1.SendToUDP(to, []byte("world")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for d2.count("world") == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := d2.count("hello"); n != 1 {
+		t.Fatalf("got %d copies", n)
+	}
+	if n := d2.count("world"); n != 1 {
+		t.Fatalf("got %d copies", n)
+	}
+
+	// Without a window, every copy is delivered.
+	if err := m2.SendToUDP(m1.LocalNode(), []byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m2.SendToUDP(m1.LocalNode(), []byte("hello")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	deadline = time.Now().Add(5 * time.Second)
+	for d1.count("hello") < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := d1.count("hello"); n != 2 {
+		t.Fatalf("got %d copies", n)
+	}
+}
+
+func TestMemberlist_UserMsgDedup_Sequenced(t *testing.T) {
+	c := testConfig()
+	c.UserMsgDedupWindow = time.Minute
+	sd := &MockSequencedDelegate{}
+	c.Delegate = sd
+	m, err := Create(c)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m.Shutdown()
+
+	// The same message sent twice gets two sequence numbers, and each is
+	// delivered once however many copies arrive.
+	for i := 0; i < 2; i++ {
+		if _, err := m.BroadcastSequenced([]byte("hello")); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	var msgs [][]byte
+	for _, msg := range m.broadcasts.GetBroadcasts(0, 1000) {
+		if messageType(msg[0]) == userSeqMsg {
+			msgs = append(msgs, msg)
+		}
+	}
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 broadcasts: %v", msgs)
+	}
+	for i := 0; i < 3; i++ {
+		for _, msg := range msgs {
+			m.handleUserSequenced(msg[1:], nil, "")
+		}
+	}
+	if len(sd.sequenced) != 2 || sd.sequenced[0].seq == sd.sequenced[1].seq {
+		t.Fatalf("bad: %v", sd.sequenced)
+	}
+}
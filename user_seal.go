@@ -0,0 +1,141 @@
+package memberlist
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/armon/go-metrics"
+	"golang.org/x/crypto/hkdf"
+)
+
+/*
+Sealed user messages are encrypted for a single recipient, on top of any
+packet encryption, so that a node forwarding them on our behalf, such as a
+relay, sees only ciphertext. With Config.SealUserMessages set, SendToUDP
+and SendToTCP seal the payload with AES-256-GCM under a key derived by
+HKDF-SHA256 from the primary cluster key and the sender and recipient
+names, in that order, so each direction between each pair of nodes gets
+its own key. The names are also authenticated as additional data, and the
+recipient drops messages addressed to anyone else.
+
+The derivation only needs the cluster key, so this doesn't protect against
+a node that holds it: it keeps payloads away from forwarders that only
+handle packets, and stops a message for one node being replayed to
+another. Receivers try every key on the ring, so keys can be rotated as
+usual. SendTo only knows an address, so its messages aren't sealed.
+Members running an older version don't understand sealed messages and log
+them as unknown.
+*/
+
+// userSealInfo is the HKDF info prefix for user message keys.
+const userSealInfo = "memberlist user message v1"
+
+// sealedUser carries a user message encrypted for one recipient.
+type sealedUser struct {
+	From    string `codec:"From"`
+	To      string `codec:"To"`
+	Payload []byte `codec:"Payload"`
+}
+
+// userSealKey derives the key for user messages from one node to another.
+func userSealKey(clusterKey []byte, from, to string) ([]byte, error) {
+	info := []byte(userSealInfo)
+	info = binary.AppendUvarint(info, uint64(len(from)))
+	info = append(info, from...)
+	info = binary.AppendUvarint(info, uint64(len(to)))
+	info = append(info, to...)
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, clusterKey, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// userSealData is the additional data authenticated with a sealed message.
+func userSealData(from, to string) []byte {
+	data := binary.AppendUvarint(nil, uint64(len(from)))
+	data = append(data, from...)
+	return append(data, to...)
+}
+
+// sealUserMsg encrypts a user message for the named node, returning it
+// framed as a sealedUserMsg.
+func (m *Memberlist) sealUserMsg(to string, msg []byte) ([]byte, error) {
+	if !m.config.EncryptionEnabled() {
+		return nil, fmt.Errorf("Sealing user messages requires a keyring")
+	}
+	from := m.config.Name
+	key, err := userSealKey(m.config.Keyring.GetPrimaryKey(), from, to)
+	if err != nil {
+		return nil, err
+	}
+	var payload bytes.Buffer
+	if err := encryptPayloadNonce(1, key, msg, userSealData(from, to), m.nonces, &payload); err != nil {
+		return nil, err
+	}
+	out, err := encode(sealedUserMsg, &sealedUser{From: from, To: to, Payload: payload.Bytes()})
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// openUserMsg decrypts a sealed user message addressed to us.
+func (m *Memberlist) openUserMsg(buf []byte) ([]byte, error) {
+	var s sealedUser
+	if err := decode(buf, &s); err != nil {
+		return nil, err
+	}
+	if s.To != m.config.Name {
+		return nil, fmt.Errorf("Sealed user message is for '%s'", s.To)
+	}
+	if !m.config.EncryptionEnabled() {
+		return nil, fmt.Errorf("No keyring to open sealed user message from '%s'", s.From)
+	}
+
+	return openSealedUser(m.config.Keyring.GetKeys(), &s)
+}
+
+// openSealedUser decrypts a sealed user message with any of the given
+// cluster keys.
+func openSealedUser(keys [][]byte, s *sealedUser) ([]byte, error) {
+	if len(s.Payload) < encryptOverhead(1) || s.Payload[0] != 1 {
+		return nil, fmt.Errorf("Sealed user message from '%s' is malformed", s.From)
+	}
+
+	data := userSealData(s.From, s.To)
+	for _, clusterKey := range keys {
+		key, err := userSealKey(clusterKey, s.From, s.To)
+		if err != nil {
+			return nil, err
+		}
+		if msg, err := decryptMessage(key, s.Payload, data); err == nil {
+			return msg, nil
+		}
+	}
+	return nil, fmt.Errorf("No installed keys could open sealed user message from '%s'", s.From)
+}
+
+// handleSealedUser opens a sealed user message and passes it to the
+// delegate.
+func (m *Memberlist) handleSealedUser(buf []byte, from net.Addr, label string) {
+	msg, err := m.openUserMsg(buf)
+	if err != nil {
+		metrics.IncrCounter([]string{"memberlist", "msg", "user", "unsealable"}, 1)
+		m.packetLog.Printf("[ERR] memberlist: Failed to open sealed user message: %v %s", err, LogAddress(from))
+		m.recordViolation(from, "auth", violationAuth)
+		return
+	}
+
+	d := m.config.Delegate
+	if d != nil && !m.duplicateUserMsg(msg) {
+		m.dispatchDelegate("", "notify_msg", func() {
+			notifyMsg(d, label, msg)
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package memberlist
+
+import (
+	"bytes"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sealTestMemberlist(name string, keys ...[]byte) *Memberlist {
+	keyring, err := NewKeyring(keys, keys[0])
+	if err != nil {
+		panic(err)
+	}
+	c := DefaultLANConfig()
+	c.Name = name
+	c.Keyring = keyring
+	return &Memberlist{config: c, nonces: randomNonces{rand.Reader}}
+}
+
+func TestUserSeal_SealOpen(t *testing.T) {
+	a := sealTestMemberlist("a", TestKeys[0])
+	b := sealTestMemberlist("b", TestKeys[1], TestKeys[0])
+	c := sealTestMemberlist("c", TestKeys[0])
+
+	buf, err := a.sealUserMsg("b", []byte("secret"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if messageType(buf[0]) != sealedUserMsg {
+		t.Fatalf("bad type: %d", buf[0])
+	}
+	if bytes.Contains(buf, []byte("secret")) {
+		t.Fatalf("payload in plaintext")
+	}
+
+	// The recipient can open it with any key on its ring.
+	msg, err := b.openUserMsg(buf[1:])
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(msg) != "secret" {
+		t.Fatalf("bad: %q", msg)
+	}
+
+	// Another member can't, even with the cluster key.
+	if _, err := c.openUserMsg(buf[1:]); err == nil || !strings.Contains(err.Error(), "is for 'b'") {
+		t.Fatalf("expected misdirected error, got %v", err)
+	}
+
+	// Readdressing it doesn't help either.
+	var s sealedUser
+	if err := decode(buf[1:], &s); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	s.To = "c"
+	out, err := encode(sealedUserMsg, &s)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := c.openUserMsg(out.Bytes()[1:]); err == nil {
+		t.Fatalf("expected readdressed message to fail")
+	}
+
+	// Nor does a different cluster key.
+	d := sealTestMemberlist("b", TestKeys[2])
+	if _, err := d.openUserMsg(buf[1:]); err == nil {
+		t.Fatalf("expected wrong key to fail")
+	}
+
+	// The key depends on the direction.
+	k1, err := userSealKey(TestKeys[0], "a", "b")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	k2, err := userSealKey(TestKeys[0], "b", "a")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if bytes.Equal(k1, k2) {
+		t.Fatalf("keys should differ by direction")
+	}
+}
+
+func TestMemberlist_SendToSealed(t *testing.T) {
+	c := testConfig()
+	c.SealUserMessages = true
+	_, err := Create(c)
+	if err == nil || !strings.Contains(err.Error(), "requires a keyring") {
+		t.Fatalf("expected keyring error, got %v", err)
+	}
+
+	d1, d2 := &MockDelegate{}, &MockDelegate{}
+	c1 := testConfig()
+	c1.SecretKey = TestKeys[0]
+	c1.SealUserMessages = true
+	c1.Delegate = d1
+	m1, err := Create(c1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m1.Shutdown()
+
+	c2 := testConfig()
+	c2.BindPort = m1.config.BindPort
+	c2.SecretKey = TestKeys[0]
+	c2.SealUserMessages = true
+	c2.Delegate = d2
+	m2, err := Create(c2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer m2.Shutdown()
+
+	if _, err := m2.Join([]string{m1.config.BindAddr}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	node1 := m2.LocalNode()
+	for _, n := range m2.Members() {
+		if n.Name == c1.Name {
+			node1 = n
+		}
+	}
+	if err := m2.SendToUDP(node1, []byte("udp")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := m2.SendToTCP(node1, []byte("tcp")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for len(d1.getMessages()) < 2 && time.Now().Before(deadline) {
+		yield()
+	}
+	msgs := d1.getMessages()
+	if len(msgs) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(msgs))
+	}
+	for _, want := range []string{"udp", "tcp"} {
+		if string(msgs[0]) != want && string(msgs[1]) != want {
+			t.Fatalf("missing %q in %q", want, msgs)
+		}
+	}
+}
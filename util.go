@@ -95,7 +95,7 @@ func decode(buf []byte, out interface{}) error {
 	r := bytes.NewReader(buf)
 	hd := codec.MsgpackHandle{}
 	dec := codec.NewDecoder(r, &hd)
-	return dec.Decode(out)
+	return decodeWire(dec, out)
 }
 
 // Encode writes an encoded object to a new bytes buffer
@@ -229,7 +229,7 @@ OUTER:
 		}
 
 		// Exclude if not alive
-		if node.State != stateAlive {
+		if !node.State.active() {
 			continue
 		}
 
@@ -279,18 +279,18 @@ func decodeCompoundMessage(buf []byte) (trunc int, parts [][]byte, err error) {
 		err = fmt.Errorf("missing compound length byte")
 		return
 	}
-	numParts := uint8(buf[0])
+	numParts := int(buf[0])
 	buf = buf[1:]
 
 	// Check we have enough bytes
-	if len(buf) < int(numParts*2) {
+	if len(buf) < numParts*2 {
 		err = fmt.Errorf("truncated len slice")
 		return
 	}
 
 	// Decode the lengths
 	lengths := make([]uint16, numParts)
-	for i := 0; i < int(numParts); i++ {
+	for i := 0; i < numParts; i++ {
 		lengths[i] = binary.BigEndian.Uint16(buf[i*2 : i*2+2])
 	}
 	buf = buf[numParts*2:]
@@ -298,7 +298,7 @@ func decodeCompoundMessage(buf []byte) (trunc int, parts [][]byte, err error) {
 	// Split each message
 	for idx, msgLen := range lengths {
 		if len(buf) < int(msgLen) {
-			trunc = int(numParts) - idx
+			trunc = numParts - idx
 			return
 		}
 
@@ -310,6 +310,78 @@ func decodeCompoundMessage(buf []byte) (trunc int, parts [][]byte, err error) {
 	return
 }
 
+// maxCompoundParts is the most messages a compoundMsg can hold, since its
+// count is a single byte.
+const maxCompoundParts = 255
+
+// makeCompoundMessages packs a list of messages into compound messages for
+// a peer. Peers that understand version 5 of the protocol get a single
+// compound2Msg. Others get compoundMsgs, as many as it takes to stay within
+// the 255 message limit of that format.
+func makeCompoundMessages(msgs [][]byte, v2 bool) []*bytes.Buffer {
+	if v2 {
+		return []*bytes.Buffer{makeCompound2Message(msgs)}
+	}
+
+	bufs := make([]*bytes.Buffer, 0, (len(msgs)+maxCompoundParts-1)/maxCompoundParts)
+	for len(msgs) > maxCompoundParts {
+		bufs = append(bufs, makeCompoundMessage(msgs[:maxCompoundParts]))
+		msgs = msgs[maxCompoundParts:]
+	}
+	return append(bufs, makeCompoundMessage(msgs))
+}
+
+// makeCompound2Message is like makeCompoundMessage, but frames the count
+// and each message length as a uvarint. There's no limit on the number of
+// messages, and lengths under 128 bytes take a single byte, so a packet
+// never needs more framing than compoundHeaderOverhead and compoundOverhead
+// allow for unless it holds over 127 messages, most of them small.
+func makeCompound2Message(msgs [][]byte) *bytes.Buffer {
+	buf := bytes.NewBuffer(nil)
+	buf.WriteByte(uint8(compound2Msg))
+
+	var scratch [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], uint64(len(msgs)))
+	buf.Write(scratch[:n])
+	for _, m := range msgs {
+		n := binary.PutUvarint(scratch[:], uint64(len(m)))
+		buf.Write(scratch[:n])
+		buf.Write(m)
+	}
+	return buf
+}
+
+// decodeCompound2Message splits a compound2Msg, returning the messages, the
+// number that were truncated, and any error.
+func decodeCompound2Message(buf []byte) (trunc int, parts [][]byte, err error) {
+	numParts, n := binary.Uvarint(buf)
+	if n <= 0 {
+		err = fmt.Errorf("bad compound length")
+		return
+	}
+	buf = buf[n:]
+
+	// Every message takes at least a byte for its length, so a count any
+	// higher can't be honest, and would overflow an int.
+	if numParts > uint64(len(buf)) {
+		err = fmt.Errorf("compound length %d exceeds packet", numParts)
+		return
+	}
+	count := int(numParts)
+
+	for i := 0; i < count; i++ {
+		msgLen, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < msgLen {
+			trunc = count - i
+			return
+		}
+		buf = buf[n:]
+		parts = append(parts, buf[:msgLen])
+		buf = buf[msgLen:]
+	}
+	return
+}
+
 // Returns if the given IP is in a private block
 func IsPrivateIP(ip_str string) bool {
 	ip := net.ParseIP(ip_str)
@@ -380,12 +452,15 @@ func decompressBuffer(c *compress) ([]byte, error) {
 	uncomp := lzw.NewReader(bytes.NewReader(c.Buf), lzw.LSB, lzwLitWidth)
 	defer uncomp.Close()
 
-	// Read all the data
+	// Read all the data, but no more than we'd accept uncompressed
 	var b bytes.Buffer
-	_, err := io.Copy(&b, uncomp)
+	n, err := io.Copy(&b, io.LimitReader(uncomp, maxPushStateBytes+1))
 	if err != nil {
 		return nil, err
 	}
+	if err := checkStreamLen("decompressed payload", n); err != nil {
+		return nil, err
+	}
 
 	// Return the uncompressed bytes
 	return b.Bytes(), nil
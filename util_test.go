@@ -1,6 +1,7 @@
 package memberlist
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -391,6 +392,86 @@ func TestDecodeCompoundMessage_Trunc(t *testing.T) {
 	}
 }
 
+func TestMakeCompoundMessages(t *testing.T) {
+	msgs := make([][]byte, 600)
+	for i := range msgs {
+		msgs[i] = []byte{byte(i)}
+	}
+
+	// Older peers get the messages split over several compounds.
+	bufs := makeCompoundMessages(msgs, false)
+	if len(bufs) != 3 {
+		t.Fatalf("bad: %d", len(bufs))
+	}
+	var got [][]byte
+	for _, buf := range bufs {
+		if messageType(buf.Bytes()[0]) != compoundMsg {
+			t.Fatalf("bad type")
+		}
+		_, parts, err := decodeCompoundMessage(buf.Bytes()[1:])
+		if err != nil {
+			t.Fatalf("unexpected err: %s", err)
+		}
+		got = append(got, parts...)
+	}
+	if !reflect.DeepEqual(got, msgs) {
+		t.Fatalf("bad: %v", got)
+	}
+
+	// Newer ones get a single compound2.
+	bufs = makeCompoundMessages(msgs, true)
+	if len(bufs) != 1 || messageType(bufs[0].Bytes()[0]) != compound2Msg {
+		t.Fatalf("bad: %v", bufs)
+	}
+	trunc, parts, err := decodeCompound2Message(bufs[0].Bytes()[1:])
+	if err != nil || trunc != 0 {
+		t.Fatalf("bad: %d %v", trunc, err)
+	}
+	if !reflect.DeepEqual(parts, msgs) {
+		t.Fatalf("bad: %v", parts)
+	}
+
+	// The varint framing is smaller than the overhead we budget for.
+	if v1 := len(msgs) * (1 + compoundOverhead); bufs[0].Len() > v1+compoundHeaderOverhead {
+		t.Fatalf("bad: %d > %d", bufs[0].Len(), v1+compoundHeaderOverhead)
+	}
+}
+
+func TestDecodeCompound2Message_Trunc(t *testing.T) {
+	msg := &ping{SeqNo: 100}
+	buf, err := encode(pingMsg, msg)
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+
+	msgs := [][]byte{buf.Bytes(), buf.Bytes(), buf.Bytes()}
+	compound := makeCompound2Message(msgs)
+
+	trunc, parts, err := decodeCompound2Message(compound.Bytes()[1 : compound.Len()-1])
+	if err != nil {
+		t.Fatalf("unexpected err: %s", err)
+	}
+	if trunc != 1 || len(parts) != 2 {
+		t.Fatalf("bad: %d %d", trunc, len(parts))
+	}
+	for _, p := range parts {
+		if len(p) != buf.Len() {
+			t.Fatalf("bad part len")
+		}
+	}
+
+	if _, _, err := decodeCompound2Message(nil); err == nil {
+		t.Fatalf("should fail")
+	}
+
+	// A count of more messages than there are bytes is refused.
+	huge := make([]byte, binary.MaxVarintLen64+3)
+	n := binary.PutUvarint(huge, ^uint64(0))
+	if _, _, err := decodeCompound2Message(huge[:n+3]); err == nil {
+		t.Fatalf("should fail")
+	}
+}
+
 func TestCompressDecompressPayload(t *testing.T) {
 	buf, err := compressPayload([]byte("testing"))
 	if err != nil {
@@ -0,0 +1,66 @@
+package memberlist
+
+import (
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+/*
+Wire structs are encoded as msgpack maps keyed by field name, which is
+what lets nodes of different versions talk: a decoder skips keys it
+doesn't know and leaves fields that weren't sent at their zero value. The
+rules below keep that working as the protocol grows.
+
+Every field carries an explicit codec tag naming it on the wire, so that
+renaming a Go field can't silently change the protocol. A wire name is
+never reused for a different type, and a field that's no longer needed
+keeps its tag so the name stays reserved.
+
+Fields added after a message was first defined are tagged omitempty and
+must mean the old behaviour when zero, since that's how older senders'
+messages decode. Where zero isn't enough, the struct implements
+wireUpgrader to fill in what the sender left out, or trim what a newer
+sender added, before anything else sees it.
+
+The golden files in testdata/wire hold each message as it was first
+encoded, and the tests check that they still decode, so a change that
+would break older nodes fails there first.
+*/
+
+// vsnLen is the number of entries in a version array: pmin, pmax, pcur,
+// dmin, dmax, dcur.
+const vsnLen = 6
+
+// wireUpgrader is implemented by wire structs that need more than zero
+// values for fields an older sender left out.
+type wireUpgrader interface {
+	upgrade()
+}
+
+// decodeWire decodes the next wire struct from a stream and upgrades it.
+func decodeWire(dec *codec.Decoder, out interface{}) error {
+	if err := dec.Decode(out); err != nil {
+		return err
+	}
+	if u, ok := out.(wireUpgrader); ok {
+		u.upgrade()
+	}
+	return nil
+}
+
+// upgradeVsn returns a version array with exactly vsnLen entries, so that
+// it can be indexed safely. Missing entries are zero, which no version
+// range accepts, and entries a newer sender appended are dropped. An empty
+// array stays empty, since that's how the oldest versions say they don't
+// send one.
+func upgradeVsn(vsn []uint8) []uint8 {
+	if len(vsn) == 0 || len(vsn) == vsnLen {
+		return vsn
+	}
+	out := make([]uint8, vsnLen)
+	copy(out, vsn)
+	return out
+}
+
+func (a *alive) upgrade()          { a.Vsn = upgradeVsn(a.Vsn) }
+func (h *pushPullHeader) upgrade() { h.Vsn = upgradeVsn(h.Vsn) }
+func (s *pushNodeState) upgrade()  { s.Vsn = upgradeVsn(s.Vsn) }
@@ -0,0 +1,220 @@
+package memberlist
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/go-msgpack/codec"
+)
+
+var updateWire = flag.Bool("update-wire", false, "write missing wire golden files")
+
+// wireCases holds a sample of every wire struct, with every field set so
+// that renaming or dropping one shows up.
+var wireCases = []struct {
+	name string
+	msg  interface{}
+}{
+	{"ping", &ping{SeqNo: 1, Node: "a", SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7946, SourceNode: "b"}},
+	{"indirect_ping", &indirectPingReq{SeqNo: 1, Target: []byte{127, 0, 0, 2}, Port: 7946, Node: "a", Nack: true, SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7947}},
+	{"indirect_ping_tcp", &indirectPingReq{SeqNo: 1, Target: []byte{127, 0, 0, 2}, Port: 7946, Node: "a", Nack: true, SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7947, TCP: true}},
+	{"ping_pad", &ping{SeqNo: 1, Node: "a", SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7946, SourceNode: "b", Pad: []byte("pad")}},
+	{"ping_introduce", &ping{SeqNo: 1, Node: "a", SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7946, SourceNode: "b", Introduce: true}},
+	{"ping_fetch_payload", &ping{SeqNo: 1, Node: "a", SourceAddr: []byte{127, 0, 0, 1}, SourcePort: 7946, SourceNode: "b", FetchPayload: true}},
+	{"ack", &ackResp{SeqNo: 1, Payload: []byte("payload")}},
+	{"ack_payload_len", &ackResp{SeqNo: 1, Payload: []byte("payload"), PayloadLen: 2000}},
+	{"nack", &nackResp{SeqNo: 1}},
+	{"nack_reason", &nackResp{SeqNo: 1, Reason: nackUnreachable}},
+	{"suspect", &suspect{Incarnation: 2, Node: "a", From: "b", Origin: "c", Hops: 3}},
+	{"alive", &alive{Incarnation: 2, Node: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, Meta: []byte("meta"), Vsn: []uint8{1, 4, 2, 0, 1, 0}, Origin: "c", Hops: 3, Paused: true, Maintenance: true}},
+	{"alive_meta_time", &alive{Incarnation: 2, Node: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, Meta: []byte("meta"), Vsn: []uint8{1, 4, 2, 0, 1, 0}, MetaTime: 1000}},
+	{"alive_moved", &alive{Incarnation: 2, Node: "a", Addr: []byte{127, 0, 0, 1}, Port: 7947, Meta: []byte("meta"), Vsn: []uint8{1, 4, 2, 0, 1, 0}, Moved: true}},
+	{"dead", &dead{Incarnation: 2, Node: "a", From: "b", Origin: "c", Hops: 3}},
+	{"dead_ack", &dead{Incarnation: 2, Node: "a", From: "a", Ack: true}},
+	{"push_pull_header", &pushPullHeader{Nodes: 2, UserStateLen: 5, Join: true, Node: "a", Vsn: []uint8{1, 4, 2, 0, 1, 0}}},
+	{"push_node_state", &pushNodeState{Name: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, Meta: []byte("meta"), Incarnation: 2, State: stateSuspect, Vsn: []uint8{1, 4, 2, 0, 1, 0}}},
+	{"push_node_state_meta_time", &pushNodeState{Name: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, Meta: []byte("meta"), Incarnation: 2, State: stateAlive, Vsn: []uint8{1, 4, 2, 0, 1, 0}, MetaTime: 1000}},
+	{"push_node_state_moved", &pushNodeState{Name: "a", Addr: []byte{127, 0, 0, 1}, Port: 7947, Meta: []byte("meta"), Incarnation: 2, State: stateAlive, Vsn: []uint8{1, 4, 2, 0, 1, 0}, Moved: true}},
+	{"merge_reject", &mergeReject{Reason: "reason"}},
+	{"merge_reject_retry", &mergeReject{Reason: "reason", RetryAfter: 1000}},
+	{"salt_resp", &saltResp{KDF: "$argon2id$v=19$m=65536,t=3,p=4$c2FsdA"}},
+	{"user_msg_header", &userMsgHeader{UserMsgLen: 5}},
+	{"compress", &compress{Algo: lzwAlgo, Buf: []byte("buf")}},
+	{"ban", &ban{Node: "a", Issued: 1000, TTL: 2000, From: "b"}},
+	{"content_announce", &contentAnnounce{ID: []byte{1, 2, 3}, Size: 3, Holder: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946}},
+	{"content_pull", &contentPull{ID: []byte{1, 2, 3}}},
+	{"content_resp", &contentResp{Error: "error", Body: []byte("body")}},
+	{"marker", &marker{ID: "id", Origin: "a", Sent: 1000, Hops: 3}},
+	{"marker_receipt", &markerReceipt{ID: "id", Node: "a", Hops: 3, Latency: 2000}},
+	{"query_resp", &queryResp{Error: "error"}},
+	{"sealed_user", &sealedUser{From: "a", To: "b", Payload: []byte("payload")}},
+	{"disconnect", &disconnect{Node: "a"}},
+	{"tree_gossip", &treeGossip{Origin: "a", Seq: 1, Hops: 2, From: "b", Payload: []byte("payload")}},
+	{"tree_ihave", &treeIHave{Origin: "a", Seq: 1, From: "b"}},
+	{"tree_graft", &treeGraft{Origin: "a", Seq: 1, From: "b"}},
+	{"tree_prune", &treePrune{From: "a"}},
+	{"replay_req", &replayReq{Origin: "a", First: 1, Last: 2}},
+	{"replay_resp", &replayResp{Error: "error", Msgs: []replayMsg{{Seq: 1, Msg: []byte("msg")}}}},
+	{"leave_ack", &leaveAck{Node: "a", From: "b"}},
+	{"ack_payload_req", &ackPayloadReq{Node: "a", SeqNo: 1}},
+	{"ack_payload_resp", &ackPayloadResp{Error: "error", Payload: []byte("payload")}},
+	{"health_advisory", &healthAdvisory{Node: "a", Reason: "reason", Issued: 1000, TTL: 2000, From: "b"}},
+}
+
+func encodeWire(t *testing.T, msg interface{}) []byte {
+	t.Helper()
+	buf, err := encode(0, msg)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return buf.Bytes()[1:]
+}
+
+// wireKeys returns the keys of an encoded wire struct.
+func wireKeys(t *testing.T, buf []byte) []string {
+	t.Helper()
+	var fields map[string]interface{}
+	if err := decode(buf, &fields); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var keys []string
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestWire_Golden(t *testing.T) {
+	for _, tc := range wireCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join("testdata", "wire", tc.name+".golden")
+			current := encodeWire(t, tc.msg)
+
+			raw, err := ioutil.ReadFile(path)
+			if err != nil && *updateWire {
+				// Golden files are only ever added, never rewritten,
+				// since they stand in for what older nodes send.
+				out := hex.EncodeToString(current) + "\n"
+				if err := ioutil.WriteFile(path, []byte(out), 0644); err != nil {
+					t.Fatalf("err: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			golden, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+
+			// The old encoding still decodes to the same message.
+			out := reflect.New(reflect.TypeOf(tc.msg).Elem()).Interface()
+			if err := decode(golden, out); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if !reflect.DeepEqual(out, tc.msg) {
+				t.Fatalf("bad: %#v", out)
+			}
+
+			// Every field the old encoding has is still sent.
+			have := make(map[string]bool)
+			for _, k := range wireKeys(t, current) {
+				have[k] = true
+			}
+			for _, k := range wireKeys(t, golden) {
+				if !have[k] {
+					t.Fatalf("field %q is no longer sent", k)
+				}
+			}
+		})
+	}
+}
+
+func TestWire_Tags(t *testing.T) {
+	for _, tc := range wireCases {
+		typ := reflect.TypeOf(tc.msg).Elem()
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			tag := f.Tag.Get("codec")
+			if name := strings.Split(tag, ",")[0]; name != f.Name {
+				t.Fatalf("%s.%s has wire name %q", typ.Name(), f.Name, name)
+			}
+		}
+	}
+}
+
+func TestWire_UnknownFields(t *testing.T) {
+	in := &alive{Incarnation: 2, Node: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946, Vsn: []uint8{1, 4, 2, 0, 1, 0}}
+
+	// Add fields from a future version to the encoding.
+	var fields map[string]interface{}
+	if err := decode(encodeWire(t, in), &fields); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fields["Future"] = "value"
+	fields["FutureList"] = []interface{}{1, 2, 3}
+	var out alive
+	if err := decode(encodeWire(t, fields), &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(&out, in) {
+		t.Fatalf("bad: %#v", out)
+	}
+}
+
+func TestWire_MissingFields(t *testing.T) {
+	// An alive from before versions or any optional fields were sent.
+	type aliveV0 struct {
+		Incarnation uint32
+		Node        string
+		Addr        []byte
+		Port        uint16
+		Meta        []byte
+	}
+	var out alive
+	old := aliveV0{Incarnation: 2, Node: "a", Addr: []byte{127, 0, 0, 1}, Port: 7946}
+	if err := decode(encodeWire(t, &old), &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if out.Node != "a" || out.Port != 7946 || out.Vsn != nil || out.Paused || out.Hops != 0 {
+		t.Fatalf("bad: %#v", out)
+	}
+
+	// Versions that are short or long are made the usual length.
+	for _, vsn := range [][]uint8{{1, 4, 2}, {1, 4, 2, 0, 1, 0, 9}} {
+		var out alive
+		if err := decode(encodeWire(t, &alive{Node: "a", Vsn: vsn}), &out); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if len(out.Vsn) != vsnLen || !bytes.Equal(out.Vsn[:3], []uint8{1, 4, 2}) {
+			t.Fatalf("bad: %v", out.Vsn)
+		}
+	}
+}
+
+func TestWire_DecodeStream(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	hd := codec.MsgpackHandle{}
+	enc := codec.NewEncoder(buf, &hd)
+	if err := enc.Encode(&pushNodeState{Name: "a", Vsn: []uint8{1, 4}}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	var state pushNodeState
+	if err := decodeWire(codec.NewDecoder(buf, &hd), &state); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := state.node(); n.PMax != 4 || n.DCur != 0 {
+		t.Fatalf("bad: %#v", n)
+	}
+}